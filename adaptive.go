@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adaptiveCheckInterval is the time between two adjustments of the adaptive CPU limits
+const adaptiveCheckInterval = 5 * time.Second
+
+// adaptiveCpu is a CPU limit adjusted to keep the utilization of the host under a target,
+// between 1% of one core and the limit of the jail
+type adaptiveCpu struct {
+	TargetPercent int `json:"target_percent"` // Host utilization kept under, in percent of all cores
+	Applied       int `json:"applied"`        // Percent of one core written to the cgroup last
+
+	previousTicks uint64       // CPU time of the tree at the previous adjustment
+	previousHost  hostCPUTimes // CPU time of the host at the previous adjustment
+	sampledAt     time.Time
+}
+
+// hostCPUTimes is the CPU time of the host in clock ticks, from /proc/stat
+type hostCPUTimes struct {
+	Busy  uint64
+	Total uint64
+}
+
+// parseAdaptiveTarget parses the --adaptive flag, the host utilization to stay under such as 70%
+func parseAdaptiveTarget(value string) (int, error) {
+	target, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil || target < 1 || target > 99 {
+		return 0, fmt.Errorf("invalid --adaptive target %q (expected the host utilization to stay under, 1%% to 99%%)", value)
+	}
+	return target, nil
+}
+
+// readHostCPUTimes reads the busy and total CPU time of the host, iowait counts as idle
+func readHostCPUTimes() (hostCPUTimes, error) {
+	content, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return hostCPUTimes{}, err
+	}
+	line, _, _ := strings.Cut(string(content), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 6 || fields[0] != "cpu" {
+		return hostCPUTimes{}, fmt.Errorf("unexpected /proc/stat: %s", line)
+	}
+	var times hostCPUTimes
+	// guest time is already counted in user and nice
+	for i, field := range fields[1:min(len(fields), 9)] {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return hostCPUTimes{}, fmt.Errorf("unexpected /proc/stat: %s", line)
+		}
+		times.Total += value
+		if i != 3 && i != 4 {
+			times.Busy += value
+		}
+	}
+	return times, nil
+}
+
+// adaptCpuPercent returns the next CPU limit of an adaptive jail: the usage of the tree
+// plus the headroom left under the target, or minus the excess over it. It moves halfway
+// there to damp the oscillations, between 1% and the ceiling
+func adaptCpuPercent(applied, ceiling, target int, hostPercent, jailPercent float64, cores int) int {
+	desired := jailPercent + (float64(target)-hostPercent)*float64(cores)
+	next := int(math.Round((float64(applied) + desired) / 2))
+	return min(max(next, 1), ceiling)
+}
+
+// adaptJails adjusts the CPU limit of the adaptive jails to the utilization of the host
+// since the previous adjustment
+func adaptJails(state *JailerState) {
+	host, err := readHostCPUTimes()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	for pid, jail := range state.ActiveJails {
+		adaptive := jail.Adaptive
+		if adaptive == nil || !jail.usesDedicatedCgroup() {
+			continue
+		}
+		var ticks uint64
+		for _, treePid := range append([]int{pid}, jail.Children...) {
+			if processTicks, err := getProcessCPUTicks(treePid); err == nil {
+				ticks += processTicks
+			}
+		}
+
+		previous, previousTicks, sampledAt := adaptive.previousHost, adaptive.previousTicks, adaptive.sampledAt
+		adaptive.previousHost, adaptive.previousTicks, adaptive.sampledAt = host, ticks, now
+		elapsed := now.Sub(sampledAt).Seconds()
+		if sampledAt.IsZero() || host.Total <= previous.Total || ticks < previousTicks || elapsed <= 0 {
+			continue
+		}
+		hostPercent := float64(host.Busy-previous.Busy) / float64(host.Total-previous.Total) * 100
+		jailPercent := float64(ticks-previousTicks) / clockTicksPerSecond / elapsed * 100
+
+		next := adaptCpuPercent(adaptive.Applied, jail.CpuPercent, adaptive.TargetPercent, hostPercent, jailPercent, runtime.NumCPU())
+		if next == adaptive.Applied {
+			continue
+		}
+		previousApplied := adaptive.Applied
+		adaptive.Applied = next
+		if err := state.Limits.updateCpuLimit(jail); err != nil {
+			adaptive.Applied = previousApplied
+			fmt.Printf("Warning: failed to adapt the CPU limit of process %d: %v\n", pid, err)
+		}
+	}
+}
+
+// runAdaptiveMonitor adjusts the adaptive CPU limits until jailer exits
+func runAdaptiveMonitor(state *JailerState) {
+	for range time.Tick(adaptiveCheckInterval) {
+		adaptJails(state)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	agentMinReconnectDelay = time.Second
+	agentMaxReconnectDelay = time.Minute
+)
+
+// remoteUnavailableCommands can't be run by a controller, they need a terminal or stop
+// the agent
+var remoteUnavailableCommands = []string{"watch", "top", "pick", "capture", "simulate", "exit", "quit"}
+
+// runAgent connects out to the controller and serves its commands, the connection is
+// established again with a growing delay whenever it is lost
+func runAgent(state *JailerState, controllerAddr, host string) {
+	delay := agentMinReconnectDelay
+	for {
+		established, err := connectAgent(state, controllerAddr, host)
+		if established {
+			delay = agentMinReconnectDelay
+		}
+		fmt.Printf("Warning: connection to controller %s lost: %v, retrying in %s\n", controllerAddr, err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, agentMaxReconnectDelay)
+	}
+}
+
+// connectAgent serves the controller over a single connection until it is lost
+func connectAgent(state *JailerState, controllerAddr, host string) (bool, error) {
+	conn, err := remoteDial(state.Config, controllerAddr)
+	if err != nil {
+		return false, err
+	}
+	rc := newRemoteConn(conn)
+	defer rc.close()
+
+	if _, err := rc.handshake("agent", host, state.Config.RemoteToken); err != nil {
+		return false, err
+	}
+	fmt.Printf("Connected to controller %s as %s\n", controllerAddr, host)
+	return true, serveController(state, rc)
+}
+
+// runAgentListener accepts the connections of controllers and serves their commands
+func runAgentListener(state *JailerState, addr, host string) error {
+	listener, err := remoteListen(state.Config, addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	fmt.Printf("Agent %s waiting for controllers on %s\n", host, listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept controller connection: %v", err)
+		}
+		go func() {
+			rc := newRemoteConn(conn)
+			defer rc.close()
+
+			if _, err := rc.handshake("agent", host, state.Config.RemoteToken); err != nil {
+				fmt.Printf("Warning: rejected controller %s: %v\n", conn.RemoteAddr(), err)
+				return
+			}
+			fmt.Printf("Controller %s connected\n", conn.RemoteAddr())
+			err := serveController(state, rc)
+			fmt.Printf("Controller %s disconnected: %v\n", conn.RemoteAddr(), err)
+		}()
+	}
+}
+
+// serveController runs the commands of an authenticated controller and reports the
+// number of active jails periodically
+func serveController(state *JailerState, rc *remoteConn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(remoteStatusInterval)
+		defer ticker.Stop()
+		for {
+			if err := rc.send(remoteMessage{Type: "status", Jails: countActiveJails(state)}); err != nil {
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	for {
+		message, err := rc.receive()
+		if err != nil {
+			return err
+		}
+		if message.Type != "command" {
+			continue
+		}
+
+		fmt.Printf("Controller %s: %s\n", rc.conn.RemoteAddr(), message.Command)
+		var output bytes.Buffer
+		err = executeRemoteCommand(state, message.Command, remoteOperator(rc, message.Operator), &output)
+
+		result := remoteMessage{Type: "result", ID: message.ID, Output: output.String(), Jails: countActiveJails(state)}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if err := rc.send(result); err != nil {
+			return err
+		}
+	}
+}
+
+// remoteOperator describes who sent a command through a controller, the user reported by
+// the controller comes with the identity it authenticated with
+func remoteOperator(rc *remoteConn, operator string) string {
+	controller := fmt.Sprintf("controller %s", rc.peerName())
+	if address := rc.conn.RemoteAddr().String(); address != rc.peerName() {
+		controller += fmt.Sprintf(" (%s)", address)
+	}
+	if operator == "" {
+		return controller
+	}
+	return operator + " via " + controller
+}
+
+// countActiveJails returns the number of jails whose process still exists
+func countActiveJails(state *JailerState) int {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	count := 0
+	for pid := range state.ActiveJails {
+		if hostProcesses.exists(pid) {
+			count++
+		}
+	}
+	return count
+}
+
+// executeRemoteCommand executes a command line received from a controller on behalf of
+// operator, its output is written to output instead of stdout
+func executeRemoteCommand(state *JailerState, input, operator string, output io.Writer) error {
+	commands, err := splitCommands(input)
+	if err != nil {
+		return err
+	}
+	for _, parts := range commands {
+		for _, unavailable := range remoteUnavailableCommands {
+			if strings.ToLower(parts[0]) == unavailable {
+				return fmt.Errorf("%s is not available remotely", parts[0])
+			}
+		}
+	}
+	return executeLockedAs(state, input, operator, output)
+}
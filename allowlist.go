@@ -0,0 +1,184 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// allowSetNames returns the names of the IPv4 and IPv6 allowlist sets of a jail
+func allowSetNames(pid int) (string, string) {
+	return fmt.Sprintf("allow4_%d", pid), fmt.Sprintf("allow6_%d", pid)
+}
+
+// allowedAddressFamily checks an address or network of an allowlist and returns its nft
+// family, ip or ip6
+func allowedAddressFamily(value string) (string, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(value); err != nil {
+			return "", fmt.Errorf("invalid address or network: %q", value)
+		}
+	}
+	if ip.To4() != nil {
+		return "ip", nil
+	}
+	return "ip6", nil
+}
+
+// nftSetElementsPattern finds the elements in the listing of a named set
+var nftSetElementsPattern = regexp.MustCompile(`(?s)elements = \{(.*?)\}`)
+
+// parseNftSetElements returns the elements of a named set listed by nft list set
+func parseNftSetElements(listing string) []string {
+	match := nftSetElementsPattern.FindStringSubmatch(listing)
+	if match == nil {
+		return nil
+	}
+	var elements []string
+	for _, element := range strings.Split(match[1], ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// runNft runs an nft command of the allowlists
+func runNft(args ...string) (string, error) {
+	output, err := runFirewallCommand(append([]string{"nft"}, args...)...)
+	if err != nil {
+		return "", fmt.Errorf("nft %s failed: %v\nOutput: %s", strings.Join(args, " "), err, string(output))
+	}
+	return string(output), nil
+}
+
+// setupAllowlist creates the sets of a jail and inserts the rules accepting their
+// addresses ahead of the drop rules
+func setupAllowlist(state *JailerState, jail *Jail) error {
+	set4, set6 := allowSetNames(jail.PID)
+	if _, err := runNft("add", "set", "inet", "jail", set4, "{ type ipv4_addr; flags interval; }"); err != nil {
+		return err
+	}
+	if _, err := runNft("add", "set", "inet", "jail", set6, "{ type ipv6_addr; flags interval; }"); err != nil {
+		releaseAllowlist(state, jail)
+		return err
+	}
+
+	match := jailNetworkMatch(state, jail)
+	for _, rule := range []struct{ chain, family, address, set string }{
+		{"output", "ip", "daddr", set4}, {"output", "ip6", "daddr", set6},
+		{"input", "ip", "saddr", set4}, {"input", "ip6", "saddr", set6},
+	} {
+		spec := append(append([]string{}, match...), rule.family, rule.address, "@"+rule.set, "accept")
+		inserted, err := insertFirewallRule(state, rule.chain, spec)
+		if err != nil {
+			releaseAllowlist(state, jail)
+			return err
+		}
+		jail.AllowRules = append(jail.AllowRules, inserted)
+	}
+	return nil
+}
+
+// releaseAllowlist removes the rules and the sets of the allowlist of a jail
+func releaseAllowlist(state *JailerState, jail *Jail) {
+	if state.FirewallTool != "nftables" {
+		return
+	}
+	deleteFirewallRules(state, jail.AllowRules)
+	jail.AllowRules = nil
+	set4, set6 := allowSetNames(jail.PID)
+	for _, set := range []string{set4, set6} {
+		// The sets are missing when the allowlist was never used
+		if _, err := runNft("list", "set", "inet", "jail", set); err != nil {
+			continue
+		}
+		if _, err := runNft("delete", "set", "inet", "jail", set); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: failed to remove allowlist set %s: %v\n", set, err)
+		}
+	}
+}
+
+// allowlistJail returns the network jail of a process whose allowlist can be managed
+func allowlistJail(state *JailerState, pid int) (*Jail, error) {
+	jail, exists := state.ActiveJails[pid]
+	if !exists || !jail.HasJailType("network") {
+		return nil, fmt.Errorf("process %d is not jailed with network jail", pid)
+	}
+	if state.FirewallTool != "nftables" {
+		return nil, fmt.Errorf("allowlists use nftables named sets, not available with %s", state.FirewallTool)
+	}
+	return jail, nil
+}
+
+// changeAllowlist adds addresses to the allowlist of a network jail or deletes them, each
+// change is a single nft transaction applied without touching the rules
+func changeAllowlist(state *JailerState, pid int, action string, addresses []string) error {
+	jail, err := allowlistJail(state, pid)
+	if err != nil {
+		return err
+	}
+
+	elements := make(map[string][]string)
+	for _, address := range addresses {
+		family, err := allowedAddressFamily(address)
+		if err != nil {
+			return err
+		}
+		elements[family] = append(elements[family], address)
+	}
+	if action == "add" && len(jail.AllowRules) == 0 {
+		if err := setupAllowlist(state, jail); err != nil {
+			return fmt.Errorf("failed to create allowlist of process %d: %v", pid, err)
+		}
+	} else if action == "del" && len(jail.AllowRules) == 0 {
+		return fmt.Errorf("allowlist of process %d is empty", pid)
+	}
+
+	nftAction := map[string]string{"add": "add", "del": "delete"}[action]
+	set4, set6 := allowSetNames(pid)
+	for family, set := range map[string]string{"ip": set4, "ip6": set6} {
+		if len(elements[family]) == 0 {
+			continue
+		}
+		if _, err := runNft(nftAction, "element", "inet", "jail", set, "{ "+strings.Join(elements[family], ", ")+" }"); err != nil {
+			return err
+		}
+	}
+
+	verb := map[string]string{"add": "Allowed", "del": "Removed from the allowlist"}[action]
+	fmt.Fprintf(state.stdout(), "%s for process %d (%s): %s\n", verb, pid, hostProcesses.name(pid), strings.Join(addresses, ", "))
+	return nil
+}
+
+// showAllowlist prints the addresses in the allowlist of a network jail
+func showAllowlist(state *JailerState, pid int) error {
+	jail, err := allowlistJail(state, pid)
+	if err != nil {
+		return err
+	}
+	if len(jail.AllowRules) == 0 {
+		fmt.Fprintf(state.stdout(), "Allowlist of process %d is empty\n", pid)
+		return nil
+	}
+
+	var addresses []string
+	set4, set6 := allowSetNames(pid)
+	for _, set := range []string{set4, set6} {
+		listing, err := runNft("list", "set", "inet", "jail", set)
+		if err != nil {
+			return err
+		}
+		addresses = append(addresses, parseNftSetElements(listing)...)
+	}
+	fmt.Fprintf(state.stdout(), "Allowlist of process %d (%s): %d entries\n", pid, hostProcesses.name(pid), len(addresses))
+	for _, address := range addresses {
+		fmt.Fprintf(state.stdout(), "  %s\n", address)
+	}
+	return nil
+}
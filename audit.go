@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultAuditLogPath is where audit events go unless the configuration says otherwise
+const defaultAuditLogPath = "/var/log/jailer/audit.log"
+
+// AuditEvent records a jail action performed by an operator, one JSON object per line
+type AuditEvent struct {
+	Time      time.Time     `json:"time"`
+	Action    string        `json:"action"`   // "jail", "unjail", "run", "mark" or "restore"
+	Operator  string        `json:"operator"` // Who performed the action, see localOperator
+	JailTypes []string      `json:"jail_types,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+	Targets   []AuditTarget `json:"targets"`
+}
+
+// AuditTarget is the outcome of an action for one process
+type AuditTarget struct {
+	PID     int    `json:"pid"`
+	Name    string `json:"name,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// newAuditTarget creates the audit outcome of an action on a process
+func newAuditTarget(pid int, name string, err error) AuditTarget {
+	target := AuditTarget{PID: pid, Name: name, Success: err == nil}
+	if err != nil {
+		target.Error = err.Error()
+	}
+	return target
+}
+
+// localOperator describes who runs jailer: the login user, which sudo doesn't change,
+// the effective user when it differs and the client address of an SSH session
+func localOperator() string {
+	effective := "?"
+	if current, err := user.Current(); err == nil {
+		effective = current.Username
+	}
+
+	operator := effective
+	if content, err := os.ReadFile("/proc/self/loginuid"); err == nil {
+		uid := strings.TrimSpace(string(content))
+		// 4294967295 means no login session, e.g. a service
+		if uid != "4294967295" {
+			if login, err := user.LookupId(uid); err == nil {
+				operator = login.Username
+			}
+		}
+	} else if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		operator = sudoUser
+	}
+	if operator != effective {
+		operator += " as " + effective
+	}
+
+	if client := sshClientAddress(os.Getpid()); client != "" {
+		operator += " via ssh from " + client
+	}
+	return operator
+}
+
+// sshClientAddress returns the client address of the SSH session a process belongs to,
+// sudo clears SSH_CONNECTION so the environment of the ancestors is searched
+func sshClientAddress(pid int) string {
+	for pid > 1 {
+		if content, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/environ"); err == nil {
+			for _, variable := range bytes.Split(content, []byte{0}) {
+				value, found := strings.CutPrefix(string(variable), "SSH_CONNECTION=")
+				if found && value != "" {
+					return strings.Fields(value)[0]
+				}
+			}
+		}
+		parent, err := hostProcesses.parent(pid)
+		if err != nil {
+			return ""
+		}
+		pid = parent
+	}
+	return ""
+}
+
+// writeAuditEvent appends an event to the audit log, failures are only reported since
+// the action itself already happened
+func writeAuditEvent(state *JailerState, event AuditEvent) {
+	path := state.Config.AuditLog
+	if path == "" || path == "off" {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Operator == "" {
+		event.Operator = state.Operator
+	}
+
+	if err := state.Store.appendAuditEvent(event); err != nil {
+		fmt.Printf("Warning: failed to write audit event: %v\n", err)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultAuditEventsSocket is the socket of the af_unix plugin of audisp
+	defaultAuditEventsSocket = "/var/run/audispd_events"
+
+	// auditEventFlushDelay ends an event whose records stopped arriving without an EOE record
+	auditEventFlushDelay = 200 * time.Millisecond
+)
+
+// AuditRule jails the process of the audit events matching it
+type AuditRule struct {
+	Name   string            `json:"name"`
+	Match  map[string]string `json:"match"`  // Record fields and their patterns, * matches anything
+	Jail   string            `json:"jail"`   // Jail type applied to the pid of the event
+	Args   []string          `json:"args"`   // Arguments of the jail type, e.g. ["5%"] for cpu
+	Reason string            `json:"reason"` // Recorded with the jail, the rule name by default
+
+	patterns map[string]*regexp.Regexp
+}
+
+// auditRecord is a record of an audit event, e.g. type=SYSCALL msg=audit(...): pid=...
+type auditRecord map[string]string
+
+// auditEncodedFields hold untrusted strings, which auditd hex-encodes instead of quoting
+// when they contain spaces or special characters. The arguments are only strings in
+// EXECVE records, SYSCALL records have the raw registers
+var (
+	auditEncodedFields   = regexp.MustCompile(`^(exe|comm|name|cwd|proctitle)$`)
+	auditExecveArguments = regexp.MustCompile(`^a[0-9]+$`)
+)
+
+// compileAuditRule validates a rule and compiles its patterns, syscall names are turned
+// into the numbers found in raw records
+func compileAuditRule(rule *AuditRule) error {
+	if len(rule.Match) == 0 {
+		return fmt.Errorf("no fields to match")
+	}
+	jailType, err := normalizeJailSpec(rule.Jail)
+	if err != nil {
+		return err
+	}
+	rule.Jail = jailType
+
+	rule.patterns = make(map[string]*regexp.Regexp, len(rule.Match))
+	for field, pattern := range rule.Match {
+		if field == "syscall" {
+			if number, found := auditSyscallNumber(pattern); found {
+				pattern = strconv.Itoa(int(number))
+			}
+		}
+		rule.patterns[field] = compileWildcard(pattern)
+	}
+	return nil
+}
+
+// compileWildcard compiles a pattern of rules where * matches any characters, / included
+func compileWildcard(pattern string) *regexp.Regexp {
+	quoted := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+	return regexp.MustCompile("^" + quoted + "$")
+}
+
+// matches reports whether one record of an event has all the fields of the rule
+func (rule *AuditRule) matches(event []auditRecord) bool {
+	for _, record := range event {
+		matched := true
+		for field, pattern := range rule.patterns {
+			value, found := record[field]
+			if !found || !pattern.MatchString(value) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuditRecord parses a raw audit record, it returns the serial number of its event
+func parseAuditRecord(line string) (auditRecord, string, error) {
+	record := make(auditRecord)
+	header, body, found := strings.Cut(line, "): ")
+	if !found {
+		// EOE records have no body
+		header = strings.TrimSuffix(line, ")")
+	}
+	stamp := strings.Index(header, "msg=audit(")
+	if stamp < 0 || !strings.HasPrefix(line, "type=") {
+		return nil, "", fmt.Errorf("not an audit record: %q", line)
+	}
+	record["type"] = strings.TrimSpace(strings.TrimPrefix(header[:stamp], "type="))
+	_, serial, _ := strings.Cut(header[stamp+len("msg=audit("):], ":")
+
+	for body != "" {
+		body = strings.TrimLeft(body, " ")
+		key, rest, found := strings.Cut(body, "=")
+		if !found {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return nil, "", fmt.Errorf("unterminated value of %s in %q", key, line)
+			}
+			value, body = rest[1:end+1], rest[end+2:]
+		} else {
+			value, body, _ = strings.Cut(rest, " ")
+			if auditEncodedFields.MatchString(key) || (record["type"] == "EXECVE" && auditExecveArguments.MatchString(key)) {
+				if decoded, err := hex.DecodeString(value); err == nil {
+					value = string(decoded)
+				}
+			}
+		}
+		// The enriched format adds the translated fields after a 0x1d separator
+		key = strings.TrimPrefix(key, "\x1d")
+		if _, exists := record[key]; !exists {
+			record[key] = value
+		}
+	}
+	return record, serial, nil
+}
+
+// openAuditEvents connects to the audisp socket, "-" reads the records from the
+// standard input when jailer is itself an audisp plugin
+func openAuditEvents(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to audit events socket %s: %v", path, err)
+	}
+	return conn, nil
+}
+
+// runAuditResponder jails the processes of the audit events matching the configured rules,
+// the socket is connected again with a growing delay whenever it is lost
+func runAuditResponder(state *JailerState, path string) {
+	if len(state.Config.AuditRules) == 0 {
+		fmt.Println("Warning: no audit_rules configured, audit events are only read")
+	}
+	delay := agentMinReconnectDelay
+	for {
+		events, err := openAuditEvents(path)
+		if err == nil {
+			fmt.Printf("Reading audit events from %s with %d rules\n", path, len(state.Config.AuditRules))
+			delay = agentMinReconnectDelay
+			err = consumeAuditEvents(state, events)
+			events.Close()
+		}
+		if path == "-" {
+			fmt.Printf("Audit events ended: %v\n", err)
+			return
+		}
+		fmt.Printf("Warning: audit events from %s lost: %v, retrying in %s\n", path, err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, agentMaxReconnectDelay)
+	}
+}
+
+// consumeAuditEvents groups the records of the stream into events and applies the rules
+// to each of them
+func consumeAuditEvents(state *JailerState, events io.Reader) error {
+	lines := make(chan string)
+	failure := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(events)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		err := scanner.Err()
+		if err == nil {
+			err = io.EOF
+		}
+		failure <- err
+	}()
+
+	var event []auditRecord
+	serial := ""
+	flush := func() {
+		if len(event) > 0 {
+			applyAuditRules(state, event, serial)
+		}
+		event, serial = nil, ""
+	}
+	for {
+		select {
+		case line := <-lines:
+			record, recordSerial, err := parseAuditRecord(strings.TrimSpace(line))
+			if err != nil {
+				continue
+			}
+			if recordSerial != serial {
+				flush()
+				serial = recordSerial
+			}
+			if record["type"] == "EOE" {
+				flush()
+				continue
+			}
+			event = append(event, record)
+		case <-time.After(auditEventFlushDelay):
+			flush()
+		case err := <-failure:
+			flush()
+			return err
+		}
+	}
+}
+
+// applyAuditRules jails the process of an event with the first rule matching it
+func applyAuditRules(state *JailerState, event []auditRecord, serial string) {
+	for i := range state.Config.AuditRules {
+		rule := &state.Config.AuditRules[i]
+		if !rule.matches(event) {
+			continue
+		}
+
+		pid := 0
+		for _, record := range event {
+			// jailer audits itself when it runs nft or iptables
+			if parent, err := strconv.Atoi(record["ppid"]); err == nil && parent == os.Getpid() {
+				return
+			}
+			if pid == 0 {
+				pid, _ = strconv.Atoi(record["pid"])
+			}
+		}
+		if pid <= 1 || pid == os.Getpid() {
+			return
+		}
+
+		reason := rule.Reason
+		if reason == "" {
+			reason = fmt.Sprintf("audit rule %s matched event %s", rule.Name, serial)
+		}
+		jailed, err := jailAutomatically(state, "audit rule "+rule.Name, rule.Jail, []int{pid}, rule.Args, reason)
+		if len(jailed) > 0 {
+			fmt.Printf("Audit rule %s matched event %s of process %d\n", rule.Name, serial, pid)
+		}
+		if err != nil {
+			fmt.Printf("Warning: audit rule %s failed to jail process %d: %v\n", rule.Name, pid, err)
+		}
+		return
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// auditSyscalls adds the syscalls that are audited but never part of seccomp profiles
+var auditSyscalls = map[string]uintptr{
+	"execve":   unix.SYS_EXECVE,
+	"execveat": unix.SYS_EXECVEAT,
+	"open":     unix.SYS_OPEN,
+	"openat":   unix.SYS_OPENAT,
+	"ptrace":   unix.SYS_PTRACE,
+	"kill":     unix.SYS_KILL,
+}
+
+// auditSyscallNumber returns the number of a syscall in the raw audit records
+func auditSyscallNumber(name string) (uintptr, bool) {
+	if number, found := auditSyscalls[name]; found {
+		return number, true
+	}
+	number, found := seccompSyscalls[name]
+	return number, found
+}
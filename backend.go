@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// The jails reach the operating system through five backends: the processes, the limits,
+// the resource settings of single processes, the disk quotas and the firewall. On Linux
+// they are procfs, cgroups, prlimit, project quotas and nftables or iptables, a port to
+// another system implements them with its own facilities, e.g. sysctl kern.proc, rctl,
+// ZFS quotas and pf anchors on FreeBSD. The commands and the jail state only go through
+// the interfaces
+
+// processBackend finds the processes to jail and describes them
+type processBackend interface {
+	exists(pid int) bool
+	name(pid int) string // A placeholder name when it can't be read
+	parent(pid int) (int, error)
+	descendants(pid int) ([]int, error) // Children, grandchildren, etc.
+}
+
+// limitBackend enforces the network, proxy, cpu, memory, rdma and misc jails by moving the
+// processes to shared limits, or to limits of their own for a jail with custom values. A
+// group is where a process was before its jail, restored at unjail time
+type limitBackend interface {
+	setup() error
+	processGroup(pid int) (string, error)
+	placeJail(jail *Jail, jailType string) error  // Decides where the own limits of a jail go, before setupJail
+	setupJail(jail *Jail) error                   // Creates the own limits of a jail with its values
+	updateCpuLimit(jail *Jail) error              // Applies a changed CPU limit to the own limits of a jail
+	liftLimits(jail *Jail, jailType string) error // Lifts the limits of a type removed while the own limits stay
+	limit(jail *Jail, pid int) error              // Moves a process to the limits matching the types of its jail
+	restore(pid int, group string) error
+	releaseJail(jail *Jail) // Removes the own limits of a jail once no process uses them
+	reclaimMemory(jail *Jail, amount uint64) (before, after uint64, err error)
+	jailGroup(jail *Jail, jailType string) string // Where the limits of a type of the jail are, shown by info
+	cleanup() error
+}
+
+// resourceBackend sets the rlimit, oom and coredump jails on single processes and gives
+// back their previous settings for the unjail
+type resourceBackend interface {
+	limit(pid int, limits map[string]uint64) (map[string]unix.Rlimit, error)
+	restoreLimits(pid int, saved map[string]unix.Rlimit) error
+	preferOomKill(pid int) (int, error) // Returns the previous OOM score
+	restoreOomScore(pid, score int) error
+	suppressCoreDumps(pid int) (savedCoreDump, error)
+	restoreCoreDumps(pid int, saved savedCoreDump) error
+	describeJail(jail *Jail, jailType string) string
+}
+
+// quotaBackend charges the writes of a quota jail to a disk quota of its own
+type quotaBackend interface {
+	setupJail(jail *Jail, pids []int) error
+	releaseJail(jail *Jail)
+	describeJail(jail *Jail) string
+}
+
+// firewallBackend installs and removes the shared rules blocking the traffic of the
+// network and proxy jails, and the rules of their own of the network jails
+type firewallBackend interface {
+	detect() (string, error) // The tool installing the rules, an error without one
+	setup() error
+	cleanup() error
+	rulesPresent() bool // The shared rules of a previous jailer are still installed
+	setupProxy() error
+	cleanupProxy()
+	setupJail(jail *Jail, options JailOptions) error
+	allowSessions(jail *Jail, pids []int) error // Keeps the established sessions of the processes open
+	enterNamespace(jail *Jail) error            // Installs the shared rules in the network namespace of a container
+	releaseJail(jail *Jail)                     // Removes every rule of a jail, nothing when it has none
+	droppedPackets() (uint64, error)
+	describe() []string               // The shared rules of the network jails
+	describeJail(jail *Jail) []string // The rules of its own of a network jail
+	describeProxy() []string          // The shared rules of the proxy jails
+}
+
+// savedCoreDump holds the core dump settings of a process before it was jailed
+type savedCoreDump struct {
+	CoreLimit unix.Rlimit
+	Filter    string
+}
+
+// savedProject is the project quota setting of a directory or a file before the quota jail
+type savedProject struct {
+	ProjectID uint32
+	Inherit   bool
+}
+
+// insertedRule is a firewall rule inserted ahead of the jail rules and deleted on its own
+type insertedRule struct {
+	Chain  string   // Chain of the jail table, "output" or "input"
+	Handle string   // nftables handle of the rule
+	Spec   []string // Match and verdict of the rule, used to delete it with iptables
+}
+
+// jailNetNamespace is the network namespace of a container holding network jail rules of
+// its own, the traffic of containers doesn't go through the OUTPUT and INPUT chains of
+// the host
+type jailNetNamespace struct {
+	file *os.File // Keeps the namespace open to remove the rules once its processes exit
+	refs int      // Jails relying on the rules
+}
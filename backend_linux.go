@@ -0,0 +1,292 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// hostProcesses is the process backend of the host
+var hostProcesses processBackend = procfsProcesses{}
+
+// setupBackends gives the state the backends of the host
+func setupBackends(state *JailerState) {
+	state.Limits = &cgroupLimits{state: state}
+	state.Resources = prlimitResources{}
+	state.Quotas = projectQuotas{}
+	state.Firewall = &netfilterFirewall{state: state}
+}
+
+// procfsProcesses reads the processes from /proc
+type procfsProcesses struct{}
+
+// parent returns the parent PID of a process from its stat file
+func (procfsProcesses) parent(pid int) (int, error) {
+	content, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	// stat file format: pid (comm) state ppid ..., comm may contain spaces and
+	// parentheses so fields are counted after its last closing parenthesis
+	stat := string(content)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected stat format for PID %d", pid)
+	}
+
+	return strconv.Atoi(fields[1])
+}
+
+// descendants returns all descendants (children, grandchildren, etc.) of a process,
+// from the children files of the tree when available and otherwise from a single pass
+// over /proc
+func (procfsProcesses) descendants(pid int) ([]int, error) {
+	getChildren := readTaskChildren
+	if !taskChildrenSupported() {
+		tree, err := buildProcessTree()
+		if err != nil {
+			return nil, err
+		}
+		getChildren = func(parentPid int) ([]int, error) {
+			return tree[parentPid], nil
+		}
+	}
+
+	var descendants []int
+	visited := map[int]bool{pid: true}
+	queue := []int{pid}
+	for len(queue) > 0 {
+		parentPid := queue[0]
+		queue = queue[1:]
+
+		children, err := getChildren(parentPid)
+		if err != nil {
+			continue // Continue even if we can't access certain processes
+		}
+		for _, childPid := range children {
+			if visited[childPid] {
+				continue // Avoid infinite loops
+			}
+			visited[childPid] = true
+			descendants = append(descendants, childPid)
+			queue = append(queue, childPid)
+		}
+	}
+
+	return descendants, nil
+}
+
+// exists checks if a process still exists
+func (procfsProcesses) exists(pid int) bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+	return err == nil
+}
+
+// name returns the name of a process
+func (procfsProcesses) name(pid int) string {
+	commFile := fmt.Sprintf("/proc/%d/comm", pid)
+	content, err := os.ReadFile(commFile)
+	if err != nil {
+		return fmt.Sprintf("PID-%d", pid)
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// cgroupLimits enforces the limits with the cgroups of the detected version, the jails
+// with custom values get a dedicated cgroup
+type cgroupLimits struct {
+	state *JailerState
+}
+
+func (l *cgroupLimits) setup() error {
+	return initializeCgroup(l.state)
+}
+
+func (l *cgroupLimits) processGroup(pid int) (string, error) {
+	return getProcessCgroup(pid)
+}
+
+func (l *cgroupLimits) placeJail(jail *Jail, jailType string) error {
+	return nestJailCgroup(l.state, jail, jailType)
+}
+
+func (l *cgroupLimits) setupJail(jail *Jail) error {
+	return setupJailCgroup(l.state, jail)
+}
+
+func (l *cgroupLimits) updateCpuLimit(jail *Jail) error {
+	return setupJailCgroupCpuLimit(l.state, jail, jailCgroupPath(l.state, jail))
+}
+
+func (l *cgroupLimits) liftLimits(jail *Jail, jailType string) error {
+	return resetControllerLimits(l.state, jail, jailType)
+}
+
+func (l *cgroupLimits) limit(jail *Jail, pid int) error {
+	return moveProcessToJailCgroups(l.state, jail, pid)
+}
+
+func (l *cgroupLimits) restore(pid int, group string) error {
+	return restoreProcessCgroup(l.state, pid, group)
+}
+
+func (l *cgroupLimits) releaseJail(jail *Jail) {
+	removeJailCgroup(l.state, jail)
+}
+
+func (l *cgroupLimits) reclaimMemory(jail *Jail, amount uint64) (uint64, uint64, error) {
+	if l.state.CgroupVersion != 2 {
+		return 0, 0, fmt.Errorf("memory.reclaim needs cgroups v2")
+	}
+	return reclaimCgroupMemory(jailCgroupPath(l.state, jail), amount)
+}
+
+func (l *cgroupLimits) jailGroup(jail *Jail, jailType string) string {
+	switch {
+	case jailType == "memory":
+		return filepath.Dir(memoryLimitFile(l.state, jail))
+	case jailType == "network" && jail.ClassID != "":
+		return classCgroupPath(jail.PID)
+	}
+	return jailCgroupPath(l.state, jail)
+}
+
+func (l *cgroupLimits) cleanup() error {
+	return cleanupCgroup(l.state)
+}
+
+// prlimitResources sets the resource limits with prlimit and the OOM score and the core
+// dump filter through /proc
+type prlimitResources struct{}
+
+func (prlimitResources) limit(pid int, limits map[string]uint64) (map[string]unix.Rlimit, error) {
+	return applyRlimits(pid, limits)
+}
+
+func (prlimitResources) restoreLimits(pid int, saved map[string]unix.Rlimit) error {
+	return restoreRlimits(pid, saved)
+}
+
+func (prlimitResources) preferOomKill(pid int) (int, error) {
+	return applyOomScoreAdj(pid)
+}
+
+func (prlimitResources) restoreOomScore(pid, score int) error {
+	return setOomScoreAdj(pid, score)
+}
+
+func (prlimitResources) suppressCoreDumps(pid int) (savedCoreDump, error) {
+	return suppressCoreDumps(pid)
+}
+
+func (prlimitResources) restoreCoreDumps(pid int, saved savedCoreDump) error {
+	return restoreCoreDumps(pid, saved)
+}
+
+func (prlimitResources) describeJail(jail *Jail, jailType string) string {
+	switch jailType {
+	case "rlimit":
+		return formatRlimits(jail.Rlimits)
+	case "oom":
+		if original, exists := jail.SavedOomScores[jail.PID]; exists {
+			return fmt.Sprintf("oom_score_adj %d (was %d)", oomScoreAdjMax, original)
+		}
+		return fmt.Sprintf("oom_score_adj %d", oomScoreAdjMax)
+	case "coredump":
+		return "core dumps suppressed"
+	}
+	return ""
+}
+
+// projectQuotas charges the quota jails to XFS or ext4 project quotas
+type projectQuotas struct{}
+
+func (projectQuotas) setupJail(jail *Jail, pids []int) error {
+	return setupQuotaJail(jail, pids)
+}
+
+func (projectQuotas) releaseJail(jail *Jail) {
+	releaseQuotaJail(jail)
+}
+
+func (projectQuotas) describeJail(jail *Jail) string {
+	return describeQuota(jail)
+}
+
+// netfilterFirewall installs the rules with the detected firewall tool, nftables or
+// iptables
+type netfilterFirewall struct {
+	state *JailerState
+}
+
+func (f *netfilterFirewall) detect() (string, error) {
+	return detectFirewallTool()
+}
+
+func (f *netfilterFirewall) setup() error {
+	return setupNetworkJail(f.state)
+}
+
+func (f *netfilterFirewall) cleanup() error {
+	return cleanupNetworkJail(f.state)
+}
+
+func (f *netfilterFirewall) rulesPresent() bool {
+	return networkJailRulesPresent(f.state)
+}
+
+func (f *netfilterFirewall) setupProxy() error {
+	return setupProxyJail(f.state)
+}
+
+func (f *netfilterFirewall) cleanupProxy() {
+	cleanupProxyJail(f.state)
+}
+
+func (f *netfilterFirewall) setupJail(jail *Jail, options JailOptions) error {
+	return setupJailNetworkRules(f.state, jail, options)
+}
+
+func (f *netfilterFirewall) allowSessions(jail *Jail, pids []int) error {
+	return allowEstablishedSessions(f.state, jail, pids)
+}
+
+func (f *netfilterFirewall) enterNamespace(jail *Jail) error {
+	return enterNetNamespace(f.state, jail)
+}
+
+func (f *netfilterFirewall) releaseJail(jail *Jail) {
+	releaseEstablishedSessions(f.state, jail)
+	releaseAllowlist(f.state, jail)
+	releaseJailNetworkRules(f.state, jail)
+	releaseNetNamespace(f.state, jail)
+}
+
+func (f *netfilterFirewall) droppedPackets() (uint64, error) {
+	return getDroppedPackets(f.state)
+}
+
+func (f *netfilterFirewall) describe() []string {
+	return describeNetworkJailRules(f.state)
+}
+
+func (f *netfilterFirewall) describeJail(jail *Jail) []string {
+	var rules []string
+	for _, ruleSet := range [][]insertedRule{jail.BlocklistRules, jail.SessionRules, jail.AllowRules, jail.IfaceRules, jail.CountryRules, jail.DropRules} {
+		for _, rule := range ruleSet {
+			rules = append(rules, rule.describe(f.state))
+		}
+	}
+	return rules
+}
+
+func (f *netfilterFirewall) describeProxy() []string {
+	return describeProxyJailRules(f.state)
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parsePidArg parses a PID, optionally annotated with its process name as completed by
+// Tab (1234:nginx), the name is checked to catch PIDs reused by another process
+func parsePidArg(arg string) (int, error) {
+	pidStr, name, annotated := strings.Cut(arg, ":")
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid PID: %s", arg)
+	}
+
+	if annotated && hostProcesses.exists(pid) {
+		if current := hostProcesses.name(pid); current != name {
+			return 0, fmt.Errorf("PID %d is now %s, not %s", pid, current, name)
+		}
+	}
+	return pid, nil
+}
+
+// isPidTarget checks if an argument designates processes: a PID, a PID annotated with its
+// name such as 1234:nginx, a range such as 1000-1010, a PID file such as @/run/nginx.pid
+// or a container such as container:web or lxd:web
+func isPidTarget(arg string) bool {
+	if strings.HasPrefix(arg, "@") {
+		return len(arg) > 1
+	}
+	if strings.HasPrefix(arg, "container:") || strings.HasPrefix(arg, "lxd:") {
+		return true
+	}
+	if pidStr, _, annotated := strings.Cut(arg, ":"); annotated {
+		_, err := strconv.Atoi(pidStr)
+		return err == nil
+	}
+	start, end, isRange := strings.Cut(arg, "-")
+	if _, err := strconv.Atoi(start); err != nil {
+		return false
+	}
+	if isRange {
+		_, err := strconv.Atoi(end)
+		return err == nil
+	}
+	return true
+}
+
+// parsePidTargets expands the process targets at the start of the arguments and returns
+// them with the remaining arguments, ranges only keep the processes that exist
+func parsePidTargets(args []string) ([]int, []string, error) {
+	var pids []int
+	seen := make(map[int]bool)
+	add := func(pid int) {
+		if !seen[pid] {
+			seen[pid] = true
+			pids = append(pids, pid)
+		}
+	}
+
+	i := 0
+	for ; i < len(args) && isPidTarget(args[i]); i++ {
+		arg := args[i]
+
+		if strings.HasPrefix(arg, "@") {
+			content, err := os.ReadFile(arg[1:])
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read PID file: %v", err)
+			}
+			for _, field := range strings.Fields(string(content)) {
+				pid, err := strconv.Atoi(field)
+				if err != nil || pid <= 0 {
+					return nil, nil, fmt.Errorf("invalid PID %q in %s", field, arg[1:])
+				}
+				add(pid)
+			}
+			continue
+		}
+
+		if container, found := strings.CutPrefix(arg, "container:"); found {
+			containerPids, err := containerTargets(container)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, pid := range containerPids {
+				add(pid)
+			}
+			continue
+		}
+		if instance, found := strings.CutPrefix(arg, "lxd:"); found {
+			containerPids, err := lxdTargets(instance)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, pid := range containerPids {
+				add(pid)
+			}
+			continue
+		}
+
+		if strings.Contains(arg, ":") {
+			pid, err := parsePidArg(arg)
+			if err != nil {
+				return nil, nil, err
+			}
+			add(pid)
+			continue
+		}
+
+		startStr, endStr, isRange := strings.Cut(arg, "-")
+		start, _ := strconv.Atoi(startStr)
+		if !isRange {
+			if start <= 0 {
+				return nil, nil, fmt.Errorf("invalid PID: %s", arg)
+			}
+			add(start)
+			continue
+		}
+
+		// A range is probed PID by PID, its end can't go past the largest PID
+		end, _ := strconv.Atoi(endStr)
+		if start <= 0 || end < start {
+			return nil, nil, fmt.Errorf("invalid PID range: %s", arg)
+		}
+		if limit := maxPid(); end > limit {
+			return nil, nil, fmt.Errorf("invalid PID range: %s, PIDs don't go past %d (kernel.pid_max)", arg, limit)
+		}
+		for pid := start; pid <= end; pid++ {
+			if hostProcesses.exists(pid) {
+				add(pid)
+			}
+		}
+	}
+
+	if i == 0 {
+		return nil, nil, fmt.Errorf("no target PID given")
+	}
+	if len(pids) == 0 {
+		return nil, nil, fmt.Errorf("no existing process in %s", strings.Join(args[:i], " "))
+	}
+
+	return pids, args[i:], nil
+}
+
+// jailSpec is a jail type of a command with its arguments
+type jailSpec struct {
+	Type string
+	Args []string
+}
+
+// parseJailSpecs parses the jail types of a command: a single type, both (network and
+// cpu) or a combination such as network,cpu=50%. In a combination the arguments of a type
+// follow it after =, joined by + when there are several (rlimit=nofile=64+nproc=100). The
+// arguments given after the PIDs go to the last type
+func parseJailSpecs(value string, args []string) ([]jailSpec, error) {
+	var specs []jailSpec
+	for _, part := range strings.Split(value, ",") {
+		name, inline, hasArgs := strings.Cut(part, "=")
+		jailType := normalizeJailType(strings.ToLower(strings.TrimSpace(name)))
+		var expanded []jailSpec
+		switch {
+		case jailType == "both" && !hasArgs:
+			expanded = []jailSpec{{Type: "network"}, {Type: "cpu"}}
+		case !knownJailType(jailType) || jailType == "both":
+			return nil, fmt.Errorf("unknown jail type: %q", name)
+		case hasArgs && inline == "":
+			return nil, fmt.Errorf("no arguments after %s=", jailType)
+		case hasArgs:
+			expanded = []jailSpec{{Type: jailType, Args: strings.Split(inline, "+")}}
+		default:
+			expanded = []jailSpec{{Type: jailType}}
+		}
+		for _, spec := range expanded {
+			if slices.Contains(jailSpecTypes(specs), spec.Type) {
+				return nil, fmt.Errorf("%s jail given twice in %s", spec.Type, value)
+			}
+			specs = append(specs, spec)
+		}
+	}
+
+	if len(args) > 0 {
+		last := &specs[len(specs)-1]
+		if len(last.Args) > 0 {
+			return nil, fmt.Errorf("%s jail has arguments already, %s has no jail type", last.Type, strings.Join(args, " "))
+		}
+		last.Args = args
+	}
+	return specs, nil
+}
+
+// jailSpecTypes returns the jail types of specs
+func jailSpecTypes(specs []jailSpec) []string {
+	var jailTypes []string
+	for _, spec := range specs {
+		jailTypes = append(jailTypes, spec.Type)
+	}
+	return jailTypes
+}
+
+// findJailSpec returns the spec of a jail type, nil when it isn't part of the command
+func findJailSpec(specs []jailSpec, jailType string) *jailSpec {
+	for i := range specs {
+		if specs[i].Type == jailType {
+			return &specs[i]
+		}
+	}
+	return nil
+}
+
+// normalizeJailSpec checks the jail types of a configuration entry, a single type or a
+// combination, and returns them normalized
+func normalizeJailSpec(value string) (string, error) {
+	specs, err := parseJailSpecs(value, nil)
+	if err != nil {
+		return "", err
+	}
+	parts := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		part := spec.Type
+		if len(spec.Args) > 0 {
+			part += "=" + strings.Join(spec.Args, "+")
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// jailTargets applies jail types to several processes, reports the outcome of each one
+// and records them in a single audit event. The jails override the schedules of their
+// types, the scheduler would remove them once the window closes
+func jailTargets(state *JailerState, specs []jailSpec, pids []int, options JailOptions) error {
+	jailTypes := jailSpecTypes(specs)
+	event := AuditEvent{Action: "jail", JailTypes: jailTypes, Reason: options.Reason}
+
+	var failed []AuditTarget
+	interrupted := currentInterrupt()
+	for _, pid := range pids {
+		name := hostProcesses.name(pid)
+
+		// The targets after a Ctrl+C are left untouched
+		err := errMoveInterrupted
+		if !interruptedBefore(interrupted) {
+			err = jailSpecs(state, specs, pid, options)
+		}
+
+		target := newAuditTarget(pid, name, err)
+		event.Targets = append(event.Targets, target)
+		if err != nil {
+			failed = append(failed, target)
+			continue
+		}
+		for _, spec := range specs {
+			dropJailSchedules(state, pid, spec.Type)
+		}
+	}
+
+	writeAuditEvent(state, event)
+
+	// A single target keeps the plain error of jailProcess
+	if len(pids) == 1 {
+		if len(failed) == 1 {
+			return fmt.Errorf("%s", failed[0].Error)
+		}
+		return nil
+	}
+
+	fmt.Fprintf(state.stdout(), "Jailed %d of %d processes with %s jail\n", len(pids)-len(failed), len(pids), strings.Join(jailTypes, ","))
+	printFailedTargets(state.stdout(), failed, options.Verbose)
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d processes could not be jailed", len(failed), len(pids))
+	}
+	return nil
+}
+
+// printFailedTargets lists the processes a bulk operation failed on, a single summary
+// line when several failed unless verbose. Each one is in the audit event anyway
+func printFailedTargets(out io.Writer, failed []AuditTarget, verbose bool) {
+	if verbose || len(failed) <= 1 {
+		for _, target := range failed {
+			fmt.Fprintf(out, "  Failed PID %d (%s): %s\n", target.PID, target.Name, target.Error)
+		}
+		return
+	}
+	errs := make(map[int]error)
+	for _, target := range failed {
+		errs[target.PID] = errors.New(target.Error)
+	}
+	fmt.Fprintf(out, "  Failed %d: %s\n", len(failed), summarizeProcessErrors(errs))
+}
+
+// jailSpecs applies the jail types of the specs to a process in turn, stopping at the
+// first that fails
+func jailSpecs(state *JailerState, specs []jailSpec, pid int, options JailOptions) error {
+	for _, spec := range specs {
+		if err := jailProcess(state, spec.Type, strconv.Itoa(pid), spec.Args, options); err != nil {
+			if len(specs) > 1 {
+				return fmt.Errorf("failed to apply %s jail: %v", spec.Type, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// unjailAll releases every active jail at the end of an incident, persistent ones
+// included, after a confirmation. The outcome of each process is reported and recorded in
+// a single audit event, and undo brings the jails back
+func unjailAll(state *JailerState, assumeYes bool) error {
+	pids := make([]int, 0, len(state.ActiveJails))
+	for pid := range state.ActiveJails {
+		pids = append(pids, pid)
+	}
+	if len(pids) == 0 {
+		fmt.Fprintln(state.stdout(), "No active jails")
+		return nil
+	}
+	sort.Ints(pids)
+
+	if !assumeYes {
+		question := fmt.Sprintf("Release the %d active jails?", len(pids))
+		if persistent := countPersistentJails(state); persistent > 0 {
+			question = fmt.Sprintf("Release the %d active jails, %d of them persistent?", len(pids), persistent)
+		}
+		confirmed, err := confirmAction(state, question)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			fmt.Fprintln(state.stdout(), "No jail released")
+			return nil
+		}
+	}
+
+	return unjailTargets(state, "", pids, "unjail all")
+}
+
+// unjailMatching releases the jails, or one jail type, of the jailed processes whose name
+// matches a glob or substring pattern (name:chrome) or that match a selector
+func unjailMatching(state *JailerState, jailType, target string, selector []string, dryRun bool) error {
+	if jailType != "" && !slices.Contains(unjailTypeWords, jailType) {
+		return fmt.Errorf("unknown jail type: %q", jailType)
+	}
+	var matches []processSnapshot
+	if pattern, found := strings.CutPrefix(target, "name:"); found {
+		if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid name pattern: %q", pattern)
+		}
+		for pid := range state.ActiveJails {
+			if name := hostProcesses.name(pid); matchesName(pattern, name) {
+				matches = append(matches, processSnapshot{PID: pid, Name: name, Jailed: true})
+			}
+		}
+	} else {
+		var err error
+		if matches, err = selectJailedProcesses(state, selector); err != nil {
+			return err
+		}
+	}
+
+	var pids []int
+	for _, process := range matches {
+		if jailType == "" || state.ActiveJails[process.PID].HasJailType(jailType) {
+			pids = append(pids, process.PID)
+		}
+	}
+	sort.Ints(pids)
+	if dryRun {
+		for _, pid := range pids {
+			fmt.Fprintf(state.stdout(), "  %d (%s): %s\n", pid, hostProcesses.name(pid), strings.Join(state.ActiveJails[pid].JailTypes, ","))
+		}
+		fmt.Fprintf(state.stdout(), "Dry run: %d jailed processes would be released\n", len(pids))
+		return nil
+	}
+	if len(pids) == 0 {
+		if jailType != "" {
+			return fmt.Errorf("no process in a %s jail matches %s", jailType, target)
+		}
+		return fmt.Errorf("no jailed process matches %s", target)
+	}
+
+	description := "unjail " + target
+	if jailType != "" {
+		description = "unjail " + jailType + " " + target
+	}
+	return unjailTargets(state, jailType, pids, description)
+}
+
+// unjailTargets releases the jails, or one jail type, of several processes, reports the
+// PIDs released and the failures and records them in a single audit event and operation
+func unjailTargets(state *JailerState, jailType string, pids []int, description string) error {
+	event := AuditEvent{Action: "unjail"}
+	if jailType != "" {
+		event.JailTypes = []string{jailType}
+	}
+	before := snapshotJails(state, pids)
+	var released []string
+	var failed []AuditTarget
+	interrupted := currentInterrupt()
+	for _, pid := range pids {
+		name := hostProcesses.name(pid)
+		var err error
+		switch {
+		case interruptedBefore(interrupted):
+			err = errMoveInterrupted
+		case jailType == "":
+			dropJailSchedules(state, pid, jailType)
+			err = unjailProcess(state, strconv.Itoa(pid))
+		default:
+			dropJailSchedules(state, pid, jailType)
+			err = unjailProcessSelective(state, jailType, strconv.Itoa(pid))
+		}
+
+		target := newAuditTarget(pid, name, err)
+		event.Targets = append(event.Targets, target)
+		if err != nil {
+			failed = append(failed, target)
+		} else {
+			released = append(released, fmt.Sprintf("%d (%s)", pid, name))
+		}
+	}
+	writeAuditEvent(state, event)
+	recordOperation(state, description, pids, before)
+
+	what := "jails"
+	if jailType != "" {
+		what = jailType + " jails"
+	}
+	fmt.Fprintf(state.stdout(), "Released the %s of %d of %d processes\n", what, len(released), len(pids))
+	if len(released) > 0 {
+		fmt.Fprintf(state.stdout(), "  Released: %s\n", strings.Join(released, ", "))
+	}
+	printFailedTargets(state.stdout(), failed, false)
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d processes could not be unjailed", len(failed), len(pids))
+	}
+	return nil
+}
+
+// jailAutomatically applies a jail on behalf of a rule, such as an audit rule or an alert
+// profile, to the processes that don't have it yet and returns them
+func jailAutomatically(state *JailerState, operator, jailType string, pids []int, args []string, reason string) ([]int, error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	specs, err := parseJailSpecs(jailType, args)
+	if err != nil {
+		return nil, err
+	}
+	jailTypes := jailSpecTypes(specs)
+	var targets []int
+	for _, pid := range pids {
+		jail, jailed := state.ActiveJails[pid]
+		missing := !jailed
+		for _, jailType := range jailTypes {
+			missing = missing || !jail.HasJailType(jailType)
+		}
+		if missing {
+			targets = append(targets, pid)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	// Nobody is there to check the targets or add --force, a rule matching PID 1 or a
+	// session leader is refused and the refusal is kept in the audit log
+	_, descendants := collectDescendants(state, targets)
+	if err := checkJailSize(state, len(targets), descendants, false); err != nil {
+		event := AuditEvent{Action: "jail", Operator: operator, JailTypes: jailTypes, Reason: reason}
+		for _, pid := range targets {
+			event.Targets = append(event.Targets, newAuditTarget(pid, hostProcesses.name(pid), err))
+		}
+		writeAuditEvent(state, event)
+		return nil, err
+	}
+
+	localOperator := state.Operator
+	state.Operator = operator
+	err = jailTargets(state, specs, targets, JailOptions{Reason: reason})
+	state.Operator = localOperator
+	publishInventory(state)
+	return targets, err
+}
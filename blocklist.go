@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	defaultBlocklistRefresh  = time.Hour
+	defaultBlocklistCacheDir = "/var/lib/jailer/blocklists"
+)
+
+// BlocklistConfig contains the threat-intel feeds of malicious addresses dropped by the firewall
+type BlocklistConfig struct {
+	Feeds        []BlocklistFeed `json:"feeds"`
+	Refresh      string          `json:"refresh"`       // Interval of the downloads, 1h by default
+	AllProcesses bool            `json:"all_processes"` // Drop the listed addresses for every process, not only the network jails
+	CacheDir     string          `json:"cache_dir"`     // Downloaded feeds, /var/lib/jailer/blocklists by default
+
+	refresh time.Duration
+}
+
+// BlocklistFeed is a URL listing malicious addresses or networks, one per line
+type BlocklistFeed struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// blocklistFeedStatus is the freshness of a feed shown by status
+type blocklistFeedStatus struct {
+	Entries   int       // Networks of the feed in the sets
+	UpdatedAt time.Time // Download of the networks in use
+	Error     string    // Failure of the last refresh, the previous download stays in use
+}
+
+// feedNamePattern matches the names of the feeds, used in the cache file names
+var feedNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// validateBlocklistConfig checks the feeds and fills in the defaults
+func validateBlocklistConfig(config *BlocklistConfig) error {
+	names := make(map[string]bool)
+	for i, feed := range config.Feeds {
+		if !feedNamePattern.MatchString(feed.Name) {
+			return fmt.Errorf("feed %d has an invalid name %q", i+1, feed.Name)
+		}
+		if names[feed.Name] {
+			return fmt.Errorf("feed %q is listed twice", feed.Name)
+		}
+		names[feed.Name] = true
+		if feed.URL == "" {
+			return fmt.Errorf("feed %q has no url", feed.Name)
+		}
+	}
+	if config.CacheDir == "" {
+		config.CacheDir = defaultBlocklistCacheDir
+	}
+	config.refresh = defaultBlocklistRefresh
+	if config.Refresh != "" {
+		refresh, err := parseDuration(config.Refresh)
+		if err != nil || refresh < time.Minute {
+			return fmt.Errorf("invalid refresh %q, at least 1m", config.Refresh)
+		}
+		config.refresh = refresh
+	}
+	return nil
+}
+
+// blocklistsEnabled tells whether feeds are configured and their sets can be loaded
+func blocklistsEnabled(state *JailerState) bool {
+	return len(state.Config.Blocklists.Feeds) > 0 && state.FirewallTool != "" &&
+		checkJailTypeEnabled(state, "network") == nil
+}
+
+// describeBlocklists returns the freshness of each feed, for status
+func describeBlocklists(state *JailerState, now time.Time) [][]string {
+	var rows [][]string
+	for _, feed := range state.Config.Blocklists.Feeds {
+		status, loaded := state.BlocklistFeeds[feed.Name]
+		switch {
+		case !loaded:
+			rows = append(rows, []string{feed.Name, "-", "-", "not loaded"})
+		case status.UpdatedAt.IsZero():
+			rows = append(rows, []string{feed.Name, "0", "never", status.Error})
+		default:
+			health := "ok"
+			if status.Error != "" {
+				health = "stale: " + status.Error
+			} else if now.Sub(status.UpdatedAt) > 2*state.Config.Blocklists.refresh {
+				health = "stale"
+			}
+			rows = append(rows, []string{feed.Name, fmt.Sprint(status.Entries),
+				fmt.Sprintf("%s ago", now.Sub(status.UpdatedAt).Round(time.Second)), health})
+		}
+	}
+	return rows
+}
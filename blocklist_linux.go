@@ -0,0 +1,163 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	blocklistSet4 = "blocklist4"
+	blocklistSet6 = "blocklist6"
+)
+
+// downloadBlocklistFeeds downloads the feeds whose cached copy is older than the refresh
+// interval and returns their networks by family. A feed that fails keeps its cached copy
+func downloadBlocklistFeeds(config BlocklistConfig, now time.Time) ([]string, []string, map[string]*blocklistFeedStatus) {
+	var networks4, networks6 []string
+	statuses := make(map[string]*blocklistFeedStatus)
+	for _, feed := range config.Feeds {
+		status := &blocklistFeedStatus{}
+		statuses[feed.Name] = status
+		cachePath := filepath.Join(config.CacheDir, feed.Name+".list")
+
+		info, err := os.Stat(cachePath)
+		if err != nil || now.Sub(info.ModTime()) >= config.refresh {
+			if err := downloadNetworkList(feed.URL, cachePath); err != nil {
+				status.Error = err.Error()
+			}
+		}
+		if info, err = os.Stat(cachePath); err != nil {
+			continue
+		}
+		networks, err := readNetworkList(cachePath)
+		if err != nil {
+			status.Error = err.Error()
+			continue
+		}
+		status.UpdatedAt = info.ModTime()
+		status.Entries = len(networks)
+		for _, network := range networks {
+			if family, _ := allowedAddressFamily(network); family == "ip6" {
+				networks6 = append(networks6, network)
+			} else {
+				networks4 = append(networks4, network)
+			}
+		}
+	}
+	return networks4, networks6, statuses
+}
+
+// refreshBlocklists downloads the stale feeds and replaces the networks of the blocklist
+// sets, the rules on the sets stay in place. The downloads run without holding the state
+func refreshBlocklists(state *JailerState) error {
+	networks4, networks6, statuses := downloadBlocklistFeeds(state.Config.Blocklists, time.Now())
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	return loadBlocklistSets(state, networks4, networks6, statuses)
+}
+
+// loadBlocklistSets loads the networks of the feeds into the blocklist sets, the caller
+// holds stateMutex
+func loadBlocklistSets(state *JailerState, networks4, networks6 []string, statuses map[string]*blocklistFeedStatus) error {
+	state.BlocklistFeeds = statuses
+	for name, status := range statuses {
+		if status.Error != "" {
+			fmt.Printf("Warning: blocklist feed %s: %s\n", name, status.Error)
+		}
+	}
+	if err := loadAddressSet(state, blocklistSet4, "ip", networks4); err != nil {
+		return err
+	}
+	if state.FirewallTool == "nftables" {
+		// iptables only filters IPv4, the IPv6 networks of the feeds are left out
+		if err := loadAddressSet(state, blocklistSet6, "ip6", networks6); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupBlocklists loads the feeds and, when they apply to every process, inserts the rules
+// dropping their networks at the top of the jail chains. The rules recovered from the
+// previous jailer are kept
+func setupBlocklists(state *JailerState) error {
+	if err := refreshBlocklists(state); err != nil {
+		return fmt.Errorf("failed to load the blocklist feeds: %v", err)
+	}
+	return addBlocklistRules(state)
+}
+
+// addBlocklistRules inserts the rules dropping the networks of the feeds for every
+// process when the blocklists apply to all of them
+func addBlocklistRules(state *JailerState) error {
+	if !state.Config.Blocklists.AllProcesses || len(state.BlocklistRules) > 0 {
+		return nil
+	}
+	for _, set := range blocklistSets(state) {
+		for _, chain := range []string{"output", "input"} {
+			rule, err := insertFirewallRule(state, chain, setRuleSpec(state, nil, chain, set.family, set.name, "drop"))
+			if err != nil {
+				return fmt.Errorf("failed to add the blocklist rules: %v", err)
+			}
+			state.BlocklistRules = append(state.BlocklistRules, rule)
+		}
+	}
+	return nil
+}
+
+// runBlocklistRefresher refreshes the feeds at the configured interval, while a firewall
+// backend is usable after a redetect
+func runBlocklistRefresher(state *JailerState) {
+	for range time.Tick(state.Config.Blocklists.refresh) {
+		if !blocklistsEnabled(state) {
+			continue
+		}
+		if err := refreshBlocklists(state); err != nil {
+			fmt.Printf("Warning: failed to refresh the blocklist feeds: %v\n", err)
+		}
+	}
+}
+
+// blocklistSets returns the blocklist sets of the firewall tool in use
+func blocklistSets(state *JailerState) []struct{ family, name string } {
+	sets := []struct{ family, name string }{{"ip", blocklistSet4}}
+	if state.FirewallTool == "nftables" {
+		sets = append(sets, struct{ family, name string }{"ip6", blocklistSet6})
+	}
+	return sets
+}
+
+// addJailBlocklistRules inserts the rules dropping the networks of the feeds for a network
+// jail at the top of the chains, ahead of the rules accepting some of its traffic
+func addJailBlocklistRules(state *JailerState, jail *Jail) error {
+	if state.BlocklistFeeds == nil || state.Config.Blocklists.AllProcesses {
+		return nil
+	}
+	match := jailNetworkMatch(state, jail)
+	for _, set := range blocklistSets(state) {
+		for _, chain := range []string{"output", "input"} {
+			rule, err := insertFirewallRule(state, chain, setRuleSpec(state, match, chain, set.family, set.name, "drop"))
+			if err != nil {
+				return fmt.Errorf("failed to add the blocklist rules of process %d: %v", jail.PID, err)
+			}
+			jail.BlocklistRules = append(jail.BlocklistRules, rule)
+		}
+	}
+	return nil
+}
+
+// cleanupBlocklists removes the rules and the sets of the feeds, the nftables sets go
+// with the jail table
+func cleanupBlocklists(state *JailerState) {
+	deleteFirewallRules(state, state.BlocklistRules)
+	state.BlocklistRules = nil
+	if state.FirewallTool == "iptables" && state.BlocklistFeeds != nil {
+		deleteAddressSet(state, blocklistSet4)
+	}
+	state.BlocklistFeeds = nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// capability is a feature of the host a jail type relies on
+type capability struct {
+	Name      string // e.g. cgroup.cpu or firewall.cgroup-match
+	Available bool
+	Detail    string
+}
+
+// allJailTypes returns the jail types of jail and run
+func allJailTypes() []string {
+	return append(append([]string{}, supportedJailTypes...), "syscall", "landlock", "readonly")
+}
+
+// applyCapabilities disables the jail types whose capabilities are missing or whose setup
+// failed at startup, and returns the newly disabled ones
+func applyCapabilities(state *JailerState, capabilities []capability) []string {
+	byName := make(map[string]capability, len(capabilities))
+	for _, probed := range capabilities {
+		byName[probed.Name] = probed
+	}
+
+	previous := state.DisabledJailTypes
+	state.DisabledJailTypes = make(map[string]string)
+	for _, jailType := range allJailTypes() {
+		if reason, failed := state.SetupFailures[jailType]; failed {
+			state.DisabledJailTypes[jailType] = reason
+			continue
+		}
+		for _, name := range jailTypeRequirements(state, jailType) {
+			if probed := byName[name]; !probed.Available {
+				state.DisabledJailTypes[jailType] = fmt.Sprintf("%s unavailable: %s", name, probed.Detail)
+				break
+			}
+		}
+	}
+
+	var disabled []string
+	for jailType := range state.DisabledJailTypes {
+		if _, before := previous[jailType]; !before {
+			disabled = append(disabled, jailType)
+		}
+	}
+	sort.Strings(disabled)
+	return disabled
+}
+
+// checkJailTypeEnabled refuses the jail types disabled on this host
+func checkJailTypeEnabled(state *JailerState, jailType string) error {
+	if reason, disabled := state.DisabledJailTypes[jailType]; disabled {
+		return fmt.Errorf("%s jails are disabled on this host: %s (see doctor)", jailType, reason)
+	}
+	return nil
+}
+
+// disableJailType disables a jail type whose setup failed
+func disableJailType(state *JailerState, jailType string, err error) {
+	if state.SetupFailures == nil {
+		state.SetupFailures = make(map[string]string)
+	}
+	state.SetupFailures[jailType] = fmt.Sprintf("setup failed: %v", err)
+	if state.DisabledJailTypes == nil {
+		state.DisabledJailTypes = make(map[string]string)
+	}
+	state.DisabledJailTypes[jailType] = state.SetupFailures[jailType]
+	fmt.Printf("Warning: %s jails disabled: %s\n", jailType, state.SetupFailures[jailType])
+}
+
+// checkCapabilities probes the host at startup and reports the disabled jail types
+func checkCapabilities(state *JailerState) {
+	for _, jailType := range applyCapabilities(state, probeCapabilities(state)) {
+		fmt.Printf("Warning: %s jails disabled: %s\n", jailType, state.DisabledJailTypes[jailType])
+	}
+}
+
+// runDoctor probes the host again and prints the capabilities and the jail types they
+// enable
+func runDoctor(state *JailerState) error {
+	capabilities := probeCapabilities(state)
+	applyCapabilities(state, capabilities)
+
+	firewallTool := state.FirewallTool
+	if firewallTool == "" {
+		firewallTool = "no firewall"
+	}
+	fmt.Fprintf(state.stdout(), "Capabilities (cgroups v%d, %s):\n", state.CgroupVersion, firewallTool)
+	w := newTableWriter(state.stdout())
+	writeTableHeader(w, "Capability", "Status", "Detail")
+	for _, probed := range capabilities {
+		status := "ok"
+		if !probed.Available {
+			status = "missing"
+		}
+		writeTableRow(w, probed.Name, status, probed.Detail)
+	}
+	w.Flush()
+
+	fmt.Fprintln(state.stdout())
+	fmt.Fprintln(state.stdout(), "Jail types:")
+	w = newTableWriter(state.stdout())
+	writeTableHeader(w, "Type", "Status", "Reason")
+	for _, jailType := range allJailTypes() {
+		if reason, disabled := state.DisabledJailTypes[jailType]; disabled {
+			writeTableRow(w, jailType, "disabled", reason)
+		} else {
+			writeTableRow(w, jailType, "enabled", "")
+		}
+	}
+	w.Flush()
+	return nil
+}
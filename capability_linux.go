@@ -0,0 +1,131 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cgroupV1Hierarchies maps the controllers to their cgroups v1 hierarchy, io is blkio
+var cgroupV1Hierarchies = map[string]string{
+	"cpu": "cpu", "memory": "memory", "io": "blkio", "pids": "pids", "net_cls": "net_cls",
+}
+
+// probeCgroupController checks if a cgroup controller can be used by the jails
+func probeCgroupController(state *JailerState, controller string) capability {
+	probed := capability{Name: "cgroup." + controller}
+	if state.CgroupVersion == 2 {
+		if controller == "net_cls" {
+			probed.Available, probed.Detail = true, "not needed, cgroups v2 uses the socket cgroup match"
+		} else if cgroupControllerAvailable(state, controller) {
+			probed.Available, probed.Detail = true, "in /sys/fs/cgroup/cgroup.controllers"
+		} else {
+			probed.Detail = "missing from /sys/fs/cgroup/cgroup.controllers"
+		}
+		return probed
+	}
+
+	hierarchy, found := cgroupV1Hierarchies[controller]
+	if !found {
+		probed.Detail = "requires cgroups v2"
+		return probed
+	}
+	path := filepath.Join("/sys/fs/cgroup", hierarchy)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		probed.Available, probed.Detail = true, "mounted at "+path
+	} else {
+		probed.Detail = path + " is not mounted"
+	}
+	return probed
+}
+
+// probeCgroupMatch checks if the firewall can match the traffic of the jail cgroup, the
+// nftables rule is only checked, not added
+func probeCgroupMatch(state *JailerState) capability {
+	probed := capability{Name: "firewall.cgroup-match"}
+	switch state.FirewallTool {
+	case "nftables":
+		match := strings.Join(networkJailMatch(state), " ")
+		script := fmt.Sprintf("table inet jailer_probe { chain output { type filter hook output priority 100; %s counter drop; } }\n", match)
+		cmd, _, cancel := firewallCommand("nft", "-c", "-f", "-")
+		defer cancel()
+		cmd.Stdin = strings.NewReader(script)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			probed.Detail = fmt.Sprintf("nft rejects %q: %s", match, strings.TrimSpace(string(output)))
+		} else {
+			probed.Available, probed.Detail = true, "nft accepts "+match
+		}
+	case "iptables":
+		output, _ := runFirewallCommand("iptables", "-m", "cgroup", "--help")
+		if strings.Contains(string(output), "cgroup match options") {
+			probed.Available, probed.Detail = true, "iptables cgroup match module"
+		} else {
+			probed.Detail = "the iptables cgroup match module (xt_cgroup) is missing"
+		}
+	default:
+		probed.Detail = "no firewall tool"
+	}
+	return probed
+}
+
+// probeCapabilities checks the cgroup controllers, firewall features and kernel features
+// the jail types rely on
+func probeCapabilities(state *JailerState) []capability {
+	var capabilities []capability
+	for _, controller := range []string{"cpu", "memory", "io", "pids", "net_cls", "rdma", "misc"} {
+		capabilities = append(capabilities, probeCgroupController(state, controller))
+	}
+
+	firewall := capability{Name: "firewall", Available: state.FirewallTool != "", Detail: state.FirewallTool}
+	if !firewall.Available {
+		firewall.Detail = "neither nftables nor iptables found"
+	}
+	capabilities = append(capabilities, firewall, probeCgroupMatch(state))
+
+	seccomp := capability{Name: "kernel.seccomp"}
+	if status, err := os.ReadFile("/proc/self/status"); err != nil || !strings.Contains(string(status), "\nSeccomp:") {
+		seccomp.Detail = "the kernel is built without seccomp"
+	} else if _, err := seccompAuditArch(); err != nil {
+		seccomp.Detail = err.Error()
+	} else {
+		seccomp.Available, seccomp.Detail = true, "seccomp filters"
+	}
+	landlock := capability{Name: "kernel.landlock"}
+	if abi, err := landlockABIVersion(); err != nil {
+		landlock.Detail = err.Error()
+	} else {
+		landlock.Available, landlock.Detail = true, fmt.Sprintf("ABI version %d", abi)
+	}
+	criu := capability{Name: "tools.criu", Available: commandExists("criu"), Detail: "checkpoint and restore"}
+	if !criu.Available {
+		criu.Detail = "criu not found, checkpoint and restore are unavailable"
+	}
+	return append(capabilities, seccomp, landlock, criu)
+}
+
+// jailTypeRequirements returns the capabilities a jail type needs
+func jailTypeRequirements(state *JailerState, jailType string) []string {
+	switch jailType {
+	case "network", "proxy":
+		if state.CgroupVersion == 1 {
+			return []string{"firewall", "firewall.cgroup-match", "cgroup.net_cls"}
+		}
+		return []string{"firewall", "firewall.cgroup-match"}
+	case "cpu":
+		return []string{"cgroup.cpu"}
+	case "rdma":
+		return []string{"cgroup.rdma"}
+	case "misc":
+		return []string{"cgroup.misc"}
+	case "memory":
+		return []string{"cgroup.memory"}
+	case "syscall":
+		return []string{"kernel.seccomp"}
+	case "landlock":
+		return []string{"kernel.landlock"}
+	}
+	return nil
+}
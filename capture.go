@@ -0,0 +1,305 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// captureNflogGroup is the NFLOG group receiving the packets of the capture rules
+	captureNflogGroup = 7401
+
+	// captureSnapLen is the number of bytes kept of each packet
+	captureSnapLen = 0xffff
+
+	// pcapLinkTypeRaw marks pcap records starting with the IP header
+	pcapLinkTypeRaw = 101
+)
+
+// NFLOG netlink protocol, see linux/netfilter/nfnetlink_log.h
+const (
+	nfnlSubsysULOG    = 4
+	nfulnlMsgPacket   = 0
+	nfulnlMsgConfig   = 1
+	nfulaCfgCmd       = 1
+	nfulaCfgMode      = 2
+	nfulnlCfgCmdBind  = 1
+	nfulnlCopyPacket  = 2
+	nfulaTimestamp    = 3
+	nfulaPayload      = 9
+	nlaTypeMask       = 0x3fff
+	nfgenmsgLen       = 4
+	captureRecvBuffer = 4 << 20
+)
+
+// captureRuleSpec returns the rule sending the traffic of the network jail of a jail to
+// the capture NFLOG group, inserted ahead of the drop rule so that dropped packets are seen
+func captureRuleSpec(state *JailerState, jail *Jail) []string {
+	group := fmt.Sprint(captureNflogGroup)
+	if state.FirewallTool == "nftables" {
+		return append(jailNetworkMatch(state, jail), "log", "group", group)
+	}
+	return append(jailNetworkMatch(state, jail), "-j", "NFLOG", "--nflog-group", group)
+}
+
+// addCaptureRules inserts the capture rules of a jail in the input and output chains
+func addCaptureRules(state *JailerState, jail *Jail) ([]insertedRule, error) {
+	var rules []insertedRule
+	for _, chain := range []string{"output", "input"} {
+		rule, err := insertFirewallRule(state, chain, captureRuleSpec(state, jail))
+		if err != nil {
+			deleteFirewallRules(state, rules)
+			return nil, fmt.Errorf("failed to add capture rule: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// nflogConfigMessage builds a configuration request of an NFLOG group
+func nflogConfigMessage(group uint16, attrType uint16, payload []byte) []byte {
+	attrLen := unix.SizeofNlAttr + len(payload)
+	length := unix.SizeofNlMsghdr + nfgenmsgLen + (attrLen+3)&^3
+	message := make([]byte, length)
+
+	binary.NativeEndian.PutUint32(message[0:], uint32(length))
+	binary.NativeEndian.PutUint16(message[4:], nfnlSubsysULOG<<8|nfulnlMsgConfig)
+	binary.NativeEndian.PutUint16(message[6:], unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	// nfgenmsg: family, version and the group in network order
+	message[16] = unix.AF_UNSPEC
+	binary.BigEndian.PutUint16(message[18:], group)
+	binary.NativeEndian.PutUint16(message[20:], uint16(attrLen))
+	binary.NativeEndian.PutUint16(message[22:], attrType)
+	copy(message[24:], payload)
+	return message
+}
+
+// openNflog binds a netlink socket to an NFLOG group copying whole packets
+func openNflog(group uint16) (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open netfilter netlink socket: %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to bind netlink socket: %v", err)
+	}
+	unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, captureRecvBuffer)
+
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, captureSnapLen)
+	mode[4] = nfulnlCopyPacket
+	for _, message := range [][]byte{
+		nflogConfigMessage(group, nfulaCfgCmd, []byte{nfulnlCfgCmdBind}),
+		nflogConfigMessage(group, nfulaCfgMode, mode),
+	} {
+		if err := unix.Sendto(fd, message, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+			unix.Close(fd)
+			return -1, fmt.Errorf("failed to configure NFLOG group %d: %v", group, err)
+		}
+		if err := readNetlinkAck(fd); err != nil {
+			unix.Close(fd)
+			return -1, fmt.Errorf("failed to configure NFLOG group %d: %v", group, err)
+		}
+	}
+
+	timeout := unix.NsecToTimeval(int64(200 * time.Millisecond))
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout)
+	return fd, nil
+}
+
+// readNetlinkAck waits for the acknowledgement of a netlink request
+func readNetlinkAck(fd int) error {
+	buffer := make([]byte, unix.Getpagesize())
+	n, _, err := unix.Recvfrom(fd, buffer, 0)
+	if err != nil {
+		return err
+	}
+	messages, err := syscall.ParseNetlinkMessage(buffer[:n])
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		if message.Header.Type == unix.NLMSG_ERROR && len(message.Data) >= 4 {
+			if errno := int32(binary.NativeEndian.Uint32(message.Data)); errno != 0 {
+				return unix.Errno(-errno)
+			}
+		}
+	}
+	return nil
+}
+
+// parseNflogPacket returns the payload and the time of an NFLOG packet message, the
+// kernel doesn't stamp the packets of the output hook
+func parseNflogPacket(message syscall.NetlinkMessage) ([]byte, time.Time, bool) {
+	if message.Header.Type != nfnlSubsysULOG<<8|nfulnlMsgPacket || len(message.Data) < nfgenmsgLen {
+		return nil, time.Time{}, false
+	}
+	var payload []byte
+	stamp := time.Now()
+	attributes := message.Data[nfgenmsgLen:]
+	for len(attributes) >= unix.SizeofNlAttr {
+		length := int(binary.NativeEndian.Uint16(attributes))
+		attrType := binary.NativeEndian.Uint16(attributes[2:]) & nlaTypeMask
+		if length < unix.SizeofNlAttr || length > len(attributes) {
+			break
+		}
+		value := attributes[unix.SizeofNlAttr:length]
+		switch attrType {
+		case nfulaPayload:
+			payload = value
+		case nfulaTimestamp:
+			if len(value) >= 16 {
+				stamp = time.Unix(int64(binary.BigEndian.Uint64(value)), int64(binary.BigEndian.Uint64(value[8:]))*1000)
+			}
+		}
+		attributes = attributes[min((length+3)&^3, len(attributes)):]
+	}
+	return payload, stamp, payload != nil
+}
+
+// pcapWriter writes packets starting with their IP header to a pcap file
+type pcapWriter struct {
+	w *bufio.Writer
+}
+
+// newPcapWriter writes the pcap file header
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], captureSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	writer := &pcapWriter{w: bufio.NewWriter(w)}
+	_, err := writer.w.Write(header)
+	return writer, err
+}
+
+// writePacket appends a packet record
+func (p *pcapWriter) writePacket(stamp time.Time, packet []byte) error {
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(stamp.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(stamp.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(packet)))
+	if _, err := p.w.Write(header); err != nil {
+		return err
+	}
+	_, err := p.w.Write(packet)
+	return err
+}
+
+// flush writes the buffered records to the file
+func (p *pcapWriter) flush() error {
+	return p.w.Flush()
+}
+
+// capturePackets writes the traffic of the network jail of a process to a pcap file
+// until the duration elapses or Ctrl+C, a zero duration captures until Ctrl+C
+func capturePackets(state *JailerState, pid int, path string, duration time.Duration) error {
+	jail, exists := state.ActiveJails[pid]
+	if !exists || !jail.HasJailType("network") {
+		return fmt.Errorf("process %d has no network jail, only the traffic of the network jail cgroup can be captured", pid)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	defer file.Close()
+	pcap, err := newPcapWriter(file)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	fd, err := openNflog(captureNflogGroup)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	rules, err := addCaptureRules(state, jail)
+	if err != nil {
+		return err
+	}
+	defer deleteFirewallRules(state, rules)
+
+	interrupted, done := startInterruptible()
+	defer done()
+	var deadline <-chan time.Time
+	if duration > 0 {
+		deadline = time.After(duration)
+		fmt.Fprintf(state.stdout(), "Capturing the network jail traffic to %s for %s (Ctrl+C to stop)\n", path, duration)
+	} else {
+		fmt.Fprintf(state.stdout(), "Capturing the network jail traffic to %s (Ctrl+C to stop)\n", path)
+	}
+
+	// The packets are received with the state unlocked, the monitors keep running
+	var packets, overruns int
+	waitUnlocked(state, func() {
+		packets, overruns, err = receivePackets(fd, pcap, path, interrupted, deadline)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := pcap.flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	fmt.Fprintf(state.stdout(), "Captured %d packets to %s\n", packets, path)
+	if overruns > 0 {
+		fmt.Fprintf(state.stdout(), "Warning: packets were lost %d times, the capture couldn't keep up\n", overruns)
+	}
+	return nil
+}
+
+// receivePackets writes the packets logged to the nflog socket to the pcap file until
+// the capture is interrupted or its deadline passes. It returns the number of packets and
+// of socket buffer overruns
+func receivePackets(fd int, pcap *pcapWriter, path string, interrupted <-chan struct{}, deadline <-chan time.Time) (int, int, error) {
+	packets, overruns := 0, 0
+	buffer := make([]byte, 1<<16)
+	for {
+		select {
+		case <-interrupted:
+			return packets, overruns, nil
+		case <-deadline:
+			return packets, overruns, nil
+		default:
+		}
+
+		n, _, err := unix.Recvfrom(fd, buffer, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err == unix.ENOBUFS {
+			// The socket buffer overflowed, the packets in it are lost
+			overruns++
+			continue
+		}
+		if err != nil {
+			return packets, overruns, fmt.Errorf("failed to receive packets: %v", err)
+		}
+		messages, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+		for _, message := range messages {
+			if payload, stamp, ok := parseNflogPacket(message); ok {
+				if err := pcap.writePacket(stamp, payload); err != nil {
+					return packets, overruns, fmt.Errorf("failed to write %s: %v", path, err)
+				}
+				packets++
+			}
+		}
+	}
+}
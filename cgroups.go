@@ -1,3 +1,5 @@
+//go:build linux
+
 package main
 
 import (
@@ -6,6 +8,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -297,13 +300,433 @@ func moveProcessToCpuCgroupV1(state *JailerState, pid int) error {
 	return nil
 }
 
+// jailCgroupPath returns the dedicated cgroup of a jail with a custom CPU limit or with
+// rdma or misc limits, nested below the original cgroup of the jail when it could be
+func jailCgroupPath(state *JailerState, jail *Jail) string {
+	if jail.CgroupPath != "" {
+		return jail.CgroupPath
+	}
+	return filepath.Join(filepath.Dir(state.CpuCgroupPath), fmt.Sprintf("jail-%d", jail.PID))
+}
+
+// setupJailCgroup creates the dedicated cgroup of a jail and applies its CPU, RDMA, misc
+// and memory limits and its OOM group
+func setupJailCgroup(state *JailerState, jail *Jail) (err error) {
+	span := startSpan("cgroup.setup", intAttribute("process.pid", jail.PID))
+	defer func() { span.end(err) }()
+
+	// Without the rdma or misc controller the limits cannot be enforced at all
+	for _, controller := range []string{"rdma", "misc"} {
+		if jail.HasJailType(controller) {
+			if err := enableCgroupController(state, controller); err != nil {
+				return err
+			}
+		}
+	}
+	if (jail.OomGroup || jail.HasJailType("memory")) && state.CgroupVersion == 2 {
+		if err := enableCgroupController(state, "memory"); err != nil {
+			return err
+		}
+	}
+
+	cgroupPath := jailCgroupPath(state, jail)
+	if err := os.MkdirAll(cgroupPath, 0755); err != nil {
+		return fmt.Errorf("failed to create jail cgroup directory: %v", err)
+	}
+
+	if err := setupJailCgroupCpuLimit(state, jail, cgroupPath); err != nil {
+		return err
+	}
+	if jail.HasJailType("rdma") {
+		if err := setupRdmaLimits(state, jail); err != nil {
+			return err
+		}
+	}
+	if jail.HasJailType("misc") {
+		if err := setupMiscLimits(state, jail); err != nil {
+			return err
+		}
+	}
+	if jail.HasJailType("memory") {
+		if err := setupMemoryLimit(state, jail); err != nil {
+			return err
+		}
+	}
+	if jail.OomGroup {
+		if err := setupJailOomGroup(cgroupPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupJailOomGroup sets memory.oom.group on the dedicated cgroup of a jail: when the OOM
+// killer picks a process of the tree, whether at a limit or on a host out of memory, the
+// whole tree dies together instead of leaving a crippled half-alive service
+func setupJailOomGroup(cgroupPath string) error {
+	oomGroupFile := filepath.Join(cgroupPath, "memory.oom.group")
+	if err := os.WriteFile(oomGroupFile, []byte("1\n"), 0644); err != nil {
+		return fmt.Errorf("failed to set memory.oom.group in %s: %v", cgroupPath, err)
+	}
+	fmt.Printf("OOM group set in %s, the OOM killer takes the whole tree\n", cgroupPath)
+	return nil
+}
+
+// setupJailCgroupCpuLimit applies the CPU limit of a jail to its dedicated cgroup, the
+// shared 1% limit applies when the cpu jail has no custom limit. A weight replaces the quota
+func setupJailCgroupCpuLimit(state *JailerState, jail *Jail, cgroupPath string) error {
+	percent := effectiveCpuPercent(jail, time.Now())
+	if percent == 0 && jail.HasJailType("cpu") && jail.CpuWeight == 0 {
+		percent = 1
+	}
+
+	// 1% of one core is 1ms of every 100ms period
+	quota := strconv.Itoa(percent * 1000)
+	if err := setupJailCgroupCpuWeight(state, jail, cgroupPath); err != nil {
+		return err
+	}
+
+	// The kernel refuses a burst over the quota, a smaller burst goes first when the quota
+	// shrinks and a larger one once it grew
+	burstFile, burst, err := cpuBurstFile(state, jail, cgroupPath, percent)
+	if err != nil {
+		return err
+	}
+	burstWritten := false
+	if burstFile != "" {
+		if current, err := readCgroupValue(burstFile); err != nil || burst < current {
+			if err := writeCpuBurst(burstFile, burst); err != nil {
+				return err
+			}
+			burstWritten = true
+		}
+	}
+
+	if state.CgroupVersion == 2 {
+		// Processes only there for their rdma, misc or network limits are not throttled,
+		// nested cgroups may not even have the cpu controller then
+		if percent == 0 {
+			quota = "max"
+		}
+		cpuMaxFile := filepath.Join(cgroupPath, "cpu.max")
+		if _, err := os.Stat(cpuMaxFile); percent == 0 && os.IsNotExist(err) {
+			return nil
+		}
+		if err := os.WriteFile(cpuMaxFile, []byte(quota+" 100000\n"), 0644); err != nil {
+			return fmt.Errorf("failed to set CPU limit in %s: %v", cpuMaxFile, err)
+		}
+	} else {
+		cpuCfsPeriodFile := filepath.Join(cgroupPath, "cpu.cfs_period_us")
+		if err := os.WriteFile(cpuCfsPeriodFile, []byte(cpuPeriod), 0644); err != nil {
+			return fmt.Errorf("failed to set CPU period in %s: %v", cpuCfsPeriodFile, err)
+		}
+
+		if percent == 0 {
+			quota = "-1"
+		}
+		cpuCfsQuotaFile := filepath.Join(cgroupPath, "cpu.cfs_quota_us")
+		if err := os.WriteFile(cpuCfsQuotaFile, []byte(quota+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to set CPU quota in %s: %v", cpuCfsQuotaFile, err)
+		}
+	}
+
+	if burstFile != "" && !burstWritten {
+		if err := writeCpuBurst(burstFile, burst); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case jail.Adaptive != nil:
+		// Adjusted every few seconds, info shows the current limit
+		if jail.Adaptive.sampledAt.IsZero() {
+			fmt.Fprintf(state.stdout(), "CPU limit of %s adapting to keep the host under %d%%, at most %d%% of one core\n",
+				cgroupPath, jail.Adaptive.TargetPercent, jail.CpuPercent)
+		}
+	case jail.Squeeze != nil:
+		jail.Squeeze.Applied = percent
+		fmt.Fprintf(state.stdout(), "CPU limit set to %d%% of one core in %s, squeezed down to %d%% by %s\n", percent, cgroupPath,
+			jail.CpuPercent, jail.Squeeze.Since.Add(jail.Squeeze.Over).Format(time.TimeOnly))
+	case jail.CpuWeight > 0:
+		fmt.Fprintf(state.stdout(), "CPU weight set to %d (default %d) in %s, no quota\n", jail.CpuWeight, defaultCpuWeight, cgroupPath)
+	case percent > 0 && jail.CpuBurst > 0:
+		fmt.Fprintf(state.stdout(), "CPU limit set to %d%% of one core in %s, bursts up to %s\n", percent, cgroupPath, jail.CpuBurst)
+	case percent > 0:
+		fmt.Fprintf(state.stdout(), "CPU limit set to %d%% of one core in %s\n", percent, cgroupPath)
+	}
+	return nil
+}
+
+// cpuBurstFile returns the burst file of a cgroup, cpu.max.burst or cpu.cfs_burst_us
+// with cgroups v1, and the burst to write in microseconds within the current quota. No
+// file when the kernel has none and the jail no burst
+func cpuBurstFile(state *JailerState, jail *Jail, cgroupPath string, percent int) (string, uint64, error) {
+	file := filepath.Join(cgroupPath, "cpu.max.burst")
+	if state.CgroupVersion == 1 {
+		file = filepath.Join(cgroupPath, "cpu.cfs_burst_us")
+	}
+	burst := uint64(min(jail.CpuBurst, time.Duration(percent)*time.Millisecond) / time.Microsecond)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if jail.CpuBurst > 0 {
+			return "", 0, fmt.Errorf("CPU burst is not available in %s, it needs Linux 5.14 or later", cgroupPath)
+		}
+		return "", 0, nil
+	}
+	return file, burst, nil
+}
+
+// writeCpuBurst writes the burst of a cgroup in microseconds
+func writeCpuBurst(file string, burst uint64) error {
+	if err := os.WriteFile(file, []byte(strconv.FormatUint(burst, 10)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to set CPU burst in %s: %v", file, err)
+	}
+	return nil
+}
+
+// setupJailCgroupCpuWeight applies the weight of a proportional CPU jail to its dedicated
+// cgroup, cpu.shares on cgroups v1 where the default is 1024. Without weight the default
+// applies, the cgroup may have had one before
+func setupJailCgroupCpuWeight(state *JailerState, jail *Jail, cgroupPath string) error {
+	weight := defaultCpuWeight
+	if jail.CpuWeight > 0 {
+		weight = jail.CpuWeight
+	}
+
+	file, value := filepath.Join(cgroupPath, "cpu.weight"), strconv.Itoa(weight)
+	if state.CgroupVersion == 1 {
+		file, value = filepath.Join(cgroupPath, "cpu.shares"), strconv.Itoa(max(2, weight*1024/defaultCpuWeight))
+	}
+	if _, err := os.Stat(file); jail.CpuWeight == 0 && os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.WriteFile(file, []byte(value+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to set CPU weight in %s: %v", file, err)
+	}
+	return nil
+}
+
+// jailTypeControllers returns the cgroup controllers a jail type needs in the dedicated
+// cgroup of a jail on cgroups v2
+func jailTypeControllers(jailType string) []string {
+	switch jailType {
+	case "cpu", "memory", "rdma", "misc":
+		return []string{jailType}
+	}
+	return nil
+}
+
+// delegateController enables a controller for the children of a cgroup v2, which the
+// kernel refuses while the cgroup holds processes of its own
+func delegateController(cgroupPath, controller string) error {
+	if content, err := os.ReadFile(filepath.Join(cgroupPath, "cgroup.subtree_control")); err == nil {
+		for _, enabled := range strings.Fields(string(content)) {
+			if enabled == controller {
+				return nil
+			}
+		}
+	}
+	controllersFile := filepath.Join(cgroupPath, "cgroup.subtree_control")
+	if err := os.WriteFile(controllersFile, []byte("+"+controller+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to enable the %s controller in %s: %v", controller, cgroupPath, err)
+	}
+	return nil
+}
+
+// nestJailCgroup places the dedicated cgroup of a jail below the original cgroup of its
+// main process on cgroups v2 when the first cgroup-based type is applied, so that the
+// accounting and delegation of the systemd unit still cover the jailed processes. The
+// cgroup stays at the top level when the original cgroup can't give the controllers of
+// the jail type to a child, a type added later to a nested jail fails instead
+func nestJailCgroup(state *JailerState, jail *Jail, jailType string) error {
+	if state.CgroupVersion != 2 || jailType == "proxy" || !isCgroupJailType(jailType) {
+		return nil
+	}
+	controllers := jailTypeControllers(jailType)
+
+	if jail.CgroupPath != "" {
+		parent := filepath.Dir(jail.CgroupPath)
+		for _, controller := range controllers {
+			if err := delegateController(parent, controller); err != nil {
+				return fmt.Errorf("the jail cgroup of process %d is nested in %s: %v", jail.PID, parent, err)
+			}
+		}
+		return nil
+	}
+
+	// The jails already at the top level stay there
+	for _, other := range jail.JailTypes {
+		if other != jailType && isCgroupJailType(other) {
+			return nil
+		}
+	}
+	// The network jails of containers match the shared cgroups of the rules in their namespace
+	if jailType == "network" {
+		if shared, err := sharesJailerNetNamespace(jail.PID); err != nil || !shared {
+			return nil
+		}
+	}
+	if jail.OriginalCgroup == "" || jail.OriginalCgroup == "/" {
+		return nil
+	}
+
+	parent := filepath.Join("/sys/fs/cgroup", strings.TrimPrefix(jail.OriginalCgroup, "/"))
+	for _, controller := range controllers {
+		if err := delegateController(parent, controller); err != nil {
+			fmt.Fprintf(state.stdout(), "Note: not nesting the jail cgroup of process %d in %s: %v\n", jail.PID, jail.OriginalCgroup, err)
+			return nil
+		}
+	}
+	cgroupPath := filepath.Join(parent, fmt.Sprintf("jail-%d", jail.PID))
+	if err := os.MkdirAll(cgroupPath, 0755); err != nil {
+		fmt.Fprintf(state.stdout(), "Note: not nesting the jail cgroup of process %d in %s: %v\n", jail.PID, jail.OriginalCgroup, err)
+		return nil
+	}
+	jail.CgroupPath = cgroupPath
+	fmt.Fprintf(state.stdout(), "Jail cgroup of process %d nested in %s\n", jail.PID, jail.OriginalCgroup)
+	return nil
+}
+
+// moveProcessToJailCgroup moves a process to the dedicated cgroup of a jail
+func moveProcessToJailCgroup(state *JailerState, jail *Jail, pid int) error {
+	procsFile := filepath.Join(jailCgroupPath(state, jail), "cgroup.procs")
+	pidStr := strconv.Itoa(pid) + "\n"
+
+	if err := os.WriteFile(procsFile, []byte(pidStr), 0644); err != nil {
+		return fmt.Errorf("failed to move PID %d to jail cgroup: %v", pid, err)
+	}
+
+	return nil
+}
+
+// moveProcessToJailCgroups moves a process to the cgroup matching the cgroup-based types of the jail
+func moveProcessToJailCgroups(state *JailerState, jail *Jail, pid int) (err error) {
+	span := startSpan("cgroup.move", intAttribute("process.pid", pid), stringAttribute("jail.types", jail.GetJailTypesString()))
+	defer func() { span.end(err) }()
+
+	hasNetwork := jail.HasJailType("network")
+	hasCpu := jail.HasJailType("cpu")
+
+	// A network jail with a classid of its own filters the traffic through its own net_cls
+	// cgroup, the other cgroups only follow the remaining types
+	if hasNetwork && jail.ClassID != "" {
+		if err := moveProcessToClassCgroup(jail, pid); err != nil {
+			return err
+		}
+		hasNetwork = false
+	}
+
+	// The memory limit is in the memory hierarchy on v1, apart from the other cgroups
+	if state.CgroupVersion == 1 && !jail.HasJailType("proxy") {
+		if err := moveProcessMemoryCgroupV1(jail, pid); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case jail.HasJailType("proxy"):
+		// The proxy jail is never combined with the other cgroup-based types
+		return moveProcessToProxyCgroup(state, pid)
+	case jail.usesDedicatedCgroup():
+		// Custom CPU, RDMA, misc and memory limits use a dedicated cgroup, the network jail
+		// only needs net_cls on v1
+		if hasNetwork && state.CgroupVersion == 1 {
+			if err := moveProcessToCgroup(state, pid); err != nil {
+				return err
+			}
+		}
+		return moveProcessToJailCgroup(state, jail, pid)
+	case hasNetwork && hasCpu:
+		return moveProcessToCombinedCgroup(state, pid, "network,cpu")
+	case hasCpu:
+		return moveProcessToCpuCgroup(state, pid)
+	case hasNetwork:
+		return moveProcessToCgroup(state, pid)
+	case jail.HasJailType("network"):
+		// Only the net_cls cgroup of the network jail applies
+		return nil
+	default:
+		// No cgroup-based jail left, go back to the original cgroup
+		return restoreProcessCgroup(state, pid, jail.originalCgroupOf(pid))
+	}
+}
+
+// removeJailCgroup removes the dedicated cgroup of a jail once it is empty, the next
+// cgroup-based jail type decides again where it goes
+func removeJailCgroup(state *JailerState, jail *Jail) {
+	cleanupEmptyCgroup(jailCgroupPath(state, jail), "dedicated jail")
+	if state.CgroupVersion == 1 {
+		cleanupEmptyCgroup(memoryCgroupPathV1(jail.PID), "memory jail")
+	}
+	jail.CgroupPath = ""
+}
+
 // restoreProcessCgroup restores a process to its original cgroup
-func restoreProcessCgroup(state *JailerState, pid int, originalCgroup string) error {
+func restoreProcessCgroup(state *JailerState, pid int, originalCgroup string) (err error) {
+	span := startSpan("cgroup.restore", intAttribute("process.pid", pid), stringAttribute("cgroup.path", originalCgroup))
+	defer func() { span.end(err) }()
+
+	cgroup, note := restoreDestination("/sys/fs/cgroup", state.CgroupVersion, originalCgroup, state.Config.CgroupFallback)
+	if note != "" {
+		fmt.Fprintf(state.stdout(), "Warning: original cgroup %s of PID %d no longer exists, %s\n", originalCgroup, pid, note)
+	}
 	if state.CgroupVersion == 2 {
-		return restoreProcessCgroupV2(pid, originalCgroup)
+		return restoreProcessCgroupV2(pid, cgroup)
 	} else {
-		return restoreProcessCgroupV1(pid, originalCgroup)
+		return restoreProcessCgroupV1(pid, cgroup)
+	}
+}
+
+// cgroupDirs returns the directories of a cgroup under the mount point, one per
+// subsystem with cgroups v1
+func cgroupDirs(root string, version int, cgroup string) []string {
+	cgroup = strings.TrimPrefix(cgroup, "/")
+	if version == 2 {
+		return []string{filepath.Join(root, cgroup)}
+	}
+	var dirs []string
+	for _, subsys := range []string{"memory", "pids", "net_cls", "cpu"} {
+		dirs = append(dirs, filepath.Join(root, subsys, cgroup))
+	}
+	return dirs
+}
+
+// cgroupExists checks if a cgroup exists in every hierarchy it is restored to
+func cgroupExists(root string, version int, cgroup string) bool {
+	for _, dir := range cgroupDirs(root, version, cgroup) {
+		if _, err := os.Stat(dir); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreDestination returns the cgroup a process goes back to when unjailed, its original
+// cgroup or the fallback when the original was removed meanwhile (service restarted,
+// container gone), with a note of what happened then. The root cgroup is the last resort
+func restoreDestination(root string, version int, originalCgroup, fallback string) (string, string) {
+	if cgroupExists(root, version, originalCgroup) {
+		return originalCgroup, ""
+	}
+	switch {
+	case fallback == "recreate":
+		var err error
+		for _, dir := range cgroupDirs(root, version, originalCgroup) {
+			if err = os.MkdirAll(dir, 0755); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return originalCgroup, "re-created it"
+		}
+		return "/", fmt.Sprintf("failed to re-create it (%v), moved to the root cgroup instead", err)
+	case strings.HasPrefix(fallback, "/"):
+		if cgroupExists(root, version, fallback) {
+			return fallback, "moved to " + fallback + " instead"
+		}
+		return "/", fmt.Sprintf("neither does the fallback %s, moved to the root cgroup instead", fallback)
 	}
+	return "/", "moved to the root cgroup instead"
 }
 
 // restoreProcessCgroupV2 restores a process to its original cgroup (v2)
@@ -406,26 +829,26 @@ func moveProcessToCombinedCgroup(state *JailerState, pid int, combinedJailType s
 	// Ensure the combined cgroup directory is created for both cpu and net_cls
 	netClsDir := filepath.Join("/sys/fs/cgroup/net_cls", JailNetworkCpuCgroup)
 	if err := os.MkdirAll(netClsDir, 0755); err != nil {
-		fmt.Printf("Error creating net_cls directory for combined jail: %v\n", err)
+		fmt.Fprintf(state.stdout(), "Error creating net_cls directory for combined jail: %v\n", err)
 		return fmt.Errorf("failed to create net_cls directory for combined jail: %v", err)
 	}
 
 	// Move the process to the combined cgroup
 	procsFile := filepath.Join(combinedCgroupPath, "cgroup.procs")
 	pidStr := strconv.Itoa(pid) + "\n"
-	fmt.Printf("Attempting to move PID %d to combined cgroup: %s\n", pid, combinedCgroupPath)
+	fmt.Fprintf(state.stdout(), "Attempting to move PID %d to combined cgroup: %s\n", pid, combinedCgroupPath)
 	if err := os.WriteFile(procsFile, []byte(pidStr), 0644); err != nil {
-		fmt.Printf("Error moving PID %d to combined cgroup %s: %v\n", pid, combinedCgroupPath, err)
+		fmt.Fprintf(state.stdout(), "Error moving PID %d to combined cgroup %s: %v\n", pid, combinedCgroupPath, err)
 		return fmt.Errorf("failed to move PID %d to combined cgroup %s: %v", pid, combinedCgroupPath, err)
 	}
 
 	// Move the process to the net_cls cgroup
 	netClsProcsFile := filepath.Join(netClsDir, "cgroup.procs")
 	if err := os.WriteFile(netClsProcsFile, []byte(pidStr), 0644); err != nil {
-		fmt.Printf("Error moving PID %d to net_cls combined cgroup %s: %v\n", pid, netClsDir, err)
+		fmt.Fprintf(state.stdout(), "Error moving PID %d to net_cls combined cgroup %s: %v\n", pid, netClsDir, err)
 		return fmt.Errorf("failed to move PID %d to net_cls combined cgroup %s: %v", pid, netClsDir, err)
 	}
 
-	fmt.Printf("Successfully moved PID %d to combined cgroup: %s\n", pid, combinedJailType)
+	fmt.Fprintf(state.stdout(), "Successfully moved PID %d to combined cgroup: %s\n", pid, combinedJailType)
 	return nil
 }
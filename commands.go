@@ -0,0 +1,1228 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chzyer/readline"
+)
+
+// commandFunc runs a command with its positional arguments once its flags are parsed
+type commandFunc func(state *JailerState, args []string) error
+
+// command describes a jailer command. Its flags are declared on a flag set so that
+// parsing, usage errors, help and completion all come from the same definition
+type command struct {
+	name     string
+	aliases  []string
+	args     string   // Positional arguments in the usage, e.g. "<pid>"
+	summary  string   // One-line description
+	details  []string // Extra help lines, e.g. the forms of the arguments
+	minArgs  int
+	maxArgs  int      // -1 when unlimited
+	rawAfter int      // Words after this many arguments are passed as they are, 0 when flags may appear anywhere
+	words    []string // Completions of the first argument, e.g. jail types
+	pids     bool     // PIDs are completed by the shell completion
+	setup    func(fs *flag.FlagSet) commandFunc
+}
+
+// commandTable lists the commands in the order of the help, filled by init since the help
+// command refers to it
+var commandTable []*command
+
+// jailTypeWords and unjailTypeWords are the jail types completed after jail and unjail
+var (
+	jailTypeWords   = []string{"network", "n", "proxy", "cpu", "c", "both", "memory", "rlimit", "oom", "coredump", "rdma", "misc", "quota"}
+	unjailTypeWords = []string{"network", "n", "proxy", "cpu", "c", "memory", "rlimit", "oom", "coredump", "rdma", "misc", "quota"}
+)
+
+// firewallJailTypes are the jail types installing firewall rules
+var firewallJailTypes = []string{"network", "n", "proxy"}
+
+// knownJailType checks if a normalized jail type is accepted by the jail command
+func knownJailType(jailType string) bool {
+	for _, word := range jailTypeWords {
+		if word == jailType {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	commandTable = []*command{
+		{
+			name: "jail", args: "<type> <pid>|<first-last>|@<pidfile> [...] [type arguments]",
+			summary: "Put processes and their descendants in a jail",
+			details: []string{
+				"jail <type> [type arguments] where <selector> - Jail every process matching the selector",
+				"  e.g. jail cpu 20% where name=~\"chrome\" && user==\"alice\" && cpu>50",
+				"  fields: pid ppid name cmdline user cpu memory jailed, operators: == != =~ !~ < <= > >= && || ! ( )",
+				"jail network|n <pid>        - Block network access",
+				"jail proxy <pid>            - Only allow connections to the configured network_proxy",
+				"jail cpu|c <pid> [N%]       - Limit CPU usage (1% by default)",
+				"jail both <pid>             - Apply both network and CPU jails",
+				"jail network,cpu=20%,oom <pid> - Combine jail types, the arguments of a type after = joined by +",
+				"  (e.g. jail cpu,rlimit=nofile=256+nproc=64 <pid>), arguments after the PIDs go to the last type",
+				"jail rlimit <pid> <resource>=<value> ... (e.g. nofile=256 fsize=100M)",
+				"jail oom <pid>              - Make process the first OOM killer victim",
+				"jail coredump <pid>         - Prevent process from dumping core",
+				"jail rdma <pid> <device>:<resource>=<value> ... (e.g. mlx5_0:hca_handle=2)",
+				"jail misc <pid> <resource>=<value> ... (e.g. sev=1)",
+				"jail quota <pid> <size> [dir...] - Cap the bytes written to the directories of the process",
+				"jail <type> container:<id|name> - Jail the processes of a Docker or Podman container",
+				"jail <type> lxd:<name>      - Jail the processes of an LXD system container",
+				"jail <type> <pid> --in container:<id|name> - PIDs as seen in the container, e.g. by its ps",
+				"jail <type> <pid> --between 09:00-18:00 - Only apply the jail within a daily window",
+				"jail <type> <pid> --for 2h  - Release the jail automatically, extend it with extend <pid> 1h",
+				"jail cpu <pid> --squeeze 50%:5m - Tighten the CPU limit down to 50% in steps over 5 minutes",
+				"jail cpu <pid> [limit] --adaptive 70% - Adjust the CPU limit to keep the host under 70%",
+				"jail cpu <pid> 20% --burst 20ms - Let the tree spend up to 20ms saved while idle over its quota",
+				"jail cpu <pid> 50% --oom-group - The OOM killer takes the whole tree together, not a single process",
+				"jail cpu <pid> --weight 10 - Lower the CPU weight instead of limiting, the default is 100",
+				"jail network <pid> --allow-iface eth1 - Keep the traffic on these interfaces going",
+				"jail network <pid> --block-country CN,RU - Only drop the traffic with these countries",
+				"jail <type> <pid> --verbose - List every descendant the jail failed on, info <pid> lists them later",
+				"jail <type> <pid> --yes     - Don't ask before jailing confirm_descendants descendants or more (50 by default)",
+				"jail <type> <pid> --force   - Jail more than max_jail_processes processes at once (500 by default)",
+			},
+			minArgs: 2, maxArgs: -1, words: jailTypeWords, pids: true,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				var options JailOptions
+				fs.StringVar(&options.Reason, "reason", "", "record why the process is jailed, as `text`")
+				fs.BoolVar(&options.OomGroup, "oom-group", false, "make the OOM killer take the whole tree together (cgroups v2)")
+				fs.BoolVar(&options.AllowEstablished, "allow-established", false, "keep the sessions open when a network jail is applied")
+				allowIface := fs.String("allow-iface", "", "keep the comma-separated `interfaces` reachable from a network jail, e.g. eth1")
+				blockCountry := fs.String("block-country", "", "drop the traffic of a network jail with the comma-separated `countries`, e.g. CN,RU")
+				allowCountry := fs.String("allow-country", "", "only let a network jail reach the comma-separated `countries`")
+				fs.BoolVar(&options.Persistent, "persistent", false, "keep the jail when jailer exits with -keep-jails-on-exit")
+				between := fs.String("between", "", "only apply the jail within a daily `window`, e.g. 09:00-18:00")
+				adaptive := fs.String("adaptive", "", "adjust the CPU limit to keep the host utilization under a `target`, e.g. 70%")
+				burst := fs.String("burst", "", "let the jail spend CPU time saved while idle over its quota, up to a `duration` per period, e.g. 20ms")
+				weight := fs.Int("weight", 0, "lower the CPU `weight` instead of limiting, 1 to 10000 where the default is 100")
+				squeeze := fs.String("squeeze", "", "tighten the CPU limit down to `limit:duration` in steps, e.g. 50%:5m")
+				expiry := fs.String("for", "", "release the jail automatically after a `duration`, e.g. 2h")
+				dryRun := fs.Bool("dry-run", false, "show the processes a selector matches without jailing them")
+				fs.BoolVar(&options.Verbose, "verbose", false, "list every descendant the jail failed on instead of a summary")
+				yes := fs.Bool("yes", false, "jail without asking when the targets have confirm_descendants descendants or more")
+				force := fs.Bool("force", false, "jail even when more than max_jail_processes processes would be moved")
+				namespace := fs.String("in", "", "the PIDs are seen in the PID namespace of `container:<id|name>`, lxd:<name> or pid:<host pid>")
+				return func(state *JailerState, args []string) error {
+					// Ctrl+C stops the moves of large trees instead of exiting jailer
+					_, done := startInterruptible()
+					defer done()
+					var pids []int
+					var typeArgs []string
+					var err error
+					if where := selectorStart(args); where > 0 {
+						if *namespace != "" {
+							return fmt.Errorf("--in doesn't apply to selectors, they match the processes of the host")
+						}
+						var matches []processSnapshot
+						if matches, err = selectProcesses(state, args[where+1:]); err != nil {
+							return err
+						}
+						if *dryRun {
+							printSelection(state.stdout(), matches, "jailed")
+							return nil
+						}
+						if len(matches) == 0 {
+							return fmt.Errorf("no process matches the selector")
+						}
+						for _, process := range matches {
+							pids = append(pids, process.PID)
+						}
+						typeArgs = args[1:where]
+					} else if *dryRun {
+						return fmt.Errorf("--dry-run needs a where selector")
+					} else if pids, typeArgs, err = parsePidTargets(args[1:]); err != nil {
+						return err
+					} else if *namespace != "" {
+						if pids, err = translateNamespacePids(*namespace, pids); err != nil {
+							return err
+						}
+					}
+					specs, err := parseJailSpecs(args[0], typeArgs)
+					if err != nil {
+						return err
+					}
+					jailTypes, cpu := jailSpecTypes(specs), findJailSpec(specs, "cpu")
+					if options.OomGroup && !slices.ContainsFunc(jailTypes, func(jailType string) bool {
+						return isCgroupJailType(jailType) && jailType != "proxy"
+					}) {
+						return fmt.Errorf("--oom-group needs a jail type moving the tree to a cgroup of its own: cpu, network, rdma or misc")
+					}
+					if options.AllowEstablished && !slices.Contains(jailTypes, "network") {
+						return fmt.Errorf("--allow-established only applies to network jails")
+					}
+					if *allowIface != "" {
+						if !slices.Contains(jailTypes, "network") {
+							return fmt.Errorf("--allow-iface only applies to network jails")
+						}
+						if options.AllowIfaces, err = parseAllowedIfaces(*allowIface); err != nil {
+							return err
+						}
+					}
+					if *blockCountry != "" || *allowCountry != "" {
+						if !slices.Contains(jailTypes, "network") {
+							return fmt.Errorf("--block-country and --allow-country only apply to network jails")
+						}
+						if *blockCountry != "" && *allowCountry != "" {
+							return fmt.Errorf("--block-country and --allow-country can't be combined")
+						}
+						if *blockCountry != "" {
+							options.BlockCountries, err = parseCountries(*blockCountry)
+						} else {
+							options.AllowCountries, err = parseCountries(*allowCountry)
+						}
+						if err != nil {
+							return err
+						}
+					}
+					if *squeeze != "" {
+						if cpu == nil {
+							return fmt.Errorf("--squeeze only applies to cpu jails")
+						}
+						if len(cpu.Args) > 0 {
+							return fmt.Errorf("--squeeze gives the CPU limit, it can't be given again")
+						}
+						percent, over, err := parseSqueeze(*squeeze)
+						if err != nil {
+							return err
+						}
+						cpu.Args = []string{fmt.Sprintf("%d%%", percent)}
+						options.SqueezeOver = over
+					}
+					if *adaptive != "" {
+						if cpu == nil {
+							return fmt.Errorf("--adaptive only applies to cpu jails")
+						}
+						if *squeeze != "" {
+							return fmt.Errorf("--adaptive and --squeeze can't be combined")
+						}
+						if options.AdaptiveTarget, err = parseAdaptiveTarget(*adaptive); err != nil {
+							return err
+						}
+						// The limit given is the ceiling of the adjustments, every core by default
+						if len(cpu.Args) == 0 {
+							cpu.Args = []string{fmt.Sprintf("%d%%", 100*runtime.NumCPU())}
+						}
+					}
+					if *burst != "" {
+						if cpu == nil {
+							return fmt.Errorf("--burst only applies to cpu jails")
+						}
+						if options.CpuBurst, err = parseCpuBurst(*burst); err != nil {
+							return err
+						}
+					}
+					if *weight != 0 {
+						if cpu == nil {
+							return fmt.Errorf("--weight only applies to cpu jails")
+						}
+						if len(cpu.Args) > 0 || *squeeze != "" || *adaptive != "" {
+							return fmt.Errorf("--weight replaces the CPU limit, it can't be combined with one")
+						}
+						cpu.Args = []string{fmt.Sprintf("weight=%d", *weight)}
+					}
+					if options.For, err = parseJailExpiry(*expiry); err != nil {
+						return err
+					}
+					if *between != "" {
+						if options.For > 0 {
+							return fmt.Errorf("--for doesn't apply to jails with --between")
+						}
+						window, err := parseTimeWindow(*between)
+						if err != nil {
+							return err
+						}
+						return scheduleJails(state, specs, pids, options, window)
+					}
+					groups, descendants := collectDescendants(state, pids)
+					if err := checkJailSize(state, len(pids), descendants, *force); err != nil {
+						return fmt.Errorf("%v, check the targets or add --force", err)
+					}
+					if proceed, err := previewDescendants(state, pids, groups, descendants, *yes); err != nil || !proceed {
+						return err
+					}
+					before := snapshotJails(state, pids)
+					err = jailTargets(state, specs, pids, options)
+					recordOperation(state, "jail "+strings.Join(args, " "), pids, before)
+					return err
+				}
+			},
+		},
+		{
+			name: "run", args: "<type>[=<option>][,<type>...] -- <command> [args...]",
+			summary: "Start a command directly inside a jail",
+			details: []string{"e.g. run network,cpu=5%,syscall=no-network -- ./binary"},
+			minArgs: 2, maxArgs: -1, rawAfter: 1,
+			words: []string{"network", "proxy", "cpu", "syscall", "landlock", "readonly"},
+			setup: func(fs *flag.FlagSet) commandFunc {
+				var options JailOptions
+				fs.StringVar(&options.Reason, "reason", "", "record why the command is jailed, as `text`")
+				fs.BoolVar(&options.Persistent, "persistent", false, "keep the jail when jailer exits with -keep-jails-on-exit")
+				expiry := fs.String("for", "", "release the jail automatically after a `duration`, e.g. 2h")
+				return func(state *JailerState, args []string) error {
+					var err error
+					if options.For, err = parseJailExpiry(*expiry); err != nil {
+						return err
+					}
+					return runJailedCommand(state, args[0], args[1:], options)
+				}
+			},
+		},
+		{
+			name: "unjail", args: "[type] <pid> | all",
+			summary: "Remove all jails, or one jail type, from a process",
+			details: []string{
+				"unjail all releases every active jail, persistent ones included, after a confirmation",
+				"  and reports the processes that failed, undo brings the jails back",
+				"unjail [type] name:<pattern> - Release the jailed processes whose name matches a glob or substring",
+				"unjail [type] where <selector> - Release the jailed processes matching the selector, as for jail",
+				"  e.g. unjail network where name=~\"chrome\" && user==\"alice\"",
+			},
+			minArgs: 1, maxArgs: -1, words: append([]string{"all"}, unjailTypeWords...), pids: true,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				yes := fs.Bool("yes", false, "release all the jails without asking, required without a terminal")
+				dryRun := fs.Bool("dry-run", false, "show the jailed processes a name pattern or selector matches without releasing them")
+				return func(state *JailerState, args []string) error {
+					// Ctrl+C stops the moves of large trees instead of exiting jailer
+					_, done := startInterruptible()
+					defer done()
+					if len(args) == 1 && strings.ToLower(args[0]) == "all" {
+						return unjailAll(state, *yes)
+					}
+					if *yes {
+						return fmt.Errorf("--yes only applies to unjail all")
+					}
+					if where := selectorStart(args); where == 0 || where == 1 {
+						jailType := ""
+						if where == 1 {
+							jailType = normalizeJailType(strings.ToLower(args[0]))
+						}
+						return unjailMatching(state, jailType, strings.Join(args[where:], " "), args[where+1:], *dryRun)
+					}
+					if len(args) > 2 {
+						return fmt.Errorf("usage: unjail [type] <pid> | all")
+					}
+					if target := args[len(args)-1]; strings.HasPrefix(target, "name:") {
+						jailType := ""
+						if len(args) == 2 {
+							jailType = normalizeJailType(strings.ToLower(args[0]))
+						}
+						return unjailMatching(state, jailType, target, nil, *dryRun)
+					}
+					if *dryRun {
+						return fmt.Errorf("--dry-run needs a name pattern or a where selector")
+					}
+					pid, err := parsePidArg(args[len(args)-1])
+					if err != nil {
+						return err
+					}
+					pidStr := strconv.Itoa(pid)
+					name := hostProcesses.name(pid)
+					event := AuditEvent{Action: "unjail"}
+					before := snapshotJails(state, []int{pid})
+					if len(args) == 1 {
+						dropJailSchedules(state, pid, "")
+						err = unjailProcess(state, pidStr)
+					} else {
+						jailType := normalizeJailType(strings.ToLower(args[0]))
+						event.JailTypes = []string{jailType}
+						dropJailSchedules(state, pid, jailType)
+						err = unjailProcessSelective(state, jailType, pidStr)
+					}
+					event.Targets = []AuditTarget{newAuditTarget(pid, name, err)}
+					writeAuditEvent(state, event)
+					recordOperation(state, "unjail "+strings.Join(args, " "), []int{pid}, before)
+					return err
+				}
+			},
+		},
+		{
+			name: "status", summary: "Show the cgroup and firewall setup, the jail count and the freshness of the blocklist feeds",
+			details: []string{"A feed is stale when its last refresh failed or it is older than twice the refresh interval"},
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					return showStatus(state)
+				}
+			},
+		},
+		{
+			name: "warnings", summary: "Show the alerts flagged by ! in the prompt, such as escapes and OOM kills",
+			details: []string{"The prompt shows jailer[<active jails>]>, and jailer[<active jails>!]> until the alerts are seen"},
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					return showWarnings(state.stdout())
+				}
+			},
+		},
+		{
+			name: "schedules", summary: "List the jails applied only within a window",
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					return showSchedules(state)
+				}
+			},
+		},
+		{
+			name: "mark", args: "<pid> persistent|ephemeral",
+			summary: "Keep a jail when jailer exits, or release it with the others",
+			details: []string{
+				"Persistent jails outlive a jailer run with -keep-jails-on-exit, e.g. to keep a compromised",
+				"process quarantined, ephemeral ones are released on exit",
+			},
+			minArgs: 2, maxArgs: 2, words: []string{"persistent", "ephemeral"}, pids: true,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					pid, err := parsePidArg(args[0])
+					if err != nil {
+						return err
+					}
+					switch strings.ToLower(args[1]) {
+					case "persistent":
+						return markJail(state, pid, true)
+					case "ephemeral":
+						return markJail(state, pid, false)
+					}
+					return fmt.Errorf("usage: mark <pid> persistent|ephemeral")
+				}
+			},
+		},
+		{
+			name: "extend", args: "<pid> <duration>",
+			summary: "Push back the release of a jail created with --for",
+			details: []string{"e.g. extend 1234 1h, the jails are notified expiry_warning (10m) before their release"},
+			minArgs: 2, maxArgs: 2, pids: true,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					pid, err := parsePidArg(args[0])
+					if err != nil {
+						return err
+					}
+					extension, err := parseDuration(args[1])
+					if err != nil {
+						return err
+					}
+					return extendJail(state, pid, extension)
+				}
+			},
+		},
+		{
+			name: "reclaim", args: "<pid> <bytes>",
+			summary: "Make the kernel reclaim memory of the jail cgroup of a process, without lowering a limit",
+			details: []string{"e.g. reclaim 1234 512M, through memory.reclaim on cgroups v2 (Linux 5.19 or later)",
+				"Only jails with a cgroup of their own, such as CPU-limited and network jails, can be reclaimed from"},
+			minArgs: 2, maxArgs: 2, pids: true,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					pid, err := parsePidArg(args[0])
+					if err != nil {
+						return err
+					}
+					amount, err := parseSize(args[1])
+					if err != nil {
+						return err
+					}
+					return reclaimJailMemory(state, pid, amount)
+				}
+			},
+		},
+		{
+			name: "simulate", args: "<type> <pid> [type arguments]",
+			summary: "Apply a jail for a while, report its impact and revert it",
+			details: []string{
+				"e.g. simulate network 1234 --duration 60s",
+				"CPU, error counters, dropped packets and sessions are compared before and during the jail",
+			},
+			minArgs: 2, maxArgs: -1, words: jailTypeWords, pids: true,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				durationText := fs.String("duration", "60s", "how long the jail is applied, as a `duration`")
+				return func(state *JailerState, args []string) error {
+					duration, err := parseDuration(*durationText)
+					if err != nil {
+						return err
+					}
+					jailType, err := normalizeJailSpec(args[0])
+					if err != nil {
+						return err
+					}
+					pid, err := parsePidArg(args[1])
+					if err != nil {
+						return err
+					}
+					return simulateJail(state, jailType, pid, args[2:], duration)
+				}
+			},
+		},
+		{
+			name: "undo", summary: "Revert the last jail or unjail command",
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					return undoLastOperation(state)
+				}
+			},
+		},
+		{
+			name: "checkpoint", args: "<pid> [dir]",
+			summary: "Dump a jailed process tree to disk with CRIU and stop it",
+			minArgs: 1, maxArgs: 2, pids: true,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					pid, err := parsePidArg(args[0])
+					if err != nil {
+						return err
+					}
+					imageDir := ""
+					if len(args) == 2 {
+						imageDir = args[1]
+					}
+					return checkpointProcess(state, strconv.Itoa(pid), imageDir)
+				}
+			},
+		},
+		{
+			name: "restore", args: "<dir>",
+			summary: "Restore a checkpointed process tree into its jail",
+			details: []string{"jailer restore without a directory, on the command line, re-creates the persistent jails after a reboot"},
+			minArgs: 1, maxArgs: 1,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					return restoreCheckpoint(state, args[0])
+				}
+			},
+		},
+		{
+			name: "script", args: "run <file> [args...]",
+			summary: "Run a Starlark playbook calling the jailer primitives, Ctrl+C stops it",
+			details: []string{
+				"jail(type, target, ..., reason=\"\")  unjail(pid, type=\"\")  run(\"<command line>\")",
+				"jails()  processes(pattern=\"\", user=\"\")  stats(pid)  sleep(seconds)  argv",
+			},
+			minArgs: 2, maxArgs: -1, rawAfter: 2, words: []string{"run"},
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					if args[0] != "run" {
+						return fmt.Errorf("unknown script subcommand: %s (expected run)", args[0])
+					}
+					return runScript(state, args[1], args[2:])
+				}
+			},
+		},
+		{
+			name: "list", summary: "List active jails, of every host with --all-hosts",
+			setup: func(fs *flag.FlagSet) commandFunc {
+				filter := addListFlags(fs)
+				fs.BoolVar(&filter.AllHosts, "all-hosts", false, "list the jails of every host from the state backend")
+				fs.BoolVar(&filter.JSON, "json", false, "print the jails as JSON")
+				return func(state *JailerState, args []string) error {
+					if filter.AllHosts {
+						return listAllHosts(state.stdout(), state.Config.StateBackend, *filter)
+					}
+					if filter.JSON {
+						return listJailsJSON(state, *filter)
+					}
+					listJails(state, *filter)
+					return nil
+				}
+			},
+		},
+		{
+			name: "history", summary: "Show the jails that ended, in this and the previous jailer runs",
+			details: []string{
+				"The ended jails are kept in history_log with who jailed and released them, when, how long",
+				"  and why, e.g. history --since 7d --name nginx for the review of an incident",
+			},
+			setup: func(fs *flag.FlagSet) commandFunc {
+				filter := &historyFilter{}
+				fs.Func("since", "only jails that ended within this `duration` (e.g. 7d, 12h)", func(value string) error {
+					var err error
+					filter.Since, err = parseDuration(value)
+					return err
+				})
+				fs.Func("name", "only processes whose name matches this glob or substring `pattern`", func(value string) error {
+					if _, err := filepath.Match(value, ""); err != nil {
+						return fmt.Errorf("invalid pattern: %s", value)
+					}
+					filter.NamePattern = value
+					return nil
+				})
+				fs.Func("type", "only jails of this `type`", func(value string) error {
+					filter.JailType = normalizeJailType(strings.ToLower(value))
+					return nil
+				})
+				fs.BoolVar(&filter.Wide, "wide", false, "don't truncate long names, types and reasons")
+				fs.BoolVar(&filter.JSON, "json", false, "print the ended jails as JSON")
+				return func(state *JailerState, args []string) error {
+					return showHistory(state, *filter)
+				}
+			},
+		},
+		{
+			name: "watch", args: "[interval]",
+			summary: "Redraw the jail list with live CPU/memory every 2s, Ctrl+C stops",
+			maxArgs: 1,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				filter := addListFlags(fs)
+				return func(state *JailerState, args []string) error {
+					interval := defaultWatchInterval
+					if len(args) == 1 {
+						var err error
+						if interval, err = parseWatchInterval(args[0]); err != nil {
+							return err
+						}
+					}
+					watchJails(state, interval, *filter)
+					return nil
+				}
+			},
+		},
+		{
+			name: "top", args: "[interval]",
+			summary: "Live CPU, throttling, memory and dropped packets per jail, Ctrl+C stops",
+			maxArgs: 1,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				sortBy := "cpu"
+				fs.Func("sort", "order the jails by `"+strings.Join(topSortKeys, "|")+"`", func(value string) error {
+					if !isTopSortKey(value) {
+						return fmt.Errorf("supported: %s", strings.Join(topSortKeys, ", "))
+					}
+					sortBy = value
+					return nil
+				})
+				wide := fs.Bool("wide", false, "don't truncate long names and types")
+				return func(state *JailerState, args []string) error {
+					interval := defaultWatchInterval
+					if len(args) == 1 {
+						var err error
+						if interval, err = parseWatchInterval(args[0]); err != nil {
+							return err
+						}
+					}
+					topJails(state, interval, sortBy, *wide)
+					return nil
+				}
+			},
+		},
+		{
+			name: "info", args: "<pid>",
+			summary: "Show everything known about the jail of a process",
+			minArgs: 1, maxArgs: 1, pids: true,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				wide := fs.Bool("wide", false, "don't truncate long values")
+				jsonOutput := fs.Bool("json", false, "print the jail as JSON")
+				return func(state *JailerState, args []string) error {
+					pid, err := parsePidArg(args[0])
+					if err != nil {
+						return err
+					}
+					if *jsonOutput {
+						return showJailInfoJSON(state, pid)
+					}
+					return showJailInfo(state, pid, *wide)
+				}
+			},
+		},
+		{
+			name: "connections", args: "<pid>",
+			summary: "List the TCP and UDP sockets of a process and its descendants",
+			minArgs: 1, maxArgs: 1, pids: true,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				listening := fs.Bool("listening", false, "only show listening and unconnected sockets")
+				return func(state *JailerState, args []string) error {
+					pid, err := parsePidArg(args[0])
+					if err != nil {
+						return err
+					}
+					return showConnections(state, pid, *listening)
+				}
+			},
+		},
+		{
+			name: "allow", args: "<pid> add|del <address>... | <pid> list",
+			summary: "Manage the addresses a network-jailed process may still reach",
+			details: []string{
+				"allow <pid> add 10.1.2.3 10.8.0.0/16 - Let the process reach addresses or networks",
+				"allow <pid> del 10.1.2.3             - Remove them from the allowlist",
+				"allow <pid> list                     - Show the allowlist",
+				"Each jail has its own nftables named sets, changes apply at once without rebuilding rules",
+			},
+			minArgs: 2, maxArgs: -1, pids: true,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					pid, err := parsePidArg(args[0])
+					if err != nil {
+						return err
+					}
+					switch action := strings.ToLower(args[1]); {
+					case action == "list" && len(args) == 2:
+						return showAllowlist(state, pid)
+					case (action == "add" || action == "del") && len(args) > 2:
+						return changeAllowlist(state, pid, action, args[2:])
+					}
+					return fmt.Errorf("usage: allow <pid> add|del <address>... or allow <pid> list")
+				}
+			},
+		},
+		{
+			name: "capture", args: "<pid> <file.pcap> [duration]",
+			summary: "Capture the traffic of the network jail to a pcap file, Ctrl+C stops",
+			details: []string{"Packets are copied ahead of the drop rules, so blocked attempts are captured too"},
+			minArgs: 2, maxArgs: 3, pids: true,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					pid, err := parsePidArg(args[0])
+					if err != nil {
+						return err
+					}
+					var duration time.Duration
+					if len(args) == 3 {
+						if duration, err = parseDuration(args[2]); err != nil {
+							return err
+						}
+					}
+					return capturePackets(state, pid, args[1], duration)
+				}
+			},
+		},
+		{
+			name: "find", args: "[pattern]",
+			summary: "Search processes by name or command line, with CPU/memory usage",
+			maxArgs: 1,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				userName := fs.String("user", "", "only processes of this `user`")
+				wide := fs.Bool("wide", false, "don't truncate long command lines")
+				return func(state *JailerState, args []string) error {
+					pattern := ""
+					if len(args) == 1 {
+						pattern = args[0]
+					}
+					return findCommand(state, pattern, *userName, *wide)
+				}
+			},
+		},
+		{
+			name: "suspects", args: "[count]",
+			summary: "Top processes by CPU, memory, disk IO and connections, with the command jailing them",
+			details: []string{"e.g. suspects 10 --by cpu, processes already jailed show their jail types instead"},
+			maxArgs: 1,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				by := fs.String("by", "", "only rank by `cpu|memory|io|network`")
+				wide := fs.Bool("wide", false, "don't truncate long command lines")
+				return func(state *JailerState, args []string) error {
+					count := defaultSuspectCount
+					if len(args) == 1 {
+						var err error
+						if count, err = strconv.Atoi(args[0]); err != nil || count <= 0 {
+							return fmt.Errorf("invalid count: %s", args[0])
+						}
+					}
+					resources := suspectResources
+					if *by != "" {
+						if _, known := suspectTitles[*by]; !known {
+							return fmt.Errorf("unknown resource %q, use cpu, memory, io or network", *by)
+						}
+						resources = []string{*by}
+					}
+					return showSuspects(state, resources, count, *wide)
+				}
+			},
+		},
+		{
+			name: "pick", args: "[type] [type arguments]",
+			summary: "Search the processes interactively and jail the highlighted one",
+			details: []string{
+				"Type to search by PID, name, user or command line, Up/Down or Ctrl+P/Ctrl+N to move,",
+				"Tab/Shift+Tab to change the jail type, Enter to jail, Ctrl+R to sample again, Esc to quit",
+				"e.g. pick cpu 20% offers a CPU jail at 20% first",
+			},
+			maxArgs: -1, words: jailTypeWords,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				var options JailOptions
+				fs.StringVar(&options.Reason, "reason", "", "record why the process is jailed, as `text`")
+				fs.BoolVar(&options.Persistent, "persistent", false, "keep the jail when jailer exits with -keep-jails-on-exit")
+				expiry := fs.String("for", "", "release the jail automatically after a `duration`, e.g. 2h")
+				return func(state *JailerState, args []string) error {
+					var err error
+					if options.For, err = parseJailExpiry(*expiry); err != nil {
+						return err
+					}
+					return pickProcess(state, args, options)
+				}
+			},
+		},
+		{
+			name: "export", args: "<file>",
+			summary: "Write active jails and the jail history of the session to a file",
+			minArgs: 1, maxArgs: 1,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				format := fs.String("format", "", "file `csv|json|template`, guessed from the extension by default")
+				return func(state *JailerState, args []string) error {
+					return exportJails(state, args[0], *format)
+				}
+			},
+		},
+		{
+			name: "export-rules", args: "[type...]",
+			summary: "Show the firewall rules installed by jailer, or the rules of network and proxy jails",
+			details: []string{
+				"export-rules               - The jail table or iptables rules as currently installed",
+				"export-rules network proxy - The rules these jail types install, as an nft -f script or iptables commands",
+			},
+			maxArgs: -1, words: firewallJailTypes,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				output := fs.String("output", "", "write the rules to a `file` instead of printing them")
+				return func(state *JailerState, args []string) error {
+					return exportRules(state, args, *output)
+				}
+			},
+		},
+		{
+			name: "import", args: "<template.json>",
+			summary: "Apply the jails of a template written by export --format template",
+			details: []string{"Each entry jails the processes matching its selector, already jailed ones are skipped"},
+			minArgs: 1, maxArgs: 1,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				dryRun := fs.Bool("dry-run", false, "show the processes the template matches without jailing them")
+				return func(state *JailerState, args []string) error {
+					return importTemplate(state, args[0], *dryRun)
+				}
+			},
+		},
+		{
+			name: "selftest", args: "[type...]",
+			summary: "Apply each jail type to throwaway processes, check its effect and revert it",
+			details: []string{
+				"cpu: a spinning process stays near 1% of a core, network and proxy: its UDP packets stop arriving",
+				"rlimit, oom, coredump: the limits are read back, syscall, landlock, readonly: the socket or write is refused",
+			},
+			maxArgs: -1, words: allJailTypes(),
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					return runSelftest(state, args)
+				}
+			},
+		},
+		{
+			name: "redetect", summary: "Detect the firewall backend again and move the jail rules when it changed",
+			details: []string{"For hosts where nftables was installed or removed, or the iptables alternatives switched, while jailer runs",
+				"A rule failing to install triggers it too, the sessions kept open and the allowlists are dropped by a move"},
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					return redetectFirewall(state)
+				}
+			},
+		},
+		{
+			name: "doctor", summary: "Probe the cgroup, firewall and kernel features and show the usable jail types",
+			details: []string{"The jail types the host can't enforce are disabled, jail and run refuse them with the reason"},
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					return runDoctor(state)
+				}
+			},
+		},
+		{
+			name: "help", args: "[command]",
+			summary: "Show this help, or the help of a command",
+			maxArgs: 1,
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					if len(args) == 0 {
+						showHelp(state.stdout())
+						return nil
+					}
+					c := lookupCommand(args[0])
+					if c == nil {
+						return fmt.Errorf("unknown command: %s", args[0])
+					}
+					c.showHelp(state.stdout())
+					return nil
+				}
+			},
+		},
+		{
+			name: "exit", aliases: []string{"quit"},
+			summary: "Clean up and exit",
+			setup: func(fs *flag.FlagSet) commandFunc {
+				return func(state *JailerState, args []string) error {
+					fmt.Println("Cleaning up and exiting...")
+					cleanup(state)
+					os.Exit(0)
+					return nil
+				}
+			},
+		},
+	}
+}
+
+// lookupCommand returns the command with a name or alias, nil when there is none
+func lookupCommand(name string) *command {
+	name = strings.ToLower(name)
+	for _, c := range commandTable {
+		if c.name == name {
+			return c
+		}
+		for _, alias := range c.aliases {
+			if alias == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// newCommandFlagSet returns a flag set reporting its errors to the caller only
+func newCommandFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// parseInterspersed parses the flags found anywhere among the words and returns the
+// other words. Everything after "--", or after rawAfter arguments and the flags that
+// directly follow them, is returned as it is
+func parseInterspersed(fs *flag.FlagSet, words []string, rawAfter int) ([]string, error) {
+	var args []string
+	for len(words) > 0 {
+		raw := rawAfter > 0 && len(args) >= rawAfter
+		if !raw && (words[0] == "-" || !strings.HasPrefix(words[0], "-")) {
+			args = append(args, words[0])
+			words = words[1:]
+			continue
+		}
+
+		// Parse stops at the first argument and drops a "--" it stops at
+		if err := fs.Parse(words); err != nil {
+			return nil, err
+		}
+		remaining := fs.Args()
+		consumed := len(words) - len(remaining)
+		if raw || (consumed > 0 && words[consumed-1] == "--") {
+			return append(args, remaining...), nil
+		}
+		words = remaining
+	}
+	return args, nil
+}
+
+// usage returns the usage line of the command, generated from its flags
+func (c *command) usage() string {
+	parts := []string{c.name}
+	if c.args != "" {
+		parts = append(parts, c.args)
+	}
+	fs := newCommandFlagSet(c.name)
+	c.setup(fs)
+	fs.VisitAll(func(f *flag.Flag) {
+		valueName, _ := flag.UnquoteUsage(f)
+		if valueName == "" {
+			parts = append(parts, "[--"+f.Name+"]")
+		} else {
+			parts = append(parts, fmt.Sprintf("[--%s %s]", f.Name, valueName))
+		}
+	})
+	return strings.Join(parts, " ")
+}
+
+// parse parses the words following the command name and returns the function running it
+// with its arguments
+func (c *command) parse(words []string) (commandFunc, []string, error) {
+	fs := newCommandFlagSet(c.name)
+	run := c.setup(fs)
+	args, err := parseInterspersed(fs, words, c.rawAfter)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("%v, usage: %s", err, c.usage())
+	}
+	if len(args) < c.minArgs || (c.maxArgs >= 0 && len(args) > c.maxArgs) {
+		return nil, nil, fmt.Errorf("usage: %s", c.usage())
+	}
+	return run, args, nil
+}
+
+// showHelp prints the usage, details and flags of the command
+func (c *command) showHelp(out io.Writer) {
+	fmt.Fprintf(out, "Usage: %s\n", c.usage())
+	fmt.Fprintf(out, "  %s\n", c.summary)
+	for _, line := range c.details {
+		fmt.Fprintf(out, "  %s\n", line)
+	}
+
+	fs := newCommandFlagSet(c.name)
+	c.setup(fs)
+	first := true
+	fs.VisitAll(func(f *flag.Flag) {
+		if first {
+			fmt.Fprintln(out)
+			fmt.Fprintln(out, "Flags:")
+			first = false
+		}
+		valueName, usage := flag.UnquoteUsage(f)
+		name := "--" + f.Name
+		if valueName != "" {
+			name += " " + valueName
+		}
+		fmt.Fprintf(out, "  %-19s - %s\n", name, strings.ToUpper(usage[:1])+usage[1:])
+	})
+}
+
+// executeParts executes a single command split into words
+func executeParts(state *JailerState, parts []string) error {
+	c := lookupCommand(parts[0])
+	if c == nil {
+		return fmt.Errorf("unknown command: %s (type 'help' for available commands)", strings.ToLower(parts[0]))
+	}
+
+	run, args, err := c.parse(parts[1:])
+	if err == flag.ErrHelp {
+		c.showHelp(state.stdout())
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return run(state, args)
+}
+
+// addListFlags declares the filter flags shared by list and watch on a flag set and
+// returns the filter they fill
+func addListFlags(fs *flag.FlagSet) *listFilter {
+	filter := &listFilter{SortBy: "pid"}
+	fs.Func("type", "only jails of this `type`", func(value string) error {
+		filter.JailType = normalizeJailType(strings.ToLower(value))
+		return nil
+	})
+	fs.Func("older-than", "only jails older than this `duration` (e.g. 30m, 2d)", func(value string) error {
+		var err error
+		filter.OlderThan, err = parseDuration(value)
+		return err
+	})
+	fs.Func("name", "only processes whose name matches this glob or substring `pattern`", func(value string) error {
+		if _, err := filepath.Match(value, ""); err != nil {
+			return fmt.Errorf("invalid name pattern: %s", value)
+		}
+		filter.NamePattern = value
+		return nil
+	})
+	fs.Func("sort", "order the jails by `pid|age|name`", func(value string) error {
+		switch value {
+		case "pid", "age", "name":
+			filter.SortBy = value
+			return nil
+		}
+		return fmt.Errorf("invalid sort order: %s (expected pid, age or name)", value)
+	})
+	fs.BoolVar(&filter.Wide, "wide", false, "don't truncate long names, types and reasons")
+	return filter
+}
+
+// parseListFilter parses the options of the list command of the controller
+func parseListFilter(args []string) (listFilter, error) {
+	fs := newCommandFlagSet("list")
+	filter := addListFlags(fs)
+	usage := "usage: list [--type <type>] [--older-than <duration>] [--name <pattern>] [--sort pid|age|name] [--wide]"
+	args, err := parseInterspersed(fs, args, 0)
+	if err != nil {
+		return *filter, fmt.Errorf("%v, %s", err, usage)
+	}
+	if len(args) > 0 {
+		return *filter, fmt.Errorf("%s", usage)
+	}
+	return *filter, nil
+}
+
+// showHelp displays help for available commands
+func showHelp(out io.Writer) {
+	fmt.Fprintln(out, "Available commands:")
+	for _, c := range commandTable {
+		usage := c.usage()
+		if len(usage) <= 19 {
+			fmt.Fprintf(out, "  %-19s - %s\n", usage, c.summary)
+		} else {
+			fmt.Fprintf(out, "  %s\n", usage)
+			fmt.Fprintf(out, "                      - %s\n", c.summary)
+		}
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "  Type 'help <command>' or '<command> --help' for the details and flags of a command")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Targets:")
+	fmt.Fprintln(out, "  jail accepts several targets: PIDs, ranges and PID files")
+	fmt.Fprintln(out, "  PIDs completed with Tab carry the process name (1234:nginx), checked before acting")
+	fmt.Fprintln(out, "                        (e.g. jail network 1234 5678 2000-2010 @/run/nginx.pid)")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Jail types:")
+	fmt.Fprintln(out, "  network/n           - Block network access")
+	fmt.Fprintln(out, "  cpu/c               - Limit CPU usage to 1% of one core")
+	fmt.Fprintln(out, "  both                - Apply both network and CPU jails")
+	fmt.Fprintln(out, "  memory              - Limit memory usage (e.g. memory=256M, memory.max or memory.limit_in_bytes)")
+	fmt.Fprintln(out, "  <type>,<type>=<args> - Any combination of the types (e.g. network,cpu,memory=256M)")
+	fmt.Fprintln(out, "  rlimit              - Lower resource limits with prlimit (no cgroups)")
+	fmt.Fprintln(out, "  oom                 - Sacrifice process first under memory pressure")
+	fmt.Fprintln(out, "  coredump            - Suppress core dumps of a possibly compromised process")
+	fmt.Fprintln(out, "  rdma                - Limit HCA handles and objects (cgroups v2 rdma controller)")
+	fmt.Fprintln(out, "  misc                - Limit misc resources such as SEV ASIDs (cgroups v2 misc controller)")
+	fmt.Fprintln(out, "  quota               - XFS/ext4 project quota on the directories written by the process")
+	fmt.Fprintln(out, "  syscall[=profile]   - Seccomp syscall filter (run only)")
+	fmt.Fprintln(out, "  landlock[=profile]  - Landlock filesystem restrictions (run only)")
+	fmt.Fprintln(out, "  readonly[=profile]  - Read-only filesystem (run only)")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Enhanced features:")
+	fmt.Fprintln(out, "  cmd1; cmd2          - Run several commands from one line")
+	fmt.Fprintln(out, "  Tab                 - Autocomplete commands")
+	fmt.Fprintln(out, "  Up/Down arrows      - Navigate command history")
+	fmt.Fprintln(out, "  Ctrl+A/Home         - Move cursor to beginning of line")
+	fmt.Fprintln(out, "  Ctrl+E/End          - Move cursor to end of line")
+	fmt.Fprintln(out, "  Ctrl+L              - Clear screen")
+	fmt.Fprintln(out, "  Ctrl+C              - Interrupt current input")
+}
+
+// commandFlags returns the flags of a command as they are typed, e.g. --wide
+func (c *command) commandFlags() []string {
+	fs := newCommandFlagSet(c.name)
+	c.setup(fs)
+	var flags []string
+	fs.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "--"+f.Name)
+	})
+	return flags
+}
+
+// commandCompleter returns the readline completer of the command names, their first
+// argument and their flags
+func commandCompleter() *readline.PrefixCompleter {
+	var items []readline.PrefixCompleterInterface
+	for _, c := range commandTable {
+		var children []readline.PrefixCompleterInterface
+		for _, word := range append(append([]string(nil), c.words...), c.commandFlags()...) {
+			children = append(children, readline.PcItem(word))
+		}
+		for _, name := range append([]string{c.name}, c.aliases...) {
+			items = append(items, readline.PcItem(name, children...))
+		}
+	}
+	return readline.NewPrefixCompleter(items...)
+}
+
+// printShellCompletion prints the bash or zsh completion script of jailer and returns the
+// exit code
+func printShellCompletion(args []string) int {
+	if len(args) != 1 || (args[0] != "bash" && args[0] != "zsh") {
+		fmt.Println("Error: usage: jailer completion bash|zsh")
+		return 1
+	}
+
+	// Program flags taking a value are skipped when looking for the command
+	var valueFlags []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !boolFlag.IsBoolFlag() {
+			valueFlags = append(valueFlags, "-"+f.Name, "--"+f.Name)
+		}
+	})
+
+	var b strings.Builder
+	if args[0] == "bash" {
+		writeBashCompletion(&b, valueFlags)
+	} else {
+		writeZshCompletion(&b, valueFlags)
+	}
+	fmt.Print(b.String())
+	return 0
+}
+
+// completionWords returns the words completed after a command, as a shell word list
+func completionWords(c *command) string {
+	return strings.Join(append(append([]string(nil), c.words...), c.commandFlags()...), " ")
+}
+
+// writeBashCompletion writes the bash completion script
+func writeBashCompletion(b *strings.Builder, valueFlags []string) {
+	var names []string
+	for _, c := range commandTable {
+		names = append(names, append([]string{c.name}, c.aliases...)...)
+	}
+
+	b.WriteString("# bash completion for jailer, generated by: jailer completion bash\n")
+	b.WriteString("_jailer() {\n")
+	b.WriteString("    local cur=${COMP_WORDS[COMP_CWORD]} command=\"\" words=\"\" i\n")
+	b.WriteString("    for ((i = 1; i < COMP_CWORD; i++)); do\n")
+	b.WriteString("        case ${COMP_WORDS[i]} in\n")
+	if len(valueFlags) > 0 {
+		fmt.Fprintf(b, "            %s) ((i++)) ;;\n", strings.Join(valueFlags, "|"))
+	}
+	b.WriteString("            -*) ;;\n")
+	b.WriteString("            *) command=${COMP_WORDS[i]}; break ;;\n")
+	b.WriteString("        esac\n")
+	b.WriteString("    done\n")
+	b.WriteString("    case $command in\n")
+	fmt.Fprintf(b, "        \"\") words=\"%s\" ;;\n", strings.Join(names, " "))
+	for _, c := range commandTable {
+		pids := ""
+		if c.pids {
+			pids = " $(cd /proc && echo [0-9]*)"
+		}
+		fmt.Fprintf(b, "        %s) words=\"%s%s\" ;;\n",
+			strings.Join(append([]string{c.name}, c.aliases...), "|"), completionWords(c), pids)
+	}
+	b.WriteString("    esac\n")
+	b.WriteString("    COMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	b.WriteString("}\n")
+	b.WriteString("complete -F _jailer jailer\n")
+}
+
+// writeZshCompletion writes the zsh completion script, which can be sourced or installed
+// as _jailer in the fpath
+func writeZshCompletion(b *strings.Builder, valueFlags []string) {
+	b.WriteString("#compdef jailer\n")
+	b.WriteString("# zsh completion for jailer, generated by: jailer completion zsh\n")
+	b.WriteString("_jailer() {\n")
+	b.WriteString("    local -a commands\n")
+	b.WriteString("    commands=(\n")
+	for _, c := range commandTable {
+		for _, name := range append([]string{c.name}, c.aliases...) {
+			fmt.Fprintf(b, "        '%s:%s'\n", name, strings.ReplaceAll(c.summary, "'", "'\\''"))
+		}
+	}
+	b.WriteString("    )\n")
+	b.WriteString("    local command=\"\" i\n")
+	b.WriteString("    for ((i = 2; i < CURRENT; i++)); do\n")
+	b.WriteString("        case ${words[i]} in\n")
+	if len(valueFlags) > 0 {
+		fmt.Fprintf(b, "            %s) ((i++)) ;;\n", strings.Join(valueFlags, "|"))
+	}
+	b.WriteString("            -*) ;;\n")
+	b.WriteString("            *) command=${words[i]}; break ;;\n")
+	b.WriteString("        esac\n")
+	b.WriteString("    done\n")
+	b.WriteString("    if [[ -z $command ]]; then\n")
+	b.WriteString("        _describe 'command' commands\n")
+	b.WriteString("        return\n")
+	b.WriteString("    fi\n")
+	b.WriteString("    case $command in\n")
+	for _, c := range commandTable {
+		pids := ""
+		if c.pids {
+			pids = " /proc/<->(:t)"
+		}
+		fmt.Fprintf(b, "        %s) compadd -- %s%s ;;\n",
+			strings.Join(append([]string{c.name}, c.aliases...), "|"), completionWords(c), pids)
+	}
+	b.WriteString("    esac\n")
+	b.WriteString("}\n")
+	b.WriteString("if [[ $zsh_eval_context[-1] == loadautofunc ]]; then\n")
+	b.WriteString("    _jailer \"$@\"\n")
+	b.WriteString("else\n")
+	b.WriteString("    compdef _jailer jailer\n")
+	b.WriteString("fi\n")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+// jailerCompleter completes command keywords with the prefix completer and PIDs with the
+// live processes, annotated with their names as <pid>:<name>
+type jailerCompleter struct {
+	state    *JailerState
+	keywords *readline.PrefixCompleter
+}
+
+// Do implements readline.AutoCompleter
+func (c *jailerCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	// Only the last command of the line is completed
+	text := string(line[:pos])
+	if i := strings.LastIndex(text, ";"); i >= 0 {
+		text = text[i+1:]
+	}
+
+	words := strings.Fields(text)
+	current := ""
+	if len(words) > 0 && !strings.HasSuffix(text, " ") {
+		current = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+
+	keywordCandidates, keywordLength := c.keywords.Do([]rune(text), len([]rune(text)))
+
+	pids := pidCompletionSlot(c.state, words)
+	if pids == nil {
+		return keywordCandidates, keywordLength
+	}
+
+	var candidates [][]rune
+	if keywordLength == len([]rune(current)) {
+		candidates = keywordCandidates
+	}
+	for _, candidate := range pidCandidates(pids) {
+		if strings.HasPrefix(candidate, current) {
+			candidates = append(candidates, []rune(candidate[len(current):]+" "))
+		}
+	}
+	return candidates, len([]rune(current))
+}
+
+// pidCompletionSlot returns the PIDs that can be completed after the given words, or nil
+// when the next word is not a PID
+func pidCompletionSlot(state *JailerState, words []string) []int {
+	if len(words) == 0 {
+		return nil
+	}
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	switch strings.ToLower(words[0]) {
+	case "jail":
+		// Any process can be jailed, several targets may follow the type
+		if len(words) >= 2 {
+			return listProcessPids()
+		}
+	case "simulate":
+		if len(words) == 2 {
+			return listProcessPids()
+		}
+	case "unjail":
+		// unjail <pid> or unjail <type> <pid>
+		if len(words) == 1 || (len(words) == 2 && !isPidTarget(words[1])) {
+			return jailedPids(state)
+		}
+	case "checkpoint", "info", "allow":
+		if len(words) == 1 {
+			return jailedPids(state)
+		}
+	}
+	return nil
+}
+
+// listProcessPids returns the PIDs of all the processes, in ascending order
+func listProcessPids() []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	pids := []int{}
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// jailedPids returns the PIDs of the active jails, in ascending order
+func jailedPids(state *JailerState) []int {
+	pids := []int{}
+	for pid := range state.ActiveJails {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// pidCandidates annotates PIDs with their process names, names that would need quoting
+// are left out
+func pidCandidates(pids []int) []string {
+	var candidates []string
+	for _, pid := range pids {
+		name := hostProcesses.name(pid)
+		if name == "" || strings.ContainsAny(name, " \t;:'\"\\") {
+			candidates = append(candidates, strconv.Itoa(pid))
+			continue
+		}
+		candidates = append(candidates, strconv.Itoa(pid)+":"+name)
+	}
+	return candidates
+}
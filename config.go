@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// defaultConfigPath is the configuration file used when -config is not given
+const defaultConfigPath = "/etc/jailer/config.json"
+
+// Config contains the settings loaded from the configuration file
+type Config struct {
+	SeccompProfiles    map[string]SeccompProfile  `json:"seccomp_profiles"`
+	LandlockProfiles   map[string]LandlockProfile `json:"landlock_profiles"`
+	ReadOnlyProfiles   map[string]ReadOnlyProfile `json:"readonly_profiles"`
+	AuditLog           string                     `json:"audit_log"`       // "off" disables the audit log
+	HistoryLog         string                     `json:"history_log"`     // Ended jails queried by history, "off" keeps them for the session only
+	Store              StoreConfig                `json:"store"`           // Files or SQLite database keeping the saved jails, audit events, history and samples
+	RemoteToken        string                     `json:"remote_token"`    // Secret shared by the agents and the controller
+	RemoteTLSCert      string                     `json:"remote_tls_cert"` // Certificate of the remote connections, mutual TLS is required
+	RemoteTLSKey       string                     `json:"remote_tls_key"`
+	RemoteTLSCA        string                     `json:"remote_tls_ca"`       // CA that signed the certificates of both ends
+	StateBackend       StateBackendConfig         `json:"state_backend"`       // Clustered store of the jails of every host
+	AuditRules         []AuditRule                `json:"audit_rules"`         // Jails applied to the processes of audit events
+	Webhook            WebhookConfig              `json:"webhook"`             // Endpoint jailing the targets of alerts
+	Events             EventsConfig               `json:"events"`              // Endpoint streaming the jail events
+	Statsd             StatsdConfig               `json:"statsd"`              // StatsD agent receiving the metrics
+	Tracing            TracingConfig              `json:"tracing"`             // OpenTelemetry collector receiving the spans
+	NetworkProxy       string                     `json:"network_proxy"`       // Only address reachable from proxy jails, host:port
+	StateFile          string                     `json:"state_file"`          // Jails recovered after a crash, "off" disables it
+	DumpFile           string                     `json:"dump_file"`           // State dumped on SIGUSR1, stderr when empty
+	ConfirmDescendants int                        `json:"confirm_descendants"` // Descendants from which jail asks before moving them, 50 by default, -1 never asks
+	MaxJailProcesses   int                        `json:"max_jail_processes"`  // Processes a jail command may move without --force, 500 by default, -1 for no cap
+	Notifications      NotificationConfig         `json:"notifications"`       // Channels receiving the alerts
+	ThrottleAlert      ThrottleAlertConfig        `json:"throttle_alert"`
+	Persist            PersistConfig              `json:"persist"`          // Persistent jails kept across reboots
+	Schedules          []ScheduledJail            `json:"schedules"`        // Recurring jails applied within their windows
+	ExpiryWarning      string                     `json:"expiry_warning"`   // Notice of the release of the jails created with --for, 10m by default, "off" disables it
+	GeoIP              GeoIPConfig                `json:"geoip"`            // Sources of the country networks of the network jails
+	Blocklists         BlocklistConfig            `json:"blocklists"`       // Threat-intel feeds dropped by the firewall
+	FirewallTimeout    string                     `json:"firewall_timeout"` // Time an nft, iptables or ipset command may take, 30s by default, "off" waits forever
+	CgroupFallback     string                     `json:"cgroup_fallback"`  // Destination of the unjailed processes whose cgroup is gone: root (default), recreate or a cgroup path
+}
+
+// newDefaultConfig returns the configuration used when no file is present
+func newDefaultConfig() *Config {
+	config := &Config{
+		SeccompProfiles:    make(map[string]SeccompProfile),
+		LandlockProfiles:   make(map[string]LandlockProfile),
+		ReadOnlyProfiles:   make(map[string]ReadOnlyProfile),
+		AuditLog:           defaultAuditLogPath,
+		HistoryLog:         defaultHistoryLogPath,
+		ConfirmDescendants: defaultConfirmDescendants,
+		MaxJailProcesses:   defaultMaxJailProcesses,
+	}
+	validateGeoIPConfig(&config.GeoIP)
+	validateBlocklistConfig(&config.Blocklists)
+	for name, profile := range builtinSeccompProfiles {
+		config.SeccompProfiles[name] = profile
+	}
+	for name, profile := range builtinLandlockProfiles {
+		config.LandlockProfiles[name] = profile
+	}
+	for name, profile := range builtinReadOnlyProfiles {
+		config.ReadOnlyProfiles[name] = profile
+	}
+	return config
+}
+
+// loadConfig reads the configuration file on top of the defaults, a missing file
+// is only an error when its path was explicitly requested
+func loadConfig(path string, explicit bool) (*Config, error) {
+	config := newDefaultConfig()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return config, nil
+		}
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+
+	var fileConfig Config
+	if err := json.Unmarshal(content, &fileConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	// Profiles from the file override the built-in profiles with the same name
+	for name, profile := range fileConfig.SeccompProfiles {
+		if err := validateSeccompProfile(profile); err != nil {
+			return nil, fmt.Errorf("invalid seccomp profile %q: %v", name, err)
+		}
+		config.SeccompProfiles[name] = profile
+	}
+	for name, profile := range fileConfig.LandlockProfiles {
+		if err := validateLandlockProfile(profile); err != nil {
+			return nil, fmt.Errorf("invalid landlock profile %q: %v", name, err)
+		}
+		config.LandlockProfiles[name] = profile
+	}
+	for name, profile := range fileConfig.ReadOnlyProfiles {
+		config.ReadOnlyProfiles[name] = profile
+	}
+	if fileConfig.AuditLog != "" {
+		config.AuditLog = fileConfig.AuditLog
+	}
+	if fileConfig.HistoryLog != "" {
+		config.HistoryLog = fileConfig.HistoryLog
+	}
+	config.RemoteToken = fileConfig.RemoteToken
+	config.RemoteTLSCert = fileConfig.RemoteTLSCert
+	config.RemoteTLSKey = fileConfig.RemoteTLSKey
+	config.RemoteTLSCA = fileConfig.RemoteTLSCA
+	config.StateBackend = fileConfig.StateBackend
+	if _, err := newStateBackend(config.StateBackend); err != nil {
+		return nil, err
+	}
+	config.AuditRules = fileConfig.AuditRules
+	for i := range config.AuditRules {
+		rule := &config.AuditRules[i]
+		if rule.Name == "" {
+			return nil, fmt.Errorf("audit rule %d has no name", i+1)
+		}
+		if err := compileAuditRule(rule); err != nil {
+			return nil, fmt.Errorf("invalid audit rule %q: %v", rule.Name, err)
+		}
+	}
+	config.StateFile = fileConfig.StateFile
+	config.DumpFile = fileConfig.DumpFile
+	if fileConfig.ConfirmDescendants != 0 {
+		config.ConfirmDescendants = fileConfig.ConfirmDescendants
+	}
+	if fileConfig.MaxJailProcesses != 0 {
+		config.MaxJailProcesses = fileConfig.MaxJailProcesses
+	}
+	config.Store = fileConfig.Store
+	if err := validateStoreConfig(&config.Store, config.StateBackend); err != nil {
+		return nil, fmt.Errorf("invalid store configuration: %v", err)
+	}
+	config.NetworkProxy = fileConfig.NetworkProxy
+	if config.NetworkProxy != "" {
+		if _, err := parseNetworkProxy(config.NetworkProxy); err != nil {
+			return nil, err
+		}
+	}
+	config.Webhook = fileConfig.Webhook
+	if err := validateWebhookConfig(&config.Webhook); err != nil {
+		return nil, fmt.Errorf("invalid webhook configuration: %v", err)
+	}
+	config.Events = fileConfig.Events
+	if err := validateEventsConfig(config.Events); err != nil {
+		return nil, fmt.Errorf("invalid events: %v", err)
+	}
+	config.Statsd = fileConfig.Statsd
+	if err := validateStatsdConfig(&config.Statsd); err != nil {
+		return nil, fmt.Errorf("invalid statsd: %v", err)
+	}
+	config.Tracing = fileConfig.Tracing
+	if err := validateTracingConfig(&config.Tracing); err != nil {
+		return nil, fmt.Errorf("invalid tracing: %v", err)
+	}
+	config.Notifications = fileConfig.Notifications
+	if err := validateNotificationConfig(config.Notifications); err != nil {
+		return nil, fmt.Errorf("invalid notifications: %v", err)
+	}
+	config.Persist = fileConfig.Persist
+	config.Schedules = fileConfig.Schedules
+	if err := validateScheduledJails(config.Schedules); err != nil {
+		return nil, fmt.Errorf("invalid schedules: %v", err)
+	}
+	config.ThrottleAlert = fileConfig.ThrottleAlert
+	if err := validateThrottleAlertConfig(&config.ThrottleAlert); err != nil {
+		return nil, fmt.Errorf("invalid throttle_alert: %v", err)
+	}
+	config.ExpiryWarning = fileConfig.ExpiryWarning
+	if _, err := parseExpiryWarning(config.ExpiryWarning); err != nil {
+		return nil, err
+	}
+	config.GeoIP = fileConfig.GeoIP
+	if err := validateGeoIPConfig(&config.GeoIP); err != nil {
+		return nil, fmt.Errorf("invalid geoip: %v", err)
+	}
+	config.Blocklists = fileConfig.Blocklists
+	if err := validateBlocklistConfig(&config.Blocklists); err != nil {
+		return nil, fmt.Errorf("invalid blocklists: %v", err)
+	}
+	config.FirewallTimeout = fileConfig.FirewallTimeout
+	if _, err := parseFirewallTimeout(config.FirewallTimeout); err != nil {
+		return nil, err
+	}
+	config.CgroupFallback = fileConfig.CgroupFallback
+	if err := validateCgroupFallback(config.CgroupFallback); err != nil {
+		return nil, err
+	}
+	if (config.RemoteTLSCert == "") != (config.RemoteTLSKey == "") {
+		return nil, fmt.Errorf("remote_tls_cert and remote_tls_key must be set together")
+	}
+	if config.RemoteTLSCert != "" && config.RemoteTLSCA == "" {
+		return nil, fmt.Errorf("remote_tls_ca must be set with remote_tls_cert, remote connections use mutual TLS")
+	}
+
+	fmt.Printf("Loaded configuration from %s\n", path)
+	return config, nil
+}
+
+// defaultFirewallTimeout is the time an nft, iptables or ipset command may take before
+// it is killed, e.g. waiting on the xtables lock held by a hung process
+const defaultFirewallTimeout = 30 * time.Second
+
+// firewallTimeout is the timeout of the firewall commands, set from firewall_timeout
+var firewallTimeout = defaultFirewallTimeout
+
+// parseFirewallTimeout parses firewall_timeout, "off" waits for the commands forever
+func parseFirewallTimeout(value string) (time.Duration, error) {
+	switch value {
+	case "":
+		return defaultFirewallTimeout, nil
+	case "off":
+		return 0, nil
+	}
+	timeout, err := parseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid firewall_timeout %q", value)
+	}
+	return timeout, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// socketProtocols are the /proc/net tables read by the connections command
+var socketProtocols = []string{"tcp", "tcp6", "udp", "udp6"}
+
+// tcpStates maps the state codes of /proc/net/tcp to their names
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED", "02": "SYN_SENT", "03": "SYN_RECV", "04": "FIN_WAIT1",
+	"05": "FIN_WAIT2", "06": "TIME_WAIT", "07": "CLOSE", "08": "CLOSE_WAIT",
+	"09": "LAST_ACK", "0A": "LISTEN", "0B": "CLOSING",
+}
+
+// socketEntry is a TCP or UDP socket of /proc/net
+type socketEntry struct {
+	Protocol string
+	Local    string
+	Remote   string
+	State    string
+}
+
+// processConnection is a socket held open by a process
+type processConnection struct {
+	PID  int
+	Name string
+	socketEntry
+}
+
+// parseProcNetAddress decodes an address of /proc/net such as 0100007F:0CEA, the words of
+// the IP are in host (little-endian) order and the port in network order
+func parseProcNetAddress(value string) (string, error) {
+	hexIP, hexPort, found := strings.Cut(value, ":")
+	if !found {
+		return "", fmt.Errorf("invalid address %q", value)
+	}
+	raw, err := hex.DecodeString(hexIP)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return "", fmt.Errorf("invalid address %q", value)
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in %q", value)
+	}
+
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	if ip.IsUnspecified() && port == 0 {
+		return "*:*", nil
+	}
+	host := ip.String()
+	if ip.IsUnspecified() {
+		host = "*"
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(port, 10)), nil
+}
+
+// readSocketTable parses a /proc/net table of a network namespace, keyed by socket inode
+func readSocketTable(path, protocol string) (map[string]socketEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]socketEntry)
+	for _, line := range strings.Split(string(content), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		local, err := parseProcNetAddress(fields[1])
+		if err != nil {
+			continue
+		}
+		remote, err := parseProcNetAddress(fields[2])
+		if err != nil {
+			continue
+		}
+
+		state := tcpStates[fields[3]]
+		if strings.HasPrefix(protocol, "udp") {
+			// UDP sockets are either connected or not, 07 is the unconnected state
+			state = "UNCONN"
+			if fields[3] == "01" {
+				state = "ESTABLISHED"
+			}
+		}
+		entries[fields[9]] = socketEntry{Protocol: protocol, Local: local, Remote: remote, State: state}
+	}
+	return entries, nil
+}
+
+// getSocketInodes returns the inodes of the sockets among the open files of a process
+func getSocketInodes(pid int) []string {
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	files, err := os.ReadDir(fdDir)
+	if err != nil {
+		return nil
+	}
+
+	var inodes []string
+	for _, file := range files {
+		target, err := os.Readlink(fdDir + "/" + file.Name())
+		if err != nil {
+			continue
+		}
+		// Sockets link to socket:[<inode>]
+		if inode, found := strings.CutPrefix(target, "socket:["); found {
+			inodes = append(inodes, strings.TrimSuffix(inode, "]"))
+		}
+	}
+	return inodes
+}
+
+// getProcessConnections returns the TCP and UDP sockets of processes, the tables are read
+// once per network namespace
+func getProcessConnections(pids []int) []processConnection {
+	tables := make(map[string]map[string]socketEntry)
+	var connections []processConnection
+	for _, pid := range pids {
+		namespace, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/net", pid))
+		if err != nil {
+			namespace = strconv.Itoa(pid)
+		}
+		table, read := tables[namespace]
+		if !read {
+			table = make(map[string]socketEntry)
+			for _, protocol := range socketProtocols {
+				entries, err := readSocketTable(fmt.Sprintf("/proc/%d/net/%s", pid, protocol), protocol)
+				if err != nil {
+					continue
+				}
+				for inode, entry := range entries {
+					table[inode] = entry
+				}
+			}
+			tables[namespace] = table
+		}
+
+		name := hostProcesses.name(pid)
+		for _, inode := range getSocketInodes(pid) {
+			if entry, found := table[inode]; found {
+				connections = append(connections, processConnection{PID: pid, Name: name, socketEntry: entry})
+			}
+		}
+	}
+
+	sort.SliceStable(connections, func(i, j int) bool {
+		a, b := connections[i], connections[j]
+		if a.PID != b.PID {
+			return a.PID < b.PID
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.Local < b.Local
+	})
+	return connections
+}
+
+// showConnections lists the sockets of a process and its descendants
+func showConnections(state *JailerState, pid int, listeningOnly bool) error {
+	if !hostProcesses.exists(pid) {
+		cleanupDeadProcesses(state)
+		return fmt.Errorf("process %d does not exist", pid)
+	}
+
+	pids := []int{pid}
+	if jail, jailed := state.ActiveJails[pid]; jailed {
+		pids = append(pids, jail.Children...)
+	} else if children, err := hostProcesses.descendants(pid); err == nil {
+		pids = append(pids, children...)
+	}
+
+	var connections []processConnection
+	for _, connection := range getProcessConnections(pids) {
+		if !listeningOnly || connection.State == "LISTEN" || connection.State == "UNCONN" {
+			connections = append(connections, connection)
+		}
+	}
+
+	description := fmt.Sprintf("process %d (%s)", pid, hostProcesses.name(pid))
+	if len(pids) > 1 {
+		description += fmt.Sprintf(" and %d descendants", len(pids)-1)
+	}
+	if len(connections) == 0 {
+		fmt.Fprintf(state.stdout(), "No TCP or UDP sockets for %s\n", description)
+		return nil
+	}
+
+	fmt.Fprintf(state.stdout(), "Sockets of %s\n", description)
+	w := newTableWriter(state.stdout())
+	writeTableHeader(w, "PID", "Process", "Proto", "Local", "Remote", "State")
+	for _, connection := range connections {
+		writeTableRow(w, strconv.Itoa(connection.PID), connection.Name, connection.Protocol,
+			connection.Local, connection.Remote, connection.State)
+	}
+	w.Flush()
+	return nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chzyer/readline"
+)
+
+// remoteHost is an agent connected to the controller
+type remoteHost struct {
+	Name        string
+	Address     string
+	ConnectedAt time.Time
+	LastSeen    time.Time
+	Jails       int
+	conn        *remoteConn
+	pending     map[int]chan remoteMessage
+}
+
+// controllerState keeps the agents connected to the controller
+type controllerState struct {
+	mutex    sync.Mutex
+	config   *Config
+	operator string // Who runs the controller, sent with every command
+	hosts    map[string]*remoteHost
+	nextID   int
+}
+
+// newControllerState creates the state of a controller without any agent
+func newControllerState(config *Config) *controllerState {
+	return &controllerState{
+		config:   config,
+		operator: localOperator(),
+		hosts:    make(map[string]*remoteHost),
+	}
+}
+
+// acceptAgents registers the agents connecting to the controller
+func (c *controllerState) acceptAgents(addr string) error {
+	listener, err := remoteListen(c.config, addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	fmt.Printf("Controller waiting for agents on %s\n", listener.Addr())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				fmt.Printf("Warning: failed to accept agent connection: %v\n", err)
+				return
+			}
+			go c.serveAgent(newRemoteConn(conn))
+		}
+	}()
+	return nil
+}
+
+// connectAgent connects to an agent started with -agent-listen
+func (c *controllerState) connectAgent(addr string) error {
+	conn, err := remoteDial(c.config, addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to agent %s: %v", addr, err)
+	}
+
+	rc := newRemoteConn(conn)
+	peer, err := rc.handshake("controller", "", c.config.RemoteToken)
+	if err != nil {
+		rc.close()
+		return err
+	}
+	go c.handleAgent(rc, peer)
+	return nil
+}
+
+// serveAgent authenticates an agent that connected to the controller
+func (c *controllerState) serveAgent(rc *remoteConn) {
+	peer, err := rc.handshake("controller", "", c.config.RemoteToken)
+	if err != nil {
+		fmt.Printf("Warning: rejected agent %s: %v\n", rc.conn.RemoteAddr(), err)
+		rc.close()
+		return
+	}
+	c.handleAgent(rc, peer)
+}
+
+// handleAgent registers an authenticated agent and reads its messages until it
+// disconnects, an agent reconnecting under the same name replaces the old connection
+func (c *controllerState) handleAgent(rc *remoteConn, peer remoteMessage) {
+	defer rc.close()
+
+	// "all" selects every host in the on command
+	name := peer.Host
+	if name == "" || name == "all" {
+		name = rc.conn.RemoteAddr().String()
+	}
+	host := &remoteHost{
+		Name:        name,
+		Address:     rc.conn.RemoteAddr().String(),
+		ConnectedAt: time.Now(),
+		LastSeen:    time.Now(),
+		conn:        rc,
+		pending:     make(map[int]chan remoteMessage),
+	}
+
+	fmt.Printf("\nAgent %s connected from %s\n", name, host.Address)
+	c.mutex.Lock()
+	if previous, exists := c.hosts[name]; exists {
+		previous.conn.close()
+	}
+	c.hosts[name] = host
+	c.mutex.Unlock()
+
+	var err error
+	for {
+		var message remoteMessage
+		if message, err = rc.receive(); err != nil {
+			break
+		}
+
+		c.mutex.Lock()
+		host.LastSeen = time.Now()
+		host.Jails = message.Jails
+		if message.Type == "result" {
+			if reply, exists := host.pending[message.ID]; exists {
+				delete(host.pending, message.ID)
+				reply <- message
+			}
+		}
+		c.mutex.Unlock()
+	}
+
+	// Commands still waiting for this connection will never get a result
+	c.mutex.Lock()
+	for id, reply := range host.pending {
+		delete(host.pending, id)
+		reply <- remoteMessage{Type: "result", Error: fmt.Sprintf("agent disconnected: %v", err)}
+	}
+	if c.hosts[name] == host {
+		delete(c.hosts, name)
+		fmt.Printf("\nAgent %s disconnected: %v\n", name, err)
+	}
+	c.mutex.Unlock()
+}
+
+// runRemoteCommand sends a command line to an agent and waits for its result, until
+// interrupted is closed
+func (c *controllerState) runRemoteCommand(name, command string, interrupted <-chan struct{}) (remoteMessage, error) {
+	c.mutex.Lock()
+	host, exists := c.hosts[name]
+	if !exists {
+		c.mutex.Unlock()
+		return remoteMessage{}, fmt.Errorf("unknown host: %s", name)
+	}
+	c.nextID++
+	id := c.nextID
+	reply := make(chan remoteMessage, 1)
+	host.pending[id] = reply
+	c.mutex.Unlock()
+
+	if err := host.conn.send(remoteMessage{Type: "command", ID: id, Command: command, Operator: c.operator}); err != nil {
+		c.mutex.Lock()
+		delete(host.pending, id)
+		c.mutex.Unlock()
+		return remoteMessage{}, fmt.Errorf("failed to send command to %s: %v", name, err)
+	}
+
+	select {
+	case result := <-reply:
+		return result, nil
+	case <-interrupted:
+	case <-time.After(remoteCommandTimeout):
+	}
+
+	// The agent may still run the command, its result is dropped
+	c.mutex.Lock()
+	delete(host.pending, id)
+	c.mutex.Unlock()
+	return remoteMessage{}, fmt.Errorf("no result from %s", name)
+}
+
+// hostNames returns the sorted names of the connected agents
+func (c *controllerState) hostNames() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	names := make([]string, 0, len(c.hosts))
+	for name := range c.hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// listHosts prints the connected agents
+func (c *controllerState) listHosts() {
+	names := c.hostNames()
+	if len(names) == 0 {
+		fmt.Println("No connected hosts")
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	w := newTableWriter(os.Stdout)
+	writeTableHeader(w, "HOST", "ADDRESS", "CONNECTED", "LAST SEEN", "JAILS")
+	for _, name := range names {
+		host, exists := c.hosts[name]
+		if !exists {
+			continue
+		}
+		writeTableRow(w, truncate(host.Name, nameColumnWidth, false), host.Address,
+			host.ConnectedAt.Format("2006-01-02 15:04:05"),
+			fmt.Sprintf("%s ago", time.Since(host.LastSeen).Round(time.Second)),
+			fmt.Sprintf("%d", host.Jails))
+	}
+	w.Flush()
+}
+
+// runOnHosts runs a command on one host, or on every host with "all"
+func (c *controllerState) runOnHosts(target string, parts []string) error {
+	command := quoteCommand(parts)
+	interrupted, done := startInterruptible()
+	defer done()
+
+	if target != "all" {
+		result, err := c.runRemoteCommand(target, command, interrupted)
+		if err != nil {
+			return err
+		}
+		fmt.Print(result.Output)
+		if result.Error != "" {
+			return fmt.Errorf("%s: %s", target, result.Error)
+		}
+		return nil
+	}
+
+	names := c.hostNames()
+	if len(names) == 0 {
+		return fmt.Errorf("no connected hosts")
+	}
+
+	// The hosts run the command concurrently, the results are printed in host order
+	results := make([]remoteMessage, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = c.runRemoteCommand(name, command, interrupted)
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, name := range names {
+		fmt.Printf("=== %s ===\n", name)
+		if errs[i] != nil {
+			fmt.Printf("Error: %v\n", errs[i])
+			failed++
+			continue
+		}
+		fmt.Print(results[i].Output)
+		if results[i].Error != "" {
+			fmt.Printf("Error: %s\n", results[i].Error)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("command failed on %d of %d hosts", failed, len(names))
+	}
+	return nil
+}
+
+// quoteCommand joins words into a command line that splits back into the same words
+func quoteCommand(parts []string) string {
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		if part != "" && !strings.ContainsAny(part, " \t;'\"\\") {
+			quoted[i] = part
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(part, "'", `'"'"'`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// executeControllerCommand executes a command line typed on the controller
+func executeControllerCommand(c *controllerState, input string) error {
+	commands, err := splitCommands(input)
+	if err != nil {
+		return err
+	}
+
+	for _, parts := range commands {
+		switch strings.ToLower(parts[0]) {
+		case "help":
+			showControllerHelp()
+		case "exit", "quit":
+			fmt.Println("Goodbye!")
+			os.Exit(0)
+		case "hosts":
+			c.listHosts()
+		case "on":
+			if len(parts) < 3 {
+				return fmt.Errorf("usage: on <host|all> <command>")
+			}
+			err = c.runOnHosts(parts[1], parts[2:])
+		case "connect":
+			if len(parts) != 2 {
+				return fmt.Errorf("usage: connect <host:port>")
+			}
+			err = c.connectAgent(parts[1])
+		case "list":
+			var filter listFilter
+			if filter, err = parseListFilter(parts[1:]); err == nil {
+				err = listAllHosts(os.Stdout, c.config.StateBackend, filter)
+			}
+		default:
+			return fmt.Errorf("unknown command: %s (type 'help' for available commands)", parts[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// showControllerHelp displays the commands of the controller
+func showControllerHelp() {
+	fmt.Println("Controller commands:")
+	fmt.Println("  hosts               - List the connected agents")
+	fmt.Println("  on <host> <command> - Run a jailer command on a host (e.g. on web1 jail network 1234)")
+	fmt.Println("  on all <command>    - Run a jailer command on every host")
+	fmt.Println("  connect <host:port> - Connect to an agent started with -agent-listen")
+	fmt.Println("  list [list options] - List the jails of every host from the state backend")
+	fmt.Println("  help                - Show this help")
+	fmt.Println("  exit                - Exit, the agents keep their jails")
+}
+
+// runController runs the interactive controller, agents connect to listenAddr when given
+func runController(config *Config, listenAddr string) {
+	controller := newControllerState(config)
+	if listenAddr != "" {
+		if err := controller.acceptAgents(listenAddr); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Ctrl+C stops waiting for a remote command, SIGTERM exits
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range sigChan {
+			if sig == syscall.SIGINT && interruptCommand() {
+				continue
+			}
+			os.Exit(0)
+		}
+	}()
+
+	hostItems := readline.PcItemDynamic(func(string) []string {
+		return append(controller.hostNames(), "all")
+	})
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:      "controller$> ",
+		HistoryFile: "/tmp/jailer_controller_history",
+		AutoComplete: readline.NewPrefixCompleter(
+			readline.PcItem("hosts"),
+			readline.PcItem("on", hostItems),
+			readline.PcItem("connect"),
+			readline.PcItem("list"),
+			readline.PcItem("help"),
+			readline.PcItem("exit"),
+		),
+		InterruptPrompt: "^C",
+		EOFPrompt:       "exit",
+	})
+	if err != nil {
+		fmt.Printf("Error creating readline interface: %v\n", err)
+		os.Exit(1)
+	}
+	defer rl.Close()
+
+	fmt.Println("Jailer controller, type 'help' for available commands")
+	for {
+		line, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			continue
+		} else if err == io.EOF {
+			fmt.Println("\nGoodbye!")
+			return
+		} else if err != nil {
+			fmt.Printf("Error reading input: %v\n", err)
+			continue
+		}
+
+		input := strings.TrimSpace(line)
+		if input == "" {
+			continue
+		}
+		if err := executeControllerCommand(controller, input); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+}
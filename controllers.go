@@ -0,0 +1,208 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cgroupControllerAvailable checks if a controller is available in the cgroups v2 hierarchy
+func cgroupControllerAvailable(state *JailerState, controller string) bool {
+	if state.CgroupVersion != 2 {
+		return false
+	}
+
+	data, err := os.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+	if err != nil {
+		return false
+	}
+	for _, available := range strings.Fields(string(data)) {
+		if available == controller {
+			return true
+		}
+	}
+	return false
+}
+
+// enableCgroupController enables a controller for the children of the root cgroup, the
+// rdma and misc controllers are only enabled when a jail needs them
+func enableCgroupController(state *JailerState, controller string) error {
+	if !cgroupControllerAvailable(state, controller) {
+		if state.CgroupVersion != 2 {
+			return fmt.Errorf("%s jails require cgroups v2", controller)
+		}
+		return fmt.Errorf("the %s cgroup controller is not available on this system", controller)
+	}
+
+	controllersFile := "/sys/fs/cgroup/cgroup.subtree_control"
+	if err := os.WriteFile(controllersFile, []byte("+"+controller+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to enable the %s controller: %v", controller, err)
+	}
+	return nil
+}
+
+// memoryCgroupPathV1 returns the cgroup of the memory hierarchy holding the limit of the
+// memory jail of a process on cgroups v1, the dedicated cgroup is in the cpu hierarchy
+func memoryCgroupPathV1(pid int) string {
+	return filepath.Join("/sys/fs/cgroup/memory", fmt.Sprintf("jail-%d", pid))
+}
+
+// memoryLimitFile returns the file holding the limit of the memory jail of a jail,
+// memory.max on cgroups v2 and memory.limit_in_bytes on v1
+func memoryLimitFile(state *JailerState, jail *Jail) string {
+	if state.CgroupVersion == 1 {
+		return filepath.Join(memoryCgroupPathV1(jail.PID), "memory.limit_in_bytes")
+	}
+	return filepath.Join(jailCgroupPath(state, jail), "memory.max")
+}
+
+// moveProcessMemoryCgroupV1 moves a process to the memory cgroup of its memory jail on
+// cgroups v1, or back to its original memory cgroup once the memory jail is removed
+func moveProcessMemoryCgroupV1(jail *Jail, pid int) error {
+	cgroupPath := memoryCgroupPathV1(jail.PID)
+	if !jail.HasJailType("memory") {
+		if _, err := os.Stat(cgroupPath); err != nil {
+			return nil
+		}
+		cgroupPath = filepath.Join("/sys/fs/cgroup/memory", strings.TrimPrefix(jail.originalCgroupOf(pid), "/"))
+	}
+	procsFile := filepath.Join(cgroupPath, "cgroup.procs")
+	if err := os.WriteFile(procsFile, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to move PID %d to memory cgroup %s: %v", pid, cgroupPath, err)
+	}
+	return nil
+}
+
+// formatRdmaMax returns the rdma.max lines setting the limits of each device, value is
+// used for every resource when not empty
+func formatRdmaMax(limits map[string]uint64, value string) []string {
+	devices := make(map[string][]string)
+	for _, key := range strings.Fields(formatLimits(limits)) {
+		device, setting, _ := strings.Cut(key, ":")
+		if value != "" {
+			resource, _, _ := strings.Cut(setting, "=")
+			setting = resource + "=" + value
+		}
+		devices[device] = append(devices[device], setting)
+	}
+
+	names := make([]string, 0, len(devices))
+	for device := range devices {
+		names = append(names, device)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, device := range names {
+		lines = append(lines, device+" "+strings.Join(devices[device], " "))
+	}
+	return lines
+}
+
+// writeControllerLimits writes one limit per line to a controller interface file
+func writeControllerLimits(cgroupPath, file string, lines []string) error {
+	limitFile := filepath.Join(cgroupPath, file)
+	for _, line := range lines {
+		if err := os.WriteFile(limitFile, []byte(line+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to set %q in %s: %v", line, limitFile, err)
+		}
+	}
+	return nil
+}
+
+// setupRdmaLimits applies the limits of the rdma jail to the dedicated cgroup of a jail
+func setupRdmaLimits(state *JailerState, jail *Jail) error {
+	cgroupPath := jailCgroupPath(state, jail)
+	if err := writeControllerLimits(cgroupPath, "rdma.max", formatRdmaMax(jail.RdmaLimits, "")); err != nil {
+		return err
+	}
+	fmt.Fprintf(state.stdout(), "RDMA limits set to %s in %s\n", formatLimits(jail.RdmaLimits), cgroupPath)
+	return nil
+}
+
+// setupMiscLimits applies the limits of the misc jail to the dedicated cgroup of a jail
+func setupMiscLimits(state *JailerState, jail *Jail) error {
+	var lines []string
+	for _, name := range miscResourceNames(jail.MiscLimits) {
+		lines = append(lines, fmt.Sprintf("%s %d", name, jail.MiscLimits[name]))
+	}
+	cgroupPath := jailCgroupPath(state, jail)
+	if err := writeControllerLimits(cgroupPath, "misc.max", lines); err != nil {
+		return err
+	}
+	fmt.Fprintf(state.stdout(), "Misc limits set to %s in %s\n", formatLimits(jail.MiscLimits), cgroupPath)
+	return nil
+}
+
+// setupMemoryLimit applies the limit of the memory jail to the dedicated cgroup of a jail,
+// or to its cgroup of the memory hierarchy on cgroups v1
+func setupMemoryLimit(state *JailerState, jail *Jail) error {
+	if state.CgroupVersion == 1 {
+		if err := os.MkdirAll(memoryCgroupPathV1(jail.PID), 0755); err != nil {
+			return fmt.Errorf("failed to create memory jail cgroup directory: %v", err)
+		}
+	}
+	limitFile := memoryLimitFile(state, jail)
+	if err := os.WriteFile(limitFile, []byte(strconv.FormatUint(jail.MemoryLimit, 10)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to set memory limit in %s: %v", limitFile, err)
+	}
+	fmt.Fprintf(state.stdout(), "Memory limit set to %s in %s\n", formatBytes(jail.MemoryLimit), filepath.Dir(limitFile))
+	return nil
+}
+
+// resetControllerLimits lifts the limits of an rdma, misc or memory jail that is removed
+// while the jail keeps its dedicated cgroup
+func resetControllerLimits(state *JailerState, jail *Jail, jailType string) error {
+	cgroupPath := jailCgroupPath(state, jail)
+	switch jailType {
+	case "rdma":
+		return writeControllerLimits(cgroupPath, "rdma.max", formatRdmaMax(jail.RdmaLimits, "max"))
+	case "misc":
+		var lines []string
+		for _, name := range miscResourceNames(jail.MiscLimits) {
+			lines = append(lines, name+" max")
+		}
+		return writeControllerLimits(cgroupPath, "misc.max", lines)
+	case "memory":
+		// -1 is no limit on cgroups v1
+		unlimited := "max"
+		if state.CgroupVersion == 1 {
+			unlimited = "-1"
+		}
+		limitFile := memoryLimitFile(state, jail)
+		if err := os.WriteFile(limitFile, []byte(unlimited+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to lift memory limit in %s: %v", limitFile, err)
+		}
+	}
+	return nil
+}
+
+// reclaimCgroupMemory writes to memory.reclaim of a cgroup and returns memory.current
+// before and after. The kernel fails with EAGAIN when it reclaimed less than asked, that
+// isn't an error here, the readings tell what was reclaimed
+func reclaimCgroupMemory(cgroupDir string, amount uint64) (uint64, uint64, error) {
+	before, err := readCgroupValue(filepath.Join(cgroupDir, "memory.current"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("no memory controller in %s: %v", cgroupDir, err)
+	}
+	reclaimFile := filepath.Join(cgroupDir, "memory.reclaim")
+	if _, err := os.Stat(reclaimFile); err != nil {
+		return 0, 0, fmt.Errorf("memory.reclaim is not available in %s, it needs Linux 5.19 or later", cgroupDir)
+	}
+	err = os.WriteFile(reclaimFile, []byte(strconv.FormatUint(amount, 10)+"\n"), 0644)
+	if err != nil && !errors.Is(err, syscall.EAGAIN) {
+		return 0, 0, fmt.Errorf("failed to write %s: %v", reclaimFile, err)
+	}
+	after, err := readCgroupValue(filepath.Join(cgroupDir, "memory.current"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
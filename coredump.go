@@ -0,0 +1,54 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// suppressCoreDumps prevents a live process from dumping its memory to disk and returns
+// the previous settings. PR_SET_DUMPABLE can only be changed by the process itself, so
+// the equivalent for another process is to clear its coredump_filter: with a piped
+// core_pattern (systemd-coredump, apport) RLIMIT_CORE=0 is not enforced, but no memory
+// mapping is written once the filter is empty.
+func suppressCoreDumps(pid int) (savedCoreDump, error) {
+	var saved savedCoreDump
+
+	filterFile := fmt.Sprintf("/proc/%d/coredump_filter", pid)
+	content, err := os.ReadFile(filterFile)
+	if err != nil {
+		return saved, fmt.Errorf("failed to read coredump_filter for PID %d: %v", pid, err)
+	}
+	saved.Filter = strings.TrimSpace(string(content))
+
+	noCore := unix.Rlimit{Cur: 0, Max: 0}
+	if err := unix.Prlimit(pid, unix.RLIMIT_CORE, &noCore, &saved.CoreLimit); err != nil {
+		return saved, fmt.Errorf("failed to set core limit for PID %d: %v", pid, err)
+	}
+
+	if err := os.WriteFile(filterFile, []byte("0\n"), 0644); err != nil {
+		// Roll back the core limit so the process is left untouched
+		unix.Prlimit(pid, unix.RLIMIT_CORE, &saved.CoreLimit, nil)
+		return saved, fmt.Errorf("failed to clear coredump_filter for PID %d: %v", pid, err)
+	}
+
+	return saved, nil
+}
+
+// restoreCoreDumps restores the core dump settings saved by suppressCoreDumps
+func restoreCoreDumps(pid int, saved savedCoreDump) error {
+	if err := unix.Prlimit(pid, unix.RLIMIT_CORE, &saved.CoreLimit, nil); err != nil {
+		return fmt.Errorf("failed to restore core limit for PID %d: %v", pid, err)
+	}
+
+	filterFile := fmt.Sprintf("/proc/%d/coredump_filter", pid)
+	if err := os.WriteFile(filterFile, []byte(saved.Filter+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to restore coredump_filter for PID %d: %v", pid, err)
+	}
+
+	return nil
+}
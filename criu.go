@@ -0,0 +1,319 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultCheckpointDir is where checkpoint images go when no directory is given
+	defaultCheckpointDir = "/var/lib/jailer/checkpoints"
+
+	// checkpointMetadataFile stores the jail of a checkpoint next to the CRIU images
+	checkpointMetadataFile = "jailer-jail.json"
+)
+
+// criuCommonOptions are needed for most real-world process trees
+var criuCommonOptions = []string{"--shell-job", "--tcp-established", "--ext-unix-sk", "--file-locks"}
+
+// checkpointMetadata describes the jail of a checkpointed process tree
+type checkpointMetadata struct {
+	PID            int               `json:"pid"`
+	Name           string            `json:"name"`
+	JailTypes      []string          `json:"jail_types"`
+	CpuPercent     int               `json:"cpu_percent,omitempty"`
+	CpuWeight      int               `json:"cpu_weight,omitempty"`
+	Rlimits        map[string]uint64 `json:"rlimits,omitempty"`
+	RdmaLimits     map[string]uint64 `json:"rdma_limits,omitempty"`
+	MiscLimits     map[string]uint64 `json:"misc_limits,omitempty"`
+	MemoryLimit    uint64            `json:"memory_limit,omitempty"`
+	QuotaBytes     uint64            `json:"quota_bytes,omitempty"`
+	QuotaDirs      []string          `json:"quota_dirs,omitempty"`
+	LaunchProfiles map[string]string `json:"launch_profiles,omitempty"`
+	Command        []string          `json:"command,omitempty"`
+	Reason         string            `json:"reason,omitempty"`
+	JailedBy       string            `json:"jailed_by,omitempty"`
+	JailedSince    time.Time         `json:"jailed_since"`
+	ExpiresAt      time.Time         `json:"expires_at,omitempty"`
+	CheckpointedAt time.Time         `json:"checkpointed_at"`
+	Options        JailOptions       `json:"options"` // Flags of the jail, applied again on restore
+
+	// CRIU restores the jailed limits and the tree lands in the cgroup of jailer, the
+	// settings from before the jail are kept for the unjail after the restore
+	OriginalCgroup  string                         `json:"original_cgroup,omitempty"`
+	OriginalCgroups map[int]string                 `json:"original_cgroups,omitempty"`
+	SavedRlimits    map[int]map[string]unix.Rlimit `json:"saved_rlimits,omitempty"`
+	SavedOomScores  map[int]int                    `json:"saved_oom_scores,omitempty"`
+	SavedCoreDumps  map[int]savedCoreDump          `json:"saved_core_dumps,omitempty"`
+}
+
+// newCheckpointMetadata describes a jail for its checkpoint
+func newCheckpointMetadata(jail *Jail, processName string) checkpointMetadata {
+	return checkpointMetadata{
+		PID:            jail.PID,
+		Name:           processName,
+		JailTypes:      jail.JailTypes,
+		CpuPercent:     jail.CpuPercent,
+		CpuWeight:      jail.CpuWeight,
+		Rlimits:        jail.Rlimits,
+		RdmaLimits:     jail.RdmaLimits,
+		MiscLimits:     jail.MiscLimits,
+		MemoryLimit:    jail.MemoryLimit,
+		QuotaBytes:     jail.QuotaBytes,
+		QuotaDirs:      jail.QuotaDirs,
+		LaunchProfiles: jail.LaunchProfiles,
+		Command:        jail.Command,
+		Reason:         jail.Reason,
+		JailedBy:       jail.JailedBy,
+		JailedSince:    jail.Timestamp,
+		ExpiresAt:      jail.ExpiresAt,
+		CheckpointedAt: time.Now(),
+		Options:        jail.jailOptions(),
+
+		OriginalCgroup:  jail.OriginalCgroup,
+		OriginalCgroups: jail.OriginalCgroups,
+		SavedRlimits:    jail.SavedRlimits,
+		SavedOomScores:  jail.SavedOomScores,
+		SavedCoreDumps:  jail.SavedCoreDumps,
+	}
+}
+
+// checkpointProcess dumps a jailed process tree to disk with CRIU, the tree is
+// stopped once the dump succeeds
+func checkpointProcess(state *JailerState, pidStr, imageDir string) error {
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return fmt.Errorf("invalid PID: %s", pidStr)
+	}
+
+	jail, exists := state.ActiveJails[pid]
+	if !exists {
+		return fmt.Errorf("process %d is not jailed", pid)
+	}
+
+	if !commandExists("criu") {
+		return fmt.Errorf("criu is not installed")
+	}
+
+	processName := hostProcesses.name(pid)
+	if imageDir == "" {
+		imageDir = filepath.Join(defaultCheckpointDir,
+			fmt.Sprintf("%d-%s", pid, time.Now().Format("20060102-150405")))
+	}
+	if err := os.MkdirAll(imageDir, 0700); err != nil {
+		return fmt.Errorf("failed to create checkpoint directory: %v", err)
+	}
+
+	// Save the jail before dumping, the PIDs are gone afterwards
+	metadata := newCheckpointMetadata(jail, processName)
+	content, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode jail metadata: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, checkpointMetadataFile), content, 0600); err != nil {
+		return fmt.Errorf("failed to write jail metadata: %v", err)
+	}
+
+	fmt.Fprintf(state.stdout(), "Checkpointing process %d (%s) and %d descendants to %s...\n",
+		pid, processName, len(jail.Children), imageDir)
+
+	args := append([]string{"dump", "-t", pidStr, "-D", imageDir, "-o", "dump.log"}, criuCommonOptions...)
+	cmd := exec.Command("criu", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("criu dump failed: %v\nOutput: %s(see %s)",
+			err, string(output), filepath.Join(imageDir, "dump.log"))
+	}
+
+	// The tree no longer exists, drop the jail without restoring anything
+	if jail.usesDedicatedCgroup() {
+		state.Limits.releaseJail(jail)
+	}
+	if jail.HasJailType("quota") {
+		state.Quotas.releaseJail(jail)
+	}
+	state.Firewall.releaseJail(jail)
+	recordJailHistory(state, jail, "checkpointed")
+	delete(state.ActiveJails, pid)
+
+	fmt.Fprintf(state.stdout(), "Successfully checkpointed process %d (%s), restore it with: restore %s\n",
+		pid, processName, imageDir)
+	return nil
+}
+
+// restoreCheckpoint restores a process tree dumped by checkpointProcess and puts it back
+// in the same jail. The tree is restored stopped and only resumed once it is jailed
+func restoreCheckpoint(state *JailerState, imageDir string) error {
+	content, err := os.ReadFile(filepath.Join(imageDir, checkpointMetadataFile))
+	if err != nil {
+		return fmt.Errorf("not a jailer checkpoint: %v", err)
+	}
+
+	var metadata checkpointMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return fmt.Errorf("invalid jail metadata: %v", err)
+	}
+
+	if !commandExists("criu") {
+		return fmt.Errorf("criu is not installed")
+	}
+
+	if _, exists := state.ActiveJails[metadata.PID]; exists {
+		return fmt.Errorf("PID %d is already jailed", metadata.PID)
+	}
+
+	fmt.Fprintf(state.stdout(), "Restoring process %d (%s) from %s...\n", metadata.PID, metadata.Name, imageDir)
+
+	// jailer puts the tree back in its jail cgroups itself, the tree must not run before
+	pidFile := filepath.Join(imageDir, "restore.pid")
+	args := append([]string{"restore", "-D", imageDir, "-o", "restore.log", "-d", "--leave-stopped",
+		"--pidfile", pidFile, "--manage-cgroups=ignore"}, criuCommonOptions...)
+	cmd := exec.Command("criu", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("criu restore failed: %v\nOutput: %s(see %s)",
+			err, string(output), filepath.Join(imageDir, "restore.log"))
+	}
+
+	pidContent, err := os.ReadFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("failed to read restored PID: %v", err)
+	}
+	pidStr := strings.TrimSpace(string(pidContent))
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return fmt.Errorf("invalid restored PID: %s", pidStr)
+	}
+	descendants, err := hostProcesses.descendants(pid)
+	if err != nil {
+		return fmt.Errorf("failed to get descendants for PID %d: %v, the restored tree is left stopped", pid, err)
+	}
+	tree := append([]int{pid}, descendants...)
+
+	jail, failed, err := rejailCheckpoint(state, pid, descendants, metadata)
+	if err != nil {
+		return fmt.Errorf("%v, the restored tree is left stopped, %s", err, stoppedTreeHint(tree))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("the %s jail of process %d could not be restored, the restored tree is left stopped, %s",
+			strings.Join(failed, ", "), pid, stoppedTreeHint(tree))
+	}
+
+	if err := resumeTree(tree); err != nil {
+		return err
+	}
+	fmt.Fprintf(state.stdout(), "Successfully restored process %d (%s) with %s jail\n",
+		pid, metadata.Name, jail.GetJailTypesString())
+	return nil
+}
+
+// rejailCheckpoint puts a stopped restored tree back in the jail of its checkpoint. The
+// jail keeps the original cgroups and settings of the checkpoint, the current ones are
+// the jailed ones restored by CRIU. It returns the jail types that could not be applied
+func rejailCheckpoint(state *JailerState, pid int, descendants []int, metadata checkpointMetadata) (*Jail, []string, error) {
+	originalCgroup := metadata.OriginalCgroup
+	if originalCgroup == "" {
+		// Checkpoints of older jailers don't have it
+		var err error
+		if originalCgroup, err = state.Limits.processGroup(pid); err != nil {
+			return nil, nil, fmt.Errorf("failed to get original cgroup for PID %d: %v", pid, err)
+		}
+	}
+
+	// The jail exists before the jail types, so that they nest and restore below the
+	// original cgroup instead of the cgroup of jailer
+	jail := newJail(pid, originalCgroup)
+	for originalPid, cgroup := range metadata.OriginalCgroups {
+		jail.OriginalCgroups[originalPid] = cgroup
+	}
+	jail.Children = descendants
+	jail.Command = metadata.Command
+	jail.Reason = metadata.Reason
+	if metadata.JailedBy != "" {
+		jail.JailedBy = metadata.JailedBy
+	}
+	state.ActiveJails[pid] = jail
+
+	// Apply the jail types again with their flags, CRIU already restored the seccomp filters.
+	// Checkpoints of older jailers only have the reason
+	options := metadata.Options
+	if options.Reason == "" {
+		options.Reason = metadata.Reason
+	}
+	var failed []string
+	for _, jailType := range metadata.JailTypes {
+		if isLaunchOnlyJailType(jailType) {
+			continue
+		}
+
+		limits := &Jail{
+			CpuPercent:  metadata.CpuPercent,
+			CpuWeight:   metadata.CpuWeight,
+			Rlimits:     metadata.Rlimits,
+			RdmaLimits:  metadata.RdmaLimits,
+			MiscLimits:  metadata.MiscLimits,
+			MemoryLimit: metadata.MemoryLimit,
+			QuotaBytes:  metadata.QuotaBytes,
+			QuotaDirs:   metadata.QuotaDirs,
+		}
+		args := jailTypeArgs(limits, jailType)
+		if err := jailProcess(state, jailType, strconv.Itoa(pid), args, options); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: failed to restore %s jail of process %d: %v\n", jailType, pid, err)
+			failed = append(failed, jailType)
+		}
+	}
+
+	// Re-applying saved the jailed values restored by CRIU as the originals
+	savedSettingsMutex.Lock()
+	for savedPid, saved := range metadata.SavedRlimits {
+		jail.SavedRlimits[savedPid] = saved
+	}
+	for savedPid, original := range metadata.SavedOomScores {
+		jail.SavedOomScores[savedPid] = original
+	}
+	for savedPid, saved := range metadata.SavedCoreDumps {
+		jail.SavedCoreDumps[savedPid] = saved
+	}
+	savedSettingsMutex.Unlock()
+
+	// The jail expires when it would have without the checkpoint
+	jail.ExpiresAt = metadata.ExpiresAt
+
+	// Record the jails that were enforced before exec
+	for jailType, profileName := range metadata.LaunchProfiles {
+		jail.AddJailType(jailType)
+		jail.LaunchProfiles[jailType] = profileName
+	}
+	if len(jail.JailTypes) == 0 {
+		delete(state.ActiveJails, pid)
+		return nil, nil, fmt.Errorf("no jail of process %d could be restored", pid)
+	}
+	return jail, failed, nil
+}
+
+// resumeTree continues the processes of a tree restored with --leave-stopped
+func resumeTree(pids []int) error {
+	for _, pid := range pids {
+		if err := unix.Kill(pid, unix.SIGCONT); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("failed to resume process %d: %v, %s", pid, err, stoppedTreeHint(pids))
+		}
+	}
+	return nil
+}
+
+// stoppedTreeHint tells how to resume a restored tree once it is jailed
+func stoppedTreeHint(pids []int) string {
+	words := make([]string, len(pids))
+	for i, pid := range pids {
+		words[i] = strconv.Itoa(pid)
+	}
+	return "resume it once jailed with: kill -CONT " + strings.Join(words, " ")
+}
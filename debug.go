@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	rpprof "runtime/pprof"
+	"syscall"
+	"time"
+)
+
+// validateDebugAddress checks that the pprof endpoint only listens on the loopback, the
+// profiles and stacks reveal the jails and the memory of jailer
+func validateDebugAddress(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid -debug-listen address %q: %v", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("-debug-listen must be a loopback address such as 127.0.0.1:6060, got %q", addr)
+	}
+	return nil
+}
+
+// runDebugListener serves net/http/pprof on /debug/pprof/ until it fails
+func runDebugListener(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	fmt.Printf("Serving pprof on http://%s/debug/pprof/\n", addr)
+	return fmt.Errorf("debug listener on %s failed: %v", addr, server.ListenAndServe())
+}
+
+// writeGoroutineStacks writes the stack of every goroutine, with how long each has been
+// blocked and on what
+func writeGoroutineStacks(w io.Writer) error {
+	fmt.Fprintf(w, "=== goroutine stacks of jailer %d at %s ===\n", os.Getpid(), time.Now().Format(time.RFC3339))
+	if err := rpprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, "=== end of goroutine stacks ===")
+	return err
+}
+
+// runStackDumper writes the goroutine stacks to stderr on every SIGUSR2 until jailer
+// exits. It doesn't lock the state, so it answers when a firewall or cgroup call hangs
+// with the state locked
+func runStackDumper() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	for range signals {
+		if err := writeGoroutineStacks(os.Stderr); err != nil {
+			fmt.Printf("Warning: failed to dump the goroutine stacks: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// dumpLockTimeout is how long a dump waits for the state, a jailer stuck with its state
+// locked still gets a dump without it
+const dumpLockTimeout = 5 * time.Second
+
+// stateDump is the in-memory state of a live jailer, written on SIGUSR1 for debugging
+type stateDump struct {
+	DumpedAt          time.Time                       `json:"dumped_at"`
+	PID               int                             `json:"pid"`
+	Goroutines        int                             `json:"goroutines"`
+	StateLocked       bool                            `json:"state_locked,omitempty"` // The state stayed locked, only the above is dumped
+	CgroupVersion     int                             `json:"cgroup_version,omitempty"`
+	FirewallTool      string                          `json:"firewall_tool,omitempty"`
+	CgroupPaths       map[string]string               `json:"cgroup_paths,omitempty"`
+	Jails             []*Jail                         `json:"jails,omitempty"`
+	Timers            []dumpTimer                     `json:"timers,omitempty"`
+	Schedules         []dumpSchedule                  `json:"schedules,omitempty"`
+	PendingPersistent []persistentJail                `json:"pending_persistent,omitempty"`
+	Operations        []string                        `json:"operations,omitempty"` // Commands undo can revert, oldest first
+	EndedJails        int                             `json:"ended_jails"`          // Jails that ended during this session
+	NetNamespaces     map[string]int                  `json:"net_namespaces,omitempty"`
+	DisabledJailTypes map[string]string               `json:"disabled_jail_types,omitempty"`
+	SetupFailures     map[string]string               `json:"setup_failures,omitempty"`
+	BlocklistFeeds    map[string]*blocklistFeedStatus `json:"blocklist_feeds,omitempty"`
+}
+
+// dumpTimer is a change the monitors will make to a jail on their own
+type dumpTimer struct {
+	PID    int       `json:"pid"`
+	Name   string    `json:"name"`
+	Kind   string    `json:"kind"` // "expiry", "squeeze" or "adaptive"
+	At     time.Time `json:"at,omitempty"`
+	In     string    `json:"in,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// dumpSchedule is a scheduled jail and whether its window is open
+type dumpSchedule struct {
+	PID      int         `json:"pid"`
+	JailType string      `json:"jail_type"`
+	Args     []string    `json:"args,omitempty"`
+	Options  JailOptions `json:"options"`
+	Window   string      `json:"window"`
+	Operator string      `json:"operator"`
+	Active   bool        `json:"active"`
+}
+
+// buildStateDump copies the state into a dump, the caller holds stateMutex
+func buildStateDump(state *JailerState, now time.Time) stateDump {
+	dump := stateDump{
+		DumpedAt:          now,
+		PID:               os.Getpid(),
+		Goroutines:        runtime.NumGoroutine(),
+		CgroupVersion:     state.CgroupVersion,
+		FirewallTool:      state.FirewallTool,
+		CgroupPaths:       make(map[string]string),
+		PendingPersistent: state.PendingPersistent,
+		EndedJails:        len(state.History),
+		NetNamespaces:     make(map[string]int),
+		DisabledJailTypes: state.DisabledJailTypes,
+		SetupFailures:     state.SetupFailures,
+		BlocklistFeeds:    state.BlocklistFeeds,
+	}
+	for name, path := range map[string]string{"network": state.NetworkCgroupPath, "cpu": state.CpuCgroupPath,
+		"network+cpu": state.NetworkCpuCgroupPath} {
+		if path != "" {
+			dump.CgroupPaths[name] = path
+		}
+	}
+	for namespace, jailNamespace := range state.NetNamespaces {
+		dump.NetNamespaces[namespace] = jailNamespace.refs
+	}
+	for _, operation := range state.Operations {
+		dump.Operations = append(dump.Operations, operation.Description)
+	}
+
+	for _, jail := range state.ActiveJails {
+		dump.Jails = append(dump.Jails, jail)
+		dump.Timers = append(dump.Timers, jailTimers(jail, now)...)
+	}
+	sort.Slice(dump.Jails, func(i, j int) bool { return dump.Jails[i].PID < dump.Jails[j].PID })
+	sort.SliceStable(dump.Timers, func(i, j int) bool { return dump.Timers[i].PID < dump.Timers[j].PID })
+
+	for _, schedule := range state.Schedules {
+		dump.Schedules = append(dump.Schedules, dumpSchedule{PID: schedule.PID, JailType: schedule.JailType,
+			Args: schedule.Args, Options: schedule.Options, Window: schedule.Window.String(), Operator: schedule.Operator,
+			Active: schedule.Window.contains(now)})
+	}
+	return dump
+}
+
+// jailTimers returns the changes the monitors will make to a jail: its release, the end
+// of its squeeze and the adjustments of an adaptive limit
+func jailTimers(jail *Jail, now time.Time) []dumpTimer {
+	var timers []dumpTimer
+	if !jail.ExpiresAt.IsZero() {
+		timers = append(timers, dumpTimer{PID: jail.PID, Name: jail.Name, Kind: "expiry", At: jail.ExpiresAt,
+			In: formatExpiry(jail, now), Detail: "released by expiry"})
+	}
+	if squeeze := jail.Squeeze; squeeze != nil {
+		end := squeeze.Since.Add(squeeze.Over)
+		timers = append(timers, dumpTimer{PID: jail.PID, Name: jail.Name, Kind: "squeeze", At: end,
+			In:     max(end.Sub(now), 0).Round(time.Second).String(),
+			Detail: fmt.Sprintf("from %d%% to %d%%, %d%% applied", squeeze.StartPercent, jail.CpuPercent, squeeze.Applied)})
+	}
+	if adaptive := jail.Adaptive; adaptive != nil {
+		timers = append(timers, dumpTimer{PID: jail.PID, Name: jail.Name, Kind: "adaptive",
+			Detail: fmt.Sprintf("up to %d%%, host kept under %d%%, %d%% applied", jail.CpuPercent, adaptive.TargetPercent,
+				adaptive.Applied)})
+	}
+	return timers
+}
+
+// lockStateWithin locks stateMutex unless it stays locked for the timeout
+func lockStateWithin(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !stateMutex.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// dumpState writes the state as JSON to dump_file, or to stderr without one
+func dumpState(state *JailerState) error {
+	if lockStateWithin(dumpLockTimeout) {
+		dump := buildStateDump(state, time.Now())
+		content, err := json.MarshalIndent(dump, "", "  ")
+		stateMutex.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to encode the state dump: %v", err)
+		}
+		return writeStateDump(state.Config.DumpFile, content, len(dump.Jails))
+	}
+
+	dump := stateDump{DumpedAt: time.Now(), PID: os.Getpid(), Goroutines: runtime.NumGoroutine(), StateLocked: true}
+	content, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the state dump: %v", err)
+	}
+	fmt.Fprintf(state.stdout(), "Warning: state locked for more than %s, dumping without it\n", dumpLockTimeout)
+	return writeStateDump(state.Config.DumpFile, content, 0)
+}
+
+// writeStateDump writes a dump to its file, replacing the previous one, or to stderr
+func writeStateDump(path string, content []byte, jails int) error {
+	content = append(content, '\n')
+	if path == "" {
+		_, err := os.Stderr.Write(content)
+		return err
+	}
+	// The jails carry their reasons and command lines
+	if err := writeAtomically(path, content, 0600); err != nil {
+		return fmt.Errorf("failed to write the state dump to %s: %v", path, err)
+	}
+	fmt.Printf("Dumped the state of %d jails to %s\n", jails, path)
+	return nil
+}
+
+// runStateDumper dumps the state on every SIGUSR1 until jailer exits
+func runStateDumper(state *JailerState) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		if err := dumpState(state); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+}
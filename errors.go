@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// errorFormat is how failed commands are reported, text or json, set by -error-format
+var errorFormat = "text"
+
+// errorOutput receives the errors reported as JSON
+var errorOutput io.Writer = os.Stderr
+
+// commandError is a failed command as reported with -error-format json
+type commandError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	PID       int    `json:"pid,omitempty"`
+	Operation string `json:"operation,omitempty"` // Command that failed, empty for a line of several commands
+	Line      int    `json:"line,omitempty"`      // Line of the piped input, 0 for the other commands
+}
+
+// errorCodes classify the error messages, the first matching code wins. Errors without
+// a match have the code "failed"
+var errorCodes = []struct {
+	code    string
+	pattern *regexp.Regexp
+}{
+	{"permission_denied", regexp.MustCompile(`(?i)permission denied|operation not permitted|read-only file system`)},
+	{"pid_not_found", regexp.MustCompile(`(?i)(process|PID) \d+ (does not exist|no longer exists)|no such process`)},
+	{"not_jailed", regexp.MustCompile(`is not jailed`)},
+	{"already_jailed", regexp.MustCompile(`is already jailed`)},
+	{"jail_type_disabled", regexp.MustCompile(`jails are disabled`)},
+	{"unknown_command", regexp.MustCompile(`^unknown command`)},
+	{"unknown_jail_type", regexp.MustCompile(`(unknown|unsupported) jail type`)},
+	{"usage", regexp.MustCompile(`usage: `)},
+	{"invalid_argument", regexp.MustCompile(`(?i)\binvalid\b|no target`)},
+	{"commands_failed", regexp.MustCompile(`^\d+ of \d+ (commands failed|processes could not be jailed)`)},
+	{"cgroup_error", regexp.MustCompile(`(?i)cgroup`)},
+	{"firewall_error", regexp.MustCompile(`(?i)firewall|nftables|iptables|\bnft\b`)},
+}
+
+// errorPID matches the PID named by an error message
+var errorPID = regexp.MustCompile(`\b(?:process|PID) (\d+)`)
+
+// parseErrorFormat checks the value of -error-format
+func parseErrorFormat(value string) (string, error) {
+	switch value {
+	case "text", "json":
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid -error-format %q, expected text or json", value)
+}
+
+// newCommandError classifies the error of a command line, the PID is the one named by
+// the message or else the first PID argument of the command
+func newCommandError(input string, line int, err error) commandError {
+	report := commandError{Code: "failed", Message: err.Error(), Line: line}
+	for _, errorCode := range errorCodes {
+		if errorCode.pattern.MatchString(report.Message) {
+			report.Code = errorCode.code
+			break
+		}
+	}
+
+	commands, _ := splitCommands(input)
+	if len(commands) == 1 && len(commands[0]) > 0 {
+		report.Operation = strings.ToLower(commands[0][0])
+		if c := lookupCommand(commands[0][0]); c != nil {
+			report.Operation = c.name
+		}
+	}
+	if match := errorPID.FindStringSubmatch(report.Message); match != nil {
+		report.PID, _ = strconv.Atoi(match[1])
+	} else if len(commands) == 1 {
+		for _, word := range commands[0][1:] {
+			if pid, err := strconv.Atoi(word); err == nil && pid > 0 {
+				report.PID = pid
+				break
+			}
+		}
+	}
+	return report
+}
+
+// reportError reports the error of a command line, as Error: ... on stdout or as a JSON
+// line on stderr with -error-format json. line is the line of the piped input, 0 otherwise
+func reportError(input string, line int, err error) {
+	if errorFormat != "json" {
+		if line > 0 {
+			fmt.Printf("Error: line %d: %v\n", line, err)
+		} else {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return
+	}
+	if encodeErr := json.NewEncoder(errorOutput).Encode(newCommandError(input, line, err)); encodeErr != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
@@ -0,0 +1,107 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// sessionEndpoint splits an address of /proc/net into the host and port matched by the
+// firewall, IPv4-mapped addresses of tcp6 sockets are seen as IPv4 by netfilter
+func sessionEndpoint(address string) (net.IP, string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, "", err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, "", fmt.Errorf("no address in %q", address)
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	return ip, port, nil
+}
+
+// sessionRuleSpecs returns the rules accepting the packets of an established session in
+// the output and input chains of the network jail of a jail, false when the firewall
+// doesn't filter the session anyway, as iptables with IPv6
+func sessionRuleSpecs(state *JailerState, jail *Jail, session socketEntry) ([]string, []string, bool) {
+	local, localPort, err := sessionEndpoint(session.Local)
+	if err != nil {
+		return nil, nil, false
+	}
+	remote, remotePort, err := sessionEndpoint(session.Remote)
+	if err != nil {
+		return nil, nil, false
+	}
+	protocol := strings.TrimSuffix(session.Protocol, "6")
+	match := jailNetworkMatch(state, jail)
+
+	if state.FirewallTool == "nftables" {
+		family := "ip"
+		if local.To4() == nil {
+			family = "ip6"
+		}
+		spec := func(source net.IP, sourcePort string, destination net.IP, destinationPort string) []string {
+			return append(append([]string{}, match...), "ct", "state", "established,related",
+				family, "saddr", source.String(), family, "daddr", destination.String(),
+				protocol, "sport", sourcePort, protocol, "dport", destinationPort, "accept")
+		}
+		return spec(local, localPort, remote, remotePort), spec(remote, remotePort, local, localPort), true
+	}
+
+	if local.To4() == nil {
+		return nil, nil, false
+	}
+	spec := func(source net.IP, sourcePort string, destination net.IP, destinationPort string) []string {
+		return append(append([]string{}, match...), "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED",
+			"-s", source.String(), "-d", destination.String(),
+			"-p", protocol, "--sport", sourcePort, "--dport", destinationPort, "-j", "ACCEPT")
+	}
+	return spec(local, localPort, remote, remotePort), spec(remote, remotePort, local, localPort), true
+}
+
+// allowEstablishedSessions lets the TCP and UDP sessions open in a process tree go on
+// through the network jail, only the sessions opened afterwards are dropped. The network
+// jails share one cgroup, so each session gets rules of its own
+func allowEstablishedSessions(state *JailerState, jail *Jail, pids []int) error {
+	seen := make(map[string]bool)
+	for _, connection := range getProcessConnections(pids) {
+		key := connection.Protocol + " " + connection.Local + " " + connection.Remote
+		if connection.State != "ESTABLISHED" || seen[key] {
+			continue
+		}
+		output, input, filtered := sessionRuleSpecs(state, jail, connection.socketEntry)
+		if !filtered {
+			continue
+		}
+		seen[key] = true
+
+		for _, rule := range []struct {
+			chain string
+			spec  []string
+		}{{"output", output}, {"input", input}} {
+			inserted, err := insertFirewallRule(state, rule.chain, rule.spec)
+			if err != nil {
+				releaseEstablishedSessions(state, jail)
+				return fmt.Errorf("failed to allow established sessions: %v", err)
+			}
+			jail.SessionRules = append(jail.SessionRules, inserted)
+		}
+		fmt.Fprintf(state.stdout(), "  Keeping %s session %s -> %s of process %d open\n",
+			connection.Protocol, connection.Local, connection.Remote, connection.PID)
+	}
+	if len(seen) == 0 {
+		fmt.Fprintf(state.stdout(), "  No established sessions to keep for process %d\n", jail.PID)
+	}
+	return nil
+}
+
+// releaseEstablishedSessions removes the rules letting the sessions of a jail through
+func releaseEstablishedSessions(state *JailerState, jail *Jail) {
+	deleteFirewallRules(state, jail.SessionRules)
+	jail.SessionRules = nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventsWatchInterval is the time between two checks for exited and escaped processes
+	eventsWatchInterval = 5 * time.Second
+
+	// eventsKeepAlive is the time between two SSE comments keeping idle streams open
+	eventsKeepAlive = 30 * time.Second
+
+	// eventsBuffer is the number of events a subscriber may lag behind before losing some
+	eventsBuffer = 256
+
+	// eventsHistory is the number of past events sent to the subscribers asking for them
+	eventsHistory = 100
+
+	// defaultEventsURL is the event stream read by the events command without --url
+	defaultEventsURL = "http://127.0.0.1:2803/events"
+)
+
+// EventsConfig configures the endpoint streaming the jail lifecycle events
+type EventsConfig struct {
+	Token   string `json:"token"`    // Bearer token required from the subscribers
+	TLSCert string `json:"tls_cert"` // Serves HTTPS when set with tls_key
+	TLSKey  string `json:"tls_key"`
+}
+
+// jailEvent is a change of a jail sent to the subscribers
+type jailEvent struct {
+	Time      time.Time `json:"time"`
+	Host      string    `json:"host"`
+	Event     string    `json:"event"` // created, updated, released, process-exited, checkpointed or escape-detected
+	PID       int       `json:"pid"`
+	Name      string    `json:"name"`
+	JailTypes []string  `json:"jail_types"`
+	Reason    string    `json:"reason,omitempty"`
+	JailedBy  string    `json:"jailed_by,omitempty"`
+	JailedAt  time.Time `json:"jailed_at"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// eventHub fans the jail events out to the subscribers, a subscriber too slow to keep up
+// loses the events its buffer can't hold instead of blocking the jail commands
+type eventHub struct {
+	mutex       sync.Mutex
+	subscribers map[chan jailEvent]struct{}
+	recent      []jailEvent // Last events, for the subscribers asking for the history
+}
+
+// jailEvents receives the events of every jail of this jailer
+var jailEvents = &eventHub{subscribers: make(map[chan jailEvent]struct{})}
+
+// subscribe returns a channel receiving the events until unsubscribe, and the last events
+// published before
+func (h *eventHub) subscribe() (chan jailEvent, []jailEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	events := make(chan jailEvent, eventsBuffer)
+	h.subscribers[events] = struct{}{}
+	return events, append([]jailEvent{}, h.recent...)
+}
+
+// unsubscribe stops sending events to a channel
+func (h *eventHub) unsubscribe(events chan jailEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.subscribers, events)
+}
+
+// publish sends an event to every subscriber and keeps it in the history
+func (h *eventHub) publish(event jailEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.recent = append(h.recent, event)
+	if len(h.recent) > eventsHistory {
+		h.recent = h.recent[len(h.recent)-eventsHistory:]
+	}
+	for events := range h.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// publishJailEvent sends a change of a jail to the subscribers
+func publishJailEvent(event string, jail *Jail, detail string) {
+	published := jailEvent{
+		Time:      time.Now(),
+		Event:     event,
+		PID:       jail.PID,
+		Name:      jail.Name,
+		JailTypes: append([]string{}, jail.JailTypes...),
+		Reason:    jail.Reason,
+		JailedBy:  jail.JailedBy,
+		JailedAt:  jail.Timestamp,
+		Detail:    detail,
+	}
+	published.Host, _ = os.Hostname()
+	jailEvents.publish(published)
+}
+
+// jailEndEvents are the events of the end reasons of the history
+var jailEndEvents = map[string]string{
+	"unjailed":     "released",
+	"expired":      "released",
+	"exited":       "process-exited",
+	"checkpointed": "checkpointed",
+}
+
+// isJailEndEvent reports whether an event is the end of a jail
+func isJailEndEvent(event string) bool {
+	for _, end := range jailEndEvents {
+		if end == event {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEventsConfig checks the TLS settings of the events endpoint
+func validateEventsConfig(config EventsConfig) error {
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	return nil
+}
+
+// isJailCgroup reports whether a cgroup path, relative to its hierarchy, is one of the jail
+// cgroups at the top level
+func isJailCgroup(path string) bool {
+	top, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return top == "jail" || strings.HasPrefix(top, "jail-")
+}
+
+// escapedProcess returns a process of a cgroup-based jail that is no longer in a jail
+// cgroup, e.g. moved out by a service manager or by the process itself with the privileges
+func escapedProcess(state *JailerState, jail *Jail) (int, string, bool) {
+	if !jail.HasCgroupJailTypes() {
+		return 0, "", false
+	}
+	controller := "cpu"
+	if state.CgroupVersion == 1 && !jail.HasJailType("cpu") {
+		controller = "net_cls"
+	}
+	root := "/sys/fs/cgroup"
+	if state.CgroupVersion == 1 {
+		root = filepath.Join(root, controller)
+	}
+
+	for _, pid := range append([]int{jail.PID}, jail.Children...) {
+		cgroupDir, err := getProcessControllerCgroup(state, pid, controller)
+		if err != nil {
+			continue
+		}
+		path := strings.TrimPrefix(cgroupDir, root)
+		// A nested jail cgroup is below the original cgroup instead of the top level
+		if !isJailCgroup(path) && (jail.CgroupPath == "" || cgroupDir != jail.CgroupPath) {
+			return pid, path, true
+		}
+	}
+	return 0, "", false
+}
+
+// eventsWatcher finds the exited processes and the escapes without waiting for a command
+type eventsWatcher struct {
+	state   *JailerState
+	escaped map[int]bool // Jails whose escape was already reported
+}
+
+// check removes the exited jails, whose events are sent by the cleanup, and reports the
+// jails with a process out of the jail cgroups once
+func (w *eventsWatcher) check() {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	cleanupDeadProcesses(w.state)
+	pids := make([]int, 0, len(w.state.ActiveJails))
+	for pid := range w.state.ActiveJails {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+
+	for pid := range w.escaped {
+		if _, exists := w.state.ActiveJails[pid]; !exists {
+			delete(w.escaped, pid)
+		}
+	}
+	for _, pid := range pids {
+		jail := w.state.ActiveJails[pid]
+		escapedPid, cgroup, escaped := escapedProcess(w.state, jail)
+		if !escaped {
+			delete(w.escaped, pid)
+			continue
+		}
+		if w.escaped[pid] {
+			continue
+		}
+		w.escaped[pid] = true
+		fmt.Printf("Warning: process %d of the %s jail of %d is in cgroup %s, outside of the jail\n",
+			escapedPid, jail.GetJailTypesString(), pid, cgroup)
+		publishJailEvent("escape-detected", jail, fmt.Sprintf("process %d is in cgroup %s", escapedPid, cgroup))
+		addPromptWarning(fmt.Sprintf("process %d of the %s jail of %d escaped to cgroup %s",
+			escapedPid, jail.GetJailTypesString(), pid, cgroup))
+	}
+}
+
+// runEventsWatcher reports the exited processes and the escapes until jailer exits
+func runEventsWatcher(state *JailerState) {
+	watcher := &eventsWatcher{state: state, escaped: make(map[int]bool)}
+	for range time.Tick(eventsWatchInterval) {
+		watcher.check()
+	}
+}
+
+// runEventsListener streams the jail events on /events until it fails
+func runEventsListener(state *JailerState, addr string) error {
+	config := state.Config.Events
+	if config.Token == "" {
+		return fmt.Errorf("events.token must be set in the configuration")
+	}
+
+	go runEventsWatcher(state)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(state, w, r)
+	})
+	registerHealthHandlers(mux, state)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	scheme := "http"
+	if config.TLSCert != "" {
+		scheme = "https"
+	}
+	fmt.Printf("Streaming jail events on %s://%s/events\n", scheme, addr)
+	var err error
+	if config.TLSCert != "" {
+		err = server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	return fmt.Errorf("events listener on %s failed: %v", addr, err)
+}
+
+// serveEvents streams the jail events to a subscriber as Server-Sent Events, one JSON
+// event per message named after the event. history=true sends the last events first and
+// follow=false ends the stream after them
+func serveEvents(state *JailerState, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "events must be requested with GET", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(state.Config.Events.Token)) != 1 {
+		fmt.Printf("Warning: rejected events subscriber %s: invalid token\n", r.RemoteAddr)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	history, _ := strconv.ParseBool(query.Get("history"))
+	follow := true
+	if value := query.Get("follow"); value != "" {
+		follow, _ = strconv.ParseBool(value)
+	}
+
+	events, recent := jailEvents.subscribe()
+	defer jailEvents.unsubscribe(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": jailer events\n\n")
+	if history {
+		for _, event := range recent {
+			writeEvent(w, event)
+		}
+	}
+	flusher.Flush()
+	if !follow {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes an event as a Server-Sent Events message
+func writeEvent(w io.Writer, event jailEvent) error {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, content)
+	return err
+}
+
+// runEventsClient prints the events of the jailer streaming them, and keeps printing the
+// new ones with --follow. It returns the exit code of jailer
+func runEventsClient(config *Config, args []string) int {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	follow := fs.Bool("follow", false, "keep printing the new events until Ctrl+C")
+	fs.BoolVar(follow, "f", false, "shorthand for --follow")
+	streamURL := fs.String("url", defaultEventsURL, "event stream of the jailer started with -events-listen")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Println("Error: usage: jailer events [--follow] [--url <url>]")
+		return 1
+	}
+	if err := followEvents(config.Events.Token, *streamURL, *follow, os.Stdout); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// followEvents prints the last events of a stream, and the new ones until it ends when
+// following it
+func followEvents(token, streamURL string, follow bool, out io.Writer) error {
+	parsed, err := url.Parse(streamURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fmt.Errorf("invalid event stream URL %q", streamURL)
+	}
+	query := parsed.Query()
+	query.Set("history", "true")
+	query.Set("follow", strconv.FormatBool(follow))
+	parsed.RawQuery = query.Encode()
+
+	request, err := http.NewRequest(http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the event stream: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("event stream refused: %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	fmt.Fprintf(out, "%-8s  %-15s  %7s  %-15s  %-15s  %s\n", "TIME", "EVENT", "PID", "NAME", "TYPES", "DETAIL")
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		data, isData := strings.CutPrefix(scanner.Text(), "data: ")
+		if !isData {
+			continue
+		}
+		var event jailEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			continue
+		}
+		detail := event.Detail
+		if detail == "" && event.Event == "created" {
+			detail = event.Reason
+		}
+		fmt.Fprintf(out, "%-8s  %-15s  %7d  %-15s  %-15s  %s\n", event.Time.Local().Format("15:04:05"),
+			event.Event, event.PID, event.Name, strings.Join(event.JailTypes, ","), detail)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("event stream interrupted: %v", err)
+	}
+	if follow {
+		return fmt.Errorf("event stream closed by jailer")
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// expiryCheckInterval is the time between two checks of the jails released automatically
+const expiryCheckInterval = 30 * time.Second
+
+// defaultExpiryWarning is how long before its release an expiring jail is notified
+const defaultExpiryWarning = 10 * time.Minute
+
+// parseExpiryWarning returns the notice given before the release of the expiring jails,
+// "off" disables the notification
+func parseExpiryWarning(value string) (time.Duration, error) {
+	switch value {
+	case "":
+		return defaultExpiryWarning, nil
+	case "off":
+		return 0, nil
+	}
+	warning, err := parseDuration(value)
+	if err != nil || warning <= 0 {
+		return 0, fmt.Errorf("invalid expiry_warning %q", value)
+	}
+	return warning, nil
+}
+
+// parseJailExpiry parses the --for flag, empty for the jails kept until unjailed
+func parseJailExpiry(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := parseDuration(value)
+	if err != nil || duration == 0 {
+		return 0, fmt.Errorf("invalid --for duration: %s", value)
+	}
+	return duration, nil
+}
+
+// formatExpiry returns the time left before the release of a jail, "-" for the jails
+// without expiry
+func formatExpiry(jail *Jail, now time.Time) string {
+	if jail.ExpiresAt.IsZero() {
+		return "-"
+	}
+	left := jail.ExpiresAt.Sub(now)
+	if left <= 0 {
+		return "now"
+	}
+	return left.Round(time.Second).String()
+}
+
+// extendJail pushes back the release of an expiring jail
+func extendJail(state *JailerState, pid int, extension time.Duration) error {
+	jail, exists := state.ActiveJails[pid]
+	if !exists {
+		return fmt.Errorf("process %d is not jailed", pid)
+	}
+	if jail.ExpiresAt.IsZero() {
+		return fmt.Errorf("jail of process %d doesn't expire, it stays until unjailed", pid)
+	}
+	if extension <= 0 {
+		return fmt.Errorf("the extension must be positive")
+	}
+	if now := time.Now(); jail.ExpiresAt.Before(now) {
+		jail.ExpiresAt = now
+	}
+	jail.ExpiresAt = jail.ExpiresAt.Add(extension)
+	fmt.Fprintf(state.stdout(), "Jail of process %d (%s) now expires at %s, in %s\n", pid, jail.Name,
+		jail.ExpiresAt.Format(time.RFC3339), formatExpiry(jail, time.Now()))
+
+	extended := "extended by " + extension.String()
+	writeAuditEvent(state, AuditEvent{Action: "extend", JailTypes: jail.JailTypes, Reason: extended,
+		Targets: []AuditTarget{newAuditTarget(pid, jail.Name, nil)}})
+	publishInventory(state)
+	publishJailEvent("updated", jail, extended)
+	return nil
+}
+
+// expiryMonitor releases the expiring jails and notifies them beforehand
+type expiryMonitor struct {
+	state   *JailerState
+	warning time.Duration
+	warned  map[int]time.Time // Expiry each jail was notified for, notified again once extended
+}
+
+// newExpiryMonitor returns a monitor of the jails of the state
+func newExpiryMonitor(state *JailerState) *expiryMonitor {
+	warning, _ := parseExpiryWarning(state.Config.ExpiryWarning)
+	return &expiryMonitor{state: state, warning: warning, warned: make(map[int]time.Time)}
+}
+
+// check releases the expired jails and notifies the ones released within the warning
+func (m *expiryMonitor) check(now time.Time) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	for pid := range m.warned {
+		if _, exists := m.state.ActiveJails[pid]; !exists {
+			delete(m.warned, pid)
+		}
+	}
+	released := false
+	for pid, jail := range m.state.ActiveJails {
+		if jail.ExpiresAt.IsZero() {
+			continue
+		}
+		if !now.Before(jail.ExpiresAt) {
+			fmt.Printf("Jail of process %d (%s) expired, releasing it\n", pid, jail.Name)
+			name, jailTypes := jail.Name, jail.JailTypes
+			err := endJail(m.state, strconv.Itoa(pid), "expired")
+			if err != nil {
+				fmt.Printf("Warning: failed to release the expired jail of process %d: %v\n", pid, err)
+			}
+			writeAuditEvent(m.state, AuditEvent{Action: "unjail", Operator: "expiry", JailTypes: jailTypes,
+				Reason: "expired", Targets: []AuditTarget{newAuditTarget(pid, name, err)}})
+			delete(m.warned, pid)
+			released = true
+			continue
+		}
+		if m.warning == 0 || jail.ExpiresAt.Sub(now) > m.warning || m.warned[pid].Equal(jail.ExpiresAt) {
+			continue
+		}
+		m.warned[pid] = jail.ExpiresAt
+		sendNotification(m.state, newNotification("jail_expiring", jail, fmt.Sprintf(
+			"Jail of process %d (%s) is released in %s, jailed %s ago by %s: %s, extend it with: extend %d 1h",
+			pid, jail.Name, jail.ExpiresAt.Sub(now).Round(time.Minute), now.Sub(jail.Timestamp).Round(time.Minute),
+			jailOperator(jail), jail.Reason, pid)))
+	}
+	if released {
+		publishInventory(m.state)
+	}
+}
+
+// runExpiryMonitor releases the expiring jails until jailer exits
+func runExpiryMonitor(state *JailerState) {
+	monitor := newExpiryMonitor(state)
+	for now := range time.Tick(expiryCheckInterval) {
+		monitor.check(now)
+	}
+}
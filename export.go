@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportReport is the JSON document written by export
+type exportReport struct {
+	ExportedAt  time.Time    `json:"exported_at"`
+	ActiveJails []JailRecord `json:"active_jails"`
+	History     []JailRecord `json:"history"`
+}
+
+// exportJails writes the active jails and the jail history to a file, the format defaults
+// to the file extension and then to JSON
+func exportJails(state *JailerState, path, format string) error {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		if format != "csv" {
+			format = "json"
+		}
+	}
+
+	cleanupDeadProcesses(state)
+	if format == "template" {
+		return exportTemplate(state, path)
+	}
+
+	report := exportReport{ExportedAt: time.Now(), History: state.History}
+	for _, entry := range selectJails(state, listFilter{}) {
+		report.ActiveJails = append(report.ActiveJails, newJailRecord(entry.jail))
+	}
+	sort.Slice(report.ActiveJails, func(i, j int) bool {
+		return report.ActiveJails[i].JailedAt.Before(report.ActiveJails[j].JailedAt)
+	})
+
+	var content []byte
+	var err error
+	switch format {
+	case "json":
+		content, err = json.MarshalIndent(report, "", "  ")
+		content = append(content, '\n')
+	case "csv":
+		content, err = formatExportCSV(report)
+	default:
+		return fmt.Errorf("unsupported export format: %s (supported: csv, json, template)", format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode jails: %v", err)
+	}
+
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	fmt.Fprintf(state.stdout(), "Exported %d active jails and %d ended jails to %s (%s)\n",
+		len(report.ActiveJails), len(report.History), path, format)
+	return nil
+}
+
+// formatExportCSV returns the report as CSV, one row per jail with a status column
+func formatExportCSV(report exportReport) ([]byte, error) {
+	var builder strings.Builder
+	writer := csv.NewWriter(&builder)
+
+	header := []string{"status", "pid", "name", "jail_types", "children", "reason", "command",
+		"jailed_at", "ended_at", "end_reason", "rlimits", "cpu_percent", "jailed_by"}
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+
+	writeRecord := func(status string, record JailRecord) error {
+		endedAt := ""
+		if !record.EndedAt.IsZero() {
+			endedAt = record.EndedAt.Format(time.RFC3339)
+		}
+		cpuPercent := ""
+		if record.CpuPercent > 0 {
+			cpuPercent = strconv.Itoa(record.CpuPercent)
+		}
+		return writer.Write([]string{
+			status, strconv.Itoa(record.PID), record.Name, strings.Join(record.JailTypes, ","),
+			strconv.Itoa(record.Children), record.Reason, strings.Join(record.Command, " "),
+			record.JailedAt.Format(time.RFC3339), endedAt, record.EndReason, record.Rlimits, cpuPercent,
+			record.JailedBy,
+		})
+	}
+
+	for _, record := range report.ActiveJails {
+		if err := writeRecord("active", record); err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range report.History {
+		if err := writeRecord("ended", record); err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+	return []byte(builder.String()), writer.Error()
+}
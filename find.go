@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// findSampleInterval is how long find measures the CPU usage of the candidates
+const findSampleInterval = 250 * time.Millisecond
+
+// processInfo describes a process found by find
+type processInfo struct {
+	PID      int
+	Name     string
+	Cmdline  string
+	User     string
+	RSSBytes uint64
+	CPU      float64 // CPU usage during the sample, in percent of one core
+}
+
+// getProcessCmdline returns the command line of a process, kernel threads have none and
+// are shown with their name in brackets like ps does
+func getProcessCmdline(pid int) string {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(content) == 0 {
+		return "[" + hostProcesses.name(pid) + "]"
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(content), "\x00", " "))
+}
+
+// getProcessUser returns the name of the real user of a process, or its UID when the
+// user is unknown
+func getProcessUser(pid int) string {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return "?"
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "Uid:" {
+			if u, err := user.LookupId(fields[1]); err == nil {
+				return u.Username
+			}
+			return fields[1]
+		}
+	}
+	return "?"
+}
+
+// findProcesses returns the processes whose name matches the pattern (glob or substring)
+// or whose command line contains it, owned by the given user when one is set
+func findProcesses(pattern, userName string) []processInfo {
+	self := os.Getpid()
+
+	var found []processInfo
+	for _, pid := range listProcessPids() {
+		if pid == self {
+			continue
+		}
+
+		name := hostProcesses.name(pid)
+		cmdline := getProcessCmdline(pid)
+		if pattern != "" && !matchesName(pattern, name) && !strings.Contains(cmdline, pattern) {
+			continue
+		}
+
+		processUser := getProcessUser(pid)
+		if userName != "" && processUser != userName {
+			continue
+		}
+
+		found = append(found, processInfo{PID: pid, Name: name, Cmdline: cmdline, User: processUser})
+	}
+	return found
+}
+
+// findCommand prints the processes matching a pattern and/or a user with their CPU and
+// memory usage, busiest first, to locate the PID to jail
+func findCommand(state *JailerState, pattern, userName string, wide bool) error {
+	if pattern == "" && userName == "" {
+		return fmt.Errorf("usage: find <pattern> [--user <user>]")
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern: %s", pattern)
+	}
+
+	processes := findProcesses(pattern, userName)
+	if len(processes) == 0 {
+		fmt.Fprintln(state.stdout(), "No matching process")
+		return nil
+	}
+
+	// Measure the CPU usage over a short interval, like top
+	first := make(map[int]uint64)
+	for _, process := range processes {
+		first[process.PID], _ = getProcessCPUTicks(process.PID)
+	}
+	start := time.Now()
+	time.Sleep(findSampleInterval)
+	elapsed := time.Since(start).Seconds()
+
+	for i := range processes {
+		process := &processes[i]
+		if ticks, err := getProcessCPUTicks(process.PID); err == nil && ticks >= first[process.PID] {
+			process.CPU = float64(ticks-first[process.PID]) / clockTicksPerSecond / elapsed * 100
+		}
+		process.RSSBytes, _ = getProcessRSS(process.PID)
+	}
+
+	sort.SliceStable(processes, func(i, j int) bool {
+		if processes[i].CPU != processes[j].CPU {
+			return processes[i].CPU > processes[j].CPU
+		}
+		return processes[i].RSSBytes > processes[j].RSSBytes
+	})
+
+	w := newTableWriter(state.stdout())
+	writeTableHeader(w, "PID", "User", "CPU", "Memory", "Jailed", "Command")
+	for _, process := range processes {
+		jailed := "-"
+		if jail, exists := state.ActiveJails[process.PID]; exists {
+			jailed = jail.GetJailTypesString()
+		}
+
+		writeTableRow(w, strconv.Itoa(process.PID), truncate(process.User, nameColumnWidth, wide),
+			fmt.Sprintf("%.1f%%", process.CPU), formatBytes(process.RSSBytes),
+			truncate(jailed, typeColumnWidth, wide), truncate(process.Cmdline, commandColumnWidth, wide))
+	}
+	w.Flush()
+	fmt.Fprintf(state.stdout(), "(%d processes)\n", len(processes))
+	return nil
+}
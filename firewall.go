@@ -1,12 +1,48 @@
+//go:build linux
+
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// firewallCommand returns a firewall command killed once firewallTimeout elapsed, the
+// cancel function must be called when it is done
+func firewallCommand(args ...string) (*exec.Cmd, context.Context, context.CancelFunc) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if firewallTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, firewallTimeout)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// Don't wait for the output of children holding the pipes once killed
+	cmd.WaitDelay = time.Second
+	return cmd, ctx, cancel
+}
+
+// runFirewallCheck runs a firewall command for its exit status only
+func runFirewallCheck(args ...string) error {
+	cmd, ctx, cancel := firewallCommand(args...)
+	defer cancel()
+	return timeoutError(ctx, args, cmd.Run())
+}
+
+// timeoutError replaces the error of a firewall command killed by its timeout with one
+// naming the command, the kill signal alone doesn't tell what happened
+func timeoutError(ctx context.Context, args []string, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out after %s (is the xtables lock held?)", strings.Join(args, " "), firewallTimeout)
+	}
+	return err
+}
+
 const (
 	netClsClassID = "0x00100001"
 	classIDPath   = "/sys/fs/cgroup/net_cls/jail/net_cls.classid"
@@ -14,19 +50,24 @@ const (
 
 // detectFirewallTool detects which firewall tool is available and used on the system
 func detectFirewallTool() (string, error) {
-	// Check nftables first (more modern)
-	if isNftablesAvailable() {
-		fmt.Println("Detected nftables as primary firewall tool")
-		return "nftables", nil
+	tool := probeFirewallTool()
+	if tool == "" {
+		return "", fmt.Errorf("neither nftables nor iptables found on system")
 	}
+	fmt.Printf("Detected %s as primary firewall tool\n", tool)
+	return tool, nil
+}
 
-	// Check iptables
+// probeFirewallTool returns the usable firewall tool, nftables first (more modern), empty
+// when there is none
+func probeFirewallTool() string {
+	if isNftablesAvailable() {
+		return "nftables"
+	}
 	if isIptablesAvailable() {
-		fmt.Println("Detected iptables as primary firewall tool")
-		return "iptables", nil
+		return "iptables"
 	}
-
-	return "", fmt.Errorf("neither nftables nor iptables found on system")
+	return ""
 }
 
 // isNftablesAvailable checks if nftables is available and usable
@@ -37,8 +78,7 @@ func isNftablesAvailable() bool {
 	}
 
 	// Check if we can list tables (tests permissions and availability)
-	cmd := exec.Command("nft", "list", "tables")
-	if err := cmd.Run(); err != nil {
+	if err := runFirewallCheck("nft", "list", "tables"); err != nil {
 		return false
 	}
 
@@ -53,20 +93,13 @@ func isIptablesAvailable() bool {
 	}
 
 	// Check if we can list rules (tests permissions and availability)
-	cmd := exec.Command("iptables", "-L", "-n")
-	if err := cmd.Run(); err != nil {
+	if err := runFirewallCheck("iptables", "-L", "-n"); err != nil {
 		return false
 	}
 
 	return true
 }
 
-// commandExists checks if a command exists in PATH
-func commandExists(cmd string) bool {
-	_, err := exec.LookPath(cmd)
-	return err == nil
-}
-
 // setupNetworkJail configures firewall rules to block traffic from the jail cgroup
 func setupNetworkJail(state *JailerState) error {
 	if state.FirewallTool == "nftables" {
@@ -77,52 +110,50 @@ func setupNetworkJail(state *JailerState) error {
 	return fmt.Errorf("unsupported firewall tool: %s", state.FirewallTool)
 }
 
-// setupNftablesJail configures nftables rules for the jail
-func setupNftablesJail(state *JailerState) error {
-	// Create a dedicated table for the jail
-	commands := [][]string{
-		// Create the jail table
-		{"nft", "add", "table", "inet", "jail"},
+// networkJailCommands returns the nft or iptables commands setting up the rules of the
+// network jail for the firewall tool in use
+func networkJailCommands(state *JailerState) [][]string {
+	var commands [][]string
+	if state.FirewallTool == "nftables" {
+		commands = [][]string{
+			// Create the jail table
+			{"nft", "add", "table", "inet", "jail"},
 
-		// Create a chain to filter outgoing traffic
-		{"nft", "add", "chain", "inet", "jail", "output", "{", "type", "filter", "hook", "output", "priority", "100", ";", "}"},
+			// Create a chain to filter outgoing traffic
+			{"nft", "add", "chain", "inet", "jail", "output", "{", "type", "filter", "hook", "output", "priority", "100", ";", "}"},
 
-		// Create a chain to filter incoming traffic
-		{"nft", "add", "chain", "inet", "jail", "input", "{", "type", "filter", "hook", "input", "priority", "100", ";", "}"},
+			// Create a chain to filter incoming traffic
+			{"nft", "add", "chain", "inet", "jail", "input", "{", "type", "filter", "hook", "input", "priority", "100", ";", "}"},
+		}
 	}
 
-	// Add rules to block traffic from the jail cgroup
-	if state.CgroupVersion == 2 {
-		// For cgroups v2, use socket cgroupv2
-		commands = append(commands, []string{
-			"nft", "add", "rule", "inet", "jail", "output",
-			"socket", "cgroupv2", "level", "1", "\"jail\"", "drop",
-		})
-		commands = append(commands, []string{
-			"nft", "add", "rule", "inet", "jail", "input",
-			"socket", "cgroupv2", "level", "1", "\"jail\"", "drop",
-		})
-	} else {
-		// For cgroups v1, use net_cls classid
-		// First define a classid for the jail cgroup
+	// Block traffic from the shared jail cgroups
+	for _, match := range sharedNetworkMatches(state) {
+		if state.FirewallTool == "nftables" {
+			commands = append(commands,
+				append(append([]string{"nft", "add", "rule", "inet", "jail", "output"}, match...), "counter", "drop"),
+				append(append([]string{"nft", "add", "rule", "inet", "jail", "input"}, match...), "counter", "drop"))
+		} else {
+			commands = append(commands,
+				append(append([]string{"iptables", "-A", "OUTPUT"}, match...), "-j", "DROP"),
+				append(append([]string{"iptables", "-A", "INPUT"}, match...), "-j", "DROP"))
+		}
+	}
+	return commands
+}
+
+// setupNftablesJail configures nftables rules for the jail
+func setupNftablesJail(state *JailerState) error {
+	// For cgroups v1, the rules match the net_cls classid of the jail cgroup
+	if state.CgroupVersion == 1 {
 		if err := writeFile(classIDPath, netClsClassID+"\n"); err != nil {
 			return fmt.Errorf("failed to set net_cls classid: %v", err)
 		}
-
-		commands = append(commands, []string{
-			"nft", "add", "rule", "inet", "jail", "output",
-			"meta", "cgroup", netClsClassID, "drop",
-		})
-		commands = append(commands, []string{
-			"nft", "add", "rule", "inet", "jail", "input",
-			"meta", "cgroup", netClsClassID, "drop",
-		})
 	}
 
 	// Execute all commands
-	for _, cmdArgs := range commands {
-		cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-		if output, err := cmd.CombinedOutput(); err != nil {
+	for _, cmdArgs := range networkJailCommands(state) {
+		if output, err := runFirewallCommand(cmdArgs...); err != nil {
 			return fmt.Errorf("failed to execute nftables command %v: %v\nOutput: %s",
 				cmdArgs, err, string(output))
 		}
@@ -134,41 +165,20 @@ func setupNftablesJail(state *JailerState) error {
 
 // setupIptablesJail configures iptables rules for the jail
 func setupIptablesJail(state *JailerState) error {
-	var commands [][]string
-
-	if state.CgroupVersion == 2 {
-		// For cgroups v2, use cgroup match
-		commands = [][]string{
-			// Block outgoing traffic from jail cgroup
-			{"iptables", "-A", "OUTPUT", "-m", "cgroup", "--path", "jail", "-j", "DROP"},
-
-			// Block incoming traffic to jail cgroup
-			{"iptables", "-A", "INPUT", "-m", "cgroup", "--path", "jail", "-j", "DROP"},
-		}
-	} else {
-		// For cgroups v1, use net_cls classid
-		// First define a classid for the jail cgroup
+	// For cgroups v1, the rules match the net_cls classid of the jail cgroup
+	if state.CgroupVersion == 1 {
 		if err := writeFile(classIDPath, netClsClassID+"\n"); err != nil {
 			return fmt.Errorf("failed to set net_cls classid: %v", err)
 		}
-
-		commands = [][]string{
-			// Block outgoing traffic with classid
-			{"iptables", "-A", "OUTPUT", "-m", "cgroup", "--cgroup", netClsClassID, "-j", "DROP"},
-
-			// Block incoming traffic with classid
-			{"iptables", "-A", "INPUT", "-m", "cgroup", "--cgroup", netClsClassID, "-j", "DROP"},
-		}
 	}
 
 	// Add logging to capture details about the iptables rules and any errors
 	fmt.Println("Setting up iptables rules for the jail...")
 
 	// Execute all commands
-	for _, cmdArgs := range commands {
+	for _, cmdArgs := range networkJailCommands(state) {
 		fmt.Printf("Executing iptables command: %v\n", cmdArgs)
-		cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-		if output, err := cmd.CombinedOutput(); err != nil {
+		if output, err := runFirewallCommand(cmdArgs...); err != nil {
 			fmt.Printf("Error executing iptables command %v: %v\nOutput: %s\n", cmdArgs, err, string(output))
 			return fmt.Errorf("failed to execute iptables command %v: %v\nOutput: %s", cmdArgs, err, string(output))
 		}
@@ -191,8 +201,7 @@ func cleanupNetworkJail(state *JailerState) error {
 // cleanupNftablesJail removes nftables rules from the jail
 func cleanupNftablesJail() error {
 	// Remove the entire jail table
-	cmd := exec.Command("nft", "delete", "table", "inet", "jail")
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := runFirewallCommand("nft", "delete", "table", "inet", "jail"); err != nil {
 		// Don't fail if the table doesn't exist
 		if !strings.Contains(string(output), "No such file or directory") {
 			return fmt.Errorf("failed to cleanup nftables jail: %v\nOutput: %s", err, string(output))
@@ -205,36 +214,231 @@ func cleanupNftablesJail() error {
 
 // cleanupIptablesJail removes iptables rules from the jail
 func cleanupIptablesJail(state *JailerState) error {
-	var commands [][]string
+	// Execute removal commands, the setup ones with -D instead of -A
+	for _, cmdArgs := range networkJailCommands(state) {
+		cmdArgs[1] = "-D"
+		if output, err := runFirewallCommand(cmdArgs...); err != nil {
+			// Don't fail if the rule doesn't exist
+			if !strings.Contains(string(output), "No chain/target/match by that name") {
+				fmt.Printf("Warning: failed to remove iptables rule %v: %v\n", cmdArgs, err)
+			}
+		}
+	}
+
+	fmt.Println("Iptables jail rules cleaned up")
+	return nil
+}
+
+// networkJailMatch returns the arguments matching the traffic of the shared network jail
+// cgroup for the firewall tool in use
+func networkJailMatch(state *JailerState) []string {
+	return networkMatch(state, JailNetworkCgroup, netClsClassID)
+}
 
+// sharedNetworkMatches returns the arguments matching the traffic of the shared cgroups
+// of the network jails, on cgroups v2 the network jail cgroup and the one combined with
+// the CPU jail
+func sharedNetworkMatches(state *JailerState) [][]string {
 	if state.CgroupVersion == 2 {
-		commands = [][]string{
-			{"iptables", "-D", "OUTPUT", "-m", "cgroup", "--path", "jail", "-j", "DROP"},
-			{"iptables", "-D", "INPUT", "-m", "cgroup", "--path", "jail", "-j", "DROP"},
+		return [][]string{networkJailMatch(state), networkMatch(state, JailNetworkCpuCgroup, "")}
+	}
+	return [][]string{networkJailMatch(state)}
+}
+
+// jailNetworkMatch returns the arguments matching the traffic of the network jail of a
+// jail, its own cgroup on cgroups v2 or its own classid on v1 when it has one
+func jailNetworkMatch(state *JailerState, jail *Jail) []string {
+	if jail != nil && (jail.NetworkCgroup != "" || jail.ClassID != "") {
+		return networkMatch(state, jail.NetworkCgroup, jail.ClassID)
+	}
+	return networkJailMatch(state)
+}
+
+// networkMatch returns the arguments matching the traffic of a cgroup on cgroups v2, as a
+// path relative to the root, or of a net_cls classid on v1
+func networkMatch(state *JailerState, cgroup, classID string) []string {
+	if state.FirewallTool == "nftables" {
+		if state.CgroupVersion == 2 {
+			level := strconv.Itoa(strings.Count(cgroup, "/") + 1)
+			return []string{"socket", "cgroupv2", "level", level, "\"" + cgroup + "\""}
 		}
-	} else {
-		commands = [][]string{
-			{"iptables", "-D", "OUTPUT", "-m", "cgroup", "--cgroup", netClsClassID, "-j", "DROP"},
-			{"iptables", "-D", "INPUT", "-m", "cgroup", "--cgroup", netClsClassID, "-j", "DROP"},
+		return []string{"meta", "cgroup", classID}
+	}
+	if state.CgroupVersion == 2 {
+		return []string{"-m", "cgroup", "--path", cgroup}
+	}
+	return []string{"-m", "cgroup", "--cgroup", classID}
+}
+
+// nftHandlePattern finds the handle of a rule echoed by nft --echo --handle
+var nftHandlePattern = regexp.MustCompile(`# handle (\d+)`)
+
+// iptablesChains maps the chains of the jail table to the iptables chains
+var iptablesChains = map[string]string{"output": "OUTPUT", "input": "INPUT"}
+
+// insertFirewallRule inserts a rule at the top of a chain so that it applies before the
+// drop rules of the jails
+func insertFirewallRule(state *JailerState, chain string, spec []string) (insertedRule, error) {
+	return addFirewallRule(state, chain, spec, true)
+}
+
+// appendFirewallRule appends a rule at the end of a chain, after the rules inserted ahead
+// of the drop rules
+func appendFirewallRule(state *JailerState, chain string, spec []string) (insertedRule, error) {
+	return addFirewallRule(state, chain, spec, false)
+}
+
+// addFirewallRule inserts or appends a rule to a chain and returns it with the handle
+// deleting it
+func addFirewallRule(state *JailerState, chain string, spec []string, insert bool) (insertedRule, error) {
+	var args []string
+	switch {
+	case state.FirewallTool == "nftables" && insert:
+		args = append([]string{"nft", "--echo", "--handle", "insert", "rule", "inet", "jail", chain}, spec...)
+	case state.FirewallTool == "nftables":
+		args = append([]string{"nft", "--echo", "--handle", "add", "rule", "inet", "jail", chain}, spec...)
+	case insert:
+		args = append([]string{"iptables", "-I", iptablesChains[chain], "1"}, spec...)
+	default:
+		args = append([]string{"iptables", "-A", iptablesChains[chain]}, spec...)
+	}
+	output, err := runFirewallCommand(args...)
+	if err != nil {
+		return insertedRule{}, checkFirewallBackend(state, fmt.Errorf("failed to add rule %v: %v\nOutput: %s", args, err, string(output)))
+	}
+
+	rule := insertedRule{Chain: chain, Spec: spec}
+	if state.FirewallTool == "nftables" {
+		match := nftHandlePattern.FindStringSubmatch(string(output))
+		if match == nil {
+			return insertedRule{}, fmt.Errorf("no handle in the output of %v: %s", args, string(output))
 		}
+		rule.Handle = match[1]
 	}
+	return rule, nil
+}
 
-	// Execute removal commands
-	for _, cmdArgs := range commands {
-		cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			// Don't fail if the rule doesn't exist
-			if !strings.Contains(string(output), "No chain/target/match by that name") {
-				fmt.Printf("Warning: failed to remove iptables rule %v: %v\n", cmdArgs, err)
+// deleteFirewallRules deletes inserted rules, failures are only reported
+func deleteFirewallRules(state *JailerState, rules []insertedRule) {
+	for _, rule := range rules {
+		var args []string
+		if state.FirewallTool == "nftables" {
+			args = []string{"nft", "delete", "rule", "inet", "jail", rule.Chain, "handle", rule.Handle}
+		} else {
+			args = append([]string{"iptables", "-D", iptablesChains[rule.Chain]}, rule.Spec...)
+		}
+		if output, err := runFirewallCommand(args...); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: failed to remove firewall rule %v: %v\nOutput: %s\n", args, err, string(output))
+		}
+	}
+}
+
+// describe returns the rule in the format of describeNetworkJailRules
+func (rule insertedRule) describe(state *JailerState) string {
+	if state.FirewallTool == "nftables" {
+		return fmt.Sprintf("inet jail %s: %s", rule.Chain, strings.Join(rule.Spec, " "))
+	}
+	return fmt.Sprintf("-I %s %s", iptablesChains[rule.Chain], strings.Join(rule.Spec, " "))
+}
+
+// describeNetworkJailRules returns the firewall rules set up for the shared network jails
+func describeNetworkJailRules(state *JailerState) []string {
+	var rules []string
+	for _, args := range networkJailCommands(state) {
+		switch {
+		case args[0] == "iptables":
+			rules = append(rules, strings.Join(args[1:], " "))
+		case args[2] == "rule":
+			rules = append(rules, fmt.Sprintf("inet jail %s: %s", args[5], strings.Join(args[6:], " ")))
+		}
+	}
+	return rules
+}
+
+// runFirewallCommand runs an nft or iptables command and returns its combined output, with
+// a span when tracing is configured. A command running past firewall_timeout is killed
+func runFirewallCommand(args ...string) ([]byte, error) {
+	span := startSpan("firewall."+args[0], stringAttribute("firewall.command", strings.Join(args, " ")))
+	cmd, ctx, cancel := firewallCommand(args...)
+	defer cancel()
+	output, err := cmd.CombinedOutput()
+	err = timeoutError(ctx, args, err)
+	span.end(err)
+	return output, err
+}
+
+// getDroppedPackets returns the number of packets dropped by the network jail rules
+func getDroppedPackets(state *JailerState) (uint64, error) {
+	if state.FirewallTool == "nftables" {
+		return getNftablesDroppedPackets()
+	} else if state.FirewallTool == "iptables" {
+		return getIptablesDroppedPackets()
+	}
+	return 0, fmt.Errorf("unsupported firewall tool: %s", state.FirewallTool)
+}
+
+// getNftablesDroppedPackets sums the counters of the jail table rules
+func getNftablesDroppedPackets() (uint64, error) {
+	output, err := runFirewallCommand("nft", "list", "table", "inet", "jail")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list nftables jail table: %v", err)
+	}
+	return parseNftablesCounters(string(output)), nil
+}
+
+// parseNftablesCounters sums the "counter packets N" statements of an nft listing
+func parseNftablesCounters(listing string) uint64 {
+	var total uint64
+	fields := strings.Fields(listing)
+	for i := 0; i+2 < len(fields); i++ {
+		if fields[i] == "counter" && fields[i+1] == "packets" {
+			if packets, err := strconv.ParseUint(fields[i+2], 10, 64); err == nil {
+				total += packets
 			}
 		}
 	}
+	return total
+}
 
-	fmt.Println("Iptables jail rules cleaned up")
-	return nil
+// getIptablesDroppedPackets sums the packet counters of the jail DROP rules
+func getIptablesDroppedPackets() (uint64, error) {
+	var total uint64
+	for _, chain := range []string{"INPUT", "OUTPUT"} {
+		output, err := runFirewallCommand("iptables", "-L", chain, "-v", "-n", "-x")
+		if err != nil {
+			return 0, fmt.Errorf("failed to list iptables %s chain: %v", chain, err)
+		}
+		total += parseIptablesDropCounters(string(output))
+	}
+	return total, nil
+}
+
+// parseIptablesDropCounters sums the packets of the cgroup DROP rules of an iptables -v listing
+func parseIptablesDropCounters(listing string) uint64 {
+	var total uint64
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[2] != "DROP" || !strings.Contains(line, "cgroup") {
+			continue
+		}
+		if packets, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+			total += packets
+		}
+	}
+	return total
 }
 
 // writeFile writes content to a file (helper function)
 func writeFile(path, content string) error {
 	return os.WriteFile(path, []byte(content), 0644)
 }
+
+// networkJailRulesPresent checks if the firewall rules of a previous jailer are still in
+// place, so that a recovered jailer doesn't add them twice
+func networkJailRulesPresent(state *JailerState) bool {
+	if state.FirewallTool == "nftables" {
+		return runFirewallCheck("nft", "list", "table", "inet", "jail") == nil
+	}
+	args := append(append([]string{"iptables", "-C", "OUTPUT"}, networkJailMatch(state)...), "-j", "DROP")
+	return runFirewallCheck(args...) == nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultGeoIPv4URL    = "https://www.ipdeny.com/ipblocks/data/aggregated/{country}-aggregated.zone"
+	defaultGeoIPv6URL    = "https://www.ipdeny.com/ipv6/ipaddresses/aggregated/{country}-aggregated.zone"
+	defaultGeoIPCacheDir = "/var/lib/jailer/geoip"
+	defaultGeoIPMaxAge   = 24 * time.Hour
+)
+
+// GeoIPConfig contains the sources of the country networks of --block-country and --allow-country
+type GeoIPConfig struct {
+	IPv4URL  string `json:"ipv4_url"`  // IPv4 networks of a country, one per line, {country} is its lowercase code
+	IPv6URL  string `json:"ipv6_url"`  // IPv6 networks of a country, "off" skips them
+	CacheDir string `json:"cache_dir"` // Downloaded lists, /var/lib/jailer/geoip by default
+	MaxAge   string `json:"max_age"`   // Lists downloaded again once older, 24h by default
+
+	maxAge time.Duration
+}
+
+// validateGeoIPConfig fills in the defaults of the GeoIP sources
+func validateGeoIPConfig(config *GeoIPConfig) error {
+	if config.IPv4URL == "" {
+		config.IPv4URL = defaultGeoIPv4URL
+	}
+	if config.IPv6URL == "" {
+		config.IPv6URL = defaultGeoIPv6URL
+	}
+	if config.CacheDir == "" {
+		config.CacheDir = defaultGeoIPCacheDir
+	}
+	config.maxAge = defaultGeoIPMaxAge
+	if config.MaxAge != "" {
+		maxAge, err := parseDuration(config.MaxAge)
+		if err != nil || maxAge <= 0 {
+			return fmt.Errorf("invalid max_age %q", config.MaxAge)
+		}
+		config.maxAge = maxAge
+	}
+	return nil
+}
+
+// countryCodePattern matches an ISO 3166-1 alpha-2 country code
+var countryCodePattern = regexp.MustCompile(`^[A-Za-z]{2}$`)
+
+// parseCountries parses the comma-separated country codes of --block-country and --allow-country
+func parseCountries(value string) ([]string, error) {
+	var countries []string
+	for _, country := range strings.Split(value, ",") {
+		country = strings.TrimSpace(country)
+		if !countryCodePattern.MatchString(country) {
+			return nil, fmt.Errorf("invalid country code: %q (two letters, e.g. CN)", country)
+		}
+		countries = append(countries, strings.ToUpper(country))
+	}
+	return countries, nil
+}
+
+// parseAllowedIfaces parses the comma-separated interfaces of --allow-iface
+func parseAllowedIfaces(value string) ([]string, error) {
+	var ifaces []string
+	for _, iface := range strings.Split(value, ",") {
+		iface = strings.TrimSpace(iface)
+		name := strings.TrimSuffix(iface, "*")
+		if name == "" || len(name) > 15 || strings.ContainsAny(name, "/*\"\\ \t") {
+			return nil, fmt.Errorf("invalid interface name: %q", iface)
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
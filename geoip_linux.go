@@ -0,0 +1,308 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	geoIPHTTPTimeout = 30 * time.Second
+	setElementsBatch = 500 // Elements per line of the nft set files
+)
+
+// countrySetNames returns the names of the IPv4 and IPv6 country sets of a jail
+func countrySetNames(pid int) (string, string) {
+	return fmt.Sprintf("geo4_%d", pid), fmt.Sprintf("geo6_%d", pid)
+}
+
+// parseNetworkList returns the networks of a list, one address or CIDR per line with
+// # or ; comments, the rest of the line after the network is ignored
+func parseNetworkList(reader io.Reader) ([]string, error) {
+	var networks []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.IndexAny(line, "#;"); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := allowedAddressFamily(fields[0]); err != nil {
+			return nil, err
+		}
+		networks = append(networks, fields[0])
+	}
+	return networks, scanner.Err()
+}
+
+// fetchNetworkList returns the networks of a list, downloaded again once the cached copy
+// is older than maxAge. The cached copy is used when the download fails
+func fetchNetworkList(url, cachePath string, maxAge time.Duration) ([]string, error) {
+	info, statErr := os.Stat(cachePath)
+	if statErr != nil || time.Since(info.ModTime()) > maxAge {
+		if err := downloadNetworkList(url, cachePath); err != nil {
+			if statErr != nil {
+				return nil, err
+			}
+			fmt.Printf("Warning: %v, using the copy of %s\n", err, info.ModTime().Format(time.RFC3339))
+		}
+	}
+	return readNetworkList(cachePath)
+}
+
+// readNetworkList returns the networks of a cached list
+func readNetworkList(cachePath string) ([]string, error) {
+	file, err := os.Open(cachePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", cachePath, err)
+	}
+	defer file.Close()
+	networks, err := parseNetworkList(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid list %s: %v", cachePath, err)
+	}
+	return networks, nil
+}
+
+// downloadNetworkList downloads a list to its cache file, replaced once it parses
+func downloadNetworkList(url, cachePath string) error {
+	client := &http.Client{Timeout: geoIPHTTPTimeout}
+	response, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", url, response.Status)
+	}
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	if _, err := parseNetworkList(strings.NewReader(string(content))); err != nil {
+		return fmt.Errorf("invalid list %s: %v", url, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(cachePath), err)
+	}
+	temporary := cachePath + ".tmp"
+	if err := os.WriteFile(temporary, content, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", temporary, err)
+	}
+	return os.Rename(temporary, cachePath)
+}
+
+// countryNetworks returns the IPv4 and IPv6 networks of countries
+func countryNetworks(config GeoIPConfig, countries []string) ([]string, []string, error) {
+	var networks4, networks6 []string
+	for _, country := range countries {
+		code := strings.ToLower(country)
+		networks, err := fetchNetworkList(strings.ReplaceAll(config.IPv4URL, "{country}", code),
+			filepath.Join(config.CacheDir, code+".ipv4"), config.maxAge)
+		if err != nil {
+			return nil, nil, fmt.Errorf("no IPv4 networks of %s: %v", country, err)
+		}
+		networks4 = append(networks4, networks...)
+
+		if config.IPv6URL == "off" {
+			continue
+		}
+		if networks, err = fetchNetworkList(strings.ReplaceAll(config.IPv6URL, "{country}", code),
+			filepath.Join(config.CacheDir, code+".ipv6"), config.maxAge); err != nil {
+			return nil, nil, fmt.Errorf("no IPv6 networks of %s: %v", country, err)
+		}
+		networks6 = append(networks6, networks...)
+	}
+	return networks4, networks6, nil
+}
+
+// loadAddressSet creates a set of networks or replaces its networks in one transaction,
+// an nftables named set or an ipset. The nft sets merge the overlapping networks
+func loadAddressSet(state *JailerState, name, family string, networks []string) error {
+	file, err := os.CreateTemp("", "jailer-set-*")
+	if err != nil {
+		return fmt.Errorf("failed to create the file of set %s: %v", name, err)
+	}
+	defer os.Remove(file.Name())
+
+	var args []string
+	if state.FirewallTool == "nftables" {
+		setType := "ipv4_addr"
+		if family == "ip6" {
+			setType = "ipv6_addr"
+		}
+		// nft -f applies the whole file as a single transaction
+		fmt.Fprintf(file, "add set inet jail %s { type %s; flags interval; auto-merge; }\n", name, setType)
+		fmt.Fprintf(file, "flush set inet jail %s\n", name)
+		for start := 0; start < len(networks); start += setElementsBatch {
+			end := min(start+setElementsBatch, len(networks))
+			fmt.Fprintf(file, "add element inet jail %s { %s }\n", name, strings.Join(networks[start:end], ", "))
+		}
+		args = []string{"nft", "-f", file.Name()}
+	} else {
+		// The networks go to a new ipset swapped with the one in use
+		fmt.Fprintf(file, "create %s hash:net family inet -exist\n", name)
+		fmt.Fprintf(file, "create %s-new hash:net family inet maxelem %d\n", name, max(65536, len(networks)))
+		for _, network := range networks {
+			fmt.Fprintf(file, "add %s-new %s -exist\n", name, network)
+		}
+		fmt.Fprintf(file, "swap %s-new %s\ndestroy %s-new\n", name, name, name)
+		args = []string{"ipset", "restore", "-file", file.Name()}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write the file of set %s: %v", name, err)
+	}
+	if output, err := runFirewallCommand(args...); err != nil {
+		if state.FirewallTool == "iptables" {
+			runFirewallCommand("ipset", "destroy", name+"-new")
+		}
+		return fmt.Errorf("failed to load set %s: %v\nOutput: %s", name, err, string(output))
+	}
+	return nil
+}
+
+// deleteAddressSet removes a set created by loadAddressSet, a missing set is ignored
+func deleteAddressSet(state *JailerState, name string) {
+	if state.FirewallTool == "nftables" {
+		if _, err := runNft("list", "set", "inet", "jail", name); err != nil {
+			return
+		}
+		if _, err := runNft("delete", "set", "inet", "jail", name); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: failed to remove set %s: %v\n", name, err)
+		}
+		return
+	}
+	if _, err := runFirewallCommand("ipset", "list", "-name", name); err != nil {
+		return
+	}
+	if output, err := runFirewallCommand("ipset", "destroy", name); err != nil {
+		fmt.Fprintf(state.stdout(), "Warning: failed to remove ipset %s: %v\nOutput: %s\n", name, err, string(output))
+	}
+}
+
+// setRuleSpec returns the rule matching the traffic of a jail to a set on the output chain,
+// or from it on the input chain, with a verdict: accept or drop
+func setRuleSpec(state *JailerState, match []string, chain, family, set, verdict string) []string {
+	spec := append([]string{}, match...)
+	if state.FirewallTool == "nftables" {
+		address := "daddr"
+		if chain == "input" {
+			address = "saddr"
+		}
+		if verdict == "drop" {
+			return append(spec, family, address, "@"+set, "counter", "drop")
+		}
+		return append(spec, family, address, "@"+set, "accept")
+	}
+	direction := "dst"
+	if chain == "input" {
+		direction = "src"
+	}
+	return append(spec, "-m", "set", "--match-set", set, direction, "-j", strings.ToUpper(verdict))
+}
+
+// acceptRuleSpec returns the rule accepting all the traffic matched by match
+func acceptRuleSpec(state *JailerState, match []string) []string {
+	if state.FirewallTool == "nftables" {
+		return append(append([]string{}, match...), "accept")
+	}
+	return append(append([]string{}, match...), "-j", "ACCEPT")
+}
+
+// setupCountryRules loads the networks of countries into sets of the jail and inserts the
+// rules ahead of its drop rules. Blocking drops the traffic with the countries and accepts
+// the rest, allowing only accepts the traffic with the countries. iptables only filters
+// IPv4, there is no ip6tables counterpart
+func setupCountryRules(state *JailerState, jail *Jail, countries []string, block bool) error {
+	networks4, networks6, err := countryNetworks(state.Config.GeoIP, countries)
+	if err != nil {
+		return err
+	}
+
+	set4, set6 := countrySetNames(jail.PID)
+	sets := []struct{ family, name string }{{"ip", set4}}
+	if len(networks4) == 0 {
+		sets = nil
+	}
+	if state.FirewallTool == "nftables" && len(networks6) > 0 {
+		sets = append(sets, struct{ family, name string }{"ip6", set6})
+	}
+	if len(sets) == 0 {
+		return fmt.Errorf("no networks listed for %s", strings.Join(countries, ", "))
+	}
+
+	// Recorded first, the release finds the sets of a partial setup
+	if block {
+		jail.BlockedCountries = countries
+	} else {
+		jail.AllowedCountries = countries
+	}
+	match := jailNetworkMatch(state, jail)
+	verdict := "accept"
+	if block {
+		verdict = "drop"
+		// Inserted first so that the drops on the sets end up ahead of it
+		for _, chain := range []string{"output", "input"} {
+			rule, err := insertFirewallRule(state, chain, acceptRuleSpec(state, match))
+			if err != nil {
+				releaseCountryRules(state, jail)
+				return err
+			}
+			jail.CountryRules = append(jail.CountryRules, rule)
+		}
+	}
+	for _, set := range sets {
+		networks := networks4
+		if set.family == "ip6" {
+			networks = networks6
+		}
+		if err := loadAddressSet(state, set.name, set.family, networks); err != nil {
+			releaseCountryRules(state, jail)
+			return err
+		}
+		for _, chain := range []string{"output", "input"} {
+			rule, err := insertFirewallRule(state, chain, setRuleSpec(state, match, chain, set.family, set.name, verdict))
+			if err != nil {
+				releaseCountryRules(state, jail)
+				return err
+			}
+			jail.CountryRules = append(jail.CountryRules, rule)
+		}
+	}
+
+	if block {
+		fmt.Fprintf(state.stdout(), "Traffic of process %d with %s dropped (%d IPv4 and %d IPv6 networks)\n",
+			jail.PID, strings.Join(countries, ", "), len(networks4), len(networks6))
+	} else {
+		fmt.Fprintf(state.stdout(), "Process %d can reach %s (%d IPv4 and %d IPv6 networks)\n",
+			jail.PID, strings.Join(countries, ", "), len(networks4), len(networks6))
+	}
+	return nil
+}
+
+// releaseCountryRules removes the rules and the sets of the countries of a jail
+func releaseCountryRules(state *JailerState, jail *Jail) {
+	if len(jail.BlockedCountries) == 0 && len(jail.AllowedCountries) == 0 {
+		return
+	}
+	deleteFirewallRules(state, jail.CountryRules)
+	jail.CountryRules = nil
+	jail.BlockedCountries = nil
+	jail.AllowedCountries = nil
+	set4, set6 := countrySetNames(jail.PID)
+	deleteAddressSet(state, set4)
+	if state.FirewallTool == "nftables" {
+		deleteAddressSet(state, set6)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// healthLockTimeout is how long the state may stay locked before jailer is reported wedged
+const healthLockTimeout = 5 * time.Second
+
+// healthCheck is the outcome of one check of /healthz or /readyz
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// healthReport is the response of /healthz and /readyz
+type healthReport struct {
+	Status string        `json:"status"` // ok or failing
+	Checks []healthCheck `json:"checks"`
+}
+
+// checkStateLock checks that the jailer state can still be locked, like the watchdog
+func checkStateLock(timeout time.Duration) healthCheck {
+	check := healthCheck{Name: "state-lock"}
+	responsive := make(chan struct{})
+	go func() {
+		stateMutex.Lock()
+		stateMutex.Unlock()
+		close(responsive)
+	}()
+	select {
+	case <-responsive:
+		check.OK, check.Detail = true, "state can be locked"
+	case <-time.After(timeout):
+		check.Detail = fmt.Sprintf("state locked for more than %s", timeout)
+	}
+	return check
+}
+
+// checkCgroupsHealth checks that the jail cgroups are still there
+func checkCgroupsHealth(state *JailerState) healthCheck {
+	check := healthCheck{Name: "cgroups"}
+	for _, path := range []string{state.NetworkCgroupPath, state.CpuCgroupPath, state.NetworkCpuCgroupPath} {
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			check.Detail = fmt.Sprintf("%s is missing", path)
+			return check
+		}
+	}
+	check.OK, check.Detail = true, fmt.Sprintf("cgroups v%d jail cgroups present", state.CgroupVersion)
+	return check
+}
+
+// checkFirewallHealth checks that the rules of the network jails are still installed, a
+// host without network jails has nothing to check
+func checkFirewallHealth(state *JailerState) healthCheck {
+	check := healthCheck{Name: "firewall"}
+	if reason, disabled := state.DisabledJailTypes["network"]; disabled {
+		check.OK, check.Detail = true, "network jails disabled: "+reason
+		return check
+	}
+	if !state.Firewall.rulesPresent() {
+		check.Detail = fmt.Sprintf("network jail rules missing from %s", state.FirewallTool)
+		return check
+	}
+	check.OK, check.Detail = true, fmt.Sprintf("network jail rules installed with %s", state.FirewallTool)
+	return check
+}
+
+// checkStateStoreHealth checks that the state file can be written, and that the last write
+// to the clustered store succeeded
+func checkStateStoreHealth(state *JailerState) []healthCheck {
+	stateFile := healthCheck{Name: "state-file", OK: true, Detail: "off"}
+	if state.StatePath != "" && state.Config.Store.Type == "kv" {
+		stateFile.Detail = "kept in the state backend"
+	} else if state.StatePath != "" {
+		dir := filepath.Dir(state.StatePath)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			stateFile.OK, stateFile.Detail = false, err.Error()
+		} else if probe, err := os.CreateTemp(dir, ".jailer-health-*"); err != nil {
+			stateFile.OK, stateFile.Detail = false, fmt.Sprintf("%s is not writable: %v", dir, err)
+		} else {
+			probe.Close()
+			os.Remove(probe.Name())
+			stateFile.Detail = dir + " is writable"
+		}
+	}
+	checks := []healthCheck{stateFile}
+
+	if state.Inventory != nil {
+		backend := healthCheck{Name: "state-backend", OK: true, Detail: "last write succeeded"}
+		if err := state.Inventory.lastError(); err != nil {
+			backend.OK, backend.Detail = false, err.Error()
+		}
+		checks = append(checks, backend)
+	}
+	return checks
+}
+
+// writeHealthReport answers 200 when every check passed and 503 otherwise
+func writeHealthReport(w http.ResponseWriter, checks []healthCheck) {
+	report := healthReport{Status: "ok", Checks: checks}
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			report.Status, status = "failing", http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// registerHealthHandlers adds /healthz, answering while jailer isn't wedged, and /readyz,
+// answering while it can enforce the jails, to the endpoints of jailer. Probes can't send
+// a token, so they need none and only tell the state of jailer
+func registerHealthHandlers(mux *http.ServeMux, state *JailerState) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, []healthCheck{checkStateLock(healthLockTimeout)})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		checks := []healthCheck{checkStateLock(healthLockTimeout), checkCgroupsHealth(state), checkFirewallHealth(state)}
+		writeHealthReport(w, append(checks, checkStateStoreHealth(state)...))
+	})
+}
+
+// runHealthListener serves /healthz and /readyz alone, for jailers without another endpoint
+func runHealthListener(state *JailerState, addr string) error {
+	mux := http.NewServeMux()
+	registerHealthHandlers(mux, state)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	fmt.Printf("Serving health checks on http://%s/healthz and /readyz\n", addr)
+	return fmt.Errorf("health listener on %s failed: %v", addr, server.ListenAndServe())
+}
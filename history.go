@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultHistoryLogPath keeps the ended jails across the jailer runs, for the reviews after
+// an incident
+const defaultHistoryLogPath = "/var/log/jailer/history.log"
+
+// JailRecord describes a jail, active or ended, for reporting
+type JailRecord struct {
+	PID        int       `json:"pid"`
+	Name       string    `json:"name"`
+	JailTypes  []string  `json:"jail_types"`
+	Children   int       `json:"children"`
+	Reason     string    `json:"reason,omitempty"`
+	JailedBy   string    `json:"jailed_by,omitempty"`
+	Command    []string  `json:"command,omitempty"`
+	JailedAt   time.Time `json:"jailed_at"`
+	EndedAt    time.Time `json:"ended_at,omitempty"`
+	EndReason  string    `json:"end_reason,omitempty"`  // "unjailed", "expired", "exited" or "checkpointed"
+	ReleasedBy string    `json:"released_by,omitempty"` // Operator of the unjail, expiry for the expired jails
+	Rlimits    string    `json:"rlimits,omitempty"`
+	CpuPercent int       `json:"cpu_percent,omitempty"`
+	Persistent bool      `json:"persistent,omitempty"`
+}
+
+// newJailRecord creates the record of a jail as it is now
+func newJailRecord(jail *Jail) JailRecord {
+	return JailRecord{
+		PID:        jail.PID,
+		Name:       jail.Name,
+		JailTypes:  append([]string(nil), jail.JailTypes...),
+		Children:   len(jail.Children),
+		Reason:     jail.Reason,
+		JailedBy:   jail.JailedBy,
+		Command:    jail.Command,
+		Persistent: jail.Persistent,
+		JailedAt:   jail.Timestamp,
+		Rlimits:    formatRlimits(jail.Rlimits),
+		CpuPercent: jail.CpuPercent,
+	}
+}
+
+// recordJailHistory adds a jail that is about to be removed to the history of the session
+// and to the history log
+func recordJailHistory(state *JailerState, jail *Jail, endReason string) {
+	record := newJailRecord(jail)
+	record.EndedAt = time.Now()
+	record.EndReason = endReason
+	switch endReason {
+	case "expired":
+		record.ReleasedBy = "expiry"
+	case "unjailed", "checkpointed":
+		record.ReleasedBy = state.Operator
+	}
+	state.History = append(state.History, record)
+	writeHistoryRecord(state, record)
+	publishJailEvent(jailEndEvents[endReason], jail, "")
+}
+
+// writeHistoryRecord appends an ended jail to the history log
+func writeHistoryRecord(state *JailerState, record JailRecord) {
+	if path := state.Config.HistoryLog; path == "" || path == "off" {
+		return
+	}
+	if err := state.Store.appendHistoryRecord(record); err != nil {
+		fmt.Printf("Warning: failed to write history record: %v\n", err)
+	}
+}
+
+// loadJailHistory returns the ended jails of the history log, or of the session when the
+// log is off. The records that can't be decoded are skipped and counted
+func loadJailHistory(state *JailerState) ([]JailRecord, int, error) {
+	if path := state.Config.HistoryLog; path == "" || path == "off" {
+		return append([]JailRecord(nil), state.History...), 0, nil
+	}
+	return state.Store.loadHistory()
+}
+
+// historyFilter selects the ended jails shown by the history command
+type historyFilter struct {
+	Since       time.Duration // Only jails that ended within this duration
+	NamePattern string        // Glob or substring matched against the process name
+	JailType    string        // Only jails with this type
+	Wide        bool          // Don't truncate the columns
+	JSON        bool          // Print JSON records instead of a table
+}
+
+// matches checks if an ended jail passes the filter
+func (f historyFilter) matches(record JailRecord, now time.Time) bool {
+	if f.Since > 0 && now.Sub(record.EndedAt) > f.Since {
+		return false
+	}
+	if f.NamePattern != "" && !matchesName(f.NamePattern, record.Name) {
+		return false
+	}
+	if f.JailType != "" && !slices.Contains(record.JailTypes, f.JailType) {
+		return false
+	}
+	return true
+}
+
+// showHistory prints the ended jails passing the filter, oldest first
+func showHistory(state *JailerState, filter historyFilter) error {
+	records, skipped, err := loadJailHistory(state)
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		fmt.Fprintf(state.stdout(), "Warning: skipped %d unreadable lines of %s\n", skipped, state.Config.HistoryLog)
+	}
+
+	now := time.Now()
+	selected := []JailRecord{}
+	for _, record := range records {
+		if filter.matches(record, now) {
+			selected = append(selected, record)
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool { return selected[i].EndedAt.Before(selected[j].EndedAt) })
+
+	if filter.JSON {
+		content, err := json.MarshalIndent(selected, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode history: %v", err)
+		}
+		fmt.Fprintln(state.stdout(), string(content))
+		return nil
+	}
+	if len(selected) == 0 {
+		fmt.Fprintf(state.stdout(), "No ended jails match the filter (%d in the history)\n", len(records))
+		return nil
+	}
+
+	w := newTableWriter(state.stdout())
+	writeTableHeader(w, "Ended", "PID", "Name", "Type", "Duration", "Jailed by", "Released by", "Outcome", "Reason")
+	for _, record := range selected {
+		writeTableRow(w,
+			record.EndedAt.Local().Format("2006-01-02 15:04"),
+			strconv.Itoa(record.PID),
+			truncate(record.Name, nameColumnWidth, filter.Wide),
+			truncate(strings.Join(record.JailTypes, ","), typeColumnWidth, filter.Wide),
+			record.EndedAt.Sub(record.JailedAt).Round(time.Second).String(),
+			historyOperator(record.JailedBy),
+			historyOperator(record.ReleasedBy),
+			record.EndReason,
+			truncate(record.Reason, reasonColumnWidth, filter.Wide))
+	}
+	w.Flush()
+	fmt.Fprintf(state.stdout(), "(%d of %d ended jails shown)\n", len(selected), len(records))
+	return nil
+}
+
+// historyOperator shows the operator of a record, - for the processes that exited and the
+// records written before the operators were kept
+func historyOperator(operator string) string {
+	if operator == "" {
+		return "-"
+	}
+	return operator
+}
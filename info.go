@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// infoSampleInterval is how long info measures the CPU usage of the jail
+const infoSampleInterval = 250 * time.Millisecond
+
+// showJailInfoJSON prints the record of the jail of a process as JSON
+func showJailInfoJSON(state *JailerState, pid int) error {
+	jail, exists := state.ActiveJails[pid]
+	if !exists {
+		return fmt.Errorf("process %d is not jailed", pid)
+	}
+	content, err := json.MarshalIndent(newJailRecord(jail), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode jail: %v", err)
+	}
+	fmt.Fprintln(state.stdout(), string(content))
+	return nil
+}
+
+// showJailInfo prints everything known about the jail of a process, long values are
+// truncated unless wide is set
+func showJailInfo(state *JailerState, pid int, wide bool) error {
+	jail, exists := state.ActiveJails[pid]
+	if !exists {
+		return fmt.Errorf("process %d is not jailed", pid)
+	}
+	if !hostProcesses.exists(pid) {
+		cleanupDeadProcesses(state)
+		return fmt.Errorf("process %d no longer exists", pid)
+	}
+
+	fmt.Fprintf(state.stdout(), "Jail of process %d (%s)\n", pid, hostProcesses.name(pid))
+	w := newTableWriter(state.stdout())
+	writeTableRow(w, "  Command:", truncate(getProcessCmdline(pid), commandColumnWidth, wide))
+	writeTableRow(w, "  User:", getProcessUser(pid))
+	writeTableRow(w, "  Jailed since:", fmt.Sprintf("%s (%s ago)",
+		jail.Timestamp.Format(time.RFC3339), time.Since(jail.Timestamp).Round(time.Second)))
+	if jail.JailedBy != "" {
+		writeTableRow(w, "  Jailed by:", jail.JailedBy)
+	}
+	if jail.Reason != "" {
+		writeTableRow(w, "  Reason:", jail.Reason)
+	}
+	writeTableRow(w, "  Persistence:", jailPersistence(state, jail))
+	if jail.OomGroup {
+		writeTableRow(w, "  OOM group:", fmt.Sprintf("the OOM killer takes the whole tree (%s)", state.Limits.jailGroup(jail, "memory")))
+	}
+	if !jail.ExpiresAt.IsZero() {
+		writeTableRow(w, "  Expires:", fmt.Sprintf("%s (in %s)", jail.ExpiresAt.Format(time.RFC3339), formatExpiry(jail, time.Now())))
+	}
+	if len(jail.Command) > 0 {
+		writeTableRow(w, "  Started with run:", truncate(strings.Join(jail.Command, " "), commandColumnWidth, wide))
+	}
+	w.Flush()
+
+	fmt.Fprintln(state.stdout())
+	fmt.Fprintf(state.stdout(), "Jail types: %s\n", jail.GetJailTypesString())
+	w = newTableWriter(state.stdout())
+	for _, jailType := range jail.JailTypes {
+		writeTableRow(w, "  "+jailType, describeJailType(state, jail, jailType))
+	}
+	w.Flush()
+
+	fmt.Fprintln(state.stdout())
+	fmt.Fprintln(state.stdout(), "Cgroups:")
+	w = newTableWriter(state.stdout())
+	writeTableRow(w, "  Original:", jail.OriginalCgroup)
+	if current, err := state.Limits.processGroup(pid); err == nil {
+		writeTableRow(w, "  Current:", current)
+	}
+	w.Flush()
+
+	if jail.HasJailType("network") {
+		fmt.Fprintln(state.stdout())
+		fmt.Fprintf(state.stdout(), "Firewall rules (%s, shared by all network jails, then the ones of the jail):\n", state.FirewallTool)
+		for _, rule := range state.Firewall.describe() {
+			fmt.Fprintf(state.stdout(), "  %s\n", rule)
+		}
+		if dropped, err := state.Firewall.droppedPackets(); err == nil {
+			fmt.Fprintf(state.stdout(), "  Dropped packets: %d\n", dropped)
+		}
+		for _, rule := range state.Firewall.describeJail(jail) {
+			fmt.Fprintf(state.stdout(), "  %s\n", rule)
+		}
+		if jail.ClassID != "" {
+			fmt.Fprintf(state.stdout(), "  Own net_cls classid %s in %s\n", jail.ClassID, state.Limits.jailGroup(jail, "network"))
+		}
+		if jail.NetNamespace != "" {
+			fmt.Fprintf(state.stdout(), "  Also installed in the network namespace %s of the process\n", jail.NetNamespace)
+		}
+	}
+	if jail.HasJailType("proxy") {
+		fmt.Fprintln(state.stdout())
+		fmt.Fprintf(state.stdout(), "Firewall rules (%s, shared by all proxy jails):\n", state.FirewallTool)
+		for _, rule := range state.Firewall.describeProxy() {
+			fmt.Fprintf(state.stdout(), "  %s\n", rule)
+		}
+	}
+
+	fmt.Fprintln(state.stdout())
+	fmt.Fprintf(state.stdout(), "Descendants (%d):\n", len(jail.Children))
+	w = newTableWriter(state.stdout())
+	for _, childPid := range jail.Children {
+		status := "running"
+		if !hostProcesses.exists(childPid) {
+			status = "exited"
+		}
+		writeTableRow(w, fmt.Sprintf("  %d", childPid), hostProcesses.name(childPid), status,
+			"from "+jail.originalCgroupOf(childPid), truncate(getProcessCmdline(childPid), commandColumnWidth, wide))
+	}
+	w.Flush()
+
+	if len(jail.FailedDescendants) > 0 {
+		fmt.Fprintln(state.stdout())
+		fmt.Fprintf(state.stdout(), "Failed descendants (%d):\n", len(jail.FailedDescendants))
+		pids := make([]int, 0, len(jail.FailedDescendants))
+		for failedPid := range jail.FailedDescendants {
+			pids = append(pids, failedPid)
+		}
+		sort.Ints(pids)
+		w = newTableWriter(state.stdout())
+		for _, failedPid := range pids {
+			writeTableRow(w, fmt.Sprintf("  %d", failedPid), hostProcesses.name(failedPid),
+				truncate(jail.FailedDescendants[failedPid], commandColumnWidth, wide))
+		}
+		w.Flush()
+	}
+
+	// Measure the current usage over a short interval
+	first := sampleJailUsage(state, jail, nil)
+	time.Sleep(infoSampleInterval)
+	usage := sampleJailUsage(state, jail, &first)
+
+	fmt.Fprintln(state.stdout())
+	fmt.Fprintln(state.stdout(), "Resource usage:")
+	w = newTableWriter(state.stdout())
+	writeTableRow(w, "  CPU:", fmt.Sprintf("%.1f%% of one core", usage.CPUPercent))
+	writeTableRow(w, "  Resident memory:", formatBytes(usage.RSSBytes))
+	if usage.HasCgroupStats {
+		writeTableRow(w, "  Cgroup memory:", formatBytes(usage.MemoryBytes))
+		writeTableRow(w, "  Cgroup throttled:", fmt.Sprintf("%s total, %d of %d periods",
+			(time.Duration(usage.ThrottledUsec)*time.Microsecond).Round(time.Millisecond),
+			usage.Throttling.Throttled, usage.Throttling.Periods))
+		writeTableRow(w, "  Memory events:", usage.MemoryEvents.String())
+	}
+	w.Flush()
+
+	return nil
+}
+
+// describeJailType returns the limits enforced by a jail type
+func describeJailType(state *JailerState, jail *Jail, jailType string) string {
+	switch jailType {
+	case "network":
+		description := "all traffic dropped"
+		if sessions := len(jail.SessionRules) / 2; sessions > 0 {
+			description = fmt.Sprintf("new traffic dropped, %d established sessions kept open", sessions)
+		}
+		if len(jail.AllowRules) > 0 {
+			description += fmt.Sprintf(", allowlist in use (allow %d list)", jail.PID)
+		}
+		if len(jail.AllowedIfaces) > 0 {
+			description += ", traffic on " + strings.Join(jail.AllowedIfaces, ", ") + " allowed"
+		}
+		if len(jail.BlockedCountries) > 0 {
+			description = "traffic with " + strings.Join(jail.BlockedCountries, ", ") + " dropped, the rest allowed"
+		} else if len(jail.AllowedCountries) > 0 {
+			description += ", only " + strings.Join(jail.AllowedCountries, ", ") + " reachable"
+		}
+		if jail.ClassID != "" {
+			description += ", classid " + jail.ClassID
+		} else if jail.NetworkCgroup != "" {
+			description += ", rules of its own on cgroup " + jail.NetworkCgroup
+		}
+		return description
+	case "proxy":
+		return fmt.Sprintf("only %s reachable, shared with the other proxy jails", state.Config.NetworkProxy)
+	case "cpu":
+		if jail.Adaptive != nil {
+			return fmt.Sprintf("%d%% of one core, adapting to keep the host under %d%%, at most %d%% (%s)", jail.Adaptive.Applied,
+				jail.Adaptive.TargetPercent, jail.CpuPercent, state.Limits.jailGroup(jail, "cpu"))
+		}
+		if jail.Squeeze != nil {
+			return fmt.Sprintf("%d%% of one core, squeezed down to %d%% by %s (%s)", jail.Squeeze.Applied, jail.CpuPercent,
+				jail.Squeeze.Since.Add(jail.Squeeze.Over).Format(time.TimeOnly), state.Limits.jailGroup(jail, "cpu"))
+		}
+		if jail.CpuWeight > 0 {
+			return fmt.Sprintf("weight %d, only loses CPU when others need it (%s)", jail.CpuWeight, state.Limits.jailGroup(jail, "cpu"))
+		}
+		if jail.CpuPercent > 0 && jail.CpuBurst > 0 {
+			return fmt.Sprintf("%d%% of one core, bursts up to %s (%s)", jail.CpuPercent, jail.CpuBurst, state.Limits.jailGroup(jail, "cpu"))
+		}
+		if jail.CpuPercent > 0 {
+			return fmt.Sprintf("%d%% of one core (%s)", jail.CpuPercent, state.Limits.jailGroup(jail, "cpu"))
+		}
+		if jail.usesDedicatedCgroup() {
+			return fmt.Sprintf("1%% of one core (%s)", state.Limits.jailGroup(jail, "cpu"))
+		}
+		return "1% of one core, shared with the other CPU jails"
+	case "rdma":
+		return fmt.Sprintf("%s (%s)", formatLimits(jail.RdmaLimits), state.Limits.jailGroup(jail, "rdma"))
+	case "misc":
+		return fmt.Sprintf("%s (%s)", formatLimits(jail.MiscLimits), state.Limits.jailGroup(jail, "misc"))
+	case "memory":
+		return fmt.Sprintf("%s (%s)", formatBytes(jail.MemoryLimit), state.Limits.jailGroup(jail, "memory"))
+	case "quota":
+		return state.Quotas.describeJail(jail)
+	case "rlimit", "oom", "coredump":
+		return state.Resources.describeJail(jail, jailType)
+	case "syscall", "landlock", "readonly":
+		return fmt.Sprintf("profile %s, enforced until exit", jail.LaunchProfiles[jailType])
+	}
+	return ""
+}
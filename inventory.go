@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	inventoryHeartbeat   = 30 * time.Second
+	inventoryStaleAfter  = 3 * inventoryHeartbeat
+	inventoryHTTPTimeout = 5 * time.Second
+	defaultInventoryKey  = "jailer"
+)
+
+// StateBackendConfig selects the clustered store receiving the jails of every host
+type StateBackendConfig struct {
+	Type     string `json:"type"`     // "consul" or "etcd"
+	Endpoint string `json:"endpoint"` // e.g. http://127.0.0.1:8500 or http://127.0.0.1:2379
+	Prefix   string `json:"prefix"`   // Key prefix, "jailer" by default
+	Token    string `json:"token"`    // Consul ACL token or etcd auth token
+}
+
+// stateBackend is a key-value store shared by the hosts of a cluster
+type stateBackend interface {
+	put(key string, value []byte) error
+	get(key string) ([]byte, error) // nil when the key doesn't exist
+	delete(key string) error
+	list(prefix string) (map[string][]byte, error)
+}
+
+// newStateBackend returns the configured clustered store, nil when none is configured
+func newStateBackend(config StateBackendConfig) (stateBackend, error) {
+	client := &http.Client{Timeout: inventoryHTTPTimeout}
+	endpoint := strings.TrimSuffix(config.Endpoint, "/")
+
+	switch config.Type {
+	case "":
+		return nil, nil
+	case "consul":
+		return &consulBackend{endpoint: endpoint, token: config.Token, client: client}, nil
+	case "etcd":
+		return &etcdBackend{endpoint: endpoint, token: config.Token, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown state backend: %s (expected consul or etcd)", config.Type)
+	}
+}
+
+// backendRequest sends a request to a state backend and returns the response body
+func backendRequest(client *http.Client, method, requestURL string, body []byte, header http.Header) ([]byte, int, error) {
+	request, err := http.NewRequest(method, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return content, response.StatusCode, nil
+}
+
+// consulBackend stores the inventory in the Consul KV store
+type consulBackend struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+// header returns the headers of the Consul requests
+func (b *consulBackend) header() http.Header {
+	header := http.Header{}
+	if b.token != "" {
+		header.Set("X-Consul-Token", b.token)
+	}
+	return header
+}
+
+func (b *consulBackend) put(key string, value []byte) error {
+	_, status, err := backendRequest(b.client, http.MethodPut, b.endpoint+"/v1/kv/"+key, value, b.header())
+	if err != nil {
+		return fmt.Errorf("consul: %v", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("consul: PUT %s returned status %d", key, status)
+	}
+	return nil
+}
+
+func (b *consulBackend) get(key string) ([]byte, error) {
+	content, status, err := backendRequest(b.client, http.MethodGet, b.endpoint+"/v1/kv/"+key+"?raw=true", nil, b.header())
+	if err != nil {
+		return nil, fmt.Errorf("consul: %v", err)
+	}
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("consul: GET %s returned status %d", key, status)
+	}
+	return content, nil
+}
+
+func (b *consulBackend) delete(key string) error {
+	_, status, err := backendRequest(b.client, http.MethodDelete, b.endpoint+"/v1/kv/"+key, nil, b.header())
+	if err != nil {
+		return fmt.Errorf("consul: %v", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("consul: DELETE %s returned status %d", key, status)
+	}
+	return nil
+}
+
+func (b *consulBackend) list(prefix string) (map[string][]byte, error) {
+	content, status, err := backendRequest(b.client, http.MethodGet, b.endpoint+"/v1/kv/"+prefix+"?recurse=true", nil, b.header())
+	if err != nil {
+		return nil, fmt.Errorf("consul: %v", err)
+	}
+	values := make(map[string][]byte)
+	if status == http.StatusNotFound {
+		return values, nil
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("consul: GET %s returned status %d", prefix, status)
+	}
+
+	var pairs []struct {
+		Key   string
+		Value []byte // Base64 in the JSON, decoded by encoding/json
+	}
+	if err := json.Unmarshal(content, &pairs); err != nil {
+		return nil, fmt.Errorf("consul: invalid response: %v", err)
+	}
+	for _, pair := range pairs {
+		values[pair.Key] = pair.Value
+	}
+	return values, nil
+}
+
+// etcdBackend stores the inventory in etcd through its v3 JSON gateway
+type etcdBackend struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+// call posts a request to the JSON gateway of etcd
+func (b *etcdBackend) call(path string, request any) ([]byte, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if b.token != "" {
+		header.Set("Authorization", b.token)
+	}
+
+	content, status, err := backendRequest(b.client, http.MethodPost, b.endpoint+path, body, header)
+	if err != nil {
+		return nil, fmt.Errorf("etcd: %v", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("etcd: %s returned status %d: %s", path, status, strings.TrimSpace(string(content)))
+	}
+	return content, nil
+}
+
+func (b *etcdBackend) put(key string, value []byte) error {
+	_, err := b.call("/v3/kv/put", map[string][]byte{"key": []byte(key), "value": value})
+	return err
+}
+
+func (b *etcdBackend) get(key string) ([]byte, error) {
+	values, err := b.rangeValues(map[string][]byte{"key": []byte(key)})
+	if err != nil {
+		return nil, err
+	}
+	return values[key], nil
+}
+
+func (b *etcdBackend) delete(key string) error {
+	_, err := b.call("/v3/kv/deleterange", map[string][]byte{"key": []byte(key)})
+	return err
+}
+
+func (b *etcdBackend) list(prefix string) (map[string][]byte, error) {
+	return b.rangeValues(map[string][]byte{"key": []byte(prefix), "range_end": prefixRangeEnd(prefix)})
+}
+
+// rangeValues returns the keys and values of a range request
+func (b *etcdBackend) rangeValues(request map[string][]byte) (map[string][]byte, error) {
+	content, err := b.call("/v3/kv/range", request)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.Unmarshal(content, &response); err != nil {
+		return nil, fmt.Errorf("etcd: invalid response: %v", err)
+	}
+	values := make(map[string][]byte)
+	for _, kv := range response.Kvs {
+		values[string(kv.Key)] = kv.Value
+	}
+	return values, nil
+}
+
+// prefixRangeEnd returns the end of the etcd range holding all the keys with a prefix
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// inventoryJail is a jail as published to the clustered store
+type inventoryJail struct {
+	PID       int       `json:"pid"`
+	Name      string    `json:"name"`
+	JailTypes []string  `json:"jail_types"`
+	Children  int       `json:"children"`
+	Reason    string    `json:"reason,omitempty"`
+	JailedBy  string    `json:"jailed_by,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// hostInventory is the record of a host in the clustered store
+type hostInventory struct {
+	Host      string          `json:"host"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Jails     []inventoryJail `json:"jails"`
+}
+
+// inventoryPublisher keeps the record of this host up to date in the clustered store
+type inventoryPublisher struct {
+	backend stateBackend
+	prefix  string
+	host    string
+	mutex   sync.Mutex
+	last    hostInventory
+	lastErr error // Outcome of the last write, for the health checks
+}
+
+// newInventoryPublisher starts publishing the jails of this host, the record is
+// refreshed periodically so that the record of a dead host goes stale
+func newInventoryPublisher(config StateBackendConfig, host string) (*inventoryPublisher, error) {
+	backend, err := newStateBackend(config)
+	if err != nil || backend == nil {
+		return nil, err
+	}
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultInventoryKey
+	}
+
+	publisher := &inventoryPublisher{backend: backend, prefix: prefix, host: host}
+	publisher.last = hostInventory{Host: host}
+	go func() {
+		for range time.Tick(inventoryHeartbeat) {
+			publisher.mutex.Lock()
+			record := publisher.last
+			publisher.mutex.Unlock()
+			publisher.put(record)
+		}
+	}()
+	return publisher, nil
+}
+
+// inventoryHostKey returns the key of the record of a host
+func inventoryHostKey(prefix, host string) string {
+	return prefix + "/hosts/" + url.PathEscape(host)
+}
+
+// publish replaces the record of this host with the current jails
+func (p *inventoryPublisher) publish(state *JailerState) {
+	record := hostInventory{Host: p.host}
+	for pid, jail := range state.ActiveJails {
+		record.Jails = append(record.Jails, inventoryJail{
+			PID:       pid,
+			Name:      jail.Name,
+			JailTypes: jail.JailTypes,
+			Children:  len(jail.Children),
+			Reason:    jail.Reason,
+			JailedBy:  jail.JailedBy,
+			Since:     jail.Timestamp,
+		})
+	}
+	sort.Slice(record.Jails, func(i, j int) bool { return record.Jails[i].PID < record.Jails[j].PID })
+
+	p.mutex.Lock()
+	p.last = record
+	p.mutex.Unlock()
+	p.put(record)
+}
+
+// put writes a record with the current time, failures only warn since jailing works
+// without the store
+func (p *inventoryPublisher) put(record hostInventory) {
+	record.UpdatedAt = time.Now()
+	content, err := json.Marshal(record)
+	if err == nil {
+		err = p.backend.put(inventoryHostKey(p.prefix, p.host), content)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to publish jails to the state backend: %v\n", err)
+	}
+	p.mutex.Lock()
+	p.lastErr = err
+	p.mutex.Unlock()
+}
+
+// lastError returns the error of the last write to the store, nil when it succeeded
+func (p *inventoryPublisher) lastError() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.lastErr
+}
+
+// publishInventory publishes the jails of this host when a clustered store is configured,
+// and saves them to the state file of a systemd service
+func publishInventory(state *JailerState) {
+	saveJailState(state)
+	savePersistentJails(state)
+	if state.Inventory != nil {
+		state.Inventory.publish(state)
+	}
+}
+
+// readInventory returns the records of all the hosts, sorted by host
+func readInventory(config StateBackendConfig) ([]hostInventory, error) {
+	backend, err := newStateBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	if backend == nil {
+		return nil, fmt.Errorf("no state backend configured")
+	}
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultInventoryKey
+	}
+
+	values, err := backend.list(prefix + "/hosts/")
+	if err != nil {
+		return nil, err
+	}
+	var records []hostInventory
+	for key, value := range values {
+		var record hostInventory
+		if err := json.Unmarshal(value, &record); err != nil {
+			fmt.Printf("Warning: ignoring invalid record %s: %v\n", key, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Host < records[j].Host })
+	return records, nil
+}
+
+// listAllHosts displays the jails of every host of the cluster, hosts that stopped
+// refreshing their record are flagged so their jails can be followed up
+func listAllHosts(out io.Writer, config StateBackendConfig, filter listFilter) error {
+	records, err := readInventory(config)
+	if err != nil {
+		return err
+	}
+	if filter.JSON {
+		for i := range records {
+			var jails []inventoryJail
+			for _, jail := range records[i].Jails {
+				if filter.matches(&Jail{PID: jail.PID, JailTypes: jail.JailTypes, Timestamp: jail.Since}, jail.Name) {
+					jails = append(jails, jail)
+				}
+			}
+			records[i].Jails = jails
+		}
+		content, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode jails: %v", err)
+		}
+		fmt.Fprintln(out, string(content))
+		return nil
+	}
+	if len(records) == 0 {
+		fmt.Fprintln(out, "No hosts in the state backend")
+		return nil
+	}
+
+	w := newTableWriter(out)
+	writeTableHeader(w, "Host", "PID", "Name", "Type", "Children", "Since", "Reason")
+	shown, total := 0, 0
+	var staleHosts []string
+	for _, record := range records {
+		host := record.Host
+		if time.Since(record.UpdatedAt) > inventoryStaleAfter {
+			host += " (stale)"
+			staleHosts = append(staleHosts, fmt.Sprintf("%s (last update %s ago)",
+				record.Host, time.Since(record.UpdatedAt).Round(time.Second)))
+		}
+		for _, jail := range record.Jails {
+			total++
+			if !filter.matches(&Jail{PID: jail.PID, JailTypes: jail.JailTypes, Timestamp: jail.Since}, jail.Name) {
+				continue
+			}
+			shown++
+			writeTableRow(w,
+				truncate(host, nameColumnWidth, filter.Wide),
+				strconv.Itoa(jail.PID),
+				truncate(jail.Name, nameColumnWidth, filter.Wide),
+				truncate(strings.Join(jail.JailTypes, ","), typeColumnWidth, filter.Wide),
+				strconv.Itoa(jail.Children),
+				time.Since(jail.Since).Round(time.Second).String(),
+				truncate(jail.Reason, reasonColumnWidth, filter.Wide))
+		}
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "(%d of %d jails shown on %d hosts)\n", shown, total, len(records))
+	for _, stale := range staleHosts {
+		fmt.Fprintf(out, "Warning: %s may be down, its jails are from its last update\n", stale)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// kvStore keeps the saved jails, the audit events and the ended jails of a host in the
+// clustered store of state_backend, under <prefix>/store/<host>/. They outlive the disk of
+// the host, and the records of the whole fleet can be read from one place
+type kvStore struct {
+	backend stateBackend
+	prefix  string // <prefix>/store/<host>
+
+	mutex    sync.Mutex
+	lastSeq  int64 // Sequence of the last appended key, keeps them ordered and unique
+	location string
+}
+
+// newKVStore returns the store of a host in the clustered store
+func newKVStore(config StateBackendConfig, host string) (*kvStore, error) {
+	backend, err := newStateBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	if backend == nil {
+		return nil, fmt.Errorf("the kv store needs a state_backend")
+	}
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultInventoryKey
+	}
+	prefix += "/store/" + url.PathEscape(host)
+	return &kvStore{backend: backend, prefix: prefix, location: config.Type + ":" + prefix}, nil
+}
+
+// appendKey returns a new key under a section, the keys of a section sort in the order
+// they were appended
+func (s *kvStore) appendKey(section string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seq := time.Now().UnixNano()
+	if seq <= s.lastSeq {
+		seq = s.lastSeq + 1
+	}
+	s.lastSeq = seq
+	return fmt.Sprintf("%s/%s/%020d", s.prefix, section, seq)
+}
+
+func (s *kvStore) putDocument(name string, content []byte) error {
+	return s.backend.put(s.prefix+"/documents/"+name, content)
+}
+
+func (s *kvStore) getDocument(name string) ([]byte, error) {
+	return s.backend.get(s.prefix + "/documents/" + name)
+}
+
+func (s *kvStore) deleteDocument(name string) error {
+	return s.backend.delete(s.prefix + "/documents/" + name)
+}
+
+func (s *kvStore) appendAuditEvent(event AuditEvent) error {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode: %v", err)
+	}
+	return s.backend.put(s.appendKey("audit"), content)
+}
+
+func (s *kvStore) appendHistoryRecord(record JailRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode: %v", err)
+	}
+	return s.backend.put(s.appendKey("history"), content)
+}
+
+func (s *kvStore) loadHistory() ([]JailRecord, int, error) {
+	values, err := s.backend.list(s.prefix + "/history/")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read history: %v", err)
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var records []JailRecord
+	skipped := 0
+	for _, key := range keys {
+		var record JailRecord
+		if err := json.Unmarshal(values[key], &record); err != nil {
+			skipped++
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, skipped, nil
+}
+
+// appendUsageSamples drops the samples, a time series would grow the clustered store
+// without bound
+func (s *kvStore) appendUsageSamples(samples []usageSample) error {
+	return nil
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// landlockReadAccess is granted on read-only paths
+	landlockReadAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR
+
+	// landlockFileAccess are the only rights that apply to a regular file rule
+	landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+		unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+)
+
+// landlockABIVersion returns the Landlock ABI version supported by the kernel
+func landlockABIVersion() (int, error) {
+	version, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0, fmt.Errorf("landlock is not available: %v", errno)
+	}
+	return int(version), nil
+}
+
+// landlockHandledAccess returns the filesystem rights known to a Landlock ABI version
+func landlockHandledAccess(abi int) uint64 {
+	// ABI 1 handles every right from EXECUTE to MAKE_SYM
+	access := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		access |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+	return access
+}
+
+// applyLandlockProfile restricts the filesystem access of the calling thread, it must run
+// on a locked OS thread right before exec
+func applyLandlockProfile(profile LandlockProfile) error {
+	abi, err := landlockABIVersion()
+	if err != nil {
+		return err
+	}
+	handledAccess := landlockHandledAccess(abi)
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handledAccess}
+	rulesetFd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create landlock ruleset: %v", errno)
+	}
+	defer unix.Close(int(rulesetFd))
+
+	for _, path := range profile.ReadOnly {
+		if err := addLandlockPathRule(int(rulesetFd), path, landlockReadAccess&handledAccess); err != nil {
+			return err
+		}
+	}
+	for _, path := range profile.ReadWrite {
+		if err := addLandlockPathRule(int(rulesetFd), path, handledAccess); err != nil {
+			return err
+		}
+	}
+
+	// Required to enforce a ruleset without CAP_SYS_ADMIN in the new program
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %v", err)
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, rulesetFd, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to enforce landlock ruleset: %v", errno)
+	}
+
+	return nil
+}
+
+// addLandlockPathRule allows access beneath a path, missing paths are skipped
+func addLandlockPathRule(rulesetFd int, path string, access uint64) error {
+	pathFd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open landlock path %s: %v", path, err)
+	}
+	defer unix.Close(pathFd)
+
+	// Directory-only rights are rejected on files
+	var stat unix.Stat_t
+	if err := unix.Fstat(pathFd, &stat); err != nil {
+		return fmt.Errorf("failed to stat landlock path %s: %v", path, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFileAccess
+	}
+
+	rule := unix.LandlockPathBeneathAttr{
+		Allowed_access: access,
+		Parent_fd:      int32(pathFd),
+	}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFd),
+		unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to add landlock rule for %s: %v", path, errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+const (
+	// launcherArg is the hidden argument that turns jailer into the launcher of a command
+	launcherArg = "__jailer-launch"
+
+	// launchSpecEnv carries the JSON launch specification to the launcher
+	launchSpecEnv = "JAILER_LAUNCH_SPEC"
+
+	// launcherExitCode is returned by the launcher when the command could not be started
+	launcherExitCode = 127
+)
+
+// LaunchSpec describes a command started by jailer and the restrictions it gets before exec
+type LaunchSpec struct {
+	Path     string           `json:"path"`
+	Args     []string         `json:"args"`
+	Seccomp  *SeccompProfile  `json:"seccomp,omitempty"`
+	Landlock *LandlockProfile `json:"landlock,omitempty"`
+	ReadOnly *ReadOnlyProfile `json:"readonly,omitempty"`
+}
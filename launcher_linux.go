@@ -0,0 +1,120 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// startLauncher starts the launcher process for a command. The launcher waits before
+// exec until a byte is written to the returned release pipe (closing it aborts the
+// launch), so the caller can jail its PID before the command runs any code.
+func startLauncher(spec *LaunchSpec, stdin io.Reader, stdout, stderr io.Writer) (*exec.Cmd, *os.File, error) {
+	// Resolve the command now so a typo fails before anything gets jailed
+	path, err := exec.LookPath(spec.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("command not found: %s", spec.Path)
+	}
+	spec.Path = path
+
+	encodedSpec, err := json.Marshal(spec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode launch specification: %v", err)
+	}
+
+	releaseReader, releaseWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create launcher pipe: %v", err)
+	}
+	defer releaseReader.Close()
+
+	cmd := exec.Command("/proc/self/exe", launcherArg)
+	cmd.Env = append(os.Environ(), launchSpecEnv+"="+string(encodedSpec))
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.ExtraFiles = []*os.File{releaseReader} // fd 3 in the launcher
+
+	// The read-only remount happens in a private mount namespace, Go also makes
+	// the mount propagation private so nothing leaks back to the host
+	if spec.ReadOnly != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWNS}
+	}
+
+	if err := cmd.Start(); err != nil {
+		releaseWriter.Close()
+		return nil, nil, fmt.Errorf("failed to start launcher: %v", err)
+	}
+
+	return cmd, releaseWriter, nil
+}
+
+// releaseLauncher lets a launcher started by startLauncher exec its command
+func releaseLauncher(release *os.File) error {
+	defer release.Close()
+	if _, err := release.Write([]byte{1}); err != nil {
+		return fmt.Errorf("failed to release launcher: %v", err)
+	}
+	return nil
+}
+
+// runLauncher is the entry point of the launcher process, it never returns
+func runLauncher() {
+	// Restrictions are per thread until exec, keep everything on this one
+	runtime.LockOSThread()
+
+	var spec LaunchSpec
+	if err := json.Unmarshal([]byte(os.Getenv(launchSpecEnv)), &spec); err != nil {
+		launcherFail("invalid launch specification: %v", err)
+	}
+	os.Unsetenv(launchSpecEnv)
+
+	// Wait until jailer has moved us into the jail
+	release := os.NewFile(3, "release")
+	buf := make([]byte, 1)
+	if n, _ := release.Read(buf); n != 1 {
+		launcherFail("launch of %s aborted", spec.Path)
+	}
+	release.Close()
+
+	// Mounts are changed first, Landlock and seccomp would forbid them afterwards
+	if spec.ReadOnly != nil {
+		if err := applyReadOnlyFilesystem(*spec.ReadOnly); err != nil {
+			launcherFail("%v", err)
+		}
+	}
+
+	// Landlock goes before seccomp, the seccomp profile could deny its syscalls
+	if spec.Landlock != nil {
+		if err := applyLandlockProfile(*spec.Landlock); err != nil {
+			launcherFail("%v", err)
+		}
+	}
+
+	if spec.Seccomp != nil {
+		filter, err := buildSeccompFilter(*spec.Seccomp)
+		if err != nil {
+			launcherFail("invalid seccomp profile: %v", err)
+		}
+		if err := installSeccompFilter(filter); err != nil {
+			launcherFail("%v", err)
+		}
+	}
+
+	err := unix.Exec(spec.Path, spec.Args, os.Environ())
+	launcherFail("failed to execute %s: %v", spec.Path, err)
+}
+
+// launcherFail reports a launcher error on stderr and exits
+func launcherFail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "jailer launcher: "+format+"\n", args...)
+	os.Exit(launcherExitCode)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultCpuWeight = 100  // cpu.weight of the cgroups without weight
+	quotaBlock       = 1024 // Unit of the block limits of the disk quotas
+)
+
+// parseSize parses a size value with an optional K, M, G or T suffix (powers of 1024)
+func parseSize(value string) (uint64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	size := value
+	multiplier := uint64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	case "T":
+		multiplier = 1 << 40
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	number, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	// The kernel takes the limits as signed 64-bit values
+	if number > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size too large: %s", size)
+	}
+
+	return number * multiplier, nil
+}
+
+// parseRlimitSpecs parses "resource=value" arguments such as nofile=256 or fsize=100M
+func parseRlimitSpecs(specs []string) (map[string]uint64, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("usage: jail rlimit <pid> <resource>=<value> [...] (resources: %s)",
+			strings.Join(rlimitResourceNames(), ", "))
+	}
+
+	limits := make(map[string]uint64)
+	for _, spec := range specs {
+		name, value, found := strings.Cut(spec, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid resource limit %q: expected <resource>=<value>", spec)
+		}
+
+		name = strings.ToLower(name)
+		if !slices.Contains(rlimitResourceNames(), name) {
+			return nil, fmt.Errorf("unknown resource %q (resources: %s)", name, strings.Join(rlimitResourceNames(), ", "))
+		}
+
+		if strings.ToLower(value) == "unlimited" {
+			limits[name] = unix.RLIM_INFINITY
+			continue
+		}
+
+		limit, err := parseSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+		limits[name] = limit
+	}
+
+	return limits, nil
+}
+
+// rlimitResourceNames returns the sorted list of supported resource names, each backend
+// maps them to the limits of its system
+func rlimitResourceNames() []string {
+	return []string{"as", "core", "cpu", "data", "fsize", "locks", "memlock", "msgqueue", "nofile", "nproc", "rss", "sigpending", "stack"}
+}
+
+// formatRlimits returns a compact "resource=value" representation of the limits
+func formatRlimits(limits map[string]uint64) string {
+	var parts []string
+	for _, name := range rlimitResourceNames() {
+		limit, ok := limits[name]
+		if !ok {
+			continue
+		}
+		if limit == unix.RLIM_INFINITY {
+			parts = append(parts, name+"=unlimited")
+		} else {
+			parts = append(parts, fmt.Sprintf("%s=%d", name, limit))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseCpuPercent parses a CPU limit such as "5%" expressed in percent of one core. The %
+// is required, a bare number after the targets of jail is another PID
+func parseCpuPercent(value string) (int, error) {
+	number, found := strings.CutSuffix(value, "%")
+	percent, err := strconv.Atoi(number)
+	if err != nil || !found {
+		return 0, fmt.Errorf("invalid CPU limit: %s (expected a percentage such as 5%%)", value)
+	}
+
+	// The kernel refuses quotas below 1ms per 100ms period
+	maxPercent := 100 * runtime.NumCPU()
+	if percent < 1 || percent > maxPercent {
+		return 0, fmt.Errorf("CPU limit must be between 1%% and %d%%", maxPercent)
+	}
+
+	return percent, nil
+}
+
+// parseCpuWeight parses the CPU weight of a proportional CPU jail, such as "weight=10",
+// on the cpu.weight scale where the default is 100
+func parseCpuWeight(value string) (int, error) {
+	weight, err := strconv.Atoi(strings.TrimPrefix(value, "weight="))
+	if err != nil || weight < 1 || weight > 10000 {
+		return 0, fmt.Errorf("invalid CPU weight: %s (expected 1 to 10000, the default is %d)", value, defaultCpuWeight)
+	}
+	return weight, nil
+}
+
+// parseCpuBurst parses the --burst flag, the CPU time a jail may save from its idle periods
+// and spend on top of its quota. The kernel takes at most the quota of a period, checked
+// once the limit is known
+func parseCpuBurst(value string) (time.Duration, error) {
+	burst, err := time.ParseDuration(value)
+	if err != nil || burst < time.Microsecond {
+		return 0, fmt.Errorf("invalid --burst %q (expected a duration such as 20ms)", value)
+	}
+	return burst, nil
+}
+
+// validateCgroupFallback checks the destination of the processes whose original cgroup
+// is gone at unjail time: root, recreate or a cgroup path such as /user.slice
+func validateCgroupFallback(fallback string) error {
+	if fallback == "" || fallback == "root" || fallback == "recreate" || strings.HasPrefix(fallback, "/") {
+		return nil
+	}
+	return fmt.Errorf("invalid cgroup_fallback %q (expected root, recreate or a cgroup path such as /user.slice)", fallback)
+}
+
+// rdmaResources lists the HCA resources limited by the rdma controller
+var rdmaResources = []string{"hca_handle", "hca_object"}
+
+// parseRdmaLimits parses RDMA limits such as "mlx5_0:hca_handle=2", keyed by
+// "<device>:<resource>"
+func parseRdmaLimits(specs []string) (map[string]uint64, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("usage: jail rdma <pid> <device>:<resource>=<value> [...] (resources: %s)",
+			strings.Join(rdmaResources, ", "))
+	}
+
+	limits := make(map[string]uint64)
+	for _, spec := range specs {
+		key, value, found := strings.Cut(spec, "=")
+		device, resource, hasDevice := strings.Cut(key, ":")
+		if !found || !hasDevice || device == "" {
+			return nil, fmt.Errorf("invalid RDMA limit %q: expected <device>:<resource>=<value>", spec)
+		}
+
+		if !isRdmaResource(resource) {
+			return nil, fmt.Errorf("unknown RDMA resource %q (resources: %s)", resource, strings.Join(rdmaResources, ", "))
+		}
+
+		limit, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %s", key, value)
+		}
+		limits[key] = limit
+	}
+
+	return limits, nil
+}
+
+// isRdmaResource checks if a resource is limited by the rdma controller
+func isRdmaResource(resource string) bool {
+	for _, r := range rdmaResources {
+		if r == resource {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMiscLimits parses misc controller limits such as "sev=1", the resources are the
+// ones listed in misc.capacity
+func parseMiscLimits(specs []string) (map[string]uint64, error) {
+	capacity, _ := readMiscCapacity()
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("usage: jail misc <pid> <resource>=<value> [...] (resources: %s)",
+			strings.Join(miscResourceNames(capacity), ", "))
+	}
+
+	limits := make(map[string]uint64)
+	for _, spec := range specs {
+		name, value, found := strings.Cut(spec, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid misc limit %q: expected <resource>=<value>", spec)
+		}
+
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %s", name, value)
+		}
+
+		// Without misc.capacity the kernel will reject unknown resources itself
+		if capacity != nil {
+			total, ok := capacity[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown misc resource %q (resources: %s)", name, strings.Join(miscResourceNames(capacity), ", "))
+			}
+			if limit > total {
+				return nil, fmt.Errorf("limit for %s exceeds its capacity of %d", name, total)
+			}
+		}
+		limits[name] = limit
+	}
+
+	return limits, nil
+}
+
+// parseMemoryLimit parses the limit of a memory jail such as "256M"
+func parseMemoryLimit(specs []string) (uint64, error) {
+	if len(specs) != 1 {
+		return 0, fmt.Errorf("usage: jail memory <pid> <size> (e.g. 256M)")
+	}
+	limit, err := parseSize(specs[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory limit: %v", err)
+	}
+	// The kernel rounds the limit down to pages, a smaller one would stop the tree at once
+	if limit < uint64(os.Getpagesize()) {
+		return 0, fmt.Errorf("memory limit %s is below a page", specs[0])
+	}
+	return limit, nil
+}
+
+// formatLimits returns a compact "key=value" representation of controller limits
+func formatLimits(limits map[string]uint64) string {
+	keys := make([]string, 0, len(limits))
+	for key := range limits {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%d", key, limits[key]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseQuotaArgs parses the arguments of the quota jail: a size followed by the
+// directories to limit, found from the files the process writes to when omitted
+func parseQuotaArgs(args []string) (uint64, []string, error) {
+	if len(args) == 0 {
+		return 0, nil, fmt.Errorf("usage: jail quota <pid> <size> [directory...] (e.g. 500M)")
+	}
+
+	limit, err := parseSize(args[0])
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid quota: %v", err)
+	}
+	if limit < quotaBlock {
+		return 0, nil, fmt.Errorf("quota must be at least 1K")
+	}
+
+	var dirs []string
+	for _, dir := range args[1:] {
+		if !filepath.IsAbs(dir) {
+			return 0, nil, fmt.Errorf("quota directory must be an absolute path: %s", dir)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return 0, nil, fmt.Errorf("not a directory: %s", dir)
+		}
+		dir = filepath.Clean(dir)
+		if isMountPoint(dir) {
+			return 0, nil, fmt.Errorf("%s is the root of a filesystem, give the directories the process writes to below it", dir)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	return limit, dirs, nil
+}
+
+// readMiscCapacity reads the resources of the misc controller and their capacity
+func readMiscCapacity() (map[string]uint64, error) {
+	data, err := os.ReadFile("/sys/fs/cgroup/misc.capacity")
+	if err != nil {
+		return nil, err
+	}
+	return parseMiscCapacity(string(data)), nil
+}
+
+// parseMiscCapacity parses the "<resource> <capacity>" lines of misc.capacity
+func parseMiscCapacity(data string) map[string]uint64 {
+	capacity := make(map[string]uint64)
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if total, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			capacity[fields[0]] = total
+		}
+	}
+	return capacity
+}
+
+// miscResourceNames returns the sorted names of the misc resources
+func miscResourceNames(capacity map[string]uint64) []string {
+	names := make([]string, 0, len(capacity))
+	for name := range capacity {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isMountPoint checks if a directory is the root of a filesystem, / included
+func isMountPoint(dir string) bool {
+	var stat, parent unix.Stat_t
+	if err := unix.Stat(dir, &stat); err != nil {
+		return false
+	}
+	if err := unix.Stat(filepath.Dir(dir), &parent); err != nil {
+		return false
+	}
+	return stat.Dev != parent.Dev || stat.Ino == parent.Ino
+}
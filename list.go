@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listFilter selects and orders the jails shown by the list command
+type listFilter struct {
+	JailType    string        // Only jails with this type
+	OlderThan   time.Duration // Only jails older than this
+	NamePattern string        // Glob or substring matched against the process name
+	SortBy      string        // "pid", "age" or "name"
+	Wide        bool          // Don't truncate the columns
+	AllHosts    bool          // Jails of every host from the clustered store
+	JSON        bool          // Print JSON records instead of a table
+}
+
+// matchesName checks a process name against a glob pattern, patterns without
+// wildcards match as substrings
+func matchesName(pattern, name string) bool {
+	if matched, _ := filepath.Match(pattern, name); matched {
+		return true
+	}
+	return !strings.ContainsAny(pattern, "*?[") && strings.Contains(name, pattern)
+}
+
+// matches checks if a jail passes the filter
+func (f listFilter) matches(jail *Jail, processName string) bool {
+	if f.JailType != "" && !jail.HasJailType(f.JailType) {
+		return false
+	}
+	if f.OlderThan > 0 && time.Since(jail.Timestamp) < f.OlderThan {
+		return false
+	}
+	if f.NamePattern != "" && !matchesName(f.NamePattern, processName) {
+		return false
+	}
+	return true
+}
+
+// listEntry is a jail selected for display
+type listEntry struct {
+	jail        *Jail
+	processName string
+}
+
+// selectJails returns the jails passing the filter, in the requested order
+func selectJails(state *JailerState, filter listFilter) []listEntry {
+	var entries []listEntry
+	for pid, jail := range state.ActiveJails {
+		processName := hostProcesses.name(pid)
+		if filter.matches(jail, processName) {
+			entries = append(entries, listEntry{jail: jail, processName: processName})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		switch filter.SortBy {
+		case "age":
+			// Oldest first
+			return entries[i].jail.Timestamp.Before(entries[j].jail.Timestamp)
+		case "name":
+			if entries[i].processName != entries[j].processName {
+				return entries[i].processName < entries[j].processName
+			}
+		}
+		return entries[i].jail.PID < entries[j].jail.PID
+	})
+
+	return entries
+}
+
+// printJailTable prints the jails table, with CPU and memory columns when usage samples are given,
+// OOM is the count of processes killed by the OOM killer in the jail cgroup
+func printJailTable(state *JailerState, entries []listEntry, usage map[int]jailUsage, wide bool) {
+	w := newTableWriter(state.stdout())
+	if usage == nil {
+		writeTableHeader(w, "PID", "Name", "Type", "Children", "Since", "Expires", "Throttled", "OOM", "Reason")
+	} else {
+		writeTableHeader(w, "PID", "Name", "Type", "Children", "Since", "Expires", "CPU", "Throttled", "Memory", "OOM", "Reason")
+	}
+
+	for _, entry := range entries {
+		jail := entry.jail
+		values := []string{
+			strconv.Itoa(jail.PID),
+			truncate(entry.processName, nameColumnWidth, wide),
+			truncate(jail.GetJailTypesString(), typeColumnWidth, wide),
+			strconv.Itoa(len(jail.Children)),
+			time.Since(jail.Timestamp).Round(time.Second).String(),
+			formatExpiry(jail, time.Now()),
+		}
+		throttled := "-"
+		if jail.HasJailType("cpu") {
+			if throttling, err := getCgroupThrottling(state, jail.PID); err == nil {
+				throttled = throttling.String()
+			}
+		}
+		oomKills := "-"
+		if jail.HasCgroupJailTypes() {
+			if events, err := getCgroupMemoryEvents(state, jail.PID); err == nil {
+				oomKills = strconv.FormatUint(events.OOMKill, 10)
+			}
+		}
+		if usage == nil {
+			values = append(values, throttled, oomKills)
+		} else {
+			sample := usage[jail.PID]
+			values = append(values, fmt.Sprintf("%.1f%%", sample.CPUPercent), throttled, formatBytes(sample.RSSBytes), oomKills)
+		}
+		values = append(values, truncate(jail.Reason, reasonColumnWidth, wide))
+		writeTableRow(w, values...)
+	}
+
+	w.Flush()
+}
+
+// listJails displays the list of active quarantines
+func listJails(state *JailerState, filter listFilter) {
+	// Clean up dead processes before displaying
+	cleanupDeadProcesses(state)
+
+	if len(state.ActiveJails) == 0 {
+		fmt.Fprintln(state.stdout(), "No active jails")
+		return
+	}
+
+	entries := selectJails(state, filter)
+	if len(entries) == 0 {
+		fmt.Fprintf(state.stdout(), "No active jails match the filter (%d active)\n", len(state.ActiveJails))
+		return
+	}
+
+	fmt.Fprintln(state.stdout(), "Active jails:")
+	printJailTable(state, entries, nil, filter.Wide)
+
+	if len(entries) < len(state.ActiveJails) {
+		fmt.Fprintf(state.stdout(), "(%d of %d active jails shown)\n", len(entries), len(state.ActiveJails))
+	}
+}
+
+// listJailsJSON prints the jails passing the filter as JSON records
+func listJailsJSON(state *JailerState, filter listFilter) error {
+	cleanupDeadProcesses(state)
+
+	records := []JailRecord{}
+	for _, entry := range selectJails(state, filter) {
+		records = append(records, newJailRecord(entry.jail))
+	}
+	content, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode jails: %v", err)
+	}
+	fmt.Fprintln(state.stdout(), string(content))
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// lxdSockets are the API sockets of the snap, native and Incus installations of LXD
+var lxdSockets = []string{
+	"/var/snap/lxd/common/lxd/unix.socket",
+	"/var/lib/lxd/unix.socket",
+	"/var/lib/incus/unix.socket",
+}
+
+// lxdResponse is the envelope of every LXD API response
+type lxdResponse struct {
+	Type      string          `json:"type"`
+	Error     string          `json:"error"`
+	ErrorCode int             `json:"error_code"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+// lxdInstanceState is the part of the state of an LXD instance jailer needs
+type lxdInstanceState struct {
+	Status string `json:"status"`
+	Pid    int    `json:"pid"`
+}
+
+// lxdSocket returns the API socket of the LXD of the host, LXD_DIR overrides the
+// locations of the usual installations
+func lxdSocket() (string, error) {
+	candidates := lxdSockets
+	if dir := os.Getenv("LXD_DIR"); dir != "" {
+		candidates = []string{dir + "/unix.socket"}
+	}
+	for _, socket := range candidates {
+		if _, err := os.Stat(socket); err == nil {
+			return socket, nil
+		}
+	}
+	return "", fmt.Errorf("no LXD API socket found in %s", strings.Join(candidates, ", "))
+}
+
+// getLxdInstanceState asks the LXD API listening on a socket about the state of an
+// instance, found is false when LXD doesn't know it
+func getLxdInstanceState(socket, name string) (lxdInstanceState, bool, error) {
+	var instance lxdInstanceState
+	response, err := unixSocketClient(socket).Get("http://lxd/1.0/instances/" + url.PathEscape(name) + "/state")
+	if err != nil {
+		return instance, false, fmt.Errorf("failed to reach the LXD API at %s: %v", socket, err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return instance, false, fmt.Errorf("failed to read the LXD API response: %v", err)
+	}
+	var envelope lxdResponse
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return instance, false, fmt.Errorf("failed to parse the LXD API response: %v", err)
+	}
+	if response.StatusCode == http.StatusNotFound || envelope.ErrorCode == http.StatusNotFound {
+		return instance, false, nil
+	}
+	if envelope.Type == "error" || response.StatusCode != http.StatusOK {
+		return instance, false, fmt.Errorf("LXD API at %s answered %s: %s", socket, response.Status, envelope.Error)
+	}
+	if err := json.Unmarshal(envelope.Metadata, &instance); err != nil {
+		return instance, false, fmt.Errorf("failed to parse the state of LXD instance %s: %v", name, err)
+	}
+	return instance, true, nil
+}
+
+// lxdInitProcess returns the init process of a running LXD instance
+func lxdInitProcess(name string) (int, error) {
+	socket, err := lxdSocket()
+	if err != nil {
+		return 0, err
+	}
+	instance, found, err := getLxdInstanceState(socket, name)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("LXD instance %q not found", name)
+	}
+	if instance.Status != "Running" || instance.Pid <= 0 {
+		return 0, fmt.Errorf("LXD instance %q is %s, not running", name, strings.ToLower(instance.Status))
+	}
+	return instance.Pid, nil
+}
+
+// lxdPayloadProcesses returns the processes of the payload cgroup of an LXD instance,
+// lxc.payload.<name> since LXD 4.0 and lxc/<name> before
+func lxdPayloadProcesses(name string) []int {
+	return cgroupProcesses(func(cgroup string) bool {
+		for _, line := range strings.Split(cgroup, "\n") {
+			components := strings.Split(line, "/")
+			for i, component := range components {
+				if component == "lxc.payload."+name || (component == name && i > 0 && components[i-1] == "lxc") {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// lxdTargets returns the processes an lxd:<name> target jails, the ones of the payload
+// cgroup of the instance whose parent is outside of it
+func lxdTargets(name string) ([]int, error) {
+	if name == "" || strings.ContainsAny(name, "/\n") {
+		return nil, fmt.Errorf("invalid target lxd:%s, expected lxd:<instance name>", name)
+	}
+	pid, err := lxdInitProcess(name)
+	if err != nil {
+		return nil, err
+	}
+	pids := lxdPayloadProcesses(name)
+	if len(pids) == 0 {
+		// Virtual machines run outside of a payload cgroup
+		pids = []int{pid}
+	}
+	roots := rootProcesses(pids)
+	fmt.Printf("LXD instance %s: %d processes, jailing %d of them with their descendants\n", name, len(pids), len(roots))
+	return roots, nil
+}
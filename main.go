@@ -1,25 +1,153 @@
 package main
 
 import (
+	"bufio"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/chzyer/readline"
+	"golang.org/x/sys/unix"
 )
 
 // Jail represents an active quarantine
 type Jail struct {
-	PID            int
-	OriginalCgroup string
-	JailTypes      []string // "network", "cpu", etc.
-	Timestamp      time.Time
-	Children       []int
+	PID               int
+	Name              string         // Process name when jailed, kept once the process is gone
+	OriginalCgroup    string         // Cgroup of the main process before it was jailed
+	OriginalCgroups   map[int]string // Cgroup of each process before a cgroup-based jail moved it
+	JailTypes         []string       // "network", "cpu", etc.
+	Timestamp         time.Time
+	Children          []int
+	CpuPercent        int                            // Custom CPU limit, 0 for the shared 1% jail
+	Squeeze           *cpuSqueeze                    // Progressive tightening down to CpuPercent, nil once reached
+	Adaptive          *adaptiveCpu                   // CPU limit adjusted up to CpuPercent to the host utilization, nil for a fixed limit
+	CpuWeight         int                            // cpu.weight of a proportional CPU jail instead of a limit, 0 without
+	CpuBurst          time.Duration                  // CPU time saved from idle periods and spent over the quota, 0 without
+	Command           []string                       // Command line of processes started with run
+	Reason            string                         // Why the process was jailed, given with --reason
+	JailedBy          string                         // Operator who created the jail
+	Persistent        bool                           // Kept when jailer exits with -keep-jails-on-exit, ephemeral otherwise
+	ExpiresAt         time.Time                      // Released automatically at this time, zero until unjailed
+	Executable        string                         // Executable of the main process, matched by jailer restore
+	Unit              string                         // systemd service of the main process, matched by jailer restore
+	LaunchProfiles    map[string]string              // Profiles of the syscall, landlock and readonly jails
+	Rlimits           map[string]uint64              // Requested limits for the rlimit jail
+	RdmaLimits        map[string]uint64              // HCA limits of the rdma jail, keyed by "<device>:<resource>"
+	MiscLimits        map[string]uint64              // Limits of the misc jail, keyed by resource
+	MemoryLimit       uint64                         // Byte limit of the memory jail
+	QuotaBytes        uint64                         // Byte limit of the quota jail
+	QuotaDirs         []string                       // Directories assigned to the project of the quota jail
+	SavedProjects     map[string]savedProject        // Original project of each quota directory and of the files charged to it
+	SessionRules      []insertedRule                 // Rules keeping the sessions open when the network jail was applied
+	AllowRules        []insertedRule                 // Rules accepting the allowlist sets of the network jail
+	ClassID           string                         // net_cls classid of the network jail on cgroups v1, empty when it shares the jail one
+	NetworkCgroup     string                         // Cgroup matched by the network jail rules on cgroups v2, empty when it shares the jail one
+	DropRules         []insertedRule                 // Rules dropping the traffic of the own classid or cgroup of the network jail
+	AllowedIfaces     []string                       // Interfaces the network jail leaves reachable
+	IfaceRules        []insertedRule                 // Rules accepting the traffic on the allowed interfaces
+	BlockedCountries  []string                       // Countries the network jail drops the traffic with, the rest goes through
+	AllowedCountries  []string                       // Only countries the network jail accepts the traffic with
+	CountryRules      []insertedRule                 // Rules on the country sets of the network jail
+	BlocklistRules    []insertedRule                 // Rules dropping the networks of the blocklist feeds for the network jail
+	OomGroup          bool                           // memory.oom.group set on the dedicated cgroup, the OOM killer takes the whole tree
+	CgroupPath        string                         // Dedicated cgroup nested below the original cgroup on cgroups v2, empty at the top level
+	NetNamespace      string                         // Network namespace of a container the network jail rules were installed in
+	SavedRlimits      map[int]map[string]unix.Rlimit // Original limits of each jailed PID
+	SavedOomScores    map[int]int                    // Original oom_score_adj of each jailed PID
+	SavedCoreDumps    map[int]savedCoreDump          // Original core dump settings of each jailed PID
+	FailedDescendants map[int]string                 // Descendants a jail type couldn't be applied to, with the type and error
+}
+
+// newJail creates the jail entry of a process
+func newJail(pid int, originalCgroup string) *Jail {
+	return &Jail{
+		PID:             pid,
+		Name:            hostProcesses.name(pid),
+		OriginalCgroup:  originalCgroup,
+		OriginalCgroups: map[int]string{pid: originalCgroup},
+		Executable:      getProcessExecutable(pid),
+		Unit:            cgroupServiceUnit(originalCgroup),
+		Timestamp:       time.Now(),
+		LaunchProfiles:  make(map[string]string),
+		SavedRlimits:    make(map[int]map[string]unix.Rlimit),
+		SavedOomScores:  make(map[int]int),
+		SavedCoreDumps:  make(map[int]savedCoreDump),
+	}
+}
+
+// usesDedicatedCgroup checks if the processes of a jail live in the dedicated cgroup of
+// the jail, needed for custom CPU limits, for rdma, misc and memory limits, for the rules of the
+// network jail on cgroups v2, for memory.oom.group and for every cgroup-based type once
+// it is nested
+func (j *Jail) usesDedicatedCgroup() bool {
+	return (j.HasJailType("cpu") && (j.CpuPercent > 0 || j.CpuWeight > 0 || j.CpuBurst > 0)) || j.HasJailType("rdma") || j.HasJailType("misc") ||
+		j.HasJailType("memory") || j.NetworkCgroup != "" || ((j.CgroupPath != "" || j.OomGroup) && j.HasCgroupJailTypes())
+}
+
+// clearJailTypeLimits drops the limits requested for a jail type that was removed
+func (j *Jail) clearJailTypeLimits(jailType string) {
+	switch jailType {
+	case "rlimit":
+		j.Rlimits = nil
+	case "cpu":
+		j.CpuPercent = 0
+		j.Squeeze = nil
+		j.Adaptive = nil
+		j.CpuWeight = 0
+		j.CpuBurst = 0
+	case "rdma":
+		j.RdmaLimits = nil
+	case "misc":
+		j.MiscLimits = nil
+	case "memory":
+		j.MemoryLimit = 0
+	case "quota":
+		j.QuotaBytes = 0
+		j.QuotaDirs = nil
+	}
+}
+
+// originalCgroupOf returns the cgroup a process was in before it was jailed, descendants
+// may come from other cgroups than the main process
+func (j *Jail) originalCgroupOf(pid int) string {
+	savedSettingsMutex.Lock()
+	defer savedSettingsMutex.Unlock()
+
+	if originalCgroup, exists := j.OriginalCgroups[pid]; exists {
+		return originalCgroup
+	}
+	return j.OriginalCgroup
+}
+
+// saveOriginalCgroup records the cgroup of a process before it is moved the first time
+func (j *Jail) saveOriginalCgroup(state *JailerState, pid int) error {
+	savedSettingsMutex.Lock()
+	_, exists := j.OriginalCgroups[pid]
+	savedSettingsMutex.Unlock()
+	if exists {
+		return nil
+	}
+
+	originalCgroup, err := state.Limits.processGroup(pid)
+	if err != nil {
+		return err
+	}
+
+	savedSettingsMutex.Lock()
+	j.OriginalCgroups[pid] = originalCgroup
+	savedSettingsMutex.Unlock()
+	return nil
 }
 
 // HasJailType checks if the jail has a specific type
@@ -47,6 +175,21 @@ func (j *Jail) RemoveJailType(jailType string) {
 			break
 		}
 	}
+	for pid, failure := range j.FailedDescendants {
+		if strings.HasPrefix(failure, jailType+": ") {
+			delete(j.FailedDescendants, pid)
+		}
+	}
+}
+
+// HasCgroupJailTypes checks if the jail has at least one cgroup-based type
+func (j *Jail) HasCgroupJailTypes() bool {
+	for _, t := range j.JailTypes {
+		if isCgroupJailType(t) {
+			return true
+		}
+	}
+	return false
 }
 
 // GetJailTypesString returns a comma-separated string of jail types
@@ -57,6 +200,22 @@ func (j *Jail) GetJailTypesString() string {
 	return strings.Join(j.JailTypes, ",")
 }
 
+// JailOptions contains the flags given to a jail command
+type JailOptions struct {
+	Reason           string        // Free-form explanation stored with the jail
+	AllowEstablished bool          // Keep the sessions open when the network jail is applied
+	AllowIfaces      []string      // Interfaces the network jail leaves reachable
+	BlockCountries   []string      // Countries the network jail drops the traffic with
+	AllowCountries   []string      // Only countries the network jail accepts the traffic with
+	Persistent       bool          // Keep the jail when jailer exits with -keep-jails-on-exit
+	For              time.Duration // Release the jail automatically after it, 0 keeps it until unjailed
+	SqueezeOver      time.Duration // Time the CPU limit takes to tighten down to its value, 0 applies it at once
+	AdaptiveTarget   int           // Host utilization the CPU limit adapts to stay under, 0 for a fixed limit
+	CpuBurst         time.Duration // CPU time the jail may spend over its quota after idle periods, 0 without
+	OomGroup         bool          // The OOM killer kills the whole tree together, needs a cgroup of its own
+	Verbose          bool          // List every descendant the jail failed on instead of a summary
+}
+
 // JailerState contains the global application state
 type JailerState struct {
 	ActiveJails          map[int]*Jail
@@ -65,45 +224,254 @@ type JailerState struct {
 	NetworkCpuCgroupPath string // Network and CPU combined jail cgroup path
 	CgroupVersion        int    // 1 or 2
 	FirewallTool         string // "nftables" or "iptables"
+	Config               *Config
+	History              []JailRecord                    // Jails that ended during this session
+	Operations           []operation                     // Jail and unjail commands that can be undone
+	Inventory            *inventoryPublisher             // Publishes the jails to the clustered store, nil without one
+	Operator             string                          // Who runs the current command, recorded in jails and audit events
+	Output               io.Writer                       // Where the current command prints, stdout when nil
+	StatePath            string                          // File the jails are saved to for recovery, empty when not saved
+	Store                stateStore                      // Keeps the saved jails, the audit events, the history and the usage samples
+	Limits               limitBackend                    // Moves the processes to the limits of the network, proxy, cpu, memory, rdma and misc jails
+	Resources            resourceBackend                 // Sets the rlimit, oom and coredump jails on the processes
+	Quotas               quotaBackend                    // Charges the writes of the quota jails to their disk quota
+	Firewall             firewallBackend                 // Installs the rules of the network and proxy jails
+	NetNamespaces        map[string]*jailNetNamespace    // Container network namespaces holding network jail rules
+	DisabledJailTypes    map[string]string               // Jail types unusable on this host, with the reason
+	SetupFailures        map[string]string               // Jail types whose setup failed at startup, with the error
+	KeepJailsOnExit      bool                            // Leave the persistent jails in place when jailer exits
+	PersistentJailsPath  string                          // File the persistent jails are saved to for jailer restore, empty when not saved
+	PendingPersistent    []persistentJail                // Persistent jails jailer restore found no process for yet
+	Schedules            []*jailSchedule                 // Jail types applied only within a window
+	BlocklistFeeds       map[string]*blocklistFeedStatus // Freshness of the blocklist feeds, nil until their sets are loaded
+	BlocklistRules       []insertedRule                  // Rules dropping the networks of the blocklist feeds for every process
 }
 
 // NewJailerState creates a new instance of the jailer state
 func NewJailerState() *JailerState {
-	return &JailerState{
-		ActiveJails: make(map[int]*Jail),
+	state := &JailerState{
+		ActiveJails:   make(map[int]*Jail),
+		Config:        newDefaultConfig(),
+		NetNamespaces: make(map[string]*jailNetNamespace),
+	}
+	state.Store = &fileStore{state: state}
+	setupBackends(state)
+	return state
+}
+
+// stateMutex serializes the commands, the scheduler, the monitors and the cleanup, the
+// jailer state isn't safe for concurrent use
+var stateMutex sync.Mutex
+
+// commandLocked is set while a command of the prompt runs with stateMutex held
+var commandLocked atomic.Bool
+
+// stdout returns where the current command prints
+func (s *JailerState) stdout() io.Writer {
+	if s.Output != nil {
+		return s.Output
 	}
+	return os.Stdout
+}
+
+// commandContext is who runs the commands and where they print outside of executeLockedAs,
+// put back in the state while a command waits unlocked
+var commandContext struct {
+	operator string
+	output   io.Writer
+}
+
+// executeLocked runs a command line with the state locked and publishes the jails it
+// changed, the scheduler and the monitors change the jails beside the prompt
+func executeLocked(state *JailerState, input string) error {
+	return executeLockedAs(state, input, state.Operator, state.Output)
+}
+
+// executeLockedAs runs a command line like executeLocked on behalf of another operator,
+// e.g. a controller, printing to output instead of stdout when it isn't nil
+func executeLockedAs(state *JailerState, input, operator string, output io.Writer) error {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	commandLocked.Store(true)
+	defer commandLocked.Store(false)
+
+	commandContext.operator, commandContext.output = state.Operator, state.Output
+	state.Operator, state.Output = operator, output
+	defer func() { state.Operator, state.Output = commandContext.operator, commandContext.output }()
+
+	err := executeCommand(state, input)
+	publishInventory(state)
+	return err
+}
+
+// waitUnlocked releases the state while a command waits on the terminal, a timer or the
+// network, so that the monitors keep running and SIGTERM still cleans up. The operator
+// and the output of the command are put aside meanwhile
+func waitUnlocked(state *JailerState, wait func()) {
+	if !commandLocked.Load() {
+		wait()
+		return
+	}
+	operator, output := state.Operator, state.Output
+	state.Operator, state.Output = commandContext.operator, commandContext.output
+	commandLocked.Store(false)
+	stateMutex.Unlock()
+	defer func() {
+		stateMutex.Lock()
+		commandLocked.Store(true)
+		state.Operator, state.Output = operator, output
+	}()
+	wait()
+}
+
+// cleanupLocked cleans up with the state locked, the monitors may still be running
+func cleanupLocked(state *JailerState) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	cleanup(state)
+}
+
+// interruptState lets a long-running command catch Ctrl+C instead of exiting jailer
+var interruptState struct {
+	sync.Mutex
+	interrupted chan struct{}
+}
+
+// startInterruptible marks the start of a command that stops on Ctrl+C and returns the
+// channel closed on interruption, the returned function must be called when it ends. A
+// command started by another one, e.g. a jail of a script, shares its channel
+func startInterruptible() (<-chan struct{}, func()) {
+	interruptState.Lock()
+	defer interruptState.Unlock()
+
+	if interruptState.interrupted != nil {
+		return interruptState.interrupted, func() {}
+	}
+	interrupted := make(chan struct{})
+	interruptState.interrupted = interrupted
+
+	return interrupted, func() {
+		interruptState.Lock()
+		if interruptState.interrupted == interrupted {
+			interruptState.interrupted = nil
+		}
+		interruptState.Unlock()
+	}
+}
+
+// currentInterrupt returns the channel of the running interruptible command, nil when
+// there is none
+func currentInterrupt() <-chan struct{} {
+	interruptState.Lock()
+	defer interruptState.Unlock()
+	return interruptState.interrupted
+}
+
+// interruptCommand interrupts the running interruptible command, if any
+func interruptCommand() bool {
+	interruptState.Lock()
+	defer interruptState.Unlock()
+
+	if interruptState.interrupted == nil {
+		return false
+	}
+	close(interruptState.interrupted)
+	interruptState.interrupted = nil
+	return true
 }
 
 // createReadlineConfig creates the readline configuration with autocompletion
-func createReadlineConfig() *readline.Config {
+func createReadlineConfig(state *JailerState) *readline.Config {
 	return &readline.Config{
-		Prompt:      "$> ",
-		HistoryFile: "/tmp/jailer_history",
-		AutoComplete: readline.NewPrefixCompleter(
-			readline.PcItem("help"),
-			readline.PcItem("jail",
-				readline.PcItem("network"),
-				readline.PcItem("n"),
-				readline.PcItem("cpu"),
-				readline.PcItem("c"),
-				readline.PcItem("both"),
-			),
-			readline.PcItem("unjail",
-				readline.PcItem("network"),
-				readline.PcItem("n"),
-				readline.PcItem("cpu"),
-				readline.PcItem("c"),
-			),
-			readline.PcItem("list"),
-			readline.PcItem("exit"),
-			readline.PcItem("quit"),
-		),
+		Prompt:          promptText(state),
+		HistoryFile:     "/tmp/jailer_history",
+		AutoComplete:    &jailerCompleter{state: state, keywords: commandCompleter()},
 		InterruptPrompt: "^C",
 		EOFPrompt:       "exit",
 	}
 }
 
 func main() {
+	// Launcher stage of a command started by jailer, see launcher.go
+	if len(os.Args) > 1 && os.Args[1] == launcherArg {
+		runLauncher()
+	}
+	// Throwaway process of the self-test, see selftest.go
+	if len(os.Args) > 1 && os.Args[1] == selftestArg {
+		runSelftestHelper(os.Args[2:])
+	}
+	// The jails go through the backends of the host, see backend.go
+	if hostProcesses == nil {
+		fmt.Printf("Error: jailer has no backend for %s\n", runtime.GOOS)
+		os.Exit(1)
+	}
+	initSystemd()
+
+	configPath := flag.String("config", defaultConfigPath, "path to the JSON configuration file")
+	controllerMode := flag.Bool("controller", false, "run as the controller of remote agents instead of jailing locally")
+	listenAddr := flag.String("listen", "", "address the controller accepts agents on (with -controller)")
+	agentAddr := flag.String("agent", "", "run as an agent connecting to the controller at this address")
+	agentListenAddr := flag.String("agent-listen", "", "run as an agent accepting controller connections on this address")
+	agentName := flag.String("name", "", "name of this host reported to the controller (default: hostname)")
+	sshTarget := flag.String("host", "", "run the command on user@host over SSH instead of locally")
+	remoteJailer := flag.String("remote-jailer", "jailer", "path of jailer on the hosts reached with -host")
+	auditEvents := flag.String("audit-events", "", "jail the processes of audit events matching audit_rules, read from this audisp socket, e.g. "+defaultAuditEventsSocket+" (- for stdin)")
+	webhookListen := flag.String("webhook-listen", "", "jail the targets of the alerts POSTed to /alert on this address with the webhook profiles")
+	eventsListen := flag.String("events-listen", "", "stream the jail events as Server-Sent Events on /events on this address")
+	healthListen := flag.String("health-listen", "", "serve /healthz and /readyz on this address, they are also on -webhook-listen and -events-listen")
+	debugListen := flag.String("debug-listen", "", "serve net/http/pprof on /debug/pprof/ at this loopback address, e.g. 127.0.0.1:6060")
+	keepJailsOnExit := flag.Bool("keep-jails-on-exit", false, "only release the ephemeral jails on exit, the persistent ones stay for the next jailer")
+	reconcilePath := flag.String("reconcile", "", "keep the jails in line with this desired-state file, releasing the ones no longer listed")
+	reconcileInterval := flag.Duration("reconcile-interval", defaultReconcileInterval, "time between two reconciliations of the desired state")
+	errorFormatFlag := flag.String("error-format", "text", "report the failed commands as text on stdout or as JSON lines on stderr (text|json)")
+	flag.Parse()
+
+	var err error
+	if errorFormat, err = parseErrorFormat(*errorFormatFlag); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(2)
+	}
+	if *debugListen != "" {
+		if err := validateDebugAddress(*debugListen); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	// Shell completion scripts are generated without root or configuration
+	if flag.Arg(0) == "completion" {
+		os.Exit(printShellCompletion(flag.Args()[1:]))
+	}
+
+	// Hosts without an agent are reached over SSH, the remote jailer does the work
+	if *sshTarget != "" {
+		os.Exit(runOverSSH(*sshTarget, *remoteJailer, flag.Args()))
+	}
+
+	// Load the configuration, the default path is optional
+	configExplicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			configExplicit = true
+		}
+	})
+	config, err := loadConfig(*configPath, configExplicit)
+	if err != nil {
+		fmt.Printf("Error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The event stream is read from the jailer serving it, without privileges
+	if flag.Arg(0) == "events" {
+		os.Exit(runEventsClient(config, flag.Args()[1:]))
+	}
+
+	// The controller only forwards commands, it needs no privileges
+	if *controllerMode {
+		runController(config, *listenAddr)
+		return
+	}
+
 	// Check root privileges
 	if os.Geteuid() != 0 {
 		fmt.Println("Error: This tool requires root privileges")
@@ -111,57 +479,273 @@ func main() {
 		os.Exit(1)
 	}
 
+	initTracing(&config.Tracing)
+	firewallTimeout, _ = parseFirewallTimeout(config.FirewallTimeout)
+
 	// Initialize jailer state
 	state := NewJailerState()
+	state.Config = config
+	state.Operator = localOperator()
+	// jailer restore without a checkpoint directory re-creates the persistent jails at boot
+	bootRestore := flag.NArg() == 1 && flag.Arg(0) == "restore"
+	state.KeepJailsOnExit = *keepJailsOnExit || bootRestore
+	switch {
+	case config.StateFile == "off":
+		if state.KeepJailsOnExit {
+			fmt.Println("Warning: state_file is off, the jails kept on exit can't be recovered by the next jailer")
+		}
+	case config.StateFile != "":
+		state.StatePath = config.StateFile
+	case systemdService.started || state.KeepJailsOnExit:
+		state.StatePath = defaultStateFile
+	default:
+		// The jails kept by a previous jailer are recovered even without -keep-jails-on-exit
+		if _, err := os.Stat(defaultStateFile); err == nil {
+			state.StatePath = defaultStateFile
+		}
+	}
+	switch config.Persist.JailsFile {
+	case "off":
+	case "":
+		state.PersistentJailsPath = defaultPersistentJailsFile
+	default:
+		state.PersistentJailsPath = config.Persist.JailsFile
+	}
+	if *agentName == "" {
+		*agentName, _ = os.Hostname()
+	}
+	if state.Store, err = openStateStore(state, *agentName); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if config.Store.Type == "sqlite" || config.Store.Type == "kv" {
+		// The database or the clustered store holds the saved jails, the paths only tell
+		// that they are saved and where
+		location := config.Store.Path
+		if store, ok := state.Store.(*kvStore); ok {
+			location = store.location
+		}
+		if config.StateFile != "off" {
+			state.StatePath = location
+		}
+		if state.PersistentJailsPath != "" {
+			state.PersistentJailsPath = location
+		}
+	}
 
 	// Initialize cgroups
-	if err := initializeCgroup(state); err != nil {
+	if err := state.Limits.setup(); err != nil {
 		fmt.Printf("Error initializing cgroups: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Detect available firewall tool
-	firewallTool, err := detectFirewallTool()
+	// Detect available firewall tool, without one the network jails are disabled
+	firewallTool, err := state.Firewall.detect()
 	if err != nil {
-		fmt.Printf("Error detecting firewall tool: %v\n", err)
-		os.Exit(1)
+		fmt.Printf("Warning: %v\n", err)
 	}
 	state.FirewallTool = firewallTool
 
-	// Initialize network filtering on startup
-	fmt.Println("Setting up network filtering rules...")
-	if err := setupNetworkJail(state); err != nil {
-		fmt.Printf("Error setting up network jail: %v\n", err)
-		os.Exit(1)
+	// Disable the jail types the host can't enforce instead of failing when they are used
+	checkCapabilities(state)
+
+	// A jailer killed without its cleanup, e.g. by the watchdog, left its jails and rules in
+	// place, they are taken over instead of being set up again
+	recovered, err := recoverJailState(state)
+	if err != nil {
+		fmt.Printf("Warning: %v, starting without the previous jails\n", err)
+	}
+	if state.PendingPersistent, err = loadPersistentJails(state); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	if recovered && state.Firewall.rulesPresent() {
+		fmt.Println("Keeping the network filtering rules of the previous jailer")
+	} else if checkJailTypeEnabled(state, "network") == nil {
+		state.BlocklistRules = nil
+		// Initialize network filtering on startup
+		fmt.Println("Setting up network filtering rules...")
+		if err := state.Firewall.setup(); err != nil {
+			disableJailType(state, "network", err)
+			disableJailType(state, "proxy", err)
+		} else if config.NetworkProxy != "" {
+			if err := state.Firewall.setupProxy(); err != nil {
+				disableJailType(state, "proxy", err)
+			}
+		}
+	}
+
+	if blocklistsEnabled(state) {
+		if err := setupBlocklists(state); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
 	}
 
 	// Configure signal handling for clean shutdown
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		<-sigChan
-		fmt.Println("\nReceived interrupt signal, cleaning up...")
-		cleanup(state)
-		os.Exit(0)
+		for sig := range sigChan {
+			// Ctrl+C only stops the running command when it can be interrupted
+			if sig == syscall.SIGINT && interruptCommand() {
+				continue
+			}
+			fmt.Println("\nReceived interrupt signal, cleaning up...")
+			stateMutex.Lock()
+			cleanup(state)
+			os.Exit(0)
+		}
 	}()
 
+	// Publish the jails of this host when a clustered store is configured
+	if state.Inventory, err = newInventoryPublisher(config.StateBackend, *agentName); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		cleanupLocked(state)
+		os.Exit(1)
+	}
+	publishInventory(state)
+
+	if bootRestore {
+		stateMutex.Lock()
+		os.Exit(runBootRestore(state))
+	}
+
+	// systemd starts the units depending on jailer once it is ready to jail
+	if err := sdNotify(fmt.Sprintf("READY=1\nSTATUS=%d jails", len(state.ActiveJails))); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	if systemdService.watchdog > 0 {
+		go runWatchdog()
+	}
+	if config.ThrottleAlert.Percent > 0 {
+		go runThrottleMonitor(state)
+	}
+	memoryEventsMonitored := len(config.Notifications.Webhooks) > 0 || len(config.Notifications.Command) > 0
+	if memoryEventsMonitored {
+		go runMemoryEventsMonitor(state)
+	}
+	if config.Statsd.Address != "" {
+		go runStatsdEmitter(state)
+	}
+	if config.Store.samples > 0 {
+		go runUsageRecorder(state)
+	}
+	go runStateDumper(state)
+	go runStackDumper()
+	go runJailScheduler(state)
+	go runExpiryMonitor(state)
+	go runSqueezeMonitor(state)
+	go runAdaptiveMonitor(state)
+	if state.BlocklistFeeds != nil {
+		go runBlocklistRefresher(state)
+	}
+	if *healthListen != "" {
+		go func() {
+			fmt.Printf("Error: %v\n", runHealthListener(state, *healthListen))
+		}()
+	}
+	if *debugListen != "" {
+		go func() {
+			fmt.Printf("Error: %v\n", runDebugListener(*debugListen))
+		}()
+	}
+
+	// Audit events, alerts, the desired state and the event stream are handled beside an
+	// agent, or on their own instead of a prompt
+	responderDone := make(chan struct{}, 4)
+	if *auditEvents != "" {
+		go func() {
+			runAuditResponder(state, *auditEvents)
+			responderDone <- struct{}{}
+		}()
+	}
+	if *webhookListen != "" {
+		go func() {
+			if err := runWebhookListener(state, *webhookListen); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			responderDone <- struct{}{}
+		}()
+	}
+	if *eventsListen != "" {
+		go func() {
+			if err := runEventsListener(state, *eventsListen); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			responderDone <- struct{}{}
+		}()
+	}
+	if *reconcilePath != "" {
+		go func() {
+			if err := runReconciler(state, *reconcilePath, *reconcileInterval); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			responderDone <- struct{}{}
+		}()
+	}
+	if (*auditEvents != "" || *webhookListen != "" || *eventsListen != "" || *reconcilePath != "") && *agentAddr == "" && *agentListenAddr == "" {
+		<-responderDone
+		cleanupLocked(state)
+		os.Exit(1)
+	}
+
+	// Agents are driven by the controller instead of a prompt
+	if *agentAddr != "" || *agentListenAddr != "" {
+		if *agentListenAddr != "" {
+			if err := runAgentListener(state, *agentListenAddr, *agentName); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		} else {
+			runAgent(state, *agentAddr, *agentName)
+		}
+		cleanupLocked(state)
+		os.Exit(1)
+	}
+
+	// jailer tui replaces the prompt with the dashboard
+	if flag.NArg() == 1 && flag.Arg(0) == "tui" {
+		err := runDashboard(state)
+		cleanupLocked(state)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// A command given on the command line runs once instead of the prompt
+	if flag.NArg() > 0 {
+		os.Exit(runOneShot(state, flag.Args()))
+	}
+
+	// Commands piped on stdin run without readline, e.g. echo "jail network 1234" | jailer
+	if !readline.IsTerminal(int(os.Stdin.Fd())) {
+		status := runPipedCommands(state, os.Stdin)
+		keepPipedJails(state)
+		cleanupLocked(state)
+		os.Exit(status)
+	}
+
 	fmt.Println("Jailer Tool v1.0")
 	fmt.Println("Type 'help' for available commands or 'exit' to quit")
 	fmt.Println("Use Tab for autocompletion, Up/Down arrows for history")
 	fmt.Println()
 
 	// Create readline instance with configuration
-	rl, err := readline.NewEx(createReadlineConfig())
+	rl, err := readline.NewEx(createReadlineConfig(state))
 	if err != nil {
 		fmt.Printf("Error creating readline interface: %v\n", err)
-		cleanup(state)
+		cleanupLocked(state)
 		os.Exit(1)
 	}
 	defer rl.Close()
 
-	// Handle SIGINT for readline
-	rl.CaptureExitSignal()
+	// The prompt shows the exits, escapes and OOM kills found in the background
+	go runEventsWatcher(state)
+	if !memoryEventsMonitored {
+		go runMemoryEventsMonitor(state)
+	}
+	go runPromptRefresher(state, rl)
 
 	// Main prompt loop
 	for {
@@ -188,13 +772,124 @@ func main() {
 		}
 
 		// Parse and execute command
-		if err := executeCommand(state, input); err != nil {
-			fmt.Printf("Error: %v\n", err)
+		if err := executeLocked(state, input); err != nil {
+			reportError(input, 0, err)
 		}
+		rl.SetPrompt(promptText(state))
 	}
 
 	// Cleanup before exit
-	cleanup(state)
+	cleanupLocked(state)
+}
+
+// runOneShot executes a command given on the command line, its jails are kept until
+// Ctrl+C or the end of the input since they are released when jailer exits. It returns
+// the exit code of jailer
+func runOneShot(state *JailerState, args []string) int {
+	// A single argument is a whole command line, possibly with several commands
+	input := quoteCommand(args)
+	if len(args) == 1 {
+		input = args[0]
+	}
+
+	err := executeLocked(state, input)
+	if err != nil {
+		reportError(input, 0, err)
+	}
+
+	stateMutex.Lock()
+	jails := len(state.ActiveJails)
+	stateMutex.Unlock()
+	if jails > 0 {
+		fmt.Printf("Keeping %d jails until Ctrl+C or the end of the input\n", jails)
+		io.Copy(io.Discard, os.Stdin)
+	}
+	cleanupLocked(state)
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// pipedUnavailableCommands need a terminal, or redraw the screen until Ctrl+C
+var pipedUnavailableCommands = []string{"watch", "top", "pick"}
+
+// runPipedCommands runs the commands read from a pipe or a file line by line, without
+// readline and without prompting. A failed command doesn't stop the following ones but
+// makes the exit status 1. Empty lines and lines starting with # are skipped, and exit or
+// quit stops reading
+func runPipedCommands(state *JailerState, input io.Reader) int {
+	status := 0
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if commands, err := splitCommands(line); err == nil && len(commands) == 1 && len(commands[0]) == 1 &&
+			(commands[0][0] == "exit" || commands[0][0] == "quit") {
+			break
+		}
+
+		err := checkPipedCommands(line)
+		if err == nil {
+			err = executeLocked(state, line)
+		}
+		if err != nil {
+			reportError(line, number, err)
+			status = 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("Error: failed to read the commands: %v\n", err)
+		status = 1
+	}
+	return status
+}
+
+// checkPipedCommands refuses a line of piped commands when one of its commands needs a
+// terminal, the line isn't run at all. Lines that don't split are left to executeCommand
+func checkPipedCommands(line string) error {
+	commands, err := splitCommands(line)
+	if err != nil {
+		return nil
+	}
+	for _, command := range commands {
+		if len(command) > 0 && slices.Contains(pipedUnavailableCommands, command[0]) {
+			return fmt.Errorf("%s needs a terminal, it isn't available to piped commands", command[0])
+		}
+	}
+	return nil
+}
+
+// keepPipedJails keeps the jails of the piped commands once their input ended, since they
+// are released when jailer exits, until Ctrl+C or until they are all released, e.g. by
+// their expiry
+func keepPipedJails(state *JailerState) {
+	stateMutex.Lock()
+	jails := len(state.ActiveJails)
+	stateMutex.Unlock()
+	if jails == 0 {
+		return
+	}
+	fmt.Printf("Keeping %d jails until Ctrl+C or their release\n", jails)
+
+	interrupted, done := startInterruptible()
+	defer done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for jails > 0 {
+		select {
+		case <-interrupted:
+			return
+		case <-ticker.C:
+		}
+		stateMutex.Lock()
+		jails = len(state.ActiveJails)
+		stateMutex.Unlock()
+	}
 }
 
 // normalizeJailType converts short forms to full jail type names
@@ -209,124 +904,345 @@ func normalizeJailType(jailType string) string {
 	}
 }
 
-// executeCommand parses and executes a user command
+// executeCommand parses and executes a user command line, which may contain several
+// commands separated by semicolons
 func executeCommand(state *JailerState, input string) error {
-	parts := strings.Fields(input)
-	if len(parts) == 0 {
-		return nil
+	commands, err := splitCommands(input)
+	if err != nil {
+		return err
+	}
+	if len(commands) == 1 {
+		return executeParts(state, commands[0])
 	}
 
-	command := strings.ToLower(parts[0])
+	// Like a shell, a failed command doesn't stop the following ones
+	failed := 0
+	for _, parts := range commands {
+		fmt.Fprintf(state.stdout(), "> %s\n", strings.Join(parts, " "))
+		if err := executeParts(state, parts); err != nil {
+			reportError(quoteCommand(parts), 0, err)
+			failed++
+		}
+	}
 
-	switch command {
-	case "help":
-		showHelp()
-	case "exit", "quit":
-		fmt.Println("Cleaning up and exiting...")
-		cleanup(state)
-		os.Exit(0)
-	case "list":
-		listJails(state)
-	case "jail":
-		if len(parts) < 3 {
-			return fmt.Errorf("usage: jail <type> <pid>")
-		}
-		jailType := normalizeJailType(strings.ToLower(parts[1]))
-		if jailType == "both" {
-			// Apply both network and CPU jails
-			pid := parts[2]
-			if err := jailProcess(state, "network", pid); err != nil {
-				return fmt.Errorf("failed to apply network jail: %v", err)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d commands failed", failed, len(commands))
+	}
+	return nil
+}
+
+// splitCommands splits a command line into commands separated by unquoted semicolons
+// and each command into words, honoring single and double quotes and backslash escapes
+func splitCommands(input string) ([][]string, error) {
+	var commands [][]string
+	var words []string
+	var current strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, r := range input {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
 			}
-			if err := jailProcess(state, "cpu", pid); err != nil {
-				return fmt.Errorf("failed to apply CPU jail: %v", err)
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, current.String())
+				current.Reset()
+				inWord = false
 			}
-			return nil
+		case r == ';':
+			if inWord {
+				words = append(words, current.String())
+				current.Reset()
+				inWord = false
+			}
+			if len(words) > 0 {
+				commands = append(commands, words)
+				words = nil
+			}
+		default:
+			current.WriteRune(r)
+			inWord = true
 		}
-		return jailProcess(state, jailType, parts[2])
-	case "unjail":
-		if len(parts) < 2 {
-			return fmt.Errorf("usage: unjail <pid> or unjail <type> <pid>")
-		}
-		if len(parts) == 2 {
-			// unjail <pid> - remove all jails
-			return unjailProcess(state, parts[1])
-		} else if len(parts) == 3 {
-			// unjail <type> <pid> - remove specific jail type
-			jailType := normalizeJailType(strings.ToLower(parts[1]))
-			return unjailProcessSelective(state, jailType, parts[2])
-		} else {
-			return fmt.Errorf("usage: unjail <pid> or unjail <type> <pid>")
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in command")
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in command")
+	}
+	if inWord {
+		words = append(words, current.String())
+	}
+	if len(words) > 0 {
+		commands = append(commands, words)
+	}
+
+	return commands, nil
+}
+
+// parseDuration parses a duration, accepting a "d" suffix for days on top of the
+// time.ParseDuration units
+func parseDuration(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		count, err := strconv.Atoi(days)
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("invalid duration: %s", value)
 		}
-	default:
-		return fmt.Errorf("unknown command: %s (type 'help' for available commands)", command)
+		return time.Duration(count) * 24 * time.Hour, nil
 	}
 
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+	return duration, nil
+}
+
+// supportedJailTypes lists the jail types accepted by the jail command
+var supportedJailTypes = []string{"network", "proxy", "cpu", "memory", "rlimit", "oom", "coredump", "rdma", "misc", "quota"}
+
+// isSupportedJailType checks if a jail type is supported
+func isSupportedJailType(jailType string) bool {
+	for _, t := range supportedJailTypes {
+		if t == jailType {
+			return true
+		}
+	}
+	return false
+}
+
+// isLaunchOnlyJailType checks if a jail type can only be applied by run, the process
+// has to set it up itself before exec
+func isLaunchOnlyJailType(jailType string) bool {
+	return jailType == "syscall" || jailType == "landlock" || jailType == "readonly"
+}
+
+// isCgroupJailType checks if a jail type is enforced through cgroup membership
+func isCgroupJailType(jailType string) bool {
+	return jailType == "network" || jailType == "proxy" || jailType == "cpu" || jailType == "memory" || jailType == "rdma" || jailType == "misc"
+}
+
+// savedSettingsMutex guards the saved settings of the jails, descendants are jailed and
+// released concurrently
+var savedSettingsMutex sync.Mutex
+
+// applyJailTypeToProcess enforces one jail type of the jail on a single process
+func applyJailTypeToProcess(state *JailerState, jail *Jail, jailType string, pid int) error {
+	switch jailType {
+	case "network", "proxy", "cpu", "memory", "rdma", "misc":
+		if err := jail.saveOriginalCgroup(state, pid); err != nil {
+			return err
+		}
+		// The target cgroup depends on all the cgroup-based types of the jail
+		return state.Limits.limit(jail, pid)
+	case "rlimit":
+		saved, err := state.Resources.limit(pid, jail.Rlimits)
+		if err != nil {
+			return err
+		}
+		savedSettingsMutex.Lock()
+		jail.SavedRlimits[pid] = saved
+		savedSettingsMutex.Unlock()
+	case "oom":
+		original, err := state.Resources.preferOomKill(pid)
+		if err != nil {
+			return err
+		}
+		savedSettingsMutex.Lock()
+		jail.SavedOomScores[pid] = original
+		savedSettingsMutex.Unlock()
+	case "coredump":
+		saved, err := state.Resources.suppressCoreDumps(pid)
+		if err != nil {
+			return err
+		}
+		savedSettingsMutex.Lock()
+		jail.SavedCoreDumps[pid] = saved
+		savedSettingsMutex.Unlock()
+	}
 	return nil
 }
 
-// showHelp displays help for available commands
-func showHelp() {
-	fmt.Println("Available commands:")
-	fmt.Println("  jail network <pid>  - Put process in network jail")
-	fmt.Println("  jail n <pid>        - Short form for network jail")
-	fmt.Println("  jail cpu <pid>      - Put process in CPU jail (1% limit)")
-	fmt.Println("  jail c <pid>        - Short form for CPU jail")
-	fmt.Println("  jail both <pid>     - Put process in both network and CPU jail")
-	fmt.Println("  unjail <pid>        - Remove all jails from process")
-	fmt.Println("  unjail <type> <pid> - Remove specific jail type from process")
-	fmt.Println("  list                - List active jails")
-	fmt.Println("  help                - Show this help")
-	fmt.Println("  exit                - Clean up and exit")
-	fmt.Println()
-	fmt.Println("Jail types:")
-	fmt.Println("  network/n           - Block network access")
-	fmt.Println("  cpu/c               - Limit CPU usage to 1% of one core")
-	fmt.Println("  both                - Apply both network and CPU jails")
-	fmt.Println()
-	fmt.Println("Enhanced features:")
-	fmt.Println("  Tab                 - Autocomplete commands")
-	fmt.Println("  Up/Down arrows      - Navigate command history")
-	fmt.Println("  Ctrl+A/Home         - Move cursor to beginning of line")
-	fmt.Println("  Ctrl+E/End          - Move cursor to end of line")
-	fmt.Println("  Ctrl+L              - Clear screen")
-	fmt.Println("  Ctrl+C              - Interrupt current input")
+// revertJailTypeOnProcess undoes one jail type on a single process, the type must
+// already be removed from the jail for cgroup-based types
+func revertJailTypeOnProcess(state *JailerState, jail *Jail, jailType string, pid int) error {
+	switch jailType {
+	case "network", "proxy", "cpu", "memory", "rdma", "misc":
+		return state.Limits.limit(jail, pid)
+	case "rlimit":
+		savedSettingsMutex.Lock()
+		saved, exists := jail.SavedRlimits[pid]
+		delete(jail.SavedRlimits, pid)
+		savedSettingsMutex.Unlock()
+		if !exists {
+			return nil
+		}
+		return state.Resources.restoreLimits(pid, saved)
+	case "oom":
+		savedSettingsMutex.Lock()
+		original, exists := jail.SavedOomScores[pid]
+		delete(jail.SavedOomScores, pid)
+		savedSettingsMutex.Unlock()
+		if !exists {
+			return nil
+		}
+		return state.Resources.restoreOomScore(pid, original)
+	case "coredump":
+		savedSettingsMutex.Lock()
+		saved, exists := jail.SavedCoreDumps[pid]
+		delete(jail.SavedCoreDumps, pid)
+		savedSettingsMutex.Unlock()
+		if !exists {
+			return nil
+		}
+		return state.Resources.restoreCoreDumps(pid, saved)
+	}
+	return nil
 }
 
-// listJails displays the list of active quarantines
-func listJails(state *JailerState) {
-	// Clean up dead processes before displaying
-	cleanupDeadProcesses(state)
+// releaseProcess undoes every jail type of the jail on a single process
+func releaseProcess(state *JailerState, jail *Jail, pid int) error {
+	var errors []string
 
-	if len(state.ActiveJails) == 0 {
-		fmt.Println("No active jails")
-		return
+	for _, jailType := range jail.JailTypes {
+		if isCgroupJailType(jailType) {
+			continue
+		}
+		if err := revertJailTypeOnProcess(state, jail, jailType, pid); err != nil {
+			errors = append(errors, err.Error())
+		}
 	}
 
-	fmt.Println("Active jails:")
-	fmt.Printf("%-8s %-12s %-15s %-10s %-20s\n", "PID", "Name", "Type", "Children", "Since")
-	fmt.Println(strings.Repeat("-", 75))
+	// Only touch the cgroup membership if the jail actually moved the process
+	if jail.HasCgroupJailTypes() {
+		if err := state.Limits.restore(pid, jail.originalCgroupOf(pid)); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
 
-	for pid, jail := range state.ActiveJails {
-		duration := time.Since(jail.Timestamp).Round(time.Second)
-		childrenCount := len(jail.Children)
-		processName := getProcessName(pid)
-		fmt.Printf("%-8d %-12s %-15s %-10d %-20s\n",
-			pid, processName, jail.GetJailTypesString(), childrenCount, duration.String())
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// reportDescendantErrors prints a single warning summarizing the descendants a jail type
+// couldn't be applied to, each one is listed with verbose. The failures are kept in the
+// jail for info
+func reportDescendantErrors(out io.Writer, jail *Jail, jailType string, total int, errs map[int]error, verbose bool) {
+	if len(errs) == 0 {
+		return
+	}
+	if jail.FailedDescendants == nil {
+		jail.FailedDescendants = make(map[int]string)
+	}
+	for pid, err := range errs {
+		jail.FailedDescendants[pid] = jailType + ": " + err.Error()
+	}
+	fmt.Fprintf(out, "Warning: failed to apply %s jail to %d of %d descendants: %s\n", jailType, len(errs), total,
+		summarizeProcessErrors(errs))
+	if verbose {
+		printProcessErrors(out, errs)
+	} else {
+		fmt.Fprintf(out, "  The failed processes are listed by info %d, or by jail --verbose\n", jail.PID)
 	}
 }
 
 // jailProcess puts a process in quarantine
-func jailProcess(state *JailerState, jailType, pidStr string) error {
+func jailProcess(state *JailerState, jailType, pidStr string, args []string, options JailOptions) (err error) {
+	span := startOperation("jail", stringAttribute("jail.type", jailType), stringAttribute("process.pid", pidStr))
+	defer func() { span.end(err) }()
+
 	// Parse the PID
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
 		return fmt.Errorf("invalid PID: %s", pidStr)
 	}
 
+	// Seccomp filters, Landlock rulesets and mount namespaces can only be set up by the
+	// process itself before exec
+	if isLaunchOnlyJailType(jailType) {
+		return fmt.Errorf("%s jails can only be applied to commands started with run", jailType)
+	}
+
 	// Check that the jail type is supported
-	if jailType != "network" && jailType != "cpu" {
-		return fmt.Errorf("unsupported jail type: %s (only 'network' and 'cpu' are supported)", jailType)
+	if !isSupportedJailType(jailType) {
+		return fmt.Errorf("unsupported jail type: %s (supported: %s)", jailType, strings.Join(supportedJailTypes, ", "))
+	}
+	if err := checkJailTypeEnabled(state, jailType); err != nil {
+		return err
+	}
+
+	// Parse the type-specific arguments
+	var rlimits, rdmaLimits, miscLimits map[string]uint64
+	var cpuPercent, cpuWeight int
+	var memoryLimit, quotaBytes uint64
+	var quotaDirs []string
+	switch {
+	case jailType == "rlimit":
+		if rlimits, err = parseRlimitSpecs(args); err != nil {
+			return err
+		}
+	case jailType == "rdma":
+		if rdmaLimits, err = parseRdmaLimits(args); err != nil {
+			return err
+		}
+	case jailType == "misc":
+		if miscLimits, err = parseMiscLimits(args); err != nil {
+			return err
+		}
+	case jailType == "memory":
+		if memoryLimit, err = parseMemoryLimit(args); err != nil {
+			return err
+		}
+	case jailType == "quota":
+		if quotaBytes, quotaDirs, err = parseQuotaArgs(args); err != nil {
+			return err
+		}
+	case jailType == "cpu" && len(args) == 1 && strings.HasPrefix(args[0], "weight="):
+		if cpuWeight, err = parseCpuWeight(args[0]); err != nil {
+			return err
+		}
+	case jailType == "cpu" && len(args) == 1:
+		if cpuPercent, err = parseCpuPercent(args[0]); err != nil {
+			return err
+		}
+	case len(args) > 0:
+		return fmt.Errorf("unexpected arguments for %s jail: %s", jailType, strings.Join(args, " "))
+	}
+	if jailType == "cpu" && options.CpuBurst > 0 {
+		if cpuWeight > 0 {
+			return fmt.Errorf("a CPU burst needs a quota, a weighted jail has none")
+		}
+		if options.CpuBurst > time.Duration(max(cpuPercent, 1))*time.Millisecond {
+			return fmt.Errorf("a CPU burst of %s is over the quota of %d%% of one core", options.CpuBurst, max(cpuPercent, 1))
+		}
+	}
+
+	// The OOM group needs the tree in a cgroup of its own, the other types ignore it
+	oomGroup := options.OomGroup && isCgroupJailType(jailType) && jailType != "proxy"
+	if oomGroup && state.CgroupVersion != 2 {
+		return fmt.Errorf("--oom-group needs cgroups v2")
+	}
+
+	if err := checkProxyJailCombination(state, state.ActiveJails[pid], jailType); err != nil {
+		return err
 	}
 
 	// Check if the process is already jailed with this specific type
@@ -336,14 +1252,102 @@ func jailProcess(state *JailerState, jailType, pidStr string) error {
 		}
 		// Process exists but doesn't have this jail type, we'll add it
 		jail.AddJailType(jailType)
-		processName := getProcessName(pid)
-		fmt.Printf("Added %s jail to already jailed process %d (%s)\n", jailType, pid, processName)
+		jail.OomGroup = jail.OomGroup || oomGroup
+		switch jailType {
+		case "rlimit":
+			jail.Rlimits = rlimits
+		case "cpu":
+			jail.CpuPercent = cpuPercent
+			jail.CpuWeight = cpuWeight
+			jail.CpuBurst = options.CpuBurst
+			if options.SqueezeOver > 0 {
+				jail.Squeeze = newCpuSqueeze(cpuPercent, options.SqueezeOver, time.Now())
+			}
+			if options.AdaptiveTarget > 0 {
+				jail.Adaptive = &adaptiveCpu{TargetPercent: options.AdaptiveTarget, Applied: cpuPercent}
+			}
+		case "rdma":
+			jail.RdmaLimits = rdmaLimits
+		case "misc":
+			jail.MiscLimits = miscLimits
+		case "memory":
+			jail.MemoryLimit = memoryLimit
+		case "quota":
+			jail.QuotaBytes, jail.QuotaDirs = quotaBytes, quotaDirs
+			if err := state.Quotas.setupJail(jail, append([]int{pid}, jail.Children...)); err != nil {
+				jail.RemoveJailType(jailType)
+				jail.clearJailTypeLimits(jailType)
+				return err
+			}
+		}
+		if err := state.Limits.placeJail(jail, jailType); err != nil {
+			jail.RemoveJailType(jailType)
+			jail.clearJailTypeLimits(jailType)
+			return err
+		}
+		if jailType == "network" {
+			if err := state.Firewall.setupJail(jail, options); err != nil {
+				jail.RemoveJailType(jailType)
+				if !jail.usesDedicatedCgroup() {
+					state.Limits.releaseJail(jail)
+				}
+				return err
+			}
+		}
+		if isCgroupJailType(jailType) && jail.usesDedicatedCgroup() {
+			if err := state.Limits.setupJail(jail); err != nil {
+				jail.RemoveJailType(jailType)
+				jail.clearJailTypeLimits(jailType)
+				if jailType == "network" {
+					state.Firewall.releaseJail(jail)
+				}
+				if !jail.usesDedicatedCgroup() {
+					state.Limits.releaseJail(jail)
+				}
+				return err
+			}
+		}
+		if jailType == "network" && options.AllowEstablished {
+			if err := state.Firewall.allowSessions(jail, append([]int{pid}, jail.Children...)); err != nil {
+				jail.RemoveJailType(jailType)
+				state.Firewall.releaseJail(jail)
+				return err
+			}
+		}
+		if jailType == "network" {
+			if err := state.Firewall.enterNamespace(jail); err != nil {
+				jail.RemoveJailType(jailType)
+				state.Firewall.releaseJail(jail)
+				return err
+			}
+		}
+		if options.Reason != "" {
+			jail.Reason = options.Reason
+		}
+		if options.Persistent {
+			jail.Persistent = true
+		}
+		if options.For > 0 {
+			jail.ExpiresAt = time.Now().Add(options.For)
+		}
+		processName := hostProcesses.name(pid)
+		fmt.Fprintf(state.stdout(), "Added %s jail to already jailed process %d (%s)\n", jailType, pid, processName)
 
-		// Move to combined jail if necessary
-		combinedJailType := jail.GetJailTypesString()
-		if err := moveProcessToCombinedCgroup(state, pid, combinedJailType); err != nil {
-			return fmt.Errorf("failed to move process to combined jail: %v", err)
+		if err := applyJailTypeToProcess(state, jail, jailType, pid); err != nil {
+			jail.RemoveJailType(jailType)
+			if jailType == "network" {
+				state.Firewall.releaseJail(jail)
+			}
+			return fmt.Errorf("failed to apply %s jail to process %d: %v", jailType, pid, err)
 		}
+		errs, _ := moveProcesses("Jailed", jail.Children, func(childPid int) error {
+			if !hostProcesses.exists(childPid) {
+				return nil
+			}
+			return applyJailTypeToProcess(state, jail, jailType, childPid)
+		})
+		reportDescendantErrors(state.stdout(), jail, jailType, len(jail.Children), errs, options.Verbose)
+		publishJailEvent("updated", jail, "added "+jailType)
 		return nil
 	}
 
@@ -353,68 +1357,131 @@ func jailProcess(state *JailerState, jailType, pidStr string) error {
 	}
 
 	// Get the original cgroup of the process
-	originalCgroup, err := getProcessCgroup(pid)
+	originalCgroup, err := state.Limits.processGroup(pid)
 	if err != nil {
 		return fmt.Errorf("failed to get original cgroup for PID %d: %v", pid, err)
 	}
 
 	// Find all descendants
-	descendants, err := getAllDescendants(pid)
+	descendants, err := hostProcesses.descendants(pid)
 	if err != nil {
 		return fmt.Errorf("failed to get descendants for PID %d: %v", pid, err)
 	}
 
-	processName := getProcessName(pid)
-	fmt.Printf("Jailing process %d (%s) and %d descendants with %s jail...\n",
+	processName := hostProcesses.name(pid)
+	fmt.Fprintf(state.stdout(), "Jailing process %d (%s) and %d descendants with %s jail...\n",
 		pid, processName, len(descendants), jailType)
 
-	// Move the main process to the appropriate jail cgroup
+	// Create jail entry
+	jail := newJail(pid, originalCgroup)
+	jail.JailTypes = []string{jailType}
+	jail.Rlimits = rlimits
+	jail.CpuPercent = cpuPercent
+	jail.CpuWeight = cpuWeight
 	if jailType == "cpu" {
-		if err := moveProcessToCpuCgroup(state, pid); err != nil {
-			return fmt.Errorf("failed to move main process to CPU jail: %v", err)
+		jail.CpuBurst = options.CpuBurst
+	}
+	if options.SqueezeOver > 0 {
+		jail.Squeeze = newCpuSqueeze(cpuPercent, options.SqueezeOver, time.Now())
+	}
+	if options.AdaptiveTarget > 0 {
+		jail.Adaptive = &adaptiveCpu{TargetPercent: options.AdaptiveTarget, Applied: cpuPercent}
+	}
+	jail.RdmaLimits = rdmaLimits
+	jail.MiscLimits = miscLimits
+	jail.MemoryLimit = memoryLimit
+	jail.OomGroup = oomGroup
+	jail.Reason = options.Reason
+	jail.JailedBy = state.Operator
+	jail.Persistent = options.Persistent
+	if options.For > 0 {
+		jail.ExpiresAt = time.Now().Add(options.For)
+	}
+
+	// On cgroups v2 the dedicated cgroup goes below the original cgroup when it can
+	if err := state.Limits.placeJail(jail, jailType); err != nil {
+		return err
+	}
+
+	// Each network jail gets drop rules of its own, matching its dedicated cgroup on
+	// cgroups v2 or a classid of its own on v1
+	if jailType == "network" {
+		if err := state.Firewall.setupJail(jail, options); err != nil {
+			state.Limits.releaseJail(jail)
+			return err
 		}
-	} else {
-		if err := moveProcessToCgroup(state, pid); err != nil {
-			return fmt.Errorf("failed to move main process to jail: %v", err)
+	}
+
+	// Custom CPU, RDMA and misc limits and the network jail on v2 get a dedicated cgroup
+	if jail.usesDedicatedCgroup() {
+		if err := state.Limits.setupJail(jail); err != nil {
+			state.Firewall.releaseJail(jail)
+			state.Limits.releaseJail(jail)
+			return err
 		}
 	}
 
-	// Move all descendants
-	var successfulDescendants []int
-	for _, descendantPid := range descendants {
-		if jailType == "cpu" {
-			if err := moveProcessToCpuCgroup(state, descendantPid); err != nil {
-				fmt.Printf("Warning: failed to move descendant %d to CPU jail: %v\n", descendantPid, err)
-				continue
-			}
-		} else {
-			if err := moveProcessToCgroup(state, descendantPid); err != nil {
-				fmt.Printf("Warning: failed to move descendant %d to jail: %v\n", descendantPid, err)
-				continue
-			}
+	// The quota jail limits the directories written by the tree, not the processes
+	if jailType == "quota" {
+		jail.QuotaBytes, jail.QuotaDirs = quotaBytes, quotaDirs
+		if err := state.Quotas.setupJail(jail, append([]int{pid}, descendants...)); err != nil {
+			return err
 		}
-		successfulDescendants = append(successfulDescendants, descendantPid)
 	}
 
-	// Create jail entry
-	jail := &Jail{
-		PID:            pid,
-		OriginalCgroup: originalCgroup,
-		JailTypes:      []string{jailType},
-		Timestamp:      time.Now(),
-		Children:       successfulDescendants,
+	// The sessions are let through before the drop applies to the tree
+	if jailType == "network" && options.AllowEstablished {
+		if err := state.Firewall.allowSessions(jail, append([]int{pid}, descendants...)); err != nil {
+			state.Firewall.releaseJail(jail)
+			state.Limits.releaseJail(jail)
+			return err
+		}
+	}
+
+	// Containers with a network namespace of their own get the rules in it as well
+	if jailType == "network" {
+		if err := state.Firewall.enterNamespace(jail); err != nil {
+			state.Firewall.releaseJail(jail)
+			state.Limits.releaseJail(jail)
+			return err
+		}
+	}
+
+	// Apply the jail to the main process
+	if err := applyJailTypeToProcess(state, jail, jailType, pid); err != nil {
+		state.Firewall.releaseJail(jail)
+		state.Limits.releaseJail(jail)
+		return fmt.Errorf("failed to apply %s jail to main process: %v", jailType, err)
+	}
+
+	// Apply the jail to all descendants concurrently, large services have hundreds. The
+	// ones Ctrl+C left untouched stay out of the jail like the failed ones
+	errs, _ := moveProcesses("Jailed", descendants, func(descendantPid int) error {
+		return applyJailTypeToProcess(state, jail, jailType, descendantPid)
+	})
+	reportDescendantErrors(state.stdout(), jail, jailType, len(descendants), errs, options.Verbose)
+	var successfulDescendants []int
+	for _, descendantPid := range descendants {
+		if _, failed := errs[descendantPid]; !failed {
+			successfulDescendants = append(successfulDescendants, descendantPid)
+		}
 	}
+	jail.Children = successfulDescendants
 
 	state.ActiveJails[pid] = jail
 
-	fmt.Printf("Successfully jailed process %d (%s) with %d descendants\n",
+	fmt.Fprintf(state.stdout(), "Successfully jailed process %d (%s) with %d descendants\n",
 		pid, processName, len(successfulDescendants))
+	publishJailEvent("created", jail, "")
 
 	return nil
 }
 
 // unjailProcessSelective removes a specific jail type from a process
-func unjailProcessSelective(state *JailerState, jailType, pidStr string) error {
+func unjailProcessSelective(state *JailerState, jailType, pidStr string) (err error) {
+	span := startOperation("unjail", stringAttribute("jail.type", jailType), stringAttribute("process.pid", pidStr))
+	defer func() { span.end(err) }()
+
 	// Parse the PID
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
@@ -432,71 +1499,80 @@ func unjailProcessSelective(state *JailerState, jailType, pidStr string) error {
 		return fmt.Errorf("process %d is not jailed with %s jail", pid, jailType)
 	}
 
-	processName := getProcessName(pid)
+	// Restrictions set up before exec stay until the process exits
+	if isLaunchOnlyJailType(jailType) {
+		return fmt.Errorf("%s jail cannot be removed from a running process", jailType)
+	}
+
+	processName := hostProcesses.name(pid)
 
 	// If this is the only jail type, remove the entire jail
 	if len(jail.JailTypes) == 1 {
-		fmt.Printf("Removing last jail type (%s) from process %d (%s), completely unjailing...\n", jailType, pid, processName)
+		fmt.Fprintf(state.stdout(), "Removing last jail type (%s) from process %d (%s), completely unjailing...\n", jailType, pid, processName)
 		return unjailProcess(state, pidStr)
 	}
 
 	// Remove the specific jail type
+	// Lift the rdma or misc limits first in case the dedicated cgroup stays in use
+	dedicatedCgroup := jail.usesDedicatedCgroup()
+	if err := state.Limits.liftLimits(jail, jailType); err != nil {
+		fmt.Fprintf(state.stdout(), "Warning: failed to lift %s limits of process %d: %v\n", jailType, pid, err)
+	}
+	if jailType == "quota" {
+		state.Quotas.releaseJail(jail)
+	}
+	if jailType == "network" {
+		state.Firewall.releaseJail(jail)
+	}
 	jail.RemoveJailType(jailType)
-	fmt.Printf("Removed %s jail from process %d (%s), remaining jails: %s\n",
+	jail.clearJailTypeLimits(jailType)
+	fmt.Fprintf(state.stdout(), "Removed %s jail from process %d (%s), remaining jails: %s\n",
 		jailType, pid, processName, jail.GetJailTypesString())
 
-	// Move the process to the appropriate cgroup based on remaining jail types
-	remainingJailTypes := jail.GetJailTypesString()
-
-	// If only one jail type remains, move to single jail cgroup
-	if len(jail.JailTypes) == 1 {
-		remainingType := jail.JailTypes[0]
-		fmt.Printf("Moving process %d to single %s jail cgroup\n", pid, remainingType)
-
-		// Move main process and descendants to the single jail type
-		if remainingType == "cpu" {
-			if err := moveProcessToCpuCgroup(state, pid); err != nil {
-				fmt.Printf("Warning: failed to move process %d to CPU jail: %v\n", pid, err)
-			}
-			for _, childPid := range jail.Children {
-				if processExists(childPid) {
-					if err := moveProcessToCpuCgroup(state, childPid); err != nil {
-						fmt.Printf("Warning: failed to move child %d to CPU jail: %v\n", childPid, err)
-					}
-				}
-			}
-		} else if remainingType == "network" {
-			if err := moveProcessToCgroup(state, pid); err != nil {
-				fmt.Printf("Warning: failed to move process %d to network jail: %v\n", pid, err)
-			}
-			for _, childPid := range jail.Children {
-				if processExists(childPid) {
-					if err := moveProcessToCgroup(state, childPid); err != nil {
-						fmt.Printf("Warning: failed to move child %d to network jail: %v\n", childPid, err)
-					}
-				}
-			}
+	// Revert the jail type on the main process and its descendants, cgroup-based
+	// types move them to the cgroup matching the remaining jail types
+	if isCgroupJailType(jailType) {
+		fmt.Fprintf(state.stdout(), "Moving process %d to jail cgroup for: %s\n", pid, jail.GetJailTypesString())
+	}
+	if err := revertJailTypeOnProcess(state, jail, jailType, pid); err != nil {
+		fmt.Fprintf(state.stdout(), "Warning: failed to remove %s jail from process %d: %v\n", jailType, pid, err)
+	}
+	errs, _ := moveProcesses("Released", jail.Children, func(childPid int) error {
+		if !hostProcesses.exists(childPid) {
+			return nil
 		}
-	} else {
-		// Multiple jail types remain, move to combined cgroup
-		fmt.Printf("Moving process %d to combined jail cgroup for: %s\n", pid, remainingJailTypes)
-		if err := moveProcessToCombinedCgroup(state, pid, remainingJailTypes); err != nil {
-			fmt.Printf("Warning: failed to move process %d to combined jail: %v\n", pid, err)
-		}
-		for _, childPid := range jail.Children {
-			if processExists(childPid) {
-				if err := moveProcessToCombinedCgroup(state, childPid, remainingJailTypes); err != nil {
-					fmt.Printf("Warning: failed to move child %d to combined jail: %v\n", childPid, err)
-				}
-			}
+		return revertJailTypeOnProcess(state, jail, jailType, childPid)
+	})
+	if len(errs) > 0 {
+		fmt.Fprintf(state.stdout(), "Warning: failed to remove %s jail from %d of %d descendants: %s\n", jailType, len(errs), len(jail.Children),
+			summarizeProcessErrors(errs))
+	}
+
+	// The dedicated cgroup is removed once no limit needs it, else its CPU limit follows
+	// the remaining jail types
+	switch {
+	case dedicatedCgroup && !jail.usesDedicatedCgroup():
+		state.Limits.releaseJail(jail)
+	case jail.usesDedicatedCgroup() && jailType == "cpu":
+		if err := state.Limits.updateCpuLimit(jail); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: failed to update CPU limit of process %d: %v\n", pid, err)
 		}
 	}
+	publishJailEvent("updated", jail, "removed "+jailType)
 
 	return nil
 }
 
 // unjailProcess removes a process from quarantine
 func unjailProcess(state *JailerState, pidStr string) error {
+	return endJail(state, pidStr, "unjailed")
+}
+
+// endJail removes a process from quarantine, the end reason goes to the history
+func endJail(state *JailerState, pidStr, endReason string) (err error) {
+	span := startOperation("unjail", stringAttribute("process.pid", pidStr))
+	defer func() { span.end(err) }()
+
 	// Parse the PID
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
@@ -509,39 +1585,71 @@ func unjailProcess(state *JailerState, pidStr string) error {
 		return fmt.Errorf("process %d is not jailed", pid)
 	}
 
-	processName := getProcessName(pid)
-	fmt.Printf("Unjailing process %d (%s) and its descendants...\n", pid, processName)
+	processName := hostProcesses.name(pid)
+	fmt.Fprintf(state.stdout(), "Unjailing process %d (%s) and its descendants...\n", pid, processName)
 
 	// Restore the main process
-	if processExists(pid) {
-		if err := restoreProcessCgroup(state, pid, jail.OriginalCgroup); err != nil {
-			fmt.Printf("Warning: failed to restore main process %d: %v\n", pid, err)
+	if hostProcesses.exists(pid) {
+		if err := releaseProcess(state, jail, pid); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: failed to restore main process %d: %v\n", pid, err)
 		} else {
-			fmt.Printf("  Restored main process %d\n", pid)
+			fmt.Fprintf(state.stdout(), "  Restored main process %d\n", pid)
 		}
 	} else {
-		fmt.Printf("  Main process %d no longer exists\n", pid)
+		fmt.Fprintf(state.stdout(), "  Main process %d no longer exists\n", pid)
 	}
 
-	// Restore all descendants
-	restoredCount := 0
+	// Restore all descendants concurrently
+	var aliveChildren []int
 	for _, childPid := range jail.Children {
-		if !processExists(childPid) {
-			fmt.Printf("  Child process %d no longer exists\n", childPid)
-			continue
+		if hostProcesses.exists(childPid) {
+			aliveChildren = append(aliveChildren, childPid)
 		}
+	}
+	if gone := len(jail.Children) - len(aliveChildren); gone > 0 {
+		fmt.Fprintf(state.stdout(), "  %d child processes no longer exist\n", gone)
+	}
+	errs, untouched := moveProcesses("Restored", aliveChildren, func(childPid int) error {
+		return releaseProcess(state, jail, childPid)
+	})
+	if len(errs) > 0 {
+		fmt.Fprintf(state.stdout(), "Warning: failed to restore %d of %d descendants: %s\n", len(errs), len(aliveChildren), summarizeProcessErrors(errs))
+	}
+	restoredCount := len(aliveChildren) - len(errs)
+
+	// Ctrl+C keeps the jail with the descendants still in it, an unjail again finishes
+	if untouched > 0 {
+		var remaining []int
+		for _, childPid := range aliveChildren {
+			if _, failed := errs[childPid]; failed {
+				remaining = append(remaining, childPid)
+			}
+		}
+		jail.Children = remaining
+		return fmt.Errorf("unjail of process %d interrupted, %d descendants restored and %d still jailed, unjail %d again to release them",
+			pid, restoredCount, len(remaining), pid)
+	}
 
-		if err := restoreProcessCgroup(state, childPid, jail.OriginalCgroup); err != nil {
-			fmt.Printf("Warning: failed to restore child process %d: %v\n", childPid, err)
-			continue
+	if jail.usesDedicatedCgroup() {
+		state.Limits.releaseJail(jail)
+	}
+	if jail.HasJailType("quota") {
+		state.Quotas.releaseJail(jail)
+	}
+	state.Firewall.releaseJail(jail)
+
+	// Restrictions set up before exec can't be lifted
+	for _, jailType := range jail.JailTypes {
+		if isLaunchOnlyJailType(jailType) {
+			fmt.Fprintf(state.stdout(), "  Note: %s jail stays enforced until process %d exits\n", jailType, pid)
 		}
-		restoredCount++
 	}
 
 	// Remove from active jails list
+	recordJailHistory(state, jail, endReason)
 	delete(state.ActiveJails, pid)
 
-	fmt.Printf("Successfully unjailed process %d with %d descendants restored\n",
+	fmt.Fprintf(state.stdout(), "Successfully unjailed process %d with %d descendants restored\n",
 		pid, restoredCount)
 
 	return nil
@@ -549,30 +1657,65 @@ func unjailProcess(state *JailerState, pidStr string) error {
 
 // cleanup cleans up all quarantines before exit
 func cleanup(state *JailerState) {
+	sdNotify("STOPPING=1")
+	defer flushTraces()
 	if len(state.ActiveJails) == 0 {
+		removeJailState(state)
 		return
 	}
 
-	fmt.Printf("Cleaning up %d active jails...\n", len(state.ActiveJails))
+	persistent := countPersistentJails(state)
+	switch {
+	case persistent > 0 && state.KeepJailsOnExit:
+		fmt.Printf("Cleaning up %d ephemeral jails, keeping %d persistent jails...\n", len(state.ActiveJails)-persistent, persistent)
+	case persistent > 0:
+		fmt.Printf("Warning: releasing %d persistent jails, run jailer with -keep-jails-on-exit to keep them\n", persistent)
+		fallthrough
+	default:
+		fmt.Printf("Cleaning up %d active jails...\n", len(state.ActiveJails))
+	}
 
 	// Clean up all jailed processes
-	for pid := range state.ActiveJails {
+	for pid, jail := range state.ActiveJails {
+		if jail.Persistent && state.KeepJailsOnExit {
+			continue
+		}
 		pidStr := strconv.Itoa(pid)
 		if err := unjailProcess(state, pidStr); err != nil {
 			fmt.Printf("  Warning: failed to unjail PID %d: %v\n", pid, err)
 		}
 	}
 
+	// The kept jails still need their rules and cgroups, the next jailer recovers them
+	// from the state file
+	if len(state.ActiveJails) > 0 {
+		publishInventory(state)
+		if state.StatePath != "" {
+			fmt.Printf("Kept %d persistent jails, saved to %s for the next jailer\n", len(state.ActiveJails), state.StatePath)
+		} else {
+			fmt.Printf("Kept %d persistent jails, the state file is off so the next jailer won't know them\n", len(state.ActiveJails))
+		}
+		return
+	}
+
 	// Clean up network filtering
-	fmt.Println("Cleaning up network filtering rules...")
-	if err := cleanupNetworkJail(state); err != nil {
-		fmt.Printf("Warning: failed to cleanup network jail: %v\n", err)
+	if state.FirewallTool != "" {
+		fmt.Println("Cleaning up network filtering rules...")
+		cleanupBlocklists(state)
+		if err := state.Firewall.cleanup(); err != nil {
+			fmt.Printf("Warning: failed to cleanup network jail: %v\n", err)
+		}
+		if state.Config.NetworkProxy != "" {
+			state.Firewall.cleanupProxy()
+		}
 	}
 
 	// Clean up cgroups
-	if err := cleanupCgroup(state); err != nil {
+	if err := state.Limits.cleanup(); err != nil {
 		fmt.Printf("Warning: failed to cleanup cgroups: %v\n", err)
 	}
 
+	publishInventory(state)
+	removeJailState(state)
 	fmt.Println("Cleanup completed")
 }
@@ -1,9 +1,43 @@
+//go:build linux
+
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/chzyer/readline"
+	"golang.org/x/sys/unix"
 )
 
 // TestDetectCgroupVersion tests cgroup version detection
@@ -47,12 +81,12 @@ func TestDetectFirewallTool(t *testing.T) {
 func TestProcessExists(t *testing.T) {
 	// Test with current process (must exist)
 	currentPID := os.Getpid()
-	if !processExists(currentPID) {
+	if !hostProcesses.exists(currentPID) {
 		t.Errorf("Current process %d should exist", currentPID)
 	}
 
 	// Test with non-existent PID (very unlikely to exist)
-	if processExists(999999) {
+	if hostProcesses.exists(999999) {
 		t.Log("Warning: PID 999999 exists, this is unexpected but not necessarily an error")
 	}
 }
@@ -60,7 +94,7 @@ func TestProcessExists(t *testing.T) {
 // TestGetProcessName tests retrieving a process name
 func TestGetProcessName(t *testing.T) {
 	currentPID := os.Getpid()
-	name := getProcessName(currentPID)
+	name := hostProcesses.name(currentPID)
 
 	if name == "" {
 		t.Error("Process name should not be empty")
@@ -125,6 +159,23 @@ func TestValidateProcessAccess(t *testing.T) {
 	}
 }
 
+func TestKernelThreads(t *testing.T) {
+	if !isKernelThreadStat("2 (kthreadd) S 0 0 0 0 -1 2129984 0 0 0 0 0 0") {
+		t.Error("Expected PF_KTHREAD to mark a kernel thread")
+	}
+	if isKernelThreadStat("4242 (sleep (1)) S 1 4242 4242 0 -1 4194560 0 0 0 0 0 0") {
+		t.Error("Expected a user process not to be a kernel thread")
+	}
+	if isKernelThread(os.Getpid()) {
+		t.Error("Expected the test process not to be a kernel thread")
+	}
+	if isKernelThread(2) {
+		if err := validateProcessAccess(2); err == nil || !strings.Contains(err.Error(), "kernel thread") {
+			t.Errorf("Expected kthreadd to be refused, got %v", err)
+		}
+	}
+}
+
 // TestCleanupDeadProcesses tests dead process cleanup
 func TestCleanupDeadProcesses(t *testing.T) {
 	state := NewJailerState()
@@ -231,92 +282,5554 @@ func TestMultipleJailTypes(t *testing.T) {
 	}
 }
 
-// TestCommandExists tests command existence check
-func TestCommandExists(t *testing.T) {
-	// Test with a command that certainly exists
-	if !commandExists("ls") {
-		t.Error("ls command should exist on Unix systems")
+// TestParseRlimitSpecs tests parsing of rlimit jail arguments
+func TestParseRlimitSpecs(t *testing.T) {
+	limits, err := parseRlimitSpecs([]string{"nofile=256", "fsize=100M", "core=unlimited"})
+	if err != nil {
+		t.Fatalf("Failed to parse valid limits: %v", err)
 	}
 
-	// Test with a command that doesn't exist
-	if commandExists("this_command_does_not_exist_12345") {
-		t.Error("Non-existent command should not be found")
+	if limits["nofile"] != 256 {
+		t.Errorf("Expected nofile=256, got %d", limits["nofile"])
+	}
+
+	if limits["fsize"] != 100*1024*1024 {
+		t.Errorf("Expected fsize=100M in bytes, got %d", limits["fsize"])
+	}
+
+	if _, ok := limits["core"]; !ok {
+		t.Error("Should have core limit")
+	}
+
+	// Test invalid specs
+	invalidSpecs := [][]string{
+		{},
+		{"nofile"},
+		{"unknown=1"},
+		{"nofile=abc"},
+		{"fsize=99999999999T"},
+		{"fsize=18446744073709551615"},
+	}
+	for _, specs := range invalidSpecs {
+		if _, err := parseRlimitSpecs(specs); err == nil {
+			t.Errorf("Should fail to parse %v", specs)
+		}
 	}
 }
 
-// TestCgroupInitialization tests cgroup initialization (requires root)
-func TestCgroupInitialization(t *testing.T) {
-	if os.Geteuid() != 0 {
-		t.Skip("Skipping cgroup initialization test: requires root privileges")
+// TestRlimitResourceNames tests that the accepted names are the limits prlimit can set
+func TestRlimitResourceNames(t *testing.T) {
+	names := rlimitResourceNames()
+	if len(names) != len(rlimitResources) {
+		t.Errorf("Expected %d names, got %v", len(rlimitResources), names)
+	}
+	for _, name := range names {
+		if _, exists := rlimitResources[name]; !exists {
+			t.Errorf("No prlimit resource for %q", name)
+		}
 	}
+}
+
+// TestGetOomScoreAdj tests reading the OOM score adjustment of a process
+func TestGetOomScoreAdj(t *testing.T) {
+	score, err := getOomScoreAdj(os.Getpid())
+	if err != nil {
+		t.Fatalf("Failed to read oom_score_adj of current process: %v", err)
+	}
+
+	if score < -1000 || score > 1000 {
+		t.Errorf("oom_score_adj out of range: %d", score)
+	}
+}
+
+// TestBuildSeccompFilter tests seccomp profile compilation
+func TestBuildSeccompFilter(t *testing.T) {
+	if _, err := seccompAuditArch(); err != nil {
+		t.Skipf("Skipping seccomp test: %v", err)
+	}
+
+	// All built-in profiles must compile
+	for name, profile := range builtinSeccompProfiles {
+		filter, err := buildSeccompFilter(profile)
+		if err != nil {
+			t.Errorf("Failed to build built-in profile %s: %v", name, err)
+			continue
+		}
+
+		// Two instructions per denied syscall plus the header and the final allow
+		if len(filter) < 2*len(profile.Deny)+5 {
+			t.Errorf("Filter for profile %s is too short: %d instructions", name, len(filter))
+		}
+	}
+
+	// Test invalid profiles
+	invalidProfiles := []SeccompProfile{
+		{},
+		{Deny: []string{"not_a_syscall"}},
+		{Deny: []string{"socket"}, Action: "explode"},
+	}
+	for _, profile := range invalidProfiles {
+		if _, err := buildSeccompFilter(profile); err == nil {
+			t.Errorf("Should fail to build profile %+v", profile)
+		}
+	}
+}
+
+// TestLandlockHandledAccess tests the filesystem rights handled per Landlock ABI
+func TestLandlockHandledAccess(t *testing.T) {
+	if access := landlockHandledAccess(1); access != 0x1fff {
+		t.Errorf("Unexpected ABI 1 access rights: %#x", access)
+	}
+
+	// Newer ABIs only add rights
+	previous := landlockHandledAccess(1)
+	for abi := 2; abi <= 6; abi++ {
+		access := landlockHandledAccess(abi)
+		if access&previous != previous {
+			t.Errorf("ABI %d drops rights of the previous ABI: %#x", abi, access)
+		}
+		previous = access
+	}
+
+	if err := validateLandlockProfile(LandlockProfile{}); err == nil {
+		t.Error("Empty landlock profile should be rejected")
+	}
+}
 
+// TestParseRunJailSpec tests parsing of the run command jail specification
+func TestParseRunJailSpec(t *testing.T) {
 	state := NewJailerState()
-	err := initializeCgroup(state)
+
+	spec, err := parseRunJailSpec(state, "n,cpu=5%,syscall,landlock=system-readonly")
 	if err != nil {
-		t.Fatalf("Failed to initialize cgroups: %v", err)
+		t.Fatalf("Failed to parse valid spec: %v", err)
 	}
 
-	// Check that paths are set
-	if state.NetworkCgroupPath == "" {
-		t.Error("NetworkCgroupPath should be set")
+	if len(spec.JailTypes) != 2 || spec.JailTypes[0] != "network" || spec.JailTypes[1] != "cpu" {
+		t.Errorf("Unexpected jail types: %v", spec.JailTypes)
 	}
 
-	if state.CpuCgroupPath == "" {
-		t.Error("CpuCgroupPath should be set")
+	if len(spec.JailArgs["cpu"]) != 1 || spec.JailArgs["cpu"][0] != "5%" {
+		t.Errorf("Unexpected cpu arguments: %v", spec.JailArgs["cpu"])
 	}
 
-	if state.NetworkCpuCgroupPath == "" {
-		t.Error("NetworkCpuCgroupPath should be set")
+	if spec.LaunchProfiles["syscall"] != "no-network" {
+		t.Errorf("Syscall jail should use the default profile, got %s", spec.LaunchProfiles["syscall"])
 	}
 
-	if state.CgroupVersion != 1 && state.CgroupVersion != 2 {
-		t.Errorf("Invalid cgroup version: %d", state.CgroupVersion)
+	if spec.Launch.Seccomp == nil || spec.Launch.Landlock == nil || spec.Launch.ReadOnly != nil {
+		t.Error("Launch specification does not match the requested jails")
 	}
 
-	t.Logf("Initialized cgroups v%d", state.CgroupVersion)
-	t.Logf("Network cgroup path: %s", state.NetworkCgroupPath)
-	t.Logf("CPU cgroup path: %s", state.CpuCgroupPath)
-	t.Logf("Combined cgroup path: %s", state.NetworkCpuCgroupPath)
+	// Test invalid specs
+	invalidSpecs := []string{"bogus", "network=1", "cpu,cpu", "syscall=unknown-profile", "rlimit"}
+	for _, specStr := range invalidSpecs {
+		if _, err := parseRunJailSpec(state, specStr); err == nil {
+			t.Errorf("Should fail to parse %q", specStr)
+		}
+	}
 }
 
-// BenchmarkGetProcessChildren benchmark for retrieving child processes
-func BenchmarkGetProcessChildren(b *testing.B) {
-	currentPID := os.Getpid()
+// TestParseCpuPercent tests parsing of custom CPU limits
+func TestParseCpuPercent(t *testing.T) {
+	for _, value := range []string{"5%", "100%"} {
+		if _, err := parseCpuPercent(value); err != nil {
+			t.Errorf("Should parse %q: %v", value, err)
+		}
+	}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		_, err := getProcessChildren(currentPID)
-		if err != nil {
-			b.Fatalf("Failed to get process children: %v", err)
+	for _, value := range []string{"0%", "-5%", "abc", "5", "1000000%"} {
+		if _, err := parseCpuPercent(value); err == nil {
+			t.Errorf("Should fail to parse %q", value)
 		}
 	}
 }
 
-// BenchmarkProcessExists benchmark for process existence check
-func BenchmarkProcessExists(b *testing.B) {
-	currentPID := os.Getpid()
+// TestSplitCommands tests quote-aware splitting of command lines
+func TestSplitCommands(t *testing.T) {
+	commands, err := splitCommands(`jail network 1234 --reason "ticket OPS-9912: suspected miner" 'a b' c\ d`)
+	if err != nil {
+		t.Fatalf("Failed to split command line: %v", err)
+	}
+	if len(commands) != 1 {
+		t.Fatalf("Expected 1 command, got %d", len(commands))
+	}
+	words := commands[0]
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		processExists(currentPID)
+	expected := []string{"jail", "network", "1234", "--reason", "ticket OPS-9912: suspected miner", "a b", "c d"}
+	if len(words) != len(expected) {
+		t.Fatalf("Expected %d words, got %d: %q", len(expected), len(words), words)
+	}
+	for i := range expected {
+		if words[i] != expected[i] {
+			t.Errorf("Word %d: expected %q, got %q", i, expected[i], words[i])
+		}
+	}
+
+	if _, err := splitCommands(`jail "unterminated`); err == nil {
+		t.Error("Should fail on unterminated quote")
+	}
+
+	// Unquoted semicolons separate commands, empty commands are dropped
+	commands, err = splitCommands(`jail cpu 1234; jail network 5678 --reason "a; b";; list;`)
+	if err != nil {
+		t.Fatalf("Failed to split command line: %v", err)
+	}
+	if len(commands) != 3 {
+		t.Fatalf("Expected 3 commands, got %d: %q", len(commands), commands)
+	}
+	if commands[1][4] != "a; b" || commands[2][0] != "list" {
+		t.Errorf("Unexpected commands: %q", commands)
 	}
 }
 
-// BenchmarkJailMethods benchmark for jail type operations
-func BenchmarkJailMethods(b *testing.B) {
+// TestParseInterspersed tests that flags are parsed anywhere before the raw words
+func TestParseInterspersed(t *testing.T) {
+	fs := newCommandFlagSet("run")
+	reason := fs.String("reason", "", "")
+	args, err := parseInterspersed(fs, []string{"network", "--reason", "why", "--", "cmd", "--reason", "x"}, 1)
+	if err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if *reason != "why" {
+		t.Errorf("Expected reason 'why', got %q", *reason)
+	}
+
+	// Words after the separator belong to the command
+	if strings.Join(args, " ") != "network cmd --reason x" {
+		t.Errorf("Unexpected remaining words: %q", args)
+	}
+
+	// Without a separator the command starts after the raw arguments
+	args, err = parseInterspersed(fs, []string{"network", "sleep", "-v", "--reason=inline"}, 1)
+	if err != nil || strings.Join(args, " ") != "network sleep -v --reason=inline" {
+		t.Errorf("Unexpected raw words: %q, %v", args, err)
+	}
+
+	fs = newCommandFlagSet("jail")
+	reason = fs.String("reason", "", "")
+	args, err = parseInterspersed(fs, []string{"rlimit", "--reason=inline", "1234", "nofile=64"}, 0)
+	if err != nil || *reason != "inline" || strings.Join(args, " ") != "rlimit 1234 nofile=64" {
+		t.Errorf("Unexpected interspersed parse: %q, %q, %v", args, *reason, err)
+	}
+
+	if _, err := parseInterspersed(fs, []string{"1234", "--reason"}, 0); err == nil {
+		t.Error("Should fail when the value is missing")
+	}
+}
+
+// TestCommandTable tests usage errors, help and completion generated from the commands
+func TestCommandTable(t *testing.T) {
+	state := NewJailerState()
+
+	for _, line := range []string{"info", "info 1 2", "info 1 --bogus", "unjail", "restore", "top --sort size", "list extra"} {
+		err := executeCommand(state, line)
+		if err == nil || !strings.Contains(err.Error(), "usage: ") {
+			t.Errorf("%q: expected a usage error, got %v", line, err)
+		}
+	}
+	if err := executeCommand(state, "frobnicate"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("Unknown command error = %v", err)
+	}
+
+	if c := lookupCommand("QUIT"); c == nil || c.name != "exit" {
+		t.Error("Aliases should be looked up case-insensitively")
+	}
+	if usage := lookupCommand("find").usage(); usage != "find [pattern] [--user user] [--wide]" {
+		t.Errorf("Unexpected find usage: %q", usage)
+	}
+
+	output, err := captureOutput(func() error { return executeCommand(state, "top --help") })
+	if err != nil || !strings.Contains(output, "--sort cpu|memory|throttled") {
+		t.Errorf("Unexpected command help: %q, %v", output, err)
+	}
+
+	output, err = captureOutput(func() error { return executeCommand(state, "list --json") })
+	if err != nil || strings.TrimSpace(output) != "[]" {
+		t.Errorf("Unexpected JSON list: %q, %v", output, err)
+	}
+
+	line := []rune("info --w")
+	candidates, length := commandCompleter().Do(line, len(line))
+	if length != 3 || len(candidates) != 1 || string(candidates[0]) != "ide " {
+		t.Errorf("Unexpected flag completion: %q (length %d)", candidates, length)
+	}
+
+	for _, shell := range []string{"bash", "zsh"} {
+		script, _ := captureOutput(func() error {
+			if code := printShellCompletion([]string{shell}); code != 0 {
+				return fmt.Errorf("exit code %d", code)
+			}
+			return nil
+		})
+		if !strings.Contains(script, "--older-than") || !strings.Contains(script, "checkpoint") {
+			t.Errorf("%s completion misses commands or flags:\n%s", shell, script)
+		}
+		if _, err := exec.LookPath(shell); err == nil {
+			if output, err := exec.Command(shell, "-n", "-c", script).CombinedOutput(); err != nil {
+				t.Errorf("%s completion is not valid: %v\n%s", shell, err, output)
+			}
+		}
+	}
+}
+
+// TestParseListFilter tests parsing of the list command options
+func TestParseListFilter(t *testing.T) {
+	filter, err := parseListFilter([]string{"--type", "c", "--older-than", "1h", "--wide", "--name", "chrom*", "--sort", "age"})
+	if err != nil {
+		t.Fatalf("Failed to parse list options: %v", err)
+	}
+
+	if filter.JailType != "cpu" || filter.OlderThan != time.Hour || filter.SortBy != "age" || !filter.Wide {
+		t.Errorf("Unexpected filter: %+v", filter)
+	}
+
 	jail := &Jail{
-		PID:            1234,
-		OriginalCgroup: "/",
-		JailTypes:      []string{"network"},
-		Timestamp:      time.Now(),
-		Children:       []int{},
+		PID:       1234,
+		JailTypes: []string{"cpu"},
+		Timestamp: time.Now().Add(-2 * time.Hour),
+	}
+	if !filter.matches(jail, "chromium") {
+		t.Error("Jail should match the filter")
+	}
+	if filter.matches(jail, "firefox") {
+		t.Error("Jail should not match another name")
 	}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		jail.AddJailType("cpu")
-		jail.HasJailType("cpu")
-		jail.RemoveJailType("cpu")
-		jail.GetJailTypesString()
+	jail.Timestamp = time.Now()
+	if filter.matches(jail, "chromium") {
+		t.Error("Recent jail should not match --older-than")
+	}
+
+	// Patterns without wildcards match substrings
+	if !matchesName("chrom", "chromium") {
+		t.Error("Substring pattern should match")
+	}
+
+	for _, args := range [][]string{{"--sort", "size"}, {"--older-than", "soon"}, {"extra"}} {
+		if _, err := parseListFilter(args); err == nil {
+			t.Errorf("Should fail to parse %v", args)
+		}
+	}
+}
+
+// TestParseDuration tests duration parsing with day support
+func TestParseDuration(t *testing.T) {
+	if duration, err := parseDuration("7d"); err != nil || duration != 7*24*time.Hour {
+		t.Errorf("Expected 7 days, got %v (%v)", duration, err)
+	}
+
+	if duration, err := parseDuration("90m"); err != nil || duration != 90*time.Minute {
+		t.Errorf("Expected 90 minutes, got %v (%v)", duration, err)
+	}
+
+	if _, err := parseDuration("-1h"); err == nil {
+		t.Error("Negative durations should be rejected")
+	}
+}
+
+// TestSampleJailUsage tests resource usage sampling of a process tree
+func TestSampleJailUsage(t *testing.T) {
+	jail := &Jail{PID: os.Getpid()}
+
+	state := &JailerState{CgroupVersion: 2}
+	first := sampleJailUsage(state, jail, nil)
+	if first.RSSBytes == 0 {
+		t.Error("Current process should use some memory")
+	}
+
+	// Burn some CPU so the second sample has something to measure
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for time.Now().Before(deadline) {
+	}
+
+	second := sampleJailUsage(state, jail, &first)
+	if second.CPUTicks < first.CPUTicks {
+		t.Errorf("CPU time went backwards: %d < %d", second.CPUTicks, first.CPUTicks)
+	}
+	if second.CPUPercent < 0 {
+		t.Errorf("Invalid CPU percentage: %f", second.CPUPercent)
+	}
+}
+
+// TestParseDropCounters tests reading the dropped packets of the firewall listings
+func TestParseDropCounters(t *testing.T) {
+	nftListing := `table inet jail {
+	chain output {
+		type filter hook output priority 100; policy accept;
+		socket cgroupv2 level 1 "jail" counter packets 12 bytes 720 drop
+	}
+	chain input {
+		type filter hook input priority 100; policy accept;
+		socket cgroupv2 level 1 "jail" counter packets 3 bytes 180 drop
+	}
+}`
+	if packets := parseNftablesCounters(nftListing); packets != 15 {
+		t.Errorf("Expected 15 dropped packets from nftables, got %d", packets)
+	}
+
+	iptablesListing := `Chain OUTPUT (policy ACCEPT 100 packets, 6000 bytes)
+    pkts      bytes target     prot opt in     out     source               destination
+       7      420 DROP       all  --  *      *       0.0.0.0/0            0.0.0.0/0            cgroup jail
+      50     3000 DROP       tcp  --  *      *       0.0.0.0/0            10.0.0.1
+`
+	if packets := parseIptablesDropCounters(iptablesListing); packets != 7 {
+		t.Errorf("Expected 7 dropped packets from iptables, got %d", packets)
+	}
+}
+
+// TestExportJails tests exporting active and ended jails
+func TestExportJails(t *testing.T) {
+	state := NewJailerState()
+
+	jail := newJail(os.Getpid(), "/")
+	jail.JailTypes = []string{"network"}
+	jail.Reason = "suspicious, \"quoted\""
+	state.ActiveJails[jail.PID] = jail
+
+	ended := newJail(999999, "/")
+	ended.Name = "gone"
+	ended.JailTypes = []string{"cpu"}
+	recordJailHistory(state, ended, "unjailed")
+
+	dir := t.TempDir()
+
+	jsonPath := filepath.Join(dir, "jails.json")
+	if err := exportJails(state, jsonPath, ""); err != nil {
+		t.Fatalf("JSON export failed: %v", err)
+	}
+	content, err := os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report exportReport
+	if err := json.Unmarshal(content, &report); err != nil {
+		t.Fatalf("Invalid JSON export: %v", err)
+	}
+	if len(report.ActiveJails) != 1 || len(report.History) != 1 {
+		t.Fatalf("Expected 1 active and 1 ended jail, got %d and %d", len(report.ActiveJails), len(report.History))
+	}
+	if report.History[0].EndReason != "unjailed" || report.History[0].Name != "gone" {
+		t.Errorf("Unexpected history record: %+v", report.History[0])
+	}
+
+	csvPath := filepath.Join(dir, "jails.out")
+	if err := exportJails(state, csvPath, "csv"); err != nil {
+		t.Fatalf("CSV export failed: %v", err)
+	}
+	file, err := os.Open(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV export: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Expected header and 2 rows, got %d rows", len(rows))
+	}
+	if rows[1][0] != "active" || rows[1][5] != jail.Reason {
+		t.Errorf("Unexpected active row: %v", rows[1])
+	}
+	if rows[2][0] != "ended" || rows[2][9] != "unjailed" {
+		t.Errorf("Unexpected ended row: %v", rows[2])
+	}
+
+	if err := exportJails(state, csvPath, "xml"); err == nil {
+		t.Error("Expected an error for an unsupported format")
+	}
+}
+
+// TestParsePidTargets tests expanding PIDs, ranges and PID files
+func TestParsePidTargets(t *testing.T) {
+	self := os.Getpid()
+	selfStr := strconv.Itoa(self)
+
+	pids, rest, err := parsePidTargets([]string{"10", "20", "10", "5%"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(pids) != 2 || pids[0] != 10 || pids[1] != 20 {
+		t.Errorf("Expected [10 20], got %v", pids)
+	}
+	if len(rest) != 1 || rest[0] != "5%" {
+		t.Errorf("Expected remaining [5%%], got %v", rest)
+	}
+
+	// A bare number is a PID, CPU limits take a %
+	if pids, rest, err := parsePidTargets([]string{"1234", "50"}); err != nil || len(pids) != 2 || len(rest) != 0 {
+		t.Errorf("Expected 2 PIDs and no remaining arguments, got %v %v (%v)", pids, rest, err)
+	}
+
+	if limit := maxPid(); limit <= 1 || limit >= pidMaxLimit {
+		t.Errorf("maxPid = %d", limit)
+	}
+
+	// Ranges only keep existing processes
+	pids, _, err = parsePidTargets([]string{selfStr + "-" + selfStr})
+	if err != nil || len(pids) != 1 || pids[0] != self {
+		t.Errorf("Expected [%d] from range, got %v (%v)", self, pids, err)
+	}
+
+	pidFile := filepath.Join(t.TempDir(), "app.pid")
+	if err := os.WriteFile(pidFile, []byte("42\n43\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pids, rest, err = parsePidTargets([]string{"@" + pidFile, "nofile=10"})
+	if err != nil || len(pids) != 2 || pids[1] != 43 || len(rest) != 1 {
+		t.Errorf("Unexpected PID file expansion: %v %v (%v)", pids, rest, err)
+	}
+
+	// PID 0, reversed ranges and ranges past pid_max are refused
+	for _, args := range [][]string{{"abc"}, {"0"}, {"0-10"}, {"20-10"}, {"1-9999999999"}, {"1-" + strconv.Itoa(maxPid()+1)}, {"@/nonexistent/pidfile"}} {
+		if _, _, err := parsePidTargets(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+// TestPidCompletion tests PID completion annotated with process names
+func TestPidCompletion(t *testing.T) {
+	state := NewJailerState()
+	self := os.Getpid()
+	state.ActiveJails[self] = newJail(self, "/")
+
+	annotated := strconv.Itoa(self) + ":" + hostProcesses.name(self)
+	pid, err := parsePidArg(annotated)
+	if err != nil || pid != self {
+		t.Errorf("parsePidArg(%q) = %d, %v", annotated, pid, err)
+	}
+	if _, err := parsePidArg(strconv.Itoa(self) + ":not-this-process"); err == nil {
+		t.Error("Expected an error for a PID annotated with another name")
+	}
+
+	completer := &jailerCompleter{state: state, keywords: readline.NewPrefixCompleter(
+		readline.PcItem("unjail", readline.PcItem("network")),
+	)}
+
+	// Only jailed processes are offered for unjail, along with the jail types
+	line := []rune("unjail ")
+	candidates, length := completer.Do(line, len(line))
+	if length != 0 {
+		t.Errorf("Expected completion length 0, got %d", length)
+	}
+	found := map[string]bool{}
+	for _, candidate := range candidates {
+		found[string(candidate)] = true
+	}
+	if !found["network "] || !found[annotated+" "] || len(candidates) != 2 {
+		t.Errorf("Unexpected candidates: %q", candidates)
+	}
+
+	// The last command of the line is completed
+	line = []rune("list; checkpoint " + strconv.Itoa(self)[:1])
+	candidates, length = completer.Do(line, len(line))
+	if length != 1 || len(candidates) != 1 || string(candidates[0]) != annotated[1:]+" " {
+		t.Errorf("Unexpected checkpoint candidates: %q (length %d)", candidates, length)
+	}
+}
+
+// TestFindProcesses tests searching processes by name, command line and user
+func TestFindProcesses(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	contains := func(processes []processInfo) bool {
+		for _, process := range processes {
+			if process.PID == pid {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !contains(findProcesses("sle*", "")) {
+		t.Error("Process not found by name glob")
+	}
+	if !contains(findProcesses("sleep 30", "")) {
+		t.Error("Process not found by command line substring")
+	}
+	if !contains(findProcesses("", getProcessUser(os.Getpid()))) {
+		t.Error("Process not found by user")
+	}
+	if contains(findProcesses("sleep", "no-such-user")) {
+		t.Error("Process found with the wrong user")
+	}
+}
+
+// TestDescribeJailType tests the limits shown by info
+func TestDescribeJailType(t *testing.T) {
+	state := NewJailerState()
+	state.CpuCgroupPath = "/sys/fs/cgroup/jail-cpu"
+	jail := newJail(1234, "/")
+	jail.CpuPercent = 5
+	jail.Rlimits = map[string]uint64{"nofile": 256}
+	jail.MiscLimits = map[string]uint64{"sev": 1}
+	jail.SavedOomScores[1234] = 0
+
+	cases := map[string]string{
+		"cpu":    "5% of one core (/sys/fs/cgroup/jail-1234)",
+		"rlimit": "nofile=256",
+		"oom":    "oom_score_adj 1000 (was 0)",
+		"misc":   "sev=1 (/sys/fs/cgroup/jail-1234)",
+	}
+	for jailType, expected := range cases {
+		if description := describeJailType(state, jail, jailType); description != expected {
+			t.Errorf("describeJailType(%s) = %q, expected %q", jailType, description, expected)
+		}
+	}
+}
+
+// TestParseRdmaLimits tests the parsing of RDMA limits and their rdma.max lines
+func TestParseRdmaLimits(t *testing.T) {
+	limits, err := parseRdmaLimits([]string{"mlx5_1:hca_object=2000", "mlx5_0:hca_handle=2", "mlx5_0:hca_object=100"})
+	if err != nil {
+		t.Fatalf("parseRdmaLimits failed: %v", err)
+	}
+
+	expected := []string{"mlx5_0 hca_handle=2 hca_object=100", "mlx5_1 hca_object=2000"}
+	if lines := formatRdmaMax(limits, ""); strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Errorf("formatRdmaMax = %q, expected %q", lines, expected)
+	}
+	expected = []string{"mlx5_0 hca_handle=max hca_object=max", "mlx5_1 hca_object=max"}
+	if lines := formatRdmaMax(limits, "max"); strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Errorf("formatRdmaMax(max) = %q, expected %q", lines, expected)
+	}
+
+	for _, spec := range []string{"hca_handle=2", "mlx5_0:hca_handle", "mlx5_0:qp=2", "mlx5_0:hca_handle=-1"} {
+		if _, err := parseRdmaLimits([]string{spec}); err == nil {
+			t.Errorf("parseRdmaLimits(%q) should fail", spec)
+		}
+	}
+	if _, err := parseRdmaLimits(nil); err == nil {
+		t.Error("parseRdmaLimits without limits should fail")
+	}
+}
+
+// TestParseMiscCapacity tests the parsing of misc.capacity
+func TestParseMiscCapacity(t *testing.T) {
+	capacity := parseMiscCapacity("res_a 50\nsev 509\nsev_es 0\n")
+	if len(capacity) != 3 || capacity["sev"] != 509 || capacity["sev_es"] != 0 {
+		t.Errorf("parseMiscCapacity = %v", capacity)
+	}
+	if names := miscResourceNames(capacity); strings.Join(names, ",") != "res_a,sev,sev_es" {
+		t.Errorf("miscResourceNames = %v", names)
+	}
+}
+
+// TestParseQuotaArgs tests the parsing of the quota jail arguments
+func TestParseQuotaArgs(t *testing.T) {
+	dir := t.TempDir()
+	limit, dirs, err := parseQuotaArgs([]string{"500M", dir + "/"})
+	if err != nil {
+		t.Fatalf("parseQuotaArgs failed: %v", err)
+	}
+	if limit != 500<<20 || len(dirs) != 1 || dirs[0] != dir {
+		t.Errorf("parseQuotaArgs = %d, %v", limit, dirs)
+	}
+
+	// Filesystem roots are refused, the whole filesystem would join the project
+	for _, args := range [][]string{nil, {"lots"}, {"512"}, {"1G", "relative/dir"}, {"1G", filepath.Join(dir, "missing")}, {"1G", "/"}, {"1G", "/proc"}} {
+		if _, _, err := parseQuotaArgs(args); err == nil {
+			t.Errorf("parseQuotaArgs(%v) should fail", args)
+		}
+	}
+}
+
+// TestFindWritableDirectories tests that only directories of files open for writing are found
+func TestFindWritableDirectories(t *testing.T) {
+	if !fdinfoWritable("pos:\t0\nflags:\t0100001\nmnt_id:\t25\n") {
+		t.Error("O_WRONLY flags should be writable")
+	}
+	if fdinfoWritable("pos:\t0\nflags:\t0100000\n") {
+		t.Error("O_RDONLY flags should not be writable")
+	}
+
+	writtenDir, readDir := t.TempDir(), t.TempDir()
+	written, err := os.Create(filepath.Join(writtenDir, "app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer written.Close()
+	if err := os.WriteFile(filepath.Join(readDir, "config"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	read, err := os.Open(filepath.Join(readDir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer read.Close()
+
+	dirs := findWritableDirectories([]int{os.Getpid()})
+	found := make(map[string]bool)
+	for _, dir := range dirs {
+		found[dir] = true
+	}
+	if !found[writtenDir] {
+		t.Errorf("findWritableDirectories = %v, expected %s", dirs, writtenDir)
+	}
+	if found[readDir] {
+		t.Errorf("findWritableDirectories = %v, %s is only read", dirs, readDir)
+	}
+
+	// The file being written is charged to the quota as well as its directory
+	files := findWritableFiles([]int{os.Getpid()})
+	if !slices.Contains(files, written.Name()) || slices.Contains(files, read.Name()) {
+		t.Errorf("findWritableFiles = %v, expected %s only", files, written.Name())
+	}
+
+	// The subdirectories of a given directory join the project, not its files or links
+	if err := os.MkdirAll(filepath.Join(writtenDir, "archive", "2024"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(writtenDir, "archive", "app.log.1"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(writtenDir, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	subdirectories, err := quotaSubdirectories(writtenDir)
+	expected := []string{filepath.Join(writtenDir, "archive"), filepath.Join(writtenDir, "archive", "2024")}
+	if err != nil || !reflect.DeepEqual(subdirectories, expected) {
+		t.Errorf("quotaSubdirectories = %v, %v, expected %v", subdirectories, err, expected)
+	}
+	if !isMountPoint("/") || isMountPoint(writtenDir) {
+		t.Errorf("isMountPoint(/) = %v, isMountPoint(%s) = %v", isMountPoint("/"), writtenDir, isMountPoint(writtenDir))
+	}
+}
+
+// captureOutput runs a function and returns what it printed on stdout
+func captureOutput(fn func() error) (string, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return "", fmt.Errorf("failed to capture output: %v", err)
+	}
+
+	output := make(chan string)
+	go func() {
+		content, _ := io.ReadAll(reader)
+		reader.Close()
+		output <- string(content)
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	err = fn()
+	os.Stdout = stdout
+	writer.Close()
+
+	return <-output, err
+}
+
+// tcpPipe returns both ends of a loopback TCP connection, both ends of the handshake
+// write before reading so net.Pipe can't be used
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// tlsPipe returns both ends of a loopback mutual TLS connection, the certificate of the
+// controller end is in the organizational unit controllerUnit
+func tlsPipe(t *testing.T, controllerUnit string) (net.Conn, net.Conn) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.crt")
+	ca, caKey := writeTestCertificate(t, caPath, "", 1, "", nil, nil)
+	endConfig := func(name, unit string, serial int64) *tls.Config {
+		config := &Config{
+			RemoteTLSCert: filepath.Join(dir, name+".crt"),
+			RemoteTLSKey:  filepath.Join(dir, name+".key"),
+			RemoteTLSCA:   caPath,
+		}
+		writeTestCertificate(t, config.RemoteTLSCert, config.RemoteTLSKey, serial, unit, ca, caKey)
+		tlsConfig, err := remoteTLSConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig.ServerName = "127.0.0.1"
+		return tlsConfig
+	}
+
+	agentConn, controllerConn := tcpPipe(t)
+	return tls.Server(agentConn, endConfig("agent", "", 2)), tls.Client(controllerConn, endConfig("controller", controllerUnit, 3))
+}
+
+// TestRemoteHandshake tests the authentication of agents and controllers
+func TestRemoteHandshake(t *testing.T) {
+	handshake := func(agentToken, controllerToken, controllerRole, controllerUnit string) (remoteMessage, error, error) {
+		agentConn, controllerConn := tlsPipe(t, controllerUnit)
+		defer agentConn.Close()
+		defer controllerConn.Close()
+
+		var agentErr error
+		done := make(chan struct{})
+		go func() {
+			_, agentErr = newRemoteConn(agentConn).handshake("agent", "web1", agentToken)
+			agentConn.Close()
+			close(done)
+		}()
+		peer, controllerErr := newRemoteConn(controllerConn).handshake(controllerRole, "", controllerToken)
+		controllerConn.Close()
+		<-done
+		return peer, agentErr, controllerErr
+	}
+
+	peer, agentErr, controllerErr := handshake("secret", "secret", "controller", remoteControllerUnit)
+	if agentErr != nil || controllerErr != nil {
+		t.Fatalf("handshake failed: %v, %v", agentErr, controllerErr)
+	}
+	if peer.Host != "web1" || peer.Role != "agent" {
+		t.Errorf("peer = %+v", peer)
+	}
+
+	if _, agentErr, controllerErr := handshake("secret", "other", "controller", remoteControllerUnit); agentErr == nil || controllerErr == nil {
+		t.Errorf("handshake with different tokens should fail: %v, %v", agentErr, controllerErr)
+	}
+	if _, agentErr, controllerErr := handshake("secret", "secret", "agent", remoteControllerUnit); agentErr == nil || controllerErr == nil {
+		t.Errorf("handshake between two agents should fail: %v, %v", agentErr, controllerErr)
+	}
+	if _, _, controllerErr := handshake("", "", "controller", remoteControllerUnit); controllerErr == nil {
+		t.Error("handshake without token should fail")
+	}
+	if _, agentErr, _ := handshake("secret", "secret", "controller", ""); agentErr == nil || !strings.Contains(agentErr.Error(), "not a controller") {
+		t.Errorf("an agent should refuse a controller without a controller certificate: %v", agentErr)
+	}
+}
+
+// writeTestCertificate writes a certificate for 127.0.0.1 in the organizational unit unit,
+// signed by a CA or self-signed when ca is nil, and returns it with its key
+func writeTestCertificate(t *testing.T, certPath, keyPath string, serial int64, unit string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := pkix.Name{CommonName: "jailer-test"}
+	if unit != "" {
+		subject.OrganizationalUnit = []string{unit}
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, parentKey := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = ca, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if keyPath != "" {
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	return certificate, key
+}
+
+// TestRemoteMutualTLS tests that remote connections require a client certificate and pick
+// up a rotated certificate without a restart
+func TestRemoteMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		RemoteTLSCert: filepath.Join(dir, "host.crt"),
+		RemoteTLSKey:  filepath.Join(dir, "host.key"),
+		RemoteTLSCA:   filepath.Join(dir, "ca.crt"),
+	}
+	ca, caKey := writeTestCertificate(t, config.RemoteTLSCA, "", 1, "", nil, nil)
+	writeTestCertificate(t, config.RemoteTLSCert, config.RemoteTLSKey, 2, "", ca, caKey)
+
+	if _, err := remoteListen(&Config{RemoteTLSCert: config.RemoteTLSCert, RemoteTLSKey: config.RemoteTLSKey}, "127.0.0.1:0"); err == nil {
+		t.Error("listening without a CA should be refused")
+	}
+
+	listener, err := remoteListen(config, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	serial := func() int64 {
+		conn, err := remoteDial(config, listener.Addr().String())
+		if err != nil {
+			t.Fatalf("remoteDial: %v", err)
+		}
+		defer conn.Close()
+		return conn.(*tls.Conn).ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := serial(); got != 2 {
+		t.Errorf("server certificate serial = %d, expected 2", got)
+	}
+
+	// A client without certificate is refused by the server
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: pool})
+	if err == nil {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil || err == io.EOF {
+		t.Errorf("a client without certificate should be refused, got %v", err)
+	}
+
+	// Rotated files are used by the next connection
+	writeTestCertificate(t, config.RemoteTLSCert, config.RemoteTLSKey, 3, "", ca, caKey)
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{config.RemoteTLSCert, config.RemoteTLSKey} {
+		os.Chtimes(path, future, future)
+	}
+	if got := serial(); got != 3 {
+		t.Errorf("server certificate serial after rotation = %d, expected 3", got)
+	}
+}
+
+// TestQuoteCommand tests that quoted commands split back into the same words
+func TestQuoteCommand(t *testing.T) {
+	parts := []string{"jail", "network", "1234", "--reason", "it's a \"miner\"; maybe", ""}
+	commands, err := splitCommands(quoteCommand(parts))
+	if err != nil {
+		t.Fatalf("splitCommands failed: %v", err)
+	}
+	if len(commands) != 1 || strings.Join(commands[0], "|") != strings.Join(parts, "|") {
+		t.Errorf("quoteCommand(%q) splits into %q", parts, commands)
+	}
+}
+
+// TestRemoteCommand tests commands sent by the controller to an agent
+func TestRemoteCommand(t *testing.T) {
+	config := newDefaultConfig()
+	config.RemoteToken = "secret"
+	state := NewJailerState()
+	state.Config = config
+	controller := newControllerState(config)
+
+	agentConn, controllerConn := tlsPipe(t, remoteControllerUnit)
+	go func() {
+		rc := newRemoteConn(agentConn)
+		defer rc.close()
+		if _, err := rc.handshake("agent", "web1", config.RemoteToken); err == nil {
+			serveController(state, rc)
+		}
+	}()
+	go controller.serveAgent(newRemoteConn(controllerConn))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(controller.hostNames()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("agent did not register")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The output is sent back without going through the stdout of the agent
+	var result remoteMessage
+	stdout, _ := captureOutput(func() (err error) {
+		result, err = controller.runRemoteCommand("web1", "list", nil)
+		return err
+	})
+	if result.Error != "" || !strings.Contains(result.Output, "No active jails") {
+		t.Errorf("list = %+v", result)
+	}
+	if strings.Contains(stdout, "No active jails") {
+		t.Errorf("Expected the output of the remote command only in the result, got %q on stdout", stdout)
+	}
+	for _, command := range []string{"watch", "pick"} {
+		if result, err := controller.runRemoteCommand("web1", command, nil); err != nil || !strings.Contains(result.Error, "not available remotely") {
+			t.Errorf("%s = %+v, %v", command, result, err)
+		}
+	}
+	if _, err := controller.runRemoteCommand("db1", "list", nil); err == nil {
+		t.Error("unknown host should fail")
+	}
+
+	controllerConn.Close()
+	for len(controller.hostNames()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("agent was not unregistered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSSHCommandArgs tests the remote command run over SSH
+func TestSSHCommandArgs(t *testing.T) {
+	command := []string{"jail", "network", "1234", "--reason", "it's mining; maybe"}
+	args := sshCommandArgs("ops@node1", "jailer", command, false)
+	expected := []string{"--", "ops@node1", `sudo -n jailer jail network 1234 --reason 'it'"'"'s mining; maybe'`}
+	if strings.Join(args, "|") != strings.Join(expected, "|") {
+		t.Errorf("sshCommandArgs = %q, expected %q", args, expected)
+	}
+
+	args = sshCommandArgs("root@node1", "/usr/local/bin/jailer", nil, true)
+	expected = []string{"-t", "--", "root@node1", "/usr/local/bin/jailer"}
+	if strings.Join(args, "|") != strings.Join(expected, "|") {
+		t.Errorf("sshCommandArgs = %q, expected %q", args, expected)
+	}
+
+	// The remote shell must split the command back into the same words
+	output, err := exec.Command("sh", "-c", "printf '%s|' "+sshCommandArgs("root@node1", "jailer", command, false)[2]).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "jailer|"+strings.Join(command, "|")+"|" {
+		t.Errorf("remote shell splits into %q", output)
+	}
+}
+
+// TestRunOverSSH tests that ssh runs with the remote command and its exit code is kept
+func TestRunOverSSH(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > " + argsFile + "\nexit 3\n"
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	if code := runOverSSH("root@node1", "jailer", []string{"list"}); code != 3 {
+		t.Errorf("runOverSSH = %d, expected the exit code of ssh", code)
+	}
+	content, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "--\nroot@node1\njailer list\n" {
+		t.Errorf("ssh called with %q", content)
+	}
+
+	if code := runOverSSH("-oProxyCommand=evil", "jailer", []string{"list"}); code == 0 {
+		t.Error("a host starting with - should be refused")
+	}
+}
+
+// fakeKVServer serves the subset of the Consul and etcd APIs used by the state backends
+func fakeKVServer(t *testing.T) *httptest.Server {
+	var mutex sync.Mutex
+	store := make(map[string][]byte)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch {
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+			body, _ := io.ReadAll(r.Body)
+			store[strings.TrimPrefix(r.URL.Path, "/v1/kv/")] = body
+			fmt.Fprint(w, "true")
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+			delete(store, strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+			fmt.Fprint(w, "true")
+		case r.Method == http.MethodGet && r.URL.Query().Has("raw"):
+			value, found := store[strings.TrimPrefix(r.URL.Path, "/v1/kv/")]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(value)
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+			type pair struct {
+				Key   string
+				Value []byte
+			}
+			var pairs []pair
+			for key, value := range store {
+				if strings.HasPrefix(key, strings.TrimPrefix(r.URL.Path, "/v1/kv/")) {
+					pairs = append(pairs, pair{key, value})
+				}
+			}
+			if len(pairs) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(pairs)
+		case r.URL.Path == "/v3/kv/put":
+			var request struct{ Key, Value []byte }
+			json.NewDecoder(r.Body).Decode(&request)
+			store[string(request.Key)] = request.Value
+			fmt.Fprint(w, "{}")
+		case r.URL.Path == "/v3/kv/range":
+			var request struct {
+				Key      []byte `json:"key"`
+				RangeEnd []byte `json:"range_end"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			type kv struct {
+				Key   []byte `json:"key"`
+				Value []byte `json:"value"`
+			}
+			var kvs []kv
+			for key, value := range store {
+				if key == string(request.Key) || key >= string(request.Key) && key < string(request.RangeEnd) {
+					kvs = append(kvs, kv{[]byte(key), value})
+				}
+			}
+			json.NewEncoder(w).Encode(map[string][]kv{"kvs": kvs})
+		case r.URL.Path == "/v3/kv/deleterange":
+			var request struct{ Key []byte }
+			json.NewDecoder(r.Body).Decode(&request)
+			delete(store, string(request.Key))
+			fmt.Fprint(w, "{}")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// TestInventoryBackends tests that the jails published by a host are read back from Consul and etcd
+func TestInventoryBackends(t *testing.T) {
+	server := fakeKVServer(t)
+	defer server.Close()
+
+	for _, backendType := range []string{"consul", "etcd"} {
+		config := StateBackendConfig{Type: backendType, Endpoint: server.URL + "/", Prefix: "test-" + backendType}
+		if records, err := readInventory(config); err != nil || len(records) != 0 {
+			t.Fatalf("%s: empty store read as %v, %v", backendType, records, err)
+		}
+
+		publisher, err := newInventoryPublisher(config, "web1")
+		if err != nil {
+			t.Fatalf("%s: %v", backendType, err)
+		}
+		state := &JailerState{ActiveJails: map[int]*Jail{
+			1234: {PID: 1234, Name: "miner", JailTypes: []string{"network", "cpu"}, Children: []int{1235}, Reason: "crypto"},
+		}}
+		publisher.publish(state)
+
+		records, err := readInventory(config)
+		if err != nil {
+			t.Fatalf("%s: %v", backendType, err)
+		}
+		if len(records) != 1 || records[0].Host != "web1" || len(records[0].Jails) != 1 {
+			t.Fatalf("%s: read %+v", backendType, records)
+		}
+		jail := records[0].Jails[0]
+		if jail.PID != 1234 || jail.Name != "miner" || jail.Children != 1 || jail.Reason != "crypto" ||
+			strings.Join(jail.JailTypes, ",") != "network,cpu" {
+			t.Errorf("%s: read jail %+v", backendType, jail)
+		}
+	}
+
+	if _, err := newStateBackend(StateBackendConfig{Type: "zookeeper"}); err == nil {
+		t.Error("an unknown backend should be refused")
+	}
+	if publisher, err := newInventoryPublisher(StateBackendConfig{}, "web1"); publisher != nil || err != nil {
+		t.Errorf("no backend gave %v, %v", publisher, err)
+	}
+}
+
+// TestPrefixRangeEnd tests the end of the etcd range of a prefix
+func TestPrefixRangeEnd(t *testing.T) {
+	tests := map[string]string{
+		"jailer/hosts/": "jailer/hosts0",
+		"a\xff":         "b",
+		"\xff\xff":      "\x00",
+	}
+	for prefix, expected := range tests {
+		if end := string(prefixRangeEnd(prefix)); end != expected {
+			t.Errorf("prefixRangeEnd(%q) = %q, expected %q", prefix, end, expected)
+		}
+	}
+}
+
+// TestListAllHosts tests that hosts which stopped updating their record are flagged
+func TestListAllHosts(t *testing.T) {
+	server := fakeKVServer(t)
+	defer server.Close()
+	config := StateBackendConfig{Type: "consul", Endpoint: server.URL}
+	backend, _ := newStateBackend(config)
+
+	for _, record := range []hostInventory{
+		{Host: "web1", UpdatedAt: time.Now(), Jails: []inventoryJail{{PID: 1, Name: "a", JailTypes: []string{"cpu"}, Since: time.Now()}}},
+		{Host: "web2", UpdatedAt: time.Now().Add(-time.Hour), Jails: []inventoryJail{{PID: 2, Name: "b", JailTypes: []string{"network"}, Since: time.Now()}}},
+	} {
+		content, _ := json.Marshal(record)
+		if err := backend.put(inventoryHostKey(defaultInventoryKey, record.Host), content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output, err := captureOutput(func() error { return listAllHosts(os.Stdout, config, listFilter{}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output, "web1 (stale)") || !strings.Contains(output, "web2 (stale)") {
+		t.Errorf("stale hosts not flagged correctly:\n%s", output)
+	}
+	if !strings.Contains(output, "(2 of 2 jails shown on 2 hosts)") || !strings.Contains(output, "Warning: web2") {
+		t.Errorf("unexpected output:\n%s", output)
+	}
+
+	output, _ = captureOutput(func() error { return listAllHosts(os.Stdout, config, listFilter{JailType: "cpu"}) })
+	if !strings.Contains(output, "(1 of 2 jails shown on 2 hosts)") {
+		t.Errorf("filter not applied:\n%s", output)
+	}
+}
+
+// TestRunScript tests that scripts drive the jailer primitives and report their errors
+func TestRunScript(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	dir := t.TempDir()
+	script := filepath.Join(dir, "triage.star")
+	content := `
+target = int(argv[0])
+matches = [p for p in processes("sleep") if p.pid == target]
+if len(matches) != 1 or matches[0].jailed:
+    fail("process not found")
+if not jail("rlimit", target, "nofile=64", reason="script"):
+    fail("jail failed")
+for j in jails():
+    print("jailed", j.pid, j.types, j.reason)
+if stats(target).processes != 1:
+    fail("unexpected stats")
+sleep(0)
+if jail("bogus", target):
+    fail("bogus jail succeeded")
+unjail(target)
+print("left", len(jails()))
+`
+	if err := os.WriteFile(script, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := captureOutput(func() error {
+		return executeCommand(state, "script run "+script+" "+strconv.Itoa(pid))
+	})
+	if err != nil {
+		t.Fatalf("Script failed: %v\n%s", err, output)
+	}
+	if !strings.Contains(output, fmt.Sprintf("jailed %d [\"rlimit\"] script", pid)) || !strings.Contains(output, "left 0") {
+		t.Errorf("Unexpected script output:\n%s", output)
+	}
+
+	if err := os.WriteFile(script, []byte("run(\"watch\")\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = captureOutput(func() error { return executeCommand(state, "script run "+script) })
+	if err == nil || !strings.Contains(err.Error(), "not available in scripts") || !strings.Contains(err.Error(), "triage.star:1") {
+		t.Errorf("Expected an error with the script line, got %v", err)
+	}
+}
+
+// TestSelector tests parsing and evaluating process selectors
+func TestSelector(t *testing.T) {
+	processes := []processSnapshot{
+		{PID: 100, Name: "chrome", User: "alice", CPU: 80, Memory: 2 << 30},
+		{PID: 101, Name: "chrome", User: "bob", CPU: 90},
+		{PID: 102, Name: "bash", User: "alice", CPU: 60, Jailed: true},
+	}
+	tests := []struct {
+		words    []string
+		expected []int
+	}{
+		{[]string{`name=~chrome`, `&&`, `user==alice`, `&&`, `cpu>50`}, []int{100}},
+		{[]string{`name=~chrome&&user!=alice`}, []int{101}},
+		{[]string{`cpu`, `>=`, `80`}, []int{100, 101}},
+		{[]string{`(user==bob`, `||`, `jailed)`, `&&`, `!name=~^ch`}, []int{102}},
+		{[]string{`!jailed`, `&&`, `memory>1G`}, []int{100}},
+		{[]string{`jailed==false`, `&&`, `(pid<101)`}, []int{100}},
+		{[]string{`cmdline!~x)y`}, nil},
+	}
+	for _, tt := range tests {
+		node, _, err := compileSelector(tt.words)
+		if err != nil {
+			if tt.expected == nil {
+				continue
+			}
+			t.Errorf("compileSelector(%q) failed: %v", tt.words, err)
+			continue
+		}
+		if tt.expected == nil {
+			t.Errorf("compileSelector(%q) should have failed", tt.words)
+			continue
+		}
+		var matched []int
+		for i := range processes {
+			if processes[i].matches(node) {
+				matched = append(matched, processes[i].PID)
+			}
+		}
+		if !reflect.DeepEqual(matched, tt.expected) {
+			t.Errorf("selector %q matched %v, expected %v", tt.words, matched, tt.expected)
+		}
+	}
+
+	for _, words := range [][]string{{"colour==red"}, {"cpu"}, {"cpu>lots"}, {"name>3"}, {"(pid==1"}, {"pid==1", "&&"}} {
+		if _, _, err := compileSelector(words); err == nil {
+			t.Errorf("compileSelector(%q) should have failed", words)
+		}
+	}
+	if _, usesCPU, _ := compileSelector([]string{"name==x"}); usesCPU {
+		t.Error("selector without cpu should not sample it")
+	}
+}
+
+// TestJailWhereDryRun tests that a dry run lists the selected processes without jailing them
+func TestJailWhereDryRun(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := strconv.Itoa(cmd.Process.Pid)
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	output, err := captureOutput(func() error {
+		return executeCommand(state, `jail cpu where name=="sleep" && pid==`+pid+` --dry-run`)
+	})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if !strings.Contains(output, pid) || !strings.Contains(output, "1 processes would be jailed") {
+		t.Errorf("Dry run output missing the process:\n%s", output)
+	}
+	if len(state.ActiveJails) != 0 {
+		t.Errorf("Dry run jailed %d processes", len(state.ActiveJails))
+	}
+
+	if err := executeCommand(state, "jail cpu 1 --dry-run"); err == nil {
+		t.Error("--dry-run without a selector should fail")
+	}
+}
+
+// TestParseAuditRecord tests parsing raw audit records
+func TestParseAuditRecord(t *testing.T) {
+	record, serial, err := parseAuditRecord(`type=SYSCALL msg=audit(1700000000.123:456): arch=c000003e syscall=59 success=yes a0=7ffd1 pid=1234 ppid=1 auid=1000 comm="x" exe=2F746D702F612062 key="exec"`)
+	if err != nil {
+		t.Fatalf("parseAuditRecord failed: %v", err)
+	}
+	if serial != "456" {
+		t.Errorf("Expected serial 456, got %q", serial)
+	}
+	expected := map[string]string{"type": "SYSCALL", "syscall": "59", "pid": "1234", "comm": "x", "exe": "/tmp/a b", "a0": "7ffd1", "key": "exec"}
+	for field, value := range expected {
+		if record[field] != value {
+			t.Errorf("Expected %s=%q, got %q", field, value, record[field])
+		}
+	}
+
+	record, _, err = parseAuditRecord(`type=EXECVE msg=audit(1700000000.123:456): argc=2 a0="sh" a1=2D63206964`)
+	if err != nil || record["a1"] != "-c id" {
+		t.Errorf("Expected decoded EXECVE argument, got %q (%v)", record["a1"], err)
+	}
+	if record, _, err := parseAuditRecord(`type=EOE msg=audit(1700000000.123:456):`); err != nil || record["type"] != "EOE" {
+		t.Errorf("Expected EOE record, got %v (%v)", record, err)
+	}
+	if _, _, err := parseAuditRecord("garbage"); err == nil {
+		t.Error("Expected an error for a line that isn't a record")
+	}
+}
+
+// TestAuditRules tests jailing the processes of matching audit events
+func TestAuditRules(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := strconv.Itoa(cmd.Process.Pid)
+
+	rules := []AuditRule{
+		{Name: "tmp-exec", Match: map[string]string{"syscall": "execve", "exe": "/tmp/*"}, Jail: "rlimit", Args: []string{"nofile=64"}},
+	}
+	for i := range rules {
+		if err := compileAuditRule(&rules[i]); err != nil {
+			t.Fatalf("compileAuditRule failed: %v", err)
+		}
+	}
+	if err := compileAuditRule(&AuditRule{Name: "bad", Match: map[string]string{"exe": "*"}, Jail: "bogus"}); err == nil {
+		t.Error("Expected an error for an unknown jail type")
+	}
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	state.Config.AuditRules = rules
+	execve := strconv.Itoa(int(unix.SYS_EXECVE))
+	stream := strings.Join([]string{
+		`type=SYSCALL msg=audit(1.000:10): syscall=` + execve + ` pid=` + pid + ` ppid=1 exe="/usr/bin/ls"`,
+		`type=EOE msg=audit(1.000:10):`,
+		`type=SYSCALL msg=audit(1.000:11): syscall=` + execve + ` pid=` + pid + ` ppid=1 exe="/tmp/x/payload"`,
+		`type=EXECVE msg=audit(1.000:11): argc=1 a0="payload"`,
+		`type=SYSCALL msg=audit(1.000:12): syscall=` + execve + ` pid=` + pid + ` ppid=1 exe="/tmp/again"`,
+	}, "\n")
+
+	output, _ := captureOutput(func() error {
+		return consumeAuditEvents(state, strings.NewReader(stream))
+	})
+	jail, jailed := state.ActiveJails[cmd.Process.Pid]
+	if !jailed || !jail.HasJailType("rlimit") {
+		t.Fatalf("Expected process to be jailed by the audit rule:\n%s", output)
+	}
+	if jail.JailedBy != "audit rule tmp-exec" || !strings.Contains(jail.Reason, "event 11") {
+		t.Errorf("Unexpected attribution %q, reason %q", jail.JailedBy, jail.Reason)
+	}
+	if strings.Count(output, "matched event") != 1 {
+		t.Errorf("Expected a single match, the process was already jailed:\n%s", output)
+	}
+	if state.Operator != "" {
+		t.Errorf("Operator not restored: %q", state.Operator)
+	}
+}
+
+// TestWebhookAlert tests jailing the process of a Falco alert
+func TestWebhookAlert(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	state.Config.Webhook = WebhookConfig{
+		Token: "secret",
+		Profiles: []WebhookProfile{
+			{Name: "ignore-debug", Rule: "*", MinPriority: "bogus", Jail: "oom"},
+		},
+	}
+	if err := validateWebhookConfig(&state.Config.Webhook); err == nil {
+		t.Error("Expected an error for an unknown priority")
+	}
+	state.Config.Webhook.Profiles = []WebhookProfile{
+		{Name: "shell", Rule: "Terminal shell*", MinPriority: "warning", Jail: "rlimit", Args: []string{"nofile=64"}},
+	}
+	if err := validateWebhookConfig(&state.Config.Webhook); err != nil {
+		t.Fatalf("validateWebhookConfig failed: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWebhookAlert(state, w, r)
+	}))
+	defer server.Close()
+	post := func(token, body string) (int, webhookResponse) {
+		request, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		defer response.Body.Close()
+		var decoded webhookResponse
+		json.NewDecoder(response.Body).Decode(&decoded)
+		return response.StatusCode, decoded
+	}
+
+	alert := fmt.Sprintf(`{"rule": "Terminal shell in container", "priority": "%%s", "output_fields": {"proc.pid": %d, "container.id": "host"}}`, pid)
+	if status, _ := post("wrong", fmt.Sprintf(alert, "Critical")); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong token, got %d", status)
+	}
+	if status, response := post("secret", fmt.Sprintf(alert, "Notice")); status != http.StatusOK || response.Profile != "" {
+		t.Errorf("Expected a low priority alert to be ignored, got %d %+v", status, response)
+	}
+	var status int
+	var response webhookResponse
+	captureOutput(func() error {
+		status, response = post("secret", fmt.Sprintf(alert, "Critical"))
+		return nil
+	})
+	if status != http.StatusOK || response.Profile != "shell" || !reflect.DeepEqual(response.Jailed, []int{pid}) {
+		t.Fatalf("Expected the process to be jailed, got %d %+v", status, response)
+	}
+	if jail := state.ActiveJails[pid]; jail == nil || !strings.HasPrefix(jail.JailedBy, "webhook profile shell") {
+		t.Errorf("Unexpected jail %+v", jail)
+	}
+	if status, response := post("secret", fmt.Sprintf(alert, "Critical")); status != http.StatusOK || len(response.Jailed) != 0 {
+		t.Errorf("Expected an already jailed process to be skipped, got %d %+v", status, response)
+	}
+	if status, _ := post("secret", "not json"); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid alert, got %d", status)
+	}
+}
+
+// TestProcessConnections tests listing the sockets of a process
+func TestProcessConnections(t *testing.T) {
+	for value, expected := range map[string]string{
+		"0100007F:0CEA":                         "127.0.0.1:3306",
+		"00000000:0000":                         "*:*",
+		"00000000:0050":                         "*:80",
+		"00000000000000000000000001000000:01BB": "[::1]:443",
+	} {
+		if address, err := parseProcNetAddress(value); err != nil || address != expected {
+			t.Errorf("parseProcNetAddress(%q) = %q (%v), expected %q", value, address, err, expected)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+
+	found := false
+	for _, connection := range getProcessConnections([]int{os.Getpid()}) {
+		if connection.Local == listener.Addr().String() && connection.State == "LISTEN" && connection.Protocol == "tcp" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Listening socket %s not found", listener.Addr())
+	}
+
+	state := NewJailerState()
+	output, err := captureOutput(func() error {
+		return executeCommand(state, "connections "+strconv.Itoa(os.Getpid())+" --listening")
+	})
+	if err != nil || !strings.Contains(output, listener.Addr().String()) {
+		t.Errorf("connections output missing the listener (%v):\n%s", err, output)
+	}
+}
+
+// TestCapture tests the pieces of the packet capture of network jails
+func TestCapture(t *testing.T) {
+	state := &JailerState{FirewallTool: "nftables", CgroupVersion: 2}
+	expected := `socket cgroupv2 level 1 "jail-network" log group 7401`
+	if args := strings.Join(captureRuleSpec(state, nil), " "); args != expected {
+		t.Errorf("Unexpected nftables capture rule: %s", args)
+	}
+	state = &JailerState{FirewallTool: "iptables", CgroupVersion: 1}
+	expected = "-m cgroup --cgroup " + netClsClassID + " -j NFLOG --nflog-group 7401"
+	if args := strings.Join(captureRuleSpec(state, nil), " "); args != expected {
+		t.Errorf("Unexpected iptables capture rule: %s", args)
+	}
+
+	// An NFLOG packet message with a timestamp and a 4 byte payload
+	data := []byte{unix.AF_INET, 0, 0x1c, 0xe9}
+	attribute := func(attrType uint16, value []byte) {
+		header := make([]byte, 4)
+		binary.NativeEndian.PutUint16(header, uint16(4+len(value)))
+		binary.NativeEndian.PutUint16(header[2:], attrType)
+		data = append(data, header...)
+		data = append(data, value...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	stamp := make([]byte, 16)
+	binary.BigEndian.PutUint64(stamp, 1700000000)
+	binary.BigEndian.PutUint64(stamp[8:], 250)
+	attribute(nfulaTimestamp, stamp)
+	attribute(nfulaPayload, []byte{0x45, 0, 0, 4})
+	message := syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: nfnlSubsysULOG<<8 | nfulnlMsgPacket}, Data: data}
+	payload, when, ok := parseNflogPacket(message)
+	if !ok || !bytes.Equal(payload, []byte{0x45, 0, 0, 4}) || when.Unix() != 1700000000 || when.Nanosecond() != 250000 {
+		t.Errorf("Unexpected NFLOG packet %v at %v (%v)", payload, when, ok)
+	}
+
+	var buffer bytes.Buffer
+	pcap, err := newPcapWriter(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pcap.writePacket(when, payload); err != nil || pcap.flush() != nil {
+		t.Fatalf("writePacket failed: %v", err)
+	}
+	content := buffer.Bytes()
+	if len(content) != 24+16+4 || binary.LittleEndian.Uint32(content) != 0xa1b2c3d4 ||
+		binary.LittleEndian.Uint32(content[20:]) != pcapLinkTypeRaw || binary.LittleEndian.Uint32(content[28:]) != 250 {
+		t.Errorf("Unexpected pcap content %x", content)
+	}
+
+	if err := capturePackets(NewJailerState(), os.Getpid(), filepath.Join(t.TempDir(), "x.pcap"), 0); err == nil {
+		t.Error("Expected an error for a process without network jail")
+	}
+}
+
+// TestProxyJail tests the rules and restrictions of the proxy jail
+func TestProxyJail(t *testing.T) {
+	for _, value := range []string{"10.0.0.5", "0.0.0.0:3128", "proxy.invalid:3128"} {
+		if _, err := parseNetworkProxy(value); err == nil {
+			t.Errorf("parseNetworkProxy(%q) should have failed", value)
+		}
+	}
+
+	state := NewJailerState()
+	state.FirewallTool = "nftables"
+	state.CgroupVersion = 2
+	state.Config.NetworkProxy = "10.0.0.5:3128"
+	rules, err := proxyJailRules(state, "-A")
+	if err != nil {
+		t.Fatalf("proxyJailRules failed: %v", err)
+	}
+	expected := []string{
+		`nft add rule inet jail output socket cgroupv2 level 1 "jail-proxy" ip daddr 10.0.0.5 tcp dport 3128 accept`,
+		`nft add rule inet jail output socket cgroupv2 level 1 "jail-proxy" counter drop`,
+		`nft add rule inet jail input socket cgroupv2 level 1 "jail-proxy" ip saddr 10.0.0.5 tcp sport 3128 accept`,
+		`nft add rule inet jail input socket cgroupv2 level 1 "jail-proxy" counter drop`,
+	}
+	for i, rule := range rules {
+		if strings.Join(rule, " ") != expected[i] {
+			t.Errorf("Rule %d: expected %s, got %s", i, expected[i], strings.Join(rule, " "))
+		}
+	}
+
+	state.FirewallTool = "iptables"
+	state.CgroupVersion = 1
+	rules, err = proxyJailRules(state, "-D")
+	if err != nil || strings.Join(rules[0], " ") != "iptables -D OUTPUT -m cgroup --cgroup "+proxyClassID+" -d 10.0.0.5 -p tcp --dport 3128 -j ACCEPT" {
+		t.Errorf("Unexpected iptables rules %v (%v)", rules, err)
+	}
+	state.Config.NetworkProxy = "[2001:db8::1]:3128"
+	if _, err := proxyJailRules(state, "-A"); err == nil {
+		t.Error("iptables rules for an IPv6 proxy should fail")
+	}
+
+	jail := &Jail{JailTypes: []string{"cpu"}}
+	if err := checkProxyJailCombination(state, jail, "proxy"); err == nil {
+		t.Error("proxy jail should not combine with a cpu jail")
+	}
+	jail.JailTypes = []string{"proxy"}
+	if err := checkProxyJailCombination(state, jail, "network"); err == nil {
+		t.Error("network jail should not combine with a proxy jail")
+	}
+	if err := checkProxyJailCombination(state, jail, "rlimit"); err != nil {
+		t.Errorf("rlimit jail should combine with a proxy jail: %v", err)
+	}
+	state.Config.NetworkProxy = ""
+	if err := checkProxyJailCombination(state, nil, "proxy"); err == nil {
+		t.Error("proxy jail should need network_proxy")
+	}
+}
+
+// TestGeneratedJailRules tests the rules shown by export-rules for jail types
+func TestGeneratedJailRules(t *testing.T) {
+	state := NewJailerState()
+	state.FirewallTool = "nftables"
+	state.CgroupVersion = 2
+	rules, err := generatedJailRules(state, []string{"n"})
+	if err != nil {
+		t.Fatalf("generatedJailRules failed: %v", err)
+	}
+	expected := `#!/usr/sbin/nft -f
+# network jails (nftables, cgroups v2)
+add table inet jail
+add chain inet jail output { type filter hook output priority 100 ; }
+add chain inet jail input { type filter hook input priority 100 ; }
+add rule inet jail output socket cgroupv2 level 1 "jail-network" counter drop
+add rule inet jail input socket cgroupv2 level 1 "jail-network" counter drop
+add rule inet jail output socket cgroupv2 level 1 "jail-network-cpu" counter drop
+add rule inet jail input socket cgroupv2 level 1 "jail-network-cpu" counter drop
+`
+	if rules != expected {
+		t.Errorf("Unexpected nftables rules:\n%s", rules)
+	}
+
+	state.FirewallTool = "iptables"
+	state.CgroupVersion = 1
+	state.Config.NetworkProxy = "10.0.0.5:3128"
+	rules, err = generatedJailRules(state, []string{"network", "proxy"})
+	if err != nil {
+		t.Fatalf("generatedJailRules failed: %v", err)
+	}
+	for _, rule := range []string{
+		"iptables -A OUTPUT -m cgroup --cgroup " + netClsClassID + " -j DROP",
+		"iptables -A INPUT -m cgroup --cgroup " + proxyClassID + " -s 10.0.0.5 -p tcp --sport 3128 -j ACCEPT",
+	} {
+		if !strings.Contains(rules, rule+"\n") {
+			t.Errorf("Expected %q in the iptables rules:\n%s", rule, rules)
+		}
+	}
+	if _, err := generatedJailRules(state, []string{"cpu"}); err == nil {
+		t.Error("cpu jails should have no firewall rules")
+	}
+}
+
+// TestJailNetworkRules tests the rules of each network jail, matching its classid on
+// cgroups v1 and its cgroup on v2
+func TestJailNetworkRules(t *testing.T) {
+	state := NewJailerState()
+	state.FirewallTool = "iptables"
+	state.CgroupVersion = 1
+	state.ActiveJails[100] = &Jail{PID: 100, ClassID: "0x00110001"}
+	state.ActiveJails[200] = &Jail{PID: 200, ClassID: "0x00110003"}
+	classID, err := allocateClassID(state)
+	if err != nil || classID != "0x00110002" {
+		t.Errorf("Expected classid 0x00110002, got %s (%v)", classID, err)
+	}
+
+	expected := "-m cgroup --cgroup 0x00110003 -j DROP"
+	if rule := strings.Join(dropRuleSpec(state, jailNetworkMatch(state, state.ActiveJails[200])), " "); rule != expected {
+		t.Errorf("Unexpected drop rule: %s", rule)
+	}
+	expected = "-m cgroup --cgroup " + netClsClassID + " -j DROP"
+	if rule := strings.Join(dropRuleSpec(state, jailNetworkMatch(state, &Jail{PID: 300})), " "); rule != expected {
+		t.Errorf("Unexpected drop rule of a jail without classid: %s", rule)
+	}
+
+	state.FirewallTool = "nftables"
+	expected = "meta cgroup 0x00110001 counter drop"
+	if rule := strings.Join(dropRuleSpec(state, jailNetworkMatch(state, state.ActiveJails[100])), " "); rule != expected {
+		t.Errorf("Unexpected nftables drop rule: %s", rule)
+	}
+
+	// cgroups v2 matches the dedicated cgroup of the jail, or the shared ones
+	state.CgroupVersion = 2
+	expected = `socket cgroupv2 level 1 "jail-400" counter drop`
+	if rule := strings.Join(dropRuleSpec(state, jailNetworkMatch(state, &Jail{PID: 400, NetworkCgroup: "jail-400"})), " "); rule != expected {
+		t.Errorf("Unexpected cgroups v2 drop rule: %s", rule)
+	}
+	state.FirewallTool = "iptables"
+	expected = "-A OUTPUT -m cgroup --path jail-network -j DROP,-A INPUT -m cgroup --path jail-network -j DROP," +
+		"-A OUTPUT -m cgroup --path jail-network-cpu -j DROP,-A INPUT -m cgroup --path jail-network-cpu -j DROP"
+	if rules := strings.Join(describeNetworkJailRules(state), ","); rules != expected {
+		t.Errorf("Unexpected shared cgroups v2 rules: %s", rules)
+	}
+}
+
+// TestAllowedIfaces tests the parsing of --allow-iface and the rules accepting the interfaces
+func TestAllowedIfaces(t *testing.T) {
+	ifaces, err := parseAllowedIfaces("eth1, vlan*")
+	if err != nil || strings.Join(ifaces, ",") != "eth1,vlan*" {
+		t.Errorf("Unexpected interfaces %v (%v)", ifaces, err)
+	}
+	for _, value := range []string{"", "eth1,", "a-very-long-interface", "eth/1", "e*th"} {
+		if _, err := parseAllowedIfaces(value); err == nil {
+			t.Errorf("Expected an error for interfaces %q", value)
+		}
+	}
+
+	state := NewJailerState()
+	state.FirewallTool = "nftables"
+	state.CgroupVersion = 2
+	match := jailNetworkMatch(state, &Jail{PID: 400, NetworkCgroup: "jail-400"})
+	expected := `socket cgroupv2 level 1 "jail-400" oifname "eth1" accept`
+	if rule := strings.Join(ifaceRuleSpec(state, match, "output", "eth1"), " "); rule != expected {
+		t.Errorf("Unexpected nftables interface rule: %s", rule)
+	}
+	expected = `socket cgroupv2 level 1 "jail-400" iifname "vlan*" accept`
+	if rule := strings.Join(ifaceRuleSpec(state, match, "input", "vlan*"), " "); rule != expected {
+		t.Errorf("Unexpected nftables input interface rule: %s", rule)
+	}
+
+	state.FirewallTool = "iptables"
+	state.CgroupVersion = 1
+	match = jailNetworkMatch(state, &Jail{PID: 100, ClassID: "0x00110001"})
+	expected = "-m cgroup --cgroup 0x00110001 -i vlan+ -j ACCEPT"
+	if rule := strings.Join(ifaceRuleSpec(state, match, "input", "vlan*"), " "); rule != expected {
+		t.Errorf("Unexpected iptables interface rule: %s", rule)
+	}
+}
+
+// TestCountryNetworks tests the country lists and the rules on the country sets
+func TestCountryNetworks(t *testing.T) {
+	countries, err := parseCountries("cn, RU")
+	if err != nil || strings.Join(countries, ",") != "CN,RU" {
+		t.Errorf("Unexpected countries %v (%v)", countries, err)
+	}
+	for _, value := range []string{"", "CHN", "C1", "CN,"} {
+		if _, err := parseCountries(value); err == nil {
+			t.Errorf("Expected an error for countries %q", value)
+		}
+	}
+
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		if r.URL.Path == "/bad.zone" {
+			fmt.Fprintln(w, "<html>")
+			return
+		}
+		fmt.Fprintln(w, "# generated list")
+		fmt.Fprintln(w, "1.0.1.0/24")
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "1.0.2.0/23")
+	}))
+	defer server.Close()
+
+	config := GeoIPConfig{IPv4URL: server.URL + "/{country}.zone", IPv6URL: "off", CacheDir: t.TempDir()}
+	if err := validateGeoIPConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	networks4, networks6, err := countryNetworks(config, []string{"CN"})
+	if err != nil || strings.Join(networks4, ",") != "1.0.1.0/24,1.0.2.0/23" || len(networks6) != 0 {
+		t.Errorf("Unexpected networks %v %v (%v)", networks4, networks6, err)
+	}
+	if _, _, err := countryNetworks(config, []string{"CN"}); err != nil || downloads != 1 {
+		t.Errorf("Expected the cached list to be used, %d downloads (%v)", downloads, err)
+	}
+	if _, _, err := countryNetworks(config, []string{"BAD"}); err == nil {
+		t.Error("Expected an error for an invalid list")
+	}
+
+	state := NewJailerState()
+	state.FirewallTool = "nftables"
+	state.CgroupVersion = 2
+	match := jailNetworkMatch(state, &Jail{PID: 400, NetworkCgroup: "jail-400"})
+	expected := `socket cgroupv2 level 1 "jail-400" ip6 saddr @geo6_400 counter drop`
+	if rule := strings.Join(setRuleSpec(state, match, "input", "ip6", "geo6_400", "drop"), " "); rule != expected {
+		t.Errorf("Unexpected nftables country rule: %s", rule)
+	}
+	state.FirewallTool = "iptables"
+	state.CgroupVersion = 1
+	match = jailNetworkMatch(state, &Jail{PID: 100, ClassID: "0x00110001"})
+	expected = "-m cgroup --cgroup 0x00110001 -m set --match-set geo4_100 dst -j ACCEPT"
+	if rule := strings.Join(setRuleSpec(state, match, "output", "ip", "geo4_100", "accept"), " "); rule != expected {
+		t.Errorf("Unexpected iptables country rule: %s", rule)
+	}
+}
+
+// TestBlocklistFeeds tests the download of the blocklist feeds and their freshness
+func TestBlocklistFeeds(t *testing.T) {
+	for _, config := range []BlocklistConfig{
+		{Feeds: []BlocklistFeed{{Name: "bad name", URL: "http://x"}}},
+		{Feeds: []BlocklistFeed{{Name: "drop", URL: "http://x"}, {Name: "drop", URL: "http://y"}}},
+		{Feeds: []BlocklistFeed{{Name: "drop"}}},
+		{Refresh: "10s"},
+	} {
+		if err := validateBlocklistConfig(&config); err == nil {
+			t.Errorf("Expected an error for blocklists %+v", config)
+		}
+	}
+
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing || r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "; Spamhaus DROP List")
+		fmt.Fprintln(w, "1.10.16.0/20 ; SBL256894")
+		fmt.Fprintln(w, "2001:db8::/32")
+	}))
+	defer server.Close()
+
+	config := BlocklistConfig{Feeds: []BlocklistFeed{{Name: "drop", URL: server.URL}, {Name: "missing", URL: server.URL + "/missing"}},
+		CacheDir: t.TempDir()}
+	if err := validateBlocklistConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	failing = true
+	if _, _, statuses := downloadBlocklistFeeds(config, time.Now()); statuses["drop"].Error == "" || !statuses["drop"].UpdatedAt.IsZero() {
+		t.Errorf("Expected a failed feed without networks, got %+v", statuses["drop"])
+	}
+	failing = false
+	networks4, networks6, statuses := downloadBlocklistFeeds(config, time.Now())
+	if strings.Join(networks4, ",") != "1.10.16.0/20" || strings.Join(networks6, ",") != "2001:db8::/32" || statuses["drop"].Entries != 2 {
+		t.Errorf("Unexpected networks %v %v", networks4, networks6)
+	}
+
+	// A failed refresh keeps the previous download
+	failing = true
+	later := time.Now().Add(2 * time.Hour)
+	if networks4, _, statuses = downloadBlocklistFeeds(config, later); len(networks4) != 1 || statuses["drop"].Error == "" {
+		t.Errorf("Expected the cached feeds to be kept, got %v %+v", networks4, statuses["drop"])
+	}
+
+	state := NewJailerState()
+	state.Config.Blocklists = config
+	if rows := describeBlocklists(state, later); rows[0][3] != "not loaded" {
+		t.Errorf("Unexpected status of an unloaded feed: %v", rows[0])
+	}
+	state.BlocklistFeeds = statuses
+	if rows := describeBlocklists(state, later); rows[0][1] != "2" || !strings.HasPrefix(rows[0][3], "stale: ") {
+		t.Errorf("Unexpected status of a failed feed: %v", rows[0])
+	}
+	statuses["drop"].Error = ""
+	if rows := describeBlocklists(state, time.Now()); rows[0][3] != "ok" || rows[1][2] != "never" {
+		t.Errorf("Unexpected status of the feeds: %v", rows)
+	}
+}
+
+// TestReclaimJailMemory tests the checks of reclaim and the write to memory.reclaim
+func TestReclaimJailMemory(t *testing.T) {
+	state := NewJailerState()
+	state.CgroupVersion = 1
+	state.ActiveJails[100] = &Jail{PID: 100, JailTypes: []string{"cpu"}, CpuPercent: 20}
+	state.ActiveJails[200] = &Jail{PID: 200, JailTypes: []string{"rlimit"}}
+	if err := reclaimJailMemory(state, 100, 1<<20); err == nil || !strings.Contains(err.Error(), "cgroups v2") {
+		t.Errorf("Expected a cgroups v2 error, got %v", err)
+	}
+	state.CgroupVersion = 2
+	if err := reclaimJailMemory(state, 300, 1<<20); err == nil {
+		t.Error("Expected an error for a process that isn't jailed")
+	}
+	if err := reclaimJailMemory(state, 200, 1<<20); err == nil || !strings.Contains(err.Error(), "no jail cgroup") {
+		t.Errorf("Expected a jail cgroup error, got %v", err)
+	}
+	state.ActiveJails[100].CpuPercent = 0
+	if err := reclaimJailMemory(state, 100, 1<<20); err == nil || !strings.Contains(err.Error(), "shares") {
+		t.Errorf("Expected a shared cgroup error, got %v", err)
+	}
+
+	dir := t.TempDir()
+	if _, _, err := reclaimCgroupMemory(dir, 1<<20); err == nil {
+		t.Error("Expected an error without memory controller")
+	}
+	os.WriteFile(filepath.Join(dir, "memory.current"), []byte("4194304\n"), 0644)
+	if _, _, err := reclaimCgroupMemory(dir, 1<<20); err == nil || !strings.Contains(err.Error(), "5.19") {
+		t.Errorf("Expected a kernel version error, got %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "memory.reclaim"), nil, 0644)
+	before, after, err := reclaimCgroupMemory(dir, 1<<20)
+	if err != nil || before != 4<<20 || after != 4<<20 {
+		t.Errorf("Unexpected readings %d -> %d (%v)", before, after, err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "memory.reclaim")); string(content) != "1048576\n" {
+		t.Errorf("Unexpected memory.reclaim write %q", content)
+	}
+}
+
+// TestCpuSqueeze tests the steps of a squeezed CPU limit
+func TestCpuSqueeze(t *testing.T) {
+	if percent, over, err := parseSqueeze("50%:5m"); err != nil || percent != 50 || over != 5*time.Minute {
+		t.Errorf("Unexpected squeeze %d%% over %s (%v)", percent, over, err)
+	}
+	for _, value := range []string{"50%", "50%:5s", "0%:5m", "50%:soon"} {
+		if _, _, err := parseSqueeze(value); err == nil {
+			t.Errorf("Expected an error for --squeeze %s", value)
+		}
+	}
+
+	since := time.Now()
+	squeeze := &cpuSqueeze{StartPercent: 800, Since: since, Over: 10 * time.Minute}
+	if percent := squeeze.percentAt(50, since); percent != 800 {
+		t.Errorf("Expected the squeeze to start at 800%%, got %d%%", percent)
+	}
+	if percent := squeeze.percentAt(50, since.Add(5*time.Minute)); percent != 200 {
+		t.Errorf("Expected 200%% halfway, got %d%%", percent)
+	}
+	previous := 800
+	for minute := 1; minute <= 10; minute++ {
+		percent := squeeze.percentAt(50, since.Add(time.Duration(minute)*time.Minute))
+		if percent >= previous {
+			t.Errorf("Expected the limit to tighten at minute %d, got %d%% after %d%%", minute, percent, previous)
+		}
+		previous = percent
+	}
+	if previous != 50 {
+		t.Errorf("Expected the squeeze to end at 50%%, got %d%%", previous)
+	}
+	if newCpuSqueeze(100*runtime.NumCPU(), time.Minute, since) != nil {
+		t.Error("Expected no squeeze for a limit of every core")
+	}
+
+	state := NewJailerState()
+	state.CgroupVersion = 2
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "cpu.max"), []byte("max 100000\n"), 0644)
+	squeeze.Since = time.Now().Add(-5 * time.Minute)
+	jail := &Jail{PID: 4242, JailTypes: []string{"cpu"}, CpuPercent: 50, CgroupPath: dir, Squeeze: squeeze}
+	state.ActiveJails[4242] = jail
+	squeezeJails(state, time.Now())
+	if content, _ := os.ReadFile(filepath.Join(dir, "cpu.max")); string(content) != "200000 100000\n" || squeeze.Applied != 200 {
+		t.Errorf("Unexpected squeezed cpu.max %q", content)
+	}
+	squeeze.Since = time.Now().Add(-time.Hour)
+	squeezeJails(state, time.Now())
+	if content, _ := os.ReadFile(filepath.Join(dir, "cpu.max")); string(content) != "50000 100000\n" || jail.Squeeze != nil {
+		t.Errorf("Expected the squeeze to end at the limit, cpu.max %q", content)
+	}
+}
+
+// TestAdaptiveCpu tests the adjustments of the adaptive CPU limits
+func TestAdaptiveCpu(t *testing.T) {
+	if target, err := parseAdaptiveTarget("70%"); err != nil || target != 70 {
+		t.Errorf("Unexpected target %d (%v)", target, err)
+	}
+	for _, value := range []string{"0%", "100%", "high"} {
+		if _, err := parseAdaptiveTarget(value); err == nil {
+			t.Errorf("Expected an error for --adaptive %s", value)
+		}
+	}
+
+	for _, test := range []struct {
+		applied, ceiling, target int
+		host, jail               float64
+		expected                 int
+	}{
+		{800, 800, 70, 90, 400, 520}, // Host over the target, the jail gives up the excess
+		{100, 800, 70, 50, 100, 180}, // Headroom left, the throttled jail gets some of it
+		{10, 800, 70, 100, 10, 1},    // Never below 1%
+		{700, 800, 70, 10, 600, 800}, // Never above the ceiling
+	} {
+		if next := adaptCpuPercent(test.applied, test.ceiling, test.target, test.host, test.jail, 8); next != test.expected {
+			t.Errorf("Expected %d%% from %d%% with the host at %.0f%% and the jail at %.0f%%, got %d%%",
+				test.expected, test.applied, test.host, test.jail, next)
+		}
+	}
+
+	times, err := readHostCPUTimes()
+	if err != nil || times.Total == 0 || times.Busy > times.Total {
+		t.Errorf("Unexpected host CPU times %+v (%v)", times, err)
+	}
+	jail := &Jail{CpuPercent: 800, Adaptive: &adaptiveCpu{TargetPercent: 70, Applied: 250}}
+	if percent := effectiveCpuPercent(jail, time.Now()); percent != 250 {
+		t.Errorf("Expected the adaptive limit to apply, got %d%%", percent)
+	}
+}
+
+// TestNestJailCgroup tests the placement of the dedicated jail cgroups below the original cgroup
+func TestNestJailCgroup(t *testing.T) {
+	state := NewJailerState()
+	state.CgroupVersion = 2
+	state.CpuCgroupPath = "/sys/fs/cgroup/jail-cpu"
+	jail := &Jail{PID: 4242, OriginalCgroup: "/system.slice/app.service", JailTypes: []string{"network"}}
+	if path := jailCgroupPath(state, jail); path != "/sys/fs/cgroup/jail-4242" {
+		t.Errorf("Unexpected top-level jail cgroup %s", path)
+	}
+	if jail.usesDedicatedCgroup() {
+		t.Error("A network jail without a cgroup of its own should not use a dedicated cgroup")
+	}
+
+	jail.CgroupPath = "/sys/fs/cgroup/system.slice/app.service/jail-4242"
+	if path := jailCgroupPath(state, jail); path != jail.CgroupPath {
+		t.Errorf("Unexpected nested jail cgroup %s", path)
+	}
+	if !jail.usesDedicatedCgroup() {
+		t.Error("A nested jail should use its dedicated cgroup")
+	}
+	state.FirewallTool = "nftables"
+	jail.NetworkCgroup = "system.slice/app.service/jail-4242"
+	expected := `socket cgroupv2 level 3 "system.slice/app.service/jail-4242"`
+	if match := strings.Join(jailNetworkMatch(state, jail), " "); match != expected {
+		t.Errorf("Unexpected nested cgroup match: %s", match)
+	}
+
+	// A jail at the top level stays there, and cgroups v1 is never nested
+	topLevel := &Jail{PID: 4242, OriginalCgroup: "/system.slice/app.service", JailTypes: []string{"cpu", "rdma"}}
+	if err := nestJailCgroup(state, topLevel, "rdma"); err != nil || topLevel.CgroupPath != "" {
+		t.Errorf("Expected the jail to stay at the top level, got %q (%v)", topLevel.CgroupPath, err)
+	}
+	state.CgroupVersion = 1
+	if err := nestJailCgroup(state, &Jail{PID: 4242, OriginalCgroup: "/user.slice"}, "cpu"); err != nil {
+		t.Errorf("nestJailCgroup on cgroups v1 failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("cpu memory\n"), 0644)
+	if err := delegateController(dir, "memory"); err != nil {
+		t.Errorf("delegateController of an enabled controller failed: %v", err)
+	}
+	if err := delegateController(filepath.Join(dir, "missing"), "cpu"); err == nil {
+		t.Error("delegateController should fail without cgroup.subtree_control")
+	}
+}
+
+// TestSessionRuleSpecs tests the rules keeping the sessions open with --allow-established
+func TestSessionRuleSpecs(t *testing.T) {
+	session := socketEntry{Protocol: "tcp6", Local: "[::ffff:10.0.0.5]:5432", Remote: "[::ffff:10.0.0.9]:41000", State: "ESTABLISHED"}
+	state := &JailerState{FirewallTool: "nftables", CgroupVersion: 2}
+	output, input, filtered := sessionRuleSpecs(state, nil, session)
+	if !filtered {
+		t.Fatalf("Session not filtered by nftables")
+	}
+	expected := `socket cgroupv2 level 1 "jail-network" ct state established,related ip saddr 10.0.0.5 ip daddr 10.0.0.9 tcp sport 5432 tcp dport 41000 accept`
+	if rule := strings.Join(output, " "); rule != expected {
+		t.Errorf("Unexpected output rule: %s", rule)
+	}
+	expected = `socket cgroupv2 level 1 "jail-network" ct state established,related ip saddr 10.0.0.9 ip daddr 10.0.0.5 tcp sport 41000 tcp dport 5432 accept`
+	if rule := strings.Join(input, " "); rule != expected {
+		t.Errorf("Unexpected input rule: %s", rule)
+	}
+
+	state = &JailerState{FirewallTool: "iptables", CgroupVersion: 1}
+	output, _, _ = sessionRuleSpecs(state, nil, socketEntry{Protocol: "udp", Local: "10.0.0.5:53", Remote: "10.0.0.1:53"})
+	expected = "-m cgroup --cgroup " + netClsClassID + " -m conntrack --ctstate ESTABLISHED,RELATED -s 10.0.0.5 -d 10.0.0.1 -p udp --sport 53 --dport 53 -j ACCEPT"
+	if rule := strings.Join(output, " "); rule != expected {
+		t.Errorf("Unexpected iptables rule: %s", rule)
+	}
+	if _, _, filtered := sessionRuleSpecs(state, nil, socketEntry{Protocol: "tcp6", Local: "[2001:db8::1]:22", Remote: "[2001:db8::2]:5000"}); filtered {
+		t.Errorf("IPv6 session filtered by iptables")
+	}
+	if _, _, filtered := sessionRuleSpecs(state, nil, socketEntry{Protocol: "tcp", Local: "*:22", Remote: "*:*"}); filtered {
+		t.Errorf("Listening socket treated as a session")
+	}
+
+	if err := executeCommand(NewJailerState(), "jail cpu --allow-established 1234"); err == nil ||
+		!strings.Contains(err.Error(), "only applies to network jails") {
+		t.Errorf("Expected --allow-established to be refused for cpu jails, got %v", err)
+	}
+}
+
+// TestAllowlist tests the validation and listing of the allowlists of network jails
+func TestAllowlist(t *testing.T) {
+	for value, expected := range map[string]string{"10.1.2.3": "ip", "10.8.0.0/16": "ip", "2001:db8::1": "ip6", "2001:db8::/32": "ip6"} {
+		if family, err := allowedAddressFamily(value); err != nil || family != expected {
+			t.Errorf("allowedAddressFamily(%q) = %q, %v, expected %q", value, family, err, expected)
+		}
+	}
+	if _, err := allowedAddressFamily("example.com"); err == nil {
+		t.Errorf("Expected an error for a host name")
+	}
+
+	listing := `table inet jail {
+	set allow4_1234 {
+		type ipv4_addr
+		flags interval
+		elements = { 10.1.2.3, 10.8.0.0/16,
+			     192.168.1.1 }
+	}
+}`
+	expected := []string{"10.1.2.3", "10.8.0.0/16", "192.168.1.1"}
+	if elements := parseNftSetElements(listing); !reflect.DeepEqual(elements, expected) {
+		t.Errorf("parseNftSetElements = %v, expected %v", elements, expected)
+	}
+	if elements := parseNftSetElements("set allow6_1234 {\n\ttype ipv6_addr\n}"); elements != nil {
+		t.Errorf("Expected no elements in an empty set, got %v", elements)
+	}
+
+	state := NewJailerState()
+	state.FirewallTool = "nftables"
+	state.ActiveJails[1234] = &Jail{PID: 1234, JailTypes: []string{"cpu"}}
+	if err := executeCommand(state, "allow 1234 add 10.1.2.3"); err == nil || !strings.Contains(err.Error(), "not jailed with network jail") {
+		t.Errorf("Expected the allowlist of a cpu jail to be refused, got %v", err)
+	}
+	state.ActiveJails[1234].JailTypes = []string{"network"}
+	if err := executeCommand(state, "allow 1234 add not-an-address"); err == nil || !strings.Contains(err.Error(), "invalid address") {
+		t.Errorf("Expected an invalid address to be refused, got %v", err)
+	}
+	if err := executeCommand(state, "allow 1234 list extra"); err == nil || !strings.Contains(err.Error(), "usage") {
+		t.Errorf("Expected a usage error, got %v", err)
+	}
+	state.FirewallTool = "iptables"
+	if err := executeCommand(state, "allow 1234 list"); err == nil || !strings.Contains(err.Error(), "nftables") {
+		t.Errorf("Expected allowlists to need nftables, got %v", err)
+	}
+}
+
+// TestSimulate tests applying a jail for a while and reverting it with its impact report
+func TestSimulate(t *testing.T) {
+	counters := readSnmpCounters("Tcp: RtoAlgorithm MaxConn RetransSegs OutRsts\nTcp: 1 -1 120 4\nUdp: InDatagrams InErrors\nUdp: 86 2\n")
+	expected := map[string]uint64{"Tcp.RtoAlgorithm": 1, "Tcp.RetransSegs": 120, "Tcp.OutRsts": 4, "Udp.InDatagrams": 86, "Udp.InErrors": 2}
+	if !reflect.DeepEqual(counters, expected) {
+		t.Errorf("readSnmpCounters = %v, expected %v", counters, expected)
+	}
+
+	start := simulationSample{At: time.Unix(0, 0), CPUTicks: 100, Counters: map[string]uint64{"Tcp.RetransSegs": 10}}
+	end := simulationSample{At: time.Unix(2, 0), CPUTicks: 150, Counters: map[string]uint64{"Tcp.RetransSegs": 50}}
+	rates := simulationRates(start, end)
+	if rates["CPU %"] != 25 || rates["Tcp.RetransSegs/s"] != 20 {
+		t.Errorf("Unexpected rates: %v", rates)
+	}
+	if _, found := rates["Dropped packets/s"]; found {
+		t.Errorf("Dropped packets reported without readings: %v", rates)
+	}
+
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := strconv.Itoa(cmd.Process.Pid)
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	if err := executeCommand(state, "simulate bogus "+pid); err == nil || !strings.Contains(err.Error(), "unknown jail type") {
+		t.Errorf("Expected an unknown jail type error, got %v", err)
+	}
+	output, err := captureOutput(func() error {
+		return executeCommand(state, "simulate rlimit "+pid+" nofile=64 --duration 1s")
+	})
+	if err != nil {
+		t.Fatalf("simulate failed: %v\n%s", err, output)
+	}
+	if !strings.Contains(output, "Impact of the rlimit jail") || !strings.Contains(output, "CPU %") {
+		t.Errorf("Missing impact report:\n%s", output)
+	}
+	if _, jailed := state.ActiveJails[cmd.Process.Pid]; jailed {
+		t.Errorf("Simulated jail not reverted")
+	}
+}
+
+// TestJailTemplates tests exporting the jails as a template and importing it
+func TestJailTemplates(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := strconv.Itoa(cmd.Process.Pid)
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	if _, err := captureOutput(func() error {
+		return executeCommand(state, "jail rlimit "+pid+" nofile=64 --reason maintenance")
+	}); err != nil {
+		t.Fatalf("jail failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "template.json")
+	if _, err := captureOutput(func() error {
+		return executeCommand(state, "export "+path+" --format template")
+	}); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	template, err := loadTemplate(path)
+	if err != nil {
+		t.Fatalf("loadTemplate failed: %v", err)
+	}
+	expected := TemplateJail{Selector: `name=="sleep"`, Jail: "rlimit", Args: []string{"nofile=64"}, Reason: "maintenance"}
+	if len(template.Jails) != 1 || template.Jails[0].Selector != expected.Selector || template.Jails[0].Jail != expected.Jail ||
+		!reflect.DeepEqual(template.Jails[0].Args, expected.Args) || template.Jails[0].Reason != expected.Reason {
+		t.Fatalf("Unexpected template: %+v", template.Jails)
+	}
+
+	// The selector is narrowed to the test process, other sleep processes may run
+	content := `{"jails": [{"selector": "pid==` + pid + `", "jail": "cpu-less", "args": []}]}`
+	os.WriteFile(path, []byte(content), 0600)
+	if _, err := loadTemplate(path); err == nil || !strings.Contains(err.Error(), "unknown jail type") {
+		t.Errorf("Expected an unknown jail type error, got %v", err)
+	}
+	content = `{"jails": [{"selector": "pid==` + pid + `", "jail": "rlimit", "args": ["nofile=32"], "reason": "window"}]}`
+	os.WriteFile(path, []byte(content), 0600)
+
+	state = NewJailerState()
+	state.Config.AuditLog = "off"
+	output, err := captureOutput(func() error {
+		return executeCommand(state, "import "+path+" --dry-run")
+	})
+	if err != nil || !strings.Contains(output, pid) || len(state.ActiveJails) != 0 {
+		t.Errorf("Unexpected dry run (%v):\n%s", err, output)
+	}
+	if _, err := captureOutput(func() error { return executeCommand(state, "import "+path) }); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	jail, jailed := state.ActiveJails[cmd.Process.Pid]
+	if !jailed || jail.Rlimits["nofile"] != 32 || jail.Reason != "window" {
+		t.Fatalf("Process not jailed by the template: %+v", jail)
+	}
+	if _, err := captureOutput(func() error { return executeCommand(state, "import "+path) }); err != nil {
+		t.Errorf("Importing again should skip the jailed process: %v", err)
+	}
+	if len(state.Operations) != 1 {
+		t.Errorf("Expected a single undoable operation, got %d", len(state.Operations))
+	}
+	if _, err := captureOutput(func() error { return executeCommand(state, "undo") }); err != nil {
+		t.Errorf("undo failed: %v", err)
+	}
+	if _, jailed := state.ActiveJails[cmd.Process.Pid]; jailed {
+		t.Errorf("Import not undone")
+	}
+}
+
+// TestReconcile tests keeping the jails in line with a desired-state file
+func TestReconcile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "desired.json")
+	for content, message := range map[string]string{
+		`{"jails": [{"jail": "cpu", "unit": "a.service"}]}`:                                           "no name",
+		`{"jails": [{"name": "a", "jail": "cpu"}]}`:                                                   "one of selector, unit or container",
+		`{"jails": [{"name": "a", "jail": "cpu", "unit": "a.service", "container": "0123456789ab"}]}`: "one of selector, unit or container",
+		`{"jails": [{"name": "a", "jail": "cpu", "container": "0123"}]}`:                              "too short",
+		`{"jails": [{"name": "a", "jail": "cpu", "selector": "bogus>1"}]}`:                            "entry \"a\"",
+	} {
+		os.WriteFile(path, []byte(content), 0600)
+		if _, err := loadDesiredState(path); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("loadDesiredState(%s) = %v, expected %q", content, err, message)
+		}
+	}
+
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+	desired := func(limit string) {
+		content := fmt.Sprintf(`{"jails": [{"name": "sleeper", "selector": "pid==%d", "jail": "rlimit", "args": ["nofile=%s"]}]}`, pid, limit)
+		os.WriteFile(path, []byte(content), 0600)
+	}
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	r := &reconciler{state: state, path: path, owned: make(map[int]map[string]reconciledJail)}
+	desired("64")
+	captureOutput(func() error { r.reconcile(); return nil })
+	jail, jailed := state.ActiveJails[pid]
+	if !jailed || jail.Rlimits["nofile"] != 64 || jail.JailedBy != "reconcile sleeper" {
+		t.Fatalf("Process not jailed by the desired state: %+v", jail)
+	}
+
+	desired("32")
+	captureOutput(func() error { r.reconcile(); return nil })
+	if jail, jailed = state.ActiveJails[pid]; !jailed || jail.Rlimits["nofile"] != 32 {
+		t.Fatalf("Changed limit not applied: %+v", jail)
+	}
+
+	// A broken file keeps the previous desired state
+	os.WriteFile(path, []byte("{"), 0600)
+	captureOutput(func() error { r.reconcile(); return nil })
+	if _, jailed = state.ActiveJails[pid]; !jailed {
+		t.Fatalf("Jail released after a parse error")
+	}
+
+	// Jails applied by an operator are left alone
+	if _, err := captureOutput(func() error { return executeCommand(state, fmt.Sprintf("jail oom %d", pid)) }); err != nil {
+		t.Fatalf("jail oom failed: %v", err)
+	}
+	os.WriteFile(path, []byte(`{"jails": []}`), 0600)
+	captureOutput(func() error { r.reconcile(); return nil })
+	if jail, jailed = state.ActiveJails[pid]; !jailed || jail.HasJailType("rlimit") || !jail.HasJailType("oom") {
+		t.Errorf("Expected only the reconciled rlimit jail to be released: %+v", jail)
+	}
+}
+
+// TestSystemdService tests the notifications to systemd and the recovery of the jails
+func TestSystemdService(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "notify")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("Cannot listen on a unixgram socket: %v", err)
+	}
+	defer listener.Close()
+
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+	t.Setenv("WATCHDOG_USEC", "4000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	saved := systemdService
+	defer func() { systemdService = saved }()
+	initSystemd()
+	if !systemdService.started || systemdService.watchdog != 4*time.Second || os.Getenv("NOTIFY_SOCKET") != "" {
+		t.Errorf("Unexpected systemd environment: %+v", systemdService)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("sdNotify failed: %v", err)
+	}
+	buffer := make([]byte, 64)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := listener.Read(buffer); err != nil || string(buffer[:n]) != "READY=1" {
+		t.Errorf("Unexpected notification %q: %v", buffer[:n], err)
+	}
+
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	state.StatePath = filepath.Join(dir, "state.json")
+	state.CgroupVersion, state.FirewallTool = 2, "nftables"
+	if _, err := captureOutput(func() error {
+		return executeCommand(state, fmt.Sprintf("jail rlimit %d nofile=64 --reason kept", cmd.Process.Pid))
+	}); err != nil {
+		t.Fatalf("jail failed: %v", err)
+	}
+	gone := newJail(999999, "/")
+	gone.JailTypes = []string{"oom"}
+	state.ActiveJails[gone.PID] = gone
+	publishInventory(state)
+
+	recovered := NewJailerState()
+	recovered.Config.AuditLog = "off"
+	recovered.StatePath = state.StatePath
+	recovered.CgroupVersion, recovered.FirewallTool = 2, "iptables"
+	if _, err := recoverJailState(recovered); err == nil || !strings.Contains(err.Error(), "iptables") {
+		t.Errorf("Expected a firewall mismatch error, got %v", err)
+	}
+	recovered.FirewallTool = "nftables"
+	found, err := recoverJailState(recovered)
+	if err != nil || !found {
+		t.Fatalf("recoverJailState = %v, %v", found, err)
+	}
+	jail, jailed := recovered.ActiveJails[cmd.Process.Pid]
+	if !jailed || jail.Reason != "kept" || jail.Rlimits["nofile"] != 64 {
+		t.Errorf("Jail not recovered: %+v", jail)
+	}
+	if _, jailed := recovered.ActiveJails[gone.PID]; jailed {
+		t.Errorf("Jail of an exited process recovered")
+	}
+
+	removeJailState(recovered)
+	empty := NewJailerState()
+	empty.StatePath = state.StatePath
+	if found, err := recoverJailState(empty); found || err != nil {
+		t.Errorf("Expected no state to recover, got %v, %v", found, err)
+	}
+}
+
+// TestNamespacePids tests translating the PIDs of another PID namespace to host PIDs
+func TestNamespacePids(t *testing.T) {
+	nsPids, err := readNSpid(os.Getpid())
+	if err != nil {
+		t.Skipf("No NSpid: %v", err)
+	}
+	if nsPids[0] != os.Getpid() {
+		t.Errorf("Unexpected NSpid of the test: %v", nsPids)
+	}
+
+	cmd := exec.Command("unshare", "--pid", "--fork", "sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start unshare: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	// The forked sleep is PID 1 of the new namespace
+	sleepPid := 0
+	for i := 0; i < 50 && sleepPid == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		for _, pid := range listProcessPids() {
+			if parent, err := hostProcesses.parent(pid); err == nil && parent == cmd.Process.Pid {
+				sleepPid = pid
+			}
+		}
+	}
+	if sleepPid == 0 {
+		t.Skip("unshare didn't start sleep in a PID namespace")
+	}
+	defer syscall.Kill(sleepPid, syscall.SIGKILL)
+
+	ref := "pid:" + strconv.Itoa(sleepPid)
+	var translated []int
+	if _, err := captureOutput(func() error {
+		translated, err = translateNamespacePids(ref, []int{1})
+		return err
+	}); err != nil || !reflect.DeepEqual(translated, []int{sleepPid}) {
+		t.Fatalf("translateNamespacePids = %v, %v, expected [%d]", translated, err, sleepPid)
+	}
+	if _, err := translateNamespacePids(ref, []int{4242}); err == nil || !strings.Contains(err.Error(), "no process 4242") {
+		t.Errorf("Expected a missing PID error, got %v", err)
+	}
+	for _, ref := range []string{"web", "vm:web", "pid:"} {
+		if _, err := namespaceProcess(ref); err == nil {
+			t.Errorf("Expected an error for namespace %q", ref)
+		}
+	}
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	if _, err := captureOutput(func() error {
+		return executeCommand(state, "jail rlimit 1 nofile=64 --in "+ref)
+	}); err != nil {
+		t.Fatalf("jail --in failed: %v", err)
+	}
+	if _, jailed := state.ActiveJails[sleepPid]; !jailed {
+		t.Errorf("Host PID %d of the namespace not jailed", sleepPid)
+	}
+	if err := executeCommand(state, "jail oom where name==sleep --in "+ref); err == nil {
+		t.Errorf("Expected --in to be refused with a selector")
+	}
+}
+
+// TestNetNamespace tests that the network jail rules are installed in the network
+// namespace of a container and removed with its last jail
+func TestNetNamespace(t *testing.T) {
+	state := NewJailerState()
+	own := newJail(os.Getpid(), "")
+	if err := enterNetNamespace(state, own); err != nil || own.NetNamespace != "" || len(state.NetNamespaces) != 0 {
+		t.Fatalf("enterNetNamespace in the namespace of jailer = %v, %q", err, own.NetNamespace)
+	}
+
+	cmd := exec.Command("unshare", "--net", "sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start unshare: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	hostNamespace, err := processNetNamespace(os.Getpid())
+	if err != nil {
+		t.Skipf("No network namespace: %v", err)
+	}
+	namespace := hostNamespace
+	for i := 0; i < 50 && namespace == hostNamespace; i++ {
+		time.Sleep(20 * time.Millisecond)
+		namespace, _ = processNetNamespace(cmd.Process.Pid)
+	}
+	if namespace == hostNamespace || namespace == "" {
+		t.Skip("unshare didn't start sleep in a network namespace")
+	}
+
+	file, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", cmd.Process.Pid))
+	if err != nil {
+		t.Fatalf("Failed to open the network namespace: %v", err)
+	}
+	var inside string
+	if err := inNetNamespace(file, func() error {
+		inside, err = os.Readlink("/proc/thread-self/ns/net")
+		return err
+	}); err != nil || inside != namespace {
+		t.Fatalf("inNetNamespace ran in %q, %v, expected %q", inside, err, namespace)
+	}
+	if current, _ := processNetNamespace(os.Getpid()); current != hostNamespace {
+		t.Errorf("jailer left in network namespace %q", current)
+	}
+
+	// Two jails share the rules of the namespace, the last one removes them
+	state.NetNamespaces[namespace] = &jailNetNamespace{file: file, refs: 2}
+	first, second := newJail(cmd.Process.Pid, ""), newJail(cmd.Process.Pid, "")
+	first.NetNamespace, second.NetNamespace = namespace, namespace
+	releaseNetNamespace(state, first)
+	if held := state.NetNamespaces[namespace]; held == nil || held.refs != 1 || first.NetNamespace != "" {
+		t.Fatalf("Namespace released with a jail left: %+v", held)
+	}
+	output, _ := captureOutput(func() error {
+		releaseNetNamespace(state, second)
+		return nil
+	})
+	if _, held := state.NetNamespaces[namespace]; held {
+		t.Errorf("Namespace still held after its last jail")
+	}
+	if !strings.Contains(output, "unsupported firewall tool") {
+		t.Errorf("Expected the cleanup to run in the namespace, got %q", output)
+	}
+}
+
+// TestPodmanContainer tests the lookup of containers through the Podman API socket
+func TestPodmanContainer(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "podman.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("Cannot listen on a unix socket: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v4.0.0/libpod/containers/web/json":
+			fmt.Fprintf(w, `{"Id":"0123456789abcdef","Name":"web","State":{"Running":true,"Pid":%d}}`, os.Getpid())
+		case "/v4.0.0/libpod/containers/broken/json":
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		default:
+			http.Error(w, "no such container", http.StatusNotFound)
+		}
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	inspected, found, err := inspectPodmanContainer(socket, "web")
+	if err != nil || !found || inspected.ID != "0123456789abcdef" || inspected.State.Pid != os.Getpid() || !inspected.State.Running {
+		t.Errorf("inspectPodmanContainer(web) = %+v, %v, %v", inspected, found, err)
+	}
+	if _, found, err := inspectPodmanContainer(socket, "missing"); found || err != nil {
+		t.Errorf("Expected a missing container to be not found, got %v, %v", found, err)
+	}
+	if _, _, err := inspectPodmanContainer(socket, "broken"); err == nil {
+		t.Errorf("Expected an error for a failing API")
+	}
+
+	if !isPidTarget("container:web") {
+		t.Errorf("container:web not recognized as a target")
+	}
+	if _, _, err := parsePidTargets([]string{"container:"}); err == nil {
+		t.Errorf("Expected an error for an empty container")
+	}
+}
+
+// TestLxdInstance tests the lookup of LXD instances through the LXD API socket
+func TestLxdInstance(t *testing.T) {
+	dir := t.TempDir()
+	listener, err := net.Listen("unix", filepath.Join(dir, "unix.socket"))
+	if err != nil {
+		t.Skipf("Cannot listen on a unix socket: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1.0/instances/web/state":
+			fmt.Fprintf(w, `{"type":"sync","status_code":200,"metadata":{"status":"Running","pid":%d}}`, os.Getpid())
+		case "/1.0/instances/db/state":
+			fmt.Fprint(w, `{"type":"sync","status_code":200,"metadata":{"status":"Stopped","pid":0}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"type":"error","error":"Instance not found","error_code":404}`)
+		}
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+	t.Setenv("LXD_DIR", dir)
+
+	if pid, err := lxdInitProcess("web"); err != nil || pid != os.Getpid() {
+		t.Errorf("lxdInitProcess(web) = %d, %v", pid, err)
+	}
+	if _, err := lxdInitProcess("db"); err == nil || !strings.Contains(err.Error(), "not running") {
+		t.Errorf("Expected a stopped instance error, got %v", err)
+	}
+	if _, err := lxdInitProcess("missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected a missing instance error, got %v", err)
+	}
+
+	// Without payload cgroup, the init process is jailed
+	var pids []int
+	if _, err := captureOutput(func() error {
+		pids, _, err = parsePidTargets([]string{"lxd:web"})
+		return err
+	}); err != nil || !reflect.DeepEqual(pids, []int{os.Getpid()}) {
+		t.Errorf("parsePidTargets(lxd:web) = %v, %v", pids, err)
+	}
+	if _, _, err := parsePidTargets([]string{"lxd:"}); err == nil {
+		t.Errorf("Expected an error for an empty instance name")
+	}
+}
+
+// TestCapabilities tests that the jail types missing a capability are disabled with the
+// reason and refused by jail and run
+func TestCapabilities(t *testing.T) {
+	state := NewJailerState()
+	state.CgroupVersion = 2
+	state.Config.AuditLog = "off"
+	disabled := applyCapabilities(state, []capability{
+		{Name: "cgroup.cpu", Available: true},
+		{Name: "cgroup.memory", Available: true},
+		{Name: "cgroup.rdma", Detail: "missing from /sys/fs/cgroup/cgroup.controllers"},
+		{Name: "firewall", Detail: "neither nftables nor iptables found"},
+		{Name: "firewall.cgroup-match", Detail: "no firewall tool"},
+		{Name: "kernel.seccomp", Available: true},
+		{Name: "kernel.landlock", Detail: "landlock is not available"},
+	})
+	expected := []string{"landlock", "misc", "network", "proxy", "rdma"}
+	if !reflect.DeepEqual(disabled, expected) {
+		t.Errorf("Disabled jail types = %v, expected %v", disabled, expected)
+	}
+	if err := checkJailTypeEnabled(state, "network"); err == nil || !strings.Contains(err.Error(), "neither nftables nor iptables") {
+		t.Errorf("Expected the network jail to be refused with the reason, got %v", err)
+	}
+	for _, jailType := range []string{"cpu", "memory", "oom", "syscall"} {
+		if err := checkJailTypeEnabled(state, jailType); err != nil {
+			t.Errorf("%s jail disabled: %v", jailType, err)
+		}
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	if err := executeCommand(state, "jail network "+pid); err == nil || !strings.Contains(err.Error(), "disabled on this host") {
+		t.Errorf("Expected jail network to be refused, got %v", err)
+	}
+	if _, jailed := state.ActiveJails[os.Getpid()]; jailed {
+		t.Errorf("Process jailed with a disabled jail type")
+	}
+	if _, err := parseRunJailSpec(state, "cpu,landlock"); err == nil || !strings.Contains(err.Error(), "landlock jails are disabled") {
+		t.Errorf("Expected run to refuse the landlock jail, got %v", err)
+	}
+
+	// A setup failure stays until restart, probing again doesn't enable the type
+	captureOutput(func() error {
+		disableJailType(state, "cpu", fmt.Errorf("cpu.max is read-only"))
+		return nil
+	})
+	applyCapabilities(state, []capability{{Name: "cgroup.cpu", Available: true}})
+	if err := checkJailTypeEnabled(state, "cpu"); err == nil || !strings.Contains(err.Error(), "setup failed") {
+		t.Errorf("Expected the cpu jail to stay disabled, got %v", err)
+	}
+
+	if version, _, err := detectCgroupVersion(); err == nil {
+		doctor := NewJailerState()
+		doctor.CgroupVersion = version
+		output, err := captureOutput(func() error { return runDoctor(doctor) })
+		if err != nil || !strings.Contains(output, "cgroup.cpu") || !strings.Contains(output, "Jail types:") {
+			t.Errorf("Unexpected doctor output: %v\n%s", err, output)
+		}
+		if _, disabled := doctor.DisabledJailTypes["network"]; !disabled {
+			t.Errorf("Network jails enabled without firewall tool")
+		}
+	}
+}
+
+// TestSelftest tests the jail types the self-test skips and the validation of its
+// arguments, the throwaway processes need the jailer binary
+func TestSelftest(t *testing.T) {
+	state := NewJailerState()
+	state.DisabledJailTypes = map[string]string{"network": "firewall unavailable: neither nftables nor iptables found"}
+	state.History = []JailRecord{{PID: 1}}
+
+	if err := runSelftest(state, []string{"teleport"}); err == nil || !strings.Contains(err.Error(), "unknown jail type") {
+		t.Errorf("Expected an unknown jail type error, got %v", err)
+	}
+	output, err := captureOutput(func() error { return runSelftest(state, []string{"n", "quota", "proxy"}) })
+	if err != nil {
+		t.Fatalf("Self-test of skipped jail types failed: %v", err)
+	}
+	for _, expected := range []string{"disabled: firewall unavailable", "project quotas", "no network_proxy configured"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Self-test output misses %q:\n%s", expected, output)
+		}
+	}
+	if len(state.History) != 1 || len(state.ActiveJails) != 0 {
+		t.Errorf("Self-test left %d history records and %d jails", len(state.History), len(state.ActiveJails))
+	}
+}
+
+// TestCPUThrottling tests the reading of the throttling statistics of cpu.stat
+func TestCPUThrottling(t *testing.T) {
+	dir := t.TempDir()
+	v2 := filepath.Join(dir, "v2.stat")
+	os.WriteFile(v2, []byte("usage_usec 912000\nnr_periods 500\nnr_throttled 410\nthrottled_usec 3200000\n"), 0644)
+	stats, err := readCgroupStats(v2)
+	if err != nil || stats["nr_periods"] != 500 || stats["nr_throttled"] != 410 {
+		t.Fatalf("readCgroupStats = %v, %v", stats, err)
+	}
+	if value, err := readCgroupStat(v2, "throttled_usec"); err != nil || value != 3200000 {
+		t.Errorf("readCgroupStat(throttled_usec) = %d, %v", value, err)
+	}
+	if _, err := readCgroupStat(v2, "throttled_time"); err == nil {
+		t.Errorf("Expected an error for a missing key")
+	}
+
+	throttling := cpuThrottling{Periods: 500, Throttled: 410, ThrottledUsec: 3200000}
+	if throttling.String() != "82% (3.2s)" {
+		t.Errorf("Unexpected throttling %q", throttling.String())
+	}
+	if (cpuThrottling{}).String() != "0% (0s)" {
+		t.Errorf("Unexpected throttling without periods %q", cpuThrottling{}.String())
+	}
+
+	version, _, err := detectCgroupVersion()
+	if err != nil {
+		t.Skipf("No cgroups: %v", err)
+	}
+	state := NewJailerState()
+	state.CgroupVersion = version
+	if _, err := getCgroupThrottling(state, os.Getpid()); err != nil {
+		t.Logf("No cpu.stat for the test process: %v", err)
+	}
+}
+
+// TestThrottleAlert tests that a CPU jail throttled above the threshold for the duration is
+// notified once to the webhooks
+func TestThrottleAlert(t *testing.T) {
+	config := ThrottleAlertConfig{Percent: 90, Duration: "10m"}
+	if err := validateThrottleAlertConfig(&config); err != nil || config.duration != 10*time.Minute {
+		t.Fatalf("validateThrottleAlertConfig = %v, %s", err, config.duration)
+	}
+	for _, invalid := range []ThrottleAlertConfig{{Percent: 120, Duration: "10m"}, {Percent: 90}, {Percent: 90, Duration: "soon"}} {
+		if err := validateThrottleAlertConfig(&invalid); err == nil {
+			t.Errorf("Expected an error for %+v", invalid)
+		}
+	}
+	if err := validateNotificationConfig(NotificationConfig{Webhooks: []string{"ftp://example.com"}}); err == nil {
+		t.Errorf("Expected an error for a non HTTP webhook")
+	}
+
+	received := make(chan Notification, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification Notification
+		json.NewDecoder(r.Body).Decode(&notification)
+		received <- notification
+	}))
+	defer server.Close()
+
+	state := NewJailerState()
+	state.Config = &Config{ThrottleAlert: config, Notifications: NotificationConfig{Webhooks: []string{server.URL}}}
+	jail := newJail(4242, "/")
+	jail.Name = "miner"
+	jail.AddJailType("cpu")
+	state.ActiveJails[4242] = jail
+	other := newJail(4343, "/")
+	other.AddJailType("network")
+	state.ActiveJails[4343] = other
+
+	// 95% of the periods throttled, then 10% once the process is under its limit
+	periods, throttled := uint64(0), uint64(0)
+	monitor := newThrottleMonitor(state)
+	monitor.read = func(pid int) (cpuThrottling, error) {
+		if pid != 4242 {
+			t.Errorf("Read the throttling of the non cpu jail %d", pid)
+		}
+		return cpuThrottling{Periods: periods, Throttled: throttled}, nil
+	}
+	start := time.Now()
+	captureOutput(func() error {
+		for minute := 0; minute <= 12; minute++ {
+			monitor.check(start.Add(time.Duration(minute) * time.Minute))
+			periods, throttled = periods+600, throttled+570
+		}
+		return nil
+	})
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 notification, got %d", len(received))
+	}
+	notification := <-received
+	if notification.Event != "cpu_throttled" || notification.PID != 4242 || notification.Name != "miner" || notification.Text != notification.Message {
+		t.Errorf("Unexpected notification %+v", notification)
+	}
+
+	// The alert is armed again once the jail went below the threshold
+	captureOutput(func() error {
+		periods, throttled = periods+600, throttled+60
+		monitor.check(start.Add(13 * time.Minute))
+		for minute := 14; minute <= 25; minute++ {
+			periods, throttled = periods+600, throttled+570
+			monitor.check(start.Add(time.Duration(minute) * time.Minute))
+		}
+		return nil
+	})
+	if len(received) != 1 {
+		t.Errorf("Expected a second notification, got %d", len(received))
+	}
+
+	delete(state.ActiveJails, 4242)
+	monitor.check(start.Add(26 * time.Minute))
+	if len(monitor.previous) != 0 || len(monitor.since) != 0 || len(monitor.alerted) != 0 {
+		t.Errorf("The readings of the ended jail were kept")
+	}
+}
+
+// TestMemoryEvents tests the reading of memory.events and the notification of new OOM kills
+func TestMemoryEvents(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "memory.events"), []byte("low 0\nhigh 0\nmax 480\noom 12\noom_kill 3\noom_group_kill 0\n"), 0644)
+	state := NewJailerState()
+	state.CgroupVersion = 2
+	events, err := readMemoryEvents(state, dir)
+	if err != nil || events != (memoryEvents{Max: 480, OOM: 12, OOMKill: 3}) {
+		t.Fatalf("readMemoryEvents = %+v, %v", events, err)
+	}
+	if events.String() != "3 oom_kill (12 oom, 480 max)" {
+		t.Errorf("Unexpected events %q", events.String())
+	}
+
+	os.WriteFile(filepath.Join(dir, "memory.failcnt"), []byte("7\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "memory.oom_control"), []byte("oom_kill_disable 0\nunder_oom 0\noom_kill 2\n"), 0644)
+	state.CgroupVersion = 1
+	if events, err := readMemoryEvents(state, dir); err != nil || events != (memoryEvents{Max: 7, OOMKill: 2}) {
+		t.Errorf("readMemoryEvents on v1 = %+v, %v", events, err)
+	}
+
+	received := make(chan Notification, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification Notification
+		json.NewDecoder(r.Body).Decode(&notification)
+		received <- notification
+	}))
+	defer server.Close()
+	state.Config = &Config{Notifications: NotificationConfig{Webhooks: []string{server.URL}}}
+
+	// Two jails share the CPU jail cgroup, the network jail has no cgroup of its own
+	for _, pid := range []int{5001, 5002} {
+		jail := newJail(pid, "/")
+		jail.AddJailType("cpu")
+		state.ActiveJails[pid] = jail
+	}
+	state.ActiveJails[5003] = newJail(5003, "/")
+	state.ActiveJails[5003].AddJailType("network")
+
+	kills := uint64(0)
+	monitor := newMemoryEventsMonitor(state)
+	monitor.cgroupOf = func(pid int) (string, error) { return "/sys/fs/cgroup/jailer_cpu", nil }
+	monitor.read = func(string) (memoryEvents, error) { return memoryEvents{OOMKill: kills}, nil }
+	captureOutput(func() error {
+		monitor.check()
+		kills = 2
+		monitor.check()
+		monitor.check()
+		return nil
+	})
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 notification, got %d", len(received))
+	}
+	if notification := <-received; notification.Event != "oom_kill" || notification.PID != 5001 || !strings.Contains(notification.Message, "killed 2 processes") {
+		t.Errorf("Unexpected notification %+v", notification)
+	}
+
+	state.ActiveJails = map[int]*Jail{}
+	monitor.check()
+	if len(monitor.previous) != 0 {
+		t.Errorf("The readings of the ended jails were kept")
+	}
+}
+
+// TestJailEvents tests the event stream of the jail lifecycle and the detection of the
+// processes out of the jail cgroups
+func TestJailEvents(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/jail-cpu": true, "/jail-4242/sub": true, "/jail": true, "/user.slice/session-1.scope": false, "/": false, "/jailed": false,
+	} {
+		if isJailCgroup(path) != expected {
+			t.Errorf("isJailCgroup(%q) = %v", path, !expected)
+		}
+	}
+	if err := validateEventsConfig(EventsConfig{TLSCert: "cert.pem"}); err == nil {
+		t.Errorf("Expected an error for a certificate without key")
+	}
+
+	state := NewJailerState()
+	state.Config = &Config{Events: EventsConfig{Token: "secret"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(state, w, r)
+	}))
+	defer server.Close()
+
+	if response, err := http.Get(server.URL); err != nil || response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a rejected subscriber without token, got %v", err)
+	}
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Unexpected content type %q", response.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(response.Body)
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, ":") {
+		t.Fatalf("Expected the opening comment, got %q, %v", line, err)
+	}
+	reader.ReadString('\n')
+
+	jail := newJail(4242, "/")
+	jail.Name = "miner"
+	jail.AddJailType("cpu")
+	publishJailEvent("created", jail, "")
+	recordJailHistory(state, jail, "exited")
+	for _, expected := range []string{"created", "process-exited"} {
+		eventLine, _ := reader.ReadString('\n')
+		dataLine, _ := reader.ReadString('\n')
+		reader.ReadString('\n')
+		if eventLine != "event: "+expected+"\n" {
+			t.Fatalf("Expected event %s, got %q", expected, eventLine)
+		}
+		var event jailEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(dataLine, "data: ")), &event); err != nil {
+			t.Fatalf("Invalid event data %q: %v", dataLine, err)
+		}
+		if event.Event != expected || event.PID != 4242 || event.Name != "miner" || len(event.JailTypes) != 1 {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	}
+
+	// The events command prints the history and ends without --follow
+	var out bytes.Buffer
+	if err := followEvents("secret", server.URL+"/events", false, &out); err != nil {
+		t.Fatalf("followEvents failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) < 3 || !strings.HasPrefix(lines[0], "TIME") {
+		t.Fatalf("Unexpected events output:\n%s", out.String())
+	}
+	if last := lines[len(lines)-1]; !strings.Contains(last, "process-exited") || !strings.Contains(last, "4242") || !strings.Contains(last, "miner") {
+		t.Errorf("Unexpected last event %q", last)
+	}
+	if err := followEvents("wrong", server.URL+"/events", false, io.Discard); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected the subscriber to be refused, got %v", err)
+	}
+}
+
+// TestStatsdEmitter tests the metrics sent to StatsD and DogStatsD agents
+func TestStatsdEmitter(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("No UDP: %v", err)
+	}
+	defer listener.Close()
+	receive := func() string {
+		listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buffer := make([]byte, statsdMaxPacket)
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("No datagram received: %v", err)
+		}
+		return string(buffer[:n])
+	}
+
+	for _, invalid := range []StatsdConfig{{Address: "localhost"}, {Address: "localhost:8125", Tags: []string{"env:prod"}}, {Address: "localhost:8125", Interval: "often"}} {
+		if err := validateStatsdConfig(&invalid); err == nil {
+			t.Errorf("Expected an error for %+v", invalid)
+		}
+	}
+	config := StatsdConfig{Address: listener.LocalAddr().String()}
+	if err := validateStatsdConfig(&config); err != nil || config.Prefix != "jailer" || config.interval != defaultStatsdInterval {
+		t.Fatalf("validateStatsdConfig = %v, %+v", err, config)
+	}
+
+	state := NewJailerState()
+	state.Config = &Config{Statsd: config}
+	jail := newJail(4242, "/")
+	jail.JailTypes = []string{"network", "cpu"}
+	state.ActiveJails[4242] = jail
+	emitter, err := newStatsdEmitter(state)
+	if err != nil {
+		t.Fatalf("newStatsdEmitter failed: %v", err)
+	}
+	emitter.reportGauges()
+	emitter.recordEvent(jailEvent{Time: jail.Timestamp.Add(90 * time.Second), Event: "process-exited", JailTypes: jail.JailTypes, JailedAt: jail.Timestamp})
+	emitter.flush()
+	lines := strings.Split(receive(), "\n")
+	for _, expected := range []string{"jailer.jails.total:1|g", "jailer.jails.active.network:1|g", "jailer.jails.active.cpu:1|g",
+		"jailer.jails.active.oom:0|g", "jailer.events.process_exited:1|c", "jailer.jail.duration.network:90000|ms"} {
+		if !slices.Contains(lines, expected) {
+			t.Errorf("Missing %q in %q", expected, lines)
+		}
+	}
+
+	emitter.config.DogStatsD, emitter.config.Tags = true, []string{"env:prod"}
+	emitter.recordEvent(jailEvent{Event: "created", JailTypes: []string{"cpu"}})
+	emitter.flush()
+	if line := receive(); line != "jailer.events:1|c|#event:created,env:prod" {
+		t.Errorf("Unexpected DogStatsD metric %q", line)
+	}
+}
+
+// TestTracing tests that the spans of an operation and of its calls are exported to the
+// collector in one trace
+func TestTracing(t *testing.T) {
+	if startSpan("disabled") != nil {
+		t.Fatalf("Expected no span without tracing")
+	}
+	var nilSpan *span
+	nilSpan.end(nil)
+
+	failing := true
+	var received []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("X-Api-Key") != "key" {
+			t.Errorf("Unexpected export to %s", r.URL.Path)
+		}
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var request struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		received = append(received, request.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}))
+	defer server.Close()
+
+	config := TracingConfig{Endpoint: server.URL, Headers: map[string]string{"X-Api-Key": "key"}}
+	if err := validateTracingConfig(&config); err != nil || config.Endpoint != server.URL+"/v1/traces" || config.ServiceName != "jailer" {
+		t.Fatalf("validateTracingConfig = %v, %+v", err, config)
+	}
+	if err := validateTracingConfig(&TracingConfig{Endpoint: "collector:4318"}); err == nil {
+		t.Errorf("Expected an error for an endpoint without scheme")
+	}
+	tracer.mutex.Lock()
+	tracer.config = &config
+	tracer.mutex.Unlock()
+	defer func() {
+		tracer.mutex.Lock()
+		tracer.config, tracer.current, tracer.pending = nil, nil, nil
+		tracer.mutex.Unlock()
+	}()
+
+	operation := startOperation("jail", stringAttribute("jail.type", "network"), intAttribute("process.pid", 4242))
+	startSpan("firewall.nft").end(fmt.Errorf("exit status 1"))
+	operation.end(nil)
+	startSpan("cgroup.move").end(nil)
+
+	captureOutput(func() error {
+		flushTraces()
+		return nil
+	})
+	if len(received) != 0 || len(tracer.pending) != 3 {
+		t.Fatalf("Expected the spans to be kept when the collector fails, %d pending", len(tracer.pending))
+	}
+	failing = false
+	flushTraces()
+	if len(received) != 3 {
+		t.Fatalf("Expected 3 spans, got %d", len(received))
+	}
+	firewall, jail, after := received[0], received[1], received[2]
+	if firewall["traceId"] != jail["traceId"] || firewall["parentSpanId"] != jail["spanId"] || jail["parentSpanId"] != nil {
+		t.Errorf("The firewall span is not the child of the operation: %v %v", firewall, jail)
+	}
+	if status := firewall["status"].(map[string]interface{}); status["code"] != float64(2) || status["message"] != "exit status 1" {
+		t.Errorf("Unexpected status %v", status)
+	}
+	if after["traceId"] == jail["traceId"] {
+		t.Errorf("A span after the operation joined its trace")
+	}
+}
+
+// TestHealthEndpoints tests the liveness and readiness checks of /healthz and /readyz
+func TestHealthEndpoints(t *testing.T) {
+	if check := checkStateLock(time.Second); !check.OK {
+		t.Errorf("Expected the state to be lockable: %+v", check)
+	}
+	stateMutex.Lock()
+	check := checkStateLock(20 * time.Millisecond)
+	stateMutex.Unlock()
+	if check.OK {
+		t.Errorf("Expected a wedged state while it is locked")
+	}
+
+	dir := t.TempDir()
+	state := NewJailerState()
+	state.CgroupVersion = 2
+	state.NetworkCgroupPath = filepath.Join(dir, JailNetworkCgroup)
+	state.CpuCgroupPath = filepath.Join(dir, JailCpuCgroup)
+	state.NetworkCpuCgroupPath = filepath.Join(dir, JailNetworkCpuCgroup)
+	state.DisabledJailTypes = map[string]string{"network": "firewall unavailable"}
+	state.StatePath = filepath.Join(dir, "run", "state.json")
+	for _, path := range []string{state.NetworkCgroupPath, state.CpuCgroupPath} {
+		os.Mkdir(path, 0755)
+	}
+	if check := checkCgroupsHealth(state); check.OK || !strings.Contains(check.Detail, JailNetworkCpuCgroup) {
+		t.Errorf("Expected the missing cgroup to be reported: %+v", check)
+	}
+	os.Mkdir(state.NetworkCpuCgroupPath, 0755)
+
+	mux := http.NewServeMux()
+	registerHealthHandlers(mux, state)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	get := func(path string) (int, healthReport) {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer response.Body.Close()
+		var report healthReport
+		json.NewDecoder(response.Body).Decode(&report)
+		return response.StatusCode, report
+	}
+
+	if status, report := get("/healthz"); status != http.StatusOK || report.Status != "ok" || len(report.Checks) != 1 {
+		t.Errorf("Unexpected /healthz %d %+v", status, report)
+	}
+	if status, report := get("/readyz"); status != http.StatusOK || len(report.Checks) != 4 {
+		t.Errorf("Unexpected /readyz %d %+v", status, report)
+	}
+
+	// A state file that can't be written makes jailer unready
+	os.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	state.StatePath = filepath.Join(dir, "file", "state.json")
+	if status, report := get("/readyz"); status != http.StatusServiceUnavailable || report.Status != "failing" {
+		t.Errorf("Expected /readyz to fail, got %d %+v", status, report)
+	}
+}
+
+// TestKeepJailsOnExit tests that cleanup only releases the ephemeral jails with
+// -keep-jails-on-exit and saves the persistent ones for the next jailer
+func TestKeepJailsOnExit(t *testing.T) {
+	var pids []string
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command("sleep", "30")
+		if err := cmd.Start(); err != nil {
+			t.Skipf("Cannot start sleep: %v", err)
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+		pids = append(pids, strconv.Itoa(cmd.Process.Pid))
+	}
+	persistentPid, _ := strconv.Atoi(pids[0])
+	ephemeralPid, _ := strconv.Atoi(pids[1])
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	state.StatePath = filepath.Join(t.TempDir(), "state.json")
+	state.CgroupVersion = 2
+	state.KeepJailsOnExit = true
+	if _, err := captureOutput(func() error {
+		if err := executeCommand(state, "jail rlimit "+pids[0]+" nofile=64 --persistent"); err != nil {
+			return err
+		}
+		return executeCommand(state, "jail rlimit "+pids[1]+" nofile=64")
+	}); err != nil {
+		t.Skipf("Cannot apply rlimit jails: %v", err)
+	}
+	if !state.ActiveJails[persistentPid].Persistent || state.ActiveJails[ephemeralPid].Persistent {
+		t.Fatalf("Unexpected persistence after jail --persistent")
+	}
+
+	captureOutput(func() error { return executeCommand(state, "mark "+pids[1]+" persistent") })
+	if !state.ActiveJails[ephemeralPid].Persistent {
+		t.Errorf("mark persistent didn't mark the jail")
+	}
+	captureOutput(func() error { return executeCommand(state, "mark "+pids[1]+" ephemeral") })
+	if state.ActiveJails[ephemeralPid].Persistent {
+		t.Errorf("mark ephemeral didn't unmark the jail")
+	}
+	if err := executeCommand(state, "mark "+pids[1]+" forever"); err == nil {
+		t.Errorf("Expected an error for an unknown persistence")
+	}
+
+	output, _ := captureOutput(func() error {
+		cleanup(state)
+		return nil
+	})
+	if _, kept := state.ActiveJails[persistentPid]; !kept {
+		t.Errorf("Persistent jail released on exit")
+	}
+	if _, kept := state.ActiveJails[ephemeralPid]; kept {
+		t.Errorf("Ephemeral jail kept on exit")
+	}
+	if !strings.Contains(output, "Kept 1 persistent jails") {
+		t.Errorf("Unexpected cleanup output: %q", output)
+	}
+
+	recovered := NewJailerState()
+	recovered.StatePath = state.StatePath
+	recovered.CgroupVersion = 2
+	if found, err := recoverJailState(recovered); !found || err != nil {
+		t.Fatalf("recoverJailState = %v, %v", found, err)
+	}
+	if jail, exists := recovered.ActiveJails[persistentPid]; !exists || !jail.Persistent {
+		t.Errorf("Persistent jail not saved for the next jailer: %+v", jail)
+	}
+
+	// Without -keep-jails-on-exit every jail is released and there is nothing left to recover
+	state.KeepJailsOnExit = false
+	output, _ = captureOutput(func() error {
+		cleanup(state)
+		return nil
+	})
+	if len(state.ActiveJails) != 0 || !strings.Contains(output, "releasing 1 persistent jails") {
+		t.Errorf("Persistent jail not released: %d jails, output %q", len(state.ActiveJails), output)
+	}
+	if _, err := os.Stat(state.StatePath); !os.IsNotExist(err) {
+		t.Errorf("State file not removed: %v", err)
+	}
+}
+
+// TestPersistentJails tests saving the persistent jails and re-creating them with jailer
+// restore, as after a reboot
+func TestPersistentJails(t *testing.T) {
+	for cgroup, unit := range map[string]string{
+		"/system.slice/nginx.service":                  "nginx.service",
+		"/system.slice/docker.service/payload/x.scope": "docker.service",
+		"/user.slice/user-1000.slice/session-2.scope":  "",
+		"/": "",
+	} {
+		if got := cgroupServiceUnit(cgroup); got != unit {
+			t.Errorf("cgroupServiceUnit(%q) = %q, expected %q", cgroup, got, unit)
+		}
+	}
+
+	cmd := exec.Command("sleep", "31")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	path := filepath.Join(t.TempDir(), "persistent.json")
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	state.PersistentJailsPath = path
+	state.Operator = "alice"
+	if _, err := captureOutput(func() error {
+		return executeCommand(state, fmt.Sprintf("jail rlimit %d nofile=64 --persistent --reason incident", pid))
+	}); err != nil {
+		t.Skipf("Cannot apply rlimit jail: %v", err)
+	}
+	if state.ActiveJails[pid].Executable == "" {
+		t.Errorf("Executable of the jailed process not recorded")
+	}
+	publishInventory(state)
+
+	// After a reboot nothing is jailed, the saved jail is matched by its command line
+	rebooted := NewJailerState()
+	rebooted.Config.AuditLog = "off"
+	rebooted.PersistentJailsPath = path
+	records, err := loadPersistentJails(rebooted)
+	if err != nil || len(records) != 1 || records[0].Cmdline != "sleep 31" {
+		t.Fatalf("loadPersistentJails = %+v, %v", records, err)
+	}
+	if pids := matchPersistentJail(rebooted, records[0]); !slices.Contains(pids, pid) {
+		t.Errorf("matchPersistentJail = %v, expected %d", pids, pid)
+	}
+
+	gone := persistentJail{Cmdline: "no-such-command --flag", Jail: newJail(999999, "/")}
+	gone.Jail.JailTypes, gone.Jail.Persistent = []string{"oom"}, true
+	rebooted.PendingPersistent = append(records, gone)
+	publishInventory(rebooted)
+
+	restoreOutput, _ := captureOutput(func() error {
+		if code := runBootRestore(rebooted); code != 0 {
+			t.Errorf("runBootRestore returned %d", code)
+		}
+		return nil
+	})
+	jail, jailed := rebooted.ActiveJails[pid]
+	if !jailed || !jail.Persistent || jail.Rlimits["nofile"] != 64 || jail.Reason != "incident" || jail.JailedBy != "alice" {
+		t.Fatalf("Jail not restored: %+v\n%s", jail, restoreOutput)
+	}
+	if len(rebooted.PendingPersistent) != 1 || rebooted.PendingPersistent[0].Cmdline != gone.Cmdline {
+		t.Errorf("Jail without a process not kept for the next restore: %+v", rebooted.PendingPersistent)
+	}
+
+	// The restored jail is active again, only the pending one is loaded by the next jailer
+	if records, err := loadPersistentJails(rebooted); err != nil || len(records) != 1 || records[0].Jail.PID != gone.Jail.PID {
+		t.Errorf("loadPersistentJails after restore = %+v, %v", records, err)
+	}
+
+	rebooted.PendingPersistent = nil
+	captureOutput(func() error { return executeCommand(rebooted, fmt.Sprintf("unjail %d", pid)) })
+	publishInventory(rebooted)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Persistent jails file not removed without persistent jails: %v", err)
+	}
+}
+
+// TestJailWindows tests the daily windows of jail --between and the scheduler applying
+// and removing the jails as they open and close
+func TestJailWindows(t *testing.T) {
+	day := func(clock string) time.Time {
+		parsed, _ := time.ParseInLocation("15:04", clock, time.Local)
+		return time.Date(2026, 10, 15, parsed.Hour(), parsed.Minute(), 0, 0, time.Local)
+	}
+	tests := []struct {
+		window  string
+		inside  []string
+		outside []string
+	}{
+		{"09:00-18:00", []string{"09:00", "12:30", "17:59"}, []string{"08:59", "18:00", "23:00"}},
+		{"22:00-06:00", []string{"22:00", "23:59", "00:00", "05:59"}, []string{"06:00", "12:00", "21:59"}},
+		{"00:00-24:00", []string{"00:00", "23:59"}, nil},
+	}
+	for _, tt := range tests {
+		window, err := parseTimeWindow(tt.window)
+		if err != nil {
+			t.Fatalf("parseTimeWindow(%q) failed: %v", tt.window, err)
+		}
+		for _, clock := range tt.inside {
+			if !window.contains(day(clock)) {
+				t.Errorf("%s should contain %s", tt.window, clock)
+			}
+		}
+		for _, clock := range tt.outside {
+			if window.contains(day(clock)) {
+				t.Errorf("%s should not contain %s", tt.window, clock)
+			}
+		}
+	}
+	for _, invalid := range []string{"09:00", "9-18", "09:00-09:00", "24:00-06:00", "25:00-26:00", "09:60-10:00", "00:00-24:01"} {
+		if _, err := parseTimeWindow(invalid); err == nil {
+			t.Errorf("parseTimeWindow(%q) should have failed", invalid)
+		}
+	}
+
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	pid := cmd.Process.Pid
+	pidStr := strconv.Itoa(pid)
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	if _, err := captureOutput(func() error {
+		return executeCommand(state, "jail rlimit "+pidStr+" nofile=64 --between 00:00-24:00 --reason nightly")
+	}); err != nil {
+		t.Skipf("Cannot schedule rlimit jail: %v", err)
+	}
+	if len(state.Schedules) != 1 || state.Schedules[0].Window.String() != "00:00-24:00" {
+		t.Fatalf("Unexpected schedules: %+v", state.Schedules)
+	}
+	if jail, jailed := state.ActiveJails[pid]; !jailed || jail.Reason != "nightly" {
+		t.Fatalf("Jail not applied within its window: %+v", jail)
+	}
+
+	// Outside the window the jail is removed and the schedule kept
+	state.Schedules[0].Window, _ = parseTimeWindow("09:00-18:00")
+	captureOutput(func() error {
+		if !applySchedules(state, day("20:00")) {
+			t.Error("Closing the window changed nothing")
+		}
+		return nil
+	})
+	if _, jailed := state.ActiveJails[pid]; jailed || len(state.Schedules) != 1 {
+		t.Errorf("Jail not removed outside its window: %d schedules", len(state.Schedules))
+	}
+	captureOutput(func() error {
+		applySchedules(state, day("10:00"))
+		return nil
+	})
+	if jail, jailed := state.ActiveJails[pid]; !jailed || jail.Rlimits["nofile"] != 64 {
+		t.Errorf("Jail not applied again when the window opened: %+v", jail)
+	}
+
+	// unjail drops the schedule, the jail isn't applied again
+	captureOutput(func() error { return executeCommand(state, "unjail "+pidStr) })
+	if len(state.Schedules) != 0 {
+		t.Errorf("Schedule kept after unjail: %+v", state.Schedules)
+	}
+
+	// A jail given by hand overrides the schedule, closing the window keeps it
+	captureOutput(func() error {
+		executeCommand(state, "jail rlimit "+pidStr+" nofile=64 --between 09:00-18:00")
+		applySchedules(state, day("20:00"))
+		return executeCommand(state, "jail rlimit "+pidStr+" nofile=64")
+	})
+	if len(state.Schedules) != 0 {
+		t.Errorf("Schedule kept after a jail by hand: %+v", state.Schedules)
+	}
+	captureOutput(func() error {
+		applySchedules(state, day("20:00"))
+		return executeCommand(state, "unjail "+pidStr)
+	})
+
+	// A failing jail is retried with a growing delay, its error reported and audited once
+	state.Config.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	window, _ := parseTimeWindow("09:00-18:00")
+	state.Schedules = []*jailSchedule{{PID: pid, JailType: "rlimit", Args: []string{"bogus=1"}, Window: window}}
+	output, _ := captureOutput(func() error {
+		for minutes := 0; minutes < 10; minutes++ {
+			applySchedules(state, day("10:00").Add(time.Duration(minutes)*time.Minute))
+		}
+		return nil
+	})
+	if schedule := state.Schedules[0]; schedule.Failures != 5 || schedule.Error == "" {
+		t.Errorf("Expected attempts at 0, 1, 2, 4 and 8 minutes, got %d (%q)", schedule.Failures, schedule.Error)
+	}
+	if strings.Count(output, "Warning") != 1 {
+		t.Errorf("Expected a single warning, got %q", output)
+	}
+	if content, err := os.ReadFile(state.Config.AuditLog); err != nil || strings.Count(string(content), "\n") != 1 {
+		t.Errorf("Expected a single audit event, got %q (%v)", content, err)
+	}
+	state.Config.AuditLog = "off"
+	state.Schedules = nil
+
+	// The schedules of exited processes are dropped
+	captureOutput(func() error { return executeCommand(state, "jail rlimit "+pidStr+" nofile=64 --between 09:00-18:00") })
+	cmd.Process.Kill()
+	cmd.Wait()
+	captureOutput(func() error {
+		applySchedules(state, day("20:00"))
+		return nil
+	})
+	if len(state.Schedules) != 0 {
+		t.Errorf("Schedule of an exited process kept: %+v", state.Schedules)
+	}
+}
+
+// TestScheduledJails tests the recurring schedules of the configuration, applied within
+// their windows and released once they close
+func TestScheduledJails(t *testing.T) {
+	if days, err := parseWeekdays([]string{"sat", "Sunday"}); err != nil || !slices.Equal(days, []time.Weekday{time.Saturday, time.Sunday}) {
+		t.Errorf("parseWeekdays = %v, %v", days, err)
+	}
+	if _, err := parseWeekdays([]string{"funday"}); err == nil {
+		t.Error("parseWeekdays should reject an unknown day")
+	}
+
+	// 2026-10-17 is a Saturday
+	at := func(day int, clock string) time.Time {
+		parsed, _ := time.Parse("15:04", clock)
+		return time.Date(2026, 10, day, parsed.Hour(), parsed.Minute(), 0, 0, time.Local)
+	}
+	saturday := timeWindow{Start: 2 * 60, End: 6 * 60, Days: []time.Weekday{time.Saturday}}
+	if !saturday.contains(at(17, "03:00")) || saturday.contains(at(18, "03:00")) || saturday.contains(at(17, "06:00")) {
+		t.Errorf("Unexpected Saturday window")
+	}
+	friday := timeWindow{Start: 22 * 60, End: 2 * 60, Days: []time.Weekday{time.Friday}}
+	if !friday.contains(at(16, "23:00")) || !friday.contains(at(17, "01:00")) || friday.contains(at(16, "01:00")) || friday.contains(at(17, "23:00")) {
+		t.Errorf("Unexpected Friday night window")
+	}
+	if friday.String() != "fri 22:00-02:00" {
+		t.Errorf("Unexpected window string %q", friday.String())
+	}
+
+	cmd := exec.Command("sleep", "37")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"audit_log": "off", "schedules": [{"name": "weekend", "selector": "cmdline==\"sleep 37\"",
+		"jail": "rlimit", "args": ["nofile=64"], "days": ["sat"], "window": "02:00-06:00"}]}`), 0600)
+	var config *Config
+	if _, err := captureOutput(func() (err error) {
+		config, err = loadConfig(path, true)
+		return err
+	}); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	for _, invalid := range []string{
+		`{"schedules": [{"name": "a", "unit": "backup.service", "jail": "cpu", "window": "02:00"}]}`,
+		`{"schedules": [{"name": "a", "unit": "backup.service", "jail": "cpu", "window": "02:00-06:00", "days": ["someday"]}]}`,
+		`{"schedules": [{"name": "a", "jail": "cpu", "window": "02:00-06:00"}]}`,
+	} {
+		os.WriteFile(path, []byte(invalid), 0600)
+		if _, err := loadConfig(path, true); err == nil {
+			t.Errorf("loadConfig should reject %s", invalid)
+		}
+	}
+
+	state := NewJailerState()
+	state.Config = config
+	scheduler := newProfileScheduler(state)
+	captureOutput(func() error {
+		scheduler.check(at(17, "01:00"))
+		return nil
+	})
+	if _, jailed := state.ActiveJails[pid]; jailed {
+		t.Fatal("Process jailed before its window")
+	}
+	captureOutput(func() error {
+		scheduler.check(at(17, "03:00"))
+		return nil
+	})
+	if jail := state.ActiveJails[pid]; jail == nil || jail.JailedBy != "schedule weekend" || jail.Rlimits["nofile"] != 64 {
+		t.Errorf("Unexpected scheduled jail: %+v", jail)
+	}
+	captureOutput(func() error {
+		scheduler.check(at(17, "06:30"))
+		return nil
+	})
+	if _, jailed := state.ActiveJails[pid]; jailed {
+		t.Error("Jail not released when the window closed")
+	}
+
+	// Jails applied by an operator are left alone
+	captureOutput(func() error { return executeCommand(state, fmt.Sprintf("jail rlimit %d nofile=64", pid)) })
+	captureOutput(func() error {
+		scheduler.check(at(17, "03:00"))
+		scheduler.check(at(17, "07:00"))
+		return nil
+	})
+	if _, jailed := state.ActiveJails[pid]; !jailed {
+		t.Error("Schedule released a jail it didn't apply")
+	}
+}
+
+// TestJailExpiry tests the jails released automatically, the notification before their
+// release and their extension
+func TestJailExpiry(t *testing.T) {
+	if warning, err := parseExpiryWarning(""); err != nil || warning != defaultExpiryWarning {
+		t.Errorf("parseExpiryWarning(\"\") = %s, %v", warning, err)
+	}
+	if warning, err := parseExpiryWarning("off"); err != nil || warning != 0 {
+		t.Errorf("parseExpiryWarning(off) = %s, %v", warning, err)
+	}
+	if _, err := parseExpiryWarning("soon"); err == nil {
+		t.Errorf("Expected an error for an invalid expiry_warning")
+	}
+
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+	pidStr := strconv.Itoa(pid)
+
+	received := make(chan Notification, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification Notification
+		json.NewDecoder(r.Body).Decode(&notification)
+		received <- notification
+	}))
+	defer server.Close()
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	state.Config.Notifications = NotificationConfig{Webhooks: []string{server.URL}}
+	state.CgroupVersion = 2
+	if err := executeCommand(state, "jail rlimit "+pidStr+" nofile=64 --for soon"); err == nil {
+		t.Errorf("Expected an error for an invalid --for duration")
+	}
+	if err := executeCommand(state, "jail rlimit "+pidStr+" nofile=64 --for 1h --between 09:00-18:00"); err == nil {
+		t.Errorf("Expected an error for --for with --between")
+	}
+	if _, err := captureOutput(func() error {
+		return executeCommand(state, "jail rlimit "+pidStr+" nofile=64 --for 1h")
+	}); err != nil {
+		t.Skipf("Cannot apply the rlimit jail: %v", err)
+	}
+	jail := state.ActiveJails[pid]
+	if left := time.Until(jail.ExpiresAt); left < 59*time.Minute || left > time.Hour {
+		t.Fatalf("Unexpected expiry in %s", left)
+	}
+	output, _ := captureOutput(func() error { return executeCommand(state, "list") })
+	if !strings.Contains(output, "Expires") || !(strings.Contains(output, "1h0m0s") || strings.Contains(output, "59m59s")) {
+		t.Errorf("Expected the countdown in the list, got:\n%s", output)
+	}
+
+	// Notified once within the warning, and again once extended
+	monitor := newExpiryMonitor(state)
+	expiresAt := jail.ExpiresAt
+	captureOutput(func() error {
+		monitor.check(expiresAt.Add(-20 * time.Minute))
+		monitor.check(expiresAt.Add(-5 * time.Minute))
+		monitor.check(expiresAt.Add(-4 * time.Minute))
+		return nil
+	})
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 notification, got %d", len(received))
+	}
+	if notification := <-received; notification.Event != "jail_expiring" || notification.PID != pid ||
+		!strings.Contains(notification.Message, "extend "+pidStr+" 1h") {
+		t.Errorf("Unexpected notification %+v", notification)
+	}
+	if err := executeCommand(state, "extend "+pidStr+" later"); err == nil {
+		t.Errorf("Expected an error for an invalid extension")
+	}
+	captureOutput(func() error { return executeCommand(state, "extend "+pidStr+" 1h") })
+	if !jail.ExpiresAt.Equal(expiresAt.Add(time.Hour)) {
+		t.Errorf("extend 1h moved the expiry from %s to %s", expiresAt, jail.ExpiresAt)
+	}
+	captureOutput(func() error {
+		monitor.check(jail.ExpiresAt.Add(-5 * time.Minute))
+		return nil
+	})
+	if len(received) != 1 {
+		t.Errorf("Expected a notification of the extended jail, got %d", len(received))
+	}
+
+	captureOutput(func() error {
+		monitor.check(jail.ExpiresAt)
+		return nil
+	})
+	if _, exists := state.ActiveJails[pid]; exists {
+		t.Errorf("Expired jail not released")
+	}
+	if len(state.History) != 1 || state.History[0].PID != pid {
+		t.Errorf("Expected the expired jail in the history, got %+v", state.History)
+	}
+	if err := executeCommand(state, "extend "+pidStr+" 1h"); err == nil {
+		t.Errorf("Expected an error when extending a released jail")
+	}
+}
+
+// TestSuspects tests the ranking of the top consumers and their jail hints
+func TestSuspects(t *testing.T) {
+	suspects := []suspect{
+		{processSnapshot: processSnapshot{PID: 10, CPU: 5, Memory: 300}, IOBytes: 0, Connections: 2},
+		{processSnapshot: processSnapshot{PID: 20, CPU: 90, Memory: 100}, IOBytes: 4096, HasIO: true},
+		{processSnapshot: processSnapshot{PID: 30, CPU: 5, Memory: 200}, Connections: 7},
+		{processSnapshot: processSnapshot{PID: 40}},
+	}
+	for resource, expected := range map[string][]int{
+		"cpu":     {20, 10},
+		"memory":  {10, 30},
+		"io":      {20},
+		"network": {30, 10},
+	} {
+		var pids []int
+		for _, s := range rankSuspects(suspects, resource, 2) {
+			pids = append(pids, s.PID)
+		}
+		if !reflect.DeepEqual(pids, expected) {
+			t.Errorf("rankSuspects(%s) = %v, expected %v", resource, pids, expected)
+		}
+	}
+
+	state := NewJailerState()
+	if hint := suspectHint(state, suspects[1], "cpu"); hint != "jail cpu 20 10%" {
+		t.Errorf("Unexpected hint %q", hint)
+	}
+	state.DisabledJailTypes = map[string]string{"network": "no firewall"}
+	if hint := suspectHint(state, suspects[2], "network"); hint != "-" {
+		t.Errorf("Expected no hint for a disabled jail type, got %q", hint)
+	}
+	jail := newJail(30, "/")
+	jail.AddJailType("cpu")
+	state.ActiveJails[30] = jail
+	if hint := suspectHint(state, suspects[2], "network"); hint != "jailed: cpu" {
+		t.Errorf("Expected the jail types of a jailed process, got %q", hint)
+	}
+
+	cmd := exec.Command("sh", "-c", "while :; do :; done")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start a busy loop: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	output, err := captureOutput(func() error { return executeCommand(NewJailerState(), "suspects 20 --by cpu") })
+	if err != nil {
+		t.Fatalf("suspects failed: %v", err)
+	}
+	if !strings.Contains(output, fmt.Sprintf("jail cpu %d 10%%", cmd.Process.Pid)) {
+		t.Errorf("Expected the busy loop among the suspects, got:\n%s", output)
+	}
+	if err := executeCommand(NewJailerState(), "suspects --by disk"); err == nil {
+		t.Errorf("Expected an error for an unknown resource")
+	}
+}
+
+// TestPicker tests the search, the navigation and the jail type choice of pick with
+// scripted keys
+func TestPicker(t *testing.T) {
+	processes := func() []processSnapshot {
+		return []processSnapshot{
+			{PID: 101, Name: "bash", User: "alice", Cmdline: "-bash", CPU: 1},
+			{PID: 102, Name: "nginx", User: "www", Cmdline: "nginx: master process", CPU: 50},
+			{PID: 103, Name: "nginx", User: "www", Cmdline: "nginx: worker process", CPU: 10},
+			{PID: 104, Name: "xmrig", User: "alice", Cmdline: "/tmp/xmrig", CPU: 90, Jailed: true},
+		}
+	}
+	state := NewJailerState()
+	pick := func(p *picker, keys string) *processSnapshot {
+		var output bytes.Buffer
+		selected, err := runPicker(p, strings.NewReader(keys), &output, 80, func() []processSnapshot {
+			return sortPickProcesses(processes())
+		})
+		if err != nil {
+			t.Fatalf("runPicker(%q) failed: %v", keys, err)
+		}
+		return selected
+	}
+
+	p := newPicker(state, processes(), pickChoice{JailType: "cpu", Args: []string{"20%"}}, 10)
+	if p.processes[0].PID != 104 || p.choices[0].String() != "cpu 20%" {
+		t.Fatalf("Unexpected order %+v or choices %+v", p.processes, p.choices)
+	}
+	if selected := pick(p, "NGINX\x1b[B\t\r"); selected == nil || selected.PID != 103 {
+		t.Errorf("Expected the nginx worker, got %+v", selected)
+	}
+	if choice := p.choices[p.choice]; choice.JailType != "network" {
+		t.Errorf("Expected the network jail after Tab, got %s", choice)
+	}
+	if selected := pick(p, "\x1b[Z\x15alice\x1b[A\x1b[A\r"); selected == nil || selected.PID != 104 || p.choices[p.choice].String() != "cpu 20%" {
+		t.Errorf("Expected xmrig with cpu 20%%, got %+v", selected)
+	}
+
+	// Enter without a match does nothing, Esc cancels
+	p = newPicker(state, processes(), pickChoice{}, 2)
+	if selected := pick(p, "nothing\r\x7f\x7f\x7f\x7f\x7f\x7f\x7f\x1b"); selected != nil || p.search != "" {
+		t.Errorf("Expected a cancelled picker with an empty search, got %+v, %q", selected, p.search)
+	}
+	if selected := pick(p, "\x1b[6~\x1b[6~\x12\x0e\x0e\x0e\r"); selected == nil || selected.PID != 101 || p.offset != 2 {
+		t.Errorf("Expected the last process scrolled into view, got %+v at offset %d", selected, p.offset)
+	}
+
+	state.DisabledJailTypes = map[string]string{"network": "no firewall"}
+	p = newPicker(state, processes(), pickChoice{}, 10)
+	for _, choice := range p.choices {
+		if choice.JailType == "network" || choice.JailType == "both" {
+			t.Errorf("Offered the disabled %s jail", choice.JailType)
+		}
+	}
+
+	if err := executeCommand(NewJailerState(), "pick cpu"); err == nil {
+		t.Errorf("Expected an error without a terminal")
+	}
+}
+
+// TestDashboard tests the graphs, the panes and the keys of jailer tui
+func TestDashboard(t *testing.T) {
+	if line := sparkline([]float64{0, 50, 100}, 100); line != "▁▅█" {
+		t.Errorf("sparkline = %q", line)
+	}
+	if line := sparkline([]float64{2, 4}, 0); line != "▅█" {
+		t.Errorf("sparkline scaled to the highest value = %q", line)
+	}
+
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	jail := newJail(pid, "/")
+	jail.AddJailType("network")
+	state.ActiveJails[pid] = jail
+	d := newDashboard(state, nil)
+	for i := 0; i < dashboardEvents+2; i++ {
+		d.addEvent(jailEvent{Event: "created", PID: i, Name: "event" + strconv.Itoa(i)})
+	}
+	d.addOutput("first\nsecond\nthird\nfourth\nfifth\n")
+	captureOutput(func() error {
+		d.refresh()
+		d.refresh()
+		return nil
+	})
+	if len(d.entries) != 1 || len(d.samples[pid]) != 2 {
+		t.Fatalf("Expected 1 jail with 2 samples, got %d, %d", len(d.entries), len(d.samples[pid]))
+	}
+	if len(d.events) != dashboardEvents || d.events[0].Name != "event2" || len(d.output) != dashboardOutput || d.output[0] != "second" {
+		t.Errorf("Unexpected panes, events %+v, output %q", d.events, d.output)
+	}
+
+	var screen bytes.Buffer
+	d.render(&screen, 100, 40)
+	for _, expected := range []string{strconv.Itoa(pid), "Events:", "event7", "fifth", "q quit"} {
+		if !strings.Contains(screen.String(), expected) {
+			t.Errorf("Expected %q on the screen:\n%s", expected, screen.String())
+		}
+	}
+
+	// The command line, then the keys of the jails
+	for _, r := range ":lisx" {
+		d.handleKey(pickKeyRune, r)
+	}
+	d.handleKey(pickKeyBackspace, 127)
+	d.handleKey(pickKeyRune, 't')
+	if !d.editing || d.input != "list" {
+		t.Errorf("Expected list on the command line, got %q", d.input)
+	}
+	output, _ := captureOutput(func() error {
+		d.handleKey(pickKeyEnter, '\r')
+		return nil
+	})
+	if d.editing || !strings.Contains(output, strconv.Itoa(pid)) || d.output[len(d.output)-1] != "$> list" {
+		t.Errorf("Expected list to run, got %q and %q", output, d.output)
+	}
+	d.handleKey(pickKeyRune, '+')
+	if d.output[len(d.output)-1] != "Error: the highlighted process has no CPU jail" {
+		t.Errorf("Expected an error adjusting a network jail, got %q", d.output)
+	}
+	d.handleKey(pickKeyRune, 'j')
+	if d.selected != 0 {
+		t.Errorf("Moved past the last jail")
+	}
+	if d.handleKey(pickKeyCancel, 27) || !d.handleKey(pickKeyCancel, 3) || !d.handleKey(pickKeyRune, 'q') {
+		t.Errorf("Expected Esc to stay and Ctrl+C and q to quit")
+	}
+}
+
+// TestPromptStatus tests the count of jails and the flag of the unseen alerts in the prompt
+func TestPromptStatus(t *testing.T) {
+	takePromptWarnings()
+	state := NewJailerState()
+	if prompt := promptText(state); prompt != "jailer[0]> " {
+		t.Errorf("promptText = %q", prompt)
+	}
+	state.ActiveJails[4242] = newJail(4242, "/")
+	state.ActiveJails[4343] = newJail(4343, "/")
+	if prompt := promptText(state); prompt != "jailer[2]> " {
+		t.Errorf("promptText = %q", prompt)
+	}
+
+	jail := state.ActiveJails[4242]
+	jail.Name = "miner"
+	captureOutput(func() error {
+		sendNotification(state, newNotification("oom_kill", jail, "OOM killer killed 1 processes"))
+		return nil
+	})
+	if prompt := promptText(state); prompt != "jailer[2!]> " {
+		t.Errorf("Expected the alert flagged, got %q", prompt)
+	}
+	output, _ := captureOutput(func() error { return executeCommand(state, "warnings") })
+	if !strings.Contains(output, "OOM killer killed 1 processes") {
+		t.Errorf("Expected the alert in the warnings, got %q", output)
+	}
+	if prompt := promptText(state); prompt != "jailer[2]> " {
+		t.Errorf("Expected the flag cleared once seen, got %q", prompt)
+	}
+	output, _ = captureOutput(func() error { return executeCommand(state, "warnings") })
+	if !strings.Contains(output, "No new warnings") {
+		t.Errorf("Expected no warnings left, got %q", output)
+	}
+
+	for i := 0; i < maxPromptWarnings+10; i++ {
+		addPromptWarning("warning " + strconv.Itoa(i))
+	}
+	if warnings := takePromptWarnings(); len(warnings) != maxPromptWarnings || warnings[0].Message != "warning 10" {
+		t.Errorf("Expected the last %d warnings, got %d", maxPromptWarnings, len(warnings))
+	}
+}
+
+// TestPipedCommands tests the commands read from a pipe and the exit status of the failures
+func TestPipedCommands(t *testing.T) {
+	state := NewJailerState()
+	var status int
+	output, _ := captureOutput(func() error {
+		status = runPipedCommands(state, strings.NewReader("# triage\n\nlist\nwarnings\n"))
+		return nil
+	})
+	if status != 0 {
+		t.Errorf("Expected status 0, got %d: %s", status, output)
+	}
+	if !strings.Contains(output, "No active jails") {
+		t.Errorf("Expected the output of list, got %q", output)
+	}
+
+	output, _ = captureOutput(func() error {
+		status = runPipedCommands(state, strings.NewReader("bogus\nlist\nwatch\nlist; top\n"))
+		return nil
+	})
+	if status != 1 {
+		t.Errorf("Expected status 1 after a failed command, got %d", status)
+	}
+	for _, expected := range []string{"Error: line 1: unknown command: bogus", "No active jails", "Error: line 3: watch needs a terminal", "Error: line 4: top needs a terminal"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q in the output, got %q", expected, output)
+		}
+	}
+
+	output, _ = captureOutput(func() error {
+		status = runPipedCommands(state, strings.NewReader("list\nexit\nbogus\n"))
+		return nil
+	})
+	if status != 0 || strings.Contains(output, "bogus") {
+		t.Errorf("Expected the commands after exit skipped, got status %d: %q", status, output)
+	}
+
+	// The jails are kept at the end of the input until they are released
+	state.ActiveJails[1234] = newJail(1234, "/")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		stateMutex.Lock()
+		delete(state.ActiveJails, 1234)
+		stateMutex.Unlock()
+	}()
+	start := time.Now()
+	output, _ = captureOutput(func() error {
+		keepPipedJails(state)
+		return nil
+	})
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || !strings.Contains(output, "Keeping 1 jails") {
+		t.Errorf("Expected the jails to be kept until released, returned after %v: %q", elapsed, output)
+	}
+}
+
+// TestCommandErrors tests the classification of the errors reported with -error-format json
+func TestCommandErrors(t *testing.T) {
+	tests := []struct {
+		input     string
+		message   string
+		code      string
+		pid       int
+		operation string
+	}{
+		{"jail cpu 4242 10%", "process 4242 does not exist", "pid_not_found", 4242, "jail"},
+		{"jail c 4242 10%", "failed to move PID 4242 to CPU jail cgroup: write /sys/fs/cgroup/cpu/jail-cpu/cgroup.procs: permission denied", "permission_denied", 4242, "jail"},
+		{"unjail 4242", "process 4242 is not jailed", "not_jailed", 4242, "unjail"},
+		{"frobnicate 4242", "unknown command: frobnicate (type 'help' for available commands)", "unknown_command", 4242, "frobnicate"},
+		{"extend 4242 soon", "invalid duration: soon", "invalid_argument", 4242, "extend"},
+		{"list; info 4242", "1 of 2 commands failed", "commands_failed", 0, ""},
+		{"selftest", "something unexpected", "failed", 0, "selftest"},
+	}
+	for _, test := range tests {
+		report := newCommandError(test.input, 0, errors.New(test.message))
+		if report.Code != test.code || report.PID != test.pid || report.Operation != test.operation || report.Message != test.message {
+			t.Errorf("newCommandError(%q, %q) = %+v", test.input, test.message, report)
+		}
+	}
+
+	var output bytes.Buffer
+	errorFormat, errorOutput = "json", &output
+	defer func() { errorFormat, errorOutput = "text", os.Stderr }()
+	state := NewJailerState()
+	captureOutput(func() error {
+		runPipedCommands(state, strings.NewReader("list\nunjail 4242\n"))
+		return nil
+	})
+	var report commandError
+	if err := json.Unmarshal(output.Bytes(), &report); err != nil {
+		t.Fatalf("Expected a JSON error, got %q: %v", output.String(), err)
+	}
+	if report.Code != "not_jailed" || report.PID != 4242 || report.Operation != "unjail" || report.Line != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if _, err := parseErrorFormat("xml"); err == nil {
+		t.Error("Expected -error-format xml to be rejected")
+	}
+}
+
+// TestWriteAuditEvent tests that audit events are appended as JSON lines
+func TestWriteAuditEvent(t *testing.T) {
+	state := NewJailerState()
+	state.Config.AuditLog = filepath.Join(t.TempDir(), "audit", "audit.log")
+	state.Operator = "alice as root via ssh from 10.0.0.5"
+
+	for i := 0; i < 2; i++ {
+		writeAuditEvent(state, AuditEvent{
+			Action:    "jail",
+			JailTypes: []string{"network"},
+			Targets:   []AuditTarget{newAuditTarget(100+i, "worker", nil)},
+		})
+	}
+
+	content, err := os.ReadFile(state.Config.AuditLog)
+	if err != nil {
+		t.Fatalf("Audit log not written: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 audit lines, got %d", len(lines))
+	}
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil {
+		t.Fatalf("Invalid audit line: %v", err)
+	}
+	if event.Action != "jail" || len(event.Targets) != 1 || event.Targets[0].PID != 101 || !event.Targets[0].Success {
+		t.Errorf("Unexpected audit event: %+v", event)
+	}
+	if event.Operator != state.Operator {
+		t.Errorf("Audit event operator = %q, expected %q", event.Operator, state.Operator)
+	}
+}
+
+// TestOperatorAttribution tests how the operator of local and remote commands is described
+func TestOperatorAttribution(t *testing.T) {
+	if operator := localOperator(); operator == "" || operator == "?" {
+		t.Errorf("localOperator() = %q", operator)
+	}
+
+	// The SSH session is found in the environment of an ancestor
+	cmd := exec.Command("sh", "-c", "sleep 10 & wait")
+	cmd.Env = append(os.Environ(), "SSH_CONNECTION=10.0.0.5 51234 10.0.0.1 22")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	if client := sshClientAddress(cmd.Process.Pid); client != "10.0.0.5" {
+		t.Errorf("sshClientAddress = %q, expected 10.0.0.5", client)
+	}
+
+	agentConn, controllerConn := tcpPipe(t)
+	defer agentConn.Close()
+	defer controllerConn.Close()
+	rc := newRemoteConn(agentConn)
+	address := agentConn.RemoteAddr().String()
+	if operator := remoteOperator(rc, "bob"); operator != "bob via controller "+address {
+		t.Errorf("remoteOperator = %q", operator)
+	}
+	if operator := remoteOperator(rc, ""); operator != "controller "+address {
+		t.Errorf("remoteOperator without user = %q", operator)
+	}
+}
+
+// TestTruncate tests column truncation
+func TestTruncate(t *testing.T) {
+	if value := truncate("network,cpu,rlimit,oom,coredump", 12, false); value != "network,cpu…" {
+		t.Errorf("Unexpected truncation: %q", value)
+	}
+	if value := truncate("network,cpu,rlimit,oom,coredump", 12, true); value != "network,cpu,rlimit,oom,coredump" {
+		t.Errorf("Wide output should not be truncated: %q", value)
+	}
+	if value := truncate("short", 12, false); value != "short" {
+		t.Errorf("Short values should not change: %q", value)
+	}
+}
+
+// TestUndo tests reverting jail and unjail commands with an rlimit jail, which doesn't
+// need cgroups or a firewall
+func TestUndo(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+	pidStr := strconv.Itoa(pid)
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+
+	if err := undoLastOperation(state); err == nil {
+		t.Error("Expected an error with nothing to undo")
+	}
+
+	if err := executeCommand(state, "jail rlimit "+pidStr+" nofile=64 --reason test --for 1h --persistent"); err != nil {
+		t.Skipf("Cannot apply rlimit jail: %v", err)
+	}
+	expiresAt := state.ActiveJails[pid].ExpiresAt
+	if err := executeCommand(state, "unjail "+pidStr); err != nil {
+		t.Fatalf("Unjail failed: %v", err)
+	}
+	if _, jailed := state.ActiveJails[pid]; jailed {
+		t.Fatal("Process still jailed after unjail")
+	}
+
+	// Undoing the unjail puts the process back with the same limits and reason
+	if err := undoLastOperation(state); err != nil {
+		t.Fatalf("Undo of unjail failed: %v", err)
+	}
+	jail, jailed := state.ActiveJails[pid]
+	if !jailed || !jail.HasJailType("rlimit") || jail.Rlimits["nofile"] != 64 || jail.Reason != "test" {
+		t.Fatalf("Jail not restored by undo: %+v", jail)
+	}
+	if !jail.ExpiresAt.Equal(expiresAt) || !jail.Persistent {
+		t.Errorf("Expiry and persistence not restored by undo: %v, %v", jail.ExpiresAt, jail.Persistent)
+	}
+	var limit unix.Rlimit
+	if err := unix.Prlimit(pid, unix.RLIMIT_NOFILE, nil, &limit); err != nil || limit.Cur != 64 {
+		t.Errorf("Limit not restored by undo: %+v (%v)", limit, err)
+	}
+
+	// Undoing the jail releases the process
+	if err := undoLastOperation(state); err != nil {
+		t.Fatalf("Undo of jail failed: %v", err)
+	}
+	if _, jailed := state.ActiveJails[pid]; jailed {
+		t.Error("Process still jailed after undoing the jail")
+	}
+	if len(state.Operations) != 0 {
+		t.Errorf("Expected an empty operation log, got %d entries", len(state.Operations))
+	}
+}
+
+// TestGetAllDescendants tests discovery of a process tree several levels deep
+func TestGetAllDescendants(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sh -c 'sleep 30; true' & sleep 30; true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start shell: %v", err)
+	}
+	defer func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// Wait for the tree to be started
+	var descendants []int
+	for i := 0; i < 50; i++ {
+		var err error
+		if descendants, err = hostProcesses.descendants(cmd.Process.Pid); err != nil {
+			t.Fatalf("Failed to get descendants: %v", err)
+		}
+		if len(descendants) >= 3 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Inner sh, its sleep and the outer sleep
+	if len(descendants) != 3 {
+		t.Fatalf("Expected 3 descendants, got %v", descendants)
+	}
+	for _, pid := range descendants {
+		ancestor := pid
+		for depth := 0; depth < 3 && ancestor != cmd.Process.Pid; depth++ {
+			ancestor, _ = hostProcesses.parent(ancestor)
+		}
+		if ancestor != cmd.Process.Pid {
+			t.Errorf("Descendant %d is not in the tree of %d", pid, cmd.Process.Pid)
+		}
+	}
+}
+
+// TestReadTaskChildren tests that the children files and the /proc scan agree
+func TestReadTaskChildren(t *testing.T) {
+	if !taskChildrenSupported() {
+		t.Skip("Kernel without /proc/<pid>/task/<tid>/children")
+	}
+
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// The child is started by one of the threads of the test process
+	children, err := readTaskChildren(os.Getpid())
+	if err != nil {
+		t.Fatalf("Failed to read children: %v", err)
+	}
+	tree, err := buildProcessTree()
+	if err != nil {
+		t.Fatalf("Failed to scan /proc: %v", err)
+	}
+
+	found := false
+	for _, pid := range children {
+		if pid == cmd.Process.Pid {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Child %d not in the children files: %v", cmd.Process.Pid, children)
+	}
+	if len(children) != len(tree[os.Getpid()]) {
+		t.Errorf("Children files %v and /proc scan %v disagree", children, tree[os.Getpid()])
+	}
+}
+
+// TestForEachProcess tests the worker pool used to change descendants concurrently
+func TestForEachProcess(t *testing.T) {
+	var pids []int
+	for pid := 1; pid <= 100; pid++ {
+		pids = append(pids, pid)
+	}
+
+	var mutex sync.Mutex
+	seen := make(map[int]int)
+	errs := forEachProcess(pids, func(pid int) error {
+		mutex.Lock()
+		seen[pid]++
+		mutex.Unlock()
+		if pid%10 == 0 {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	})
+
+	if len(seen) != 100 {
+		t.Errorf("Expected 100 processes visited, got %d", len(seen))
+	}
+	for pid, count := range seen {
+		if count != 1 {
+			t.Errorf("PID %d visited %d times", pid, count)
+		}
+	}
+	if len(errs) != 10 || errs[50] == nil {
+		t.Errorf("Expected 10 errors, got %v", errs)
+	}
+
+	if summary := summarizeProcessErrors(errs); summary != "failed" {
+		t.Errorf("Unexpected error summary: %s", summary)
+	}
+
+	if errs := forEachProcess(nil, func(int) error { return nil }); len(errs) != 0 {
+		t.Errorf("Expected no error for an empty list, got %v", errs)
+	}
+}
+
+// TestOriginalCgroups tests that each process is restored to its own cgroup
+func TestOriginalCgroups(t *testing.T) {
+	self := os.Getpid()
+	state := NewJailerState()
+	jail := newJail(1234, "/system.slice/app.service")
+
+	if err := jail.saveOriginalCgroup(state, self); err != nil {
+		t.Fatalf("Failed to save original cgroup: %v", err)
+	}
+	current, err := getProcessCgroup(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin := jail.originalCgroupOf(self); origin != current {
+		t.Errorf("Expected origin %s for PID %d, got %s", current, self, origin)
+	}
+
+	// A process moved first keeps its first origin
+	jail.OriginalCgroups[self] = "/user.slice/worker"
+	if err := jail.saveOriginalCgroup(state, self); err != nil || jail.originalCgroupOf(self) != "/user.slice/worker" {
+		t.Errorf("Origin overwritten: %s (%v)", jail.originalCgroupOf(self), err)
+	}
+
+	// Unknown processes fall back to the origin of the main process
+	if origin := jail.originalCgroupOf(999999); origin != "/system.slice/app.service" {
+		t.Errorf("Expected fallback to the main process origin, got %s", origin)
+	}
+}
+
+// TestFormatBytes tests human-readable sizes
+func TestFormatBytes(t *testing.T) {
+	cases := map[uint64]string{
+		512:             "512B",
+		2048:            "2.0K",
+		5 * 1024 * 1024: "5.0M",
+	}
+	for bytes, expected := range cases {
+		if formatted := formatBytes(bytes); formatted != expected {
+			t.Errorf("formatBytes(%d) = %s, expected %s", bytes, formatted, expected)
+		}
+	}
+}
+
+// TestCommandExists tests command existence check
+func TestCommandExists(t *testing.T) {
+	// Test with a command that certainly exists
+	if !commandExists("ls") {
+		t.Error("ls command should exist on Unix systems")
+	}
+
+	// Test with a command that doesn't exist
+	if commandExists("this_command_does_not_exist_12345") {
+		t.Error("Non-existent command should not be found")
+	}
+}
+
+// TestCgroupInitialization tests cgroup initialization (requires root)
+func TestCgroupInitialization(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping cgroup initialization test: requires root privileges")
+	}
+
+	state := NewJailerState()
+	err := initializeCgroup(state)
+	if err != nil {
+		t.Fatalf("Failed to initialize cgroups: %v", err)
+	}
+
+	// Check that paths are set
+	if state.NetworkCgroupPath == "" {
+		t.Error("NetworkCgroupPath should be set")
+	}
+
+	if state.CpuCgroupPath == "" {
+		t.Error("CpuCgroupPath should be set")
+	}
+
+	if state.NetworkCpuCgroupPath == "" {
+		t.Error("NetworkCpuCgroupPath should be set")
+	}
+
+	if state.CgroupVersion != 1 && state.CgroupVersion != 2 {
+		t.Errorf("Invalid cgroup version: %d", state.CgroupVersion)
+	}
+
+	t.Logf("Initialized cgroups v%d", state.CgroupVersion)
+	t.Logf("Network cgroup path: %s", state.NetworkCgroupPath)
+	t.Logf("CPU cgroup path: %s", state.CpuCgroupPath)
+	t.Logf("Combined cgroup path: %s", state.NetworkCpuCgroupPath)
+}
+
+// BenchmarkGetProcessChildren benchmark for retrieving child processes
+func BenchmarkGetProcessChildren(b *testing.B) {
+	currentPID := os.Getpid()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := getProcessChildren(currentPID)
+		if err != nil {
+			b.Fatalf("Failed to get process children: %v", err)
+		}
+	}
+}
+
+// BenchmarkGetAllDescendants benchmark for retrieving a process tree
+func BenchmarkGetAllDescendants(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := hostProcesses.descendants(1); err != nil {
+			b.Fatalf("Failed to get descendants: %v", err)
+		}
+	}
+}
+
+// BenchmarkProcessExists benchmark for process existence check
+func BenchmarkProcessExists(b *testing.B) {
+	currentPID := os.Getpid()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hostProcesses.exists(currentPID)
+	}
+}
+
+// BenchmarkJailMethods benchmark for jail type operations
+func BenchmarkJailMethods(b *testing.B) {
+	jail := &Jail{
+		PID:            1234,
+		OriginalCgroup: "/",
+		JailTypes:      []string{"network"},
+		Timestamp:      time.Now(),
+		Children:       []int{},
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		jail.AddJailType("cpu")
+		jail.HasJailType("cpu")
+		jail.RemoveJailType("cpu")
+		jail.GetJailTypesString()
+	}
+}
+
+func TestCpuWeight(t *testing.T) {
+	if weight, err := parseCpuWeight("weight=10"); err != nil || weight != 10 {
+		t.Errorf("Unexpected weight %d (%v)", weight, err)
+	}
+	for _, value := range []string{"weight=0", "weight=10001", "weight=low"} {
+		if _, err := parseCpuWeight(value); err == nil {
+			t.Errorf("Expected an error for %s", value)
+		}
+	}
+
+	state := NewJailerState()
+	state.CgroupVersion = 2
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "cpu.max"), []byte("1000 100000\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "cpu.weight"), []byte("100\n"), 0644)
+	jail := &Jail{PID: 4242, JailTypes: []string{"cpu"}, CpuWeight: 10, CgroupPath: dir}
+	if !jail.usesDedicatedCgroup() {
+		t.Fatal("Expected a weighted CPU jail to use a cgroup of its own")
+	}
+	if err := setupJailCgroupCpuLimit(state, jail, dir); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "cpu.max")); !strings.HasPrefix(string(content), "max ") {
+		t.Errorf("Expected no quota for a weighted jail, got %q", content)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "cpu.weight")); string(content) != "10\n" {
+		t.Errorf("Expected cpu.weight 10, got %q", content)
+	}
+	if args := jailTypeArgs(jail, "cpu"); strings.Join(args, " ") != "weight=10" {
+		t.Errorf("Unexpected jail type args %v", args)
+	}
+
+	// Releasing the weight restores the default
+	jail.CpuWeight, jail.CpuPercent = 0, 50
+	if err := setupJailCgroupCpuLimit(state, jail, dir); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "cpu.weight")); string(content) != "100\n" {
+		t.Errorf("Expected the default cpu.weight, got %q", content)
+	}
+
+	state.CgroupVersion = 1
+	os.WriteFile(filepath.Join(dir, "cpu.shares"), []byte("1024\n"), 0644)
+	jail.CpuWeight, jail.CpuPercent = 50, 0
+	if err := setupJailCgroupCpuWeight(state, jail, dir); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "cpu.shares")); string(content) != "512\n" {
+		t.Errorf("Expected cpu.shares 512, got %q", content)
+	}
+}
+
+func TestCpuBurst(t *testing.T) {
+	if burst, err := parseCpuBurst("20ms"); err != nil || burst != 20*time.Millisecond {
+		t.Errorf("Unexpected burst %s (%v)", burst, err)
+	}
+	for _, value := range []string{"0s", "-5ms", "soon"} {
+		if _, err := parseCpuBurst(value); err == nil {
+			t.Errorf("Expected an error for --burst %s", value)
+		}
+	}
+
+	state := NewJailerState()
+	state.CgroupVersion = 2
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "cpu.max"), []byte("max 100000\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "cpu.max.burst"), []byte("0\n"), 0644)
+	jail := &Jail{PID: 4242, JailTypes: []string{"cpu"}, CpuPercent: 50, CpuBurst: 20 * time.Millisecond, CgroupPath: dir}
+	if err := setupJailCgroupCpuLimit(state, jail, dir); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "cpu.max.burst")); string(content) != "20000\n" {
+		t.Errorf("Expected a burst of 20000us, got %q", content)
+	}
+
+	// The burst follows the quota down when the limit tightens
+	jail.Adaptive = &adaptiveCpu{TargetPercent: 70, Applied: 5}
+	if err := setupJailCgroupCpuLimit(state, jail, dir); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "cpu.max.burst")); string(content) != "5000\n" {
+		t.Errorf("Expected the burst clamped to the 5ms quota, got %q", content)
+	}
+
+	// Without the burst file the kernel is too old for a burst
+	os.Remove(filepath.Join(dir, "cpu.max.burst"))
+	if err := setupJailCgroupCpuLimit(state, jail, dir); err == nil {
+		t.Error("Expected an error without cpu.max.burst")
+	}
+	jail.CpuBurst = 0
+	if err := setupJailCgroupCpuLimit(state, jail, dir); err != nil {
+		t.Errorf("Expected no burst file to be needed without burst, got %v", err)
+	}
+}
+
+func TestRestoreDestination(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "system.slice", "app.service"), 0755)
+	os.MkdirAll(filepath.Join(root, "user.slice"), 0755)
+
+	if cgroup, note := restoreDestination(root, 2, "/system.slice/app.service", ""); cgroup != "/system.slice/app.service" || note != "" {
+		t.Errorf("Expected the original cgroup, got %s (%s)", cgroup, note)
+	}
+	if cgroup, _ := restoreDestination(root, 2, "/system.slice/gone.service", ""); cgroup != "/" {
+		t.Errorf("Expected the root cgroup by default, got %s", cgroup)
+	}
+	if cgroup, _ := restoreDestination(root, 2, "/system.slice/gone.service", "/user.slice"); cgroup != "/user.slice" {
+		t.Errorf("Expected the fallback cgroup, got %s", cgroup)
+	}
+	if cgroup, _ := restoreDestination(root, 2, "/system.slice/gone.service", "/missing.slice"); cgroup != "/" {
+		t.Errorf("Expected the root cgroup when the fallback is gone too, got %s", cgroup)
+	}
+	cgroup, note := restoreDestination(root, 2, "/system.slice/gone.service", "recreate")
+	if _, err := os.Stat(filepath.Join(root, "system.slice", "gone.service")); cgroup != "/system.slice/gone.service" || err != nil {
+		t.Errorf("Expected the original cgroup to be re-created, got %s (%s, %v)", cgroup, note, err)
+	}
+
+	// With cgroups v1 the cgroup must exist in every hierarchy
+	os.MkdirAll(filepath.Join(root, "memory", "app"), 0755)
+	if cgroup, _ := restoreDestination(root, 1, "/app", ""); cgroup != "/" {
+		t.Errorf("Expected the root cgroup when a hierarchy lacks the cgroup, got %s", cgroup)
+	}
+
+	for _, fallback := range []string{"", "root", "recreate", "/user.slice"} {
+		if err := validateCgroupFallback(fallback); err != nil {
+			t.Errorf("Unexpected error for %q: %v", fallback, err)
+		}
+	}
+	if err := validateCgroupFallback("user.slice"); err == nil {
+		t.Error("Expected an error for a relative fallback")
+	}
+}
+
+func TestFirewallTimeout(t *testing.T) {
+	for value, expected := range map[string]time.Duration{"": defaultFirewallTimeout, "off": 0, "5s": 5 * time.Second} {
+		if timeout, err := parseFirewallTimeout(value); err != nil || timeout != expected {
+			t.Errorf("Unexpected timeout %s for %q (%v)", timeout, value, err)
+		}
+	}
+	if _, err := parseFirewallTimeout("0s"); err == nil {
+		t.Error("Expected an error for a zero timeout")
+	}
+
+	previous := firewallTimeout
+	defer func() { firewallTimeout = previous }()
+	firewallTimeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err := runFirewallCommand("sleep", "5")
+	if err == nil || !strings.Contains(err.Error(), "sleep 5 timed out") {
+		t.Errorf("Expected the command to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the command to be killed, it ran for %s", elapsed)
+	}
+	if err := runFirewallCheck("true"); err != nil {
+		t.Errorf("Unexpected error for a quick command: %v", err)
+	}
+}
+
+func TestRedetectFirewallUnchanged(t *testing.T) {
+	state := NewJailerState()
+	state.FirewallTool = probeFirewallTool()
+	output, err := captureOutput(func() error { return redetectFirewall(state) })
+	if err != nil || !strings.Contains(output, "Firewall backend unchanged") {
+		t.Errorf("Expected the backend to be unchanged, got %q (%v)", output, err)
+	}
+
+	// A failure with the same backend keeps its error
+	failure := fmt.Errorf("failed to add rule")
+	if err := checkFirewallBackend(state, failure); err != failure {
+		t.Errorf("Expected the original error, got %v", err)
+	}
+	redetectingFirewall = true
+	defer func() { redetectingFirewall = false }()
+	state.FirewallTool = "changed"
+	if err := checkFirewallBackend(state, failure); err != failure {
+		t.Errorf("Expected no detection while the rules move, got %v", err)
+	}
+}
+
+func TestOomGroup(t *testing.T) {
+	jail := &Jail{PID: 4242, JailTypes: []string{"cpu"}}
+	if jail.usesDedicatedCgroup() {
+		t.Error("Expected the shared 1% jail not to use a cgroup of its own")
+	}
+	jail.OomGroup = true
+	if !jail.usesDedicatedCgroup() {
+		t.Error("Expected an OOM group to need a cgroup of its own")
+	}
+	if (&Jail{JailTypes: []string{"oom"}, OomGroup: true}).usesDedicatedCgroup() {
+		t.Error("Expected no cgroup for a jail without cgroup-based type")
+	}
+
+	dir := t.TempDir()
+	if err := setupJailOomGroup(dir); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "memory.oom.group")); string(content) != "1\n" {
+		t.Errorf("Expected memory.oom.group 1, got %q", content)
+	}
+
+	state := NewJailerState()
+	state.CgroupVersion = 1
+	err := jailProcess(state, "cpu", strconv.Itoa(os.Getpid()), nil, JailOptions{OomGroup: true})
+	if err == nil || !strings.Contains(err.Error(), "cgroups v2") {
+		t.Errorf("Expected --oom-group to need cgroups v2, got %v", err)
+	}
+}
+
+func TestJailSpecs(t *testing.T) {
+	specs, err := parseJailSpecs("n,CPU=20%+weight=50,rlimit", []string{"nofile=64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types := jailSpecTypes(specs); strings.Join(types, ",") != "network,cpu,rlimit" {
+		t.Errorf("Unexpected jail types %v", types)
+	}
+	if cpu := findJailSpec(specs, "cpu"); cpu == nil || strings.Join(cpu.Args, " ") != "20% weight=50" {
+		t.Errorf("Unexpected cpu spec %+v", cpu)
+	}
+	if rlimit := findJailSpec(specs, "rlimit"); strings.Join(rlimit.Args, " ") != "nofile=64" {
+		t.Errorf("Expected the arguments after the PIDs on the last type, got %v", rlimit.Args)
+	}
+	if findJailSpec(specs, "oom") != nil {
+		t.Error("Expected no oom spec")
+	}
+
+	if spec, err := normalizeJailSpec("both"); err != nil || spec != "network,cpu" {
+		t.Errorf("Unexpected normalized both %q (%v)", spec, err)
+	}
+	if types := expandJailType("c=10%,coredump"); strings.Join(types, ",") != "cpu,coredump" {
+		t.Errorf("Unexpected expanded jail types %v", types)
+	}
+
+	for _, value := range []string{"network,io=10M", "both,cpu", "network,n", "cpu=", "both=1"} {
+		if _, err := parseJailSpecs(value, nil); err == nil {
+			t.Errorf("Expected an error for %s", value)
+		}
+	}
+	if _, err := parseJailSpecs("network,cpu=20%", []string{"30%"}); err == nil {
+		t.Error("Expected an error for arguments given twice to the last type")
+	}
+}
+
+// TestMemoryJail tests the limit of the memory jail and its removal
+func TestMemoryJail(t *testing.T) {
+	specs, err := parseJailSpecs("network,cpu,memory=256M", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types := jailSpecTypes(specs); strings.Join(types, ",") != "network,cpu,memory" {
+		t.Errorf("Unexpected jail types %v", types)
+	}
+	memory := findJailSpec(specs, "memory")
+	if memory == nil {
+		t.Fatal("Expected a memory spec")
+	}
+	if limit, err := parseMemoryLimit(memory.Args); err != nil || limit != 256<<20 {
+		t.Errorf("Unexpected memory limit %d (%v)", limit, err)
+	}
+	for _, args := range [][]string{nil, {"1"}, {"lots"}, {"1M", "2M"}} {
+		if _, err := parseMemoryLimit(args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+
+	state := NewJailerState()
+	state.Output = io.Discard
+	state.CgroupVersion = 2
+	jail := &Jail{PID: 1, JailTypes: []string{"memory"}, MemoryLimit: 256 << 20, CgroupPath: t.TempDir()}
+	if !jail.usesDedicatedCgroup() {
+		t.Error("Expected a dedicated cgroup for a memory jail")
+	}
+	if err := setupMemoryLimit(state, jail); err != nil {
+		t.Fatal(err)
+	}
+	limitFile := filepath.Join(jail.CgroupPath, "memory.max")
+	if data, _ := os.ReadFile(limitFile); string(data) != "268435456\n" {
+		t.Errorf("Unexpected memory.max %q", data)
+	}
+	if err := resetControllerLimits(state, jail, "memory"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(limitFile); string(data) != "max\n" {
+		t.Errorf("Expected the limit lifted, got %q", data)
+	}
+
+	// The request as given, on a real process
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping the memory jail of a process: requires root privileges")
+	}
+	if _, err := detectFirewallTool(); err != nil {
+		t.Skipf("Skipping the memory jail of a process: %v", err)
+	}
+	state = NewJailerState()
+	state.Output = io.Discard
+	state.Config.AuditLog = "off"
+	if err := initializeCgroup(state); err != nil {
+		t.Skipf("Skipping the memory jail of a process: %v", err)
+	}
+	if err := setupNetworkJail(state); err != nil {
+		t.Skipf("Skipping the memory jail of a process: %v", err)
+	}
+	defer cleanupNetworkJail(state)
+	defer cleanupCgroup(state)
+
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	pidStr := strconv.Itoa(cmd.Process.Pid)
+	if err := executeCommand(state, "jail network,cpu,memory=256M "+pidStr); err != nil {
+		t.Fatal(err)
+	}
+	defer executeCommand(state, "unjail "+pidStr)
+	jail = state.ActiveJails[cmd.Process.Pid]
+	if jail == nil || !jail.HasJailType("memory") || jail.MemoryLimit != 256<<20 {
+		t.Fatalf("Unexpected jail %+v", jail)
+	}
+	limitFile = memoryLimitFile(state, jail)
+	if data, err := os.ReadFile(limitFile); err != nil || strings.TrimSpace(string(data)) != "268435456" {
+		t.Errorf("Unexpected memory limit %q (%v)", data, err)
+	}
+	if err := executeCommand(state, "unjail memory "+pidStr); err != nil {
+		t.Fatal(err)
+	}
+	if jail.HasJailType("memory") || !jail.HasJailType("cpu") {
+		t.Errorf("Expected only the memory jail removed, got %v", jail.JailTypes)
+	}
+}
+
+func TestUnjailAll(t *testing.T) {
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	if err := executeCommand(state, "unjail all"); err != nil {
+		t.Fatalf("Expected nothing to release, got %v", err)
+	}
+
+	var pids []string
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command("sleep", "30")
+		if err := cmd.Start(); err != nil {
+			t.Skipf("Cannot start sleep: %v", err)
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+		pids = append(pids, strconv.Itoa(cmd.Process.Pid))
+	}
+	if err := executeCommand(state, "jail rlimit "+strings.Join(pids, " ")+" nofile=64"); err != nil {
+		t.Skipf("Cannot apply rlimit jails: %v", err)
+	}
+
+	// Without a terminal the release has to be confirmed with --yes
+	if err := executeCommand(state, "unjail all"); err == nil || len(state.ActiveJails) != 2 {
+		t.Fatalf("Expected a refusal without --yes, got %v", err)
+	}
+	if err := executeCommand(state, "unjail 1 --yes"); err == nil {
+		t.Error("Expected --yes to be refused for a single process")
+	}
+	if err := executeCommand(state, "unjail all --yes"); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.ActiveJails) != 0 {
+		t.Errorf("Expected no jail left, got %d", len(state.ActiveJails))
+	}
+
+	// A single undo brings all of them back
+	if err := undoLastOperation(state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.ActiveJails) != 2 {
+		t.Errorf("Expected the 2 jails back after undo, got %d", len(state.ActiveJails))
+	}
+	executeCommand(state, "unjail all --yes")
+}
+
+func TestUnjailMatching(t *testing.T) {
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	var pids []string
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command("sleep", "30")
+		if err := cmd.Start(); err != nil {
+			t.Skipf("Cannot start sleep: %v", err)
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+		pids = append(pids, strconv.Itoa(cmd.Process.Pid))
+	}
+	if err := executeCommand(state, "jail rlimit "+strings.Join(pids, " ")+" nofile=64"); err != nil {
+		t.Skipf("Cannot apply rlimit jails: %v", err)
+	}
+
+	for _, command := range []string{"unjail name:chrome", "unjail cpu name:sleep", "unjail name:[", "unjail bogus name:sleep", "unjail 1 --dry-run"} {
+		if err := executeCommand(state, command); err == nil {
+			t.Errorf("Expected an error for %s", command)
+		}
+	}
+	if err := executeCommand(state, "unjail name:sle* --dry-run"); err != nil || len(state.ActiveJails) != 2 {
+		t.Fatalf("Expected the dry run to keep the jails, got %v", err)
+	}
+	if err := executeCommand(state, "unjail rlimit where name==\"sleep\" && pid=="+pids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.ActiveJails) != 1 {
+		t.Errorf("Expected the selector to release 1 jail, %d left", len(state.ActiveJails))
+	}
+	if err := executeCommand(state, "unjail name:slee"); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.ActiveJails) != 0 {
+		t.Errorf("Expected the name pattern to release the last jail, %d left", len(state.ActiveJails))
+	}
+}
+
+func TestJailHistoryLog(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pidStr := strconv.Itoa(cmd.Process.Pid)
+
+	state := NewJailerState()
+	state.Config.AuditLog = "off"
+	state.Config.HistoryLog = filepath.Join(t.TempDir(), "history.log")
+	state.Operator = "alice"
+	if err := executeCommand(state, "jail rlimit "+pidStr+" nofile=64 --reason \"incident 42\""); err != nil {
+		t.Skipf("Cannot apply rlimit jail: %v", err)
+	}
+	if err := executeCommand(state, "unjail "+pidStr); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new session reads the records of the previous ones from the log
+	next := NewJailerState()
+	next.Config.HistoryLog = state.Config.HistoryLog
+	records, skipped, err := loadJailHistory(next)
+	if err != nil || skipped != 0 || len(records) != 1 {
+		t.Fatalf("Unexpected history %+v, %d skipped (%v)", records, skipped, err)
+	}
+	record := records[0]
+	if record.Name != "sleep" || record.EndReason != "unjailed" || record.JailedBy != "alice" ||
+		record.ReleasedBy != "alice" || record.Reason != "incident 42" {
+		t.Errorf("Unexpected record %+v", record)
+	}
+
+	now := time.Now()
+	for _, test := range []struct {
+		filter  historyFilter
+		matches bool
+	}{
+		{historyFilter{}, true},
+		{historyFilter{Since: time.Hour, NamePattern: "sle*", JailType: "rlimit"}, true},
+		{historyFilter{NamePattern: "nginx"}, false},
+		{historyFilter{JailType: "cpu"}, false},
+	} {
+		if test.filter.matches(record, now) != test.matches {
+			t.Errorf("Expected %v for %+v", test.matches, test.filter)
+		}
+	}
+	if (historyFilter{Since: time.Hour}).matches(record, now.Add(2*time.Hour)) {
+		t.Error("Expected a jail ended before --since to be left out")
+	}
+	if err := executeCommand(next, "history --since 7d --name sleep"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStateStore(t *testing.T) {
+	for _, config := range []StoreConfig{{Type: "mysql"}, {Path: "/tmp/jailer.db"}, {Type: "sqlite", Samples: "100ms"}} {
+		if err := validateStoreConfig(&config, StateBackendConfig{}); err == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+	config := StoreConfig{Type: "sqlite", Samples: "off"}
+	if err := validateStoreConfig(&config, StateBackendConfig{}); err != nil || config.Path != defaultStorePath || config.samples != 0 {
+		t.Errorf("Unexpected store configuration %+v (%v)", config, err)
+	}
+
+	state := NewJailerState()
+	dir := t.TempDir()
+	state.StatePath = filepath.Join(dir, "state.json")
+	store := state.Store
+	if content, err := store.getDocument(stateDocument); content != nil || err != nil {
+		t.Errorf("Expected no saved state, got %q (%v)", content, err)
+	}
+	if err := store.putDocument(stateDocument, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(state.StatePath); err != nil || string(content) != "{}" {
+		t.Errorf("Expected the state file to be written, got %q (%v)", content, err)
+	}
+	if err := store.deleteDocument(stateDocument); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(state.StatePath); !os.IsNotExist(err) {
+		t.Error("Expected the state file to be removed")
+	}
+
+	// Documents without a path aren't saved
+	if err := store.putDocument(persistentDocument, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := store.getDocument(persistentDocument); content != nil {
+		t.Errorf("Expected no persistent jails document, got %q", content)
+	}
+}
+
+// TestKVStore tests that the kv store keeps the documents and the ended jails of a host in Consul and etcd
+func TestKVStore(t *testing.T) {
+	server := fakeKVServer(t)
+	defer server.Close()
+
+	config := StoreConfig{Type: "kv"}
+	if err := validateStoreConfig(&config, StateBackendConfig{}); err == nil {
+		t.Error("Expected an error for the kv store without a state_backend")
+	}
+
+	for _, backendType := range []string{"consul", "etcd"} {
+		backend := StateBackendConfig{Type: backendType, Endpoint: server.URL, Prefix: "test-" + backendType}
+		if err := validateStoreConfig(&config, backend); err != nil {
+			t.Fatalf("%s: %v", backendType, err)
+		}
+		store, err := newKVStore(backend, "web1")
+		if err != nil {
+			t.Fatalf("%s: %v", backendType, err)
+		}
+		if store.location != backendType+":test-"+backendType+"/store/web1" {
+			t.Errorf("%s: unexpected location %s", backendType, store.location)
+		}
+
+		if content, err := store.getDocument(stateDocument); content != nil || err != nil {
+			t.Errorf("%s: expected no saved state, got %q (%v)", backendType, content, err)
+		}
+		if err := store.putDocument(stateDocument, []byte(`{"jails":[]}`)); err != nil {
+			t.Fatalf("%s: %v", backendType, err)
+		}
+		if content, err := store.getDocument(stateDocument); string(content) != `{"jails":[]}` || err != nil {
+			t.Errorf("%s: read back %q (%v)", backendType, content, err)
+		}
+		if err := store.deleteDocument(stateDocument); err != nil {
+			t.Fatalf("%s: %v", backendType, err)
+		}
+		if content, _ := store.getDocument(stateDocument); content != nil {
+			t.Errorf("%s: expected the state to be removed, got %q", backendType, content)
+		}
+
+		for _, name := range []string{"first", "second", "third"} {
+			if err := store.appendHistoryRecord(JailRecord{Name: name, EndReason: "unjailed"}); err != nil {
+				t.Fatalf("%s: %v", backendType, err)
+			}
+		}
+		records, skipped, err := store.loadHistory()
+		if err != nil || skipped != 0 || len(records) != 3 {
+			t.Fatalf("%s: loaded %+v, %d skipped (%v)", backendType, records, skipped, err)
+		}
+		if records[0].Name != "first" || records[2].Name != "third" {
+			t.Errorf("%s: records out of order: %+v", backendType, records)
+		}
+		if err := store.appendAuditEvent(AuditEvent{Action: "jail"}); err != nil {
+			t.Errorf("%s: %v", backendType, err)
+		}
+	}
+}
+
+// TestStateDump tests that the dump holds the jails, their timers and the scheduled jails
+func TestStateDump(t *testing.T) {
+	now := time.Now()
+	state := NewJailerState()
+	state.ActiveJails[1234] = &Jail{PID: 1234, Name: "miner", JailTypes: []string{"cpu"}, Children: []int{1235},
+		CpuPercent: 10, ExpiresAt: now.Add(time.Hour), Squeeze: &cpuSqueeze{StartPercent: 50, Since: now, Over: 5 * time.Minute, Applied: 50}}
+	state.ActiveJails[99] = &Jail{PID: 99, Name: "worker", JailTypes: []string{"network"}}
+	state.Schedules = []*jailSchedule{{PID: 99, JailType: "cpu", Window: timeWindow{Start: 0, End: 24*60 - 1}}}
+	state.Operations = []operation{{Description: "jail cpu 1234 10%"}}
+
+	dump := buildStateDump(state, now)
+	if len(dump.Jails) != 2 || dump.Jails[0].PID != 99 || dump.Jails[1].Children[0] != 1235 {
+		t.Errorf("Unexpected jails %+v", dump.Jails)
+	}
+	if len(dump.Timers) != 2 || dump.Timers[0].Kind != "expiry" || dump.Timers[0].In != "1h0m0s" ||
+		dump.Timers[1].Kind != "squeeze" || dump.Timers[1].Detail != "from 50% to 10%, 50% applied" {
+		t.Errorf("Unexpected timers %+v", dump.Timers)
+	}
+	if len(dump.Schedules) != 1 || dump.Schedules[0].Window != "00:00-23:59" {
+		t.Errorf("Unexpected schedules %+v", dump.Schedules)
+	}
+	if len(dump.Operations) != 1 || dump.PID != os.Getpid() {
+		t.Errorf("Unexpected dump %+v", dump)
+	}
+
+	state.Config.DumpFile = filepath.Join(t.TempDir(), "dump.json")
+	if err := dumpState(state); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(state.Config.DumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written stateDump
+	if err := json.Unmarshal(content, &written); err != nil || len(written.Jails) != 2 || written.StateLocked {
+		t.Errorf("Unexpected dump file %s (%v)", content, err)
+	}
+}
+
+// TestRuntimeDiagnostics tests that pprof only listens on the loopback and that the stacks of every goroutine are dumped
+func TestRuntimeDiagnostics(t *testing.T) {
+	for addr, valid := range map[string]bool{
+		"127.0.0.1:6060": true,
+		"[::1]:6060":     true,
+		"localhost:6060": true,
+		":6060":          false,
+		"0.0.0.0:6060":   false,
+		"10.0.0.5:6060":  false,
+		"127.0.0.1":      false,
+	} {
+		if err := validateDebugAddress(addr); (err == nil) != valid {
+			t.Errorf("validateDebugAddress(%q) = %v", addr, err)
+		}
+	}
+
+	var output bytes.Buffer
+	if err := writeGoroutineStacks(&output); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "TestRuntimeDiagnostics") || !strings.HasSuffix(output.String(), "=== end of goroutine stacks ===\n") {
+		t.Errorf("Unexpected stacks:\n%s", output.String())
+	}
+}
+
+// TestSummarizeProcessErrors tests that the same failure on many processes is reported once
+func TestSummarizeProcessErrors(t *testing.T) {
+	errs := make(map[int]error)
+	for pid := 1000; pid < 1050; pid++ {
+		errs[pid] = fmt.Errorf("failed to move PID %d to jail cgroup: permission denied", pid)
+	}
+	if summary := summarizeProcessErrors(errs); summary != "failed to move the process to jail cgroup: permission denied" {
+		t.Errorf("Unexpected summary: %s", summary)
+	}
+
+	errs[2000] = fmt.Errorf("process 2000 does not exist")
+	errs[2001] = fmt.Errorf("process 2001 does not exist")
+	errs[3000] = fmt.Errorf("no such file")
+	errs[4000] = fmt.Errorf("read-only file system")
+	summary := summarizeProcessErrors(errs)
+	expected := "50: failed to move the process to jail cgroup: permission denied; 2: the process does not exist; 1: no such file; 1 with other errors"
+	if summary != expected {
+		t.Errorf("Unexpected summary:\n%s\nexpected:\n%s", summary, expected)
+	}
+
+	jail := newJail(1234, "/")
+	jail.JailTypes = []string{"cpu", "rlimit"}
+	output, _ := captureOutput(func() error {
+		reportDescendantErrors(os.Stdout, jail, "cpu", 300, map[int]error{5: errors.New("permission denied"), 6: errors.New("permission denied")}, false)
+		return nil
+	})
+	if !strings.Contains(output, "failed to apply cpu jail to 2 of 300 descendants: permission denied\n") || strings.Contains(output, "  5 ") {
+		t.Errorf("Unexpected warning:\n%s", output)
+	}
+	if len(jail.FailedDescendants) != 2 || jail.FailedDescendants[5] != "cpu: permission denied" {
+		t.Errorf("Unexpected failed descendants %v", jail.FailedDescendants)
+	}
+	jail.RemoveJailType("cpu")
+	if len(jail.FailedDescendants) != 0 {
+		t.Errorf("Expected the failures of a removed type to be dropped, got %v", jail.FailedDescendants)
+	}
+}
+
+// TestMoveProcesses tests that Ctrl+C stops the moves of a large tree and leaves the remaining processes untouched
+func TestMoveProcesses(t *testing.T) {
+	interrupted, done := startInterruptible()
+	defer done()
+	if nested, nestedDone := startInterruptible(); nested != interrupted {
+		t.Error("Expected a nested command to share the channel of the running one")
+	} else {
+		nestedDone()
+	}
+	if currentInterrupt() != interrupted {
+		t.Fatal("Expected the running command to stay interruptible after a nested one ended")
+	}
+
+	// Small trees aren't interruptible
+	errs, untouched := moveProcesses("Jailed", []int{1, 2, 3}, func(pid int) error {
+		if pid == 2 {
+			return errors.New("permission denied")
+		}
+		return nil
+	})
+	if len(errs) != 1 || untouched != 0 {
+		t.Errorf("Unexpected outcome of a small tree: %v, %d untouched", errs, untouched)
+	}
+
+	pids := make([]int, 2*largeTreeProcesses)
+	for i := range pids {
+		pids[i] = 1000 + i
+	}
+	var moved atomic.Int64
+	output, _ := captureOutput(func() error {
+		errs, untouched = moveProcesses("Jailed", pids, func(pid int) error {
+			if moved.Add(1) == 20 {
+				interruptCommand()
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+		return nil
+	})
+	if untouched == 0 || int(moved.Load())+untouched != len(pids) || len(errs) != untouched {
+		t.Errorf("Expected every process to be moved or untouched, %d moved and %d untouched", moved.Load(), untouched)
+	}
+	for _, err := range errs {
+		if err != errMoveInterrupted {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+	if !strings.Contains(output, fmt.Sprintf("the other %d were left untouched", untouched)) {
+		t.Errorf("Unexpected report:\n%s", output)
+	}
+	if !interruptedBefore(interrupted) || interruptedBefore(nil) {
+		t.Error("Expected the command to be interrupted")
+	}
+}
+
+// TestPreviewDescendants tests that the descendants are listed by name and that large trees need a confirmation
+func TestPreviewDescendants(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 30 & sleep 30 & wait")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sh: %v", err)
+	}
+	defer func() {
+		if descendants, err := hostProcesses.descendants(cmd.Process.Pid); err == nil {
+			for _, pid := range descendants {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if descendants, _ := hostProcesses.descendants(pid); len(descendants) == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	state := NewJailerState()
+	groups, total := collectDescendants(state, []int{pid})
+	if total != 2 || len(groups) != 1 || groups[0].Name != "sleep" || len(groups[0].PIDs) != 2 {
+		t.Fatalf("Unexpected descendants %+v (%d)", groups, total)
+	}
+	if _, total := collectDescendants(state, append([]int{pid}, groups[0].PIDs...)); total != 0 {
+		t.Errorf("Expected the targets to be left out of the descendants, got %d", total)
+	}
+
+	state.Config.ConfirmDescendants = 2
+	output, err := captureOutput(func() error {
+		proceed, err := previewDescendants(state, []int{pid}, groups, total, true)
+		if !proceed {
+			t.Error("Expected --yes to skip the confirmation")
+		}
+		return err
+	})
+	if err != nil || !strings.Contains(output, fmt.Sprintf("Process %d (sh) has 2 descendants:", pid)) || !strings.Contains(output, "sleep") {
+		t.Errorf("Unexpected preview (%v):\n%s", err, output)
+	}
+	// The tests have no terminal to confirm on
+	if proceed, err := previewDescendants(state, []int{pid}, groups, total, false); proceed || err == nil {
+		t.Error("Expected a confirmation to be needed from confirm_descendants descendants on")
+	}
+	state.Config.ConfirmDescendants = 3
+	if proceed, err := previewDescendants(state, []int{pid}, groups, total, false); !proceed || err != nil {
+		t.Errorf("Expected no confirmation under confirm_descendants, got %v", err)
+	}
+
+	if state.Config.MaxJailProcesses != defaultMaxJailProcesses || checkJailSize(state, 1, 499, false) != nil {
+		t.Error("Expected 500 processes to be jailed without --force")
+	}
+	if err := checkJailSize(state, 1, 500, false); err == nil || !strings.Contains(err.Error(), "more than max_jail_processes") {
+		t.Errorf("Expected more than max_jail_processes to be refused, got %v", err)
+	}
+	if checkJailSize(state, 1, 500, true) != nil {
+		t.Error("Expected --force to override max_jail_processes")
+	}
+	state.Config.MaxJailProcesses = -1
+	if checkJailSize(state, 1, 100000, false) != nil {
+		t.Error("Expected -1 to disable max_jail_processes")
+	}
+	state.Config.MaxJailProcesses = 2
+	if err := executeCommand(state, fmt.Sprintf("jail cpu %d", pid)); err == nil || !strings.Contains(err.Error(), "more than max_jail_processes (2)") {
+		t.Errorf("Expected the jail command to be refused, got %v", err)
+	}
+
+	// The jails of the rules are refused as well and the refusal is audited
+	state.Config.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	jailed, err := jailAutomatically(state, "schedule nightly", "cpu", []int{pid}, nil, "nightly build")
+	if err == nil || len(jailed) != 0 || len(state.ActiveJails) != 0 {
+		t.Errorf("Expected the automatic jail to be refused, got %v, %v", jailed, err)
+	}
+	if content, err := os.ReadFile(state.Config.AuditLog); err != nil || !strings.Contains(string(content), "more than max_jail_processes (2)") {
+		t.Errorf("Expected the refusal in the audit log, got %q (%v)", content, err)
+	}
+}
+
+// TestStateLocking tests that the commands hold the state against the monitors and release
+// it while they wait
+func TestStateLocking(t *testing.T) {
+	state := NewJailerState()
+	if err := executeLocked(state, "warnings"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !stateMutex.TryLock() {
+		t.Fatalf("Expected the state to be unlocked after the command")
+	}
+	stateMutex.Unlock()
+
+	// A command of a controller prints to its own output and runs as its operator
+	var output bytes.Buffer
+	if err := executeLockedAs(state, "warnings", "ops via controller", &output); err != nil || output.Len() == 0 {
+		t.Errorf("Expected the output of the command, got %q (%v)", output.String(), err)
+	}
+	if state.Output != nil || state.Operator != "" {
+		t.Errorf("Expected the output and the operator to be restored, got %v, %q", state.Output, state.Operator)
+	}
+
+	// A command waiting on the terminal or a timer lets the monitors lock the state, they
+	// don't print to its output meanwhile
+	stateMutex.Lock()
+	commandLocked.Store(true)
+	state.Output = &output
+	waitUnlocked(state, func() {
+		if !stateMutex.TryLock() {
+			t.Errorf("Expected the state to be unlocked while the command waits")
+			return
+		}
+		if state.Output != nil {
+			t.Errorf("Expected the output of the command to be put aside while it waits")
+		}
+		stateMutex.Unlock()
+	})
+	if state.Output != &output {
+		t.Errorf("Expected the output of the command back after waiting")
+	}
+	state.Output = nil
+	if stateMutex.TryLock() {
+		t.Errorf("Expected the command to hold the state again after waiting")
+		stateMutex.Unlock()
+	}
+	commandLocked.Store(false)
+	stateMutex.Unlock()
+
+	// An automated jail keeps the state locked
+	stateMutex.Lock()
+	waitUnlocked(state, func() {
+		if stateMutex.TryLock() {
+			t.Errorf("Expected the state to stay locked outside of a command")
+			stateMutex.Unlock()
+		}
+	})
+	stateMutex.Unlock()
+}
+
+// TestCheckpointOptions tests that the flags of a jail survive its checkpoint and are
+// applied again on restore
+func TestCheckpointOptions(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	source := newJail(pid, "/system.slice/app.service")
+	source.JailTypes = []string{"rlimit"}
+	source.Rlimits = map[string]uint64{"nofile": 64}
+	source.CpuWeight = 20
+	source.CpuBurst = 5 * time.Millisecond
+	source.OomGroup = true
+	source.Persistent = true
+	source.Reason = "incident 43"
+	source.AllowedIfaces = []string{"lo"}
+	source.BlockedCountries = []string{"XX"}
+	source.Adaptive = &adaptiveCpu{TargetPercent: 70}
+	source.ExpiresAt = time.Now().Add(time.Hour).Round(time.Second)
+
+	content, err := json.Marshal(newCheckpointMetadata(source, "sleep"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata checkpointMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata.Options, source.jailOptions()) || metadata.CpuWeight != 20 || !metadata.ExpiresAt.Equal(source.ExpiresAt) {
+		t.Fatalf("Options lost in the metadata: %+v", metadata)
+	}
+	if args := jailTypeArgs(&Jail{CpuWeight: metadata.CpuWeight}, "cpu"); len(args) != 1 || args[0] != "weight=20" {
+		t.Errorf("Expected the CPU weight to be applied again, got %v", args)
+	}
+
+	state := NewJailerState()
+	state.StatePath = ""
+	jail, failed, err := rejailCheckpoint(state, pid, nil, metadata)
+	if err != nil || len(failed) > 0 {
+		t.Skipf("Cannot apply rlimit jails: %v %v", failed, err)
+	}
+	if !jail.Persistent || !jail.ExpiresAt.Equal(source.ExpiresAt) || jail.Reason != "incident 43" {
+		t.Errorf("Unexpected restored jail: persistent %v, expires %v, reason %q", jail.Persistent, jail.ExpiresAt, jail.Reason)
+	}
+}
+
+// TestRejailCheckpoint tests that a restored tree keeps the settings from before its jail
+// and is resumed once jailed
+func TestRejailCheckpoint(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	state := NewJailerState()
+	state.StatePath = ""
+	original := unix.Rlimit{Cur: 1024, Max: 4096}
+	metadata := checkpointMetadata{
+		PID:             pid,
+		JailTypes:       []string{"rlimit"},
+		Rlimits:         map[string]uint64{"nofile": 64},
+		Reason:          "incident 42",
+		OriginalCgroup:  "/system.slice/app.service",
+		OriginalCgroups: map[int]string{pid: "/system.slice/app.service"},
+		SavedRlimits:    map[int]map[string]unix.Rlimit{pid: {"nofile": original}},
+		SavedOomScores:  map[int]int{pid: -100},
+	}
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded checkpointMetadata
+	if err := json.Unmarshal(content, &decoded); err != nil || !reflect.DeepEqual(decoded.SavedRlimits, metadata.SavedRlimits) {
+		t.Fatalf("Saved settings lost in the metadata: %+v, %v", decoded, err)
+	}
+
+	jail, failed, err := rejailCheckpoint(state, pid, nil, decoded)
+	if err != nil {
+		t.Skipf("Cannot apply rlimit jails: %v", err)
+	}
+	if len(failed) > 0 {
+		t.Fatalf("Unexpected failed jail types: %v", failed)
+	}
+	if jail.OriginalCgroup != "/system.slice/app.service" || jail.originalCgroupOf(pid) != "/system.slice/app.service" {
+		t.Errorf("Expected the original cgroup of the checkpoint, got %q", jail.OriginalCgroup)
+	}
+	if saved := jail.SavedRlimits[pid]["nofile"]; saved != original {
+		t.Errorf("Expected the original limit of the checkpoint, got %+v", saved)
+	}
+	if jail.SavedOomScores[pid] != -100 || jail.Reason != "incident 42" {
+		t.Errorf("Unexpected restored jail: %+v", jail)
+	}
+
+	// The tree restored stopped runs again once resumed
+	if err := syscall.Kill(pid, syscall.SIGSTOP); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumeTree([]int{pid}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+		if fields[0] != "T" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Process %d still stopped after resumeTree", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hint := stoppedTreeHint([]int{pid, 7}); hint != fmt.Sprintf("resume it once jailed with: kill -CONT %d 7", pid) {
+		t.Errorf("Unexpected hint: %q", hint)
+	}
+}
+
+// recordingLimits is a limit backend recording the calls of the jails
+type recordingLimits struct {
+	calls []string
+}
+
+func (l *recordingLimits) record(format string, args ...any) error {
+	l.calls = append(l.calls, fmt.Sprintf(format, args...))
+	return nil
+}
+
+func (l *recordingLimits) setup() error {
+	return nil
+}
+
+func (l *recordingLimits) processGroup(pid int) (string, error) {
+	return "/original", nil
+}
+
+func (l *recordingLimits) placeJail(jail *Jail, jailType string) error {
+	return l.record("place %d %s", jail.PID, jailType)
+}
+
+func (l *recordingLimits) setupJail(jail *Jail) error {
+	return l.record("setup %d", jail.PID)
+}
+
+func (l *recordingLimits) updateCpuLimit(jail *Jail) error {
+	return l.record("cpu limit %d %d%%", jail.PID, jail.CpuPercent)
+}
+
+func (l *recordingLimits) liftLimits(jail *Jail, jailType string) error {
+	return l.record("lift %d %s", jail.PID, jailType)
+}
+
+func (l *recordingLimits) limit(jail *Jail, pid int) error {
+	return l.record("limit %d %s", pid, jail.GetJailTypesString())
+}
+
+func (l *recordingLimits) restore(pid int, group string) error {
+	return l.record("restore %d %s", pid, group)
+}
+
+func (l *recordingLimits) releaseJail(jail *Jail) {
+	l.record("release %d", jail.PID)
+}
+
+func (l *recordingLimits) reclaimMemory(jail *Jail, amount uint64) (uint64, uint64, error) {
+	return amount, 0, l.record("reclaim %d %d", jail.PID, amount)
+}
+
+func (l *recordingLimits) jailGroup(jail *Jail, jailType string) string {
+	return fmt.Sprintf("group-%d", jail.PID)
+}
+
+func (l *recordingLimits) cleanup() error {
+	return nil
+}
+
+// recordingResources is a resource backend recording the calls of the jails
+type recordingResources struct {
+	recordingLimits
+}
+
+func (r *recordingResources) limit(pid int, limits map[string]uint64) (map[string]unix.Rlimit, error) {
+	r.record("rlimit %d %s", pid, formatRlimits(limits))
+	return map[string]unix.Rlimit{"nofile": {Cur: 1024, Max: 4096}}, nil
+}
+
+func (r *recordingResources) restoreLimits(pid int, saved map[string]unix.Rlimit) error {
+	return r.record("restore rlimit %d %d", pid, saved["nofile"].Cur)
+}
+
+func (r *recordingResources) preferOomKill(pid int) (int, error) {
+	return -100, r.record("oom %d", pid)
+}
+
+func (r *recordingResources) restoreOomScore(pid, score int) error {
+	return r.record("restore oom %d %d", pid, score)
+}
+
+func (r *recordingResources) suppressCoreDumps(pid int) (savedCoreDump, error) {
+	return savedCoreDump{Filter: "33"}, r.record("coredump %d", pid)
+}
+
+func (r *recordingResources) restoreCoreDumps(pid int, saved savedCoreDump) error {
+	return r.record("restore coredump %d %s", pid, saved.Filter)
+}
+
+func (r *recordingResources) describeJail(jail *Jail, jailType string) string {
+	return jailType
+}
+
+// TestLimitBackend tests that the limits of the jails and the settings of the rlimit and
+// oom jails go through the backends
+func TestLimitBackend(t *testing.T) {
+	state := NewJailerState()
+	limits := &recordingLimits{}
+	resources := &recordingResources{}
+	state.Limits, state.Resources = limits, resources
+
+	jail := newJail(1234, "/original")
+	jail.JailTypes = []string{"cpu", "rlimit", "oom"}
+	jail.CpuPercent = 20
+	jail.Rlimits = map[string]uint64{"nofile": 64}
+	state.ActiveJails[1234] = jail
+	for _, jailType := range jail.JailTypes {
+		if err := applyJailTypeToProcess(state, jail, jailType, 1234); err != nil {
+			t.Fatalf("applyJailTypeToProcess(%s) failed: %v", jailType, err)
+		}
+	}
+	if jail.originalCgroupOf(1234) != "/original" || jail.SavedOomScores[1234] != -100 || jail.SavedRlimits[1234]["nofile"].Max != 4096 {
+		t.Errorf("Unexpected saved settings %q, %v, %v", jail.OriginalCgroups, jail.SavedOomScores, jail.SavedRlimits)
+	}
+
+	// The cpu type goes with its dedicated limits, the others stay
+	if err := unjailProcessSelective(state, "cpu", "1234"); err != nil {
+		t.Fatalf("unjailProcessSelective failed: %v", err)
+	}
+	if err := releaseProcess(state, jail, 1234); err != nil {
+		t.Fatalf("releaseProcess failed: %v", err)
+	}
+
+	expectedLimits := []string{"limit 1234 cpu,rlimit,oom", "lift 1234 cpu", "limit 1234 rlimit,oom", "release 1234"}
+	if !slices.Equal(limits.calls, expectedLimits) {
+		t.Errorf("limit calls = %q, expected %q", limits.calls, expectedLimits)
+	}
+	expectedResources := []string{"rlimit 1234 nofile=64", "oom 1234", "restore rlimit 1234 1024", "restore oom 1234 -100"}
+	if !slices.Equal(resources.calls, expectedResources) {
+		t.Errorf("resource calls = %q, expected %q", resources.calls, expectedResources)
+	}
+	if description := describeJailType(state, jail, "oom"); description != "oom" {
+		t.Errorf("describeJailType(oom) = %q", description)
 	}
 }
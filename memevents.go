@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// memoryEventsCheckInterval is the time between two readings of the memory events of the jails
+const memoryEventsCheckInterval = 10 * time.Second
+
+// memoryEvents are the events of a memory cgroup, from memory.events
+type memoryEvents struct {
+	Max     uint64 // Times the usage reached the limit
+	OOM     uint64 // Times the limit was reached with reclaim failing, 0 on cgroups v1
+	OOMKill uint64 // Processes of the cgroup killed by the OOM killer
+}
+
+// String returns the events, e.g. 3 oom_kill (12 oom, 480 max)
+func (e memoryEvents) String() string {
+	return fmt.Sprintf("%d oom_kill (%d oom, %d max)", e.OOMKill, e.OOM, e.Max)
+}
+
+// readMemoryEvents reads the events of a memory cgroup, on cgroups v1 the limit hits are
+// memory.failcnt and the kills are in memory.oom_control
+func readMemoryEvents(state *JailerState, cgroupDir string) (memoryEvents, error) {
+	var events memoryEvents
+	if state.CgroupVersion == 2 {
+		stats, err := readCgroupStats(filepath.Join(cgroupDir, "memory.events"))
+		if err != nil {
+			return events, err
+		}
+		events.Max, events.OOM, events.OOMKill = stats["max"], stats["oom"], stats["oom_kill"]
+		return events, nil
+	}
+
+	failcnt, err := readCgroupValue(filepath.Join(cgroupDir, "memory.failcnt"))
+	if err != nil {
+		return events, err
+	}
+	events.Max = failcnt
+	if kills, err := readCgroupStat(filepath.Join(cgroupDir, "memory.oom_control"), "oom_kill"); err == nil {
+		events.OOMKill = kills
+	}
+	return events, nil
+}
+
+// getCgroupMemoryEvents returns the events of the memory cgroup of a process
+func getCgroupMemoryEvents(state *JailerState, pid int) (memoryEvents, error) {
+	cgroupDir, err := getProcessControllerCgroup(state, pid, "memory")
+	if err != nil {
+		return memoryEvents{}, err
+	}
+	return readMemoryEvents(state, cgroupDir)
+}
+
+// memoryEventsMonitor notifies the OOM kills in the cgroups of the jails, the readings are
+// kept by cgroup so that the jails sharing one are notified once
+type memoryEventsMonitor struct {
+	state    *JailerState
+	cgroupOf func(pid int) (string, error)
+	read     func(cgroupDir string) (memoryEvents, error)
+	previous map[string]memoryEvents
+}
+
+// newMemoryEventsMonitor returns a monitor reading the memory cgroups of the jails
+func newMemoryEventsMonitor(state *JailerState) *memoryEventsMonitor {
+	return &memoryEventsMonitor{
+		state:    state,
+		cgroupOf: func(pid int) (string, error) { return getProcessControllerCgroup(state, pid, "memory") },
+		read:     func(cgroupDir string) (memoryEvents, error) { return readMemoryEvents(state, cgroupDir) },
+		previous: make(map[string]memoryEvents),
+	}
+}
+
+// check reads the memory events of the jail cgroups and notifies the new OOM kills, the
+// first reading of a cgroup is only the reference
+func (m *memoryEventsMonitor) check() {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	// The jails sharing a cgroup are notified with the lowest PID
+	pids := make([]int, 0, len(m.state.ActiveJails))
+	for pid := range m.state.ActiveJails {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+
+	seen := make(map[string]bool)
+	for _, pid := range pids {
+		jail := m.state.ActiveJails[pid]
+		if !jail.HasCgroupJailTypes() {
+			continue
+		}
+		cgroupDir, err := m.cgroupOf(pid)
+		if err != nil || seen[cgroupDir] {
+			continue
+		}
+		seen[cgroupDir] = true
+		current, err := m.read(cgroupDir)
+		if err != nil {
+			continue
+		}
+		previous, known := m.previous[cgroupDir]
+		m.previous[cgroupDir] = current
+		if !known || current.OOMKill <= previous.OOMKill {
+			continue
+		}
+
+		sendNotification(m.state, newNotification("oom_kill", jail, fmt.Sprintf(
+			"OOM killer killed %d processes in the memory cgroup of the %s jail of process %d (%s), %s",
+			current.OOMKill-previous.OOMKill, jail.GetJailTypesString(), pid, jail.Name, current)))
+	}
+	for cgroupDir := range m.previous {
+		if !seen[cgroupDir] {
+			delete(m.previous, cgroupDir)
+		}
+	}
+}
+
+// runMemoryEventsMonitor checks the memory events of the jails until jailer exits
+func runMemoryEventsMonitor(state *JailerState) {
+	monitor := newMemoryEventsMonitor(state)
+	for range time.Tick(memoryEventsCheckInterval) {
+		monitor.check()
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// readNSpid returns the PIDs of a process in each of its PID namespaces, from the host to
+// the innermost one, as the NSpid line of /proc/<pid>/status
+func readNSpid(pid int) ([]int, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		values, found := strings.CutPrefix(line, "NSpid:")
+		if !found {
+			continue
+		}
+		var pids []int
+		for _, field := range strings.Fields(values) {
+			nsPid, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid NSpid of process %d: %q", pid, line)
+			}
+			pids = append(pids, nsPid)
+		}
+		return pids, nil
+	}
+	return nil, fmt.Errorf("no NSpid in the status of process %d, the kernel is too old", pid)
+}
+
+// containerInitProcess returns a host process of a container, found by ID through the
+// cgroups, or by name through the Podman API or with docker or podman
+func containerInitProcess(container string) (int, error) {
+	if pids := containerProcesses(container); len(pids) > 0 {
+		return pids[0], nil
+	}
+	if inspected, found := findPodmanContainer(container); found && inspected.State.Running && inspected.State.Pid > 0 {
+		return inspected.State.Pid, nil
+	}
+	for _, runtime := range []string{"docker", "podman"} {
+		if !commandExists(runtime) {
+			continue
+		}
+		output, err := exec.Command(runtime, "inspect", "--format", "{{.State.Pid}}", container).Output()
+		if err != nil {
+			continue
+		}
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(output))); err == nil && pid > 0 {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("container %q not found or not running", container)
+}
+
+// namespaceProcess returns a host process in the PID namespace given to --in, either
+// container:<id or name>, lxd:<instance name> or pid:<host pid>
+func namespaceProcess(ref string) (int, error) {
+	kind, value, found := strings.Cut(ref, ":")
+	if !found || value == "" {
+		return 0, fmt.Errorf("invalid namespace %q, expected container:<id or name>, lxd:<name> or pid:<host pid>", ref)
+	}
+	switch kind {
+	case "container":
+		return containerInitProcess(value)
+	case "lxd":
+		return lxdInitProcess(value)
+	case "pid":
+		pid, err := parsePidArg(value)
+		if err != nil {
+			return 0, err
+		}
+		if !hostProcesses.exists(pid) {
+			return 0, fmt.Errorf("process %d does not exist", pid)
+		}
+		return pid, nil
+	}
+	return 0, fmt.Errorf("invalid namespace %q, expected container:<id or name>, lxd:<name> or pid:<host pid>", ref)
+}
+
+// translateNamespacePids maps PIDs seen in the PID namespace given to --in, e.g. by the
+// ps of a container, to the PIDs of the host
+func translateNamespacePids(ref string, pids []int) ([]int, error) {
+	member, err := namespaceProcess(ref)
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", member))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PID namespace of process %d: %v", member, err)
+	}
+
+	// The processes of the namespace have their PID in it last in NSpid
+	hostPids := make(map[int]int)
+	for _, pid := range listProcessPids() {
+		if link, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid)); err != nil || link != namespace {
+			continue
+		}
+		if nsPids, err := readNSpid(pid); err == nil && len(nsPids) > 0 {
+			hostPids[nsPids[len(nsPids)-1]] = pid
+		}
+	}
+
+	translated := make([]int, 0, len(pids))
+	for _, pid := range pids {
+		hostPid, found := hostPids[pid]
+		if !found {
+			return nil, fmt.Errorf("no process %d in the PID namespace of %s", pid, ref)
+		}
+		fmt.Printf("PID %d in %s is host PID %d\n", pid, ref, hostPid)
+		translated = append(translated, hostPid)
+	}
+	return translated, nil
+}
+
+// commandExists checks if a command exists in PATH
+func commandExists(cmd string) bool {
+	_, err := exec.LookPath(cmd)
+	return err == nil
+}
@@ -0,0 +1,114 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// processNetNamespace returns the network namespace of a process, e.g. net:[4026532290]
+func processNetNamespace(pid int) (string, error) {
+	namespace, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return "", fmt.Errorf("failed to read network namespace of process %d: %v", pid, err)
+	}
+	return namespace, nil
+}
+
+// sharesJailerNetNamespace checks if a process is in the network namespace of jailer, so
+// that the rules jailer installs see its traffic
+func sharesJailerNetNamespace(pid int) (bool, error) {
+	namespace, err := processNetNamespace(pid)
+	if err != nil {
+		return false, err
+	}
+	own, err := processNetNamespace(os.Getpid())
+	if err != nil {
+		return false, err
+	}
+	return namespace == own, nil
+}
+
+// inNetNamespace runs fn with the calling thread in a network namespace, the commands it
+// starts inherit the namespace
+func inNetNamespace(namespace *os.File, fn func() error) error {
+	runtime.LockOSThread()
+	original, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open current network namespace: %v", err)
+	}
+	defer original.Close()
+	if err := unix.Setns(int(namespace.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace: %v", err)
+	}
+
+	fnErr := fn()
+	if err := unix.Setns(int(original.Fd()), unix.CLONE_NEWNET); err != nil {
+		// The thread stays locked so that Go discards it with the goroutine
+		return fmt.Errorf("failed to return to the original network namespace: %v", err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+// enterNetNamespace installs the network jail rules in the network namespace of a jailed
+// process when it isn't the one of jailer, once per namespace
+func enterNetNamespace(state *JailerState, jail *Jail) error {
+	namespace, err := processNetNamespace(jail.PID)
+	if err != nil {
+		return err
+	}
+	if own, err := processNetNamespace(os.Getpid()); err != nil || namespace == own {
+		return err
+	}
+	if existing, found := state.NetNamespaces[namespace]; found {
+		existing.refs++
+		jail.NetNamespace = namespace
+		return nil
+	}
+
+	file, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", jail.PID))
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace of process %d: %v", jail.PID, err)
+	}
+	if state.NetNamespaces == nil {
+		state.NetNamespaces = make(map[string]*jailNetNamespace)
+	}
+	fmt.Fprintf(state.stdout(), "Process %d has its own network namespace %s, installing the network jail rules in it\n", jail.PID, namespace)
+	if err := inNetNamespace(file, func() error { return state.Firewall.setup() }); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to set up network jail in %s: %v", namespace, err)
+	}
+	state.NetNamespaces[namespace] = &jailNetNamespace{file: file, refs: 1}
+	jail.NetNamespace = namespace
+	return nil
+}
+
+// releaseNetNamespace removes the network jail rules of the namespace of a jail once no
+// other jail relies on them
+func releaseNetNamespace(state *JailerState, jail *Jail) {
+	if jail.NetNamespace == "" {
+		return
+	}
+	namespace := jail.NetNamespace
+	jail.NetNamespace = ""
+	held, found := state.NetNamespaces[namespace]
+	if !found {
+		// Recovered from the state file, the namespace isn't open anymore
+		return
+	}
+	if held.refs--; held.refs > 0 {
+		return
+	}
+	delete(state.NetNamespaces, namespace)
+	defer held.file.Close()
+	if err := inNetNamespace(held.file, func() error { return state.Firewall.cleanup() }); err != nil {
+		fmt.Fprintf(state.stdout(), "Warning: failed to remove network jail rules from %s: %v\n", namespace, err)
+	}
+}
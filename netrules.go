@@ -0,0 +1,190 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// classIDMajor is the major number of the classids of the network jails on cgroups v1,
+// the shared network and proxy jails use 0x0010
+const classIDMajor = 0x0011
+
+// classCgroupPath returns the net_cls cgroup of a network jail with a classid of its own
+func classCgroupPath(jailPid int) string {
+	return filepath.Join("/sys/fs/cgroup/net_cls", fmt.Sprintf("jail-%d", jailPid))
+}
+
+// allocateClassID returns the lowest classid no active jail uses
+func allocateClassID(state *JailerState) (string, error) {
+	used := make(map[string]bool)
+	for _, jail := range state.ActiveJails {
+		if jail.ClassID != "" {
+			used[jail.ClassID] = true
+		}
+	}
+	for minor := 1; minor <= 0xffff; minor++ {
+		classID := fmt.Sprintf("0x%04x%04x", classIDMajor, minor)
+		if !used[classID] {
+			return classID, nil
+		}
+	}
+	return "", fmt.Errorf("no net_cls classid left for a network jail")
+}
+
+// dropRuleSpec returns the rule dropping the traffic matched by match
+func dropRuleSpec(state *JailerState, match []string) []string {
+	if state.FirewallTool == "nftables" {
+		return append(append([]string{}, match...), "counter", "drop")
+	}
+	return append(append([]string{}, match...), "-j", "DROP")
+}
+
+// ifaceRuleSpec returns the rule accepting the traffic matched by match that leaves through
+// an interface on the output chain, or comes in through it on the input chain. A trailing
+// * matches the interfaces starting with the name
+func ifaceRuleSpec(state *JailerState, match []string, chain, iface string) []string {
+	if state.FirewallTool == "nftables" {
+		keyword := "oifname"
+		if chain == "input" {
+			keyword = "iifname"
+		}
+		return append(append([]string{}, match...), keyword, fmt.Sprintf("%q", iface), "accept")
+	}
+	flag := "-o"
+	if chain == "input" {
+		flag = "-i"
+	}
+	return append(append([]string{}, match...), flag, strings.Replace(iface, "*", "+", 1), "-j", "ACCEPT")
+}
+
+// setupJailNetworkRules gives the network jail of a jail drop rules of its own, so that
+// the firewall can tell the jails apart: on cgroups v2 they match the dedicated cgroup of
+// the jail, on v1 a net_cls cgroup with a classid of its own. Containers with a network
+// namespace of their own keep the shared rules installed in the namespace. The traffic on
+// the allowed interfaces and the country rules go ahead of the drop rules
+func setupJailNetworkRules(state *JailerState, jail *Jail, options JailOptions) error {
+	if jail.ClassID != "" || jail.NetworkCgroup != "" {
+		return nil
+	}
+	if shared, err := sharesJailerNetNamespace(jail.PID); err != nil || !shared {
+		if err == nil && len(options.AllowIfaces) > 0 {
+			return fmt.Errorf("--allow-iface doesn't apply to process %d, it has a network namespace of its own", jail.PID)
+		}
+		if err == nil && len(options.BlockCountries)+len(options.AllowCountries) > 0 {
+			return fmt.Errorf("--block-country and --allow-country don't apply to process %d, it has a network namespace of its own", jail.PID)
+		}
+		return err
+	}
+
+	if state.CgroupVersion == 2 {
+		// nft resolves the cgroup when the rule is added, it has to exist first
+		cgroupPath := jailCgroupPath(state, jail)
+		if err := os.MkdirAll(cgroupPath, 0755); err != nil {
+			return fmt.Errorf("failed to create jail cgroup directory: %v", err)
+		}
+		jail.NetworkCgroup = strings.TrimPrefix(cgroupPath, "/sys/fs/cgroup/")
+	} else {
+		classID, err := allocateClassID(state)
+		if err != nil {
+			return err
+		}
+		cgroupPath := classCgroupPath(jail.PID)
+		if err := os.MkdirAll(cgroupPath, 0755); err != nil {
+			return fmt.Errorf("failed to create net_cls cgroup of process %d: %v", jail.PID, err)
+		}
+		if err := writeFile(filepath.Join(cgroupPath, "net_cls.classid"), classID+"\n"); err != nil {
+			cleanupEmptyCgroup(cgroupPath, "net_cls jail")
+			return fmt.Errorf("failed to set net_cls classid of process %d: %v", jail.PID, err)
+		}
+		jail.ClassID = classID
+	}
+
+	// Appended so that the allowlist and session rules inserted ahead still apply
+	for _, chain := range []string{"output", "input"} {
+		rule, err := appendFirewallRule(state, chain, dropRuleSpec(state, jailNetworkMatch(state, jail)))
+		if err != nil {
+			releaseJailNetworkRules(state, jail)
+			return fmt.Errorf("failed to add the drop rules of process %d: %v", jail.PID, err)
+		}
+		jail.DropRules = append(jail.DropRules, rule)
+	}
+	for _, iface := range options.AllowIfaces {
+		for _, chain := range []string{"output", "input"} {
+			rule, err := insertFirewallRule(state, chain, ifaceRuleSpec(state, jailNetworkMatch(state, jail), chain, iface))
+			if err != nil {
+				releaseJailNetworkRules(state, jail)
+				return fmt.Errorf("failed to allow interface %s for process %d: %v", iface, jail.PID, err)
+			}
+			jail.IfaceRules = append(jail.IfaceRules, rule)
+		}
+		jail.AllowedIfaces = append(jail.AllowedIfaces, iface)
+	}
+	if len(options.BlockCountries) > 0 || len(options.AllowCountries) > 0 {
+		err := setupCountryRules(state, jail, append(options.BlockCountries, options.AllowCountries...), len(options.BlockCountries) > 0)
+		if err != nil {
+			releaseJailNetworkRules(state, jail)
+			return fmt.Errorf("failed to set up the country rules of process %d: %v", jail.PID, err)
+		}
+	}
+	if err := addJailBlocklistRules(state, jail); err != nil {
+		releaseJailNetworkRules(state, jail)
+		return err
+	}
+	if jail.ClassID != "" {
+		fmt.Fprintf(state.stdout(), "Network jail of process %d filtered by its own classid %s\n", jail.PID, jail.ClassID)
+	} else {
+		fmt.Fprintf(state.stdout(), "Network jail of process %d filtered by its own cgroup %s\n", jail.PID, jail.NetworkCgroup)
+	}
+	return nil
+}
+
+// moveProcessToClassCgroup moves a process to the net_cls cgroup of its network jail
+func moveProcessToClassCgroup(jail *Jail, pid int) error {
+	procsFile := filepath.Join(classCgroupPath(jail.PID), "cgroup.procs")
+	if err := os.WriteFile(procsFile, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to move PID %d to net_cls cgroup of classid %s: %v", pid, jail.ClassID, err)
+	}
+	return nil
+}
+
+// releaseJailNetworkRules removes the drop rules of the network jail of a jail. On cgroups
+// v1 its net_cls cgroup goes once the processes still in it are back in their original
+// one, on v2 the dedicated cgroup stays as long as the other jail types need it
+func releaseJailNetworkRules(state *JailerState, jail *Jail) {
+	releaseCountryRules(state, jail)
+	deleteFirewallRules(state, append(append(jail.BlocklistRules, jail.IfaceRules...), jail.DropRules...))
+	jail.BlocklistRules = nil
+	jail.IfaceRules = nil
+	jail.AllowedIfaces = nil
+	jail.DropRules = nil
+	if jail.NetworkCgroup != "" {
+		jail.NetworkCgroup = ""
+		if !jail.usesDedicatedCgroup() {
+			removeJailCgroup(state, jail)
+		}
+	}
+	if jail.ClassID == "" {
+		return
+	}
+	jail.ClassID = ""
+
+	cgroupPath := classCgroupPath(jail.PID)
+	if content, err := os.ReadFile(filepath.Join(cgroupPath, "cgroup.procs")); err == nil {
+		for _, field := range strings.Fields(string(content)) {
+			pid, err := strconv.Atoi(field)
+			if err != nil {
+				continue
+			}
+			original := filepath.Join("/sys/fs/cgroup/net_cls", strings.TrimPrefix(jail.originalCgroupOf(pid), "/"), "cgroup.procs")
+			if err := writeFile(original, field+"\n"); err != nil {
+				fmt.Fprintf(state.stdout(), "Warning: failed to move PID %d out of %s: %v\n", pid, cgroupPath, err)
+			}
+		}
+	}
+	cleanupEmptyCgroup(cgroupPath, "net_cls jail")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// notificationTimeout bounds the delivery of a notification to a channel
+const notificationTimeout = 10 * time.Second
+
+// NotificationConfig lists the channels receiving the alerts of jailer, such as the jails
+// throttled for too long
+type NotificationConfig struct {
+	Webhooks []string `json:"webhooks"` // URLs receiving the alert as a JSON POST, Slack compatible
+	Command  []string `json:"command"`  // Command run with the alert as JSON on its stdin
+}
+
+// Notification is an alert sent to the notification channels
+type Notification struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Event   string    `json:"event"` // e.g. cpu_throttled
+	PID     int       `json:"pid,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Jail    string    `json:"jail,omitempty"` // Jail types of the process
+	Message string    `json:"message"`
+	Text    string    `json:"text"` // The message again, shown by Slack incoming webhooks
+}
+
+// validateNotificationConfig checks the URLs of the webhooks
+func validateNotificationConfig(config NotificationConfig) error {
+	for _, webhook := range config.Webhooks {
+		parsed, err := url.Parse(webhook)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid webhook URL %q", webhook)
+		}
+	}
+	return nil
+}
+
+// newNotification returns the notification of an event about a jail
+func newNotification(event string, jail *Jail, message string) Notification {
+	notification := Notification{Time: time.Now(), Event: event, Message: message, Text: message}
+	notification.Host, _ = os.Hostname()
+	if jail != nil {
+		notification.PID, notification.Name, notification.Jail = jail.PID, jail.Name, jail.GetJailTypesString()
+	}
+	return notification
+}
+
+// sendNotification prints an alert and delivers it to the configured channels, a channel
+// that fails only prints a warning
+func sendNotification(state *JailerState, notification Notification) {
+	fmt.Printf("Alert: %s\n", notification.Message)
+	addPromptWarning(notification.Message)
+	config := state.Config.Notifications
+	if len(config.Webhooks) == 0 && len(config.Command) == 0 {
+		return
+	}
+	content, err := json.Marshal(notification)
+	if err != nil {
+		fmt.Printf("Warning: failed to encode notification: %v\n", err)
+		return
+	}
+
+	client := &http.Client{Timeout: notificationTimeout}
+	for _, webhook := range config.Webhooks {
+		response, err := client.Post(webhook, "application/json", bytes.NewReader(content))
+		if err != nil {
+			fmt.Printf("Warning: failed to notify %s: %v\n", webhook, err)
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode >= 300 {
+			fmt.Printf("Warning: failed to notify %s: %s\n", webhook, response.Status)
+		}
+	}
+	if len(config.Command) > 0 {
+		cmd := exec.Command(config.Command[0], config.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(content)
+		done := make(chan error, 1)
+		if err := cmd.Start(); err != nil {
+			fmt.Printf("Warning: failed to run notification command: %v\n", err)
+			return
+		}
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err := <-done:
+			if err != nil {
+				fmt.Printf("Warning: notification command failed: %v\n", err)
+			}
+		case <-time.After(notificationTimeout):
+			cmd.Process.Kill()
+			fmt.Println("Warning: notification command timed out")
+		}
+	}
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// oomScoreAdjMax makes the kernel pick the process first under memory pressure
+const oomScoreAdjMax = 1000
+
+// getOomScoreAdj reads the current oom_score_adj of a process
+func getOomScoreAdj(pid int) (int, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/oom_score_adj", pid))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read oom_score_adj for PID %d: %v", pid, err)
+	}
+
+	score, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid oom_score_adj for PID %d: %v", pid, err)
+	}
+
+	return score, nil
+}
+
+// setOomScoreAdj writes the oom_score_adj of a process
+func setOomScoreAdj(pid, score int) error {
+	oomFile := fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+	if err := os.WriteFile(oomFile, []byte(strconv.Itoa(score)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to set oom_score_adj for PID %d: %v", pid, err)
+	}
+	return nil
+}
+
+// applyOomScoreAdj marks a process as the preferred OOM victim and returns its previous score
+func applyOomScoreAdj(pid int) (int, error) {
+	original, err := getOomScoreAdj(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := setOomScoreAdj(pid, oomScoreAdjMax); err != nil {
+		return 0, err
+	}
+
+	return original, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// countPersistentJails returns the number of jails kept when jailer exits with
+// -keep-jails-on-exit
+func countPersistentJails(state *JailerState) int {
+	count := 0
+	for _, jail := range state.ActiveJails {
+		if jail.Persistent {
+			count++
+		}
+	}
+	return count
+}
+
+// jailPersistence describes whether a jail outlives jailer
+func jailPersistence(state *JailerState, jail *Jail) string {
+	switch {
+	case !jail.Persistent:
+		return "ephemeral, released when jailer exits"
+	case state.KeepJailsOnExit:
+		return "persistent, kept when jailer exits"
+	}
+	return "persistent, released when jailer exits without -keep-jails-on-exit"
+}
+
+// markJail makes a jail persistent or ephemeral
+func markJail(state *JailerState, pid int, persistent bool) error {
+	jail, exists := state.ActiveJails[pid]
+	if !exists {
+		return fmt.Errorf("process %d is not jailed", pid)
+	}
+	if jail.Persistent == persistent {
+		fmt.Fprintf(state.stdout(), "Jail of process %d is already %s\n", pid, jailPersistence(state, jail))
+		return nil
+	}
+	jail.Persistent = persistent
+	fmt.Fprintf(state.stdout(), "Jail of process %d (%s) is now %s\n", pid, jail.Name, jailPersistence(state, jail))
+	if persistent && !state.KeepJailsOnExit {
+		fmt.Fprintln(state.stdout(), "Warning: jailer runs without -keep-jails-on-exit, persistent jails are still released on exit")
+	}
+
+	marked := "marked ephemeral"
+	if persistent {
+		marked = "marked persistent"
+	}
+	writeAuditEvent(state, AuditEvent{Action: "mark", JailTypes: jail.JailTypes, Reason: marked,
+		Targets: []AuditTarget{newAuditTarget(pid, jail.Name, nil)}})
+	publishInventory(state)
+	publishJailEvent("updated", jail, marked)
+	return nil
+}
+
+// defaultPersistentJailsFile keeps the persistent jails across reboots, unlike the state file
+const defaultPersistentJailsFile = "/var/lib/jailer/persistent.json"
+
+// PersistConfig keeps the persistent jails and their firewall rules across reboots
+type PersistConfig struct {
+	RulesFile string `json:"rules_file"` // nftables include file the jail ruleset is written to, empty disables it
+	JailsFile string `json:"jails_file"` // Persistent jails re-created by jailer restore, /var/lib/jailer/persistent.json by default, "off" disables it
+}
+
+// persistentJail is a persistent jail saved for jailer restore, matched to the processes
+// after a reboot by its executable and service, or its command line outside services
+type persistentJail struct {
+	Cmdline string `json:"cmdline"`
+	Jail    *Jail  `json:"jail"`
+}
+
+// savedPersistentJails is the content of the persistent jails file
+type savedPersistentJails struct {
+	SavedAt time.Time        `json:"saved_at"`
+	Jails   []persistentJail `json:"jails"`
+}
+
+// writeAtomically replaces a file with new content without leaving a partial file behind
+func writeAtomically(path string, content []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, content, mode); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+// savePersistentJails writes the persistent jails, and the ones still waiting for their
+// process, to the jails file for jailer restore, and the jail rules to the rules file
+func savePersistentJails(state *JailerState) {
+	writeJailRuleset(state)
+	path := state.PersistentJailsPath
+	if path == "" {
+		return
+	}
+
+	saved := savedPersistentJails{SavedAt: time.Now(), Jails: append([]persistentJail(nil), state.PendingPersistent...)}
+	for _, pid := range jailedPids(state) {
+		if jail := state.ActiveJails[pid]; jail.Persistent {
+			saved.Jails = append(saved.Jails, persistentJail{Cmdline: getProcessCmdline(pid), Jail: jail})
+		}
+	}
+	if len(saved.Jails) == 0 {
+		if err := state.Store.deleteDocument(persistentDocument); err != nil {
+			fmt.Printf("Warning: failed to remove %s: %v\n", path, err)
+		}
+		return
+	}
+
+	content, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		err = state.Store.putDocument(persistentDocument, content)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save persistent jails to %s: %v\n", path, err)
+	}
+}
+
+// loadPersistentJails returns the saved persistent jails that aren't active, the jails
+// recovered from the state file are still the same processes
+func loadPersistentJails(state *JailerState) ([]persistentJail, error) {
+	path := state.PersistentJailsPath
+	if path == "" {
+		return nil, nil
+	}
+	content, err := state.Store.getDocument(persistentDocument)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read persistent jails: %v", err)
+	}
+	if content == nil {
+		return nil, nil
+	}
+	var saved savedPersistentJails
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse persistent jails %s: %v", path, err)
+	}
+
+	var records []persistentJail
+	for _, record := range saved.Jails {
+		if record.Jail == nil {
+			continue
+		}
+		if active, exists := state.ActiveJails[record.Jail.PID]; exists && active.Persistent {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// matchPersistentJail returns the processes a saved jail applies to after a reboot: the
+// processes of its executable in its service, or with its command line outside services.
+// Only the roots are returned, their descendants follow them into the jail
+func matchPersistentJail(state *JailerState, record persistentJail) []int {
+	saved := record.Jail
+	if saved.Unit == "" && record.Cmdline == "" {
+		return nil
+	}
+	self := os.Getpid()
+	matched := make(map[int]bool)
+	for _, pid := range listProcessPids() {
+		if pid == self || (saved.Executable != "" && getProcessExecutable(pid) != saved.Executable) {
+			continue
+		}
+		if saved.Unit != "" {
+			if cgroup, err := state.Limits.processGroup(pid); err != nil || cgroupServiceUnit(cgroup) != saved.Unit {
+				continue
+			}
+		} else if getProcessCmdline(pid) != record.Cmdline {
+			continue
+		}
+		matched[pid] = true
+	}
+
+	var roots []int
+	for pid := range matched {
+		if parent, err := hostProcesses.parent(pid); err == nil && matched[parent] {
+			continue
+		}
+		roots = append(roots, pid)
+	}
+	sort.Ints(roots)
+	return roots
+}
+
+// restorePersistentJail applies the jail types and limits of a saved jail to a process,
+// the launch-only jail types can't be applied to a running process
+func restorePersistentJail(state *JailerState, saved *Jail, pid int) error {
+	options := saved.jailOptions()
+	options.Persistent = true
+	var applied []string
+	for _, jailType := range saved.JailTypes {
+		if isLaunchOnlyJailType(jailType) {
+			fmt.Fprintf(state.stdout(), "Warning: the %s jail of %s only applies at launch, it isn't restored\n", jailType, saved.Name)
+			continue
+		}
+		if err := jailProcess(state, jailType, strconv.Itoa(pid), jailTypeArgs(saved, jailType), options); err != nil {
+			return fmt.Errorf("failed to apply %s jail: %v", jailType, err)
+		}
+		applied = append(applied, jailType)
+	}
+	jail, jailed := state.ActiveJails[pid]
+	if !jailed {
+		return fmt.Errorf("no jail type of %s can be restored", saved.Name)
+	}
+	jail.JailedBy = saved.JailedBy
+	writeAuditEvent(state, AuditEvent{Action: "restore", JailTypes: applied, Reason: saved.Reason,
+		Targets: []AuditTarget{newAuditTarget(pid, jail.Name, nil)}})
+	return nil
+}
+
+// runBootRestore re-creates the persistent jails saved before a reboot, the cgroups and
+// rules are already set up. The jails without a process yet stay saved for the next run,
+// the restored ones are kept when jailer exits. It returns the exit code of jailer
+func runBootRestore(state *JailerState) int {
+	records, err := loadPersistentJails(state)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		cleanup(state)
+		return 1
+	}
+	state.KeepJailsOnExit = true
+	state.PendingPersistent = nil
+
+	restored := 0
+	for _, record := range records {
+		pids := matchPersistentJail(state, record)
+		failed := 0
+		for _, pid := range pids {
+			if _, jailed := state.ActiveJails[pid]; jailed {
+				fmt.Printf("Warning: process %d matching the jail of %s is already jailed\n", pid, record.Jail.Name)
+				failed++
+				continue
+			}
+			if err := restorePersistentJail(state, record.Jail, pid); err != nil {
+				fmt.Printf("Warning: failed to restore the jail of %s on process %d: %v\n", record.Jail.Name, pid, err)
+				failed++
+				continue
+			}
+			restored++
+		}
+		if failed == len(pids) {
+			fmt.Printf("Warning: no process of %s (%s) restored, its jail waits for the next restore\n",
+				record.Jail.Name, persistentJailTarget(record))
+			state.PendingPersistent = append(state.PendingPersistent, record)
+		}
+	}
+
+	fmt.Printf("Restored %d persistent jails, %d waiting for their process\n", restored, len(state.PendingPersistent))
+	cleanup(state)
+	return 0
+}
+
+// persistentJailTarget describes what the processes of a saved jail are matched with
+func persistentJailTarget(record persistentJail) string {
+	if record.Jail.Unit != "" {
+		return "service " + record.Jail.Unit
+	}
+	return "command " + strings.TrimSpace(record.Cmdline)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+// pickJailTypes are the jail types pick cycles through with Tab, the ones applying to a
+// running process without type arguments
+var pickJailTypes = []string{"network", "cpu", "both", "proxy", "oom", "coredump"}
+
+// pickKey is a key pressed in the picker
+type pickKey int
+
+const (
+	pickKeyRune pickKey = iota
+	pickKeyUp
+	pickKeyDown
+	pickKeyPageUp
+	pickKeyPageDown
+	pickKeyNextType
+	pickKeyPreviousType
+	pickKeyBackspace
+	pickKeyClear
+	pickKeyRefresh
+	pickKeyEnter
+	pickKeyCancel
+	pickKeyIgnored
+)
+
+// pickChoice is a jail type offered by the picker with its type arguments
+type pickChoice struct {
+	JailType string
+	Args     []string
+}
+
+// String returns the choice as given to jail, e.g. cpu 20%
+func (c pickChoice) String() string {
+	return strings.Join(append([]string{c.JailType}, c.Args...), " ")
+}
+
+// picker is the state of the process picker: the processes, the search and the selection
+type picker struct {
+	state     *JailerState // Unlocked while waiting on a key
+	processes []processSnapshot
+	choices   []pickChoice
+	choice    int    // Index of the jail type applied with Enter
+	search    string // Case-insensitive text matched against the PID, name, user and command line
+	selected  int    // Index of the highlighted process among the matching ones
+	offset    int    // Index of the first matching process shown
+	height    int    // Number of processes shown at once
+}
+
+// sortPickProcesses sorts the processes of the picker, busiest first
+func sortPickProcesses(processes []processSnapshot) []processSnapshot {
+	sort.SliceStable(processes, func(i, j int) bool {
+		if processes[i].CPU != processes[j].CPU {
+			return processes[i].CPU > processes[j].CPU
+		}
+		return processes[i].Memory > processes[j].Memory
+	})
+	return processes
+}
+
+// newPicker returns a picker of the processes, busiest first, offering the given jail
+// type first and then the others of pickJailTypes that are enabled
+func newPicker(state *JailerState, processes []processSnapshot, first pickChoice, height int) *picker {
+	p := &picker{state: state, processes: sortPickProcesses(processes), height: height}
+	if first.JailType != "" {
+		p.choices = append(p.choices, first)
+	}
+	for _, jailType := range pickJailTypes {
+		if normalized, _ := normalizeJailSpec(jailType); normalized == first.JailType || checkJailTypeEnabled(state, jailType) != nil {
+			continue
+		}
+		if jailType == "both" && (checkJailTypeEnabled(state, "network") != nil || checkJailTypeEnabled(state, "cpu") != nil) {
+			continue
+		}
+		p.choices = append(p.choices, pickChoice{JailType: jailType})
+	}
+	if p.height < 1 {
+		p.height = 1
+	}
+	return p
+}
+
+// matching returns the processes matching the search
+func (p *picker) matching() []processSnapshot {
+	if p.search == "" {
+		return p.processes
+	}
+	search := strings.ToLower(p.search)
+	var matches []processSnapshot
+	for _, process := range p.processes {
+		text := strings.ToLower(fmt.Sprintf("%d %s %s %s", process.PID, process.Name, process.User, process.Cmdline))
+		if strings.Contains(text, search) {
+			matches = append(matches, process)
+		}
+	}
+	return matches
+}
+
+// move moves the highlight by delta processes, keeping it visible
+func (p *picker) move(delta int) {
+	count := len(p.matching())
+	p.selected = max(0, min(p.selected+delta, count-1))
+	if p.selected < p.offset {
+		p.offset = p.selected
+	}
+	if p.selected >= p.offset+p.height {
+		p.offset = p.selected - p.height + 1
+	}
+}
+
+// handleKey updates the picker, done is set once the picker must close. The selected
+// process is nil when the picker was cancelled
+func (p *picker) handleKey(key pickKey, r rune) (selected *processSnapshot, done bool) {
+	switch key {
+	case pickKeyRune:
+		p.search += string(r)
+		p.selected, p.offset = 0, 0
+	case pickKeyBackspace:
+		if p.search != "" {
+			runes := []rune(p.search)
+			p.search = string(runes[:len(runes)-1])
+			p.selected, p.offset = 0, 0
+		}
+	case pickKeyClear:
+		p.search = ""
+		p.selected, p.offset = 0, 0
+	case pickKeyUp:
+		p.move(-1)
+	case pickKeyDown:
+		p.move(1)
+	case pickKeyPageUp:
+		p.move(-p.height)
+	case pickKeyPageDown:
+		p.move(p.height)
+	case pickKeyNextType:
+		if len(p.choices) > 0 {
+			p.choice = (p.choice + 1) % len(p.choices)
+		}
+	case pickKeyPreviousType:
+		if len(p.choices) > 0 {
+			p.choice = (p.choice + len(p.choices) - 1) % len(p.choices)
+		}
+	case pickKeyEnter:
+		matches := p.matching()
+		if len(matches) == 0 || len(p.choices) == 0 {
+			return nil, false
+		}
+		return &matches[p.selected], true
+	case pickKeyCancel:
+		return nil, true
+	}
+	return nil, false
+}
+
+// render draws the picker, lines end with \r\n since the terminal is in raw mode
+func (p *picker) render(w io.Writer, width int) {
+	choice := "none enabled"
+	if len(p.choices) > 0 {
+		choice = p.choices[p.choice].String()
+	}
+	matches := p.matching()
+	fmt.Fprint(w, "\033[H\033[2J")
+	fmt.Fprintf(w, "Jail: %s (Tab to change) - Up/Down to move, Enter to jail, Esc to quit\r\n", choice)
+	fmt.Fprintf(w, "Search: %s_  (%d of %d processes)\r\n\r\n", p.search, len(matches), len(p.processes))
+	fmt.Fprintf(w, "%-8s %-16s %-12s %6s  %s\r\n", "PID", "Name", "User", "CPU", "Command")
+
+	for i := p.offset; i < len(matches) && i < p.offset+p.height; i++ {
+		process := matches[i]
+		jailed := ""
+		if process.Jailed {
+			jailed = "[jailed] "
+		}
+		line := fmt.Sprintf("%-8d %-16s %-12s %5.1f%%  %s%s", process.PID, truncate(process.Name, nameColumnWidth, false),
+			truncate(process.User, 12, false), process.CPU, jailed, strings.Join(strings.Fields(process.Cmdline), " "))
+		if runes := []rune(line); width > 0 && len(runes) > width {
+			line = string(runes[:width])
+		}
+		if i == p.selected {
+			line = "\033[7m" + line + "\033[0m"
+		}
+		fmt.Fprint(w, line+"\r\n")
+	}
+}
+
+// readPickKey reads a key from the terminal, decoding the escape sequences of the arrows,
+// Shift+Tab and the page keys. A lone Esc cancels
+func readPickKey(reader *bufio.Reader) (pickKey, rune, error) {
+	r, _, err := reader.ReadRune()
+	if err != nil {
+		return pickKeyCancel, 0, err
+	}
+	switch r {
+	case '\r', '\n':
+		return pickKeyEnter, r, nil
+	case '\t':
+		return pickKeyNextType, r, nil
+	case 127, 8:
+		return pickKeyBackspace, r, nil
+	case 3, 4: // Ctrl+C, Ctrl+D
+		return pickKeyCancel, r, nil
+	case 21: // Ctrl+U
+		return pickKeyClear, r, nil
+	case 18: // Ctrl+R
+		return pickKeyRefresh, r, nil
+	case 16: // Ctrl+P
+		return pickKeyUp, r, nil
+	case 14: // Ctrl+N
+		return pickKeyDown, r, nil
+	case 27:
+		if reader.Buffered() == 0 {
+			return pickKeyCancel, r, nil
+		}
+		next, _, _ := reader.ReadRune()
+		if next != '[' && next != 'O' {
+			return pickKeyIgnored, r, nil
+		}
+		sequence := ""
+		for {
+			c, _, err := reader.ReadRune()
+			if err != nil {
+				return pickKeyCancel, r, err
+			}
+			sequence += string(c)
+			if c >= '@' && c <= '~' {
+				break
+			}
+		}
+		switch sequence {
+		case "A":
+			return pickKeyUp, r, nil
+		case "B":
+			return pickKeyDown, r, nil
+		case "Z":
+			return pickKeyPreviousType, r, nil
+		case "5~":
+			return pickKeyPageUp, r, nil
+		case "6~":
+			return pickKeyPageDown, r, nil
+		}
+		return pickKeyIgnored, r, nil
+	}
+	if r < ' ' {
+		return pickKeyIgnored, r, nil
+	}
+	return pickKeyRune, r, nil
+}
+
+// runPicker reads keys until a process is picked or the picker is cancelled, refresh
+// samples the processes again for Ctrl+R
+func runPicker(p *picker, input io.Reader, output io.Writer, width int, refresh func() []processSnapshot) (*processSnapshot, error) {
+	reader := bufio.NewReader(input)
+	for {
+		p.render(output, width)
+		var key pickKey
+		var r rune
+		var err error
+		waitUnlocked(p.state, func() { key, r, err = readPickKey(reader) })
+		if err != nil {
+			return nil, err
+		}
+		if key == pickKeyRefresh {
+			fmt.Fprint(output, "\r\nSampling the processes...")
+			p.processes = refresh()
+			p.selected, p.offset = 0, 0
+			continue
+		}
+		if selected, done := p.handleKey(key, r); done {
+			return selected, nil
+		}
+	}
+}
+
+// pickProcess opens the picker on the terminal and jails the picked process with the
+// chosen jail type
+func pickProcess(state *JailerState, args []string, options JailOptions) error {
+	fd := int(os.Stdin.Fd())
+	if !readline.IsTerminal(fd) {
+		return fmt.Errorf("pick needs a terminal, use find or suspects and jail instead")
+	}
+	var first pickChoice
+	if len(args) > 0 {
+		jailType, err := normalizeJailSpec(args[0])
+		if err != nil {
+			return err
+		}
+		first = pickChoice{JailType: jailType, Args: args[1:]}
+	}
+	width, height, err := readline.GetSize(fd)
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	fmt.Fprintln(state.stdout(), "Sampling the processes...")
+	sample := func() []processSnapshot { return snapshotProcesses(state, true) }
+	p := newPicker(state, sample(), first, height-5)
+	terminal, err := readline.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to set the terminal in raw mode: %v", err)
+	}
+	selected, err := runPicker(p, os.Stdin, os.Stdout, width, func() []processSnapshot {
+		return sortPickProcesses(sample())
+	})
+	readline.Restore(fd, terminal)
+	fmt.Fprint(state.stdout(), "\033[H\033[2J")
+	if err != nil {
+		return err
+	}
+	if selected == nil {
+		fmt.Fprintln(state.stdout(), "Nothing jailed")
+		return nil
+	}
+
+	choice := p.choices[p.choice]
+	specs, err := parseJailSpecs(choice.JailType, choice.Args)
+	if err != nil {
+		return err
+	}
+	pids := []int{selected.PID}
+	before := snapshotJails(state, pids)
+	err = jailTargets(state, specs, pids, options)
+	recordOperation(state, "jail "+choice.String()+" "+strconv.Itoa(selected.PID), pids, before)
+	return err
+}
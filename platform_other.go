@@ -0,0 +1,101 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// The jails are enforced with Linux cgroups, nftables or iptables, seccomp and landlock,
+// all in the files built for Linux. A port to another system implements the backends of
+// backend.go in files built for it, e.g. FreeBSD with rctl for the CPU and memory limits
+// and pf anchors for the network jails, and replaces the stubs below. Without backends
+// main refuses to start
+
+// hostProcesses is the process backend of the host, none yet
+var hostProcesses processBackend
+
+// setupBackends leaves the state without backends
+func setupBackends(state *JailerState) {}
+
+// errNoBackend is returned by the features that only exist on Linux
+var errNoBackend = fmt.Errorf("not supported on %s, it requires Linux", runtime.GOOS)
+
+func auditSyscallNumber(name string) (uintptr, bool) {
+	return 0, false
+}
+
+func validateSeccompProfile(profile SeccompProfile) error {
+	return errNoBackend
+}
+
+func probeCapabilities(state *JailerState) []capability {
+	return nil
+}
+
+func jailTypeRequirements(state *JailerState, jailType string) []string {
+	return nil
+}
+
+func runLauncher() {
+	os.Exit(launcherExitCode)
+}
+
+func startLauncher(spec *LaunchSpec, stdin io.Reader, stdout, stderr io.Writer) (*exec.Cmd, *os.File, error) {
+	return nil, nil, errNoBackend
+}
+
+func releaseLauncher(release *os.File) error {
+	return errNoBackend
+}
+
+func runSelftestHelper(args []string) {
+	os.Exit(2)
+}
+
+func runSelftest(state *JailerState, jailTypes []string) error {
+	return errNoBackend
+}
+
+func setupBlocklists(state *JailerState) error {
+	return errNoBackend
+}
+
+func runBlocklistRefresher(state *JailerState) {}
+
+func cleanupBlocklists(state *JailerState) {}
+
+func changeAllowlist(state *JailerState, pid int, action string, addresses []string) error {
+	return errNoBackend
+}
+
+func showAllowlist(state *JailerState, pid int) error {
+	return errNoBackend
+}
+
+func capturePackets(state *JailerState, pid int, path string, duration time.Duration) error {
+	return errNoBackend
+}
+
+func exportRules(state *JailerState, jailTypes []string, path string) error {
+	return errNoBackend
+}
+
+func writeJailRuleset(state *JailerState) {}
+
+func redetectFirewall(state *JailerState) error {
+	return errNoBackend
+}
+
+func checkpointProcess(state *JailerState, pidStr, imageDir string) error {
+	return errNoBackend
+}
+
+func restoreCheckpoint(state *JailerState, imageDir string) error {
+	return errNoBackend
+}
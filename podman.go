@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// containerAPITimeout bounds a request to the API socket of a container manager
+const containerAPITimeout = 5 * time.Second
+
+// podmanRootfulSocket is the API socket of the podman.socket unit of root
+const podmanRootfulSocket = "/run/podman/podman.sock"
+
+// podmanContainer is the part of a libpod container inspection jailer needs
+type podmanContainer struct {
+	ID    string `json:"Id"`
+	Name  string `json:"Name"`
+	State struct {
+		Running bool `json:"Running"`
+		Pid     int  `json:"Pid"`
+	} `json:"State"`
+}
+
+// podmanSockets returns the Podman API sockets of the host, the one of root first and
+// then the rootless ones of the users with a podman.socket unit
+func podmanSockets() []string {
+	var sockets []string
+	if _, err := os.Stat(podmanRootfulSocket); err == nil {
+		sockets = append(sockets, podmanRootfulSocket)
+	}
+	rootless, _ := filepath.Glob("/run/user/*/podman/podman.sock")
+	sort.Strings(rootless)
+	return append(sockets, rootless...)
+}
+
+// unixSocketClient returns an HTTP client sending its requests to a unix socket, whatever
+// the host of the URL
+func unixSocketClient(socket string) *http.Client {
+	return &http.Client{
+		Timeout: containerAPITimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// inspectPodmanContainer asks the Podman API listening on a socket about a container by
+// name or ID, found is false when that Podman doesn't know the container
+func inspectPodmanContainer(socket, container string) (podmanContainer, bool, error) {
+	var inspected podmanContainer
+	response, err := unixSocketClient(socket).Get("http://podman/v4.0.0/libpod/containers/" + url.PathEscape(container) + "/json")
+	if err != nil {
+		return inspected, false, fmt.Errorf("failed to reach the Podman API at %s: %v", socket, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return inspected, false, nil
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return inspected, false, fmt.Errorf("failed to read the Podman API response: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return inspected, false, fmt.Errorf("Podman API at %s answered %s: %s", socket, response.Status, body)
+	}
+	if err := json.Unmarshal(body, &inspected); err != nil {
+		return inspected, false, fmt.Errorf("failed to parse the Podman API response: %v", err)
+	}
+	return inspected, true, nil
+}
+
+// findPodmanContainer looks a container up in the rootful and rootless Podman instances
+func findPodmanContainer(container string) (podmanContainer, bool) {
+	for _, socket := range podmanSockets() {
+		inspected, found, err := inspectPodmanContainer(socket, container)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+			continue
+		}
+		if found {
+			return inspected, true
+		}
+	}
+	return podmanContainer{}, false
+}
+
+// containerTargets returns the processes a container:<id or name> target jails, the ones
+// of the container whose parent is outside of it, the jail covers their descendants
+func containerTargets(container string) ([]int, error) {
+	if container == "" {
+		return nil, fmt.Errorf("invalid target container:, expected container:<id or name>")
+	}
+	pids := containerProcesses(container)
+	if len(pids) == 0 {
+		if inspected, found := findPodmanContainer(container); found {
+			if !inspected.State.Running || inspected.State.Pid <= 0 {
+				return nil, fmt.Errorf("container %q is not running", container)
+			}
+			if pids = containerProcesses(inspected.ID); len(pids) == 0 {
+				pids = []int{inspected.State.Pid}
+			}
+		}
+	}
+	if len(pids) == 0 {
+		pid, err := containerInitProcess(container)
+		if err != nil {
+			return nil, err
+		}
+		pids = []int{pid}
+	}
+
+	roots := rootProcesses(pids)
+	fmt.Printf("Container %s: %d processes, jailing %d of them with their descendants\n", container, len(pids), len(roots))
+	return roots, nil
+}
+
+// rootProcesses returns the processes of a set whose parent is outside of it, jailing
+// them with their descendants covers the whole set
+func rootProcesses(pids []int) []int {
+	inSet := make(map[int]bool, len(pids))
+	for _, pid := range pids {
+		inSet[pid] = true
+	}
+	var roots []int
+	for _, pid := range pids {
+		if parent, err := hostProcesses.parent(pid); err != nil || !inSet[parent] {
+			roots = append(roots, pid)
+		}
+	}
+	return roots
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultConfirmDescendants is the number of descendants from which jail asks before
+	// moving them, a container runtime or a desktop session has hundreds
+	defaultConfirmDescendants = 50
+
+	// defaultMaxJailProcesses is the number of processes a jail command may move without
+	// --force, PID 1 or a display manager bring the whole host or session
+	defaultMaxJailProcesses = 500
+)
+
+// descendantGroup is the descendants of the targets sharing a process name
+type descendantGroup struct {
+	Name string
+	PIDs []int
+}
+
+// collectDescendants returns the processes a jail of the targets would also move: the
+// descendants of the new jails and the children of the existing ones, grouped by name with
+// the largest groups first. The targets themselves are left out
+func collectDescendants(state *JailerState, pids []int) ([]descendantGroup, int) {
+	targets := make(map[int]bool)
+	for _, pid := range pids {
+		targets[pid] = true
+	}
+
+	seen := make(map[int]bool)
+	byName := make(map[string][]int)
+	for _, pid := range pids {
+		var descendants []int
+		if jail, jailed := state.ActiveJails[pid]; jailed {
+			descendants = jail.Children
+		} else {
+			descendants, _ = hostProcesses.descendants(pid)
+		}
+		for _, descendant := range descendants {
+			if targets[descendant] || seen[descendant] || !hostProcesses.exists(descendant) {
+				continue
+			}
+			seen[descendant] = true
+			name := hostProcesses.name(descendant)
+			byName[name] = append(byName[name], descendant)
+		}
+	}
+
+	groups := make([]descendantGroup, 0, len(byName))
+	for name, groupPids := range byName {
+		sort.Ints(groupPids)
+		groups = append(groups, descendantGroup{Name: name, PIDs: groupPids})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].PIDs) != len(groups[j].PIDs) {
+			return len(groups[i].PIDs) > len(groups[j].PIDs)
+		}
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, len(seen)
+}
+
+// checkJailSize refuses a jail command moving more than max_jail_processes processes,
+// the targets and their descendants, unless forced
+func checkJailSize(state *JailerState, targets, descendants int, force bool) error {
+	limit := state.Config.MaxJailProcesses
+	if force || limit < 0 || targets+descendants <= limit {
+		return nil
+	}
+	return fmt.Errorf("the jail would move %d processes (%d targets and %d descendants), more than max_jail_processes (%d)",
+		targets+descendants, targets, descendants, limit)
+}
+
+// previewDescendants lists the descendants of collectDescendants a jail command is about
+// to move and asks for a confirmation from confirm_descendants of them on, unless
+// assumeYes. It returns false when the jail is called off
+func previewDescendants(state *JailerState, pids []int, groups []descendantGroup, total int, assumeYes bool) (bool, error) {
+	const maxPidsShown = 5
+
+	if total == 0 {
+		return true, nil
+	}
+
+	if len(pids) == 1 {
+		fmt.Fprintf(state.stdout(), "Process %d (%s) has %d descendants:\n", pids[0], hostProcesses.name(pids[0]), total)
+	} else {
+		fmt.Fprintf(state.stdout(), "The %d processes have %d descendants:\n", len(pids), total)
+	}
+	w := newTableWriter(state.stdout())
+	for _, group := range groups {
+		var shown []string
+		for i, pid := range group.PIDs {
+			if i == maxPidsShown {
+				shown = append(shown, fmt.Sprintf("and %d more", len(group.PIDs)-maxPidsShown))
+				break
+			}
+			shown = append(shown, strconv.Itoa(pid))
+		}
+		writeTableRow(w, "  "+truncate(group.Name, nameColumnWidth, false), strconv.Itoa(len(group.PIDs)), strings.Join(shown, ", "))
+	}
+	w.Flush()
+
+	threshold := state.Config.ConfirmDescendants
+	if assumeYes || threshold < 0 || total < threshold {
+		return true, nil
+	}
+	confirmed, err := confirmAction(state, fmt.Sprintf("Jail them with their %d descendants?", total))
+	if err != nil {
+		return false, err
+	}
+	if !confirmed {
+		fmt.Fprintln(state.stdout(), "Nothing was jailed")
+	}
+	return confirmed, nil
+}
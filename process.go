@@ -2,120 +2,288 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-// getProcessChildren returns all direct child processes of a process
-func getProcessChildren(pid int) ([]int, error) {
-	var children []int
+// pidMaxLimit is the largest pid_max of the kernel, PID_MAX_LIMIT on 64-bit systems
+const pidMaxLimit = 4194304
+
+// maxPid returns the largest PID of the host from kernel.pid_max
+func maxPid() int {
+	content, err := os.ReadFile("/proc/sys/kernel/pid_max")
+	if err != nil {
+		return pidMaxLimit
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || limit <= 0 {
+		return pidMaxLimit
+	}
+	// pid_max is one past the largest PID
+	return limit - 1
+}
+
+// pfKthread is the flag of the kernel threads in /proc/<pid>/stat (PF_KTHREAD)
+const pfKthread = 0x00200000
+
+// isKernelThreadStat checks the flags field of a stat file for PF_KTHREAD
+func isKernelThreadStat(stat string) bool {
+	// flags is field 9, the 7th after the process name
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 7 {
+		return false
+	}
+	flags, err := strconv.ParseUint(fields[6], 10, 64)
+	return err == nil && flags&pfKthread != 0
+}
+
+// isKernelThread checks if a process is a kernel thread: PF_KTHREAD set and no command line
+func isKernelThread(pid int) bool {
+	content, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil || !isKernelThreadStat(string(content)) {
+		return false
+	}
+	cmdline, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	return err == nil && len(cmdline) == 0
+}
+
+// getProcessExecutable returns the path of the executable of a process, empty when it
+// can't be read, e.g. for kernel threads
+func getProcessExecutable(pid int) string {
+	executable, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(executable, " (deleted)")
+}
+
+// cgroupServiceUnit returns the systemd service a cgroup belongs to, empty outside services
+func cgroupServiceUnit(cgroupPath string) string {
+	parts := strings.Split(cgroupPath, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if strings.HasSuffix(parts[i], ".service") {
+			return parts[i]
+		}
+	}
+	return ""
+}
 
-	// Browse all processes in /proc
+// buildProcessTree maps every process to its direct children in a single pass over /proc
+func buildProcessTree() (map[int][]int, error) {
 	entries, err := os.ReadDir("/proc")
 	if err != nil {
 		return nil, fmt.Errorf("failed to read /proc directory: %v", err)
 	}
 
+	tree := make(map[int][]int)
 	for _, entry := range entries {
 		if !entry.IsDir() {
 			continue
 		}
 
 		// Check if it's a PID (numeric name)
-		childPid, err := strconv.Atoi(entry.Name())
+		pid, err := strconv.Atoi(entry.Name())
 		if err != nil {
 			continue // Not a PID
 		}
 
-		// Read the PPID (parent PID) of this process
-		statFile := filepath.Join("/proc", entry.Name(), "stat")
-		content, err := os.ReadFile(statFile)
+		ppid, err := hostProcesses.parent(pid)
 		if err != nil {
 			continue // Process may have disappeared
 		}
+		tree[ppid] = append(tree[ppid], pid)
+	}
 
-		// stat file format: pid (comm) state ppid ...
-		fields := strings.Fields(string(content))
-		if len(fields) < 4 {
-			continue
-		}
+	return tree, nil
+}
 
-		ppid, err := strconv.Atoi(fields[3])
+// taskChildrenSupported checks if the kernel provides /proc/<pid>/task/<tid>/children
+// (CONFIG_PROC_CHILDREN)
+func taskChildrenSupported() bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/self/task/%d/children", os.Getpid()))
+	return err == nil
+}
+
+// readTaskChildren returns the direct children of a process by reading the children file
+// of each of its threads, children of any thread are children of the process
+func readTaskChildren(pid int) ([]int, error) {
+	files, err := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	var children []int
+	for _, file := range files {
+		content, err := os.ReadFile(file)
 		if err != nil {
-			continue
+			continue // Thread may have exited
 		}
-
-		// If the PPID matches our PID, it's a child
-		if ppid == pid {
-			children = append(children, childPid)
+		for _, field := range strings.Fields(string(content)) {
+			if childPid, err := strconv.Atoi(field); err == nil {
+				children = append(children, childPid)
+			}
 		}
 	}
 
 	return children, nil
 }
 
-// getAllDescendants returns all descendants (children, grandchildren, etc.) of a process
-func getAllDescendants(pid int) ([]int, error) {
-	var descendants []int
-	visited := make(map[int]bool)
+// getProcessChildren returns all direct child processes of a process
+func getProcessChildren(pid int) ([]int, error) {
+	if taskChildrenSupported() {
+		return readTaskChildren(pid)
+	}
+
+	tree, err := buildProcessTree()
+	if err != nil {
+		return nil, err
+	}
+	return tree[pid], nil
+}
 
-	// Recursive function to find all descendants
-	var findDescendants func(int) error
-	findDescendants = func(parentPid int) error {
-		if visited[parentPid] {
-			return nil // Avoid infinite loops
+// cgroupProcesses returns the processes whose /proc/<pid>/cgroup content is matched,
+// without their descendants which the jails cover
+func cgroupProcesses(match func(cgroup string) bool) []int {
+	members := make(map[int]bool)
+	for _, pid := range listProcessPids() {
+		content, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+		if err == nil && match(string(content)) {
+			members[pid] = true
 		}
-		visited[parentPid] = true
+	}
 
-		children, err := getProcessChildren(parentPid)
-		if err != nil {
-			return err
+	var pids []int
+	for pid := range members {
+		if parent, err := hostProcesses.parent(pid); err != nil || !members[parent] {
+			pids = append(pids, pid)
 		}
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// maxProcessWorkers bounds the number of processes changed concurrently
+const maxProcessWorkers = 16
+
+// forEachProcess calls fn for every PID with a bounded pool of workers and returns the
+// errors by PID
+func forEachProcess(pids []int, fn func(pid int) error) map[int]error {
+	errs, _ := forEachProcessUntil(pids, nil, fn)
+	return errs
+}
+
+// forEachProcessUntil is forEachProcess stopping once stop is closed, the PIDs not handed
+// to a worker by then are returned untouched. A nil stop never closes
+func forEachProcessUntil(pids []int, stop <-chan struct{}, fn func(pid int) error) (map[int]error, []int) {
+	errs := make(map[int]error)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
 
-		for _, childPid := range children {
-			descendants = append(descendants, childPid)
-			// Recursively find descendants of this child
-			if err := findDescendants(childPid); err != nil {
-				// Continue even if we can't access certain processes
-				continue
+	queue := make(chan int)
+	workers := min(maxProcessWorkers, len(pids))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pid := range queue {
+				if err := fn(pid); err != nil {
+					mutex.Lock()
+					errs[pid] = err
+					mutex.Unlock()
+				}
 			}
-		}
+		}()
+	}
 
-		return nil
+	var skipped []int
+dispatch:
+	for i, pid := range pids {
+		select {
+		case queue <- pid:
+		case <-stop:
+			skipped = append(skipped, pids[i:]...)
+			break dispatch
+		}
 	}
+	close(queue)
+	wg.Wait()
 
-	if err := findDescendants(pid); err != nil {
-		return nil, err
+	return errs, skipped
+}
+
+// summarizeProcessErrors collapses the errors of a bulk operation into their causes, most
+// frequent first, so that the same failure on hundreds of processes is reported once
+func summarizeProcessErrors(errs map[int]error) string {
+	const maxCauses = 3
+
+	counts := make(map[string]int)
+	for pid, err := range errs {
+		counts[processErrorCause(pid, err)]++
+	}
+	causes := make([]string, 0, len(counts))
+	for cause := range counts {
+		causes = append(causes, cause)
+	}
+	sort.Slice(causes, func(i, j int) bool {
+		if counts[causes[i]] != counts[causes[j]] {
+			return counts[causes[i]] > counts[causes[j]]
+		}
+		return causes[i] < causes[j]
+	})
+	if len(causes) == 1 {
+		return causes[0]
 	}
 
-	return descendants, nil
+	var parts []string
+	others := len(errs)
+	for i, cause := range causes {
+		if i == maxCauses {
+			parts = append(parts, fmt.Sprintf("%d with other errors", others))
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%d: %s", counts[cause], cause))
+		others -= counts[cause]
+	}
+	return strings.Join(parts, "; ")
 }
 
-// processExists checks if a process still exists
-func processExists(pid int) bool {
-	_, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
-	return err == nil
+// processErrorCause returns the error of a process without its PID, the same failure on
+// different processes gives the same cause
+func processErrorCause(pid int, err error) string {
+	pidPattern := regexp.MustCompile(`(?i)\b(pid|process) ` + strconv.Itoa(pid) + `\b`)
+	return pidPattern.ReplaceAllString(err.Error(), "the process")
 }
 
-// getProcessName returns the name of a process
-func getProcessName(pid int) string {
-	commFile := fmt.Sprintf("/proc/%d/comm", pid)
-	content, err := os.ReadFile(commFile)
-	if err != nil {
-		return fmt.Sprintf("PID-%d", pid)
+// printProcessErrors prints the error of every process on its own line, in PID order
+func printProcessErrors(out io.Writer, errs map[int]error) {
+	pids := make([]int, 0, len(errs))
+	for pid := range errs {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		fmt.Fprintf(out, "  %d (%s): %v\n", pid, hostProcesses.name(pid), errs[pid])
 	}
-	return strings.TrimSpace(string(content))
 }
 
 // validateProcessAccess checks that we can access the process and its information
 func validateProcessAccess(pid int) error {
 	// Check that the process exists
-	if !processExists(pid) {
+	if !hostProcesses.exists(pid) {
 		return fmt.Errorf("process %d does not exist", pid)
 	}
 
+	// Kernel threads can't be moved to cgroups or limited, the writes would only fail later
+	if isKernelThread(pid) {
+		return fmt.Errorf("process %d (%s) is a kernel thread, kernel threads can't be jailed", pid, hostProcesses.name(pid))
+	}
+
 	// Check that we can read its cgroup information
 	cgroupFile := fmt.Sprintf("/proc/%d/cgroup", pid)
 	if _, err := os.Stat(cgroupFile); err != nil {
@@ -130,9 +298,14 @@ func cleanupDeadProcesses(state *JailerState) {
 	var deadProcesses []int
 
 	for pid, jail := range state.ActiveJails {
-		if !processExists(pid) {
-			fmt.Printf("Process %d no longer exists, removing from jail list (had jails: %s)\n",
+		if !hostProcesses.exists(pid) {
+			fmt.Fprintf(state.stdout(), "Process %d no longer exists, removing from jail list (had jails: %s)\n",
 				pid, jail.GetJailTypesString())
+			recordJailHistory(state, jail, "exited")
+			if jail.HasJailType("quota") {
+				state.Quotas.releaseJail(jail)
+			}
+			state.Firewall.releaseJail(jail)
 			deadProcesses = append(deadProcesses, pid)
 			continue
 		}
@@ -141,7 +314,7 @@ func cleanupDeadProcesses(state *JailerState) {
 		aliveChildren := jail.Children[:0] // Reuse slice capacity
 		deadChildren := 0
 		for _, childPid := range jail.Children {
-			if processExists(childPid) {
+			if hostProcesses.exists(childPid) {
 				aliveChildren = append(aliveChildren, childPid)
 			} else {
 				deadChildren++
@@ -150,7 +323,7 @@ func cleanupDeadProcesses(state *JailerState) {
 
 		// Update children list and log if any children died
 		if deadChildren > 0 {
-			fmt.Printf("Process %d (%s): %d child processes died, %d still alive\n",
+			fmt.Fprintf(state.stdout(), "Process %d (%s): %d child processes died, %d still alive\n",
 				pid, jail.GetJailTypesString(), deadChildren, len(aliveChildren))
 			jail.Children = aliveChildren
 		}
@@ -162,6 +335,6 @@ func cleanupDeadProcesses(state *JailerState) {
 	}
 
 	if len(deadProcesses) > 0 {
-		fmt.Printf("Cleaned up %d dead processes from jail list\n", len(deadProcesses))
+		fmt.Fprintf(state.stdout(), "Cleaned up %d dead processes from jail list\n", len(deadProcesses))
 	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import "fmt"
+
+// SeccompProfile describes the syscalls denied to a command launched in a syscall jail
+type SeccompProfile struct {
+	Deny   []string `json:"deny"`             // Syscall names to reject
+	Action string   `json:"action,omitempty"` // "errno" (default, fails with EPERM) or "kill"
+}
+
+// builtinSeccompProfiles are always available and can be overridden in the config file
+var builtinSeccompProfiles = map[string]SeccompProfile{
+	"no-network": {
+		Deny: []string{"socket", "connect", "bind", "listen", "accept", "accept4", "sendto", "sendmsg", "sendmmsg"},
+	},
+	"no-ptrace": {
+		Deny: []string{"ptrace", "process_vm_readv", "process_vm_writev"},
+	},
+	"no-admin": {
+		Deny: []string{"mount", "umount2", "pivot_root", "chroot", "unshare", "setns", "init_module",
+			"finit_module", "delete_module", "kexec_load", "reboot", "swapon", "swapoff", "bpf", "perf_event_open"},
+	},
+}
+
+// LandlockProfile lists the filesystem paths a command launched in a landlock jail may access,
+// everything else is denied
+type LandlockProfile struct {
+	ReadOnly  []string `json:"read_only"`
+	ReadWrite []string `json:"read_write"`
+}
+
+// builtinLandlockProfiles are always available and can be overridden in the config file
+var builtinLandlockProfiles = map[string]LandlockProfile{
+	"system-readonly": {
+		ReadOnly:  []string{"/usr", "/lib", "/lib64", "/bin", "/sbin", "/etc", "/proc", "/dev"},
+		ReadWrite: []string{"/tmp", "/dev/null"},
+	},
+}
+
+// validateLandlockProfile checks that a profile grants access to something
+func validateLandlockProfile(profile LandlockProfile) error {
+	if len(profile.ReadOnly) == 0 && len(profile.ReadWrite) == 0 {
+		return fmt.Errorf("profile does not allow any path")
+	}
+	return nil
+}
+
+// ReadOnlyProfile lists the paths that stay writable for a command launched in a readonly jail
+type ReadOnlyProfile struct {
+	Writable []string `json:"writable"`
+}
+
+// builtinReadOnlyProfiles are always available and can be overridden in the config file
+var builtinReadOnlyProfiles = map[string]ReadOnlyProfile{
+	"tmp-writable": {
+		Writable: []string{"/tmp"},
+	},
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chzyer/readline"
+)
+
+const (
+	// largeTreeProcesses is the size from which the moves of a tree show their progress
+	// and stop on Ctrl+C
+	largeTreeProcesses = 100
+
+	// progressInterval is the time between two updates of the progress line
+	progressInterval = 200 * time.Millisecond
+)
+
+// errMoveInterrupted is the error of the processes left untouched by Ctrl+C
+var errMoveInterrupted = errors.New("interrupted by Ctrl+C")
+
+// moveProcesses calls fn for every process of a tree like forEachProcess. From
+// largeTreeProcesses on, the count of the processes done is shown on the terminal, and
+// Ctrl+C in an interruptible command stops the remaining ones: they are left untouched
+// with errMoveInterrupted as their error. It returns the errors and the untouched count
+func moveProcesses(verb string, pids []int, fn func(pid int) error) (map[int]error, int) {
+	if len(pids) < largeTreeProcesses {
+		return forEachProcess(pids, fn), 0
+	}
+
+	interrupted := currentInterrupt()
+	var done atomic.Int64
+	stopProgress := showProgress(verb, len(pids), &done, interrupted != nil)
+	errs, skipped := forEachProcessUntil(pids, interrupted, func(pid int) error {
+		defer done.Add(1)
+		return fn(pid)
+	})
+	stopProgress()
+
+	for _, pid := range skipped {
+		errs[pid] = errMoveInterrupted
+	}
+	if len(skipped) > 0 {
+		fmt.Printf("Interrupted: %s %d of %d descendants, the other %d were left untouched\n",
+			strings.ToLower(verb), len(pids)-len(skipped), len(pids), len(skipped))
+	}
+	return errs, len(skipped)
+}
+
+// showProgress keeps a "Jailed X/Y descendants" line up to date on the terminal until the
+// returned function is called, it shows nothing when the output isn't a terminal
+func showProgress(verb string, total int, done *atomic.Int64, interruptible bool) func() {
+	if !readline.IsTerminal(int(os.Stdout.Fd())) {
+		return func() {}
+	}
+	hint := ""
+	if interruptible {
+		hint = " (Ctrl+C stops)"
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			fmt.Printf("\r\033[K  %s %d/%d descendants%s", verb, done.Load(), total, hint)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				fmt.Printf("\r\033[K  %s %d/%d descendants\n", verb, done.Load(), total)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// interruptedBefore checks if Ctrl+C stopped the command owning the channel, so that the
+// remaining targets of a bulk operation are left untouched
+func interruptedBefore(interrupted <-chan struct{}) bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
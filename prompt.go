@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chzyer/readline"
+)
+
+// promptRefreshInterval is the time between two updates of the prompt while it waits
+const promptRefreshInterval = time.Second
+
+// maxPromptWarnings bounds the warnings kept until the warnings command shows them
+const maxPromptWarnings = 100
+
+// promptWarning is an alert raised in the background, flagged by the prompt until seen
+type promptWarning struct {
+	Time    time.Time
+	Message string
+}
+
+// promptWarnings are the alerts not seen yet with the warnings command
+var promptWarnings struct {
+	sync.Mutex
+	list []promptWarning
+}
+
+// addPromptWarning flags an alert in the prompt
+func addPromptWarning(message string) {
+	promptWarnings.Lock()
+	defer promptWarnings.Unlock()
+	promptWarnings.list = append(promptWarnings.list, promptWarning{Time: time.Now(), Message: message})
+	if len(promptWarnings.list) > maxPromptWarnings {
+		promptWarnings.list = promptWarnings.list[len(promptWarnings.list)-maxPromptWarnings:]
+	}
+}
+
+// takePromptWarnings returns the alerts not seen yet and clears the flag of the prompt
+func takePromptWarnings() []promptWarning {
+	promptWarnings.Lock()
+	defer promptWarnings.Unlock()
+	warnings := promptWarnings.list
+	promptWarnings.list = nil
+	return warnings
+}
+
+// promptText returns the prompt with the number of active jails, e.g. jailer[3]> , and a !
+// while alerts such as escapes or OOM kills weren't seen with the warnings command
+func promptText(state *JailerState) string {
+	promptWarnings.Lock()
+	flag := ""
+	if len(promptWarnings.list) > 0 {
+		flag = "!"
+	}
+	promptWarnings.Unlock()
+
+	// The prompt is refreshed beside the monitors changing the jails
+	stateMutex.Lock()
+	jails := len(state.ActiveJails)
+	stateMutex.Unlock()
+	return fmt.Sprintf("jailer[%d%s]> ", jails, flag)
+}
+
+// showWarnings prints the alerts raised since the last call and clears the flag of the prompt
+func showWarnings(out io.Writer) error {
+	warnings := takePromptWarnings()
+	if len(warnings) == 0 {
+		fmt.Fprintln(out, "No new warnings")
+		return nil
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(out, "%s  %s\n", warning.Time.Format("15:04:05"), warning.Message)
+	}
+	return nil
+}
+
+// runPromptRefresher redraws the prompt when the jails or the warnings change in the
+// background, e.g. a jailed process exited or escaped
+func runPromptRefresher(state *JailerState, rl *readline.Instance) {
+	shown := promptText(state)
+	for range time.Tick(promptRefreshInterval) {
+		if text := promptText(state); text != shown {
+			shown = text
+			rl.SetPrompt(text)
+			rl.Refresh()
+		}
+	}
+}
+
+// confirmAction asks a yes/no question on the terminal. Piped commands and the commands of
+// a controller have nobody to answer, they must confirm with --yes instead
+func confirmAction(state *JailerState, question string) (bool, error) {
+	if state.Output != nil || !readline.IsTerminal(int(os.Stdin.Fd())) || !readline.IsTerminal(int(os.Stdout.Fd())) {
+		return false, fmt.Errorf("no terminal to confirm on, add --yes")
+	}
+	fmt.Fprintf(state.stdout(), "%s [y/N] ", question)
+	var answer string
+	var err error
+	waitUnlocked(state, func() {
+		answer, err = bufio.NewReader(os.Stdin).ReadString('\n')
+	})
+	if err != nil {
+		fmt.Fprintln(state.stdout())
+		return false, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
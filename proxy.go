@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// parseNetworkProxy resolves the address of the proxy that proxy jails may reach
+func parseNetworkProxy(value string) (*net.TCPAddr, error) {
+	address, err := net.ResolveTCPAddr("tcp", value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network_proxy %q: %v", value, err)
+	}
+	if address.IP == nil || address.IP.IsUnspecified() || address.Port == 0 {
+		return nil, fmt.Errorf("invalid network_proxy %q: a host and a port are required", value)
+	}
+	return address, nil
+}
+
+// checkProxyJailCombination refuses to combine the proxy jail with the jail types that
+// need another cgroup or contradict it
+func checkProxyJailCombination(state *JailerState, jail *Jail, jailType string) error {
+	if jailType == "proxy" && state.Config.NetworkProxy == "" {
+		return fmt.Errorf("proxy jails need network_proxy in the configuration")
+	}
+	if jail == nil {
+		return nil
+	}
+	for _, other := range jail.JailTypes {
+		conflict := ""
+		if jailType == "proxy" && other != "proxy" && isCgroupJailType(other) {
+			conflict = other
+		} else if other == "proxy" && jailType != "proxy" && isCgroupJailType(jailType) {
+			conflict = jailType
+		}
+		if conflict != "" {
+			return fmt.Errorf("the proxy jail can't be combined with the %s jail", conflict)
+		}
+	}
+	return nil
+}
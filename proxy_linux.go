@@ -0,0 +1,155 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// JailProxyCgroup holds the processes of proxy jails, on v1 in the net_cls hierarchy
+	JailProxyCgroup = "jail-proxy"
+
+	// proxyClassID tags the traffic of proxy jails on cgroups v1
+	proxyClassID = "0x00100002"
+)
+
+// proxyCgroupPath returns the cgroup of the proxy jails
+func proxyCgroupPath(state *JailerState) string {
+	if state.CgroupVersion == 2 {
+		return filepath.Join("/sys/fs/cgroup", JailProxyCgroup)
+	}
+	return filepath.Join("/sys/fs/cgroup/net_cls", JailProxyCgroup)
+}
+
+// proxyJailMatch returns the arguments matching the traffic of the proxy jail cgroup for
+// the firewall tool in use
+func proxyJailMatch(state *JailerState) []string {
+	if state.FirewallTool == "nftables" {
+		if state.CgroupVersion == 2 {
+			return []string{"socket", "cgroupv2", "level", "1", "\"" + JailProxyCgroup + "\""}
+		}
+		return []string{"meta", "cgroup", proxyClassID}
+	}
+	if state.CgroupVersion == 2 {
+		return []string{"-m", "cgroup", "--path", JailProxyCgroup}
+	}
+	return []string{"-m", "cgroup", "--cgroup", proxyClassID}
+}
+
+// proxyJailRules returns the firewall commands letting the proxy jail reach the proxy
+// and dropping the rest of its traffic, action is -A or -D for iptables
+func proxyJailRules(state *JailerState, action string) ([][]string, error) {
+	proxy, err := parseNetworkProxy(state.Config.NetworkProxy)
+	if err != nil {
+		return nil, err
+	}
+	match := proxyJailMatch(state)
+	port := strconv.Itoa(proxy.Port)
+
+	var rules [][]string
+	if state.FirewallTool == "nftables" {
+		family := "ip"
+		if proxy.IP.To4() == nil {
+			family = "ip6"
+		}
+		for _, chain := range []struct{ name, address, port string }{
+			{"output", "daddr", "dport"},
+			{"input", "saddr", "sport"},
+		} {
+			prefix := append([]string{"nft", "add", "rule", "inet", "jail", chain.name}, match...)
+			rules = append(rules,
+				append(append([]string{}, prefix...), family, chain.address, proxy.IP.String(), "tcp", chain.port, port, "accept"),
+				append(append([]string{}, prefix...), "counter", "drop"),
+			)
+		}
+		return rules, nil
+	}
+
+	if proxy.IP.To4() == nil {
+		return nil, fmt.Errorf("iptables only filters IPv4, network_proxy must be an IPv4 address")
+	}
+	for _, chain := range []struct{ name, address, port string }{
+		{"OUTPUT", "-d", "--dport"},
+		{"INPUT", "-s", "--sport"},
+	} {
+		prefix := append([]string{"iptables", action, chain.name}, match...)
+		rules = append(rules,
+			append(append([]string{}, prefix...), chain.address, proxy.IP.String(), "-p", "tcp", chain.port, port, "-j", "ACCEPT"),
+			append(append([]string{}, prefix...), "-j", "DROP"),
+		)
+	}
+	return rules, nil
+}
+
+// setupProxyJail creates the cgroup and the firewall rules of the proxy jails
+func setupProxyJail(state *JailerState) error {
+	cgroupPath := proxyCgroupPath(state)
+	if err := os.MkdirAll(cgroupPath, 0755); err != nil {
+		return fmt.Errorf("failed to create proxy jail cgroup: %v", err)
+	}
+	if state.CgroupVersion == 1 {
+		if err := writeFile(filepath.Join(cgroupPath, "net_cls.classid"), proxyClassID+"\n"); err != nil {
+			return fmt.Errorf("failed to set net_cls classid of the proxy jail: %v", err)
+		}
+	}
+
+	rules, err := proxyJailRules(state, "-A")
+	if err != nil {
+		return err
+	}
+	for _, args := range rules {
+		if output, err := runFirewallCommand(args...); err != nil {
+			return fmt.Errorf("failed to execute %s command %v: %v\nOutput: %s", args[0], args, err, string(output))
+		}
+	}
+
+	fmt.Printf("Proxy jail rules configured, only %s is reachable\n", state.Config.NetworkProxy)
+	return nil
+}
+
+// cleanupProxyJail removes the rules and the cgroup of the proxy jails, the nftables rules
+// go away with the jail table
+func cleanupProxyJail(state *JailerState) {
+	if state.FirewallTool == "iptables" {
+		if rules, err := proxyJailRules(state, "-D"); err == nil {
+			for _, args := range rules {
+				if output, err := runFirewallCommand(args...); err != nil &&
+					!strings.Contains(string(output), "No chain/target/match by that name") {
+					fmt.Printf("Warning: failed to remove iptables rule %v: %v\n", args, err)
+				}
+			}
+		}
+	}
+	cleanupEmptyCgroup(proxyCgroupPath(state), "proxy jail")
+}
+
+// moveProcessToProxyCgroup moves a process to the proxy jail cgroup
+func moveProcessToProxyCgroup(state *JailerState, pid int) error {
+	procsFile := filepath.Join(proxyCgroupPath(state), "cgroup.procs")
+	if err := os.WriteFile(procsFile, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to move PID %d to proxy jail cgroup: %v", pid, err)
+	}
+	return nil
+}
+
+// describeProxyJailRules returns the firewall rules set up for the proxy jails
+func describeProxyJailRules(state *JailerState) []string {
+	rules, err := proxyJailRules(state, "-A")
+	if err != nil {
+		return nil
+	}
+	descriptions := make([]string, len(rules))
+	for i, args := range rules {
+		if state.FirewallTool == "nftables" {
+			descriptions[i] = fmt.Sprintf("inet jail %s: %s", args[5], strings.Join(args[6:], " "))
+		} else {
+			descriptions[i] = strings.Join(args[1:], " ")
+		}
+	}
+	return descriptions
+}
@@ -0,0 +1,370 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// FS_IOC_FSGETXATTR and FS_IOC_FSSETXATTR, _IOR/_IOW('X', 31/32, struct fsxattr)
+	fsIocFsGetXattr    = 0x801c581f
+	fsIocFsSetXattr    = 0x401c5820
+	fsXflagProjInherit = 0x00000200
+
+	// quotactl commands for project quotas, QCMD(Q_GETQUOTA/Q_SETQUOTA, PRJQUOTA)
+	prjQuota      = 2
+	qGetQuota     = 0x800007<<8 | prjQuota
+	qSetQuota     = 0x800008<<8 | prjQuota
+	qifBlockLimit = 1
+	qifSpace      = 2
+
+	// Project IDs of the quota jails, far above the IDs usually given in /etc/projid
+	quotaProjectBase = 1 << 30
+
+	// maxQuotaDirectories bounds the subdirectories of the given directories a quota jail
+	// moves to its project, each one is saved with the jail
+	maxQuotaDirectories = 10000
+)
+
+// fsxattr mirrors struct fsxattr of linux/fs.h
+type fsxattr struct {
+	Xflags     uint32
+	Extsize    uint32
+	Nextents   uint32
+	Projid     uint32
+	Cowextsize uint32
+	Pad        [8]byte
+}
+
+// ifDqblk mirrors struct if_dqblk of linux/quota.h
+type ifDqblk struct {
+	BHardLimit uint64
+	BSoftLimit uint64
+	CurSpace   uint64
+	IHardLimit uint64
+	ISoftLimit uint64
+	CurInodes  uint64
+	BTime      uint64
+	ITime      uint64
+	Valid      uint32
+	_          uint32
+}
+
+// quotaProjectID returns the project ID used by the quota jail of a process
+func quotaProjectID(jailPid int) uint32 {
+	return uint32(quotaProjectBase + jailPid)
+}
+
+// findWritableFiles returns the regular files the processes have open for writing
+func findWritableFiles(pids []int) []string {
+	seen := make(map[string]bool)
+	var files []string
+
+	for _, pid := range pids {
+		fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+		entries, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			target, err := os.Readlink(filepath.Join(fdDir, entry.Name()))
+			if err != nil || !filepath.IsAbs(target) || seen[target] {
+				continue
+			}
+			if info, err := os.Stat(target); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if !isOpenForWriting(pid, entry.Name()) {
+				continue
+			}
+			seen[target] = true
+			files = append(files, target)
+		}
+	}
+
+	sort.Strings(files)
+	return files
+}
+
+// findWritableDirectories returns the directories of the regular files the processes
+// have open for writing
+func findWritableDirectories(pids []int) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, file := range findWritableFiles(pids) {
+		if dir := filepath.Dir(file); !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	sort.Strings(dirs)
+	return dirs
+}
+
+// quotaSubdirectories returns the subdirectories of a directory given to a quota jail,
+// without crossing into other filesystems. Their files are charged through the inherit
+// flag of the project, at most maxQuotaDirectories of them are taken
+func quotaSubdirectories(dir string) ([]string, error) {
+	var root unix.Stat_t
+	if err := unix.Lstat(dir, &root); err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == dir || !entry.IsDir() {
+			return nil
+		}
+		var stat unix.Stat_t
+		if err := unix.Lstat(path, &stat); err != nil || stat.Dev != root.Dev {
+			return filepath.SkipDir
+		}
+		if len(dirs) == maxQuotaDirectories {
+			return fmt.Errorf("more than %d directories below %s, give the directories the process writes to", maxQuotaDirectories, dir)
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	return dirs, err
+}
+
+// isOpenForWriting checks the access mode of a file descriptor in /proc/<pid>/fdinfo
+func isOpenForWriting(pid int, fd string) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%s", pid, fd))
+	if err != nil {
+		return false
+	}
+	return fdinfoWritable(string(data))
+}
+
+// fdinfoWritable checks the octal flags line of fdinfo for a write access mode
+func fdinfoWritable(fdinfo string) bool {
+	for _, line := range strings.Split(fdinfo, "\n") {
+		value, found := strings.CutPrefix(line, "flags:")
+		if !found {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+		if err != nil {
+			return false
+		}
+		mode := flags & unix.O_ACCMODE
+		return mode == unix.O_WRONLY || mode == unix.O_RDWR
+	}
+	return false
+}
+
+// supportsProjectQuota checks if a directory lives on a filesystem with project quotas
+func supportsProjectQuota(dir string) bool {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil {
+		return false
+	}
+	return fs.Type == unix.XFS_SUPER_MAGIC || fs.Type == unix.EXT4_SUPER_MAGIC
+}
+
+// setupQuotaJail assigns the directories of the quota jail to the project of the jail
+// and limits the project, pids are searched for writable directories if none were given.
+// Existing files keep their project, so the files the pids write to are charged to the
+// project as well, and the subdirectories of the given directories join it
+func setupQuotaJail(jail *Jail, pids []int) error {
+	explicit := len(jail.QuotaDirs) > 0
+	if !explicit {
+		for _, dir := range findWritableDirectories(pids) {
+			if !supportsProjectQuota(dir) {
+				fmt.Printf("  Skipping %s: not on an XFS or ext4 filesystem\n", dir)
+				continue
+			}
+			jail.QuotaDirs = append(jail.QuotaDirs, dir)
+		}
+		if len(jail.QuotaDirs) == 0 {
+			return fmt.Errorf("no written directory found on XFS or ext4, give the directories explicitly")
+		}
+	}
+
+	projectID := quotaProjectID(jail.PID)
+	jail.SavedProjects = make(map[string]savedProject)
+	for _, dir := range jail.QuotaDirs {
+		if !supportsProjectQuota(dir) {
+			releaseQuotaJail(jail)
+			return fmt.Errorf("%s is not on an XFS or ext4 filesystem", dir)
+		}
+		saved, err := setPathProject(dir, projectID, true)
+		if err != nil {
+			releaseQuotaJail(jail)
+			return err
+		}
+		jail.SavedProjects[dir] = saved
+		if err := setQuotaLimit(dir, projectID, jail.QuotaBytes); err != nil {
+			releaseQuotaJail(jail)
+			return err
+		}
+		fmt.Printf("  Limited %s to %s (project %d)\n", dir, formatBytes(jail.QuotaBytes), projectID)
+	}
+
+	var paths []string
+	if explicit {
+		for _, dir := range jail.QuotaDirs {
+			subdirectories, err := quotaSubdirectories(dir)
+			if err != nil {
+				releaseQuotaJail(jail)
+				return err
+			}
+			paths = append(paths, subdirectories...)
+		}
+	} else {
+		for _, file := range findWritableFiles(pids) {
+			if slices.Contains(jail.QuotaDirs, filepath.Dir(file)) {
+				paths = append(paths, file)
+			}
+		}
+	}
+	charged := 0
+	for _, path := range paths {
+		if _, exists := jail.SavedProjects[path]; exists {
+			continue
+		}
+		saved, err := setPathProject(path, projectID, true)
+		if err != nil {
+			fmt.Printf("  Warning: %v, its writes aren't charged to the quota\n", err)
+			continue
+		}
+		jail.SavedProjects[path] = saved
+		charged++
+	}
+	if charged > 0 {
+		what := "open files"
+		if explicit {
+			what = "subdirectories"
+		}
+		fmt.Printf("  Charged %d existing %s to project %d\n", charged, what, projectID)
+	}
+
+	return nil
+}
+
+// releaseQuotaJail gives the directories and files charged to a quota jail their project
+// back and lifts the limit, files created meanwhile keep the project of the jail
+func releaseQuotaJail(jail *Jail) {
+	projectID := quotaProjectID(jail.PID)
+	for path, saved := range jail.SavedProjects {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			// Removed while jailed, nothing to give back
+			continue
+		}
+		if _, err := setPathProject(path, saved.ProjectID, saved.Inherit); err != nil {
+			fmt.Printf("Warning: failed to restore project of %s: %v\n", path, err)
+		}
+	}
+	for _, dir := range jail.QuotaDirs {
+		if _, exists := jail.SavedProjects[dir]; !exists {
+			continue
+		}
+		if err := setQuotaLimit(dir, projectID, 0); err != nil {
+			fmt.Printf("Warning: failed to lift quota of %s: %v\n", dir, err)
+		}
+	}
+	jail.SavedProjects = nil
+}
+
+// setPathProject sets the project ID of a directory or a regular file and returns the
+// previous one, the inherit flag makes the new files and subdirectories of a directory
+// join the project
+func setPathProject(path string, projectID uint32, inherit bool) (savedProject, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return savedProject{}, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer unix.Close(fd)
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return savedProject{}, fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	isDir := stat.Mode&unix.S_IFMT == unix.S_IFDIR
+
+	var attr fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), fsIocFsGetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return savedProject{}, fmt.Errorf("failed to read project of %s: %v", path, errno)
+	}
+	saved := savedProject{ProjectID: attr.Projid, Inherit: attr.Xflags&fsXflagProjInherit != 0}
+
+	attr.Projid = projectID
+	if isDir && inherit {
+		attr.Xflags |= fsXflagProjInherit
+	} else if isDir {
+		attr.Xflags &^= fsXflagProjInherit
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), fsIocFsSetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		if errno == unix.EOPNOTSUPP {
+			return savedProject{}, fmt.Errorf("project quotas are not enabled on the filesystem of %s (mount it with prjquota)", path)
+		}
+		return savedProject{}, fmt.Errorf("failed to set project of %s: %v", path, errno)
+	}
+
+	return saved, nil
+}
+
+// quotactlProject runs a project quota command on the filesystem of a directory
+func quotactlProject(dir string, cmd int, projectID uint32, quota *ifDqblk) error {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", dir, err)
+	}
+	defer unix.Close(fd)
+
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL_FD, uintptr(fd), uintptr(cmd), uintptr(projectID),
+		uintptr(unsafe.Pointer(quota)), 0, 0)
+	switch errno {
+	case 0:
+		return nil
+	case unix.ENOSYS:
+		return fmt.Errorf("quota jails require Linux 5.14 or later")
+	case unix.ESRCH, unix.ENOTSUP:
+		return fmt.Errorf("project quotas are not enabled on the filesystem of %s (mount it with prjquota)", dir)
+	default:
+		return fmt.Errorf("quotactl failed on %s: %v", dir, errno)
+	}
+}
+
+// setQuotaLimit sets the byte limit of a project on the filesystem of a directory, 0
+// removes the limit
+func setQuotaLimit(dir string, projectID uint32, limit uint64) error {
+	blocks := (limit + quotaBlock - 1) / quotaBlock
+	quota := ifDqblk{BHardLimit: blocks, BSoftLimit: blocks, Valid: qifBlockLimit}
+	return quotactlProject(dir, qSetQuota, projectID, &quota)
+}
+
+// getQuotaUsage returns the bytes used by a project on the filesystem of a directory
+func getQuotaUsage(dir string, projectID uint32) (uint64, error) {
+	var quota ifDqblk
+	if err := quotactlProject(dir, qGetQuota, projectID, &quota); err != nil {
+		return 0, err
+	}
+	if quota.Valid&qifSpace == 0 {
+		return 0, fmt.Errorf("no space usage reported for %s", dir)
+	}
+	return quota.CurSpace, nil
+}
+
+// describeQuota returns the limit of a quota jail, its directories and their usage
+func describeQuota(jail *Jail) string {
+	description := fmt.Sprintf("%s on %s", formatBytes(jail.QuotaBytes), strings.Join(jail.QuotaDirs, ", "))
+	if len(jail.QuotaDirs) > 0 {
+		if used, err := getQuotaUsage(jail.QuotaDirs[0], quotaProjectID(jail.PID)); err == nil {
+			description += fmt.Sprintf(" (%s used)", formatBytes(used))
+		}
+	}
+	return description
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// alwaysWritablePaths keep device nodes such as /dev/null and terminals usable
+var alwaysWritablePaths = []string{"/dev"}
+
+// applyReadOnlyFilesystem remounts the whole mount tree read-only and bind-mounts the
+// writable paths of the profile back read-write. It must run in a private mount
+// namespace (see startLauncher) so the rest of the host is not affected.
+func applyReadOnlyFilesystem(profile ReadOnlyProfile) error {
+	readOnly := unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}
+	if err := unix.MountSetattr(unix.AT_FDCWD, "/", unix.AT_RECURSIVE, &readOnly); err != nil {
+		return fmt.Errorf("failed to remount filesystem read-only (requires Linux 5.12+): %v", err)
+	}
+
+	writablePaths := append(append([]string{}, alwaysWritablePaths...), profile.Writable...)
+	for _, path := range writablePaths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		// The bind mount inherits the read-only flag, then it is cleared on the new mount only
+		if err := unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind-mount writable path %s: %v", path, err)
+		}
+		readWrite := unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_RDONLY}
+		if err := unix.MountSetattr(unix.AT_FDCWD, path, unix.AT_RECURSIVE, &readWrite); err != nil {
+			return fmt.Errorf("failed to make %s writable: %v", path, err)
+		}
+	}
+
+	return nil
+}
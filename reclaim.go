@@ -0,0 +1,37 @@
+package main
+
+import "fmt"
+
+// reclaimJailMemory makes the kernel reclaim memory of the jail cgroup of a process, e.g.
+// page cache left by a batch job, without lowering a limit the tree would then hit
+func reclaimJailMemory(state *JailerState, pid int, amount uint64) error {
+	jail, exists := state.ActiveJails[pid]
+	if !exists {
+		return fmt.Errorf("process %d is not jailed", pid)
+	}
+	if !jail.HasCgroupJailTypes() {
+		return fmt.Errorf("process %d is in no jail cgroup, its %s jail doesn't use one", pid, jail.GetJailTypesString())
+	}
+	if !jail.usesDedicatedCgroup() {
+		return fmt.Errorf("process %d shares its jail cgroup with the other jails, reclaim only applies to a cgroup of its own", pid)
+	}
+	if amount == 0 {
+		return fmt.Errorf("the amount to reclaim must be positive")
+	}
+
+	before, after, err := state.Limits.reclaimMemory(jail, amount)
+	if err != nil {
+		return err
+	}
+	var reclaimed uint64
+	if after < before {
+		reclaimed = before - after
+	}
+	fmt.Fprintf(state.stdout(), "Reclaimed %s of the %s asked from %s, memory of the jail %s -> %s\n",
+		formatBytes(reclaimed), formatBytes(amount), state.Limits.jailGroup(jail, "memory"), formatBytes(before), formatBytes(after))
+
+	reason := fmt.Sprintf("%s reclaimed of %s asked", formatBytes(reclaimed), formatBytes(amount))
+	writeAuditEvent(state, AuditEvent{Action: "reclaim", JailTypes: jail.JailTypes, Reason: reason,
+		Targets: []AuditTarget{newAuditTarget(pid, jail.Name, nil)}})
+	return nil
+}
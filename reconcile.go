@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultReconcileInterval is the time between two passes of the reconciler
+const defaultReconcileInterval = 30 * time.Second
+
+// DesiredJail is an entry of the desired-state file: a jail type the processes of a
+// selector, a systemd unit or a container must have
+type DesiredJail struct {
+	Name      string   `json:"name"`
+	Selector  string   `json:"selector"`  // Selector of jail ... where, e.g. name=="xmrig"
+	Unit      string   `json:"unit"`      // systemd unit, e.g. backup.service
+	Container string   `json:"container"` // Container ID, at least 12 characters
+	Jail      string   `json:"jail"`
+	Args      []string `json:"args"`
+	Reason    string   `json:"reason"` // Recorded with the jail, the entry name by default
+
+	words []string
+}
+
+// desiredState is the content of the desired-state file
+type desiredState struct {
+	Jails []DesiredJail `json:"jails"`
+}
+
+// reconciledJail is a jail type applied by the reconciler, which only releases its own
+type reconciledJail struct {
+	Entry string // Name of the entry that applied it
+	Args  string // Arguments it was applied with
+}
+
+// reconciler jails the processes of the desired-state file and releases its jails once
+// they are no longer listed
+type reconciler struct {
+	state   *JailerState
+	path    string
+	desired []DesiredJail
+	loaded  bool
+	owned   map[int]map[string]reconciledJail
+}
+
+// loadDesiredState reads and checks the desired-state file
+func loadDesiredState(path string) ([]DesiredJail, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read desired state: %v", err)
+	}
+	var desired desiredState
+	if err := json.Unmarshal(content, &desired); err != nil {
+		return nil, fmt.Errorf("failed to parse desired state %s: %v", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i := range desired.Jails {
+		entry := &desired.Jails[i]
+		if entry.Name == "" {
+			return nil, fmt.Errorf("entry %d has no name", i+1)
+		}
+		if names[entry.Name] {
+			return nil, fmt.Errorf("entry %q is listed twice", entry.Name)
+		}
+		names[entry.Name] = true
+		if err := validateDesiredJail(entry); err != nil {
+			return nil, err
+		}
+	}
+	return desired.Jails, nil
+}
+
+// validateDesiredJail checks the jail type and the target of an entry and compiles its
+// selector
+func validateDesiredJail(entry *DesiredJail) error {
+	jailType, err := normalizeJailSpec(entry.Jail)
+	if err != nil {
+		return fmt.Errorf("entry %q: %v", entry.Name, err)
+	}
+	entry.Jail = jailType
+
+	targets := 0
+	for _, target := range []string{entry.Selector, entry.Unit, entry.Container} {
+		if target != "" {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return fmt.Errorf("entry %q needs one of selector, unit or container", entry.Name)
+	}
+	switch {
+	case entry.Selector != "":
+		commands, err := splitCommands(entry.Selector)
+		if err != nil || len(commands) != 1 {
+			return fmt.Errorf("entry %q: invalid selector %q", entry.Name, entry.Selector)
+		}
+		if _, _, err := compileSelector(commands[0]); err != nil {
+			return fmt.Errorf("entry %q: %v", entry.Name, err)
+		}
+		entry.words = commands[0]
+	case entry.Container != "" && len(entry.Container) < 12:
+		return fmt.Errorf("entry %q: container ID %q is too short", entry.Name, entry.Container)
+	case entry.Unit != "" && strings.ContainsAny(entry.Unit, "/\n"):
+		return fmt.Errorf("entry %q: invalid unit %q", entry.Name, entry.Unit)
+	}
+	return nil
+}
+
+// unitProcesses returns the processes of a systemd unit, found in the cgroup named after it
+func unitProcesses(unit string) []int {
+	return cgroupProcesses(func(cgroup string) bool {
+		for _, line := range strings.Split(cgroup, "\n") {
+			for _, component := range strings.Split(line, "/") {
+				if component == unit {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// desiredJailTargets returns the processes an entry applies to
+func desiredJailTargets(state *JailerState, entry *DesiredJail) ([]int, error) {
+	switch {
+	case entry.Unit != "":
+		return unitProcesses(entry.Unit), nil
+	case entry.Container != "":
+		return containerProcesses(entry.Container), nil
+	}
+	stateMutex.Lock()
+	matches, err := selectProcesses(state, entry.words)
+	stateMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, process := range matches {
+		pids = append(pids, process.PID)
+	}
+	return pids, nil
+}
+
+// targets returns the processes an entry of the desired state applies to
+func (r *reconciler) targets(entry *DesiredJail) []int {
+	pids, err := desiredJailTargets(r.state, entry)
+	if err != nil {
+		fmt.Printf("Warning: reconcile entry %s: %v\n", entry.Name, err)
+	}
+	return pids
+}
+
+// reconcile brings the jails in line with the desired state once. A file that can't be
+// read keeps the previous desired state, a mistake never releases every jail
+func (r *reconciler) reconcile() {
+	desired, err := loadDesiredState(r.path)
+	if err != nil {
+		fmt.Printf("Warning: %v, keeping the previous desired state\n", err)
+		if !r.loaded {
+			return
+		}
+	} else {
+		r.desired, r.loaded = desired, true
+	}
+
+	// The first entry listing a jail type of a process wins
+	wanted := make(map[int]map[string]*DesiredJail)
+	entryTargets := make(map[string][]int)
+	for i := range r.desired {
+		entry := &r.desired[i]
+		entryTargets[entry.Name] = r.targets(entry)
+		for _, pid := range entryTargets[entry.Name] {
+			if wanted[pid] == nil {
+				wanted[pid] = make(map[string]*DesiredJail)
+			}
+			for _, jailType := range expandJailType(entry.Jail) {
+				if _, exists := wanted[pid][jailType]; !exists {
+					wanted[pid][jailType] = entry
+				}
+			}
+		}
+	}
+
+	released := r.release(wanted)
+
+	jailed := 0
+	for i := range r.desired {
+		entry := &r.desired[i]
+		reason := entry.Reason
+		if reason == "" {
+			reason = "desired state entry " + entry.Name
+		}
+		pids, err := jailAutomatically(r.state, "reconcile "+entry.Name, entry.Jail, entryTargets[entry.Name], entry.Args, reason)
+		if err != nil {
+			fmt.Printf("Warning: reconcile entry %s: %v\n", entry.Name, err)
+		}
+		stateMutex.Lock()
+		for _, pid := range pids {
+			jail, exists := r.state.ActiveJails[pid]
+			for _, jailType := range expandJailType(entry.Jail) {
+				if exists && jail.HasJailType(jailType) {
+					if r.owned[pid] == nil {
+						r.owned[pid] = make(map[string]reconciledJail)
+					}
+					r.owned[pid][jailType] = reconciledJail{Entry: entry.Name, Args: strings.Join(entry.Args, " ")}
+					jailed++
+				}
+			}
+		}
+		stateMutex.Unlock()
+	}
+
+	if jailed > 0 || released > 0 {
+		fmt.Printf("Reconciled %s: %d jails applied, %d released\n", r.path, jailed, released)
+	}
+}
+
+// release removes the jail types the reconciler applied that the desired state no longer
+// lists, or lists with other arguments, and returns how many it removed
+func (r *reconciler) release(wanted map[int]map[string]*DesiredJail) int {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	released := 0
+	for pid, jailTypes := range r.owned {
+		for jailType, owned := range jailTypes {
+			jail, exists := r.state.ActiveJails[pid]
+			if !exists || !jail.HasJailType(jailType) {
+				// The process exited or an operator released it
+				delete(jailTypes, jailType)
+				continue
+			}
+			entry := wanted[pid][jailType]
+			if entry != nil && entry.Name == owned.Entry && strings.Join(entry.Args, " ") == owned.Args {
+				continue
+			}
+
+			name := hostProcesses.name(pid)
+			err := unjailProcessSelective(r.state, jailType, strconv.Itoa(pid))
+			writeAuditEvent(r.state, AuditEvent{
+				Action:    "unjail",
+				Operator:  "reconcile " + owned.Entry,
+				JailTypes: []string{jailType},
+				Reason:    "no longer in the desired state",
+				Targets:   []AuditTarget{newAuditTarget(pid, name, err)},
+			})
+			if err != nil {
+				fmt.Printf("Warning: reconcile failed to release %s jail of process %d: %v\n", jailType, pid, err)
+				continue
+			}
+			delete(jailTypes, jailType)
+			released++
+		}
+		if len(jailTypes) == 0 {
+			delete(r.owned, pid)
+		}
+	}
+	if released > 0 {
+		publishInventory(r.state)
+	}
+	return released
+}
+
+// expandJailType returns the jail types applied by a normalized jail type or combination
+func expandJailType(jailType string) []string {
+	specs, _ := parseJailSpecs(jailType, nil)
+	return jailSpecTypes(specs)
+}
+
+// runReconciler reconciles the jails with the desired-state file at every interval, the
+// file is read again each time so that changes apply without restarting jailer
+func runReconciler(state *JailerState, path string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid reconcile interval: %s", interval)
+	}
+	if _, err := loadDesiredState(path); err != nil {
+		return err
+	}
+	r := &reconciler{state: state, path: path, owned: make(map[int]map[string]reconciledJail)}
+	fmt.Printf("Reconciling the jails with %s every %s\n", path, interval)
+	for {
+		r.reconcile()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// redetectingFirewall is set while the rules move to another backend, the failures then
+// don't trigger another detection
+var redetectingFirewall bool
+
+// redetectFirewall detects the firewall backend again, for hosts where nftables was
+// installed or removed or the iptables alternatives switched while jailer runs. When it
+// changed the rules of jailer move to the new backend: the shared network jail rules, the
+// proxy and blocklist rules and the rules of the jails filtered by their own cgroup or
+// classid. The sessions kept open and the allowlists are dropped
+func redetectFirewall(state *JailerState) error {
+	previous, tool := state.FirewallTool, probeFirewallTool()
+	if tool == previous {
+		fmt.Fprintf(state.stdout(), "Firewall backend unchanged: %s\n", describeFirewallTool(tool))
+		return nil
+	}
+	fmt.Fprintf(state.stdout(), "Firewall backend changed from %s to %s, moving the jail rules\n", describeFirewallTool(previous), describeFirewallTool(tool))
+	redetectingFirewall = true
+	defer func() { redetectingFirewall = false }()
+
+	// Removed with the previous backend, its tool may be gone already so failures are
+	// only reported
+	var pids []int
+	options := make(map[int]JailOptions)
+	for pid, jail := range state.ActiveJails {
+		if !jail.HasJailType("network") {
+			continue
+		}
+		releaseEstablishedSessions(state, jail)
+		releaseAllowlist(state, jail)
+		switch {
+		case jail.ClassID != "" || jail.NetworkCgroup != "":
+			options[pid] = JailOptions{AllowIfaces: jail.AllowedIfaces, BlockCountries: jail.BlockedCountries, AllowCountries: jail.AllowedCountries}
+			releaseCountryRules(state, jail)
+			deleteFirewallRules(state, append(append(jail.BlocklistRules, jail.IfaceRules...), jail.DropRules...))
+			jail.BlocklistRules, jail.IfaceRules, jail.AllowedIfaces, jail.DropRules = nil, nil, nil, nil
+			pids = append(pids, pid)
+		case jail.NetNamespace != "":
+			fmt.Fprintf(state.stdout(), "Warning: the rules of process %d stay in the network namespace of its container, re-jail it to move them\n", pid)
+		}
+	}
+	if previous != "" {
+		cleanupBlocklists(state)
+		if err := state.Firewall.cleanup(); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: failed to remove the rules of %s: %v\n", previous, err)
+		}
+		if state.Config.NetworkProxy != "" {
+			cleanupProxyJail(state)
+		}
+	}
+
+	// The jail types disabled by the previous backend may work with the new one
+	state.FirewallTool = tool
+	delete(state.SetupFailures, "network")
+	delete(state.SetupFailures, "proxy")
+	checkCapabilities(state)
+	if err := checkJailTypeEnabled(state, "network"); err != nil {
+		if len(options) > 0 {
+			return fmt.Errorf("the network jails of %d processes are no longer enforced: %v", len(options), err)
+		}
+		return nil
+	}
+
+	fmt.Fprintln(state.stdout(), "Setting up network filtering rules...")
+	if err := state.Firewall.setup(); err != nil {
+		disableJailType(state, "network", err)
+		disableJailType(state, "proxy", err)
+		return err
+	}
+	if state.Config.NetworkProxy != "" {
+		if err := setupProxyJail(state); err != nil {
+			disableJailType(state, "proxy", err)
+		}
+	}
+	if blocklistsEnabled(state) {
+		networks4, networks6, statuses := downloadBlocklistFeeds(state.Config.Blocklists, time.Now())
+		if err := loadBlocklistSets(state, networks4, networks6, statuses); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: failed to load the blocklist feeds: %v\n", err)
+		} else if err := addBlocklistRules(state); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: %v\n", err)
+		}
+	}
+
+	// The jails keep their cgroup or net_cls cgroup, only the rules matching it are added
+	sort.Ints(pids)
+	var failed []int
+	for _, pid := range pids {
+		jail := state.ActiveJails[pid]
+		jail.ClassID, jail.NetworkCgroup = "", ""
+		if err := setupJailNetworkRules(state, jail, options[pid]); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: %v\n", err)
+			failed = append(failed, pid)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("the rules of the network jails of processes %v couldn't be moved to %s", failed, tool)
+	}
+	fmt.Fprintf(state.stdout(), "Firewall rules moved to %s\n", tool)
+	return nil
+}
+
+// checkFirewallBackend detects the firewall backend again after a rule failed to install
+// and moves the rules when it changed, the command then has to be run again
+func checkFirewallBackend(state *JailerState, err error) error {
+	if redetectingFirewall || probeFirewallTool() == state.FirewallTool {
+		return err
+	}
+	previous := state.FirewallTool
+	if redetectErr := redetectFirewall(state); redetectErr != nil {
+		return fmt.Errorf("%v\nThe firewall backend changed from %s, moving the rules failed: %v", err, describeFirewallTool(previous), redetectErr)
+	}
+	return fmt.Errorf("%v\nThe firewall backend changed from %s to %s and the rules were moved, run the command again",
+		err, describeFirewallTool(previous), describeFirewallTool(state.FirewallTool))
+}
+
+// describeFirewallTool names a firewall backend for the messages
+func describeFirewallTool(tool string) string {
+	if tool == "" {
+		return "none"
+	}
+	return tool
+}
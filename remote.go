@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	remoteHandshakeTimeout = 10 * time.Second
+	remoteDialTimeout      = 10 * time.Second
+	remoteStatusInterval   = 10 * time.Second
+	remoteCommandTimeout   = 5 * time.Minute
+
+	// remoteControllerUnit is the organizational unit of the controller certificates, agents
+	// and controllers share the CA and only a controller may send commands
+	remoteControllerUnit = "jailer-controller"
+)
+
+// remoteMessage is a message exchanged between agents and the controller, sent as one
+// JSON object per line
+type remoteMessage struct {
+	Type     string `json:"type"` // hello, auth, command, result or status
+	Role     string `json:"role,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	ID       int    `json:"id,omitempty"`
+	Command  string `json:"command,omitempty"`
+	Operator string `json:"operator,omitempty"` // Who typed the command on the controller
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Jails    int    `json:"jails"`
+}
+
+// remoteConn is a connection between an agent and the controller
+type remoteConn struct {
+	conn      net.Conn
+	decoder   *json.Decoder
+	encoder   *json.Encoder
+	sendMutex sync.Mutex
+}
+
+// newRemoteConn wraps a network connection to exchange remote messages
+func newRemoteConn(conn net.Conn) *remoteConn {
+	return &remoteConn{
+		conn:    conn,
+		decoder: json.NewDecoder(conn),
+		encoder: json.NewEncoder(conn),
+	}
+}
+
+// send writes a message, messages can be sent from several goroutines
+func (c *remoteConn) send(message remoteMessage) error {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	return c.encoder.Encode(message)
+}
+
+// receive reads the next message
+func (c *remoteConn) receive() (remoteMessage, error) {
+	var message remoteMessage
+	err := c.decoder.Decode(&message)
+	return message, err
+}
+
+// peerName returns the common name of the certificate of the peer, or its address
+func (c *remoteConn) peerName() string {
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		if certificates := tlsConn.ConnectionState().PeerCertificates; len(certificates) > 0 && certificates[0].Subject.CommonName != "" {
+			return certificates[0].Subject.CommonName
+		}
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+// peerIsController tells whether the certificate of the peer is a controller certificate
+func (c *remoteConn) peerIsController() bool {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	return len(certificates) > 0 && slices.Contains(certificates[0].Subject.OrganizationalUnit, remoteControllerUnit)
+}
+
+// close closes the underlying connection
+func (c *remoteConn) close() {
+	c.conn.Close()
+}
+
+// remoteMAC proves the knowledge of the shared token for a nonce of the peer, the role
+// of the sender keeps a MAC from being reflected to the other side
+func remoteMAC(token, role, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(role + ":" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// handshake authenticates both ends of the connection with the shared token and returns
+// the hello message of the peer. A peer can only be a controller with a controller
+// certificate, the token and the CA are shared with the agents
+func (c *remoteConn) handshake(role, host, token string) (remoteMessage, error) {
+	if token == "" {
+		return remoteMessage{}, fmt.Errorf("remote_token must be set in the configuration")
+	}
+
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return remoteMessage{}, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+
+	c.conn.SetDeadline(time.Now().Add(remoteHandshakeTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if err := c.send(remoteMessage{Type: "hello", Role: role, Host: host, Nonce: nonce}); err != nil {
+		return remoteMessage{}, fmt.Errorf("failed to send hello: %v", err)
+	}
+	peer, err := c.receive()
+	if err != nil {
+		return remoteMessage{}, fmt.Errorf("failed to read hello: %v", err)
+	}
+	if peer.Type != "hello" || peer.Nonce == "" || peer.Role == role || (peer.Role != "agent" && peer.Role != "controller") {
+		return remoteMessage{}, fmt.Errorf("unexpected hello from %s", c.conn.RemoteAddr())
+	}
+	if peer.Role == "controller" && !c.peerIsController() {
+		return remoteMessage{}, fmt.Errorf("%s is not a controller, its certificate lacks the %s organizational unit",
+			c.peerName(), remoteControllerUnit)
+	}
+
+	if err := c.send(remoteMessage{Type: "auth", MAC: remoteMAC(token, role, peer.Nonce)}); err != nil {
+		return remoteMessage{}, fmt.Errorf("failed to send authentication: %v", err)
+	}
+	auth, err := c.receive()
+	if err != nil {
+		return remoteMessage{}, fmt.Errorf("failed to read authentication: %v", err)
+	}
+	expected := remoteMAC(token, peer.Role, nonce)
+	if auth.Type != "auth" || !hmac.Equal([]byte(auth.MAC), []byte(expected)) {
+		return remoteMessage{}, fmt.Errorf("authentication of %s failed", c.conn.RemoteAddr())
+	}
+
+	return peer, nil
+}
+
+// remoteTLSConfig returns the mutual TLS configuration of the remote connections, both
+// ends must present a certificate signed by the CA since a peer can jail any process
+func remoteTLSConfig(config *Config) (*tls.Config, error) {
+	if config.RemoteTLSCert == "" || config.RemoteTLSKey == "" || config.RemoteTLSCA == "" {
+		return nil, fmt.Errorf("remote connections require mutual TLS: remote_tls_cert, remote_tls_key and remote_tls_ca must be set in the configuration")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(config.RemoteTLSCert, config.RemoteTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	content, err := os.ReadFile(config.RemoteTLSCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificate found in TLS CA %s", config.RemoteTLSCA)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// tlsReloader loads the TLS files again when they change, so that rotated certificates
+// are used by the next connections without a restart
+type tlsReloader struct {
+	config   *Config
+	mutex    sync.Mutex
+	modTimes []time.Time
+	current  *tls.Config
+}
+
+// get returns the TLS configuration of the current files, the previous configuration is
+// kept when the new files can't be loaded, e.g. while they are being replaced
+func (r *tlsReloader) get() (*tls.Config, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var modTimes []time.Time
+	for _, path := range []string{r.config.RemoteTLSCert, r.config.RemoteTLSKey, r.config.RemoteTLSCA} {
+		var modTime time.Time
+		if info, err := os.Stat(path); err == nil {
+			modTime = info.ModTime()
+		}
+		modTimes = append(modTimes, modTime)
+	}
+	if r.current != nil && slices.Equal(modTimes, r.modTimes) {
+		return r.current, nil
+	}
+
+	tlsConfig, err := remoteTLSConfig(r.config)
+	if err != nil {
+		if r.current == nil {
+			return nil, err
+		}
+		fmt.Printf("Warning: keeping the previous TLS certificate: %v\n", err)
+		return r.current, nil
+	}
+	if r.current != nil {
+		fmt.Println("Reloaded the TLS certificate of the remote connections")
+	}
+	r.current = tlsConfig
+	r.modTimes = modTimes
+	return tlsConfig, nil
+}
+
+// remoteListen listens for remote connections over mutual TLS, the certificate files are
+// checked for rotation on every connection
+func remoteListen(config *Config, addr string) (net.Listener, error) {
+	reloader := &tlsReloader{config: config}
+	if _, err := reloader.get(); err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", addr, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return reloader.get()
+		},
+	})
+}
+
+// remoteDial connects to a remote agent or controller over mutual TLS, the certificate
+// files are read on every connection
+func remoteDial(config *Config, addr string) (net.Conn, error) {
+	tlsConfig, err := remoteTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		tlsConfig.ServerName = host
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: remoteDialTimeout}, "tcp", addr, tlsConfig)
+}
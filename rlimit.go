@@ -0,0 +1,66 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// rlimitResources maps the user-facing resource names to their RLIMIT_* constants
+var rlimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// applyRlimits sets the resource limits on a live process using prlimit64 and returns
+// the previous values so they can be restored later
+func applyRlimits(pid int, limits map[string]uint64) (map[string]unix.Rlimit, error) {
+	saved := make(map[string]unix.Rlimit)
+
+	for name, limit := range limits {
+		resource := rlimitResources[name]
+
+		// Both soft and hard limits are lowered so the process can't raise them back
+		newLimit := unix.Rlimit{Cur: limit, Max: limit}
+		var oldLimit unix.Rlimit
+		if err := unix.Prlimit(pid, resource, &newLimit, &oldLimit); err != nil {
+			// Roll back what was already changed so the process is left untouched
+			restoreRlimits(pid, saved)
+			return nil, fmt.Errorf("failed to set %s limit for PID %d: %v", name, pid, err)
+		}
+		saved[name] = oldLimit
+	}
+
+	return saved, nil
+}
+
+// restoreRlimits restores the resource limits saved by applyRlimits
+func restoreRlimits(pid int, saved map[string]unix.Rlimit) error {
+	var failed []string
+
+	for name, oldLimit := range saved {
+		limit := oldLimit
+		if err := unix.Prlimit(pid, rlimitResources[name], &limit, nil); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to restore limits for PID %d (%s)", pid, strings.Join(failed, "; "))
+	}
+	return nil
+}
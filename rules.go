@@ -0,0 +1,116 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// installedJailRules returns the jail rules installed in the firewall, the jail table for
+// nftables and the cgroup rules of the INPUT and OUTPUT chains for iptables
+func installedJailRules(state *JailerState) (string, error) {
+	if state.FirewallTool == "nftables" {
+		output, err := runFirewallCommand("nft", "list", "table", "inet", "jail")
+		if err != nil {
+			return "", fmt.Errorf("no jail table installed: %v\nOutput: %s", err, string(output))
+		}
+		return "# Installed by jailer, listed by nft list table inet jail\n" + string(output), nil
+	}
+
+	var builder strings.Builder
+	builder.WriteString("# Installed by jailer, listed by iptables -S\n")
+	for _, chain := range []string{"OUTPUT", "INPUT"} {
+		output, err := runFirewallCommand("iptables", "-S", chain)
+		if err != nil {
+			return "", fmt.Errorf("failed to list iptables %s chain: %v\nOutput: %s", chain, err, string(output))
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			if strings.Contains(line, "-m cgroup") {
+				builder.WriteString(line + "\n")
+			}
+		}
+	}
+	return builder.String(), nil
+}
+
+// generatedJailRules returns the rules jailer installs for jail types, whether they are
+// installed or not: an nft -f script for nftables and iptables commands otherwise
+func generatedJailRules(state *JailerState, jailTypes []string) (string, error) {
+	var builder strings.Builder
+	if state.FirewallTool == "nftables" {
+		builder.WriteString("#!/usr/sbin/nft -f\n")
+	}
+	for _, jailType := range jailTypes {
+		var commands [][]string
+		switch normalizeJailType(jailType) {
+		case "network":
+			commands = networkJailCommands(state)
+		case "proxy":
+			var err error
+			if commands, err = proxyJailRules(state, "-A"); err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("%s jails install no firewall rules, only network and proxy jails do", jailType)
+		}
+
+		fmt.Fprintf(&builder, "# %s jails (%s, cgroups v%d)\n", normalizeJailType(jailType), state.FirewallTool, state.CgroupVersion)
+		for _, args := range commands {
+			if state.FirewallTool == "nftables" {
+				// nft -f reads the arguments of the nft commands
+				builder.WriteString(strings.Join(args[1:], " ") + "\n")
+			} else {
+				builder.WriteString(quoteCommand(args) + "\n")
+			}
+		}
+	}
+	return builder.String(), nil
+}
+
+// exportRules prints the firewall rules of the jails, or writes them to a file. Without
+// jail types, the rules installed by jailer, otherwise the rules of these jail types
+func exportRules(state *JailerState, jailTypes []string, path string) error {
+	if state.FirewallTool == "" {
+		return fmt.Errorf("no firewall tool available, network jails are disabled")
+	}
+
+	var rules string
+	var err error
+	if len(jailTypes) == 0 {
+		rules, err = installedJailRules(state)
+	} else {
+		rules, err = generatedJailRules(state, jailTypes)
+	}
+	if err != nil {
+		return err
+	}
+
+	if path == "" {
+		fmt.Fprint(state.stdout(), rules)
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	fmt.Fprintf(state.stdout(), "Exported the %s jail rules to %s\n", state.FirewallTool, path)
+	return nil
+}
+
+// writeJailRuleset writes the jail table to the rules file. Loading it replaces the jail
+// table, and removes it once jailer released every jail
+func writeJailRuleset(state *JailerState) {
+	path := state.Config.Persist.RulesFile
+	if path == "" || state.FirewallTool != "nftables" {
+		return
+	}
+	content := "# Written by jailer, include it from /etc/nftables.conf to keep the jail rules\n" +
+		"table inet jail\ndelete table inet jail\n"
+	if listing, err := runFirewallCommand("nft", "list", "table", "inet", "jail"); err == nil {
+		content += string(listing)
+	}
+	if err := writeAtomically(path, []byte(content), 0644); err != nil {
+		fmt.Printf("Warning: failed to write jail rules to %s: %v\n", path, err)
+	}
+}
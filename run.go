@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultLaunchProfiles are used when a launch-only jail type is given without a profile
+var defaultLaunchProfiles = map[string]string{
+	"syscall":  "no-network",
+	"landlock": "system-readonly",
+	"readonly": "tmp-writable",
+}
+
+// runJailSpec is the parsed jail specification of the run command
+type runJailSpec struct {
+	JailTypes      []string            // Jail types applied by PID once the launcher is started
+	JailArgs       map[string][]string // Arguments of those jail types
+	LaunchProfiles map[string]string   // Profiles of the launch-only jail types
+	Launch         LaunchSpec
+}
+
+// parseRunJailSpec parses a specification such as "network,cpu=5%,syscall=no-network"
+func parseRunJailSpec(state *JailerState, specStr string) (*runJailSpec, error) {
+	spec := &runJailSpec{
+		JailArgs:       make(map[string][]string),
+		LaunchProfiles: make(map[string]string),
+	}
+
+	for _, item := range strings.Split(specStr, ",") {
+		name, value, hasValue := strings.Cut(item, "=")
+		jailType := normalizeJailType(strings.ToLower(name))
+
+		if spec.has(jailType) {
+			return nil, fmt.Errorf("jail type %s given twice", jailType)
+		}
+		if err := checkJailTypeEnabled(state, jailType); err != nil {
+			return nil, err
+		}
+
+		switch jailType {
+		case "network", "proxy", "oom", "coredump":
+			if hasValue {
+				return nil, fmt.Errorf("%s jail does not take a value", jailType)
+			}
+			spec.JailTypes = append(spec.JailTypes, jailType)
+		case "cpu":
+			spec.JailTypes = append(spec.JailTypes, jailType)
+			if hasValue {
+				spec.JailArgs[jailType] = []string{value}
+			}
+		case "syscall", "landlock", "readonly":
+			profileName := defaultLaunchProfiles[jailType]
+			if hasValue {
+				profileName = value
+			}
+			if err := spec.setLaunchProfile(state, jailType, profileName); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported jail type for run: %s (supported: network, proxy, cpu, oom, coredump, syscall, landlock, readonly)", jailType)
+		}
+	}
+
+	return spec, nil
+}
+
+// has checks if the specification already contains a jail type
+func (s *runJailSpec) has(jailType string) bool {
+	if _, exists := s.LaunchProfiles[jailType]; exists {
+		return true
+	}
+	for _, t := range s.JailTypes {
+		if t == jailType {
+			return true
+		}
+	}
+	return false
+}
+
+// setLaunchProfile resolves the profile of a launch-only jail type from the configuration
+func (s *runJailSpec) setLaunchProfile(state *JailerState, jailType, profileName string) error {
+	switch jailType {
+	case "syscall":
+		profile, exists := state.Config.SeccompProfiles[profileName]
+		if !exists {
+			return fmt.Errorf("unknown seccomp profile: %s", profileName)
+		}
+		s.Launch.Seccomp = &profile
+	case "landlock":
+		profile, exists := state.Config.LandlockProfiles[profileName]
+		if !exists {
+			return fmt.Errorf("unknown landlock profile: %s", profileName)
+		}
+		s.Launch.Landlock = &profile
+	case "readonly":
+		profile, exists := state.Config.ReadOnlyProfiles[profileName]
+		if !exists {
+			return fmt.Errorf("unknown readonly profile: %s", profileName)
+		}
+		s.Launch.ReadOnly = &profile
+	}
+
+	s.LaunchProfiles[jailType] = profileName
+	return nil
+}
+
+// runJailedCommand starts a command and puts it in the requested jails before it runs any
+// code, avoiding the race of jailing an already running process by PID
+func runJailedCommand(state *JailerState, specStr string, command []string, options JailOptions) error {
+	if len(command) == 0 {
+		return fmt.Errorf("usage: run <type>[=<option>][,<type>...] -- <command> [args...]")
+	}
+
+	spec, err := parseRunJailSpec(state, specStr)
+	if err != nil {
+		return err
+	}
+	spec.Launch.Path = command[0]
+	spec.Launch.Args = command
+
+	// The output goes to a log file so it doesn't mix with the prompt
+	logFile, err := os.CreateTemp("", "jailer-run-*.log")
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %v", err)
+	}
+	defer logFile.Close()
+
+	cmd, release, err := startLauncher(&spec.Launch, nil, logFile, logFile)
+	if err != nil {
+		os.Remove(logFile.Name())
+		return err
+	}
+	pid := cmd.Process.Pid
+	pidStr := strconv.Itoa(pid)
+
+	// Reap the process when it exits, dead jails are cleaned up by list
+	go cmd.Wait()
+
+	// Jail the launcher while it waits, everything is inherited by the command
+	for _, jailType := range spec.JailTypes {
+		if err := jailProcess(state, jailType, pidStr, spec.JailArgs[jailType], options); err != nil {
+			release.Close()
+			if _, exists := state.ActiveJails[pid]; exists {
+				unjailProcess(state, pidStr)
+			}
+			return fmt.Errorf("failed to apply %s jail, command not started: %v", jailType, err)
+		}
+	}
+
+	// Record the jails enforced by the launcher itself
+	jail, existed := state.ActiveJails[pid]
+	if !existed {
+		originalCgroup, err := state.Limits.processGroup(pid)
+		if err != nil {
+			release.Close()
+			return fmt.Errorf("failed to get original cgroup for PID %d: %v", pid, err)
+		}
+		jail = newJail(pid, originalCgroup)
+		jail.JailedBy = state.Operator
+		state.ActiveJails[pid] = jail
+	}
+	for _, jailType := range []string{"syscall", "landlock", "readonly"} {
+		if profileName, exists := spec.LaunchProfiles[jailType]; exists {
+			jail.AddJailType(jailType)
+			jail.LaunchProfiles[jailType] = profileName
+		}
+	}
+	jail.Command = command
+	if options.Reason != "" {
+		jail.Reason = options.Reason
+	}
+	if options.Persistent {
+		jail.Persistent = true
+	}
+	if options.For > 0 {
+		jail.ExpiresAt = time.Now().Add(options.For)
+	}
+
+	if err := releaseLauncher(release); err != nil {
+		return err
+	}
+	if existed {
+		publishJailEvent("updated", jail, "started "+strings.Join(command, " "))
+	} else {
+		publishJailEvent("created", jail, "")
+	}
+
+	writeAuditEvent(state, AuditEvent{
+		Action:    "run",
+		JailTypes: jail.JailTypes,
+		Reason:    jail.Reason,
+		Targets:   []AuditTarget{newAuditTarget(pid, filepath.Base(command[0]), nil)},
+	})
+
+	fmt.Fprintf(state.stdout(), "Started %s as PID %d with %s jail, output in %s\n",
+		strings.Join(command, " "), pid, jail.GetJailTypesString(), logFile.Name())
+	return nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scheduleCheckInterval = 30 * time.Second // Time between two checks of the jail windows
+	scheduleMaxRetryDelay = time.Hour        // Longest delay before a failed scheduled jail is tried again
+)
+
+// timeWindow is a daily time range, it spans midnight when the end is before the start.
+// With days it only starts on those days
+type timeWindow struct {
+	Start int            `json:"start"` // Minutes since midnight
+	End   int            `json:"end"`
+	Days  []time.Weekday `json:"days,omitempty"`
+}
+
+// weekdayNames are the names of the days of the schedules, indexed by time.Weekday
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseWeekdays parses day names such as sat or Saturday
+func parseWeekdays(names []string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, name := range names {
+		lower := strings.ToLower(strings.TrimSpace(name))
+		day := -1
+		for i, short := range weekdayNames {
+			if lower == short || lower == strings.ToLower(time.Weekday(i).String()) {
+				day = i
+			}
+		}
+		if day < 0 {
+			return nil, fmt.Errorf("invalid day %q", name)
+		}
+		days = append(days, time.Weekday(day))
+	}
+	return days, nil
+}
+
+// parseClock parses a time of day such as 09:00 into minutes since midnight, 24:00 is
+// the end of the day
+func parseClock(text string) (int, error) {
+	hours, minutes, found := strings.Cut(text, ":")
+	h, err := strconv.Atoi(hours)
+	if err != nil || !found || len(minutes) != 2 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", text)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", text)
+	}
+	return h*60 + m, nil
+}
+
+// parseTimeWindow parses a daily window such as 09:00-18:00 or 22:00-06:00
+func parseTimeWindow(text string) (timeWindow, error) {
+	start, end, found := strings.Cut(text, "-")
+	if !found {
+		return timeWindow{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", text)
+	}
+	var window timeWindow
+	var err error
+	if window.Start, err = parseClock(strings.TrimSpace(start)); err != nil {
+		return timeWindow{}, err
+	}
+	if window.End, err = parseClock(strings.TrimSpace(end)); err != nil {
+		return timeWindow{}, err
+	}
+	if window.Start == 24*60 {
+		return timeWindow{}, fmt.Errorf("window %q starts at the end of the day", text)
+	}
+	if window.Start == window.End {
+		return timeWindow{}, fmt.Errorf("window %q is empty", text)
+	}
+	return window, nil
+}
+
+// startsOn checks if the window starts on a day
+func (w timeWindow) startsOn(day time.Weekday) bool {
+	return len(w.Days) == 0 || slices.Contains(w.Days, day)
+}
+
+// contains checks if a time falls within the window, in the local time zone. A window
+// spanning midnight ends on the day after the one it started on
+func (w timeWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return minute >= w.Start && minute < w.End && w.startsOn(t.Weekday())
+	}
+	yesterday := (t.Weekday() + 6) % 7
+	return (minute >= w.Start && w.startsOn(t.Weekday())) || (minute < w.End && w.startsOn(yesterday))
+}
+
+// String returns the window as given to --between, after its days
+func (w timeWindow) String() string {
+	clock := fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+	if len(w.Days) == 0 {
+		return clock
+	}
+	var days []string
+	for _, day := range w.Days {
+		days = append(days, weekdayNames[day])
+	}
+	return strings.Join(days, ",") + " " + clock
+}
+
+// jailSchedule is a jail type applied to a process only within a daily window, the
+// scheduler applies and removes it as the window opens and closes
+type jailSchedule struct {
+	PID      int         `json:"pid"`
+	JailType string      `json:"jail_type"`
+	Args     []string    `json:"args,omitempty"`
+	Options  JailOptions `json:"options"`
+	Window   timeWindow  `json:"window"`
+	Operator string      `json:"operator"`           // Who scheduled the jail, recorded in the jails it applies
+	Failures int         `json:"failures,omitempty"` // Failed attempts in a row to apply or remove the jail
+	Error    string      `json:"error,omitempty"`    // Error of the last failed attempt
+	RetryAt  time.Time   `json:"-"`                  // The jail isn't tried again before, after a failure
+}
+
+// retryDelay returns the delay before a failing scheduled jail is tried again, doubled at
+// every failure
+func (s *jailSchedule) retryDelay() time.Duration {
+	delay := scheduleCheckInterval
+	for i := 1; i < s.Failures && delay < scheduleMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, scheduleMaxRetryDelay)
+}
+
+// scheduleJails registers the jail types of processes applied within a window, and applies
+// the ones whose window is open
+func scheduleJails(state *JailerState, specs []jailSpec, pids []int, options JailOptions, window timeWindow) error {
+	for _, spec := range specs {
+		if isLaunchOnlyJailType(spec.Type) {
+			return fmt.Errorf("%s jails can't be scheduled", spec.Type)
+		}
+		if err := checkJailTypeEnabled(state, spec.Type); err != nil {
+			return err
+		}
+	}
+	for _, pid := range pids {
+		if !hostProcesses.exists(pid) {
+			return fmt.Errorf("process %d does not exist", pid)
+		}
+	}
+
+	for _, pid := range pids {
+		for _, spec := range specs {
+			dropJailSchedules(state, pid, spec.Type)
+			state.Schedules = append(state.Schedules, &jailSchedule{
+				PID: pid, JailType: spec.Type, Args: spec.Args, Options: options, Window: window, Operator: state.Operator,
+			})
+			fmt.Fprintf(state.stdout(), "Scheduled %s jail of process %d (%s) between %s\n", spec.Type, pid, hostProcesses.name(pid), window)
+		}
+	}
+	applySchedules(state, time.Now())
+	return nil
+}
+
+// dropJailSchedules removes the schedules of a jail type of a process, of every type when
+// jailType is empty
+func dropJailSchedules(state *JailerState, pid int, jailType string) {
+	kept := state.Schedules[:0]
+	for _, schedule := range state.Schedules {
+		if schedule.PID != pid || (jailType != "" && schedule.JailType != jailType) {
+			kept = append(kept, schedule)
+		}
+	}
+	state.Schedules = kept
+}
+
+// applySchedules applies the scheduled jails whose window is open and removes the others,
+// the schedules of the processes that exited are dropped. A failing jail is tried again
+// with a growing delay, it is only reported and audited again when its error changes. It
+// returns true when a jail changed
+func applySchedules(state *JailerState, now time.Time) bool {
+	changed := false
+	kept := state.Schedules[:0]
+	for _, schedule := range state.Schedules {
+		if !hostProcesses.exists(schedule.PID) {
+			fmt.Printf("Dropping the %s jail schedule of process %d, it exited\n", schedule.JailType, schedule.PID)
+			continue
+		}
+		kept = append(kept, schedule)
+
+		jail, jailed := state.ActiveJails[schedule.PID]
+		active := jailed && jail.HasJailType(schedule.JailType)
+		open := schedule.Window.contains(now)
+		if open == active {
+			schedule.Failures, schedule.Error, schedule.RetryAt = 0, "", time.Time{}
+			continue
+		}
+		if now.Before(schedule.RetryAt) {
+			continue
+		}
+
+		pidStr := strconv.Itoa(schedule.PID)
+		name := hostProcesses.name(schedule.PID)
+		event := AuditEvent{Operator: "schedule " + schedule.Window.String(), JailTypes: []string{schedule.JailType}, Reason: schedule.Options.Reason}
+		var err error
+		if open {
+			if schedule.Failures == 0 {
+				fmt.Printf("Window %s opened, applying %s jail to process %d (%s)\n", schedule.Window, schedule.JailType, schedule.PID, name)
+			}
+			operator := state.Operator
+			state.Operator = schedule.Operator
+			err = jailProcess(state, schedule.JailType, pidStr, schedule.Args, schedule.Options)
+			state.Operator = operator
+			event.Action = "jail"
+		} else {
+			if schedule.Failures == 0 {
+				fmt.Printf("Window %s closed, removing %s jail from process %d (%s)\n", schedule.Window, schedule.JailType, schedule.PID, name)
+			}
+			err = unjailProcessSelective(state, schedule.JailType, pidStr)
+			event.Action = "unjail"
+		}
+		repeated := err != nil && err.Error() == schedule.Error
+		if !repeated {
+			event.Targets = []AuditTarget{newAuditTarget(schedule.PID, name, err)}
+			writeAuditEvent(state, event)
+		}
+		if err != nil {
+			schedule.Failures++
+			schedule.Error = err.Error()
+			schedule.RetryAt = now.Add(schedule.retryDelay())
+			if !repeated {
+				fmt.Printf("Warning: scheduled %s jail of process %d: %v, retrying in %s\n", schedule.JailType, schedule.PID, err, schedule.retryDelay())
+			}
+			continue
+		}
+		schedule.Failures, schedule.Error, schedule.RetryAt = 0, "", time.Time{}
+		changed = true
+	}
+	state.Schedules = kept
+	return changed
+}
+
+// ScheduledJail is a recurring schedule of the configuration: a jail the processes of a
+// selector, a systemd unit or a container get within a window, e.g. every Saturday from
+// 02:00 to 06:00
+type ScheduledJail struct {
+	DesiredJail
+	Days   []string `json:"days"`   // e.g. ["sat", "sun"], every day when empty
+	Window string   `json:"window"` // e.g. 02:00-06:00
+
+	window timeWindow
+}
+
+// validateScheduledJails checks the schedules of the configuration and parses their windows
+func validateScheduledJails(schedules []ScheduledJail) error {
+	names := make(map[string]bool)
+	for i := range schedules {
+		schedule := &schedules[i]
+		if schedule.Name == "" {
+			return fmt.Errorf("schedule %d has no name", i+1)
+		}
+		if names[schedule.Name] {
+			return fmt.Errorf("schedule %q is listed twice", schedule.Name)
+		}
+		names[schedule.Name] = true
+		if err := validateDesiredJail(&schedule.DesiredJail); err != nil {
+			return err
+		}
+		window, err := parseTimeWindow(schedule.Window)
+		if err != nil {
+			return fmt.Errorf("entry %q: %v", schedule.Name, err)
+		}
+		if window.Days, err = parseWeekdays(schedule.Days); err != nil {
+			return fmt.Errorf("entry %q: %v", schedule.Name, err)
+		}
+		schedule.window = window
+	}
+	return nil
+}
+
+// profileScheduler applies the schedules of the configuration within their windows, and
+// only releases the jails it applied once they close
+type profileScheduler struct {
+	state     *JailerState
+	schedules []ScheduledJail
+	owned     map[int]map[string]string // Schedule that applied each jail type of a process
+}
+
+// newProfileScheduler creates the scheduler of the schedules of the configuration
+func newProfileScheduler(state *JailerState) *profileScheduler {
+	return &profileScheduler{state: state, schedules: state.Config.Schedules, owned: make(map[int]map[string]string)}
+}
+
+// check releases the jails of the closed windows and jails the targets of the open ones,
+// the processes started within a window are jailed at the next check
+func (s *profileScheduler) check(now time.Time) {
+	open := make(map[string]bool)
+	for _, schedule := range s.schedules {
+		open[schedule.Name] = schedule.window.contains(now)
+	}
+
+	stateMutex.Lock()
+	released := 0
+	for pid, jailTypes := range s.owned {
+		for jailType, name := range jailTypes {
+			jail, exists := s.state.ActiveJails[pid]
+			if !exists || !jail.HasJailType(jailType) {
+				// The process exited or an operator released it
+				delete(jailTypes, jailType)
+				continue
+			}
+			if open[name] {
+				continue
+			}
+			processName := hostProcesses.name(pid)
+			err := unjailProcessSelective(s.state, jailType, strconv.Itoa(pid))
+			writeAuditEvent(s.state, AuditEvent{
+				Action:    "unjail",
+				Operator:  "schedule " + name,
+				JailTypes: []string{jailType},
+				Reason:    "schedule window closed",
+				Targets:   []AuditTarget{newAuditTarget(pid, processName, err)},
+			})
+			if err != nil {
+				fmt.Printf("Warning: schedule %s failed to release %s jail of process %d: %v\n", name, jailType, pid, err)
+				continue
+			}
+			delete(jailTypes, jailType)
+			released++
+		}
+		if len(jailTypes) == 0 {
+			delete(s.owned, pid)
+		}
+	}
+	if released > 0 {
+		publishInventory(s.state)
+	}
+	stateMutex.Unlock()
+
+	for i := range s.schedules {
+		schedule := &s.schedules[i]
+		if !open[schedule.Name] {
+			continue
+		}
+		targets, err := desiredJailTargets(s.state, &schedule.DesiredJail)
+		if err != nil {
+			fmt.Printf("Warning: schedule %s: %v\n", schedule.Name, err)
+			continue
+		}
+		reason := schedule.Reason
+		if reason == "" {
+			reason = "schedule " + schedule.Name
+		}
+		pids, err := jailAutomatically(s.state, "schedule "+schedule.Name, schedule.Jail, targets, schedule.Args, reason)
+		if err != nil {
+			fmt.Printf("Warning: schedule %s: %v\n", schedule.Name, err)
+		}
+		stateMutex.Lock()
+		for _, pid := range pids {
+			jail, exists := s.state.ActiveJails[pid]
+			for _, jailType := range expandJailType(schedule.Jail) {
+				if exists && jail.HasJailType(jailType) {
+					if s.owned[pid] == nil {
+						s.owned[pid] = make(map[string]string)
+					}
+					s.owned[pid][jailType] = schedule.Name
+				}
+			}
+		}
+		stateMutex.Unlock()
+	}
+}
+
+// scheduledJailTarget describes the processes a schedule of the configuration applies to
+func scheduledJailTarget(schedule ScheduledJail) string {
+	switch {
+	case schedule.Unit != "":
+		return "unit " + schedule.Unit
+	case schedule.Container != "":
+		return "container " + schedule.Container
+	}
+	return "where " + schedule.Selector
+}
+
+// showSchedules lists the scheduled jails and whether their window is open
+func showSchedules(state *JailerState) error {
+	if len(state.Schedules) == 0 && len(state.Config.Schedules) == 0 {
+		fmt.Fprintln(state.stdout(), "No scheduled jails")
+		return nil
+	}
+	now := time.Now()
+	if len(state.Config.Schedules) > 0 {
+		w := newTableWriter(state.stdout())
+		writeTableHeader(w, "NAME", "TARGET", "TYPE", "WINDOW", "STATE")
+		for _, schedule := range state.Config.Schedules {
+			status := "waiting"
+			if schedule.window.contains(now) {
+				status = "active"
+			}
+			jailType := strings.Join(append([]string{schedule.Jail}, schedule.Args...), " ")
+			writeTableRow(w, schedule.Name, scheduledJailTarget(schedule), jailType, schedule.window.String(), status)
+		}
+		w.Flush()
+		if len(state.Schedules) == 0 {
+			return nil
+		}
+		fmt.Fprintln(state.stdout())
+	}
+	w := newTableWriter(state.stdout())
+	writeTableHeader(w, "PID", "NAME", "TYPE", "WINDOW", "STATE")
+	for _, schedule := range state.Schedules {
+		status := "waiting"
+		if schedule.Window.contains(now) {
+			status = "active"
+		}
+		if schedule.Failures > 0 {
+			status = fmt.Sprintf("failing (%d): %s", schedule.Failures, schedule.Error)
+		}
+		jailType := schedule.JailType
+		if len(schedule.Args) > 0 {
+			jailType += " " + strings.Join(schedule.Args, " ")
+		}
+		writeTableRow(w, strconv.Itoa(schedule.PID), hostProcesses.name(schedule.PID), jailType, schedule.Window.String(), status)
+	}
+	return w.Flush()
+}
+
+// runJailScheduler applies and removes the scheduled jails, and the ones of the schedules
+// of the configuration, as their windows open and close until jailer exits
+func runJailScheduler(state *JailerState) {
+	profiles := newProfileScheduler(state)
+	if len(profiles.schedules) > 0 {
+		fmt.Printf("Running %d jail schedules of the configuration\n", len(profiles.schedules))
+		profiles.check(time.Now())
+	}
+	ticker := time.NewTicker(scheduleCheckInterval)
+	for range ticker.C {
+		stateMutex.Lock()
+		if applySchedules(state, time.Now()) {
+			publishInventory(state)
+		}
+		stateMutex.Unlock()
+		profiles.check(time.Now())
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// scriptFileOptions allows the statements a playbook needs at the top level of a script
+var scriptFileOptions = &syntax.FileOptions{
+	Set:             true,
+	While:           true,
+	TopLevelControl: true,
+	GlobalReassign:  true,
+}
+
+// scriptUnavailableCommands can't be run from a script, they wait for Ctrl+C themselves
+var scriptUnavailableCommands = []string{"watch", "top", "script", "capture", "simulate"}
+
+// runScript runs a Starlark script with the jailer primitives, Ctrl+C stops it
+func runScript(state *JailerState, path string, args []string) error {
+	interrupted, done := startInterruptible()
+	defer done()
+
+	thread := &starlark.Thread{
+		Name:  path,
+		Print: func(_ *starlark.Thread, msg string) { fmt.Fprintln(state.stdout(), msg) },
+	}
+	thread.SetLocal("interrupted", interrupted)
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-interrupted:
+			thread.Cancel("interrupted")
+		case <-finished:
+		}
+	}()
+
+	argv := make([]starlark.Value, len(args))
+	for i, arg := range args {
+		argv[i] = starlark.String(arg)
+	}
+
+	_, err := starlark.ExecFileOptions(scriptFileOptions, thread, path, nil, scriptBuiltins(state, starlark.NewList(argv)))
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		return fmt.Errorf("script failed: %s", evalErr.Backtrace())
+	}
+	if err != nil {
+		return fmt.Errorf("script failed: %v", err)
+	}
+	return nil
+}
+
+// scriptBuiltins returns the functions and values predeclared in scripts
+func scriptBuiltins(state *JailerState, argv *starlark.List) starlark.StringDict {
+	return starlark.StringDict{
+		"argv": argv,
+		"jail": starlark.NewBuiltin("jail", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			// jail(type, target, ..., [type arguments], reason="")
+			var reason string
+			if err := starlark.UnpackArgs(fn.Name(), nil, kwargs, "reason?", &reason); err != nil {
+				return nil, err
+			}
+			if len(args) < 2 {
+				return nil, fmt.Errorf("%s: expected a jail type and at least one target", fn.Name())
+			}
+			words, err := scriptWords(fn.Name(), args)
+			if err != nil {
+				return nil, err
+			}
+			words = append([]string{"jail"}, words...)
+			if reason != "" {
+				words = append(words, "--reason", reason)
+			}
+			return scriptCommand(state, words), nil
+		}),
+		"unjail": starlark.NewBuiltin("unjail", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var pid int
+			var jailType string
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "pid", &pid, "type?", &jailType); err != nil {
+				return nil, err
+			}
+			words := []string{"unjail", strconv.Itoa(pid)}
+			if jailType != "" {
+				words = []string{"unjail", jailType, strconv.Itoa(pid)}
+			}
+			return scriptCommand(state, words), nil
+		}),
+		"run": starlark.NewBuiltin("run", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			// run("list --type cpu") runs any jailer command line
+			var line string
+			if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &line); err != nil {
+				return nil, err
+			}
+			commands, err := splitCommands(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+			}
+			for _, parts := range commands {
+				for _, unavailable := range scriptUnavailableCommands {
+					if strings.ToLower(parts[0]) == unavailable {
+						return nil, fmt.Errorf("%s: %s is not available in scripts", fn.Name(), parts[0])
+					}
+				}
+			}
+			if err := executeCommand(state, line); err != nil {
+				fmt.Fprintf(state.stdout(), "Error: %v\n", err)
+				return starlark.False, nil
+			}
+			return starlark.True, nil
+		}),
+		"jails": starlark.NewBuiltin("jails", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 0); err != nil {
+				return nil, err
+			}
+			cleanupDeadProcesses(state)
+			var jails []starlark.Value
+			for _, entry := range selectJails(state, listFilter{SortBy: "pid"}) {
+				jails = append(jails, scriptJail(entry.jail))
+			}
+			return starlark.NewList(jails), nil
+		}),
+		"processes": starlark.NewBuiltin("processes", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			// processes(pattern="", user="") matches like the find command
+			var pattern, userName string
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "pattern?", &pattern, "user?", &userName); err != nil {
+				return nil, err
+			}
+			var processes []starlark.Value
+			for _, process := range findProcesses(pattern, userName) {
+				_, jailed := state.ActiveJails[process.PID]
+				processes = append(processes, starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+					"pid":     starlark.MakeInt(process.PID),
+					"name":    starlark.String(process.Name),
+					"user":    starlark.String(process.User),
+					"cmdline": starlark.String(process.Cmdline),
+					"jailed":  starlark.Bool(jailed),
+				}))
+			}
+			return starlark.NewList(processes), nil
+		}),
+		"stats": starlark.NewBuiltin("stats", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			// stats(pid) measures a process and its descendants like info
+			var pid int
+			if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &pid); err != nil {
+				return nil, err
+			}
+			if !hostProcesses.exists(pid) {
+				return nil, fmt.Errorf("%s: process %d does not exist", fn.Name(), pid)
+			}
+			jail, jailed := state.ActiveJails[pid]
+			if !jailed {
+				children, _ := hostProcesses.descendants(pid)
+				jail = &Jail{PID: pid, Children: children}
+			}
+			first := sampleJailUsage(state, jail, nil)
+			time.Sleep(infoSampleInterval)
+			usage := sampleJailUsage(state, jail, &first)
+			return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+				"cpu":            starlark.Float(usage.CPUPercent),
+				"rss":            starlark.MakeUint64(usage.RSSBytes),
+				"memory":         starlark.MakeUint64(usage.MemoryBytes),
+				"throttled_usec": starlark.MakeUint64(usage.ThrottledUsec),
+				"nr_throttled":   starlark.MakeUint64(usage.Throttling.Throttled),
+				"nr_periods":     starlark.MakeUint64(usage.Throttling.Periods),
+				"memory_max":     starlark.MakeUint64(usage.MemoryEvents.Max),
+				"oom":            starlark.MakeUint64(usage.MemoryEvents.OOM),
+				"oom_kill":       starlark.MakeUint64(usage.MemoryEvents.OOMKill),
+				"processes":      starlark.MakeInt(1 + len(jail.Children)),
+			}), nil
+		}),
+		"sleep": starlark.NewBuiltin("sleep", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var value starlark.Value
+			if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &value); err != nil {
+				return nil, err
+			}
+			seconds, ok := starlark.AsFloat(value)
+			if !ok {
+				return nil, fmt.Errorf("%s: got %s, want a number of seconds", fn.Name(), value.Type())
+			}
+			interrupted, _ := thread.Local("interrupted").(<-chan struct{})
+			completed := false
+			waitUnlocked(state, func() {
+				select {
+				case <-time.After(time.Duration(seconds * float64(time.Second))):
+					completed = true
+				case <-interrupted:
+				}
+			})
+			if !completed {
+				return nil, fmt.Errorf("interrupted")
+			}
+			return starlark.None, nil
+		}),
+	}
+}
+
+// scriptWords converts the arguments of a builtin into command words, PIDs may be given
+// as integers
+func scriptWords(name string, args starlark.Tuple) ([]string, error) {
+	words := make([]string, len(args))
+	for i, arg := range args {
+		switch value := arg.(type) {
+		case starlark.String:
+			words[i] = string(value)
+		case starlark.Int:
+			words[i] = value.String()
+		default:
+			return nil, fmt.Errorf("%s: argument %d must be a string or an int, not %s", name, i+1, arg.Type())
+		}
+	}
+	return words, nil
+}
+
+// scriptCommand runs a command for a script, failures are printed like at the prompt and
+// reported as False so that playbooks can react to them
+func scriptCommand(state *JailerState, words []string) starlark.Value {
+	if err := executeParts(state, words); err != nil {
+		fmt.Fprintf(state.stdout(), "Error: %v\n", err)
+		return starlark.False
+	}
+	return starlark.True
+}
+
+// scriptJail converts a jail to the struct seen by scripts
+func scriptJail(jail *Jail) starlark.Value {
+	types := make([]starlark.Value, len(jail.JailTypes))
+	for i, jailType := range jail.JailTypes {
+		types[i] = starlark.String(jailType)
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"pid":       starlark.MakeInt(jail.PID),
+		"name":      starlark.String(jail.Name),
+		"types":     starlark.NewList(types),
+		"children":  starlark.MakeInt(len(jail.Children)),
+		"age":       starlark.Float(time.Since(jail.Timestamp).Seconds()),
+		"reason":    starlark.String(jail.Reason),
+		"jailed_by": starlark.String(jail.JailedBy),
+	})
+}
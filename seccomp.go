@@ -0,0 +1,162 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// seccompSyscalls maps the syscall names usable in profiles to their numbers
+var seccompSyscalls = map[string]uintptr{
+	"accept":            unix.SYS_ACCEPT,
+	"accept4":           unix.SYS_ACCEPT4,
+	"bind":              unix.SYS_BIND,
+	"bpf":               unix.SYS_BPF,
+	"chroot":            unix.SYS_CHROOT,
+	"connect":           unix.SYS_CONNECT,
+	"delete_module":     unix.SYS_DELETE_MODULE,
+	"finit_module":      unix.SYS_FINIT_MODULE,
+	"init_module":       unix.SYS_INIT_MODULE,
+	"kexec_load":        unix.SYS_KEXEC_LOAD,
+	"keyctl":            unix.SYS_KEYCTL,
+	"listen":            unix.SYS_LISTEN,
+	"mount":             unix.SYS_MOUNT,
+	"perf_event_open":   unix.SYS_PERF_EVENT_OPEN,
+	"personality":       unix.SYS_PERSONALITY,
+	"pivot_root":        unix.SYS_PIVOT_ROOT,
+	"process_vm_readv":  unix.SYS_PROCESS_VM_READV,
+	"process_vm_writev": unix.SYS_PROCESS_VM_WRITEV,
+	"ptrace":            unix.SYS_PTRACE,
+	"reboot":            unix.SYS_REBOOT,
+	"recvfrom":          unix.SYS_RECVFROM,
+	"recvmsg":           unix.SYS_RECVMSG,
+	"sendmmsg":          unix.SYS_SENDMMSG,
+	"sendmsg":           unix.SYS_SENDMSG,
+	"sendto":            unix.SYS_SENDTO,
+	"setns":             unix.SYS_SETNS,
+	"socket":            unix.SYS_SOCKET,
+	"socketpair":        unix.SYS_SOCKETPAIR,
+	"swapoff":           unix.SYS_SWAPOFF,
+	"swapon":            unix.SYS_SWAPON,
+	"umount2":           unix.SYS_UMOUNT2,
+	"unshare":           unix.SYS_UNSHARE,
+}
+
+// x32SyscallBit flags syscalls made through the x32 ABI on amd64
+const x32SyscallBit = 0x40000000
+
+// seccompAuditArch returns the audit architecture the filter must check against
+func seccompAuditArch() (uint32, error) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return unix.AUDIT_ARCH_X86_64, nil
+	case "arm64":
+		return unix.AUDIT_ARCH_AARCH64, nil
+	}
+	return 0, fmt.Errorf("seccomp filters are not supported on %s", runtime.GOARCH)
+}
+
+// bpfStmt returns a BPF statement
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+// bpfJump returns a BPF conditional jump
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// validateSeccompProfile checks that a profile compiles to a filter for this architecture
+func validateSeccompProfile(profile SeccompProfile) error {
+	_, err := buildSeccompFilter(profile)
+	return err
+}
+
+// buildSeccompFilter compiles a profile into a classic BPF program for seccomp
+func buildSeccompFilter(profile SeccompProfile) ([]unix.SockFilter, error) {
+	arch, err := seccompAuditArch()
+	if err != nil {
+		return nil, err
+	}
+
+	var action uint32
+	switch profile.Action {
+	case "", "errno":
+		action = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	case "kill":
+		action = unix.SECCOMP_RET_KILL_PROCESS
+	default:
+		return nil, fmt.Errorf("unknown seccomp action %q (expected 'errno' or 'kill')", profile.Action)
+	}
+
+	if len(profile.Deny) == 0 {
+		return nil, fmt.Errorf("profile does not deny any syscall")
+	}
+
+	// seccomp_data layout: nr at offset 0, arch at offset 4
+	filter := []unix.SockFilter{
+		// Kill anything that isn't using the native architecture
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 4),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 0),
+	}
+
+	// The x32 ABI would otherwise bypass the syscall numbers below
+	if runtime.GOARCH == "amd64" {
+		filter = append(filter,
+			bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, action))
+	}
+
+	for _, name := range profile.Deny {
+		nr, exists := seccompSyscalls[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown syscall %q (supported: %s)", name, strings.Join(seccompSyscallNames(), ", "))
+		}
+		filter = append(filter,
+			bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, action))
+	}
+
+	filter = append(filter, bpfStmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW))
+	return filter, nil
+}
+
+// seccompSyscallNames returns the sorted list of syscalls usable in profiles
+func seccompSyscallNames() []string {
+	names := make([]string, 0, len(seccompSyscalls))
+	for name := range seccompSyscalls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// installSeccompFilter installs the filter on the calling process, it must run on a
+// locked OS thread right before exec
+func installSeccompFilter(filter []unix.SockFilter) error {
+	// Required to install a filter and guarantees exec can't regain privileges
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %v", err)
+	}
+
+	program := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	// TSYNC applies the filter to every thread of the Go runtime, not only this one
+	if _, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&program))); errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %v", errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// selectorSampleInterval is how long the CPU usage is measured when a selector uses it
+const selectorSampleInterval = 250 * time.Millisecond
+
+// processSnapshot is what a selector knows about a process
+type processSnapshot struct {
+	PID     int
+	PPID    int
+	Name    string
+	Cmdline string
+	User    string
+	CPU     float64 // Percent of one core during the sample
+	Memory  uint64  // Resident memory in bytes
+	Jailed  bool
+}
+
+// selectorFields maps the fields of the selector language to their kind
+var selectorFields = map[string]string{
+	"pid":     "number",
+	"ppid":    "number",
+	"name":    "string",
+	"cmdline": "string",
+	"user":    "string",
+	"cpu":     "number",
+	"memory":  "size",
+	"jailed":  "bool",
+}
+
+// selectorStart returns the position of the "where" word starting a selector in the
+// arguments of a command, or -1 when the targets are given explicitly
+func selectorStart(args []string) int {
+	for i, arg := range args {
+		if strings.EqualFold(arg, "where") {
+			return i
+		}
+	}
+	return -1
+}
+
+// selectorNode is a compiled selector expression
+type selectorNode interface {
+	matches(p *processSnapshot) bool
+}
+
+type selectorAnd struct{ left, right selectorNode }
+type selectorOr struct{ left, right selectorNode }
+type selectorNot struct{ operand selectorNode }
+
+func (n selectorAnd) matches(p *processSnapshot) bool { return n.left.matches(p) && n.right.matches(p) }
+func (n selectorOr) matches(p *processSnapshot) bool  { return n.left.matches(p) || n.right.matches(p) }
+func (n selectorNot) matches(p *processSnapshot) bool { return !n.operand.matches(p) }
+
+// selectorComparison compares a field of the process with a constant
+type selectorComparison struct {
+	field    string
+	operator string
+	text     string
+	number   float64
+	pattern  *regexp.Regexp
+}
+
+func (c selectorComparison) matches(p *processSnapshot) bool {
+	switch selectorFields[c.field] {
+	case "bool":
+		return p.Jailed == (c.operator == "==")
+	case "string":
+		value := map[string]string{"name": p.Name, "cmdline": p.Cmdline, "user": p.User}[c.field]
+		switch c.operator {
+		case "==":
+			return value == c.text
+		case "!=":
+			return value != c.text
+		case "=~":
+			return c.pattern.MatchString(value)
+		default:
+			return !c.pattern.MatchString(value)
+		}
+	}
+
+	value := map[string]float64{
+		"pid": float64(p.PID), "ppid": float64(p.PPID), "cpu": p.CPU, "memory": float64(p.Memory),
+	}[c.field]
+	switch c.operator {
+	case "==":
+		return value == c.number
+	case "!=":
+		return value != c.number
+	case "<":
+		return value < c.number
+	case "<=":
+		return value <= c.number
+	case ">":
+		return value > c.number
+	default:
+		return value >= c.number
+	}
+}
+
+// selectorOperators are the comparison operators, longest first so that they are
+// matched greedily
+var selectorOperators = []string{"==", "!=", "=~", "!~", "<=", ">=", "<", ">"}
+
+// selectorToken is a token of a selector: a field, an operator, a value or punctuation
+type selectorToken struct {
+	kind  string // "field", "operator", "value", "&&", "||", "!", "(" or ")"
+	value string
+}
+
+// tokenizeSelector splits the words of a selector into tokens. The quotes of the values
+// are already removed by the command line, so a value runs to the end of its word, minus
+// the parentheses closing groups opened before it. Operators may be written with or
+// without spaces around them
+func tokenizeSelector(words []string) ([]selectorToken, error) {
+	var tokens []selectorToken
+	depth := 0
+	last := func() string {
+		if len(tokens) == 0 {
+			return ""
+		}
+		return tokens[len(tokens)-1].kind
+	}
+	for _, word := range words {
+		for word != "" {
+			operator := ""
+			if last() == "field" {
+				for _, candidate := range selectorOperators {
+					if strings.HasPrefix(word, candidate) {
+						operator = candidate
+						break
+					}
+				}
+			}
+
+			switch {
+			case operator != "":
+				tokens = append(tokens, selectorToken{kind: "operator", value: operator})
+				word = word[len(operator):]
+			case last() == "operator":
+				// The value takes the rest of the word, up to "&&" or "||"
+				value := word
+				if i := strings.Index(value, "&&"); i >= 0 {
+					value = value[:i]
+				}
+				if i := strings.Index(value, "||"); i >= 0 {
+					value = value[:i]
+				}
+				word = word[len(value):]
+				for depth > 0 && strings.HasSuffix(value, ")") {
+					value = value[:len(value)-1]
+					word = ")" + word
+				}
+				tokens = append(tokens, selectorToken{kind: "value", value: value})
+			case strings.HasPrefix(word, "&&"), strings.HasPrefix(word, "||"):
+				tokens = append(tokens, selectorToken{kind: word[:2]})
+				word = word[2:]
+			case word[0] == '(':
+				depth++
+				tokens = append(tokens, selectorToken{kind: "("})
+				word = word[1:]
+			case word[0] == ')':
+				depth--
+				tokens = append(tokens, selectorToken{kind: ")"})
+				word = word[1:]
+			case word[0] == '!':
+				tokens = append(tokens, selectorToken{kind: "!"})
+				word = word[1:]
+			default:
+				end := strings.IndexFunc(word, func(r rune) bool {
+					return !(r >= 'a' && r <= 'z' || r == '_')
+				})
+				if end < 0 {
+					end = len(word)
+				}
+				if end == 0 {
+					return nil, fmt.Errorf("unexpected %q in selector", word)
+				}
+				tokens = append(tokens, selectorToken{kind: "field", value: word[:end]})
+				word = word[end:]
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// selectorParser is a recursive descent parser of selector tokens
+type selectorParser struct {
+	tokens []selectorToken
+	pos    int
+}
+
+func (p *selectorParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].kind
+	}
+	return ""
+}
+
+func (p *selectorParser) next() selectorToken {
+	token := p.tokens[p.pos]
+	p.pos++
+	return token
+}
+
+// parseOr parses: and ("||" and)*
+func (p *selectorParser) parseOr() (selectorNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var right selectorNode
+		if right, err = p.parseAnd(); err == nil {
+			left = selectorOr{left, right}
+		}
+	}
+	return left, err
+}
+
+// parseAnd parses: unary ("&&" unary)*
+func (p *selectorParser) parseAnd() (selectorNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var right selectorNode
+		if right, err = p.parseUnary(); err == nil {
+			left = selectorAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+// parseUnary parses: "!" unary | "(" or ")" | comparison
+func (p *selectorParser) parseUnary() (selectorNode, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		operand, err := p.parseUnary()
+		return selectorNot{operand}, err
+	case "(":
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ) in selector")
+		}
+		p.next()
+		return node, nil
+	case "field":
+		return p.parseComparison()
+	case "":
+		return nil, fmt.Errorf("incomplete selector")
+	}
+	return nil, fmt.Errorf("unexpected %s in selector", p.next().kind)
+}
+
+// parseComparison parses: field [operator value], a lone field must be a boolean
+func (p *selectorParser) parseComparison() (selectorNode, error) {
+	field := p.next().value
+	kind, known := selectorFields[field]
+	if !known {
+		return nil, fmt.Errorf("unknown selector field: %s (supported: %s)", field, strings.Join(selectorFieldNames(), ", "))
+	}
+
+	if p.peek() != "operator" {
+		if kind != "bool" {
+			return nil, fmt.Errorf("%s needs a comparison", field)
+		}
+		return selectorComparison{field: field, operator: "=="}, nil
+	}
+	operator := p.next().value
+	if p.peek() != "value" {
+		return nil, fmt.Errorf("missing value after %s%s", field, operator)
+	}
+	value := p.next().value
+	comparison := selectorComparison{field: field, operator: operator, text: value}
+
+	switch kind {
+	case "bool":
+		if (operator != "==" && operator != "!=") || (value != "true" && value != "false") {
+			return nil, fmt.Errorf("%s can only be compared with == or != to true or false", field)
+		}
+		if (operator == "==") != (value == "true") {
+			comparison.operator = "!="
+		} else {
+			comparison.operator = "=="
+		}
+	case "string":
+		switch operator {
+		case "==", "!=":
+		case "=~", "!~":
+			pattern, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression for %s: %v", field, err)
+			}
+			comparison.pattern = pattern
+		default:
+			return nil, fmt.Errorf("%s can only be compared with ==, !=, =~ or !~", field)
+		}
+	default:
+		if operator == "=~" || operator == "!~" {
+			return nil, fmt.Errorf("%s can't be matched with a regular expression", field)
+		}
+		if kind == "size" {
+			size, err := parseSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size for %s: %s", field, value)
+			}
+			comparison.number = float64(size)
+		} else {
+			number, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number for %s: %s", field, value)
+			}
+			comparison.number = number
+		}
+	}
+	return comparison, nil
+}
+
+// selectorFieldNames returns the sorted names of the selector fields
+func selectorFieldNames() []string {
+	names := make([]string, 0, len(selectorFields))
+	for name := range selectorFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compileSelector compiles the words of a selector and reports whether it uses the CPU
+// usage, which takes a sampling interval to measure
+func compileSelector(words []string) (selectorNode, bool, error) {
+	tokens, err := tokenizeSelector(words)
+	if err != nil {
+		return nil, false, err
+	}
+	parser := &selectorParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, false, err
+	}
+	if parser.pos < len(tokens) {
+		return nil, false, fmt.Errorf("unexpected %s in selector", tokens[parser.pos].kind)
+	}
+
+	usesCPU := false
+	for _, token := range tokens {
+		if token.kind == "field" && token.value == "cpu" {
+			usesCPU = true
+		}
+	}
+	return node, usesCPU, nil
+}
+
+// snapshotProcesses reads the processes that may be selected. Kernel threads, init,
+// jailer itself and its ancestors, such as the shell it runs in, are left out
+func snapshotProcesses(state *JailerState, sampleCPU bool) []processSnapshot {
+	excluded := map[int]bool{1: true, 2: true}
+	for pid := os.Getpid(); pid > 1; {
+		excluded[pid] = true
+		parent, err := hostProcesses.parent(pid)
+		if err != nil {
+			break
+		}
+		pid = parent
+	}
+
+	var processes []processSnapshot
+	for _, pid := range listProcessPids() {
+		ppid, err := hostProcesses.parent(pid)
+		if err != nil || excluded[pid] || ppid == 2 {
+			continue
+		}
+		_, jailed := state.ActiveJails[pid]
+		processes = append(processes, processSnapshot{
+			PID:     pid,
+			PPID:    ppid,
+			Name:    hostProcesses.name(pid),
+			Cmdline: getProcessCmdline(pid),
+			User:    getProcessUser(pid),
+			Jailed:  jailed,
+		})
+	}
+
+	if sampleCPU {
+		first := make(map[int]uint64)
+		for _, process := range processes {
+			first[process.PID], _ = getProcessCPUTicks(process.PID)
+		}
+		start := time.Now()
+		time.Sleep(selectorSampleInterval)
+		elapsed := time.Since(start).Seconds()
+		for i := range processes {
+			process := &processes[i]
+			if ticks, err := getProcessCPUTicks(process.PID); err == nil && ticks >= first[process.PID] {
+				process.CPU = float64(ticks-first[process.PID]) / clockTicksPerSecond / elapsed * 100
+			}
+		}
+	}
+	for i := range processes {
+		processes[i].Memory, _ = getProcessRSS(processes[i].PID)
+	}
+	return processes
+}
+
+// selectProcesses returns the processes matching a selector. A match whose ancestor also
+// matches is left out since jailing the ancestor covers its descendants
+func selectProcesses(state *JailerState, words []string) ([]processSnapshot, error) {
+	node, usesCPU, err := compileSelector(words)
+	if err != nil {
+		return nil, err
+	}
+
+	processes := snapshotProcesses(state, usesCPU)
+	parents := make(map[int]int, len(processes))
+	selected := make(map[int]bool)
+	for i := range processes {
+		parents[processes[i].PID] = processes[i].PPID
+		if processes[i].matches(node) {
+			selected[processes[i].PID] = true
+		}
+	}
+
+	var matches []processSnapshot
+	for _, process := range processes {
+		if !selected[process.PID] {
+			continue
+		}
+		covered := false
+		for pid := parents[process.PID]; pid > 1 && !covered; pid = parents[pid] {
+			covered = selected[pid]
+		}
+		if !covered {
+			matches = append(matches, process)
+		}
+	}
+	return matches, nil
+}
+
+// matches reports whether the process passes a compiled selector
+func (p *processSnapshot) matches(node selectorNode) bool {
+	return node.matches(p)
+}
+
+// selectJailedProcesses returns the jailed processes matching a selector, each one on its
+// own since every jail is released separately
+func selectJailedProcesses(state *JailerState, words []string) ([]processSnapshot, error) {
+	node, usesCPU, err := compileSelector(words)
+	if err != nil {
+		return nil, err
+	}
+	var matches []processSnapshot
+	for _, process := range snapshotProcesses(state, usesCPU) {
+		if _, jailed := state.ActiveJails[process.PID]; jailed && process.matches(node) {
+			matches = append(matches, process)
+		}
+	}
+	return matches, nil
+}
+
+// printSelection prints the processes a command would act on, for --dry-run
+func printSelection(out io.Writer, processes []processSnapshot, action string) {
+	if len(processes) == 0 {
+		fmt.Fprintln(out, "No process matches the selector")
+		return
+	}
+	w := newTableWriter(out)
+	writeTableHeader(w, "PID", "User", "CPU", "Memory", "Jailed", "Command")
+	for _, process := range processes {
+		jailed := "no"
+		if process.Jailed {
+			jailed = "yes"
+		}
+		command := process.Cmdline
+		if command == "" {
+			command = process.Name
+		}
+		writeTableRow(w, strconv.Itoa(process.PID), process.User, fmt.Sprintf("%.1f%%", process.CPU),
+			formatBytes(process.Memory), jailed, truncate(command, commandColumnWidth, false))
+	}
+	w.Flush()
+	fmt.Fprintf(out, "Dry run: %d processes would be %s with their descendants\n", len(processes), action)
+}
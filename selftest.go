@@ -0,0 +1,13 @@
+package main
+
+const (
+	// selftestArg is the hidden argument that turns jailer into a throwaway process of
+	// the self-test
+	selftestArg = "__jailer-selftest"
+
+	// selftestBlockedExitCode is returned by a helper whose socket or write was refused
+	selftestBlockedExitCode = 3
+
+	// selftestMaxCPUPercent is the CPU use above which the 1% cpu jail failed
+	selftestMaxCPUPercent = 5.0
+)
@@ -0,0 +1,361 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// selftestResult is the outcome of the self-test of a jail type
+type selftestResult struct {
+	JailType string
+	Result   string // "pass", "fail" or "skipped"
+	Detail   string
+}
+
+// runSelftestHelper is the entry point of the throwaway processes, it never returns
+func runSelftestHelper(args []string) {
+	if len(args) == 0 {
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "spin":
+		for {
+		}
+	case "sleep":
+		select {}
+	case "udp":
+		// A new socket for every packet, sockets created after the jail are covered by it
+		for {
+			if conn, err := net.Dial("udp", args[1]); err == nil {
+				conn.Write([]byte("jailer selftest"))
+				conn.Close()
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	case "socket":
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+		if err != nil {
+			os.Exit(selftestBlockedExitCode)
+		}
+		unix.Close(fd)
+		os.Exit(0)
+	case "write":
+		if err := os.WriteFile(args[1], []byte("jailer selftest\n"), 0600); err != nil {
+			os.Exit(selftestBlockedExitCode)
+		}
+		os.Exit(0)
+	}
+	os.Exit(2)
+}
+
+// startSelftestHelper starts a throwaway process of the self-test
+func startSelftestHelper(args ...string) (*exec.Cmd, error) {
+	cmd := exec.Command("/proc/self/exe", append([]string{selftestArg}, args...)...)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start self-test process: %v", err)
+	}
+	return cmd, nil
+}
+
+// stopSelftestHelper releases the jail of a throwaway process and kills it
+func stopSelftestHelper(state *JailerState, cmd *exec.Cmd) {
+	if _, jailed := state.ActiveJails[cmd.Process.Pid]; jailed {
+		if err := unjailProcess(state, strconv.Itoa(cmd.Process.Pid)); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: failed to release self-test process %d: %v\n", cmd.Process.Pid, err)
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+// jailSelftestHelper starts a throwaway process and applies a jail type to it
+func jailSelftestHelper(state *JailerState, jailType string, args []string, helperArgs ...string) (*exec.Cmd, error) {
+	cmd, err := startSelftestHelper(helperArgs...)
+	if err != nil {
+		return nil, err
+	}
+	if err := jailProcess(state, jailType, strconv.Itoa(cmd.Process.Pid), args, JailOptions{Reason: "selftest"}); err != nil {
+		stopSelftestHelper(state, cmd)
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// selftestCPU checks that a spinning process gets about 1% of a core in the cpu jail
+func selftestCPU(state *JailerState) (string, string) {
+	cmd, err := jailSelftestHelper(state, "cpu", nil, "spin")
+	if err != nil {
+		return "fail", err.Error()
+	}
+	defer stopSelftestHelper(state, cmd)
+
+	time.Sleep(300 * time.Millisecond)
+	start, err := getProcessCPUTicks(cmd.Process.Pid)
+	if err != nil {
+		return "fail", err.Error()
+	}
+	measured := 2 * time.Second
+	time.Sleep(measured)
+	end, err := getProcessCPUTicks(cmd.Process.Pid)
+	if err != nil {
+		return "fail", err.Error()
+	}
+	percent := float64(end-start) / clockTicksPerSecond / measured.Seconds() * 100
+	if percent > selftestMaxCPUPercent {
+		return "fail", fmt.Sprintf("a spinning process used %.1f%% of a core, expected about 1%%", percent)
+	}
+	return "pass", fmt.Sprintf("a spinning process used %.1f%% of a core", percent)
+}
+
+// selftestNetwork checks that the UDP packets of a process stop reaching a local
+// listener once the network or proxy jail is applied
+func selftestNetwork(state *JailerState, jailType string) (string, string) {
+	if jailType == "proxy" && state.Config.NetworkProxy == "" {
+		return "skipped", "no network_proxy configured"
+	}
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "fail", fmt.Sprintf("failed to listen for the test packets: %v", err)
+	}
+	defer listener.Close()
+	var received atomic.Int64
+	go func() {
+		buffer := make([]byte, 64)
+		for {
+			if _, _, err := listener.ReadFrom(buffer); err != nil {
+				return
+			}
+			received.Add(1)
+		}
+	}()
+
+	cmd, err := startSelftestHelper("udp", listener.LocalAddr().String())
+	if err != nil {
+		return "fail", err.Error()
+	}
+	defer stopSelftestHelper(state, cmd)
+	for i := 0; i < 40 && received.Load() == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if received.Load() == 0 {
+		return "skipped", "the packets of the test process don't arrive even without jail"
+	}
+
+	droppedBefore, droppedErr := getDroppedPackets(state)
+	if err := jailProcess(state, jailType, strconv.Itoa(cmd.Process.Pid), nil, JailOptions{Reason: "selftest"}); err != nil {
+		return "fail", err.Error()
+	}
+	time.Sleep(300 * time.Millisecond)
+	received.Store(0)
+	time.Sleep(1500 * time.Millisecond)
+	if count := received.Load(); count > 0 {
+		return "fail", fmt.Sprintf("%d packets still arrived from the jailed process", count)
+	}
+	detail := "packets of the jailed process no longer arrive"
+	if droppedAfter, err := getDroppedPackets(state); droppedErr == nil && err == nil {
+		detail += fmt.Sprintf(", %d dropped by the firewall", droppedAfter-droppedBefore)
+	}
+	return "pass", detail
+}
+
+// selftestProcess checks a setting of a jailed throwaway process
+func selftestProcess(state *JailerState, jailType string, args []string, check func(pid int) (string, string)) (string, string) {
+	cmd, err := jailSelftestHelper(state, jailType, args, "sleep")
+	if err != nil {
+		return "fail", err.Error()
+	}
+	defer stopSelftestHelper(state, cmd)
+	return check(cmd.Process.Pid)
+}
+
+// selftestLaunch starts a throwaway process with a launch-only jail type and checks
+// that its socket or write is refused
+func selftestLaunch(state *JailerState, jailType string, helperArgs ...string) (string, string) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "fail", fmt.Sprintf("failed to find the jailer executable: %v", err)
+	}
+	spec := &runJailSpec{LaunchProfiles: make(map[string]string)}
+	if err := spec.setLaunchProfile(state, jailType, defaultLaunchProfiles[jailType]); err != nil {
+		return "fail", err.Error()
+	}
+	if spec.Launch.Landlock != nil {
+		// The test process is jailer itself, which may live outside of the system paths
+		profile := *spec.Launch.Landlock
+		profile.ReadOnly = append(append([]string{}, profile.ReadOnly...), filepath.Dir(executable))
+		spec.Launch.Landlock = &profile
+	}
+	spec.Launch.Path = executable
+	spec.Launch.Args = append([]string{executable, selftestArg}, helperArgs...)
+	cmd, release, err := startLauncher(&spec.Launch, nil, nil, nil)
+	if err != nil {
+		return "fail", err.Error()
+	}
+	if err := releaseLauncher(release); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return "fail", err.Error()
+	}
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "fail", fmt.Sprintf("%s was allowed with profile %s", helperArgs[0], defaultLaunchProfiles[jailType])
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == selftestBlockedExitCode:
+		return "pass", fmt.Sprintf("%s refused with profile %s", helperArgs[0], defaultLaunchProfiles[jailType])
+	}
+	return "fail", fmt.Sprintf("test process failed: %v", err)
+}
+
+// selftestWrite checks that a launch-only jail type refuses a write outside of the
+// writable paths of its default profile, which only keep /tmp writable
+func selftestWrite(state *JailerState, jailType string) (string, string) {
+	dir, err := os.MkdirTemp("/var/tmp", "jailer-selftest-")
+	if err != nil {
+		return "skipped", fmt.Sprintf("no writable directory outside of /tmp: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	return selftestLaunch(state, jailType, "write", filepath.Join(dir, "probe"))
+}
+
+// selftestJailType applies a jail type to throwaway processes and checks its effect
+func selftestJailType(state *JailerState, jailType string) (string, string) {
+	if reason, disabled := state.DisabledJailTypes[jailType]; disabled {
+		return "skipped", "disabled: " + reason
+	}
+	switch jailType {
+	case "cpu":
+		return selftestCPU(state)
+	case "network", "proxy":
+		return selftestNetwork(state, jailType)
+	case "rlimit":
+		return selftestProcess(state, "rlimit", []string{"nofile=64"}, func(pid int) (string, string) {
+			var limit unix.Rlimit
+			if err := unix.Prlimit(pid, unix.RLIMIT_NOFILE, nil, &limit); err != nil {
+				return "fail", err.Error()
+			}
+			if limit.Cur != 64 {
+				return "fail", fmt.Sprintf("open files limit is %d, expected 64", limit.Cur)
+			}
+			return "pass", "open files limit clamped to 64"
+		})
+	case "memory":
+		return selftestProcess(state, "memory", []string{"64M"}, func(pid int) (string, string) {
+			cgroupDir, err := getProcessControllerCgroup(state, pid, "memory")
+			if err != nil {
+				return "fail", err.Error()
+			}
+			limitFile := filepath.Join(cgroupDir, "memory.max")
+			if state.CgroupVersion == 1 {
+				limitFile = filepath.Join(cgroupDir, "memory.limit_in_bytes")
+			}
+			limit, err := readCgroupValue(limitFile)
+			if err != nil {
+				return "fail", err.Error()
+			}
+			if limit != 64<<20 {
+				return "fail", fmt.Sprintf("memory limit is %d, expected %d", limit, 64<<20)
+			}
+			return "pass", "memory limit of the cgroup is 64M"
+		})
+	case "oom":
+		return selftestProcess(state, "oom", nil, func(pid int) (string, string) {
+			content, err := os.ReadFile(fmt.Sprintf("/proc/%d/oom_score_adj", pid))
+			if err != nil {
+				return "fail", err.Error()
+			}
+			if score := strings.TrimSpace(string(content)); score != "1000" {
+				return "fail", fmt.Sprintf("oom_score_adj is %s, expected 1000", score)
+			}
+			return "pass", "oom_score_adj is 1000"
+		})
+	case "coredump":
+		return selftestProcess(state, "coredump", nil, func(pid int) (string, string) {
+			var limit unix.Rlimit
+			if err := unix.Prlimit(pid, unix.RLIMIT_CORE, nil, &limit); err != nil {
+				return "fail", err.Error()
+			}
+			content, err := os.ReadFile(fmt.Sprintf("/proc/%d/coredump_filter", pid))
+			if err != nil {
+				return "fail", err.Error()
+			}
+			filter, err := strconv.ParseUint(strings.TrimSpace(string(content)), 16, 64)
+			if err != nil || limit.Cur != 0 || filter != 0 {
+				return "fail", fmt.Sprintf("core limit %d and coredump_filter %s, expected 0", limit.Cur, strings.TrimSpace(string(content)))
+			}
+			return "pass", "core limit and coredump_filter are 0"
+		})
+	case "syscall":
+		return selftestLaunch(state, "syscall", "socket")
+	case "landlock", "readonly":
+		return selftestWrite(state, jailType)
+	case "rdma":
+		return "skipped", "needs an RDMA device"
+	case "misc":
+		return "skipped", "needs a misc controller resource such as sev"
+	case "quota":
+		return "skipped", "needs a directory on a filesystem with project quotas"
+	}
+	return "skipped", "no test"
+}
+
+// runSelftest applies each jail type to throwaway processes, checks its effect and
+// reverts it, the session history doesn't keep the test jails
+func runSelftest(state *JailerState, jailTypes []string) error {
+	if len(jailTypes) == 0 {
+		jailTypes = allJailTypes()
+	}
+	for i, jailType := range jailTypes {
+		jailTypes[i] = normalizeJailType(strings.ToLower(jailType))
+		known := false
+		for _, candidate := range allJailTypes() {
+			known = known || candidate == jailTypes[i]
+		}
+		if !known {
+			return fmt.Errorf("unknown jail type: %s (types: %s)", jailType, strings.Join(allJailTypes(), ", "))
+		}
+	}
+
+	// The throwaway processes stay out of the history and its log
+	historyLength, historyLog := len(state.History), state.Config.HistoryLog
+	state.Config.HistoryLog = "off"
+	defer func() {
+		state.History = state.History[:historyLength]
+		state.Config.HistoryLog = historyLog
+	}()
+
+	var results []selftestResult
+	failed := 0
+	for _, jailType := range jailTypes {
+		fmt.Fprintf(state.stdout(), "Testing %s jail...\n", jailType)
+		result, detail := selftestJailType(state, jailType)
+		if result == "fail" {
+			failed++
+		}
+		results = append(results, selftestResult{JailType: jailType, Result: result, Detail: detail})
+	}
+
+	fmt.Fprintln(state.stdout())
+	w := newTableWriter(state.stdout())
+	writeTableHeader(w, "Type", "Result", "Detail")
+	for _, result := range results {
+		writeTableRow(w, result.JailType, result.Result, result.Detail)
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jail types failed the self-test", failed, len(results))
+	}
+	return nil
+}
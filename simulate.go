@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// simulationMaxBaseline bounds the time the metrics are measured before the jail is applied
+const simulationMaxBaseline = 10 * time.Second
+
+// simulationCounters are the error counters of /proc/<pid>/net/snmp compared by simulate,
+// they cover the whole network namespace of the process
+var simulationCounters = []string{"Tcp.AttemptFails", "Tcp.EstabResets", "Tcp.RetransSegs", "Tcp.OutRsts", "Udp.InErrors"}
+
+// simulationSample is a reading of the metrics compared by simulate
+type simulationSample struct {
+	At         time.Time
+	CPUTicks   uint64            // utime + stime of the tree
+	Counters   map[string]uint64 // Error counters of the network namespace
+	Dropped    uint64            // Packets dropped by the network jail rules
+	HasDropped bool
+	Sessions   int // Established TCP and UDP sessions of the tree
+	Alive      int // Processes of the tree still running
+}
+
+// readSnmpCounters parses a /proc/net/snmp file, whose lines go by pairs of names and
+// values, into counters keyed by "<protocol>.<name>"
+func readSnmpCounters(content string) map[string]uint64 {
+	counters := make(map[string]uint64)
+	lines := strings.Split(content, "\n")
+	for i := 0; i+1 < len(lines); i += 2 {
+		names, values := strings.Fields(lines[i]), strings.Fields(lines[i+1])
+		if len(names) != len(values) || len(names) == 0 || names[0] != values[0] {
+			continue
+		}
+		protocol := strings.TrimSuffix(names[0], ":")
+		for j := 1; j < len(names); j++ {
+			// Some counters such as MaxConn are signed, they aren't compared
+			if value, err := strconv.ParseUint(values[j], 10, 64); err == nil {
+				counters[protocol+"."+names[j]] = value
+			}
+		}
+	}
+	return counters
+}
+
+// takeSimulationSample reads the metrics of a process tree
+func takeSimulationSample(state *JailerState, pids []int) simulationSample {
+	sample := simulationSample{At: time.Now()}
+	var alive []int
+	for _, pid := range pids {
+		if ticks, err := getProcessCPUTicks(pid); err == nil {
+			sample.CPUTicks += ticks
+			alive = append(alive, pid)
+		}
+	}
+	sample.Alive = len(alive)
+	if len(alive) > 0 {
+		if content, err := os.ReadFile(fmt.Sprintf("/proc/%d/net/snmp", alive[0])); err == nil {
+			sample.Counters = readSnmpCounters(string(content))
+		}
+	}
+	if dropped, err := state.Firewall.droppedPackets(); err == nil {
+		sample.Dropped, sample.HasDropped = dropped, true
+	}
+	for _, connection := range getProcessConnections(alive) {
+		if connection.State == "ESTABLISHED" {
+			sample.Sessions++
+		}
+	}
+	return sample
+}
+
+// simulationRates returns the per-second rates of the metrics between two samples, keyed
+// by the names of the report
+func simulationRates(start, end simulationSample) map[string]float64 {
+	elapsed := end.At.Sub(start.At).Seconds()
+	if elapsed <= 0 {
+		return nil
+	}
+	delta := func(before, after uint64) float64 {
+		if after < before {
+			return 0
+		}
+		return float64(after-before) / elapsed
+	}
+	rates := map[string]float64{"CPU %": delta(start.CPUTicks, end.CPUTicks) / clockTicksPerSecond * 100}
+	if start.HasDropped && end.HasDropped {
+		rates["Dropped packets/s"] = delta(start.Dropped, end.Dropped)
+	}
+	for _, counter := range simulationCounters {
+		before, beforeFound := start.Counters[counter]
+		after, afterFound := end.Counters[counter]
+		if beforeFound && afterFound {
+			rates[counter+"/s"] = delta(before, after)
+		}
+	}
+	return rates
+}
+
+// waitSimulation waits for the end of a simulation phase, false when it is interrupted
+func waitSimulation(state *JailerState, interrupted <-chan struct{}, duration time.Duration) bool {
+	completed := false
+	waitUnlocked(state, func() {
+		select {
+		case <-interrupted:
+		case <-time.After(duration):
+			completed = true
+		}
+	})
+	return completed
+}
+
+// simulateJail applies a jail for a while, compares the metrics of the tree before and
+// during the jail and reverts it, to see what the jail would do to a service
+func simulateJail(state *JailerState, jailType string, pid int, args []string, duration time.Duration) error {
+	if duration <= 0 {
+		return fmt.Errorf("the simulation needs a positive --duration")
+	}
+	if !hostProcesses.exists(pid) {
+		cleanupDeadProcesses(state)
+		return fmt.Errorf("process %d does not exist", pid)
+	}
+	specs, err := parseJailSpecs(jailType, args)
+	if err != nil {
+		return err
+	}
+	jailTypes := jailSpecTypes(specs)
+	if jail, jailed := state.ActiveJails[pid]; jailed {
+		for _, jailType := range jailTypes {
+			if jail.HasJailType(jailType) {
+				return fmt.Errorf("process %d is already jailed with %s jail, nothing to simulate", pid, jailType)
+			}
+		}
+	}
+	for _, schedule := range state.Schedules {
+		if schedule.PID == pid && slices.Contains(jailTypes, schedule.JailType) {
+			return fmt.Errorf("process %d has a scheduled %s jail, nothing to simulate", pid, schedule.JailType)
+		}
+	}
+
+	pids := []int{pid}
+	if descendants, err := hostProcesses.descendants(pid); err == nil {
+		pids = append(pids, descendants...)
+	}
+	baseline := min(duration, simulationMaxBaseline)
+
+	interrupted, done := startInterruptible()
+	defer done()
+	processName := hostProcesses.name(pid)
+	fmt.Fprintf(state.stdout(), "Measuring process %d (%s) and %d descendants for %s before the simulation (Ctrl+C to abort)\n",
+		pid, processName, len(pids)-1, baseline)
+	baselineStart := takeSimulationSample(state, pids)
+	if !waitSimulation(state, interrupted, baseline) {
+		fmt.Fprintln(state.stdout(), "Simulation aborted, nothing was jailed")
+		return nil
+	}
+	baselineEnd := takeSimulationSample(state, pids)
+
+	reason := fmt.Sprintf("simulation of the %s jail for %s", strings.Join(jailTypes, ","), duration)
+	err = jailTargets(state, specs, []int{pid}, JailOptions{Reason: reason})
+	var applied []string
+	if jail, jailed := state.ActiveJails[pid]; jailed {
+		for _, jailType := range jailTypes {
+			if jail.HasJailType(jailType) {
+				applied = append(applied, jailType)
+			}
+		}
+	}
+	if err == nil {
+		fmt.Fprintf(state.stdout(), "Simulating the %s jail for %s (Ctrl+C to revert early)\n", strings.Join(jailTypes, ","), duration)
+		jailedStart := takeSimulationSample(state, pids)
+		completed := waitSimulation(state, interrupted, duration)
+		jailedEnd := takeSimulationSample(state, pids)
+		if !completed {
+			fmt.Fprintln(state.stdout(), "Simulation interrupted, reverting now")
+		}
+		defer printSimulationReport(state.stdout(), pid, processName, jailTypes, baselineStart, baselineEnd, jailedStart, jailedEnd)
+	}
+
+	// Only the jail types added by the simulation are removed
+	event := AuditEvent{Action: "unjail", JailTypes: applied, Reason: reason}
+	var revertErr error
+	for i := len(applied) - 1; i >= 0; i-- {
+		if revertErr = unjailProcessSelective(state, applied[i], strconv.Itoa(pid)); revertErr != nil {
+			fmt.Fprintf(state.stdout(), "Warning: failed to revert %s jail of process %d: %v\n", applied[i], pid, revertErr)
+		}
+	}
+	if len(applied) > 0 {
+		event.Targets = []AuditTarget{newAuditTarget(pid, processName, revertErr)}
+		writeAuditEvent(state, event)
+	}
+	if err != nil {
+		return fmt.Errorf("simulation failed: %v", err)
+	}
+	return revertErr
+}
+
+// printSimulationReport prints the metrics of the tree before and during the jail
+func printSimulationReport(out io.Writer, pid int, processName string, jailTypes []string, baselineStart, baselineEnd, jailedStart, jailedEnd simulationSample) {
+	before := simulationRates(baselineStart, baselineEnd)
+	during := simulationRates(jailedStart, jailedEnd)
+
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "Impact of the %s jail on process %d (%s)\n", strings.Join(jailTypes, ","), pid, processName)
+	w := newTableWriter(out)
+	writeTableHeader(w, "Metric", "Before", "Jailed", "Change")
+	names := []string{"CPU %", "Dropped packets/s"}
+	for _, counter := range simulationCounters {
+		names = append(names, counter+"/s")
+	}
+	for _, name := range names {
+		beforeRate, beforeFound := before[name]
+		duringRate, duringFound := during[name]
+		if !beforeFound || !duringFound {
+			continue
+		}
+		writeTableRow(w, name, fmt.Sprintf("%.2f", beforeRate), fmt.Sprintf("%.2f", duringRate),
+			fmt.Sprintf("%+.2f", duringRate-beforeRate))
+	}
+	writeTableRow(w, "Established sessions", strconv.Itoa(baselineEnd.Sessions), strconv.Itoa(jailedEnd.Sessions),
+		fmt.Sprintf("%+d", jailedEnd.Sessions-baselineEnd.Sessions))
+	writeTableRow(w, "Running processes", strconv.Itoa(baselineEnd.Alive), strconv.Itoa(jailedEnd.Alive),
+		fmt.Sprintf("%+d", jailedEnd.Alive-baselineEnd.Alive))
+	w.Flush()
+	fmt.Fprintln(out, "The error counters cover the network namespace of the process, the dropped packets all network jails")
+}
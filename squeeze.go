@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	squeezeSteps         = 10              // Steps from the starting quota down to the limit
+	squeezeCheckInterval = 5 * time.Second // Time between two checks of the squeezed jails
+)
+
+// cpuSqueeze is the progressive tightening of the CPU limit of a jail, from a quota of
+// every core down to the limit of the jail
+type cpuSqueeze struct {
+	StartPercent int           `json:"start_percent"`
+	Since        time.Time     `json:"since"`
+	Over         time.Duration `json:"over"`
+	Applied      int           `json:"applied"` // Percent written to the cgroup last
+}
+
+// parseSqueeze parses the --squeeze flag, the limit and the time to reach it as in 50%:5m
+func parseSqueeze(value string) (int, time.Duration, error) {
+	limit, over, found := strings.Cut(value, ":")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid --squeeze %q (expected <limit>:<duration>, e.g. 50%%:5m)", value)
+	}
+	percent, err := parseCpuPercent(limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	duration, err := parseDuration(over)
+	if err != nil || duration < squeezeSteps*time.Second {
+		return 0, 0, fmt.Errorf("invalid --squeeze duration %q, at least %ds", over, squeezeSteps)
+	}
+	return percent, duration, nil
+}
+
+// newCpuSqueeze starts the squeeze of a jail towards its CPU limit, nil when the limit
+// already allows every core
+func newCpuSqueeze(percent int, over time.Duration, now time.Time) *cpuSqueeze {
+	start := 100 * runtime.NumCPU()
+	if percent >= start {
+		return nil
+	}
+	return &cpuSqueeze{StartPercent: start, Since: now, Over: over}
+}
+
+// percentAt returns the CPU limit of a squeezed jail at a time. Each step takes the same
+// share of the quota away, the last one reaches the limit
+func (s *cpuSqueeze) percentAt(limit int, now time.Time) int {
+	step := int(now.Sub(s.Since) * squeezeSteps / s.Over)
+	if step >= squeezeSteps {
+		return limit
+	}
+	step = max(step, 0)
+	ratio := math.Pow(float64(limit)/float64(s.StartPercent), float64(step)/squeezeSteps)
+	return max(limit, int(math.Round(float64(s.StartPercent)*ratio)))
+}
+
+// effectiveCpuPercent returns the CPU limit applied to a jail, the adaptive limit, the
+// current step of its squeeze or its limit
+func effectiveCpuPercent(jail *Jail, now time.Time) int {
+	switch {
+	case jail.Adaptive != nil:
+		return jail.Adaptive.Applied
+	case jail.Squeeze != nil:
+		return jail.Squeeze.percentAt(jail.CpuPercent, now)
+	}
+	return jail.CpuPercent
+}
+
+// squeezeJails tightens the CPU limit of the squeezed jails whose step changed, the
+// squeeze ends once the limit is reached
+func squeezeJails(state *JailerState, now time.Time) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	changed := false
+	for pid, jail := range state.ActiveJails {
+		if jail.Squeeze == nil || !jail.usesDedicatedCgroup() {
+			continue
+		}
+		percent := effectiveCpuPercent(jail, now)
+		if percent == jail.Squeeze.Applied {
+			continue
+		}
+		if err := state.Limits.updateCpuLimit(jail); err != nil {
+			fmt.Printf("Warning: failed to squeeze the CPU limit of process %d: %v\n", pid, err)
+			continue
+		}
+		if percent == jail.CpuPercent {
+			fmt.Printf("Squeeze of process %d (%s) done, CPU limit at %d%% of one core\n", pid, jail.Name, percent)
+			jail.Squeeze = nil
+		}
+		publishJailEvent("updated", jail, fmt.Sprintf("squeezed to %d%%", percent))
+		changed = true
+	}
+	if changed {
+		publishInventory(state)
+	}
+}
+
+// runSqueezeMonitor tightens the squeezed CPU limits until jailer exits
+func runSqueezeMonitor(state *JailerState) {
+	for now := range time.Tick(squeezeCheckInterval) {
+		squeezeJails(state, now)
+	}
+}
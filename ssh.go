@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+// shellQuote quotes a word for the POSIX shell running the command of ssh
+func shellQuote(word string) string {
+	if word != "" && !strings.ContainsAny(word, " \t\n;&|<>()$`\\\"'*?[]#~=%{}!") {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'"'"'`) + "'"
+}
+
+// sshCommandArgs returns the arguments of ssh running jailer on a remote host, jailer
+// runs under sudo unless the remote user is root
+func sshCommandArgs(target, remoteJailer string, command []string, terminal bool) []string {
+	remote := []string{shellQuote(remoteJailer)}
+	for _, word := range command {
+		remote = append(remote, shellQuote(word))
+	}
+
+	user, _, hasUser := strings.Cut(target, "@")
+	if !hasUser || user != "root" {
+		// Without a terminal sudo can't ask for a password and must fail at once
+		if terminal {
+			remote = append([]string{"sudo"}, remote...)
+		} else {
+			remote = append([]string{"sudo", "-n"}, remote...)
+		}
+	}
+
+	args := []string{}
+	if terminal {
+		// A terminal on the remote side forwards Ctrl+C and the prompt
+		args = append(args, "-t")
+	}
+	return append(args, "--", target, strings.Join(remote, " "))
+}
+
+// runOverSSH runs jailer on a remote host over SSH and streams its output back, with an
+// interactive prompt when no command is given. It returns the exit code of ssh
+func runOverSSH(target, remoteJailer string, command []string) int {
+	if target == "" || strings.HasPrefix(target, "-") {
+		fmt.Printf("Error: invalid host: %q\n", target)
+		return 1
+	}
+
+	terminal := readline.IsTerminal(int(os.Stdin.Fd()))
+	if len(command) == 0 && !terminal {
+		fmt.Println("Error: an interactive remote session needs a terminal, give a command instead")
+		return 1
+	}
+
+	cmd := exec.Command("ssh", sshCommandArgs(target, remoteJailer, command, terminal)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Printf("Error: failed to run ssh: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultStatsdInterval is the time between two reports of the gauges
+	defaultStatsdInterval = 10 * time.Second
+
+	// statsdMaxPacket keeps the datagrams below the usual MTU
+	statsdMaxPacket = 1400
+)
+
+// StatsdConfig sends the metrics of the jails to a StatsD or DogStatsD agent, for the hosts
+// without Prometheus
+type StatsdConfig struct {
+	Address   string   `json:"address"`   // host:port of the agent, empty disables the metrics
+	Prefix    string   `json:"prefix"`    // Prefix of the metric names, jailer by default
+	DogStatsD bool     `json:"dogstatsd"` // Jail types and events as tags instead of in the names
+	Tags      []string `json:"tags"`      // DogStatsD tags added to every metric, e.g. env:prod
+	Interval  string   `json:"interval"`  // Time between two reports of the gauges, 10s by default
+
+	interval time.Duration
+}
+
+// validateStatsdConfig checks the address and parses the interval
+func validateStatsdConfig(config *StatsdConfig) error {
+	if config.Address == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %v", config.Address, err)
+	}
+	if len(config.Tags) > 0 && !config.DogStatsD {
+		return fmt.Errorf("tags require dogstatsd")
+	}
+	if config.Prefix == "" {
+		config.Prefix = "jailer"
+	}
+	config.interval = defaultStatsdInterval
+	if config.Interval != "" {
+		interval, err := parseDuration(config.Interval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid interval %q", config.Interval)
+		}
+		config.interval = interval
+	}
+	return nil
+}
+
+// statsdEmitter buffers the metrics and sends them in as few datagrams as possible
+type statsdEmitter struct {
+	state       *JailerState
+	config      StatsdConfig
+	conn        net.Conn
+	packet      strings.Builder
+	lastDropped uint64
+	hasDropped  bool
+}
+
+// newStatsdEmitter connects to the agent, UDP only fails on an unresolvable address
+func newStatsdEmitter(state *JailerState) (*statsdEmitter, error) {
+	config := state.Config.Statsd
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to StatsD agent %s: %v", config.Address, err)
+	}
+	return &statsdEmitter{state: state, config: config, conn: conn}, nil
+}
+
+// metric adds a metric to the next datagram. The dimension, e.g. the jail type, is a tag
+// named key with DogStatsD and the last part of the name with plain StatsD
+func (e *statsdEmitter) metric(name, value, kind, key, dimension string) {
+	line := e.config.Prefix + "." + name
+	var tags []string
+	if dimension != "" {
+		if e.config.DogStatsD {
+			tags = append(tags, key+":"+dimension)
+		} else {
+			line += "." + strings.ReplaceAll(dimension, ".", "_")
+		}
+	}
+	line += ":" + value + "|" + kind
+	if e.config.DogStatsD {
+		if tags = append(tags, e.config.Tags...); len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+	}
+
+	if e.packet.Len() > 0 && e.packet.Len()+1+len(line) > statsdMaxPacket {
+		e.flush()
+	}
+	if e.packet.Len() > 0 {
+		e.packet.WriteByte('\n')
+	}
+	e.packet.WriteString(line)
+}
+
+// flush sends the buffered metrics, a lost datagram only loses its metrics
+func (e *statsdEmitter) flush() {
+	if e.packet.Len() == 0 {
+		return
+	}
+	e.conn.Write([]byte(e.packet.String()))
+	e.packet.Reset()
+}
+
+// recordEvent counts a jail event, and times the jails that ended
+func (e *statsdEmitter) recordEvent(event jailEvent) {
+	e.metric("events", "1", "c", "event", strings.ReplaceAll(event.Event, "-", "_"))
+	if !isJailEndEvent(event.Event) || event.JailedAt.IsZero() {
+		return
+	}
+	duration := event.Time.Sub(event.JailedAt).Milliseconds()
+	for _, jailType := range event.JailTypes {
+		e.metric("jail.duration", fmt.Sprint(duration), "ms", "jail_type", jailType)
+	}
+}
+
+// reportGauges sends the number of jails by type and the packets dropped since the last
+// report
+func (e *statsdEmitter) reportGauges() {
+	stateMutex.Lock()
+	counts := make(map[string]int)
+	for _, jail := range e.state.ActiveJails {
+		for _, jailType := range jail.JailTypes {
+			counts[jailType]++
+		}
+	}
+	total := len(e.state.ActiveJails)
+	var dropped uint64
+	droppedRead := false
+	if e.state.FirewallTool != "" {
+		var err error
+		dropped, err = e.state.Firewall.droppedPackets()
+		droppedRead = err == nil
+	}
+	stateMutex.Unlock()
+
+	e.metric("jails.total", fmt.Sprint(total), "g", "", "")
+	for _, jailType := range allJailTypes() {
+		e.metric("jails.active", fmt.Sprint(counts[jailType]), "g", "jail_type", jailType)
+	}
+	if droppedRead {
+		// The counters start again when the rules are set up again
+		if e.hasDropped && dropped >= e.lastDropped {
+			e.metric("packets.dropped", fmt.Sprint(dropped-e.lastDropped), "c", "", "")
+		}
+		e.lastDropped, e.hasDropped = dropped, true
+	}
+}
+
+// runStatsdEmitter reports the gauges at the configured interval and the jail events as
+// they happen until jailer exits
+func runStatsdEmitter(state *JailerState) {
+	emitter, err := newStatsdEmitter(state)
+	if err != nil {
+		fmt.Printf("Warning: %v, no metrics are sent\n", err)
+		return
+	}
+	fmt.Printf("Sending metrics to StatsD agent %s every %s\n", emitter.config.Address, emitter.config.interval)
+
+	events, _ := jailEvents.subscribe()
+	ticker := time.NewTicker(emitter.config.interval)
+	emitter.reportGauges()
+	emitter.flush()
+	for {
+		select {
+		case event := <-events:
+			emitter.recordEvent(event)
+		case <-ticker.C:
+			emitter.reportGauges()
+		}
+		emitter.flush()
+	}
+}
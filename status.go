@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// showStatus prints an overview of jailer: the cgroup and firewall setup, the jails and
+// the freshness of the blocklist feeds
+func showStatus(state *JailerState) error {
+	cleanupDeadProcesses(state)
+
+	firewallTool := state.FirewallTool
+	if firewallTool == "" {
+		firewallTool = "none, network jails disabled"
+	}
+	w := newTableWriter(state.stdout())
+	writeTableRow(w, "Cgroups:", fmt.Sprintf("v%d", state.CgroupVersion))
+	writeTableRow(w, "Firewall:", firewallTool)
+	writeTableRow(w, "Active jails:", fmt.Sprintf("%d (%d persistent)", len(state.ActiveJails), countPersistentJails(state)))
+	writeTableRow(w, "Disabled jail types:", fmt.Sprint(len(state.DisabledJailTypes)))
+	w.Flush()
+
+	config := state.Config.Blocklists
+	fmt.Fprintln(state.stdout())
+	if len(config.Feeds) == 0 {
+		fmt.Fprintln(state.stdout(), "Blocklist feeds: none configured")
+		return nil
+	}
+	scope := "network jails"
+	if config.AllProcesses {
+		scope = "all processes"
+	}
+	fmt.Fprintf(state.stdout(), "Blocklist feeds (refreshed every %s, dropped for %s):\n", config.refresh, scope)
+	w = newTableWriter(state.stdout())
+	writeTableHeader(w, "Feed", "Entries", "Updated", "Status")
+	for _, row := range describeBlocklists(state, time.Now()) {
+		writeTableRow(w, row...)
+	}
+	w.Flush()
+	return nil
+}
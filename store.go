@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	defaultStorePath      = "/var/lib/jailer/jailer.db"
+	defaultSampleInterval = time.Minute
+
+	// Documents replaced as a whole at each save
+	stateDocument      = "state"
+	persistentDocument = "persistent"
+)
+
+// StoreConfig selects where jailer keeps the jail state, the persistent jails, the audit
+// events, the ended jails and the usage samples
+type StoreConfig struct {
+	Type    string `json:"type"`    // "files" (default), "sqlite" or "kv" for the clustered store of state_backend
+	Path    string `json:"path"`    // Database of the sqlite store, /var/lib/jailer/jailer.db by default
+	Samples string `json:"samples"` // Interval of the usage samples of the sqlite store, 1m by default, "off" disables them
+
+	samples time.Duration
+}
+
+// validateStoreConfig checks the store and fills in the defaults, the kv store needs the
+// clustered store of state_backend
+func validateStoreConfig(config *StoreConfig, backend StateBackendConfig) error {
+	switch config.Type {
+	case "", "files", "kv":
+		if config.Path != "" || config.Samples != "" {
+			return fmt.Errorf("path and samples only apply to the sqlite store")
+		}
+		if config.Type == "kv" && backend.Type == "" {
+			return fmt.Errorf("the kv store needs a state_backend")
+		}
+		return nil
+	case "sqlite":
+	default:
+		return fmt.Errorf("unknown store type: %s (expected files, sqlite or kv)", config.Type)
+	}
+	if config.Path == "" {
+		config.Path = defaultStorePath
+	}
+	config.samples = defaultSampleInterval
+	switch config.Samples {
+	case "":
+	case "off":
+		config.samples = 0
+	default:
+		samples, err := parseDuration(config.Samples)
+		if err != nil || samples < time.Second {
+			return fmt.Errorf("invalid samples interval %q, at least 1s", config.Samples)
+		}
+		config.samples = samples
+	}
+	return nil
+}
+
+// stateStore keeps what jailer saves for the next runs and the reviews after an incident.
+// Whether each kind is saved at all stays decided by its setting: state_file, the jails
+// file of persist, audit_log and history_log
+type stateStore interface {
+	putDocument(name string, content []byte) error
+	getDocument(name string) ([]byte, error) // nil when the document isn't saved
+	deleteDocument(name string) error
+	appendAuditEvent(event AuditEvent) error
+	appendHistoryRecord(record JailRecord) error
+	loadHistory() ([]JailRecord, int, error) // The records and the number of unreadable ones
+	appendUsageSamples(samples []usageSample) error
+}
+
+// usageSample is the resource usage of a jail at a time
+type usageSample struct {
+	Time          time.Time
+	PID           int
+	Name          string
+	CPUPercent    float64 // Since the previous sample, in percent of one core
+	MemoryBytes   uint64
+	ThrottledUsec uint64 // Throttled time since the previous sample
+}
+
+// openStateStore returns the configured store, the kv store keeps the records of a host
+// under its name
+func openStateStore(state *JailerState, host string) (stateStore, error) {
+	switch state.Config.Store.Type {
+	case "sqlite":
+		return openSQLiteStore(state.Config.Store.Path)
+	case "kv":
+		return newKVStore(state.Config.StateBackend, host)
+	}
+	return &fileStore{state: state}, nil
+}
+
+// fileStore keeps each kind in its own file: the documents are JSON files replaced at
+// once, the audit events and the ended jails JSON lines appended to their log. The paths
+// are read from the state at each call since they are set after the store is created
+type fileStore struct {
+	state *JailerState
+}
+
+// documentPath returns the file of a document, empty when it isn't saved
+func (s *fileStore) documentPath(name string) string {
+	if name == persistentDocument {
+		return s.state.PersistentJailsPath
+	}
+	return s.state.StatePath
+}
+
+func (s *fileStore) putDocument(name string, content []byte) error {
+	path := s.documentPath(name)
+	if path == "" {
+		return nil
+	}
+	return writeAtomically(path, content, 0600)
+}
+
+func (s *fileStore) getDocument(name string) ([]byte, error) {
+	path := s.documentPath(name)
+	if path == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return content, err
+}
+
+func (s *fileStore) deleteDocument(name string) error {
+	path := s.documentPath(name)
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) appendAuditEvent(event AuditEvent) error {
+	return appendJSONLine(s.state.Config.AuditLog, event)
+}
+
+func (s *fileStore) appendHistoryRecord(record JailRecord) error {
+	return appendJSONLine(s.state.Config.HistoryLog, record)
+}
+
+func (s *fileStore) loadHistory() ([]JailRecord, int, error) {
+	file, err := os.Open(s.state.Config.HistoryLog)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("failed to open history log: %v", err)
+	}
+	defer file.Close()
+
+	var records []JailRecord
+	skipped := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var record JailRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			skipped++
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read history log: %v", err)
+	}
+	return records, skipped, nil
+}
+
+// appendUsageSamples drops the samples, the files store keeps no time series
+func (s *fileStore) appendUsageSamples(samples []usageSample) error {
+	return nil
+}
+
+// appendJSONLine appends a value to a log file as a JSON line
+func appendJSONLine(path string, value any) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// collectUsageSamples measures the usage of the jails, previous keeps the last sample of
+// each jail for the CPU percentage and the throttled time
+func collectUsageSamples(state *JailerState, previous map[int]jailUsage) []usageSample {
+	var samples []usageSample
+	for pid, jail := range state.ActiveJails {
+		var last *jailUsage
+		if usage, found := previous[pid]; found {
+			last = &usage
+		}
+		usage := sampleJailUsage(state, jail, last)
+		previous[pid] = usage
+		if last == nil {
+			continue
+		}
+		samples = append(samples, usageSample{Time: usage.SampledAt, PID: pid, Name: jail.Name,
+			CPUPercent: usage.CPUPercent, MemoryBytes: usage.MemoryBytes, ThrottledUsec: usage.ThrottledDelta})
+	}
+	for pid := range previous {
+		if _, active := state.ActiveJails[pid]; !active {
+			delete(previous, pid)
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].PID < samples[j].PID })
+	return samples
+}
+
+// runUsageRecorder saves the usage of the jails to the store at the samples interval, the
+// first sample of a jail only serves as the base of the next one
+func runUsageRecorder(state *JailerState) {
+	previous := make(map[int]jailUsage)
+	for range time.Tick(state.Config.Store.samples) {
+		stateMutex.Lock()
+		samples := collectUsageSamples(state, previous)
+		stateMutex.Unlock()
+		if len(samples) == 0 {
+			continue
+		}
+		if err := state.Store.appendUsageSamples(samples); err != nil {
+			fmt.Printf("Warning: failed to save the usage samples: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !sqlite
+
+package main
+
+import "fmt"
+
+// openSQLiteStore is only available when jailer is built with the pure-Go SQLite driver,
+// go build -tags sqlite
+func openSQLiteStore(path string) (stateStore, error) {
+	return nil, fmt.Errorf("the sqlite store needs jailer built with -tags sqlite")
+}
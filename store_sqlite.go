@@ -0,0 +1,166 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the tables of the sqlite store, the records are kept as the JSON of
+// the files store next to the columns they are queried by
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS documents (
+	name     TEXT PRIMARY KEY,
+	content  BLOB NOT NULL,
+	saved_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS audit_events (
+	id       INTEGER PRIMARY KEY,
+	time     INTEGER NOT NULL,
+	action   TEXT NOT NULL,
+	operator TEXT NOT NULL,
+	event    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_events_time ON audit_events (time);
+CREATE TABLE IF NOT EXISTS history (
+	id       INTEGER PRIMARY KEY,
+	ended_at INTEGER NOT NULL,
+	pid      INTEGER NOT NULL,
+	name     TEXT NOT NULL,
+	record   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS history_ended_at ON history (ended_at);
+CREATE TABLE IF NOT EXISTS usage_samples (
+	time           INTEGER NOT NULL,
+	pid            INTEGER NOT NULL,
+	name           TEXT NOT NULL,
+	cpu_percent    REAL NOT NULL,
+	memory_bytes   INTEGER NOT NULL,
+	throttled_usec INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS usage_samples_pid_time ON usage_samples (pid, time);
+`
+
+// sqliteStore keeps everything in a single SQLite database, written in WAL mode so that
+// the reports can read it while jailer runs
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLiteStore opens the database, creating it and its tables when needed
+func openSQLiteStore(path string) (stateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the sqlite store directory: %v", err)
+	}
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the sqlite store %s: %v", path, err)
+	}
+	// A single connection serializes the writes of the monitors and the commands
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set up the sqlite store %s: %v", path, err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) putDocument(name string, content []byte) error {
+	_, err := s.db.Exec(`INSERT INTO documents (name, content, saved_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET content = excluded.content, saved_at = excluded.saved_at`,
+		name, content, time.Now().Unix())
+	return err
+}
+
+func (s *sqliteStore) getDocument(name string) ([]byte, error) {
+	var content []byte
+	err := s.db.QueryRow(`SELECT content FROM documents WHERE name = ?`, name).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return content, err
+}
+
+func (s *sqliteStore) deleteDocument(name string) error {
+	_, err := s.db.Exec(`DELETE FROM documents WHERE name = ?`, name)
+	return err
+}
+
+func (s *sqliteStore) appendAuditEvent(event AuditEvent) error {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode: %v", err)
+	}
+	_, err = s.db.Exec(`INSERT INTO audit_events (time, action, operator, event) VALUES (?, ?, ?, ?)`,
+		event.Time.UnixMilli(), event.Action, event.Operator, string(content))
+	return err
+}
+
+func (s *sqliteStore) appendHistoryRecord(record JailRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode: %v", err)
+	}
+	_, err = s.db.Exec(`INSERT INTO history (ended_at, pid, name, record) VALUES (?, ?, ?, ?)`,
+		record.EndedAt.UnixMilli(), record.PID, record.Name, string(content))
+	return err
+}
+
+func (s *sqliteStore) loadHistory() ([]JailRecord, int, error) {
+	rows, err := s.db.Query(`SELECT record FROM history ORDER BY ended_at, id`)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read history: %v", err)
+	}
+	defer rows.Close()
+
+	var records []JailRecord
+	skipped := 0
+	for rows.Next() {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			return nil, 0, fmt.Errorf("failed to read history: %v", err)
+		}
+		var record JailRecord
+		if err := json.Unmarshal([]byte(content), &record); err != nil {
+			skipped++
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read history: %v", err)
+	}
+	return records, skipped, nil
+}
+
+// appendUsageSamples inserts the samples of an interval in a single transaction
+func (s *sqliteStore) appendUsageSamples(samples []usageSample) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	statement, err := tx.Prepare(`INSERT INTO usage_samples (time, pid, name, cpu_percent, memory_bytes, throttled_usec)
+		VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer statement.Close()
+	for _, sample := range samples {
+		if _, err := statement.Exec(sample.Time.UnixMilli(), sample.PID, sample.Name, sample.CPUPercent,
+			int64(sample.MemoryBytes), int64(sample.ThrottledUsec)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
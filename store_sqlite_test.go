@@ -0,0 +1,80 @@
+//go:build sqlite
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSQLiteStore tests that the sqlite store keeps the documents, audit events, ended jails
+// and usage samples across reopens
+func TestSQLiteStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store", "jailer.db")
+	store, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := store.getDocument(stateDocument); content != nil || err != nil {
+		t.Errorf("Expected no saved state, got %q (%v)", content, err)
+	}
+	for _, content := range []string{"{}", `{"jails":[]}`} {
+		if err := store.putDocument(stateDocument, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.putDocument(persistentDocument, []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.deleteDocument(persistentDocument); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	event := AuditEvent{Time: now, Action: "jail", Operator: "alice", JailTypes: []string{"cpu"}}
+	if err := store.appendAuditEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"sleep", "curl"} {
+		record := JailRecord{PID: 100 + i, Name: name, JailTypes: []string{"network"}, JailedAt: now,
+			EndedAt: now.Add(time.Duration(i) * time.Second), EndReason: "unjailed"}
+		if err := store.appendHistoryRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	samples := []usageSample{{Time: now, PID: 100, Name: "sleep", CPUPercent: 12.5, MemoryBytes: 1 << 20}}
+	if err := store.appendUsageSamples(samples); err != nil {
+		t.Fatal(err)
+	}
+	store.(*sqliteStore).db.Close()
+
+	// Everything is read back by the next jailer
+	store, err = openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.(*sqliteStore).db.Close()
+	if content, err := store.getDocument(stateDocument); string(content) != `{"jails":[]}` || err != nil {
+		t.Errorf("Expected the last saved state, got %q (%v)", content, err)
+	}
+	if content, err := store.getDocument(persistentDocument); content != nil || err != nil {
+		t.Errorf("Expected the deleted document to be gone, got %q (%v)", content, err)
+	}
+	records, skipped, err := store.loadHistory()
+	if err != nil || skipped != 0 || len(records) != 2 || records[0].Name != "sleep" || records[1].PID != 101 {
+		t.Errorf("Unexpected history %+v (%d skipped, %v)", records, skipped, err)
+	}
+
+	db := store.(*sqliteStore).db
+	var operator string
+	if err := db.QueryRow(`SELECT operator FROM audit_events WHERE action = 'jail'`).Scan(&operator); err != nil || operator != "alice" {
+		t.Errorf("Unexpected audit event operator %q (%v)", operator, err)
+	}
+	var cpu float64
+	var memory int64
+	if err := db.QueryRow(`SELECT cpu_percent, memory_bytes FROM usage_samples WHERE pid = 100`).Scan(&cpu, &memory); err != nil ||
+		cpu != 12.5 || memory != 1<<20 {
+		t.Errorf("Unexpected usage sample %v %v (%v)", cpu, memory, err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSuspectCount is how many processes suspects lists per resource
+const defaultSuspectCount = 5
+
+// suspectResources are the resources suspects ranks the processes by, in display order
+var suspectResources = []string{"cpu", "memory", "io", "network"}
+
+// suspectTitles are the titles of the rankings of suspects
+var suspectTitles = map[string]string{
+	"cpu":     "CPU",
+	"memory":  "memory",
+	"io":      "disk IO",
+	"network": "network connections",
+}
+
+// suspect is a process sampled by suspects
+type suspect struct {
+	processSnapshot
+	IOBytes     float64 // Bytes read and written per second during the sample
+	Connections int     // Established TCP and UDP connections
+	HasIO       bool    // Whether /proc/<pid>/io could be read
+}
+
+// getProcessIOBytes returns the bytes read and written to storage by a process, only
+// readable by root or the owner of the process
+func getProcessIOBytes(pid int) (uint64, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found || (key != "read_bytes" && key != "write_bytes") {
+			continue
+		}
+		count, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected io format for PID %d", pid)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// sampleSuspects reads the processes with their CPU and IO rates over a short sample, and
+// their established connections
+func sampleSuspects(state *JailerState) []suspect {
+	first := make(map[int]uint64)
+	for _, pid := range listProcessPids() {
+		if bytes, err := getProcessIOBytes(pid); err == nil {
+			first[pid] = bytes
+		}
+	}
+	start := time.Now()
+	processes := snapshotProcesses(state, true)
+	elapsed := time.Since(start).Seconds()
+
+	suspects := make([]suspect, len(processes))
+	pids := make([]int, len(processes))
+	for i, process := range processes {
+		suspects[i].processSnapshot = process
+		pids[i] = process.PID
+		before, known := first[process.PID]
+		if bytes, err := getProcessIOBytes(process.PID); err == nil && known && bytes >= before {
+			suspects[i].IOBytes = float64(bytes-before) / elapsed
+			suspects[i].HasIO = true
+		}
+	}
+
+	connections := make(map[int]int)
+	for _, connection := range getProcessConnections(pids) {
+		if connection.State == "ESTABLISHED" {
+			connections[connection.PID]++
+		}
+	}
+	for i := range suspects {
+		suspects[i].Connections = connections[suspects[i].PID]
+	}
+	return suspects
+}
+
+// rankSuspects returns the processes using the most of a resource, busiest first, the
+// processes not using it are left out
+func rankSuspects(suspects []suspect, resource string, count int) []suspect {
+	usage := func(s *suspect) float64 {
+		switch resource {
+		case "cpu":
+			return s.CPU
+		case "memory":
+			return float64(s.Memory)
+		case "io":
+			return s.IOBytes
+		}
+		return float64(s.Connections)
+	}
+
+	var ranked []suspect
+	for i := range suspects {
+		if usage(&suspects[i]) > 0 {
+			ranked = append(ranked, suspects[i])
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if usage(&ranked[i]) != usage(&ranked[j]) {
+			return usage(&ranked[i]) > usage(&ranked[j])
+		}
+		return ranked[i].PID < ranked[j].PID
+	})
+	if len(ranked) > count {
+		ranked = ranked[:count]
+	}
+	return ranked
+}
+
+// suspectJailTypes are the jail types suggested for the top consumers of each resource
+var suspectJailTypes = map[string]string{
+	"cpu":     "cpu %d 10%%",
+	"memory":  "oom %d",
+	"io":      "quota %d 1G",
+	"network": "network %d",
+}
+
+// suspectHint returns the command jailing a top consumer of a resource, or the jail types
+// of the processes already jailed
+func suspectHint(state *JailerState, s suspect, resource string) string {
+	if jail, exists := state.ActiveJails[s.PID]; exists {
+		return "jailed: " + jail.GetJailTypesString()
+	}
+	command := fmt.Sprintf(suspectJailTypes[resource], s.PID)
+	if err := checkJailTypeEnabled(state, strings.Fields(command)[0]); err != nil {
+		return "-"
+	}
+	return "jail " + command
+}
+
+// showSuspects prints the top consumers of each resource with the command jailing them
+func showSuspects(state *JailerState, resources []string, count int, wide bool) error {
+	suspects := sampleSuspects(state)
+	hasIO := false
+	for _, s := range suspects {
+		hasIO = hasIO || s.HasIO
+	}
+
+	for i, resource := range resources {
+		if i > 0 {
+			fmt.Fprintln(state.stdout())
+		}
+		if resource == "io" && !hasIO {
+			fmt.Fprintln(state.stdout(), "Top disk IO: /proc/<pid>/io is not readable on this host")
+			continue
+		}
+		ranked := rankSuspects(suspects, resource, count)
+		fmt.Fprintf(state.stdout(), "Top %s:\n", suspectTitles[resource])
+		if len(ranked) == 0 {
+			fmt.Fprintln(state.stdout(), "  No process uses it")
+			continue
+		}
+		w := newTableWriter(state.stdout())
+		writeTableHeader(w, "PID", "User", "CPU", "Memory", "IO", "Conns", "Jail this", "Command")
+		for _, s := range ranked {
+			io := "-"
+			if s.HasIO {
+				io = formatBytes(uint64(s.IOBytes)) + "/s"
+			}
+			// Command lines may hold newlines, e.g. python -c scripts
+			command := strings.Join(strings.Fields(s.Cmdline), " ")
+			if command == "" {
+				command = s.Name
+			}
+			writeTableRow(w, strconv.Itoa(s.PID), truncate(s.User, nameColumnWidth, wide),
+				fmt.Sprintf("%.1f%%", s.CPU), formatBytes(s.Memory), io, strconv.Itoa(s.Connections),
+				suspectHint(state, s, resource), truncate(command, commandColumnWidth, wide))
+		}
+		w.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultStateFile keeps the jails of a jailer started by systemd, on tmpfs since the
+// jails don't survive a reboot either
+const defaultStateFile = "/run/jailer/state.json"
+
+// systemdService describes how systemd started jailer, read once at startup
+var systemdService struct {
+	notifySocket string        // NOTIFY_SOCKET of Type=notify services
+	watchdog     time.Duration // WatchdogSec of the service, 0 without watchdog
+	started      bool          // Started as a systemd service
+}
+
+// savedJailState is the content of the state file, read back after jailer was killed
+// without its cleanup, e.g. by the watchdog
+type savedJailState struct {
+	SavedAt       time.Time       `json:"saved_at"`
+	CgroupVersion int             `json:"cgroup_version"`
+	FirewallTool  string          `json:"firewall_tool"`
+	Jails         []*Jail         `json:"jails"`
+	Schedules     []*jailSchedule `json:"schedules,omitempty"`
+	Blocklist     []insertedRule  `json:"blocklist_rules,omitempty"`
+}
+
+// initSystemd reads the environment systemd gives a service and removes it, so that the
+// commands started by run don't inherit the notification socket
+func initSystemd() {
+	systemdService.notifySocket = os.Getenv("NOTIFY_SOCKET")
+	systemdService.started = systemdService.notifySocket != "" || os.Getenv("INVOCATION_ID") != ""
+	if usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		pid := os.Getenv("WATCHDOG_PID")
+		if pid == "" || pid == strconv.Itoa(os.Getpid()) {
+			systemdService.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	for _, name := range []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID"} {
+		os.Unsetenv(name)
+	}
+}
+
+// sdNotify sends a state change such as READY=1 to systemd, nothing is sent when jailer
+// isn't a Type=notify service
+func sdNotify(message string) error {
+	if systemdService.notifySocket == "" {
+		return nil
+	}
+	address := systemdService.notifySocket
+	if address[0] == '@' {
+		// Abstract socket
+		address = "\x00" + address[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: address, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd notify socket: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(message)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %v", err)
+	}
+	return nil
+}
+
+// runWatchdog pings the systemd watchdog at half its timeout while the jailer state can
+// still be locked, a jailer stuck on it is restarted by systemd
+func runWatchdog() {
+	interval := systemdService.watchdog / 2
+	for range time.Tick(interval) {
+		responsive := make(chan struct{})
+		go func() {
+			stateMutex.Lock()
+			stateMutex.Unlock()
+			close(responsive)
+		}()
+		select {
+		case <-responsive:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			}
+		case <-time.After(interval):
+			fmt.Println("Warning: jailer state locked for too long, not answering the watchdog")
+		}
+	}
+}
+
+// saveJailState writes the active jails to the state file, replacing it at once so that a
+// crash never leaves half a file
+func saveJailState(state *JailerState) {
+	if state.StatePath == "" {
+		return
+	}
+	saved := savedJailState{SavedAt: time.Now(), CgroupVersion: state.CgroupVersion, FirewallTool: state.FirewallTool, Schedules: state.Schedules,
+		Blocklist: state.BlocklistRules}
+	for _, jail := range state.ActiveJails {
+		saved.Jails = append(saved.Jails, jail)
+	}
+	content, err := json.Marshal(saved)
+	if err == nil {
+		err = state.Store.putDocument(stateDocument, content)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save jail state to %s: %v\n", state.StatePath, err)
+	}
+}
+
+// removeJailState removes the state file once every jail is released, there is then
+// nothing to recover
+func removeJailState(state *JailerState) {
+	if state.StatePath == "" {
+		return
+	}
+	if err := state.Store.deleteDocument(stateDocument); err != nil {
+		fmt.Printf("Warning: failed to remove %s: %v\n", state.StatePath, err)
+	}
+}
+
+// recoverJailState loads the jails left by a jailer that didn't clean up, the processes
+// gone meanwhile are released. It returns false when there is no state to recover
+func recoverJailState(state *JailerState) (bool, error) {
+	if state.StatePath == "" {
+		return false, nil
+	}
+	content, err := state.Store.getDocument(stateDocument)
+	if err != nil {
+		return false, fmt.Errorf("failed to read jail state: %v", err)
+	}
+	if content == nil {
+		return false, nil
+	}
+	var saved savedJailState
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return false, fmt.Errorf("failed to parse jail state %s: %v", state.StatePath, err)
+	}
+	if saved.CgroupVersion != state.CgroupVersion || saved.FirewallTool != state.FirewallTool {
+		return false, fmt.Errorf("jail state %s was saved with cgroups v%d and %s, not cgroups v%d and %s",
+			state.StatePath, saved.CgroupVersion, saved.FirewallTool, state.CgroupVersion, state.FirewallTool)
+	}
+
+	for _, jail := range saved.Jails {
+		state.ActiveJails[jail.PID] = jail
+	}
+	state.Schedules = saved.Schedules
+	state.BlocklistRules = saved.Blocklist
+	fmt.Printf("Recovering %d jails saved at %s by the previous jailer\n", len(saved.Jails), saved.SavedAt.Format(time.RFC3339))
+	cleanupDeadProcesses(state)
+	return true, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Column widths of the tables, values are truncated unless --wide is given
+const (
+	nameColumnWidth    = 16
+	typeColumnWidth    = 24
+	reasonColumnWidth  = 40
+	commandColumnWidth = 60
+)
+
+// newTableWriter returns a writer aligning the tab-separated columns of a table written to out
+func newTableWriter(out io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+}
+
+// writeTableHeader writes the column names of a table, underlined
+func writeTableHeader(w io.Writer, columns ...string) {
+	underlines := make([]string, len(columns))
+	for i, column := range columns {
+		underlines[i] = strings.Repeat("-", len(column))
+	}
+	fmt.Fprintln(w, strings.Join(columns, "\t"))
+	fmt.Fprintln(w, strings.Join(underlines, "\t"))
+}
+
+// writeTableRow writes a row of a table, tabs inside values would break the alignment
+// and are replaced by spaces
+func writeTableRow(w io.Writer, values ...string) {
+	for i, value := range values {
+		values[i] = strings.ReplaceAll(value, "\t", " ")
+	}
+	fmt.Fprintln(w, strings.Join(values, "\t"))
+}
+
+// truncate shortens a value to width characters with an ellipsis, unless wide is set
+func truncate(value string, width int, wide bool) string {
+	runes := []rune(value)
+	if wide || len(runes) <= width {
+		return value
+	}
+	return string(runes[:width-1]) + "…"
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// JailTemplate is a set of jails written by export --format template and applied again by
+// import, on the same host or another one
+type JailTemplate struct {
+	CreatedAt time.Time      `json:"created_at"`
+	Host      string         `json:"host"`
+	Jails     []TemplateJail `json:"jails"`
+}
+
+// TemplateJail applies a jail type to the processes matching a selector
+type TemplateJail struct {
+	Selector string   `json:"selector"` // Selector of jail ... where, e.g. name=="postgres"
+	Jail     string   `json:"jail"`
+	Args     []string `json:"args,omitempty"` // Arguments of the jail type, e.g. ["20%"] for cpu
+	Reason   string   `json:"reason,omitempty"`
+
+	words []string
+}
+
+// templateSelector returns the selector matching the processes of a jail by name
+func templateSelector(jail *Jail) string {
+	return "name==" + strconv.Quote(jail.Name)
+}
+
+// exportTemplate writes the active jails as a template, one entry per jail type. The
+// types set up before exec can't be applied to running processes and are left out
+func exportTemplate(state *JailerState, path string) error {
+	template := JailTemplate{CreatedAt: time.Now()}
+	template.Host, _ = os.Hostname()
+	for _, entry := range selectJails(state, listFilter{}) {
+		for _, jailType := range entry.jail.JailTypes {
+			if isLaunchOnlyJailType(jailType) {
+				continue
+			}
+			template.Jails = append(template.Jails, TemplateJail{
+				Selector: templateSelector(entry.jail),
+				Jail:     jailType,
+				Args:     jailTypeArgs(entry.jail, jailType),
+				Reason:   entry.jail.Reason,
+			})
+		}
+	}
+
+	content, err := json.MarshalIndent(template, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode template: %v", err)
+	}
+	if err := os.WriteFile(path, append(content, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	fmt.Fprintf(state.stdout(), "Exported %d jails to template %s, edit the selectors to match other processes\n", len(template.Jails), path)
+	return nil
+}
+
+// loadTemplate reads a template and checks every entry before any is applied
+func loadTemplate(path string) (*JailTemplate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %v", err)
+	}
+	var template JailTemplate
+	if err := json.Unmarshal(content, &template); err != nil {
+		return nil, fmt.Errorf("failed to parse template %s: %v", path, err)
+	}
+
+	for i := range template.Jails {
+		entry := &template.Jails[i]
+		jailType, err := normalizeJailSpec(entry.Jail)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i+1, err)
+		}
+		entry.Jail = jailType
+		commands, err := splitCommands(entry.Selector)
+		if err != nil || len(commands) != 1 {
+			return nil, fmt.Errorf("entry %d: invalid selector %q", i+1, entry.Selector)
+		}
+		if _, _, err := compileSelector(commands[0]); err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i+1, err)
+		}
+		entry.words = commands[0]
+	}
+	return &template, nil
+}
+
+// importTemplate jails the processes matching the entries of a template, the processes
+// already jailed with the type of an entry are skipped. The import is undone at once
+func importTemplate(state *JailerState, path string, dryRun bool) error {
+	template, err := loadTemplate(path)
+	if err != nil {
+		return err
+	}
+
+	before := make(map[int]*Jail)
+	var targets []int
+	failed := 0
+	for _, entry := range template.Jails {
+		matches, err := selectProcesses(state, entry.words)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(state.stdout(), "%s jail where %s:\n", entry.Jail, entry.Selector)
+		if dryRun {
+			printSelection(state.stdout(), matches, "jailed")
+			continue
+		}
+
+		specs, err := parseJailSpecs(entry.Jail, entry.Args)
+		if err != nil {
+			return err
+		}
+		var pids []int
+		for _, process := range matches {
+			if jail, jailed := state.ActiveJails[process.PID]; jailed && jail.HasJailType(specs[0].Type) {
+				continue
+			}
+			pids = append(pids, process.PID)
+		}
+		if len(pids) == 0 {
+			fmt.Fprintln(state.stdout(), "  No process to jail")
+			continue
+		}
+
+		for pid, jail := range snapshotJails(state, pids) {
+			if _, seen := before[pid]; !seen {
+				before[pid] = jail
+				targets = append(targets, pid)
+			}
+		}
+		if err := jailTargets(state, specs, pids, JailOptions{Reason: entry.Reason}); err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: %v\n", err)
+			failed++
+		}
+	}
+	if dryRun {
+		return nil
+	}
+
+	recordOperation(state, "import "+path, targets, before)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d template entries failed", failed, len(template.Jails))
+	}
+	fmt.Fprintf(state.stdout(), "Imported %d template entries from %s\n", len(template.Jails), path)
+	return nil
+}
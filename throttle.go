@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// throttleCheckInterval is the time between two readings of the throttling of the jails
+const throttleCheckInterval = 30 * time.Second
+
+// ThrottleAlertConfig notifies the CPU jails throttled most of the time for long, e.g.
+// jails forgotten on a process that became legitimate
+type ThrottleAlertConfig struct {
+	Percent  float64 `json:"percent"`  // Share of the periods throttled, e.g. 90, 0 disables the alert
+	Duration string  `json:"duration"` // How long the jail stays above it, e.g. 10m
+
+	duration time.Duration
+}
+
+// validateThrottleAlertConfig checks the threshold and parses the duration
+func validateThrottleAlertConfig(config *ThrottleAlertConfig) error {
+	if config.Percent == 0 {
+		return nil
+	}
+	if config.Percent < 0 || config.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100, not %g", config.Percent)
+	}
+	duration, err := parseDuration(config.Duration)
+	if err != nil || duration <= 0 {
+		return fmt.Errorf("invalid duration %q", config.Duration)
+	}
+	config.duration = duration
+	return nil
+}
+
+// throttleMonitor follows the throttling of the CPU jails between two readings
+type throttleMonitor struct {
+	state    *JailerState
+	config   ThrottleAlertConfig
+	read     func(pid int) (cpuThrottling, error)
+	previous map[int]cpuThrottling
+	since    map[int]time.Time // Since when each jail is above the threshold
+	alerted  map[int]bool      // Jails notified, again only once they went below
+}
+
+// newThrottleMonitor returns a monitor reading the cgroups of the jails
+func newThrottleMonitor(state *JailerState) *throttleMonitor {
+	return &throttleMonitor{
+		state:    state,
+		config:   state.Config.ThrottleAlert,
+		read:     func(pid int) (cpuThrottling, error) { return getCgroupThrottling(state, pid) },
+		previous: make(map[int]cpuThrottling),
+		since:    make(map[int]time.Time),
+		alerted:  make(map[int]bool),
+	}
+}
+
+// check reads the throttling of the CPU jails and notifies the ones above the threshold
+// for the configured duration, the share is the one of the periods since the last check
+func (m *throttleMonitor) check(now time.Time) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	for pid := range m.previous {
+		if jail, exists := m.state.ActiveJails[pid]; !exists || !jail.HasJailType("cpu") {
+			delete(m.previous, pid)
+			delete(m.since, pid)
+			delete(m.alerted, pid)
+		}
+	}
+	for pid, jail := range m.state.ActiveJails {
+		if !jail.HasJailType("cpu") {
+			continue
+		}
+		current, err := m.read(pid)
+		if err != nil {
+			continue
+		}
+		previous, known := m.previous[pid]
+		m.previous[pid] = current
+		if !known || current.Periods < previous.Periods || current.Throttled < previous.Throttled {
+			continue
+		}
+
+		interval := cpuThrottling{Periods: current.Periods - previous.Periods, Throttled: current.Throttled - previous.Throttled}
+		if interval.Periods == 0 || interval.percent() < m.config.Percent {
+			delete(m.since, pid)
+			delete(m.alerted, pid)
+			continue
+		}
+		if _, above := m.since[pid]; !above {
+			m.since[pid] = now
+		}
+		if m.alerted[pid] || now.Sub(m.since[pid]) < m.config.duration {
+			continue
+		}
+		m.alerted[pid] = true
+		sendNotification(m.state, newNotification("cpu_throttled", jail, fmt.Sprintf(
+			"CPU jail of process %d (%s) throttled in more than %g%% of the periods for %s, jailed %s ago by %s: %s",
+			pid, jail.Name, m.config.Percent, now.Sub(m.since[pid]).Round(time.Second),
+			now.Sub(jail.Timestamp).Round(time.Minute), jailOperator(jail), jail.Reason)))
+	}
+}
+
+// jailOperator returns who created a jail, for the messages
+func jailOperator(jail *Jail) string {
+	if jail.JailedBy == "" {
+		return "unknown"
+	}
+	return jail.JailedBy
+}
+
+// runThrottleMonitor checks the throttling of the CPU jails until jailer exits
+func runThrottleMonitor(state *JailerState) {
+	monitor := newThrottleMonitor(state)
+	fmt.Printf("Notifying the CPU jails throttled in more than %g%% of the periods for %s\n",
+		monitor.config.Percent, monitor.config.duration)
+	for now := range time.Tick(throttleCheckInterval) {
+		monitor.check(now)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// topSortKeys are the orders supported by top
+var topSortKeys = []string{"cpu", "memory", "throttled"}
+
+// topJails continuously shows the resource usage of every jail, busiest first, until Ctrl+C
+func topJails(state *JailerState, interval time.Duration, sortBy string, wide bool) {
+	previous := make(map[int]jailUsage)
+	var previousDropped uint64
+	firstDraw := true
+
+	refreshScreen(state, interval, func() {
+		cleanupDeadProcesses(state)
+		entries := selectJails(state, listFilter{})
+		usage := sampleJails(state, entries, previous)
+		previous = usage
+
+		sort.SliceStable(entries, func(i, j int) bool {
+			a, b := usage[entries[i].jail.PID], usage[entries[j].jail.PID]
+			switch sortBy {
+			case "memory":
+				return a.MemoryBytes > b.MemoryBytes
+			case "throttled":
+				return a.ThrottledDelta > b.ThrottledDelta
+			}
+			return a.CPUPercent > b.CPUPercent
+		})
+
+		fmt.Fprintf(state.stdout(), "jailer top - %s - %d active jails, every %s, sorted by %s - Ctrl+C to stop\n",
+			time.Now().Format("15:04:05"), len(state.ActiveJails), interval, sortBy)
+
+		// The network jail rules are shared, drops can't be attributed to a single jail
+		if dropped, err := state.Firewall.droppedPackets(); err != nil {
+			fmt.Fprintf(state.stdout(), "Dropped packets: unavailable (%v)\n\n", err)
+		} else {
+			recent := "-"
+			if !firstDraw && dropped >= previousDropped {
+				recent = fmt.Sprintf("+%d", dropped-previousDropped)
+			}
+			fmt.Fprintf(state.stdout(), "Dropped packets (network jail): %d total, %s since last refresh\n\n", dropped, recent)
+			previousDropped = dropped
+		}
+		firstDraw = false
+
+		if len(entries) == 0 {
+			fmt.Fprintln(state.stdout(), "No active jails")
+			return
+		}
+
+		w := newTableWriter(state.stdout())
+		writeTableHeader(w, "PID", "Name", "Type", "CPU", "Throttled", "Memory", "Procs")
+		for _, entry := range entries {
+			jail := entry.jail
+			sample := usage[jail.PID]
+
+			throttled := "-"
+			if sample.HasCgroupStats {
+				throttled = (time.Duration(sample.ThrottledDelta) * time.Microsecond).Round(time.Millisecond).String()
+			}
+
+			writeTableRow(w, strconv.Itoa(jail.PID),
+				truncate(entry.processName, nameColumnWidth, wide),
+				truncate(jail.GetJailTypesString(), typeColumnWidth, wide),
+				fmt.Sprintf("%.1f%%", sample.CPUPercent), throttled,
+				formatBytes(sample.MemoryBytes), strconv.Itoa(len(jail.Children)+1))
+		}
+		w.Flush()
+	})
+}
+
+// isTopSortKey checks if top can sort by the given key
+func isTopSortKey(key string) bool {
+	for _, k := range topSortKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
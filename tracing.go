@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// traceExportInterval is the longest time a finished span waits before being exported
+	traceExportInterval = 5 * time.Second
+
+	// traceBatchSize exports the spans early when that many are waiting
+	traceBatchSize = 256
+
+	// traceMaxPending drops the oldest spans when the collector is unreachable for long
+	traceMaxPending = 4096
+)
+
+// TracingConfig exports the spans of the jail operations and of their firewall and cgroup
+// calls to an OpenTelemetry collector over OTLP/HTTP
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`     // Collector, e.g. http://127.0.0.1:4318, empty disables tracing
+	ServiceName string            `json:"service_name"` // service.name of the spans, jailer by default
+	Headers     map[string]string `json:"headers"`      // Added to the export requests, e.g. an API key
+}
+
+// validateTracingConfig checks the endpoint and completes the path of the traces
+func validateTracingConfig(config *TracingConfig) error {
+	if config.Endpoint == "" {
+		return nil
+	}
+	parsed, err := url.Parse(config.Endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid endpoint %q", config.Endpoint)
+	}
+	if !strings.HasSuffix(parsed.Path, "/v1/traces") {
+		parsed.Path = strings.TrimSuffix(parsed.Path, "/") + "/v1/traces"
+		config.Endpoint = parsed.String()
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = "jailer"
+	}
+	return nil
+}
+
+// otlpValue is an attribute value in the OTLP JSON encoding, integers are strings
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    string  `json:"intValue,omitempty"`
+}
+
+// otlpAttribute is a key and value of a span or of the resource
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// stringAttribute returns a string attribute
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+// intAttribute returns an integer attribute
+func intAttribute(key string, value int) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: strconv.Itoa(value)}}
+}
+
+// otlpStatus is the outcome of a span, code 2 is an error
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpSpan is a finished span in the OTLP JSON encoding, the IDs are hexadecimal
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"` // 1 is internal
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+// span is a running span, nil when tracing is disabled so that the callers don't check
+type span struct {
+	data  otlpSpan
+	start time.Time
+}
+
+// tracer collects the finished spans. The jail operations run one at a time, so the calls
+// made while one runs are its children, even from the goroutines of its descendants
+var tracer struct {
+	mutex   sync.Mutex
+	config  *TracingConfig
+	current *span
+	pending []otlpSpan
+	wake    chan struct{}
+}
+
+// newSpanID returns a random ID of the given size in hexadecimal
+func newSpanID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// startSpan starts a span, the child of the running operation if any
+func startSpan(name string, attributes ...otlpAttribute) *span {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	if tracer.config == nil {
+		return nil
+	}
+
+	s := &span{start: time.Now()}
+	s.data = otlpSpan{SpanID: newSpanID(8), Name: name, Kind: 1, Attributes: attributes}
+	if tracer.current != nil {
+		s.data.TraceID, s.data.ParentSpanID = tracer.current.data.TraceID, tracer.current.data.SpanID
+	} else {
+		s.data.TraceID = newSpanID(16)
+	}
+	return s
+}
+
+// startOperation starts the span of a jail operation, the root of its trace unless it runs
+// inside another operation
+func startOperation(name string, attributes ...otlpAttribute) *span {
+	s := startSpan(name, attributes...)
+	if s != nil {
+		tracer.mutex.Lock()
+		if tracer.current == nil {
+			tracer.current = s
+		}
+		tracer.mutex.Unlock()
+	}
+	return s
+}
+
+// end finishes a span, with an error status when err is not nil
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.data.Start = strconv.FormatInt(s.start.UnixNano(), 10)
+	s.data.End = strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err != nil {
+		s.data.Status = otlpStatus{Code: 2, Message: err.Error()}
+	}
+
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	if tracer.current == s {
+		tracer.current = nil
+	}
+	tracer.pending = append(tracer.pending, s.data)
+	if len(tracer.pending) > traceMaxPending {
+		tracer.pending = tracer.pending[len(tracer.pending)-traceMaxPending:]
+	}
+	if len(tracer.pending) >= traceBatchSize {
+		select {
+		case tracer.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// initTracing enables the spans and starts exporting them
+func initTracing(config *TracingConfig) {
+	if config.Endpoint == "" {
+		return
+	}
+	tracer.mutex.Lock()
+	tracer.config = config
+	tracer.wake = make(chan struct{}, 1)
+	tracer.mutex.Unlock()
+	fmt.Printf("Exporting traces to %s\n", config.Endpoint)
+
+	go func() {
+		ticker := time.NewTicker(traceExportInterval)
+		for {
+			select {
+			case <-ticker.C:
+			case <-tracer.wake:
+			}
+			flushTraces()
+		}
+	}()
+}
+
+// flushTraces exports the finished spans, they are kept for the next export when the
+// collector fails
+func flushTraces() {
+	tracer.mutex.Lock()
+	config, spans := tracer.config, tracer.pending
+	tracer.pending = nil
+	tracer.mutex.Unlock()
+	if config == nil || len(spans) == 0 {
+		return
+	}
+
+	if err := exportSpans(config, spans); err != nil {
+		fmt.Printf("Warning: failed to export %d spans: %v\n", len(spans), err)
+		tracer.mutex.Lock()
+		tracer.pending = append(spans, tracer.pending...)
+		if len(tracer.pending) > traceMaxPending {
+			tracer.pending = tracer.pending[len(tracer.pending)-traceMaxPending:]
+		}
+		tracer.mutex.Unlock()
+	}
+}
+
+// exportSpans sends spans to the collector in the OTLP/HTTP JSON encoding
+func exportSpans(config *TracingConfig, spans []otlpSpan) error {
+	host, _ := os.Hostname()
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{stringAttribute("service.name", config.ServiceName), stringAttribute("host.name", host)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "jailer"},
+				"spans": spans,
+			}},
+		}},
+	}
+	content, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	httpRequest, err := http.NewRequest(http.MethodPost, config.Endpoint, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	for key, value := range config.Headers {
+		httpRequest.Header.Set(key, value)
+	}
+	response, err := (&http.Client{Timeout: 10 * time.Second}).Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %s", response.Status)
+	}
+	return nil
+}
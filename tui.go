@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chzyer/readline"
+)
+
+const (
+	// dashboardInterval is the time between two redraws of the dashboard
+	dashboardInterval = 2 * time.Second
+
+	// dashboardSamples is the number of samples kept for the graphs of a jail
+	dashboardSamples = 60
+
+	// dashboardEvents and dashboardOutput are the lines of the event and output panes
+	dashboardEvents = 6
+	dashboardOutput = 4
+)
+
+// sparkBlocks are the bars of the graphs, from the lowest to the highest
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws values as bars scaled to the highest one, or to limit when it is higher
+func sparkline(values []float64, limit float64) string {
+	for _, value := range values {
+		limit = max(limit, value)
+	}
+	var line strings.Builder
+	for _, value := range values {
+		index := 0
+		if limit > 0 {
+			index = min(int(value/limit*float64(len(sparkBlocks)-1)+0.5), len(sparkBlocks)-1)
+		}
+		line.WriteRune(sparkBlocks[index])
+	}
+	return line.String()
+}
+
+// dashboard is the state of jailer tui: the jails with their samples, the events and the
+// output of the commands
+type dashboard struct {
+	state    *JailerState
+	entries  []listEntry
+	usage    map[int]jailUsage
+	samples  map[int][]jailUsage // Last samples of each jail, oldest first, for the graphs
+	selected int                 // Index of the highlighted jail
+	events   []jailEvent
+	editing  bool   // Whether the command line is open
+	input    string // Command being typed
+
+	outputMutex sync.Mutex
+	output      []string // Last lines printed by the commands and the background monitors
+}
+
+// newDashboard returns a dashboard showing the recent events of the jails
+func newDashboard(state *JailerState, events []jailEvent) *dashboard {
+	return &dashboard{
+		state:   state,
+		usage:   make(map[int]jailUsage),
+		samples: make(map[int][]jailUsage),
+		events:  events,
+	}
+}
+
+// refresh samples the jails again and keeps the samples of the graphs
+func (d *dashboard) refresh() {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	cleanupDeadProcesses(d.state)
+	d.entries = selectJails(d.state, listFilter{})
+	d.usage = sampleJails(d.state, d.entries, d.usage)
+	samples := make(map[int][]jailUsage)
+	for pid, usage := range d.usage {
+		samples[pid] = append(d.samples[pid], usage)
+		if len(samples[pid]) > dashboardSamples {
+			samples[pid] = samples[pid][len(samples[pid])-dashboardSamples:]
+		}
+	}
+	d.samples = samples
+	d.selected = max(0, min(d.selected, len(d.entries)-1))
+}
+
+// addEvent adds a jail event to the event pane
+func (d *dashboard) addEvent(event jailEvent) {
+	d.events = append(d.events, event)
+	if len(d.events) > dashboardEvents {
+		d.events = d.events[len(d.events)-dashboardEvents:]
+	}
+}
+
+// addOutput adds the lines printed by a command or a monitor to the output pane
+func (d *dashboard) addOutput(text string) {
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		d.output = append(d.output, strings.TrimRight(line, "\r"))
+	}
+	if len(d.output) > dashboardOutput {
+		d.output = d.output[len(d.output)-dashboardOutput:]
+	}
+}
+
+// execute runs a command line like the prompt would
+func (d *dashboard) execute(input string) {
+	d.addOutput("$> " + input)
+	if err := executeLocked(d.state, input); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+// selectedJail returns the highlighted jail, nil without jails
+func (d *dashboard) selectedJail() *Jail {
+	if d.selected >= len(d.entries) {
+		return nil
+	}
+	return d.entries[d.selected].jail
+}
+
+// adjustCpu changes the CPU limit of the highlighted CPU jail by delta points
+func (d *dashboard) adjustCpu(delta int) {
+	jail := d.selectedJail()
+	if jail == nil || !jail.HasJailType("cpu") {
+		d.addOutput("Error: the highlighted process has no CPU jail")
+		return
+	}
+	percent := max(1, jail.CpuPercent)
+	adjusted := max(1, min(100, percent+delta))
+	if adjusted == percent {
+		return
+	}
+	d.execute(fmt.Sprintf("unjail cpu %d; jail cpu %d %d%%", jail.PID, jail.PID, adjusted))
+}
+
+// handleKey runs the action of a key, quit is set once the dashboard must close
+func (d *dashboard) handleKey(key pickKey, r rune) (quit bool) {
+	if d.editing {
+		switch key {
+		case pickKeyRune:
+			d.input += string(r)
+		case pickKeyBackspace:
+			if d.input != "" {
+				runes := []rune(d.input)
+				d.input = string(runes[:len(runes)-1])
+			}
+		case pickKeyClear:
+			d.input = ""
+		case pickKeyEnter:
+			d.editing = false
+			if input := strings.TrimSpace(d.input); input != "" {
+				d.execute(input)
+				d.refresh()
+			}
+		case pickKeyCancel:
+			d.editing = false
+		}
+		return false
+	}
+
+	switch key {
+	case pickKeyUp:
+		d.selected = max(0, d.selected-1)
+	case pickKeyDown:
+		d.selected = max(0, min(d.selected+1, len(d.entries)-1))
+	case pickKeyRefresh:
+		d.refresh()
+	case pickKeyCancel:
+		return r != 27 // Esc alone doesn't quit
+	case pickKeyRune:
+		jail := d.selectedJail()
+		switch r {
+		case 'q':
+			return true
+		case 'k':
+			d.selected = max(0, d.selected-1)
+		case 'j':
+			d.selected = max(0, min(d.selected+1, len(d.entries)-1))
+		case ':':
+			d.editing, d.input = true, ""
+		case 'J':
+			d.editing, d.input = true, "jail "
+		case 'u':
+			if jail != nil {
+				d.execute("unjail " + strconv.Itoa(jail.PID))
+				d.refresh()
+			}
+		case '+':
+			d.adjustCpu(5)
+			d.refresh()
+		case '-':
+			d.adjustCpu(-5)
+			d.refresh()
+		case 'e':
+			if jail != nil {
+				d.execute("extend " + strconv.Itoa(jail.PID) + " 1h")
+			}
+		}
+	}
+	return false
+}
+
+// render draws the panes of the dashboard for a terminal of the given size, lines end
+// with \r\n since the terminal is in raw mode
+func (d *dashboard) render(w io.Writer, width, height int) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	var lines []string
+	fit := func(line string) string {
+		if runes := []rune(line); width > 0 && len(runes) > width {
+			return string(runes[:width])
+		}
+		return line
+	}
+	add := func(format string, args ...any) {
+		lines = append(lines, fit(fmt.Sprintf(format, args...)))
+	}
+
+	add("jailer tui - %d jails - %s", len(d.state.ActiveJails), time.Now().Format("15:04:05"))
+	add("")
+	jailRows := max(3, height-dashboardEvents-dashboardOutput-12)
+	add("%-8s %-16s %-16s %7s %9s %10s %9s", "PID", "Name", "Type", "CPU", "Memory", "Throttled", "Expires")
+	first := max(0, d.selected-jailRows+1)
+	for i := first; i < len(d.entries) && i < first+jailRows; i++ {
+		jail := d.entries[i].jail
+		usage := d.usage[jail.PID]
+		throttled := "-"
+		if usage.HasCgroupStats && jail.HasJailType("cpu") {
+			throttled = usage.Throttling.String()
+		}
+		line := fmt.Sprintf("%-8d %-16s %-16s %6.1f%% %9s %10s %9s", jail.PID, truncate(d.entries[i].processName, nameColumnWidth, false),
+			truncate(jail.GetJailTypesString(), 16, false), usage.CPUPercent, formatBytes(usage.RSSBytes), throttled,
+			formatExpiry(jail, time.Now()))
+		line = fit(line)
+		if i == d.selected {
+			line = "\033[7m" + line + "\033[0m"
+		}
+		lines = append(lines, line)
+	}
+	shown := min(len(d.entries)-first, jailRows)
+	if len(d.entries) == 0 {
+		add("No active jails, : opens the command line, e.g. jail cpu 1234")
+		shown = 1
+	}
+	for i := shown; i < jailRows; i++ {
+		add("")
+	}
+
+	add("")
+	if jail := d.selectedJail(); jail != nil {
+		var cpu, memory []float64
+		for _, sample := range d.samples[jail.PID] {
+			cpu = append(cpu, sample.CPUPercent)
+			memory = append(memory, float64(sample.RSSBytes))
+		}
+		usage := d.usage[jail.PID]
+		add("Process %d (%s), last %s:", jail.PID, jail.Name, time.Duration(len(cpu))*dashboardInterval)
+		add("  CPU    %-*s %6.1f%%", dashboardSamples, sparkline(cpu, 100), usage.CPUPercent)
+		add("  Memory %-*s %7s", dashboardSamples, sparkline(memory, 0), formatBytes(usage.RSSBytes))
+	} else {
+		add("")
+		add("")
+		add("")
+	}
+
+	add("")
+	add("Events:")
+	for i := 0; i < dashboardEvents; i++ {
+		if i >= len(d.events) {
+			add("")
+			continue
+		}
+		event := d.events[i]
+		detail := event.Detail
+		if detail == "" && event.Event == "created" {
+			detail = event.Reason
+		}
+		add("  %-8s  %-15s  %7d  %-15s  %-15s  %s", event.Time.Local().Format("15:04:05"),
+			event.Event, event.PID, truncate(event.Name, 15, false), truncate(strings.Join(event.JailTypes, ","), 15, false), detail)
+	}
+
+	add("")
+	d.outputMutex.Lock()
+	for i := 0; i < dashboardOutput; i++ {
+		if i < len(d.output) {
+			add("%s", d.output[i])
+		} else {
+			add("")
+		}
+	}
+	d.outputMutex.Unlock()
+
+	if d.editing {
+		add("$> %s_", d.input)
+	} else {
+		add("Up/Down move  : command  J jail  u unjail  +/- CPU limit  e extend 1h  Ctrl+R refresh  q quit")
+	}
+
+	fmt.Fprint(w, "\033[H\033[2J")
+	for i, line := range lines {
+		if i > 0 {
+			fmt.Fprint(w, "\r\n")
+		}
+		fmt.Fprint(w, line)
+	}
+}
+
+// runDashboard runs jailer tui until q or Ctrl+C. The output of the commands and of the
+// background monitors goes to the output pane instead of the terminal
+func runDashboard(state *JailerState) error {
+	fd := int(os.Stdin.Fd())
+	if !readline.IsTerminal(fd) {
+		return fmt.Errorf("jailer tui needs a terminal")
+	}
+	width, height, err := readline.GetSize(fd)
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	events, recent := jailEvents.subscribe()
+	defer jailEvents.unsubscribe(events)
+	d := newDashboard(state, nil)
+	for _, event := range recent {
+		d.addEvent(event)
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to capture output: %v", err)
+	}
+	terminal := os.Stdout
+	os.Stdout = writer
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			d.addOutput(scanner.Text())
+		}
+	}()
+	defer func() {
+		os.Stdout = terminal
+		writer.Close()
+	}()
+
+	saved, err := readline.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to set the terminal in raw mode: %v", err)
+	}
+	defer func() {
+		readline.Restore(fd, saved)
+		fmt.Fprint(terminal, "\033[H\033[2J")
+	}()
+
+	type keyPress struct {
+		key pickKey
+		r   rune
+	}
+	keys := make(chan keyPress)
+	go func() {
+		input := bufio.NewReader(os.Stdin)
+		for {
+			key, r, err := readPickKey(input)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- keyPress{key, r}
+		}
+	}()
+
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+	d.refresh()
+	for {
+		d.render(terminal, width, height)
+		select {
+		case press, open := <-keys:
+			if !open || d.handleKey(press.key, press.r) {
+				return nil
+			}
+		case event := <-events:
+			d.addEvent(event)
+		case <-ticker.C:
+			if width, height, err = readline.GetSize(fd); err != nil || width <= 0 || height <= 0 {
+				width, height = 80, 24
+			}
+			d.refresh()
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxOperations is the number of jail and unjail commands that can be undone
+const maxOperations = 100
+
+// operation is a jail or unjail command that can be undone
+type operation struct {
+	Description string        // The command as typed
+	PIDs        []int         // Processes targeted by the command
+	Before      map[int]*Jail // Jail of each target before the command, nil if it wasn't jailed
+}
+
+// snapshot returns a copy of the jail that later changes to the jail don't affect
+func (j *Jail) snapshot() *Jail {
+	copied := *j
+	copied.JailTypes = append([]string(nil), j.JailTypes...)
+	copied.Children = append([]int(nil), j.Children...)
+	copied.LaunchProfiles = make(map[string]string)
+	for jailType, profileName := range j.LaunchProfiles {
+		copied.LaunchProfiles[jailType] = profileName
+	}
+	copied.OriginalCgroups = make(map[int]string)
+	for pid, originalCgroup := range j.OriginalCgroups {
+		copied.OriginalCgroups[pid] = originalCgroup
+	}
+	copied.Rlimits = make(map[string]uint64)
+	for name, limit := range j.Rlimits {
+		copied.Rlimits[name] = limit
+	}
+	copied.RdmaLimits = make(map[string]uint64)
+	for key, limit := range j.RdmaLimits {
+		copied.RdmaLimits[key] = limit
+	}
+	copied.QuotaDirs = append([]string(nil), j.QuotaDirs...)
+	copied.MiscLimits = make(map[string]uint64)
+	for name, limit := range j.MiscLimits {
+		copied.MiscLimits[name] = limit
+	}
+	copied.FailedDescendants = make(map[int]string)
+	for pid, failure := range j.FailedDescendants {
+		copied.FailedDescendants[pid] = failure
+	}
+	return &copied
+}
+
+// jailOptions returns the options that apply the jail types of a jail again with the same
+// settings, the expiry is left to the caller
+func (j *Jail) jailOptions() JailOptions {
+	options := JailOptions{Reason: j.Reason, AllowEstablished: len(j.SessionRules) > 0, AllowIfaces: j.AllowedIfaces,
+		BlockCountries: j.BlockedCountries, AllowCountries: j.AllowedCountries, Persistent: j.Persistent,
+		CpuBurst: j.CpuBurst, OomGroup: j.OomGroup}
+	if j.Adaptive != nil {
+		options.AdaptiveTarget = j.Adaptive.TargetPercent
+	}
+	return options
+}
+
+// jailTypeArgs returns the arguments that apply a jail type with the limits of a jail
+func jailTypeArgs(jail *Jail, jailType string) []string {
+	switch {
+	case jailType == "cpu" && jail.CpuWeight > 0:
+		return []string{fmt.Sprintf("weight=%d", jail.CpuWeight)}
+	case jailType == "cpu" && jail.CpuPercent > 0:
+		return []string{fmt.Sprintf("%d%%", jail.CpuPercent)}
+	case jailType == "rlimit":
+		return strings.Fields(formatRlimits(jail.Rlimits))
+	case jailType == "rdma":
+		return strings.Fields(formatLimits(jail.RdmaLimits))
+	case jailType == "misc":
+		return strings.Fields(formatLimits(jail.MiscLimits))
+	case jailType == "memory":
+		return []string{strconv.FormatUint(jail.MemoryLimit, 10)}
+	case jailType == "quota":
+		return append([]string{strconv.FormatUint(jail.QuotaBytes, 10)}, jail.QuotaDirs...)
+	}
+	return nil
+}
+
+// sameJailTypeLimits checks if two jails apply a jail type with the same limits
+func sameJailTypeLimits(a, b *Jail, jailType string) bool {
+	return strings.Join(jailTypeArgs(a, jailType), " ") == strings.Join(jailTypeArgs(b, jailType), " ")
+}
+
+// jailChanged checks if a command changed the jail of a process
+func jailChanged(state *JailerState, pid int, before *Jail) bool {
+	jail, jailed := state.ActiveJails[pid]
+	if !jailed || before == nil {
+		return jailed != (before != nil)
+	}
+	if jail.GetJailTypesString() != before.GetJailTypesString() || jail.Reason != before.Reason {
+		return true
+	}
+	for _, jailType := range jail.JailTypes {
+		if !sameJailTypeLimits(jail, before, jailType) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotJails saves the jails of processes before a command changes them
+func snapshotJails(state *JailerState, pids []int) map[int]*Jail {
+	before := make(map[int]*Jail)
+	for _, pid := range pids {
+		if jail, exists := state.ActiveJails[pid]; exists {
+			before[pid] = jail.snapshot()
+		} else {
+			before[pid] = nil
+		}
+	}
+	return before
+}
+
+// recordOperation adds a command to the operation log if it changed any jail, the oldest
+// entries are dropped
+func recordOperation(state *JailerState, description string, pids []int, before map[int]*Jail) {
+	changed := false
+	for _, pid := range pids {
+		if jailChanged(state, pid, before[pid]) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+
+	state.Operations = append(state.Operations, operation{Description: description, PIDs: pids, Before: before})
+	if len(state.Operations) > maxOperations {
+		state.Operations = state.Operations[len(state.Operations)-maxOperations:]
+	}
+}
+
+// undoLastOperation reverts the most recent jail or unjail command
+func undoLastOperation(state *JailerState) error {
+	if len(state.Operations) == 0 {
+		return fmt.Errorf("nothing to undo")
+	}
+
+	op := state.Operations[len(state.Operations)-1]
+	state.Operations = state.Operations[:len(state.Operations)-1]
+
+	fmt.Fprintf(state.stdout(), "Undoing: %s\n", op.Description)
+
+	event := AuditEvent{Action: "undo", Reason: op.Description}
+	failed := 0
+	for _, pid := range op.PIDs {
+		name := hostProcesses.name(pid)
+		err := restoreJailState(state, pid, op.Before[pid])
+		if err != nil {
+			fmt.Fprintf(state.stdout(), "Warning: failed to restore the jail of process %d: %v\n", pid, err)
+			failed++
+		}
+		event.Targets = append(event.Targets, newAuditTarget(pid, name, err))
+	}
+	writeAuditEvent(state, event)
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d processes could not be restored", failed, len(op.PIDs))
+	}
+	return nil
+}
+
+// restoreJailState brings the jail of a process back to a previous state, a nil state
+// means the process wasn't jailed
+func restoreJailState(state *JailerState, pid int, before *Jail) error {
+	pidStr := strconv.Itoa(pid)
+	jail, jailed := state.ActiveJails[pid]
+
+	if before == nil {
+		if !jailed {
+			return nil
+		}
+		return unjailProcess(state, pidStr)
+	}
+
+	if !hostProcesses.exists(pid) {
+		return fmt.Errorf("process %d no longer exists", pid)
+	}
+
+	// Remove the jail types added or changed since, launch-only types can't be removed
+	if jailed {
+		for _, jailType := range append([]string(nil), jail.JailTypes...) {
+			if isLaunchOnlyJailType(jailType) {
+				continue
+			}
+			if !before.HasJailType(jailType) || !sameJailTypeLimits(jail, before, jailType) {
+				if err := unjailProcessSelective(state, jailType, pidStr); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Apply the jail types removed since
+	options := before.jailOptions()
+	for _, jailType := range before.JailTypes {
+		if isLaunchOnlyJailType(jailType) {
+			continue
+		}
+		if current, exists := state.ActiveJails[pid]; exists && current.HasJailType(jailType) {
+			continue
+		}
+		if err := jailProcess(state, jailType, pidStr, jailTypeArgs(before, jailType), options); err != nil {
+			return fmt.Errorf("failed to apply %s jail: %v", jailType, err)
+		}
+	}
+
+	// Bring back what the jail entry knew about the process
+	jail, jailed = state.ActiveJails[pid]
+	if !jailed {
+		return nil
+	}
+	for jailType, profileName := range before.LaunchProfiles {
+		jail.AddJailType(jailType)
+		jail.LaunchProfiles[jailType] = profileName
+	}
+	jail.Reason = before.Reason
+	jail.JailedBy = before.JailedBy
+	jail.Command = before.Command
+	jail.Timestamp = before.Timestamp
+	jail.ExpiresAt = before.ExpiresAt
+	jail.Persistent = before.Persistent
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// clockTicksPerSecond is USER_HZ, the unit of the CPU times in /proc/<pid>/stat
+	clockTicksPerSecond = 100
+
+	// pageSize is the unit of the memory sizes in /proc/<pid>/statm
+	pageSize = 4096
+)
+
+// jailUsage is a resource usage sample of a jailed process tree
+type jailUsage struct {
+	CPUTicks   uint64    // utime + stime of the tree
+	RSSBytes   uint64    // Resident memory of the tree
+	SampledAt  time.Time // When the sample was taken
+	CPUPercent float64   // CPU usage since the previous sample, in percent of one core
+
+	// Readings of the jail cgroup, shared by all the jails in the same cgroup
+	HasCgroupStats bool
+	MemoryBytes    uint64        // memory.current of the cgroup, or the resident memory without cgroup
+	ThrottledUsec  uint64        // Total time the cgroup was throttled by its CPU limit
+	ThrottledDelta uint64        // Throttled time since the previous sample
+	Throttling     cpuThrottling // cpu.stat of the cgroup
+	MemoryEvents   memoryEvents  // memory.events of the cgroup
+}
+
+// getProcessCPUTicks returns the CPU time (user + system) consumed by a process in clock ticks
+func getProcessCPUTicks(pid int) (uint64, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// The process name may contain spaces, fields are counted after its closing parenthesis
+	stat := string(content)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected stat format for PID %d", pid)
+	}
+
+	// utime and stime are fields 14 and 15 of the stat file
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return utime + stime, nil
+}
+
+// getProcessRSS returns the resident memory of a process in bytes
+func getProcessRSS(pid int) (uint64, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected statm format for PID %d", pid)
+	}
+
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return pages * pageSize, nil
+}
+
+// getProcessControllerCgroup returns the directory of the cgroup of a process for a
+// controller, the controller is ignored with cgroups v2
+func getProcessControllerCgroup(state *JailerState, pid int, controller string) (string, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", fmt.Errorf("failed to read cgroup file for PID %d: %v", pid, err)
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 3 {
+			continue
+		}
+
+		if state.CgroupVersion == 2 {
+			if parts[0] == "0" {
+				return filepath.Join("/sys/fs/cgroup", parts[2]), nil
+			}
+			continue
+		}
+
+		for _, name := range strings.Split(parts[1], ",") {
+			if name == controller {
+				return filepath.Join("/sys/fs/cgroup", controller, parts[2]), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no %s cgroup found for PID %d", controller, pid)
+}
+
+// readCgroupValue reads a single numeric value from a cgroup file
+func readCgroupValue(path string) (uint64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// readCgroupStats reads the numeric keys of a flat keyed cgroup file such as cpu.stat
+func readCgroupStats(path string) (map[string]uint64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]uint64)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			stats[fields[0]] = value
+		}
+	}
+	return stats, nil
+}
+
+// readCgroupStat reads a key of a flat keyed cgroup file such as cpu.stat
+func readCgroupStat(path, key string) (uint64, error) {
+	stats, err := readCgroupStats(path)
+	if err != nil {
+		return 0, err
+	}
+	value, found := stats[key]
+	if !found {
+		return 0, fmt.Errorf("%s not found in %s", key, path)
+	}
+	return value, nil
+}
+
+// cpuThrottling is the throttling of a CPU cgroup by its quota, from cpu.stat
+type cpuThrottling struct {
+	Periods       uint64 // Enforcement periods in which the cgroup had runnable tasks
+	Throttled     uint64 // Periods in which the cgroup used up its quota
+	ThrottledUsec uint64 // Total time the cgroup was throttled
+}
+
+// percent returns the share of the periods in which the cgroup was throttled
+func (t cpuThrottling) percent() float64 {
+	if t.Periods == 0 {
+		return 0
+	}
+	return float64(t.Throttled) / float64(t.Periods) * 100
+}
+
+// String returns the throttled share of the periods and the throttled time, e.g. 82% (3.2s)
+func (t cpuThrottling) String() string {
+	return fmt.Sprintf("%.0f%% (%s)", t.percent(), (time.Duration(t.ThrottledUsec) * time.Microsecond).Round(time.Millisecond))
+}
+
+// getCgroupThrottling returns the throttling of the CPU cgroup of a process
+func getCgroupThrottling(state *JailerState, pid int) (cpuThrottling, error) {
+	var throttling cpuThrottling
+	cgroupDir, err := getProcessControllerCgroup(state, pid, "cpu")
+	if err != nil {
+		return throttling, err
+	}
+	path := filepath.Join(cgroupDir, "cpu.stat")
+	stats, err := readCgroupStats(path)
+	if err != nil {
+		return throttling, err
+	}
+
+	throttling.Periods, throttling.Throttled = stats["nr_periods"], stats["nr_throttled"]
+	if usec, found := stats["throttled_usec"]; found {
+		throttling.ThrottledUsec = usec
+	} else if nsec, found := stats["throttled_time"]; found {
+		// cgroups v1 reports the throttled time in nanoseconds
+		throttling.ThrottledUsec = nsec / 1000
+	} else {
+		return throttling, fmt.Errorf("no throttled time in %s", path)
+	}
+	return throttling, nil
+}
+
+// getCgroupMemory returns the memory used by the memory cgroup of a process
+func getCgroupMemory(state *JailerState, pid int) (uint64, error) {
+	cgroupDir, err := getProcessControllerCgroup(state, pid, "memory")
+	if err != nil {
+		return 0, err
+	}
+
+	if state.CgroupVersion == 2 {
+		return readCgroupValue(filepath.Join(cgroupDir, "memory.current"))
+	}
+	return readCgroupValue(filepath.Join(cgroupDir, "memory.usage_in_bytes"))
+}
+
+// sampleJailUsage measures the resource usage of a jailed process and its descendants,
+// the CPU percentage is computed against the previous sample when there is one
+func sampleJailUsage(state *JailerState, jail *Jail, previous *jailUsage) jailUsage {
+	usage := jailUsage{SampledAt: time.Now()}
+
+	for _, pid := range append([]int{jail.PID}, jail.Children...) {
+		if ticks, err := getProcessCPUTicks(pid); err == nil {
+			usage.CPUTicks += ticks
+		}
+		if rss, err := getProcessRSS(pid); err == nil {
+			usage.RSSBytes += rss
+		}
+	}
+
+	if previous != nil && usage.CPUTicks >= previous.CPUTicks {
+		elapsed := usage.SampledAt.Sub(previous.SampledAt).Seconds()
+		if elapsed > 0 {
+			usage.CPUPercent = float64(usage.CPUTicks-previous.CPUTicks) / clockTicksPerSecond / elapsed * 100
+		}
+	}
+
+	// Processes jailed without cgroup live in cgroups jailer doesn't own, such as the
+	// user session, whose readings would be meaningless for the jail
+	usage.MemoryBytes = usage.RSSBytes
+	if jail.HasCgroupJailTypes() {
+		throttling, throttledErr := getCgroupThrottling(state, jail.PID)
+		memory, memoryErr := getCgroupMemory(state, jail.PID)
+		if throttledErr == nil && memoryErr == nil {
+			throttled := throttling.ThrottledUsec
+			usage.HasCgroupStats = true
+			usage.Throttling = throttling
+			usage.ThrottledUsec = throttled
+			usage.MemoryBytes = memory
+			usage.MemoryEvents, _ = getCgroupMemoryEvents(state, jail.PID)
+			if previous != nil && previous.HasCgroupStats && throttled >= previous.ThrottledUsec {
+				usage.ThrottledDelta = throttled - previous.ThrottledUsec
+			}
+		}
+	}
+
+	return usage
+}
+
+// formatBytes returns a human-readable size such as 12.5M
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	value := float64(bytes)
+	suffixes := "KMGTP"
+	i := -1
+	for value >= unit && i < len(suffixes)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", value, suffixes[i])
+}
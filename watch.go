@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// defaultWatchInterval is the refresh interval of watch when none is given
+const defaultWatchInterval = 2 * time.Second
+
+// parseWatchInterval parses the refresh interval of watch, plain numbers are seconds
+func parseWatchInterval(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		value = fmt.Sprintf("%ds", seconds)
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 100*time.Millisecond {
+		return 0, fmt.Errorf("invalid interval: %s", value)
+	}
+	return interval, nil
+}
+
+// refreshScreen clears the screen and calls redraw every interval until Ctrl+C
+func refreshScreen(state *JailerState, interval time.Duration, redraw func()) {
+	interrupted, done := startInterruptible()
+	defer done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		fmt.Fprint(state.stdout(), "\033[H\033[2J")
+		redraw()
+
+		stopped := false
+		waitUnlocked(state, func() {
+			select {
+			case <-ticker.C:
+			case <-interrupted:
+				stopped = true
+			}
+		})
+		if stopped {
+			fmt.Fprintln(state.stdout())
+			return
+		}
+	}
+}
+
+// sampleJails samples the resource usage of the given jails, CPU usage is computed
+// against the previous samples
+func sampleJails(state *JailerState, entries []listEntry, previous map[int]jailUsage) map[int]jailUsage {
+	usage := make(map[int]jailUsage)
+	for _, entry := range entries {
+		var last *jailUsage
+		if sample, exists := previous[entry.jail.PID]; exists {
+			last = &sample
+		}
+		usage[entry.jail.PID] = sampleJailUsage(state, entry.jail, last)
+	}
+	return usage
+}
+
+// watchJails redraws the jails table with live CPU and memory readings until Ctrl+C
+func watchJails(state *JailerState, interval time.Duration, filter listFilter) {
+	previous := make(map[int]jailUsage)
+
+	refreshScreen(state, interval, func() {
+		cleanupDeadProcesses(state)
+		entries := selectJails(state, filter)
+		usage := sampleJails(state, entries, previous)
+		previous = usage
+
+		fmt.Fprintf(state.stdout(), "Every %s: jails (%d shown, %d active) - Ctrl+C to stop    %s\n\n",
+			interval, len(entries), len(state.ActiveJails), time.Now().Format("15:04:05"))
+		if len(entries) == 0 {
+			fmt.Fprintln(state.stdout(), "No active jails")
+		} else {
+			printJailTable(state, entries, usage, filter.Wide)
+		}
+	})
+}
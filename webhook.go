@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookMaxAlertSize bounds the body of an alert
+const webhookMaxAlertSize = 1 << 20
+
+// WebhookConfig configures the endpoint receiving the alerts of Falco or another alerting
+// system
+type WebhookConfig struct {
+	Token    string           `json:"token"`    // Bearer token required from the senders
+	TLSCert  string           `json:"tls_cert"` // Serves HTTPS when set with tls_key
+	TLSKey   string           `json:"tls_key"`
+	Profiles []WebhookProfile `json:"profiles"` // Jails applied to the alerts, the first match wins
+}
+
+// WebhookProfile jails the process or container of the alerts matching it
+type WebhookProfile struct {
+	Name        string   `json:"name"`
+	Rule        string   `json:"rule"`         // Pattern of the alert rule, * matches anything
+	MinPriority string   `json:"min_priority"` // Lowest Falco priority applied, all by default
+	Jail        string   `json:"jail"`
+	Args        []string `json:"args"`
+	Reason      string   `json:"reason"` // Recorded with the jail, the alert rule by default
+
+	rule *regexp.Regexp
+}
+
+// webhookAlert is the part of an alert jailer uses. Falco sends the target in its output
+// fields, other systems may give pid or container_id directly
+type webhookAlert struct {
+	Rule         string                 `json:"rule"`
+	Priority     string                 `json:"priority"`
+	Output       string                 `json:"output"`
+	OutputFields map[string]interface{} `json:"output_fields"`
+	PID          int                    `json:"pid"`
+	ContainerID  string                 `json:"container_id"`
+}
+
+// webhookResponse tells the sender what was done with an alert
+type webhookResponse struct {
+	Profile string `json:"profile,omitempty"`
+	Jailed  []int  `json:"jailed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// falcoPriorities are the priorities of Falco from the lowest to the highest
+var falcoPriorities = []string{"debug", "informational", "notice", "warning", "error", "critical", "alert", "emergency"}
+
+// falcoPriorityLevel returns the rank of a priority, -1 when it is unknown
+func falcoPriorityLevel(priority string) int {
+	priority = strings.ToLower(priority)
+	if priority == "info" {
+		priority = "informational"
+	}
+	for level, name := range falcoPriorities {
+		if name == priority {
+			return level
+		}
+	}
+	return -1
+}
+
+// validateWebhookConfig checks the profiles and compiles their rule patterns
+func validateWebhookConfig(config *WebhookConfig) error {
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	for i := range config.Profiles {
+		profile := &config.Profiles[i]
+		if profile.Name == "" {
+			return fmt.Errorf("profile %d has no name", i+1)
+		}
+		jailType, err := normalizeJailSpec(profile.Jail)
+		if err != nil {
+			return fmt.Errorf("profile %q: %v", profile.Name, err)
+		}
+		profile.Jail = jailType
+		if profile.MinPriority != "" && falcoPriorityLevel(profile.MinPriority) < 0 {
+			return fmt.Errorf("profile %q: unknown priority: %q", profile.Name, profile.MinPriority)
+		}
+		pattern := profile.Rule
+		if pattern == "" {
+			pattern = "*"
+		}
+		profile.rule = compileWildcard(pattern)
+	}
+	return nil
+}
+
+// matches reports whether an alert is handled by the profile
+func (profile *WebhookProfile) matches(alert *webhookAlert) bool {
+	if !profile.rule.MatchString(alert.Rule) {
+		return false
+	}
+	if profile.MinPriority != "" && falcoPriorityLevel(alert.Priority) < falcoPriorityLevel(profile.MinPriority) {
+		return false
+	}
+	return true
+}
+
+// target returns the PID or the container ID the alert is about
+func (alert *webhookAlert) target() (int, string) {
+	pid, containerID := alert.PID, alert.ContainerID
+	if pid == 0 {
+		switch value := alert.OutputFields["proc.pid"].(type) {
+		case float64:
+			pid = int(value)
+		case string:
+			pid, _ = strconv.Atoi(value)
+		}
+	}
+	if containerID == "" {
+		containerID, _ = alert.OutputFields["container.id"].(string)
+	}
+	// Falco reports the processes outside of containers in the host pseudo-container
+	if containerID == "host" {
+		containerID = ""
+	}
+	return pid, containerID
+}
+
+// containerProcesses returns the processes whose cgroup names the container, without
+// their descendants which the jail covers
+func containerProcesses(containerID string) []int {
+	if len(containerID) < 12 || strings.ContainsAny(containerID, "/\n") {
+		return nil
+	}
+	return cgroupProcesses(func(cgroup string) bool {
+		return strings.Contains(cgroup, containerID)
+	})
+}
+
+// runWebhookListener serves the alert endpoint until it fails
+func runWebhookListener(state *JailerState, addr string) error {
+	config := &state.Config.Webhook
+	if config.Token == "" {
+		return fmt.Errorf("webhook.token must be set in the configuration")
+	}
+	if len(config.Profiles) == 0 {
+		fmt.Println("Warning: no webhook profiles configured, alerts are only acknowledged")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/alert", func(w http.ResponseWriter, r *http.Request) {
+		serveWebhookAlert(state, w, r)
+	})
+	registerHealthHandlers(mux, state)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	scheme := "http"
+	if config.TLSCert != "" {
+		scheme = "https"
+	}
+	fmt.Printf("Waiting for alerts on %s://%s/alert with %d profiles\n", scheme, addr, len(config.Profiles))
+	var err error
+	if config.TLSCert != "" {
+		err = server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	return fmt.Errorf("webhook listener on %s failed: %v", addr, err)
+}
+
+// serveWebhookAlert jails the target of an alert with the first matching profile
+func serveWebhookAlert(state *JailerState, w http.ResponseWriter, r *http.Request) {
+	reply := func(status int, response webhookResponse) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}
+
+	if r.Method != http.MethodPost {
+		reply(http.StatusMethodNotAllowed, webhookResponse{Error: "alerts must be POSTed"})
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(state.Config.Webhook.Token)) != 1 {
+		fmt.Printf("Warning: rejected alert from %s: invalid token\n", r.RemoteAddr)
+		reply(http.StatusUnauthorized, webhookResponse{Error: "invalid token"})
+		return
+	}
+
+	var alert webhookAlert
+	body, err := io.ReadAll(io.LimitReader(r.Body, webhookMaxAlertSize))
+	if err == nil {
+		err = json.Unmarshal(body, &alert)
+	}
+	if err != nil {
+		reply(http.StatusBadRequest, webhookResponse{Error: fmt.Sprintf("invalid alert: %v", err)})
+		return
+	}
+
+	for i := range state.Config.Webhook.Profiles {
+		profile := &state.Config.Webhook.Profiles[i]
+		if !profile.matches(&alert) {
+			continue
+		}
+
+		pid, containerID := alert.target()
+		var pids []int
+		switch {
+		case containerID != "":
+			pids = containerProcesses(containerID)
+		case pid > 1 && pid != os.Getpid() && hostProcesses.exists(pid):
+			pids = []int{pid}
+		}
+		if len(pids) == 0 {
+			reply(http.StatusUnprocessableEntity, webhookResponse{Profile: profile.Name, Error: "no process found for the alert"})
+			return
+		}
+
+		reason := profile.Reason
+		if reason == "" {
+			reason = "alert: " + alert.Rule
+		}
+		operator := fmt.Sprintf("webhook profile %s from %s", profile.Name, r.RemoteAddr)
+		jailed, err := jailAutomatically(state, operator, profile.Jail, pids, profile.Args, reason)
+		fmt.Printf("Alert %q from %s: %s jail applied to %d processes by profile %s\n", alert.Rule, r.RemoteAddr, profile.Jail, len(jailed), profile.Name)
+		response := webhookResponse{Profile: profile.Name, Jailed: jailed}
+		if err != nil {
+			response.Error = err.Error()
+			reply(http.StatusInternalServerError, response)
+			return
+		}
+		reply(http.StatusOK, response)
+		return
+	}
+	reply(http.StatusOK, webhookResponse{})
+}